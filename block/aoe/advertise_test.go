@@ -0,0 +1,52 @@
+package aoe
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mdlayher/raw"
+)
+
+type recordingConn struct {
+	net.PacketConn
+	to []string
+}
+
+func (c *recordingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.to = append(c.to, addr.(*raw.Addr).HardwareAddr.String())
+	return len(b), nil
+}
+
+func TestAdvertiseTo(t *testing.T) {
+	a := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	b := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	for _, tt := range []struct {
+		opts ServerOptions
+		want []string
+	}{
+		{ServerOptions{}, []string{broadcastAddr.String()}},
+		{ServerOptions{AdvertiseTo: []net.HardwareAddr{a, b}}, []string{a.String(), b.String()}},
+		{ServerOptions{AdvertiseTo: []net.HardwareAddr{a}, AdvertiseBroadcast: true}, []string{a.String(), broadcastAddr.String()}},
+	} {
+		s := &Server{
+			advertiseTo: advertiseAddrs(&tt.opts),
+			initiators:  make(map[string]*InitiatorStats),
+		}
+		conn := &recordingConn{}
+		iface := &Interface{
+			Interface:  &net.Interface{Name: "test0", MTU: 1500, HardwareAddr: net.HardwareAddr{0, 0, 0, 0, 0, 9}},
+			PacketConn: conn,
+		}
+		if err := s.advertise(iface); err != nil {
+			t.Fatal(err)
+		}
+		if len(conn.to) != len(tt.want) {
+			t.Fatalf("%+v: advertised to %v, expected %v", tt.opts, conn.to, tt.want)
+		}
+		for i := range tt.want {
+			if conn.to[i] != tt.want[i] {
+				t.Fatalf("%+v: advertised to %v, expected %v", tt.opts, conn.to, tt.want)
+			}
+		}
+	}
+}
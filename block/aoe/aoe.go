@@ -1,29 +1,98 @@
 package aoe
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
-	"syscall"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/scsi"
+	"github.com/coreos/torus/internal/ratelog"
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/mdlayher/aoe"
+	"github.com/mdlayher/ethernet"
 	"github.com/mdlayher/raw"
+	"golang.org/x/net/context"
 )
 
 var (
 	clog          = capnslog.NewPackageLogger("github.com/coreos/torus", "aoe")
+	rlog          = ratelog.New(clog, ratelog.DefaultInterval)
 	broadcastAddr = net.HardwareAddr([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
 )
 
 type Server struct {
 	dfs *block.BlockVolume
+	// file is the open volume behind dev.
+	file *block.BlockFile
 
 	dev Device
+	// ataDev is dev as ATA commands see it, which may not sync on flush.
+	ataDev Device
+	// timeouts is dev if it bounds the time spent in each operation.
+	timeouts *timeoutDevice
+	// fence enforces the volume's SCSI persistent reservations, which AoE
+	// initiators can't register for.
+	fence *scsi.Fence
+
+	major       uint16
+	minor       uint8
+	export      *block.AoEExport
+	etherType   ethernet.EtherType
+	sendRetries int
+
+	advertiseInterval time.Duration
+	advertiseTo       []net.HardwareAddr
+	syncInterval      time.Duration
+	maxSectors        int
+	failFast          bool
+	stop              chan struct{}
+	stopOnce          sync.Once
+
+	maxInitiators int
+	queue         *fairQueue
+	workers       *workerPool
+	badFrames     *badFrames
+
+	// allow lists the initiators this server accepts, if it is limited.
+	allow            []net.HardwareAddr
+	refuseDisallowed bool
+
+	mut      sync.Mutex
+	status   ServerStatus
+	ifaces   []*Interface
+	shutdown bool
+	macMask  []net.HardwareAddr
+	// reservation caches the initiators holding the volume's
+	// reservation.
+	reservation []net.HardwareAddr
+	// config caches the volume's config string.
+	config     string
+	initiators map[string]*InitiatorStats
+	// quiesced holds the initiators whose commands are dropped, and
+	// commands counts those being served, by initiator.
+	quiesced map[string]bool
+	commands map[string]int
+	drained  *sync.Cond
+}
 
-	major uint16
-	minor uint8
+// ServerStatus reports on the health of a Server.
+type ServerStatus struct {
+	// Started is when the server started serving, or zero if it hasn't.
+	Started time.Time
+	// LastAdvertise is when the server last announced itself on the
+	// network. If it falls behind by more than the advertise interval,
+	// initiators may be losing sight of the target.
+	LastAdvertise time.Time
+	// AdvertiseError is the error from the latest advertisement, if it
+	// failed.
+	AdvertiseError error
 }
 
 // ServerOptions specifies options for a Server.
@@ -36,8 +105,140 @@ type ServerOptions struct {
 	// network must have different major and minor addresses.
 	Major uint16
 	Minor uint8
+
+	// AllocateMinor makes NewServer pick the minor address itself: the
+	// lowest under Major not exported anywhere in the cluster. Minor is
+	// then ignored. Either way, the export is recorded in the cluster
+	// metadata while the server runs, and NewServer fails if its address
+	// is already exported.
+	AllocateMinor bool
+
+	// DeviceTimeout bounds each read, write and flush issued against the
+	// underlying volume. A command which times out is not answered, so the
+	// initiator retransmits it rather than treating the target as dead.
+	// Zero disables the timeout.
+	DeviceTimeout time.Duration
+
+	// SectorFormat selects the sector geometry advertised to initiators.
+	// AoE addresses devices in 512 byte sectors, so block.Sector4Kn is
+	// not supported.
+	SectorFormat block.SectorFormat
+
+	// EtherType overrides the protocol number frames are sent with. It must
+	// match that of the Interface the server is run on. Zero selects the
+	// standard AoE ethertype.
+	EtherType ethernet.EtherType
+
+	// SendRetries is how many times a response is resent after a transient
+	// transmit error, such as a full socket buffer, before it is given up
+	// on and left to the initiator to retransmit its command. Zero selects
+	// DefaultSendRetries and a negative value disables resending.
+	SendRetries int
+
+	// AdvertiseInterval is how often the server announces itself on the
+	// network after the first time, so that initiators which missed it,
+	// or lost it across a link flap, find it again. Zero selects
+	// DefaultAdvertiseInterval and a negative value only advertises once.
+	AdvertiseInterval time.Duration
+
+	// AdvertiseTo lists the initiators to announce the server to, by
+	// unicast. If it is set, the server no longer broadcasts its
+	// announcements unless AdvertiseBroadcast is also set, so hosts which
+	// attach to any target they see won't find it unprompted. It does not
+	// stop any host from querying for targets itself.
+	AdvertiseTo        []net.HardwareAddr
+	AdvertiseBroadcast bool
+
+	// MaxSectorsPerFrame limits the sectors initiators are told they may
+	// read or write in one command. Zero allows as many as fit the MTU of
+	// the interface, so that jumbo frames carry up to 17 sectors where
+	// standard ones carry 2. Serving fails on an interface whose MTU
+	// can't carry as many as are asked for here.
+	MaxSectorsPerFrame int
+
+	// FailFast makes Serve return on the first error reading from the
+	// interface. Otherwise read errors are taken to mean the interface is
+	// temporarily down, and Serve waits for it to come back and resumes;
+	// it only returns once the interface is closed.
+	FailFast bool
+
+	// SyncInterval is how often the volume is synced, storing the writes
+	// made since the last sync. Zero selects DefaultSyncInterval and a
+	// negative value disables periodic syncs, leaving them to flushes.
+	SyncInterval time.Duration
+
+	// IgnoreFlush answers ATA FLUSH CACHE commands without syncing the
+	// volume, leaving writes to the periodic sync. Initiators then can't
+	// make their writes durable when they need to, so it is only for
+	// data which can be lost. It can't be combined with disabling the
+	// periodic sync.
+	IgnoreFlush bool
+
+	// SkipInitialSync stops NewServer from syncing the volume before
+	// returning. The volume is then first synced by Serve, at a random
+	// point within its sync interval, which keeps many servers started at
+	// once from all hitting the cluster together.
+	SkipInitialSync bool
+
+	// MaxInitiators bounds the number of initiators the server keeps
+	// separate command statistics for, in Initiators and in its metrics.
+	// Initiators beyond it are counted together. Zero selects
+	// DefaultMaxInitiators.
+	MaxInitiators int
+
+	// MaxInFlightPerInitiator limits the ATA commands each initiator may
+	// have outstanding. Commands are then served from a queue per
+	// initiator, taking turns, so that one initiator with a deep queue
+	// can't starve the others. Commands beyond the limit are dropped and
+	// left to the initiator to retransmit. Zero serves commands in the
+	// order they arrive, without a limit.
+	MaxInFlightPerInitiator int
+
+	// Workers is the number of ATA commands served at once, so that a
+	// slow one doesn't hold up other initiators. Commands from an
+	// initiator with the same tag are always served in order. Zero
+	// serves commands one at a time.
+	Workers int
+
+	// AllowInitiators lists the hardware addresses of the only initiators
+	// this server accepts frames from, if it is set. Unlike the volume's
+	// MAC mask list, it applies to this server alone and can't be changed
+	// by initiators. An initiator must be allowed by both.
+	AllowInitiators []net.HardwareAddr
+
+	// RefuseDisallowed answers ATA commands from initiators which aren't
+	// allowed with a device unavailable error, instead of ignoring them
+	// as AoE specifies, so that they fail at once rather than time out.
+	RefuseDisallowed bool
+
+	// ReadOnly exports the volume as it was when the server started,
+	// without locking it, failing any writes.
+	ReadOnly bool
+
+	// BadFrameLimit is the number of oversized or malformed frames a
+	// source may send within ten seconds before the server ignores all
+	// its frames for BadFrameBan. Zero never ignores a source. Zero
+	// BadFrameBan selects DefaultBadFrameBan.
+	BadFrameLimit int
+	BadFrameBan   time.Duration
 }
 
+// DefaultSyncInterval is how often Serve syncs the volume when
+// ServerOptions doesn't say.
+const DefaultSyncInterval = 5 * time.Second
+
+// initialSyncs limits how many servers in the process sync their volume in
+// NewServer at the same time.
+var initialSyncs = make(chan struct{}, 4)
+
+// DefaultAdvertiseInterval is how often a server re-advertises itself when
+// ServerOptions doesn't say.
+const DefaultAdvertiseInterval = time.Minute
+
+// DefaultSendRetries is the number of times a response is resent after a
+// transient transmit error when ServerOptions doesn't say.
+const DefaultSendRetries = 3
+
 // DefaultServerOptions is the default ServerOptions configuration used
 // by NewServer when none is specified.
 var DefaultServerOptions = &ServerOptions{
@@ -51,112 +252,451 @@ func NewServer(b *block.BlockVolume, options *ServerOptions) (*Server, error) {
 	if options == nil {
 		options = DefaultServerOptions
 	}
+	s, err := newServer(b, options)
+	if err == torus.ErrExists {
+		err = fmt.Errorf("aoe: address %d.%d is already exported in the cluster", options.Major, options.Minor)
+	}
+	return s, err
+}
+
+// newServer is NewServer, failing with torus.ErrExists if the address is in
+// use.
+func newServer(b *block.BlockVolume, options *ServerOptions) (*Server, error) {
+
+	if options.SectorFormat == block.Sector4Kn {
+		return nil, errors.New("aoe: 4Kn sectors cannot be exported over AoE")
+	}
+	if err := b.CheckSectorFormat(options.SectorFormat); err != nil {
+		return nil, err
+	}
+	if options.IgnoreFlush && options.SyncInterval < 0 {
+		return nil, errors.New("aoe: a server which ignores flushes must sync periodically")
+	}
 
-	f, err := b.OpenBlockFile()
+	var f *block.BlockFile
+	var reservation []net.HardwareAddr
+	var err error
+	if options.ReadOnly {
+		f, err = b.OpenReadOnlyAttachment()
+	} else {
+		f, err = b.OpenAttachment()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	f.Sync()
+	if !options.SkipInitialSync {
+		initialSyncs <- struct{}{}
+		err := f.Sync()
+		<-initialSyncs
+		if err != nil {
+			clog.Warningf("initial sync failed: %v", err)
+		}
+	}
 
-	fd := &FileDevice{f}
+	var config string
+	mask, err := b.MACMask()
+	if err == nil {
+		reservation, err = b.Reservation()
+	}
+	if err == nil {
+		config, err = b.AoEConfig()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var export *block.AoEExport
+	if options.AllocateMinor {
+		export, err = b.AllocateAoEExport(options.Major)
+	} else {
+		export, err = b.RegisterAoEExport(options.Major, options.Minor)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var dev Device = &FileDevice{
+		BlockFile: f,
+		Format:    options.SectorFormat,
+	}
+	var timeouts *timeoutDevice
+	if options.DeviceTimeout > 0 {
+		timeouts = newTimeoutDevice(dev, options.DeviceTimeout)
+		dev = timeouts
+	}
+
+	et := options.EtherType
+	if et == 0 {
+		et = aoe.EtherType
+	}
+
+	retries := options.SendRetries
+	switch {
+	case retries == 0:
+		retries = DefaultSendRetries
+	case retries < 0:
+		retries = 0
+	}
+
+	syncEvery := options.SyncInterval
+	if syncEvery == 0 {
+		syncEvery = DefaultSyncInterval
+	}
+
+	advertise := options.AdvertiseInterval
+	if advertise == 0 {
+		advertise = DefaultAdvertiseInterval
+	}
+
+	maxInitiators := options.MaxInitiators
+	if maxInitiators <= 0 {
+		maxInitiators = DefaultMaxInitiators
+	}
 
 	as := &Server{
-		dfs:   b,
-		dev:   fd,
-		major: options.Major,
-		minor: options.Minor,
+		dfs:               b,
+		file:              f,
+		dev:               dev,
+		timeouts:          timeouts,
+		ataDev:            flushDevice{Device: dev, ignore: options.IgnoreFlush},
+		fence:             scsi.NewFence(b),
+		major:             export.Major,
+		minor:             export.Minor,
+		export:            export,
+		etherType:         et,
+		sendRetries:       retries,
+		advertiseInterval: advertise,
+		advertiseTo:       advertiseAddrs(options),
+		syncInterval:      syncEvery,
+		maxSectors:        options.MaxSectorsPerFrame,
+		failFast:          options.FailFast,
+		stop:              make(chan struct{}),
+		maxInitiators:     maxInitiators,
+		allow:             append([]net.HardwareAddr(nil), options.AllowInitiators...),
+		refuseDisallowed:  options.RefuseDisallowed,
+		initiators:        make(map[string]*InitiatorStats),
+		badFrames:         newBadFrames(options.BadFrameLimit, options.BadFrameBan),
+		macMask:           mask,
+		reservation:       reservation,
+		config:            config,
+	}
+	if options.MaxInFlightPerInitiator > 0 {
+		as.queue = newFairQueue(options.MaxInFlightPerInitiator)
+	}
+	if options.Workers > 0 {
+		as.workers = newWorkerPool(options.Workers)
 	}
 
 	return as, nil
 }
 
-func (s *Server) advertise(iface *Interface) error {
-	// little hack to trigger a broadcast
-	from := &raw.Addr{
-		HardwareAddr: broadcastAddr,
+// advertiseAddrs returns the addresses a server with options announces itself
+// to.
+func advertiseAddrs(options *ServerOptions) []net.HardwareAddr {
+	addrs := append([]net.HardwareAddr(nil), options.AdvertiseTo...)
+	if len(addrs) == 0 || options.AdvertiseBroadcast {
+		addrs = append(addrs, broadcastAddr)
 	}
+	return addrs
+}
 
-	fr := &Frame{
-		Header: aoe.Header{
-			Command: aoe.CommandQueryConfigInformation,
-			Arg: &aoe.ConfigArg{
-				Command: aoe.ConfigCommandRead,
+func (s *Server) advertise(iface *Interface) error {
+	var err error
+	for _, to := range s.advertiseTo {
+		// little hack: answer a config query nobody sent, addressed to
+		// the broadcast address or to a single initiator.
+		from := &raw.Addr{
+			HardwareAddr: to,
+		}
+
+		fr := &Frame{
+			Header: aoe.Header{
+				Command: aoe.CommandQueryConfigInformation,
+				Arg: &aoe.ConfigArg{
+					Command: aoe.ConfigCommandRead,
+				},
 			},
-		},
+		}
+
+		// One unreachable initiator mustn't keep the rest from hearing
+		// of the server.
+		if _, aerr := s.handleFrame(from, iface, fr); aerr != nil && err == nil {
+			err = fmt.Errorf("advertising to %s: %v", to, aerr)
+		}
 	}
 
-	_, err := s.handleFrame(from, iface, fr)
-	return err
+	labels := s.promLabels(iface)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.status.AdvertiseError = err
+	if err != nil {
+		promAdvertiseFailures.WithLabelValues(labels...).Inc()
+		return err
+	}
+	s.status.LastAdvertise = time.Now()
+	promLastAdvertiseTime.WithLabelValues(labels...).Set(float64(s.status.LastAdvertise.Unix()))
+	return nil
 }
 
-func (s *Server) Serve(iface *Interface) error {
-	clog.Tracef("beginning server loop on %+v", iface)
-
-	// cheap sync proc, should stop when server is shut off
-	go func() {
-		for {
-			if err := s.dev.Sync(); err != nil {
-				clog.Warningf("failed to sync %s: %v", s.dev, err)
+func (s *Server) readvertise(iface *Interface) {
+	if s.advertiseInterval < 0 {
+		return
+	}
+	t := time.NewTicker(s.advertiseInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.advertise(iface); err != nil {
+				rlog.Warningf("re-advertisement failed: %v", err)
 			}
-
-			time.Sleep(5 * time.Second)
+		case <-s.stop:
+			return
 		}
-	}()
+	}
+}
+
+func (s *Server) promLabels(iface *Interface) []string {
+	return []string{
+		iface.Name,
+		strconv.Itoa(int(s.major)),
+		strconv.Itoa(int(s.minor)),
+	}
+}
 
-	// broadcast ourselves
-	if err := s.advertise(iface); err != nil {
-		clog.Errorf("advertisement failed: %v", err)
+// Status returns when the server started serving and how its advertisements
+// are going.
+func (s *Server) Status() ServerStatus {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.status
+}
+
+// Serve exports the volume on iface until the server is shut down or the
+// interface is closed.
+func (s *Server) Serve(iface *Interface) error {
+	return s.ServeInterfaces(iface)
+}
+
+// ServeInterfaces exports the volume on several interfaces at once, such as
+// the members of a bond or links to separate storage networks. Each is read
+// separately, and replies are sent on the interface the command arrived on,
+// from its own address. It returns once reading has stopped on all of them,
+// with the first error any of them stopped with.
+func (s *Server) ServeInterfaces(ifaces ...*Interface) error {
+	if len(ifaces) == 0 {
+		return errors.New("aoe: no interfaces to serve on")
+	}
+	if err := s.checkInterfaces(ifaces); err != nil {
+		return err
+	}
+	if ok, err := s.start(ifaces); !ok {
 		return err
 	}
 
-	for {
-		payload := make([]byte, iface.MTU)
-		n, addr, err := iface.ReadFrom(payload)
-		if err != nil {
-			clog.Errorf("ReadFrom failed: %v", err)
-			// will be syscall.EBADF if the conn from raw closed
-			if err == syscall.EBADF {
-				break
-			}
+	loops := make([]*frameLoop, len(ifaces))
+	for i, iface := range ifaces {
+		loops[i] = s.frameLoop(iface)
+	}
+	return runLoops(loops)
+}
+
+// checkInterfaces returns an error if the server can't be served on all of
+// ifaces.
+func (s *Server) checkInterfaces(ifaces []*Interface) error {
+	for _, iface := range ifaces {
+		if iface.EtherType != s.etherType {
+			return fmt.Errorf("aoe: interface %s uses ethertype %#04x but the server is configured for %#04x", iface.Name, uint16(iface.EtherType), uint16(s.etherType))
+		}
+		if err := s.checkMTU(iface); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// start advertises the server on ifaces and starts its background work,
+// leaving the interfaces to be read by the caller. It returns false if the
+// server has been shut down or couldn't be advertised.
+func (s *Server) start(ifaces []*Interface) (bool, error) {
+	started := time.Now()
+	s.mut.Lock()
+	if s.shutdown {
+		s.mut.Unlock()
+		return false, nil
+	}
+	s.ifaces = ifaces
+	s.status.Started = started
+	s.mut.Unlock()
+
+	go s.syncPeriodically()
+	for _, iface := range ifaces {
+		promServerStartTime.WithLabelValues(s.promLabels(iface)...).Set(float64(started.Unix()))
+		// broadcast ourselves
+		if err := s.advertise(iface); err != nil {
+			clog.Errorf("advertisement on %s failed: %v", iface.Name, err)
+			return false, err
+		}
+		go s.readvertise(iface)
+		go s.watchLink(iface)
+	}
+	go s.refreshReservation()
+	if s.queue != nil {
+		go s.serveQueue()
+	}
+	if s.workers != nil {
+		s.startWorkers()
+	}
+	return true, nil
+}
 
-		// resize payload
-		payload = payload[:n]
+// frameLoop returns the loop which reads and serves the frames arriving on
+// iface until the server is stopped or iface is closed.
+func (s *Server) frameLoop(iface *Interface) *frameLoop {
+	return &frameLoop{
+		iface:     iface,
+		stop:      s.stop,
+		failFast:  s.failFast,
+		badFrames: s.badFrames,
+		labels:    s.promLabels(iface),
+		advertise: s.advertise,
+		handle:    s.receive,
+	}
+}
 
-		var f Frame
-		if err := f.UnmarshalBinary(payload); err != nil {
-			clog.Errorf("Failed to unmarshal frame: %v", err)
-			continue
+// receive serves the frame f, which arrived from addr on iface, unless the
+// initiator isn't allowed to use the server.
+func (s *Server) receive(addr net.Addr, iface *Interface, f *Frame) {
+	if s.stopped() {
+		return
+	}
+	promFramesReceived.WithLabelValues(append(s.promLabels(iface), commandLabel(f.Header.Command))...).Inc()
+	if !s.initiatorAllowed(addr.(*raw.Addr).HardwareAddr) {
+		promDisallowedFrames.WithLabelValues(strconv.Itoa(int(s.major)), strconv.Itoa(int(s.minor))).Inc()
+		if s.refuseDisallowed && f.Header.Command == aoe.CommandIssueATACommand {
+			s.newSender(addr, iface, f).SendError(aoe.ErrorDeviceUnavailable)
+			return
 		}
+		clog.Debugf("ignoring %s, which isn't allowed to use the server", addr)
+		return
+	}
 
-		clog.Debugf("recv %d %s %+v", n, addr, f.Header)
-		//clog.Debugf("recv arg %+v", f.Header.Arg)
+	if f.Header.Command == aoe.CommandIssueATACommand && (s.queue != nil || s.workers != nil) {
+		hw := addr.(*raw.Addr).HardwareAddr
+		qf := queuedFrame{key: hw.String(), from: addr, iface: iface, f: f}
+		if s.queue == nil {
+			s.dispatch(qf)
+		} else if !s.queue.push(qf) {
+			rlog.Warningf("initiator %s has too many commands in flight, dropping", hw)
+			promInitiatorThrottled.WithLabelValues(s.initiatorLabels(hw)...).Inc()
+		}
+		return
+	}
 
-		s.handleFrame(addr, iface, &f)
+	s.handleFrame(addr, iface, f)
+}
+
+// syncPeriodically syncs the volume every sync interval until the server is
+// stopped.
+func (s *Server) syncPeriodically() {
+	if s.syncInterval < 0 {
+		return
+	}
+	// Spread out servers started together.
+	wait := time.Duration(rand.Int63n(int64(s.syncInterval)))
+	for {
+		select {
+		case <-time.After(wait):
+		case <-s.stop:
+			return
+		}
+		if err := s.dev.Sync(); err != nil {
+			clog.Warningf("failed to sync %s: %v", s.dev, err)
+		}
+		wait = s.syncInterval
 	}
+}
 
-	return nil
+func (s *Server) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
 }
 
-func (s *Server) handleFrame(from net.Addr, iface *Interface, f *Frame) (int, error) {
-	hdr := &f.Header
+// serveQueue serves queued ATA commands until the server is closed.
+func (s *Server) serveQueue() {
+	for {
+		qf, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		s.dispatch(qf)
+	}
+}
 
-	sender := &FrameSender{
-		orig:  f,
-		dst:   from.(*raw.Addr).HardwareAddr,
-		src:   iface.HardwareAddr,
-		conn:  iface.PacketConn,
-		major: s.major,
-		minor: s.minor,
+// newSender returns a FrameSender answering the frame f, which arrived from
+// addr on iface.
+func (s *Server) newSender(from net.Addr, iface *Interface, f *Frame) *FrameSender {
+	return &FrameSender{
+		orig:      f,
+		dst:       from.(*raw.Addr).HardwareAddr,
+		src:       iface.HardwareAddr,
+		conn:      iface.PacketConn,
+		major:     s.major,
+		minor:     s.minor,
+		etherType: s.etherType,
+		vlan:      iface.VLAN,
+		retries:   s.sendRetries,
 	}
+}
+
+func (s *Server) handleFrame(from net.Addr, iface *Interface, f *Frame) (int, error) {
+	hdr := &f.Header
+	sender := s.newSender(from, iface, f)
+	defer func(start time.Time, cmd string) {
+		promFrameSeconds.WithLabelValues(strconv.Itoa(int(s.major)), strconv.Itoa(int(s.minor)), cmd).Observe(time.Since(start).Seconds())
+	}(time.Now(), commandLabel(hdr.Command))
 
 	switch hdr.Command {
 	case aoe.CommandIssueATACommand:
-		n, err := aoe.ServeATA(sender, hdr, s.dev)
+		if !s.beginCommand(sender.dst) {
+			promInitiatorQuiesced.WithLabelValues(s.initiatorLabels(sender.dst)...).Inc()
+			return 0, nil
+		}
+		defer s.endCommand(sender.dst)
+		if !s.reservationAllows(sender.dst) {
+			return sender.SendError(aoe.ErrorTargetIsReserved)
+		}
+		if arg, ok := hdr.Arg.(*aoe.ATAArg); ok {
+			if int(arg.SectorCount) > s.sectorsPerFrame(iface) {
+				// The response wouldn't fit in a frame.
+				rlog.Warningf("%s asked for %d sectors in one command, more than the %d advertised", sender.dst, arg.SectorCount, s.sectorsPerFrame(iface))
+				return sender.SendError(aoe.ErrorBadArgumentParameter)
+			}
+			s.recordATA(sender.dst, arg)
+			if !s.fenceAllows(arg) {
+				return sender.SendError(aoe.ErrorTargetIsReserved)
+			}
+			if arg.CmdStatus == ataDataSetMgmt {
+				return s.serveTrim(sender, hdr, arg)
+			}
+		}
+		n, err := aoe.ServeATA(sender, hdr, s.ataDev)
 		if err != nil {
-			clog.Errorf("ServeATA failed: %v", err)
+			if err == errDeviceTimeout {
+				// AoE has no busy response; staying silent makes the
+				// initiator retransmit once its own timer expires.
+				rlog.Warningf("ATA command from %s timed out, awaiting retransmit", from)
+				s.holdCommand(sender.dst)
+				return 0, nil
+			}
+			rlog.Errorf("ServeATA failed: %v", err)
 			switch err {
 			case aoe.ErrInvalidATARequest:
 				return sender.SendError(aoe.ErrorBadArgumentParameter)
@@ -167,36 +707,95 @@ func (s *Server) handleFrame(from net.Addr, iface *Interface, f *Frame) (int, er
 
 		return n, nil
 	case aoe.CommandQueryConfigInformation:
-		cfgarg := f.Header.Arg.(*aoe.ConfigArg)
-		clog.Debugf("cfgarg: %+v", cfgarg)
-
-		switch cfgarg.Command {
-		case aoe.ConfigCommandRead:
-			hdr.Arg = &aoe.ConfigArg{
-				// if < 2, linux aoe handles it poorly
-				BufferCount:     2,
-				FirmwareVersion: 0,
-				// naive, but works.
-				SectorCount:  uint8(iface.MTU / 512),
-				Version:      1,
-				Command:      aoe.ConfigCommandRead,
-				StringLength: 0,
-				String:       []byte{},
-			}
-
-			return sender.Send(hdr)
+		cfgarg, ok := hdr.Arg.(*aoe.ConfigArg)
+		if !ok {
+			return sender.SendError(aoe.ErrorBadArgumentParameter)
 		}
-
-		return sender.SendError(aoe.ErrorUnrecognizedCommandCode)
+		clog.Debugf("cfgarg: %+v", cfgarg)
+		return s.serveConfig(sender, iface, hdr, cfgarg)
 	case aoe.CommandMACMaskList:
-		fallthrough
+		arg, ok := hdr.Arg.(*aoe.MACMaskArg)
+		if !ok {
+			return sender.SendError(aoe.ErrorBadArgumentParameter)
+		}
+		return s.serveMACMask(sender, hdr, arg)
 	case aoe.CommandReserveRelease:
-		fallthrough
+		arg, ok := hdr.Arg.(*aoe.ReserveReleaseArg)
+		if !ok {
+			return sender.SendError(aoe.ErrorBadArgumentParameter)
+		}
+		return s.serveReserveRelease(sender, hdr, arg)
 	default:
 		return sender.SendError(aoe.ErrorUnrecognizedCommandCode)
 	}
 }
 
+// Shutdown stops the server in an orderly way, for detaching the volume.
+// Frames received from then on are ignored, and Serve returns nil instead of
+// reading the next one; the reads it is blocked in are cut short where the
+// Interfaces support deadlines, and otherwise end when they are closed.
+// Shutdown waits for the ATA commands already being served to complete,
+// including device operations abandoned when they timed out, then syncs and
+// closes the volume. If ctx is done first, the volume is closed without being
+// synced and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mut.Lock()
+	s.shutdown = true
+	ifaces := s.ifaces
+	s.mut.Unlock()
+	s.halt()
+	for _, iface := range ifaces {
+		iface.SetReadDeadline(time.Now())
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.mut.Lock()
+		for len(s.commands) > 0 {
+			s.drainedCond().Wait()
+		}
+		s.mut.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.dev.Close()
+		return ctx.Err()
+	}
+
+	err := s.dev.Sync()
+	if cerr := s.dev.Close(); err == nil {
+		err = cerr
+	}
+	clog.Infof("server %d.%d shut down", s.major, s.minor)
+	return err
+}
+
+// Close stops the server and closes the volume at once, without waiting for
+// the commands being served. Use Shutdown to stop it cleanly.
 func (s *Server) Close() error {
+	s.halt()
 	return s.dev.Close()
 }
+
+// Address returns the server's major and minor address.
+func (s *Server) Address() (major uint16, minor uint8) {
+	return s.major, s.minor
+}
+
+// halt stops the server's background work and its queue, and withdraws its
+// export.
+func (s *Server) halt() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.queue != nil {
+			s.queue.close()
+		}
+		if s.export != nil {
+			if err := s.dfs.UnregisterAoEExport(s.export); err != nil {
+				clog.Warningf("couldn't unregister export %s: %v", s.export.Address(), err)
+			}
+		}
+	})
+}
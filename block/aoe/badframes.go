@@ -0,0 +1,106 @@
+package aoe
+
+import (
+	"sync"
+	"time"
+)
+
+// frameOverhead is the most a frame read from the interface can exceed its
+// MTU by: an Ethernet header with an 802.1Q tag.
+const frameOverhead = 18
+
+// DefaultBadFrameBan is how long a source which sent too many bad frames is
+// ignored for when ServerOptions doesn't say.
+const DefaultBadFrameBan = time.Minute
+
+// badFrameWindow is the period over which a source's bad frames are counted
+// against the limit.
+const badFrameWindow = 10 * time.Second
+
+// maxBadSources bounds the number of sources of bad frames tracked at once.
+// Beyond it, sources which have neither sent a bad frame recently nor are
+// banned are forgotten first.
+const maxBadSources = 1024
+
+// Reasons a frame is dropped before being handled, as counted by
+// torus_aoe_bad_frames_total.
+const (
+	badFrameOversized = "oversized"
+	badFrameMalformed = "malformed"
+	badFrameBanned    = "banned"
+)
+
+type badSource struct {
+	windowStart time.Time
+	count       int
+	bannedUntil time.Time
+}
+
+// badFrames tracks which sources send oversized or malformed frames, and bans
+// those sending more than limit per badFrameWindow. A limit of zero counts
+// without banning, as does a nil badFrames.
+type badFrames struct {
+	mut     sync.Mutex
+	limit   int
+	ban     time.Duration
+	sources map[string]*badSource
+}
+
+func newBadFrames(limit int, ban time.Duration) *badFrames {
+	if ban <= 0 {
+		ban = DefaultBadFrameBan
+	}
+	return &badFrames{
+		limit:   limit,
+		ban:     ban,
+		sources: make(map[string]*badSource),
+	}
+}
+
+// banned reports whether frames from src are being ignored.
+func (b *badFrames) banned(src string, now time.Time) bool {
+	if b == nil || b.limit <= 0 {
+		return false
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	s, ok := b.sources[src]
+	return ok && now.Before(s.bannedUntil)
+}
+
+// record counts a bad frame from src, and reports whether it got src banned.
+func (b *badFrames) record(src string, now time.Time) bool {
+	if b == nil || b.limit <= 0 {
+		return false
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	s, ok := b.sources[src]
+	if !ok {
+		if len(b.sources) >= maxBadSources {
+			b.expire(now)
+		}
+		s = &badSource{windowStart: now}
+		b.sources[src] = s
+	}
+	if now.Sub(s.windowStart) > badFrameWindow {
+		s.windowStart = now
+		s.count = 0
+	}
+	s.count++
+	if s.count > b.limit && !now.Before(s.bannedUntil) {
+		s.bannedUntil = now.Add(b.ban)
+		return true
+	}
+	return false
+}
+
+// expire forgets sources which are neither banned nor within their window.
+// b.mut must be held.
+func (b *badFrames) expire(now time.Time) {
+	for k, s := range b.sources {
+		if now.Sub(s.windowStart) > badFrameWindow && !now.Before(s.bannedUntil) {
+			delete(b.sources, k)
+		}
+	}
+}
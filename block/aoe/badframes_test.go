@@ -0,0 +1,40 @@
+package aoe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBadFramesBan(t *testing.T) {
+	b := newBadFrames(2, time.Minute)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if b.record("a", now) {
+			t.Fatalf("banned after %d bad frames", i+1)
+		}
+	}
+	if !b.record("a", now) {
+		t.Fatal("not banned after exceeding the limit")
+	}
+	if !b.banned("a", now.Add(time.Second)) {
+		t.Error("banned source let through")
+	}
+	if b.banned("b", now) {
+		t.Error("innocent source banned")
+	}
+	if b.banned("a", now.Add(2*time.Minute)) {
+		t.Error("ban didn't expire")
+	}
+
+	// Bad frames spread out over more than the window don't add up.
+	b.record("c", now)
+	b.record("c", now)
+	if b.record("c", now.Add(2*badFrameWindow)) {
+		t.Error("banned for bad frames in different windows")
+	}
+
+	var disabled *badFrames
+	if disabled.record("a", now) || disabled.banned("a", now) {
+		t.Error("nil tracker banned a source")
+	}
+}
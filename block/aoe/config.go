@@ -0,0 +1,81 @@
+package aoe
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/mdlayher/aoe"
+)
+
+// maxConfigString is the longest config string AoE allows.
+const maxConfigString = 1024
+
+var errConfigPresent = errors.New("aoe: config string already set")
+
+// serveConfig answers a query config information command. Reads are always
+// answered; tests are only answered if the config string matches, so that
+// initiators can find the targets they configured. Setting the config string
+// succeeds if it is empty or already the same, and forcing it succeeds
+// regardless; either way it is changed in the cluster metadata, so it holds
+// on every server exporting the volume.
+func (s *Server) serveConfig(sender *FrameSender, iface *Interface, hdr *aoe.Header, arg *aoe.ConfigArg) (int, error) {
+	s.mut.Lock()
+	config := s.config
+	s.mut.Unlock()
+
+	switch arg.Command {
+	case aoe.ConfigCommandRead:
+	case aoe.ConfigCommandTest:
+		if !bytes.Equal(arg.String, []byte(config)) {
+			return 0, nil
+		}
+	case aoe.ConfigCommandTestPrefix:
+		if !bytes.HasPrefix([]byte(config), arg.String) {
+			return 0, nil
+		}
+	case aoe.ConfigCommandSet, aoe.ConfigCommandForceSet:
+		if len(arg.String) > maxConfigString {
+			return sender.SendError(aoe.ErrorBadArgumentParameter)
+		}
+		force := arg.Command == aoe.ConfigCommandForceSet
+		next, err := s.dfs.UpdateAoEConfig(func(cur string) (string, error) {
+			if !force && cur != "" && cur != string(arg.String) {
+				return "", errConfigPresent
+			}
+			return string(arg.String), nil
+		})
+		if err == errConfigPresent {
+			s.setConfig(next)
+			return sender.SendError(aoe.ErrorConfigStringPresent)
+		}
+		if err != nil {
+			rlog.Errorf("couldn't store config string: %v", err)
+			return sender.SendError(aoe.ErrorDeviceUnavailable)
+		}
+		s.setConfig(next)
+		if next != config {
+			clog.Infof("config string set to %q by %s", next, sender.dst)
+		}
+		config = next
+	default:
+		return sender.SendError(aoe.ErrorUnrecognizedCommandCode)
+	}
+
+	hdr.Arg = &aoe.ConfigArg{
+		// if < 2, linux aoe handles it poorly
+		BufferCount:     2,
+		FirmwareVersion: 0,
+		SectorCount:     uint8(s.sectorsPerFrame(iface)),
+		Version:         1,
+		Command:         arg.Command,
+		StringLength:    uint16(len(config)),
+		String:          []byte(config),
+	}
+	return sender.Send(hdr)
+}
+
+func (s *Server) setConfig(config string) {
+	s.mut.Lock()
+	s.config = config
+	s.mut.Unlock()
+}
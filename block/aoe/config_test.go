@@ -0,0 +1,39 @@
+package aoe
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mdlayher/aoe"
+)
+
+func TestConfigTest(t *testing.T) {
+	s := &Server{config: "shelf 1"}
+	iface := &Interface{Interface: &net.Interface{Name: "test0", MTU: 1500}}
+	for _, tt := range []struct {
+		cmd    aoe.ConfigCommand
+		str    string
+		answer bool
+	}{
+		{aoe.ConfigCommandRead, "anything", true},
+		{aoe.ConfigCommandTest, "shelf 1", true},
+		{aoe.ConfigCommandTest, "shelf", false},
+		{aoe.ConfigCommandTestPrefix, "shelf", true},
+		{aoe.ConfigCommandTestPrefix, "", true},
+		{aoe.ConfigCommandTestPrefix, "shelf 12", false},
+	} {
+		conn := &flakyConn{}
+		hdr := testHeader()
+		arg := &aoe.ConfigArg{Command: tt.cmd, String: []byte(tt.str)}
+		hdr.Arg = arg
+		if _, err := s.serveConfig(newTestSender(conn, 0), iface, hdr, arg); err != nil {
+			t.Fatal(err)
+		}
+		if answered := conn.sent == 1; answered != tt.answer {
+			t.Fatalf("command %d with %q: answered=%v, expected %v", tt.cmd, tt.str, answered, tt.answer)
+		}
+		if tt.answer && string(hdr.Arg.(*aoe.ConfigArg).String) != s.config {
+			t.Fatalf("command %d: answered with %q", tt.cmd, hdr.Arg.(*aoe.ConfigArg).String)
+		}
+	}
+}
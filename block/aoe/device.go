@@ -4,6 +4,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/coreos/torus/block"
 
@@ -12,6 +15,11 @@ import (
 
 var (
 	_ Device = &FileDevice{}
+	_ Device = &timeoutDevice{}
+
+	// errDeviceTimeout is returned by a timeoutDevice when an operation on
+	// the underlying device does not complete within the configured timeout.
+	errDeviceTimeout = errors.New("aoe: device operation timed out")
 )
 
 type Device interface {
@@ -84,8 +92,35 @@ func pstring(p []byte, off int, sz int, ident string) {
 	copy(p[off*2:], id)
 }
 
+// flushDevice is the Device ATA commands are served from. ServeATA syncs the
+// device for FLUSH CACHE, which flushDevice skips when flushes are ignored.
+type flushDevice struct {
+	Device
+	ignore bool
+}
+
+func (d flushDevice) Trim(off, length int64) error {
+	t, ok := d.Device.(Trimmer)
+	if !ok {
+		return errors.New("aoe: device doesn't support TRIM")
+	}
+	return t.Trim(off, length)
+}
+
+func (d flushDevice) Sync() error {
+	if d.ignore {
+		return nil
+	}
+	return d.Device.Sync()
+}
+
 type FileDevice struct {
 	*block.BlockFile
+
+	// Format is the sector geometry reported by Identify. AoE always
+	// addresses the device in 512 byte sectors, so only Sector512 and
+	// Sector512e are meaningful here.
+	Format block.SectorFormat
 }
 
 func (fd *FileDevice) Sectors() (int64, error) {
@@ -97,6 +132,15 @@ func (fd *FileDevice) Sectors() (int64, error) {
 	return int64(fi) / 512, nil
 }
 
+// Trim discards the data in the range, failing if it runs past the end of
+// the device.
+func (fd *FileDevice) Trim(off, length int64) error {
+	if off < 0 || length < 0 || off+length > int64(fd.BlockFile.Size()) {
+		return errTrimRange
+	}
+	return fd.BlockFile.Trim(off, length)
+}
+
 func (fd *FileDevice) Identify() ([512]byte, error) {
 	bufa := [512]byte{}
 
@@ -128,6 +172,16 @@ func (fd *FileDevice) Identify() ([512]byte, error) {
 	pshort(buf, 69, 0x4000)
 	// we support TRIM
 	pshort(buf, 169, 0x0001)
+	// of up to one sector of ranges per DATA SET MANAGEMENT command
+	pshort(buf, 105, 0x0001)
+
+	if fd.Format == block.Sector512e {
+		// physical sector size valid, multiple logical sectors per
+		// physical sector, 2^3 logical sectors per physical sector
+		pshort(buf, 106, 0x6003)
+		// alignment valid, logical sector 0 is at offset 0
+		pshort(buf, 209, 0x4000)
+	}
 
 	// Serial number
 	pstring(buf, 10, 20, "0")
@@ -147,3 +201,155 @@ func (fd *FileDevice) Identify() ([512]byte, error) {
 
 	return bufa, nil
 }
+
+// timeoutDevice bounds the time spent in each read, write and sync on the
+// wrapped Device. An operation that times out keeps running in the
+// background on a copy of the caller's buffer; the caller simply stops
+// waiting for it. Until it returns, later operations wait behind it, so that
+// an abandoned write can't land after the initiator's retransmit of it or a
+// newer write to the same sectors.
+//
+// Read and Write are implemented in terms of ReadAt and WriteAt against an
+// offset tracked here, so that an abandoned operation can't move the file
+// offset out from under the next request.
+type timeoutDevice struct {
+	Device
+	timeout time.Duration
+
+	mu  sync.Mutex
+	off int64
+
+	// abandoned counts the operations which timed out and haven't
+	// returned yet; idle is closed whenever it is zero.
+	amu       sync.Mutex
+	abandoned int
+	idle      chan struct{}
+}
+
+func newTimeoutDevice(d Device, timeout time.Duration) *timeoutDevice {
+	idle := make(chan struct{})
+	close(idle)
+	return &timeoutDevice{
+		Device:  d,
+		timeout: timeout,
+		idle:    idle,
+	}
+}
+
+// settled returns a channel which is closed once every operation abandoned
+// so far has returned.
+func (d *timeoutDevice) settled() <-chan struct{} {
+	d.amu.Lock()
+	defer d.amu.Unlock()
+	return d.idle
+}
+
+func (d *timeoutDevice) do(fn func() (int, error)) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	t := time.NewTimer(d.timeout)
+	defer t.Stop()
+	select {
+	case <-d.settled():
+	case <-t.C:
+		return 0, errDeviceTimeout
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		n, err := fn()
+		ch <- result{n, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.n, r.err
+	case <-t.C:
+	}
+
+	d.amu.Lock()
+	if d.abandoned == 0 {
+		d.idle = make(chan struct{})
+	}
+	d.abandoned++
+	d.amu.Unlock()
+	go func() {
+		<-ch
+		d.amu.Lock()
+		defer d.amu.Unlock()
+		d.abandoned--
+		if d.abandoned == 0 {
+			close(d.idle)
+		}
+	}()
+	return 0, errDeviceTimeout
+}
+
+func (d *timeoutDevice) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch whence {
+	case os.SEEK_SET:
+		d.off = offset
+	case os.SEEK_CUR:
+		d.off += offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	return d.off, nil
+}
+
+func (d *timeoutDevice) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.ReadAt(p, d.off)
+	d.off += int64(n)
+	return n, err
+}
+
+func (d *timeoutDevice) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.WriteAt(p, d.off)
+	d.off += int64(n)
+	return n, err
+}
+
+// ReadAt reads into a buffer of its own, which p is only filled from if the
+// read completes in time.
+func (d *timeoutDevice) ReadAt(p []byte, off int64) (int, error) {
+	buf := make([]byte, len(p))
+	n, err := d.do(func() (int, error) {
+		return d.Device.ReadAt(buf, off)
+	})
+	copy(p, buf[:n])
+	return n, err
+}
+
+// WriteAt writes a copy of p, so that the caller may reuse p even if the
+// write is abandoned.
+func (d *timeoutDevice) WriteAt(p []byte, off int64) (int, error) {
+	buf := append([]byte(nil), p...)
+	return d.do(func() (int, error) {
+		return d.Device.WriteAt(buf, off)
+	})
+}
+
+func (d *timeoutDevice) Trim(off, length int64) error {
+	t, ok := d.Device.(Trimmer)
+	if !ok {
+		return errors.New("aoe: device doesn't support TRIM")
+	}
+	_, err := d.do(func() (int, error) {
+		return 0, t.Trim(off, length)
+	})
+	return err
+}
+
+func (d *timeoutDevice) Sync() error {
+	_, err := d.do(func() (int, error) {
+		return 0, d.Device.Sync()
+	})
+	return err
+}
@@ -0,0 +1,83 @@
+package aoe
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallDevice holds every write until release is closed.
+type stallDevice struct {
+	Device
+	release chan struct{}
+
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (d *stallDevice) WriteAt(p []byte, off int64) (int, error) {
+	<-d.release
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writes = append(d.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (d *stallDevice) Sync() error { return nil }
+
+func (d *stallDevice) written() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.writes
+}
+
+func TestTimeoutDeviceAbandonedWrite(t *testing.T) {
+	sd := &stallDevice{release: make(chan struct{})}
+	d := newTimeoutDevice(sd, 20*time.Millisecond)
+	s := &Server{dev: d, timeouts: d}
+	a := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+
+	// The initiator's write times out, and the buffer it came in is
+	// reused for something else.
+	if !s.beginCommand(a) {
+		t.Fatal("command refused")
+	}
+	p := []byte{1, 2, 3}
+	if _, err := d.WriteAt(p, 0); err != errDeviceTimeout {
+		t.Fatalf("expected the stalled write to time out, got %v", err)
+	}
+	s.holdCommand(a)
+	s.endCommand(a)
+	p[0] = 9
+
+	// Its retransmit waits behind it rather than racing it.
+	if _, err := d.WriteAt([]byte{4, 5, 6}, 0); err != errDeviceTimeout {
+		t.Fatalf("expected a write behind the stalled one to time out, got %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Quiesce(a) }()
+	select {
+	case <-done:
+		t.Fatal("quiesce returned while an abandoned write was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(sd.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("quiesce didn't return once the abandoned write did")
+	}
+	if _, err := d.WriteAt([]byte{4, 5, 6}, 0); err != nil {
+		t.Fatal(err)
+	}
+	w := sd.written()
+	if len(w) != 2 || !bytes.Equal(w[0], []byte{1, 2, 3}) || !bytes.Equal(w[1], []byte{4, 5, 6}) {
+		t.Fatalf("device saw writes %v, expected [1 2 3] then [4 5 6]", w)
+	}
+}
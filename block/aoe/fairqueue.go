@@ -0,0 +1,100 @@
+package aoe
+
+import (
+	"net"
+	"sync"
+)
+
+// queuedFrame is an ATA command waiting to be served.
+type queuedFrame struct {
+	key   string
+	from  net.Addr
+	iface *Interface
+	f     *Frame
+}
+
+// fairQueue holds received ATA commands until they can be served, one queue
+// per initiator, and hands them out round-robin across initiators. An
+// initiator with a deep queue thus gets no more than its turn, and one which
+// already has limit commands in flight has any more dropped; it will
+// retransmit them.
+type fairQueue struct {
+	mut      sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	queues   map[string][]queuedFrame
+	inflight map[string]int
+	// order lists the initiators with queued commands, next to be served
+	// first.
+	order  []string
+	closed bool
+}
+
+func newFairQueue(limit int) *fairQueue {
+	q := &fairQueue{
+		limit:    limit,
+		queues:   make(map[string][]queuedFrame),
+		inflight: make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.mut)
+	return q
+}
+
+// push queues qf, unless its initiator is at the limit, in which case it
+// returns false.
+func (q *fairQueue) push(qf queuedFrame) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if q.closed || q.inflight[qf.key] >= q.limit {
+		return false
+	}
+	q.inflight[qf.key]++
+	if len(q.queues[qf.key]) == 0 {
+		q.order = append(q.order, qf.key)
+	}
+	q.queues[qf.key] = append(q.queues[qf.key], qf)
+	q.cond.Signal()
+	return true
+}
+
+// pop waits for a command and returns it. Once the command is served, done
+// must be called with its key. pop returns false when the queue is closed.
+func (q *fairQueue) pop() (queuedFrame, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	for len(q.order) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return queuedFrame{}, false
+	}
+	key := q.order[0]
+	q.order = q.order[1:]
+	pending := q.queues[key]
+	qf := pending[0]
+	pending[0] = queuedFrame{}
+	pending = pending[1:]
+	if len(pending) == 0 {
+		delete(q.queues, key)
+	} else {
+		q.queues[key] = pending
+		q.order = append(q.order, key)
+	}
+	return qf, true
+}
+
+func (q *fairQueue) done(key string) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.inflight[key]--
+	if q.inflight[key] <= 0 {
+		delete(q.inflight, key)
+	}
+}
+
+func (q *fairQueue) close() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,34 @@
+package aoe
+
+import "testing"
+
+func TestFairQueue(t *testing.T) {
+	q := newFairQueue(2)
+	for i, key := range []string{"a", "a", "a", "b"} {
+		ok := q.push(queuedFrame{key: key})
+		if want := i != 2; ok != want {
+			t.Fatalf("push %d from %s: got %v, want %v", i, key, ok, want)
+		}
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		qf, ok := q.pop()
+		if !ok {
+			t.Fatal("queue closed early")
+		}
+		got = append(got, qf.key)
+		q.done(qf.key)
+	}
+	if got[0] != "a" || got[1] != "b" || got[2] != "a" {
+		t.Fatalf("initiators not served in turn: %v", got)
+	}
+
+	if !q.push(queuedFrame{key: "a"}) {
+		t.Fatal("push refused once commands were done")
+	}
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Fatal("pop succeeded on a closed queue")
+	}
+}
@@ -2,6 +2,10 @@ package aoe
 
 import (
 	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/mdlayher/aoe"
 	"github.com/mdlayher/ethernet"
@@ -37,8 +41,35 @@ type FrameSender struct {
 	src  net.HardwareAddr
 	conn WriterTo
 
-	major uint16
-	minor uint8
+	major     uint16
+	minor     uint8
+	etherType ethernet.EtherType
+	vlan      *ethernet.VLAN
+
+	// retries is how many more times a frame is sent after a transient
+	// transmit failure.
+	retries int
+}
+
+// sendBackoff is the wait before the first resend of a frame; it doubles
+// with each further attempt.
+const sendBackoff = 50 * time.Microsecond
+
+// retriableSendError reports whether err is a transmit failure which may
+// succeed if tried again shortly, such as a full socket buffer.
+func retriableSendError(err error) bool {
+	switch e := err.(type) {
+	case *net.OpError:
+		return retriableSendError(e.Err)
+	case *os.SyscallError:
+		return retriableSendError(e.Err)
+	case syscall.Errno:
+		switch e {
+		case syscall.EAGAIN, syscall.ENOBUFS, syscall.EINTR:
+			return true
+		}
+	}
+	return false
 }
 
 func (fs *FrameSender) Send(hdr *aoe.Header) (int, error) {
@@ -56,9 +87,12 @@ func (fs *FrameSender) Send(hdr *aoe.Header) (int, error) {
 	frame := &ethernet.Frame{
 		Destination: fs.dst,
 		Source:      fs.src,
-		EtherType:   aoe.EtherType,
+		EtherType:   fs.etherType,
 		Payload:     hbuf,
 	}
+	if fs.vlan != nil {
+		frame.VLAN = []*ethernet.VLAN{fs.vlan}
+	}
 
 	ebuf, err := frame.MarshalBinary()
 	if err != nil {
@@ -68,13 +102,23 @@ func (fs *FrameSender) Send(hdr *aoe.Header) (int, error) {
 	clog.Debugf("send %d %s %+v", len(ebuf), fs.dst, hdr)
 	//clog.Debugf("send arg %+v", hdr.Arg)
 
-	return fs.conn.WriteTo(ebuf, &raw.Addr{HardwareAddr: fs.dst})
+	addr := &raw.Addr{HardwareAddr: fs.dst}
+	backoff := sendBackoff
+	for i := 0; ; i++ {
+		n, err := fs.conn.WriteTo(ebuf, addr)
+		if err == nil || i >= fs.retries || !retriableSendError(err) {
+			return n, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 func (fs *FrameSender) SendError(aerr aoe.Error) (int, error) {
 	hdr := fs.orig.Header
 	hdr.FlagError = true
 	hdr.Error = aerr
+	promErrorReplies.WithLabelValues(strconv.Itoa(int(fs.major)), strconv.Itoa(int(fs.minor)), errorLabel(aerr)).Inc()
 
 	return fs.Send(&hdr)
 }
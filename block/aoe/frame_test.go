@@ -0,0 +1,74 @@
+package aoe
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/mdlayher/aoe"
+)
+
+type flakyConn struct {
+	fails []error
+	sent  int
+}
+
+func (c *flakyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(c.fails) != 0 {
+		err := c.fails[0]
+		c.fails = c.fails[1:]
+		return 0, err
+	}
+	c.sent++
+	return len(b), nil
+}
+
+func newTestSender(conn WriterTo, retries int) *FrameSender {
+	return &FrameSender{
+		orig:    &Frame{},
+		dst:     broadcastAddr,
+		src:     broadcastAddr,
+		conn:    conn,
+		retries: retries,
+	}
+}
+
+func testHeader() *aoe.Header {
+	return &aoe.Header{
+		Command: aoe.CommandQueryConfigInformation,
+		Arg: &aoe.ConfigArg{
+			Command: aoe.ConfigCommandRead,
+			String:  []byte{},
+		},
+	}
+}
+
+func TestSendRetriesTransientErrors(t *testing.T) {
+	eagain := &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EAGAIN)}
+	conn := &flakyConn{fails: []error{eagain, syscall.ENOBUFS}}
+	_, err := newTestSender(conn, 3).Send(testHeader())
+	if err != nil {
+		t.Fatalf("expected the send to succeed after retrying, got %v", err)
+	}
+	if conn.sent != 1 {
+		t.Fatalf("expected one frame sent, got %d", conn.sent)
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	conn := &flakyConn{fails: []error{syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN}}
+	_, err := newTestSender(conn, 2).Send(testHeader())
+	if err != syscall.EAGAIN {
+		t.Fatalf("expected EAGAIN once retries ran out, got %v", err)
+	}
+
+	conn = &flakyConn{fails: []error{syscall.ENETDOWN}}
+	_, err = newTestSender(conn, 3).Send(testHeader())
+	if err != syscall.ENETDOWN {
+		t.Fatalf("expected a non-retriable error to be returned at once, got %v", err)
+	}
+	if conn.sent != 0 {
+		t.Fatal("resent after a non-retriable error")
+	}
+}
@@ -0,0 +1,186 @@
+package aoe
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	minReadBackoff = 10 * time.Millisecond
+	maxReadBackoff = 5 * time.Second
+)
+
+// frameLoop reads the frames arriving on an interface and hands the
+// well-formed ones on, for a Server or a MultiServer.
+type frameLoop struct {
+	iface     *Interface
+	stop      chan struct{}
+	failFast  bool
+	badFrames *badFrames
+	labels    []string
+	// advertise announces the targets served on the interface once it
+	// comes back up after going down.
+	advertise func(*Interface) error
+	handle    func(addr net.Addr, iface *Interface, f *Frame)
+}
+
+// run reads frames until stop is closed or the interface is.
+func (l *frameLoop) run() error {
+	iface := l.iface
+	clog.Tracef("beginning server loop on %+v", iface)
+	var backoff time.Duration
+	for {
+		// One byte more than the largest valid frame, to tell oversized
+		// frames from ones which just fill the buffer.
+		payload := make([]byte, iface.MTU+frameOverhead+1)
+		n, addr, err := iface.ReadFrom(payload)
+		if l.stopped() {
+			return nil
+		}
+		if err != nil {
+			rlog.Errorf("ReadFrom failed: %v", err)
+			// will be syscall.EBADF if the conn from raw closed
+			if err == syscall.EBADF {
+				break
+			}
+			if l.failFast {
+				return err
+			}
+			backoff *= 2
+			if backoff == 0 {
+				backoff = minReadBackoff
+			}
+			if backoff > maxReadBackoff {
+				backoff = maxReadBackoff
+			}
+			if err := l.waitForInterface(backoff); err != nil {
+				return err
+			}
+			if l.stopped() {
+				return nil
+			}
+			continue
+		}
+		backoff = 0
+
+		src := addr.String()
+		now := time.Now()
+		if l.badFrames.banned(src, now) {
+			promBadFrames.WithLabelValues(append(l.labels, badFrameBanned)...).Inc()
+			continue
+		}
+		if n == len(payload) {
+			// The frame didn't fit, so whatever was read of it
+			// is incomplete.
+			rlog.Warningf("dropping frame from %s larger than the %d byte MTU", src, iface.MTU)
+			l.badFrame(src, now, badFrameOversized)
+			continue
+		}
+
+		// resize payload
+		payload = payload[:n]
+
+		var f Frame
+		err = f.Frame.UnmarshalBinary(payload)
+		if err == nil && !iface.accepts(&f.Frame) {
+			continue
+		}
+		if err == nil {
+			err = f.Header.UnmarshalBinary(f.Frame.Payload)
+		}
+		if err != nil {
+			rlog.Warningf("dropping malformed frame from %s: %v", src, err)
+			l.badFrame(src, now, badFrameMalformed)
+			continue
+		}
+
+		clog.Debugf("recv %d %s %+v", n, addr, f.Header)
+		//clog.Debugf("recv arg %+v", f.Header.Arg)
+
+		l.handle(addr, iface, &f)
+	}
+
+	return nil
+}
+
+// runLoops runs loops at once. It returns when all of them have, with the
+// first error any of them stopped with.
+func runLoops(loops []*frameLoop) error {
+	errs := make(chan error, len(loops))
+	for _, l := range loops {
+		go func(l *frameLoop) {
+			err := l.run()
+			if err != nil && len(loops) > 1 {
+				clog.Errorf("stopped serving on %s: %v", l.iface.Name, err)
+			}
+			errs <- err
+		}(l)
+	}
+	var err error
+	for range loops {
+		if lerr := <-errs; lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+func (l *frameLoop) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// badFrame counts a frame dropped for reason, banning its source if it has
+// sent too many.
+func (l *frameLoop) badFrame(src string, now time.Time, reason string) {
+	promBadFrames.WithLabelValues(append(l.labels, reason)...).Inc()
+	if l.badFrames.record(src, now) {
+		clog.Warningf("ignoring %s for %s after too many bad frames", src, l.badFrames.ban)
+	}
+}
+
+// waitForInterface is called after a failed read. It waits out the backoff,
+// then until the interface is up, and re-advertises if it had gone down. It
+// returns nil once reading can resume or the loop is stopped.
+func (l *frameLoop) waitForInterface(backoff time.Duration) error {
+	iface := l.iface
+	wasDown := false
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-l.stop:
+			return nil
+		}
+		ifc, err := net.InterfaceByName(iface.Name)
+		if err == nil && ifc.Flags&net.FlagUp != 0 {
+			if ifc.Index != iface.Index {
+				// The socket is bound to the old interface and will
+				// never see another frame.
+				return fmt.Errorf("aoe: interface %s was recreated; the server must be restarted", iface.Name)
+			}
+			if wasDown {
+				clog.Infof("interface %s is up again, resuming", iface.Name)
+				if err := l.advertise(iface); err != nil {
+					clog.Errorf("advertisement failed: %v", err)
+				}
+			}
+			return nil
+		}
+		if !wasDown {
+			clog.Warningf("interface %s is down, waiting for it to come back", iface.Name)
+			wasDown = true
+		}
+		if backoff < maxReadBackoff {
+			backoff *= 2
+		}
+		if backoff > maxReadBackoff {
+			backoff = maxReadBackoff
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package aoe
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mdlayher/aoe"
+)
+
+// DefaultMaxInitiators is the number of initiators a server keeps separate
+// statistics for when ServerOptions doesn't say.
+const DefaultMaxInitiators = 64
+
+// otherInitiators labels the statistics of initiators seen after the limit on
+// tracked initiators was reached.
+const otherInitiators = "other"
+
+// ATA command codes, as found in the command/status field of an ATA request.
+const (
+	ataReadSectors     = 0x20
+	ataReadSectorsExt  = 0x24
+	ataWriteSectors    = 0x30
+	ataWriteSectorsExt = 0x34
+	ataDataSetMgmt     = 0x06
+	ataFlushCache      = 0xe7
+	ataFlushCacheExt   = 0xea
+)
+
+// CommandStats counts the ATA commands of one kind and the data they moved.
+type CommandStats struct {
+	Count uint64
+	Bytes uint64
+}
+
+// InitiatorStats breaks down the ATA commands issued by one initiator.
+type InitiatorStats struct {
+	// Addr is the initiator's hardware address. It is nil for the entry
+	// that collects initiators beyond the server's limit.
+	Addr      net.HardwareAddr
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	Read  CommandStats
+	Write CommandStats
+	Flush CommandStats
+	Trim  CommandStats
+	Other CommandStats
+}
+
+func (st *InitiatorStats) command(arg *aoe.ATAArg) (string, *CommandStats, uint64) {
+	n := uint64(arg.SectorCount) * 512
+	switch arg.CmdStatus {
+	case ataReadSectors, ataReadSectorsExt:
+		return "read", &st.Read, n
+	case ataWriteSectors, ataWriteSectorsExt:
+		return "write", &st.Write, n
+	case ataFlushCache, ataFlushCacheExt:
+		return "flush", &st.Flush, 0
+	case ataDataSetMgmt:
+		return "trim", &st.Trim, 0
+	}
+	return "other", &st.Other, 0
+}
+
+// recordATA accounts an ATA command from addr to its initiator.
+func (s *Server) recordATA(addr net.HardwareAddr, arg *aoe.ATAArg) {
+	now := time.Now()
+	key := addr.String()
+
+	s.mut.Lock()
+	st, ok := s.initiators[key]
+	if !ok {
+		if len(s.initiators) >= s.maxInitiators {
+			key = otherInitiators
+			st, ok = s.initiators[key]
+		}
+		if !ok {
+			st = &InitiatorStats{FirstSeen: now}
+			if key != otherInitiators {
+				st.Addr = append(net.HardwareAddr(nil), addr...)
+			}
+			s.initiators[key] = st
+		}
+	}
+	st.LastSeen = now
+	kind, cs, n := st.command(arg)
+	cs.Count++
+	cs.Bytes += n
+	s.mut.Unlock()
+
+	major, minor := strconv.Itoa(int(s.major)), strconv.Itoa(int(s.minor))
+	promInitiatorCommands.WithLabelValues(major, minor, key, kind).Inc()
+	if n != 0 {
+		promInitiatorBytes.WithLabelValues(major, minor, key, kind).Add(float64(n))
+	}
+}
+
+// initiatorLabels returns the metric labels for addr, which are shared with
+// the other untracked initiators if it isn't tracked.
+func (s *Server) initiatorLabels(addr net.HardwareAddr) []string {
+	key := addr.String()
+	s.mut.Lock()
+	if _, ok := s.initiators[key]; !ok && len(s.initiators) >= s.maxInitiators {
+		key = otherInitiators
+	}
+	s.mut.Unlock()
+	return []string{strconv.Itoa(int(s.major)), strconv.Itoa(int(s.minor)), key}
+}
+
+// Initiators returns the ATA command statistics of each initiator that has
+// used the server, ordered by address. Once the server's limit on tracked
+// initiators is reached, any new ones are counted together in a final entry
+// with a nil Addr.
+func (s *Server) Initiators() []InitiatorStats {
+	s.mut.Lock()
+	out := make([]InitiatorStats, 0, len(s.initiators))
+	for _, st := range s.initiators {
+		out = append(out, *st)
+	}
+	s.mut.Unlock()
+	sort.Sort(initiatorsByAddr(out))
+	return out
+}
+
+type initiatorsByAddr []InitiatorStats
+
+func (b initiatorsByAddr) Len() int      { return len(b) }
+func (b initiatorsByAddr) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b initiatorsByAddr) Less(i, j int) bool {
+	switch {
+	case b[i].Addr == nil:
+		return false
+	case b[j].Addr == nil:
+		return true
+	}
+	return bytes.Compare(b[i].Addr, b[j].Addr) < 0
+}
@@ -0,0 +1,41 @@
+package aoe
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mdlayher/aoe"
+)
+
+func TestServerInitiators(t *testing.T) {
+	s := &Server{
+		maxInitiators: 2,
+		initiators:    make(map[string]*InitiatorStats),
+	}
+	a := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	b := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	c := net.HardwareAddr{0, 0, 0, 0, 0, 3}
+
+	s.recordATA(a, &aoe.ATAArg{CmdStatus: ataReadSectorsExt, SectorCount: 8})
+	s.recordATA(a, &aoe.ATAArg{CmdStatus: ataReadSectors, SectorCount: 2})
+	s.recordATA(b, &aoe.ATAArg{CmdStatus: ataWriteSectorsExt, SectorCount: 1})
+	s.recordATA(b, &aoe.ATAArg{CmdStatus: ataFlushCacheExt})
+	s.recordATA(c, &aoe.ATAArg{CmdStatus: ataWriteSectors, SectorCount: 4})
+
+	got := s.Initiators()
+	if len(got) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(got))
+	}
+	if got[0].Addr.String() != b.String() || got[1].Addr.String() != a.String() || got[2].Addr != nil {
+		t.Fatalf("unexpected order: %v, %v, %v", got[0].Addr, got[1].Addr, got[2].Addr)
+	}
+	if got[1].Read != (CommandStats{Count: 2, Bytes: 10 * 512}) {
+		t.Fatalf("unexpected reads for %s: %+v", a, got[1].Read)
+	}
+	if got[0].Write != (CommandStats{Count: 1, Bytes: 512}) || got[0].Flush.Count != 1 {
+		t.Fatalf("unexpected stats for %s: %+v", b, got[0])
+	}
+	if got[2].Write != (CommandStats{Count: 1, Bytes: 4 * 512}) {
+		t.Fatalf("initiator beyond the limit not counted as other: %+v", got[2])
+	}
+}
@@ -1,8 +1,11 @@
 package aoe
 
 import (
+	"fmt"
 	"net"
 
+	"github.com/mdlayher/aoe"
+	"github.com/mdlayher/ethernet"
 	"github.com/mdlayher/raw"
 )
 
@@ -10,19 +13,72 @@ import (
 type Interface struct {
 	*net.Interface
 	net.PacketConn
+
+	// EtherType is the protocol number the interface sends and receives
+	// frames with.
+	EtherType ethernet.EtherType
+
+	// VLAN is the 802.1Q tag the interface sends frames with, if it is
+	// on a VLAN. Only frames tagged with its ID are then received.
+	VLAN *ethernet.VLAN
 }
 
+// NewInterface opens a raw socket for the standard AoE ethertype on ifname.
 func NewInterface(ifname string) (*Interface, error) {
+	return NewInterfaceWithEtherType(ifname, aoe.EtherType)
+}
+
+// NewInterfaceWithEtherType is like NewInterface but uses a different
+// protocol number, so that a separate AoE fabric can share the network with
+// standard AoE devices. Initiators have to be set up to use the same one.
+func NewInterfaceWithEtherType(ifname string, et ethernet.EtherType) (*Interface, error) {
 	ifc, err := net.InterfaceByName(ifname)
 	if err != nil {
 		return nil, err
 	}
 
-	pc, err := raw.ListenPacket(ifc, raw.ProtocolAoE)
+	pc, err := raw.ListenPacket(ifc, raw.Protocol(et))
 	if err != nil {
 		return nil, err
 	}
 
-	ai := &Interface{ifc, pc}
+	ai := &Interface{ifc, pc, et, nil}
 	return ai, nil
 }
+
+// NewVLANInterface is like NewInterfaceWithEtherType, but serves the VLAN
+// with vlan's ID on the untagged interface ifname. Frames are tagged with
+// vlan, including its priority, when sent, and untagged when received.
+//
+// The raw socket receives the tagged frames as they are, so if the network
+// card strips VLAN tags itself, that has to be turned off (on Linux, with
+// "ethtool -K IFNAME rxvlan off").
+func NewVLANInterface(ifname string, et ethernet.EtherType, vlan ethernet.VLAN) (*Interface, error) {
+	if vlan.ID == 0 || vlan.ID >= 0xfff {
+		return nil, fmt.Errorf("aoe: invalid VLAN ID %d", vlan.ID)
+	}
+	if vlan.Priority > 7 {
+		return nil, fmt.Errorf("aoe: invalid VLAN priority %d", vlan.Priority)
+	}
+	ifc, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := raw.ListenPacket(ifc, raw.Protocol(ethernet.EtherTypeVLAN))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Interface{ifc, pc, et, &vlan}, nil
+}
+
+// accepts reports whether a frame f read from the interface is meant for it.
+// Frames on a VLAN arrive on a socket for all tagged frames, so those for
+// other VLANs or protocols are picked out here.
+func (i *Interface) accepts(f *ethernet.Frame) bool {
+	if i.VLAN == nil {
+		return true
+	}
+	return len(f.VLAN) == 1 && f.VLAN[0].ID == i.VLAN.ID && f.EtherType == i.EtherType
+}
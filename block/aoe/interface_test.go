@@ -4,6 +4,9 @@ import (
 	"sync"
 	"syscall"
 	"testing"
+
+	"github.com/mdlayher/aoe"
+	"github.com/mdlayher/ethernet"
 )
 
 func TestInterfaceClose(t *testing.T) {
@@ -36,3 +39,28 @@ func TestInterfaceClose(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestInterfaceAcceptsVLAN(t *testing.T) {
+	iface := &Interface{EtherType: aoe.EtherType}
+	untagged := &ethernet.Frame{EtherType: aoe.EtherType}
+	if !iface.accepts(untagged) {
+		t.Fatal("untagged interface refused a frame")
+	}
+
+	iface.VLAN = &ethernet.VLAN{ID: 10}
+	for _, tt := range []struct {
+		f    *ethernet.Frame
+		want bool
+	}{
+		{untagged, false},
+		{&ethernet.Frame{VLAN: []*ethernet.VLAN{{ID: 10}}, EtherType: aoe.EtherType}, true},
+		{&ethernet.Frame{VLAN: []*ethernet.VLAN{{ID: 10, Priority: 5}}, EtherType: aoe.EtherType}, true},
+		{&ethernet.Frame{VLAN: []*ethernet.VLAN{{ID: 11}}, EtherType: aoe.EtherType}, false},
+		{&ethernet.Frame{VLAN: []*ethernet.VLAN{{ID: 10}}, EtherType: ethernet.EtherTypeIPv4}, false},
+		{&ethernet.Frame{VLAN: []*ethernet.VLAN{{ID: 20}, {ID: 10}}, EtherType: aoe.EtherType}, false},
+	} {
+		if got := iface.accepts(tt.f); got != tt.want {
+			t.Fatalf("VLAN %v, ethertype %#04x: accepted=%v, expected %v", tt.f.VLAN, uint16(tt.f.EtherType), got, tt.want)
+		}
+	}
+}
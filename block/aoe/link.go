@@ -0,0 +1,64 @@
+package aoe
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// linkPollInterval is how often a server checks whether the links of its
+// interfaces are up.
+const linkPollInterval = time.Second
+
+// sysClassNet is where Linux reports the state of network interfaces.
+var sysClassNet = "/sys/class/net"
+
+// linkUp reports whether the interface named name is up and, where the
+// system says, has a carrier. An interface which can't be found is down.
+func linkUp(name string) bool {
+	ifc, err := net.InterfaceByName(name)
+	if err != nil || ifc.Flags&net.FlagUp == 0 {
+		return false
+	}
+	b, err := ioutil.ReadFile(filepath.Join(sysClassNet, name, "operstate"))
+	if err != nil {
+		// Not Linux, or nothing more to go on.
+		return true
+	}
+	switch strings.TrimSpace(string(b)) {
+	case "up", "unknown":
+		// Virtual interfaces without a carrier report unknown.
+		return true
+	}
+	return false
+}
+
+// watchLink checks the link of iface every linkPollInterval until the server
+// is stopped, and re-advertises the server whenever it comes back up, so that
+// initiators which lost sight of it across a cable pull or switch restart
+// find it again straight away.
+func (s *Server) watchLink(iface *Interface) {
+	t := time.NewTicker(linkPollInterval)
+	defer t.Stop()
+	up := true
+	for {
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+		now := linkUp(iface.Name)
+		switch {
+		case up && !now:
+			clog.Warningf("link on %s is down", iface.Name)
+		case !up && now:
+			clog.Infof("link on %s is up again, re-advertising", iface.Name)
+			if err := s.advertise(iface); err != nil {
+				clog.Errorf("advertisement on %s failed: %v", iface.Name, err)
+			}
+		}
+		up = now
+	}
+}
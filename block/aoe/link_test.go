@@ -0,0 +1,39 @@
+package aoe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aoe-link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { sysClassNet = orig }(sysClassNet)
+	sysClassNet = dir
+
+	if linkUp("torus-no-such-interface") {
+		t.Fatal("missing interface reported up")
+	}
+	if !linkUp("lo") {
+		t.Fatal("lo reported down without an operstate")
+	}
+	os.Mkdir(filepath.Join(dir, "lo"), 0755)
+	for state, want := range map[string]bool{
+		"up\n":             true,
+		"unknown\n":        true,
+		"down\n":           false,
+		"lowerlayerdown\n": false,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "lo", "operstate"), []byte(state), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := linkUp("lo"); got != want {
+			t.Fatalf("operstate %q: got up=%v, expected %v", state, got, want)
+		}
+	}
+}
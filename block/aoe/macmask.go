@@ -0,0 +1,119 @@
+package aoe
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/mdlayher/aoe"
+)
+
+// maxMACMask is the most addresses a MAC mask list may hold, the most a
+// response can carry.
+const maxMACMask = 255
+
+// maskAllows reports whether the initiator addr may use the server: the MAC
+// mask list is empty, or lists it.
+func (s *Server) maskAllows(addr net.HardwareAddr) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if len(s.macMask) == 0 {
+		return true
+	}
+	for _, m := range s.macMask {
+		if bytes.Equal(m, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// initiatorAllowed reports whether the initiator addr may use the server: it
+// is on the server's own allow list, if there is one, and the MAC mask list
+// allows it.
+func (s *Server) initiatorAllowed(addr net.HardwareAddr) bool {
+	if len(s.allow) != 0 && indexMAC(s.allow, addr) < 0 {
+		return false
+	}
+	return s.maskAllows(addr)
+}
+
+// serveMACMask answers a MAC mask list command, reading the list or editing
+// it. Edits are stored with the volume before they take effect, so they last
+// beyond this server.
+func (s *Server) serveMACMask(sender *FrameSender, hdr *aoe.Header, arg *aoe.MACMaskArg) (int, error) {
+	s.mut.Lock()
+	mask := s.macMask
+	s.mut.Unlock()
+
+	var merr aoe.MACMaskError
+	switch arg.Command {
+	case aoe.MACMaskCommandRead:
+	case aoe.MACMaskCommandEdit:
+		var edited []net.HardwareAddr
+		edited, merr = editMACMask(mask, arg.Directives)
+		if merr != 0 {
+			break
+		}
+		if err := s.dfs.SetMACMask(edited); err != nil {
+			rlog.Errorf("couldn't store MAC mask list: %v", err)
+			merr = aoe.MACMaskErrorUnspecified
+			break
+		}
+		s.mut.Lock()
+		s.macMask = edited
+		s.mut.Unlock()
+		mask = edited
+		clog.Infof("MAC mask list set to %v by %s", mask, sender.dst)
+	default:
+		return sender.SendError(aoe.ErrorUnrecognizedCommandCode)
+	}
+
+	out := &aoe.MACMaskArg{
+		Command: arg.Command,
+		Error:   merr,
+	}
+	for _, m := range mask {
+		out.Directives = append(out.Directives, &aoe.Directive{
+			Command: aoe.DirectiveCommandNone,
+			MAC:     m,
+		})
+	}
+	hdr.Arg = out
+	return sender.Send(hdr)
+}
+
+// editMACMask returns mask with directives applied in order. If any of them
+// can't be, mask is returned unchanged, with the error to report.
+func editMACMask(mask []net.HardwareAddr, directives []*aoe.Directive) ([]net.HardwareAddr, aoe.MACMaskError) {
+	out := append([]net.HardwareAddr(nil), mask...)
+	for _, d := range directives {
+		i := indexMAC(out, d.MAC)
+		switch d.Command {
+		case aoe.DirectiveCommandNone:
+		case aoe.DirectiveCommandAdd:
+			if i >= 0 {
+				continue
+			}
+			if len(out) >= maxMACMask {
+				return mask, aoe.MACMaskErrorListFull
+			}
+			out = append(out, d.MAC)
+		case aoe.DirectiveCommandDelete:
+			if i >= 0 {
+				out = append(out[:i], out[i+1:]...)
+			}
+		default:
+			return mask, aoe.MACMaskErrorBadDirCommand
+		}
+	}
+	return out, 0
+}
+
+func indexMAC(mask []net.HardwareAddr, addr net.HardwareAddr) int {
+	for i, m := range mask {
+		if bytes.Equal(m, addr) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,65 @@
+package aoe
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mdlayher/aoe"
+)
+
+func TestEditMACMask(t *testing.T) {
+	a := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	b := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+
+	mask, merr := editMACMask(nil, []*aoe.Directive{
+		{Command: aoe.DirectiveCommandAdd, MAC: a},
+		{Command: aoe.DirectiveCommandAdd, MAC: b},
+		{Command: aoe.DirectiveCommandAdd, MAC: a},
+	})
+	if merr != 0 || len(mask) != 2 {
+		t.Fatalf("expected both addresses listed once, got %v, error %d", mask, merr)
+	}
+
+	edited, merr := editMACMask(mask, []*aoe.Directive{
+		{Command: aoe.DirectiveCommandDelete, MAC: a},
+		{Command: 7, MAC: b},
+	})
+	if merr != aoe.MACMaskErrorBadDirCommand {
+		t.Fatalf("expected a bad directive error, got %d", merr)
+	}
+	if len(edited) != 2 {
+		t.Fatalf("failed edit changed the list to %v", edited)
+	}
+
+	edited, merr = editMACMask(mask, []*aoe.Directive{
+		{Command: aoe.DirectiveCommandDelete, MAC: a},
+	})
+	if merr != 0 || len(edited) != 1 || edited[0].String() != b.String() {
+		t.Fatalf("expected only %s left, got %v, error %d", b, edited, merr)
+	}
+	if len(mask) != 2 {
+		t.Fatal("edit changed the original list")
+	}
+}
+
+func TestInitiatorAllowed(t *testing.T) {
+	a := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	b := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	c := net.HardwareAddr{0, 0, 0, 0, 0, 3}
+	for _, tt := range []struct {
+		allow, mask []net.HardwareAddr
+		want        []bool
+	}{
+		{nil, nil, []bool{true, true, true}},
+		{[]net.HardwareAddr{a, b}, nil, []bool{true, true, false}},
+		{nil, []net.HardwareAddr{b}, []bool{false, true, false}},
+		{[]net.HardwareAddr{a, b}, []net.HardwareAddr{b, c}, []bool{false, true, false}},
+	} {
+		s := &Server{allow: tt.allow, macMask: tt.mask}
+		for i, addr := range []net.HardwareAddr{a, b, c} {
+			if got := s.initiatorAllowed(addr); got != tt.want[i] {
+				t.Fatalf("allow %v, mask %v: %s allowed=%v, expected %v", tt.allow, tt.mask, addr, got, tt.want[i])
+			}
+		}
+	}
+}
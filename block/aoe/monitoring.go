@@ -0,0 +1,114 @@
+package aoe
+
+import (
+	"strconv"
+
+	"github.com/mdlayher/aoe"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promServerStartTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_aoe_server_start_time_seconds",
+		Help: "Unix time at which the AoE server started serving",
+	}, []string{"interface", "major", "minor"})
+	promLastAdvertiseTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_aoe_last_advertise_time_seconds",
+		Help: "Unix time of the AoE server's last successful advertisement",
+	}, []string{"interface", "major", "minor"})
+	promAdvertiseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_advertise_failures_total",
+		Help: "Number of times the AoE server failed to advertise itself",
+	}, []string{"interface", "major", "minor"})
+	promInitiatorCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_initiator_commands_total",
+		Help: "Number of ATA commands served, by initiator and kind of command",
+	}, []string{"major", "minor", "initiator", "command"})
+	promInitiatorBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_initiator_bytes_total",
+		Help: "Bytes read and written by ATA commands, by initiator and kind of command",
+	}, []string{"major", "minor", "initiator", "command"})
+	promBadFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_bad_frames_total",
+		Help: "Number of frames dropped unread, because they were oversized or malformed or their source was banned for sending too many such frames",
+	}, []string{"interface", "major", "minor", "reason"})
+	promInitiatorThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_initiator_throttled_total",
+		Help: "Number of ATA commands dropped because the initiator had too many in flight",
+	}, []string{"major", "minor", "initiator"})
+	promInitiatorQuiesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_initiator_quiesced_total",
+		Help: "Number of ATA commands dropped because the initiator was quiesced",
+	}, []string{"major", "minor", "initiator"})
+	promFramesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_frames_received_total",
+		Help: "Number of AoE frames received for the AoE server, by command",
+	}, []string{"interface", "major", "minor", "command"})
+	promErrorReplies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_error_replies_total",
+		Help: "Number of error responses sent by the AoE server, by AoE error",
+	}, []string{"major", "minor", "error"})
+	promFrameSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "torus_aoe_frame_seconds",
+		Help:    "Histogram of the time taken to serve an AoE frame, from handling it to sending the response, by command",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"major", "minor", "command"})
+	promDisallowedFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_disallowed_frames_total",
+		Help: "Number of frames from initiators not allowed to use the AoE server",
+	}, []string{"major", "minor"})
+	promWorkerDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_aoe_worker_drops_total",
+		Help: "Number of ATA commands dropped because the worker assigned them was backed up",
+	}, []string{"interface", "major", "minor"})
+)
+
+func init() {
+	prometheus.MustRegister(promServerStartTime)
+	prometheus.MustRegister(promLastAdvertiseTime)
+	prometheus.MustRegister(promAdvertiseFailures)
+	prometheus.MustRegister(promInitiatorCommands)
+	prometheus.MustRegister(promInitiatorBytes)
+	prometheus.MustRegister(promInitiatorThrottled)
+	prometheus.MustRegister(promInitiatorQuiesced)
+	prometheus.MustRegister(promBadFrames)
+	prometheus.MustRegister(promWorkerDrops)
+	prometheus.MustRegister(promDisallowedFrames)
+	prometheus.MustRegister(promFramesReceived)
+	prometheus.MustRegister(promErrorReplies)
+	prometheus.MustRegister(promFrameSeconds)
+}
+
+// commandLabel names an AoE command in metrics.
+func commandLabel(c aoe.Command) string {
+	switch c {
+	case aoe.CommandIssueATACommand:
+		return "ata"
+	case aoe.CommandQueryConfigInformation:
+		return "config"
+	case aoe.CommandMACMaskList:
+		return "mac_mask"
+	case aoe.CommandReserveRelease:
+		return "reserve_release"
+	}
+	return "other"
+}
+
+// errorLabel names an AoE error in metrics.
+func errorLabel(e aoe.Error) string {
+	switch e {
+	case aoe.ErrorUnrecognizedCommandCode:
+		return "unrecognized_command"
+	case aoe.ErrorBadArgumentParameter:
+		return "bad_argument"
+	case aoe.ErrorDeviceUnavailable:
+		return "device_unavailable"
+	case aoe.ErrorConfigStringPresent:
+		return "config_string_present"
+	case aoe.ErrorUnsupportedVersion:
+		return "unsupported_version"
+	case aoe.ErrorTargetIsReserved:
+		return "target_reserved"
+	}
+	return strconv.Itoa(int(e))
+}
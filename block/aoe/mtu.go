@@ -0,0 +1,49 @@
+package aoe
+
+import (
+	"fmt"
+)
+
+// ataHeaderSize is the size of the AoE and ATA headers in front of the data
+// in a frame carrying an ATA command or its response.
+const ataHeaderSize = 10 + 12
+
+// maxSectorCount is the most sectors a config reply can advertise.
+const maxSectorCount = 255
+
+// mtuSectors returns how many 512 byte sectors fit in one frame on an
+// interface with the given MTU, along with the headers.
+func mtuSectors(mtu int) int {
+	n := (mtu - ataHeaderSize) / 512
+	if n > maxSectorCount {
+		n = maxSectorCount
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// sectorsPerFrame returns how many sectors initiators may read or write in
+// one command on iface: as many as fit its MTU, up to the server's limit.
+func (s *Server) sectorsPerFrame(iface *Interface) int {
+	n := mtuSectors(iface.MTU)
+	if s.maxSectors > 0 && s.maxSectors < n {
+		n = s.maxSectors
+	}
+	return n
+}
+
+// checkMTU makes sure iface can carry the server's commands, and that its
+// MTU allows the sectors per frame asked for.
+func (s *Server) checkMTU(iface *Interface) error {
+	n := mtuSectors(iface.MTU)
+	if n == 0 {
+		return fmt.Errorf("aoe: the %d byte MTU of interface %s is too small to carry a sector", iface.MTU, iface.Name)
+	}
+	if s.maxSectors > n {
+		return fmt.Errorf("aoe: the %d byte MTU of interface %s carries at most %d sectors per frame, fewer than the %d asked for; raise the MTU for jumbo frames, or ask for fewer", iface.MTU, iface.Name, n, s.maxSectors)
+	}
+	clog.Infof("serving on %s with a %d byte MTU, %d sectors per frame", iface.Name, iface.MTU, s.sectorsPerFrame(iface))
+	return nil
+}
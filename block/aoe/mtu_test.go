@@ -0,0 +1,20 @@
+package aoe
+
+import "testing"
+
+func TestMTUSectors(t *testing.T) {
+	for _, tt := range []struct {
+		mtu     int
+		sectors int
+	}{
+		{mtu: 1500, sectors: 2},
+		{mtu: 9000, sectors: 17},
+		{mtu: 512, sectors: 0},
+		{mtu: 65535, sectors: 127},
+		{mtu: 1 << 20, sectors: 255},
+	} {
+		if got := mtuSectors(tt.mtu); got != tt.sectors {
+			t.Errorf("%d byte MTU: expected %d sectors, got %d", tt.mtu, tt.sectors, got)
+		}
+	}
+}
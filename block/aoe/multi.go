@@ -0,0 +1,201 @@
+package aoe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+	"golang.org/x/net/context"
+)
+
+// broadcastMajor and broadcastMinor in a command's header address it to
+// every major or minor address.
+const (
+	broadcastMajor = 0xffff
+	broadcastMinor = 0xff
+)
+
+// MultiServer exports several volumes on the same interfaces, each through a
+// Server at its own address. It reads each interface once and hands every
+// frame to the servers addressed in its header, so a gateway exporting many
+// volumes needs one raw socket per interface rather than one per volume.
+type MultiServer struct {
+	servers   []*Server
+	etherType ethernet.EtherType
+	failFast  bool
+	badFrames *badFrames
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	mut    sync.Mutex
+	ifaces []*Interface
+}
+
+// NewMultiServer combines servers created by NewServer, to be served together.
+// They must have different addresses and the same EtherType. The interfaces
+// are read as the FailFast and BadFrameLimit options of the first one say;
+// each server otherwise keeps its own options.
+func NewMultiServer(servers ...*Server) (*MultiServer, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("aoe: no servers to serve")
+	}
+	seen := make(map[string]bool)
+	for _, s := range servers {
+		addr := fmt.Sprintf("%d.%d", s.major, s.minor)
+		if seen[addr] {
+			return nil, fmt.Errorf("aoe: more than one server has address %s", addr)
+		}
+		seen[addr] = true
+		if s.etherType != servers[0].etherType {
+			return nil, fmt.Errorf("aoe: server %s uses ethertype %#04x but server %d.%d uses %#04x", addr, uint16(s.etherType), servers[0].major, servers[0].minor, uint16(servers[0].etherType))
+		}
+	}
+	return &MultiServer{
+		servers:   servers,
+		etherType: servers[0].etherType,
+		failFast:  servers[0].failFast,
+		badFrames: servers[0].badFrames,
+		stop:      make(chan struct{}),
+	}, nil
+}
+
+// Servers returns the servers the MultiServer serves.
+func (m *MultiServer) Servers() []*Server {
+	return append([]*Server(nil), m.servers...)
+}
+
+// Serve exports the volumes on iface until the MultiServer is shut down or the
+// interface is closed.
+func (m *MultiServer) Serve(iface *Interface) error {
+	return m.ServeInterfaces(iface)
+}
+
+// ServeInterfaces exports the volumes on several interfaces at once, as
+// Server.ServeInterfaces does for one.
+func (m *MultiServer) ServeInterfaces(ifaces ...*Interface) error {
+	if len(ifaces) == 0 {
+		return errors.New("aoe: no interfaces to serve on")
+	}
+	for _, s := range m.servers {
+		if err := s.checkInterfaces(ifaces); err != nil {
+			return err
+		}
+	}
+
+	m.mut.Lock()
+	if m.stopped() {
+		m.mut.Unlock()
+		return nil
+	}
+	m.ifaces = ifaces
+	m.mut.Unlock()
+
+	for _, s := range m.servers {
+		if _, err := s.start(ifaces); err != nil {
+			return err
+		}
+	}
+
+	loops := make([]*frameLoop, len(ifaces))
+	for i, iface := range ifaces {
+		loops[i] = &frameLoop{
+			iface:     iface,
+			stop:      m.stop,
+			failFast:  m.failFast,
+			badFrames: m.badFrames,
+			// Frames are dropped before it's known which server
+			// they are for.
+			labels:    []string{iface.Name, "", ""},
+			advertise: m.advertise,
+			handle:    m.route,
+		}
+	}
+	return runLoops(loops)
+}
+
+// route hands the frame f to each server it is addressed to.
+func (m *MultiServer) route(addr net.Addr, iface *Interface, f *Frame) {
+	for _, s := range m.servers {
+		if !s.addressedBy(f) {
+			continue
+		}
+		// Servers answer by rewriting the header, so each needs its
+		// own.
+		g := *f
+		s.receive(addr, iface, &g)
+	}
+}
+
+// addressedBy reports whether the frame f is addressed to the server.
+func (s *Server) addressedBy(f *Frame) bool {
+	return (f.Header.Major == s.major || f.Header.Major == broadcastMajor) &&
+		(f.Header.Minor == s.minor || f.Header.Minor == broadcastMinor)
+}
+
+// advertise announces every server on iface, returning the first error.
+func (m *MultiServer) advertise(iface *Interface) error {
+	var err error
+	for _, s := range m.servers {
+		if aerr := s.advertise(iface); aerr != nil && err == nil {
+			err = aerr
+		}
+	}
+	return err
+}
+
+func (m *MultiServer) stopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *MultiServer) halt() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Shutdown stops reading the interfaces and shuts down every server as
+// Server.Shutdown does, at once. It returns the first error any of them
+// returned.
+func (m *MultiServer) Shutdown(ctx context.Context) error {
+	m.mut.Lock()
+	m.halt()
+	ifaces := m.ifaces
+	m.mut.Unlock()
+	for _, iface := range ifaces {
+		iface.SetReadDeadline(time.Now())
+	}
+
+	errs := make(chan error, len(m.servers))
+	for _, s := range m.servers {
+		go func(s *Server) {
+			errs <- s.Shutdown(ctx)
+		}(s)
+	}
+	var err error
+	for range m.servers {
+		if serr := <-errs; serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Close stops reading the interfaces and closes every server at once.
+func (m *MultiServer) Close() error {
+	m.halt()
+	var err error
+	for _, s := range m.servers {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package aoe
+
+import "testing"
+
+func TestMultiServerAddressing(t *testing.T) {
+	a := &Server{major: 1, minor: 1}
+	b := &Server{major: 1, minor: 2}
+	c := &Server{major: 2, minor: 1}
+	if _, err := NewMultiServer(a, b, &Server{major: 1, minor: 2}); err == nil {
+		t.Fatal("combined two servers with the same address")
+	}
+	if _, err := NewMultiServer(a, b, c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		major uint16
+		minor uint8
+		want  []*Server
+	}{
+		{1, 2, []*Server{b}},
+		{1, broadcastMinor, []*Server{a, b}},
+		{broadcastMajor, 1, []*Server{a, c}},
+		{broadcastMajor, broadcastMinor, []*Server{a, b, c}},
+		{3, 1, nil},
+	} {
+		f := &Frame{}
+		f.Header.Major = tt.major
+		f.Header.Minor = tt.minor
+		var got []*Server
+		for _, s := range []*Server{a, b, c} {
+			if s.addressedBy(f) {
+				got = append(got, s)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%d.%d: addressed %d servers, expected %d", tt.major, tt.minor, len(got), len(tt.want))
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%d.%d: addressed %d.%d, expected %d.%d", tt.major, tt.minor, got[i].major, got[i].minor, tt.want[i].major, tt.want[i].minor)
+			}
+		}
+	}
+}
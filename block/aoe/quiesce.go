@@ -0,0 +1,130 @@
+package aoe
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Quiesce stops serving ATA commands from the initiator addr, for instance
+// while the VM using the volume is live-migrated to another host. Commands it
+// sends from then on are dropped unanswered, so that it retransmits them once
+// resumed. Quiesce returns once the commands from addr already being served
+// have completed and the volume has been synced, so that everything addr
+// wrote is stored.
+func (s *Server) Quiesce(addr net.HardwareAddr) error {
+	key := addr.String()
+	s.mut.Lock()
+	if s.quiesced == nil {
+		s.quiesced = make(map[string]bool)
+	}
+	s.quiesced[key] = true
+	for s.commands[key] > 0 {
+		s.drainedCond().Wait()
+	}
+	s.mut.Unlock()
+	clog.Infof("quiesced initiator %s", addr)
+	return s.dev.Sync()
+}
+
+// Resume serves commands from the initiator addr again.
+func (s *Server) Resume(addr net.HardwareAddr) {
+	s.mut.Lock()
+	delete(s.quiesced, addr.String())
+	s.mut.Unlock()
+	clog.Infof("resumed initiator %s", addr)
+}
+
+// Transfer hands the volume over from the quiesced initiator from to the
+// initiator to, once the VM using it has moved between their hosts. to is
+// resumed if it was quiesced, while from stays quiesced, so that nothing the
+// old host sends after the handoff reaches the volume; Resume lets it back.
+func (s *Server) Transfer(from, to net.HardwareAddr) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !s.quiesced[from.String()] {
+		return fmt.Errorf("aoe: initiator %s must be quiesced before its volume is transferred", from)
+	}
+	delete(s.quiesced, to.String())
+	clog.Infof("transferred volume from initiator %s to %s", from, to)
+	return nil
+}
+
+// Quiesced returns the initiators which are quiesced, in address order.
+func (s *Server) Quiesced() []net.HardwareAddr {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	var out []net.HardwareAddr
+	for key := range s.quiesced {
+		addr, err := net.ParseMAC(key)
+		if err == nil {
+			out = append(out, addr)
+		}
+	}
+	sort.Sort(byAddr(out))
+	return out
+}
+
+type byAddr []net.HardwareAddr
+
+func (a byAddr) Len() int           { return len(a) }
+func (a byAddr) Less(i, j int) bool { return bytes.Compare(a[i], a[j]) < 0 }
+func (a byAddr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// beginCommand marks an ATA command from addr as being served, unless addr is
+// quiesced or the server is shutting down, in which case it returns false and
+// the command must be dropped.
+// Each command begun must be ended with endCommand.
+func (s *Server) beginCommand(addr net.HardwareAddr) bool {
+	key := addr.String()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.quiesced[key] || s.shutdown {
+		return false
+	}
+	if s.commands == nil {
+		s.commands = make(map[string]int)
+	}
+	s.commands[key]++
+	return true
+}
+
+func (s *Server) endCommand(addr net.HardwareAddr) {
+	key := addr.String()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.commands[key]--
+	if s.commands[key] == 0 {
+		delete(s.commands, key)
+		s.drainedCond().Broadcast()
+	}
+}
+
+// holdCommand keeps a command from addr which timed out counted as being
+// served until the device operations abandoned so far return, so that Quiesce
+// and Shutdown don't go ahead while they may still change the volume. It is
+// called while the command is still counted.
+func (s *Server) holdCommand(addr net.HardwareAddr) {
+	if s.timeouts == nil {
+		return
+	}
+	settled := s.timeouts.settled()
+	s.mut.Lock()
+	s.commands[addr.String()]++
+	s.mut.Unlock()
+	go func() {
+		<-settled
+		s.endCommand(addr)
+	}()
+}
+
+// drainedCond returns the condition signalled when an initiator has no more
+// commands being served. s.mut must be held.
+func (s *Server) drainedCond() *sync.Cond {
+	if s.drained == nil {
+		s.drained = sync.NewCond(&s.mut)
+	}
+	return s.drained
+}
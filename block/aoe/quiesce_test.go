@@ -0,0 +1,116 @@
+package aoe
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type syncCounter struct {
+	Device
+	syncs  int
+	closed bool
+}
+
+func (d *syncCounter) Sync() error {
+	d.syncs++
+	return nil
+}
+
+func (d *syncCounter) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestQuiesce(t *testing.T) {
+	dev := &syncCounter{}
+	s := &Server{dev: dev}
+	a := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	b := net.HardwareAddr{0, 0, 0, 0, 0, 2}
+
+	if !s.beginCommand(a) {
+		t.Fatal("command refused before quiescing")
+	}
+	done := make(chan error)
+	go func() { done <- s.Quiesce(a) }()
+	select {
+	case <-done:
+		t.Fatal("quiesce returned with a command in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if s.beginCommand(a) {
+		t.Fatal("command accepted while quiescing")
+	}
+	if !s.beginCommand(b) {
+		t.Fatal("other initiator's command refused")
+	}
+	s.endCommand(b)
+	s.endCommand(a)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if dev.syncs != 1 {
+		t.Fatalf("expected the device synced once, got %d", dev.syncs)
+	}
+
+	if err := s.Transfer(b, a); err == nil {
+		t.Fatal("transferred from an initiator which wasn't quiesced")
+	}
+	if err := s.Quiesce(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Transfer(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if !s.beginCommand(b) || s.beginCommand(a) {
+		t.Fatal("transfer didn't move the volume to the new initiator")
+	}
+	s.endCommand(b)
+	if q := s.Quiesced(); len(q) != 1 || q[0].String() != a.String() {
+		t.Fatalf("expected only %s quiesced, got %v", a, q)
+	}
+	s.Resume(a)
+	if !s.beginCommand(a) {
+		t.Fatal("command refused after resuming")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dev := &syncCounter{}
+	s := &Server{dev: dev, stop: make(chan struct{})}
+	a := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+
+	if !s.beginCommand(a) {
+		t.Fatal("command refused before shutting down")
+	}
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with a command in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if s.beginCommand(a) {
+		t.Fatal("command accepted while shutting down")
+	}
+	if !s.stopped() {
+		t.Fatal("server not stopped")
+	}
+	s.endCommand(a)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if dev.syncs != 1 || !dev.closed {
+		t.Fatalf("expected the device synced once and closed, got %d syncs, closed %v", dev.syncs, dev.closed)
+	}
+
+	s = &Server{dev: &syncCounter{}, stop: make(chan struct{})}
+	s.beginCommand(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package aoe
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/mdlayher/aoe"
+)
+
+// reservationRefresh is how often a server re-reads the volume's reservation
+// and config string, to pick up changes made through other servers exporting
+// it, and its size, to pick up the volume being grown.
+const reservationRefresh = 2 * time.Second
+
+var errReserved = errors.New("aoe: target is reserved by another initiator")
+
+// reservationAllows reports whether the initiator addr may issue ATA
+// commands: nobody holds the reservation, or addr is among those who do.
+func (s *Server) reservationAllows(addr net.HardwareAddr) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return len(s.reservation) == 0 || indexMAC(s.reservation, addr) >= 0
+}
+
+// serveReserveRelease answers a reserve/release command. Setting the
+// reservation succeeds if it is free or the sender holds it, and an empty
+// list releases it; forcing it succeeds regardless. The reservation is
+// changed in the cluster metadata, so it holds on every server exporting the
+// volume.
+func (s *Server) serveReserveRelease(sender *FrameSender, hdr *aoe.Header, arg *aoe.ReserveReleaseArg) (int, error) {
+	var holders []net.HardwareAddr
+	var err error
+	switch arg.Command {
+	case aoe.ReserveReleaseCommandRead:
+		holders, err = s.dfs.Reservation()
+	case aoe.ReserveReleaseCommandSet, aoe.ReserveReleaseCommandForceSet:
+		force := arg.Command == aoe.ReserveReleaseCommandForceSet
+		holders, err = s.dfs.UpdateReservation(func(cur []net.HardwareAddr) ([]net.HardwareAddr, error) {
+			if !force && len(cur) != 0 && indexMAC(cur, sender.dst) < 0 {
+				return nil, errReserved
+			}
+			return arg.MACs, nil
+		})
+		if err == nil {
+			clog.Infof("reservation set to %v by %s", holders, sender.dst)
+		}
+	default:
+		return sender.SendError(aoe.ErrorUnrecognizedCommandCode)
+	}
+	if err == errReserved {
+		s.setReservation(holders)
+		return sender.SendError(aoe.ErrorTargetIsReserved)
+	}
+	if err != nil {
+		rlog.Errorf("reserve/release failed: %v", err)
+		return sender.SendError(aoe.ErrorDeviceUnavailable)
+	}
+	s.setReservation(holders)
+
+	hdr.Arg = &aoe.ReserveReleaseArg{
+		Command: arg.Command,
+		MACs:    holders,
+	}
+	return sender.Send(hdr)
+}
+
+func (s *Server) setReservation(holders []net.HardwareAddr) {
+	s.mut.Lock()
+	s.reservation = holders
+	s.mut.Unlock()
+}
+
+// refreshReservation re-reads the reservation and config string every
+// reservationRefresh until the server is stopped.
+func (s *Server) refreshReservation() {
+	t := time.NewTicker(reservationRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+		if _, err := s.file.RefreshSize(); err != nil {
+			rlog.Warningf("couldn't refresh volume size: %v", err)
+		}
+		holders, err := s.dfs.Reservation()
+		if err != nil {
+			rlog.Warningf("couldn't refresh reservation: %v", err)
+			continue
+		}
+		s.setReservation(holders)
+		config, err := s.dfs.AoEConfig()
+		if err != nil {
+			rlog.Warningf("couldn't refresh config string: %v", err)
+			continue
+		}
+		s.setConfig(config)
+	}
+}
+
+// fenceAllows reports whether the volume's SCSI persistent reservations
+// allow the ATA command in arg. AoE initiators can't register, so they're
+// refused whatever a reservation keeps from initiators which haven't.
+func (s *Server) fenceAllows(arg *aoe.ATAArg) bool {
+	switch arg.CmdStatus {
+	case ataReadSectors, ataReadSectorsExt:
+		return s.fence.Allows("", false)
+	case ataWriteSectors, ataWriteSectorsExt, ataDataSetMgmt,
+		ataFlushCache, ataFlushCacheExt:
+		return s.fence.Allows("", true)
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package aoe
+
+import (
+	"errors"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"golang.org/x/net/context"
+)
+
+// standbyRetry is how long a standby waits before trying again to take over
+// an address which another server still holds.
+const standbyRetry = time.Second
+
+// NewStandbyServer waits until nothing is exported at the address in options
+// anywhere in the cluster, then creates a Server there as NewServer does.
+// Run on a second node while the volume is exported from another, it takes
+// the export over once that node's server shuts down, or dies and its lease
+// expires. If another standby takes it over first, it waits on that one in
+// turn. It returns ctx's error if ctx is done first.
+func NewStandbyServer(ctx context.Context, b *block.BlockVolume, options *ServerOptions) (*Server, error) {
+	if options == nil {
+		options = DefaultServerOptions
+	}
+	if options.AllocateMinor {
+		return nil, errors.New("aoe: a standby server must be given its minor address")
+	}
+	for {
+		if err := b.WaitAoEExportFree(ctx, options.Major, options.Minor); err != nil {
+			return nil, err
+		}
+		s, err := newServer(b, options)
+		switch err {
+		case nil:
+			clog.Infof("took over AoE %d.%d", options.Major, options.Minor)
+			return s, nil
+		case torus.ErrExists, torus.ErrLocked:
+			// Another standby got there first, or the old server
+			// hasn't released the volume yet.
+		default:
+			return nil, err
+		}
+		select {
+		case <-time.After(standbyRetry):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package aoe
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mdlayher/aoe"
+)
+
+const (
+	// dsmTrim is the DATA SET MANAGEMENT feature bit selecting TRIM.
+	dsmTrim = 0x01
+	// ataStatusReady is the ATA status of a command which succeeded.
+	ataStatusReady = 0x40
+)
+
+var errTrimRange = errors.New("aoe: TRIM range past the end of the device")
+
+// Trimmer is implemented by Devices which can discard ranges of their data,
+// so that the storage behind them is released.
+type Trimmer interface {
+	Trim(off, length int64) error
+}
+
+// trimRange is one range of a DATA SET MANAGEMENT command, in sectors.
+type trimRange struct {
+	lba, sectors int64
+}
+
+// trimRanges decodes the ranges listed in the data of a DATA SET MANAGEMENT
+// command: up to 64 entries per sector, each a 48-bit LBA and a 16-bit sector
+// count, little-endian. Entries with a count of zero are padding.
+func trimRanges(data []byte) []trimRange {
+	var out []trimRange
+	for ; len(data) >= 8; data = data[8:] {
+		e := binary.LittleEndian.Uint64(data)
+		r := trimRange{
+			lba:     int64(e & (1<<48 - 1)),
+			sectors: int64(e >> 48),
+		}
+		if r.sectors != 0 {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// serveTrim answers a DATA SET MANAGEMENT command by trimming the ranges it
+// lists from the volume, which releases the blocks wholly within them, as a
+// TRIM from NBD does.
+func (s *Server) serveTrim(sender *FrameSender, hdr *aoe.Header, arg *aoe.ATAArg) (int, error) {
+	t, ok := s.ataDev.(Trimmer)
+	if arg.ErrFeature&dsmTrim == 0 || !ok {
+		return sender.SendError(aoe.ErrorBadArgumentParameter)
+	}
+	data := arg.Data
+	if max := int(arg.SectorCount) * 512; len(data) > max {
+		data = data[:max]
+	}
+	for _, r := range trimRanges(data) {
+		if err := t.Trim(r.lba*512, r.sectors*512); err != nil {
+			if err == errTrimRange {
+				return sender.SendError(aoe.ErrorBadArgumentParameter)
+			}
+			if err == errDeviceTimeout {
+				rlog.Warningf("TRIM from %s timed out, awaiting retransmit", sender.dst)
+				s.holdCommand(sender.dst)
+				return 0, nil
+			}
+			rlog.Errorf("TRIM failed: %v", err)
+			return sender.SendError(aoe.ErrorDeviceUnavailable)
+		}
+	}
+
+	hdr.Arg = &aoe.ATAArg{
+		CmdStatus: ataStatusReady,
+	}
+	return sender.Send(hdr)
+}
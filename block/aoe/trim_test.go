@@ -0,0 +1,26 @@
+package aoe
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestTrimRanges(t *testing.T) {
+	data := make([]byte, 512)
+	binary.LittleEndian.PutUint64(data[0:], 1<<48|100)
+	binary.LittleEndian.PutUint64(data[8:], 0xffff<<48|(1<<48-1))
+	// A zero count is padding, whatever the LBA.
+	binary.LittleEndian.PutUint64(data[16:], 7)
+	binary.LittleEndian.PutUint64(data[24:], 8<<48|2048)
+
+	got := trimRanges(data)
+	want := []trimRange{{100, 1}, {1<<48 - 1, 0xffff}, {2048, 8}}
+	if len(got) != len(want) {
+		t.Fatalf("got ranges %v, expected %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got ranges %v, expected %v", got, want)
+		}
+	}
+}
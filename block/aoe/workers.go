@@ -0,0 +1,82 @@
+package aoe
+
+import (
+	"hash/fnv"
+)
+
+// workerBacklog is how many ATA commands may wait for each worker before
+// further ones assigned to it are dropped.
+const workerBacklog = 32
+
+// workerPool serves ATA commands on a fixed number of goroutines, so that one
+// slow command doesn't hold up the rest. Each command is assigned to a worker
+// by its initiator and tag, so a retransmitted command is never served
+// alongside or ahead of the one it repeats.
+type workerPool struct {
+	queues []chan queuedFrame
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{queues: make([]chan queuedFrame, n)}
+	for i := range p.queues {
+		p.queues[i] = make(chan queuedFrame, workerBacklog)
+	}
+	return p
+}
+
+// queueFor returns the queue of the worker which serves qf.
+func (p *workerPool) queueFor(qf queuedFrame) chan queuedFrame {
+	h := fnv.New32a()
+	h.Write([]byte(qf.key))
+	h.Write(qf.f.Header.Tag[:])
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// submit queues qf for its worker, unless the worker is backed up, in which
+// case it returns false.
+func (p *workerPool) submit(qf queuedFrame) bool {
+	select {
+	case p.queueFor(qf) <- qf:
+		return true
+	default:
+		return false
+	}
+}
+
+// startWorkers starts the server's workers, which run until it is stopped.
+func (s *Server) startWorkers() {
+	for _, q := range s.workers.queues {
+		go func(q chan queuedFrame) {
+			for {
+				select {
+				case qf := <-q:
+					s.serveFrame(qf)
+				case <-s.stop:
+					return
+				}
+			}
+		}(q)
+	}
+}
+
+// dispatch serves the ATA command qf, on a worker if the server has them.
+func (s *Server) dispatch(qf queuedFrame) {
+	if s.workers == nil {
+		s.serveFrame(qf)
+		return
+	}
+	if !s.workers.submit(qf) {
+		rlog.Warningf("too many commands waiting to be served, dropping one from %s", qf.key)
+		promWorkerDrops.WithLabelValues(s.promLabels(qf.iface)...).Inc()
+		if s.queue != nil {
+			s.queue.done(qf.key)
+		}
+	}
+}
+
+func (s *Server) serveFrame(qf queuedFrame) {
+	s.handleFrame(qf.from, qf.iface, qf.f)
+	if s.queue != nil {
+		s.queue.done(qf.key)
+	}
+}
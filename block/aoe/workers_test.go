@@ -0,0 +1,37 @@
+package aoe
+
+import (
+	"testing"
+)
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	p := newWorkerPool(4)
+	qf := func(key string, tag byte) queuedFrame {
+		f := &Frame{}
+		f.Header.Tag = [4]byte{0, 0, 0, tag}
+		return queuedFrame{key: key, f: f}
+	}
+
+	// A retransmission must land behind the original.
+	a := qf("00:00:00:00:00:01", 1)
+	if p.queueFor(a) != p.queueFor(qf("00:00:00:00:00:01", 1)) {
+		t.Fatal("commands with the same initiator and tag went to different workers")
+	}
+
+	used := make(map[chan queuedFrame]bool)
+	for tag := byte(0); tag < 64; tag++ {
+		used[p.queueFor(qf("00:00:00:00:00:01", tag))] = true
+	}
+	if len(used) < 2 {
+		t.Fatal("an initiator's commands all went to one worker")
+	}
+
+	for i := 0; i < workerBacklog; i++ {
+		if !p.submit(a) {
+			t.Fatalf("command %d dropped with room in the backlog", i)
+		}
+	}
+	if p.submit(a) {
+		t.Fatal("command accepted by a backed up worker")
+	}
+}
@@ -0,0 +1,120 @@
+package block
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/coreos/torus"
+	"golang.org/x/net/context"
+)
+
+// AoEExport records a volume being served over AoE, at the major (shelf) and
+// minor (slot) address initiators know it by. Exports are registered for as
+// long as the lease of the server exporting them lasts, so they disappear
+// when it dies.
+type AoEExport struct {
+	Major   uint16    `json:"major"`
+	Minor   uint8     `json:"minor"`
+	Volume  string    `json:"volume"`
+	Node    string    `json:"node"`
+	Started time.Time `json:"started"`
+}
+
+// Address returns the export's address in the usual MAJOR.MINOR form.
+func (e AoEExport) Address() string {
+	return fmt.Sprintf("%d.%d", e.Major, e.Minor)
+}
+
+// maxAoEMinor is the highest minor address a target may take; 255 addresses
+// every minor.
+const maxAoEMinor = 254
+
+// GetAoEExports returns the volumes exported over AoE across the cluster, by
+// address.
+func GetAoEExports(mds torus.MetadataService) ([]AoEExport, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	out, err := bmds.GetAoEExports()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(exportsByAddress(out))
+	return out, nil
+}
+
+// RegisterAoEExport records that the volume is exported at major.minor. It
+// fails with torus.ErrExists if another export has that address.
+func (s *BlockVolume) RegisterAoEExport(major uint16, minor uint8) (*AoEExport, error) {
+	e := AoEExport{
+		Major:   major,
+		Minor:   minor,
+		Volume:  s.volume.Name,
+		Node:    s.srv.MDS.UUID(),
+		Started: time.Now(),
+	}
+	err := s.mds.RegisterAoEExport(e, s.srv.Lease())
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// AllocateAoEExport registers the volume as exported under major, at the
+// lowest minor address no other export in the cluster has.
+func (s *BlockVolume) AllocateAoEExport(major uint16) (*AoEExport, error) {
+	for {
+		exports, err := s.mds.GetAoEExports()
+		if err != nil {
+			return nil, err
+		}
+		used := make(map[uint8]bool)
+		for _, e := range exports {
+			if e.Major == major {
+				used[e.Minor] = true
+			}
+		}
+		minor := -1
+		for m := 0; m <= maxAoEMinor; m++ {
+			if !used[uint8(m)] {
+				minor = m
+				break
+			}
+		}
+		if minor < 0 {
+			return nil, fmt.Errorf("no free AoE minor addresses under major %d", major)
+		}
+		e, err := s.RegisterAoEExport(major, uint8(minor))
+		if err == torus.ErrExists {
+			// Another server took it first.
+			continue
+		}
+		return e, err
+	}
+}
+
+// WaitAoEExportFree blocks until nothing is exported at major.minor anywhere
+// in the cluster, or ctx is done. An export disappears when it is
+// unregistered or the lease of the server which registered it expires, so
+// this returns once a server that died has been gone for the lease's TTL.
+func (s *BlockVolume) WaitAoEExportFree(ctx context.Context, major uint16, minor uint8) error {
+	return s.mds.WaitAoEExportFree(ctx, major, minor)
+}
+
+// UnregisterAoEExport removes the record of an export by this node.
+func (s *BlockVolume) UnregisterAoEExport(e *AoEExport) error {
+	return s.mds.UnregisterAoEExport(*e)
+}
+
+type exportsByAddress []AoEExport
+
+func (e exportsByAddress) Len() int      { return len(e) }
+func (e exportsByAddress) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e exportsByAddress) Less(i, j int) bool {
+	if e[i].Major != e[j].Major {
+		return e[i].Major < e[j].Major
+	}
+	return e[i].Minor < e[j].Minor
+}
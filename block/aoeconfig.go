@@ -0,0 +1,52 @@
+package block
+
+import (
+	"fmt"
+
+	"github.com/coreos/torus"
+)
+
+// A volume's AoE config string is set by initiators to identify the target,
+// and matched against when they query for targets. It is kept in the cluster
+// metadata and changed atomically, so it's the same wherever the volume is
+// exported.
+
+// maxAoEConfig is the longest config string AoE allows.
+const maxAoEConfig = 1024
+
+// GetAoEConfig returns the AoE config string of the named volume.
+func GetAoEConfig(mds torus.MetadataService, volume string) (string, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return "", err
+	}
+	return bmds.GetAoEConfig()
+}
+
+// SetAoEConfig replaces the AoE config string of the named volume, whatever
+// it was.
+func SetAoEConfig(mds torus.MetadataService, volume string, config string) error {
+	if len(config) > maxAoEConfig {
+		return fmt.Errorf("AoE config strings are limited to %d bytes", maxAoEConfig)
+	}
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	_, err = bmds.UpdateAoEConfig(func(string) (string, error) {
+		return config, nil
+	})
+	return err
+}
+
+// AoEConfig returns the volume's AoE config string.
+func (s *BlockVolume) AoEConfig() (string, error) {
+	return s.mds.GetAoEConfig()
+}
+
+// UpdateAoEConfig atomically replaces the volume's AoE config string with
+// what fn returns for the current one. If fn fails, the string is left as it
+// is, and returned with fn's error.
+func (s *BlockVolume) UpdateAoEConfig(fn func(cur string) (string, error)) (string, error) {
+	return s.mds.UpdateAoEConfig(fn)
+}
@@ -1,6 +1,11 @@
 package block
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/blockset"
 	"golang.org/x/net/context"
@@ -8,7 +13,20 @@ import (
 
 type BlockFile struct {
 	*torus.File
-	vol *BlockVolume
+	vol      *BlockVolume
+	tuned    time.Time
+	throttle throttle
+	// tempSnapshot is the snapshot a read-only attachment is pinned to,
+	// deleted on Close.
+	tempSnapshot string
+	// shared is set if the file was opened with OpenSharedBlockFile.
+	shared *sharedFile
+
+	// fence is held for writing while a compaction asked for by another
+	// node runs, and for reading by everything which changes the file.
+	fence        sync.RWMutex
+	stopCompacts context.CancelFunc
+	compacting   chan struct{}
 }
 
 func (s *BlockVolume) OpenBlockFile() (*BlockFile, error) {
@@ -23,43 +41,104 @@ func (s *BlockVolume) OpenBlockFile() (*BlockFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	inode, err := s.getOrCreateBlockINode(ref)
+	f, err := s.openINode(ref)
 	if err != nil {
 		return nil, err
 	}
-	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), s.srv.Blocks)
+	// Pick up a grow which happened while the volume was detached.
+	if _, err := f.RefreshSize(); err != nil {
+		f.File.Close()
+		s.mds.Unlock()
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, f.stopCompacts = context.WithCancel(context.Background())
+	f.compacting = make(chan struct{})
+	go f.serveCompactions(ctx)
+	return f, nil
+}
+
+// OpenReadOnlyBlockFile opens the current contents of the volume without
+// taking the volume lock. The file will not see writes committed after it
+// is opened, and cannot itself be written to.
+func (s *BlockVolume) OpenReadOnlyBlockFile() (*BlockFile, error) {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	ref, err := s.mds.GetINode()
 	if err != nil {
 		return nil, err
 	}
-	f, err := s.srv.CreateFile(s.volume, inode, bs)
+	f, err := s.openINode(ref)
 	if err != nil {
 		return nil, err
 	}
-	return &BlockFile{
-		File: f,
-		vol:  s,
-	}, nil
+	f.ReadOnly = true
+	return f, nil
+}
+
+// attachSnapshotPrefix starts the names of the snapshots which hold the
+// contents of read-only attachments.
+const attachSnapshotPrefix = "temp-attach-"
+
+// OpenReadOnlyAttachment opens the current contents of the volume for an
+// export which won't write to it. Like OpenReadOnlyBlockFile, it doesn't
+// take the volume lock, so any number of them may be attached alongside the
+// volume's writer. The contents are held by a snapshot, which Close deletes,
+// so that the writer's changes don't let the blocks still being read be
+// collected.
+func (s *BlockVolume) OpenReadOnlyAttachment() (*BlockFile, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	name := attachSnapshotPrefix + hex.EncodeToString(id)
+	if err := s.SaveSnapshot(name); err != nil {
+		return nil, err
+	}
+	f, err := s.OpenSnapshot(name)
+	if err != nil {
+		s.DeleteSnapshot(name)
+		return nil, err
+	}
+	f.tempSnapshot = name
+	return f, nil
 }
 
 func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
 	if s.volume.Type != VolumeType {
 		panic("wrong type")
 	}
-	snaps, err := s.mds.GetSnapshots()
+	found, err := s.snapshot(name)
 	if err != nil {
 		return nil, err
 	}
-	var found Snapshot
+	f, err := s.openINode(torus.INodeRefFromBytes(found.INodeRef))
+	if err != nil {
+		return nil, err
+	}
+	f.ReadOnly = true
+	return f, nil
+}
+
+// snapshot returns the volume's snapshot called name.
+func (s *BlockVolume) snapshot(name string) (Snapshot, error) {
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
 	for _, x := range snaps {
 		if x.Name == name {
-			found = x
-			break
+			return x, nil
 		}
 	}
-	if found.Name != name {
-		return nil, torus.ErrNotExist
+	return Snapshot{}, torus.ErrNotExist
+}
+
+func (s *BlockVolume) openINode(ref torus.INodeRef) (*BlockFile, error) {
+	if err := s.loadKey(); err != nil {
+		return nil, err
 	}
-	ref := torus.INodeRefFromBytes(found.INodeRef)
 	inode, err := s.getOrCreateBlockINode(ref)
 	if err != nil {
 		return nil, err
@@ -68,34 +147,113 @@ func (s *BlockVolume) OpenSnapshot(name string) (*BlockFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	blockset.SetContentStore(bs, contentStore{s.mds, s.srv.Lease()})
 	f, err := s.srv.CreateFile(s.volume, inode, bs)
 	if err != nil {
 		return nil, err
 	}
-	f.ReadOnly = true
-	return &BlockFile{
+	bf := &BlockFile{
 		File: f,
 		vol:  s,
-	}, nil
+	}
+	if err := bf.applyTuning(); err != nil {
+		return nil, err
+	}
+	return bf, nil
 }
 
 func (f *BlockFile) Close() error {
+	if f.stopCompacts != nil {
+		f.stopCompacts()
+		<-f.compacting
+		f.stopCompacts = nil
+	}
 	err := f.Sync()
 	if err != nil {
 		return err
 	}
+	if f.shared != nil {
+		f.closeShared()
+	}
 	err = f.File.Close()
 	if err != nil {
 		return err
 	}
+	if f.tempSnapshot != "" {
+		return f.vol.mds.DeleteSnapshot(f.tempSnapshot)
+	}
+	if f.IsReadOnly() || f.shared != nil {
+		// Read-only files never hold the volume lock, and shared ones
+		// only while they change it.
+		return nil
+	}
 	return f.vol.mds.Unlock()
 }
 
+// ReadAt reads from the volume, within its IOPS and bandwidth limits.
+func (f *BlockFile) ReadAt(b []byte, off int64) (n int, err error) {
+	f.throttle.wait(len(b))
+	if f.shared == nil {
+		return f.File.ReadAt(b, off)
+	}
+	serr := f.sharedRead(func() {
+		n, err = f.File.ReadAt(b, off)
+	})
+	if serr != nil {
+		return 0, serr
+	}
+	return n, err
+}
+
+// WriteAt writes to the volume, within its IOPS and bandwidth limits.
+func (f *BlockFile) WriteAt(b []byte, off int64) (n int, err error) {
+	f.throttle.wait(len(b))
+	if f.shared == nil {
+		f.fence.RLock()
+		defer f.fence.RUnlock()
+		return f.File.WriteAt(b, off)
+	}
+	err = f.sharedChange(off, int64(len(b)), func() error {
+		var err error
+		n, err = f.File.WriteAt(b, off)
+		return err
+	})
+	return n, err
+}
+
+// Trim zeroes part of the volume.
+func (f *BlockFile) Trim(offset, length int64) error {
+	if f.shared == nil {
+		f.fence.RLock()
+		defer f.fence.RUnlock()
+		return f.File.Trim(offset, length)
+	}
+	return f.sharedChange(offset, length, func() error {
+		return f.File.Trim(offset, length)
+	})
+}
+
 func (f *BlockFile) inodeContext() context.Context {
 	return context.WithValue(context.TODO(), torus.CtxWriteLevel, torus.WriteAll)
 }
 
 func (f *BlockFile) Sync() error {
+	if f.shared != nil {
+		// Every change has been committed already.
+		f.shared.mut.Lock()
+		defer f.shared.mut.Unlock()
+		return f.refreshTuning()
+	}
+	if err := f.refreshTuning(); err != nil {
+		return err
+	}
+	f.fence.RLock()
+	defer f.fence.RUnlock()
+	return f.sync()
+}
+
+// sync commits the file's writes; Sync fences it off from compactions.
+func (f *BlockFile) sync() error {
 	if !f.WriteOpen() {
 		clog.Debugf("not syncing")
 		return nil
@@ -105,9 +263,37 @@ func (f *BlockFile) Sync() error {
 	if err != nil {
 		return err
 	}
+	for {
+		err = f.syncINode()
+		if err != nil {
+			return err
+		}
+		// Deduplicated blocks are only safe from the GC once the inode
+		// naming them is synced; any collected before then have been
+		// written again, and the inode must be synced once more.
+		again, err := blockset.ConfirmDeduplicated(f.inodeContext(), f.File.Blocks())
+		if err != nil || !again {
+			return err
+		}
+		err = f.File.SyncBlocks()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *BlockFile) syncINode() error {
 	ref, err := f.File.SyncINode(f.inodeContext())
 	if err != nil {
 		return err
 	}
-	return f.vol.mds.SyncINode(ref)
+	err = f.vol.mds.SyncINode(ref)
+	if err == torus.ErrLocked {
+		// Someone else holds the lock now -- most likely a standby was
+		// promoted over us. Stop accepting writes so that we can't
+		// diverge from the new owner.
+		clog.Errorf("volume %s was fenced by another node; refusing further writes", f.vol.volume.Name)
+		f.SetReadOnly(true)
+	}
+	return err
 }
@@ -0,0 +1,87 @@
+package block
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// checkpointSnapshotPrefix names the snapshot a checkpoint takes of each
+// volume. The snapshots keep the checkpointed blocks from being collected.
+const checkpointSnapshotPrefix = "checkpoint-"
+
+// Checkpoint is a snapshot of every block volume in the cluster taken at a
+// single metadata revision.
+type Checkpoint struct {
+	Name    string
+	Created time.Time
+	// Revision is the metadata revision the volumes were read at. The temp
+	// metadata service has no revisions and leaves it zero.
+	Revision int64
+	// Volumes maps each volume name to the INodeRef it had at Revision.
+	Volumes map[string][]byte
+}
+
+// SnapshotName is the name of the snapshot the checkpoint took of each
+// volume.
+func (c *Checkpoint) SnapshotName() string {
+	return checkpointSnapshotPrefix + c.Name
+}
+
+// SaveCheckpoint records the current state of every block volume under
+// name. Volumes may be written to while it runs; each is recorded as it was
+// at the same instant, so that the checkpoint as a whole is consistent.
+func SaveCheckpoint(mds torus.MetadataService, name string) (*Checkpoint, error) {
+	if name == "" {
+		return nil, errors.New("checkpoint name cannot be empty")
+	}
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.SaveCheckpoint(name, time.Now())
+}
+
+// GetCheckpoints returns the checkpoints in the cluster, oldest first.
+func GetCheckpoints(mds torus.MetadataService) ([]Checkpoint, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	out, err := bmds.GetCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(checkpointsByAge(out))
+	return out, nil
+}
+
+// DeleteCheckpoint deletes a checkpoint and the snapshots it took.
+func DeleteCheckpoint(mds torus.MetadataService, name string) error {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return err
+	}
+	return bmds.DeleteCheckpoint(name)
+}
+
+// RestoreCheckpoint returns every volume recorded in the checkpoint to the
+// state it was in at the time. None of them may be attached; if any is,
+// nothing is restored and torus.ErrLocked is returned. Volumes deleted since
+// the checkpoint can't be brought back and are returned as skipped. Volumes
+// created since are left alone.
+func RestoreCheckpoint(mds torus.MetadataService, name string) (skipped []string, err error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.RestoreCheckpoint(name)
+}
+
+type checkpointsByAge []Checkpoint
+
+func (c checkpointsByAge) Len() int           { return len(c) }
+func (c checkpointsByAge) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c checkpointsByAge) Less(i, j int) bool { return c[i].Created.Before(c[j].Created) }
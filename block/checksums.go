@@ -0,0 +1,202 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/torus/blockset"
+)
+
+// checksumsHeader starts every checksum manifest, so that tools can recognize
+// one.
+const checksumsHeader = "# torus block checksums v1"
+
+// ErrChecksumMismatch is returned when data doesn't match its checksum
+// manifest.
+var ErrChecksumMismatch = errors.New("block: data doesn't match its checksums")
+
+// Checksums lists the checksum of every block of a volume, as stored by the
+// volume's checksum layer, so that a copy of the volume's data can be checked
+// without Torus. Each checksum covers BlockSize bytes of the volume starting
+// at its index times BlockSize; the last block is padded with zeros.
+type Checksums struct {
+	Algorithm blockset.ChecksumAlgorithm
+	BlockSize uint64
+	// Size is the size of the volume in bytes.
+	Size uint64
+	Sums [][]byte
+}
+
+// Checksums returns the stored checksums of the file's blocks. The blocks
+// aren't read.
+func (f *BlockFile) Checksums() (*Checksums, error) {
+	algo, sums, err := blockset.Checksums(f.Blocks())
+	if err != nil {
+		return nil, err
+	}
+	return &Checksums{
+		Algorithm: algo,
+		BlockSize: f.vol.srv.Blocks.BlockSize(),
+		Size:      f.Size(),
+		Sums:      sums,
+	}, nil
+}
+
+// Write writes c out as a manifest: a header, then algorithm, block-size and
+// size lines, then one "INDEX CHECKSUM" line per block.
+func (c *Checksums) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s\nalgorithm %s\nblock-size %d\nsize %d\n", checksumsHeader, c.Algorithm, c.BlockSize, c.Size)
+	for i, sum := range c.Sums {
+		fmt.Fprintf(bw, "%d %s\n", i, c.Algorithm.Format(sum))
+	}
+	return bw.Flush()
+}
+
+// ReadChecksums reads a manifest written by Checksums.Write.
+func ReadChecksums(r io.Reader) (*Checksums, error) {
+	c := &Checksums{}
+	var sums []string
+	s := bufio.NewScanner(r)
+	if !s.Scan() || s.Text() != checksumsHeader {
+		return nil, errors.New("block: not a checksum manifest")
+	}
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("block: bad checksum manifest line %q", s.Text())
+		}
+		var err error
+		switch fields[0] {
+		case "algorithm":
+			c.Algorithm, err = blockset.ParseChecksumAlgorithm(fields[1])
+		case "block-size":
+			c.BlockSize, err = strconv.ParseUint(fields[1], 10, 64)
+		case "size":
+			c.Size, err = strconv.ParseUint(fields[1], 10, 64)
+		default:
+			var i int
+			i, err = strconv.Atoi(fields[0])
+			if err == nil && i != len(sums) {
+				err = fmt.Errorf("block %d out of order", i)
+			}
+			sums = append(sums, fields[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("block: bad checksum manifest: %v", err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if c.BlockSize == 0 {
+		return nil, errors.New("block: checksum manifest has no block size")
+	}
+	// The algorithm may only be known once the sums have been read.
+	for i, sum := range sums {
+		b, err := c.Algorithm.Parse(sum)
+		if err != nil {
+			return nil, fmt.Errorf("block: bad checksum for block %d: %v", i, err)
+		}
+		c.Sums = append(c.Sums, b)
+	}
+	return c, nil
+}
+
+// VerifyReader wraps r, checking each block of the data read through it
+// against c. A block which doesn't match fails the read, naming the block,
+// before any of it is returned.
+func VerifyReader(r io.Reader, c *Checksums) io.Reader {
+	return &verifyReader{r: r, c: c}
+}
+
+type verifyReader struct {
+	r    io.Reader
+	c    *Checksums
+	next int
+	buf  bytes.Buffer
+	err  error
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	for v.buf.Len() == 0 && v.err == nil {
+		v.err = v.fill()
+	}
+	if v.buf.Len() != 0 {
+		return v.buf.Read(p)
+	}
+	return 0, v.err
+}
+
+// fill reads and verifies the next block.
+func (v *verifyReader) fill() error {
+	blk := make([]byte, v.c.BlockSize)
+	n, err := io.ReadFull(v.r, blk)
+	if err == io.EOF {
+		if v.next != len(v.c.Sums) {
+			return fmt.Errorf("%v: data ends at block %d of %d", ErrChecksumMismatch, v.next, len(v.c.Sums))
+		}
+		return io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if v.next >= len(v.c.Sums) {
+		return fmt.Errorf("%v: more data than blocks", ErrChecksumMismatch)
+	}
+	// The rest of a short final block is zeros, as in the volume.
+	for i := n; i < len(blk); i++ {
+		blk[i] = 0
+	}
+	if !bytes.Equal(v.c.Algorithm.Sum(blk), v.c.Sums[v.next]) {
+		return fmt.Errorf("%v: block %d", ErrChecksumMismatch, v.next)
+	}
+	v.next++
+	v.buf.Write(blk[:n])
+	return nil
+}
+
+// Mismatch is a block of a volume which doesn't match its checksum manifest.
+type Mismatch struct {
+	Block  int
+	Offset uint64
+	// Err is set if the block couldn't be read at all.
+	Err error
+}
+
+// Verify reads every block of the file, through the same path as any other
+// reader, and compares it against c. It returns the blocks which don't match,
+// in order; an error is returned only if the file can't be compared at all.
+func (f *BlockFile) Verify(c *Checksums) ([]Mismatch, error) {
+	if f.Size() != c.Size {
+		return nil, fmt.Errorf("%v: volume is %d bytes, but the checksums are for %d", ErrChecksumMismatch, f.Size(), c.Size)
+	}
+	if blocks := (c.Size + c.BlockSize - 1) / c.BlockSize; uint64(len(c.Sums)) != blocks {
+		return nil, fmt.Errorf("block: checksum manifest lists %d blocks for %d bytes", len(c.Sums), c.Size)
+	}
+	var bad []Mismatch
+	blk := make([]byte, c.BlockSize)
+	for i, want := range c.Sums {
+		off := uint64(i) * c.BlockSize
+		n, err := f.ReadAt(blk, int64(off))
+		if err == io.EOF && off+uint64(n) == c.Size {
+			err = nil
+		}
+		if err != nil {
+			bad = append(bad, Mismatch{Block: i, Offset: off, Err: err})
+			continue
+		}
+		for j := n; j < len(blk); j++ {
+			blk[j] = 0
+		}
+		if !bytes.Equal(c.Algorithm.Sum(blk), want) {
+			bad = append(bad, Mismatch{Block: i, Offset: off})
+		}
+	}
+	return bad, nil
+}
@@ -0,0 +1,90 @@
+package block
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/models"
+)
+
+// CloneVolume creates the block volume name as a copy-on-write clone of the
+// snapshot of source. The clone shares the snapshot's blocks until it
+// overwrites them, but is otherwise independent: either volume may be
+// written, snapshotted or deleted without affecting the other, as the
+// garbage collector keeps blocks while any volume refers to them. The clone
+// has the source's options, and no labels.
+func CloneVolume(srv *torus.Server, source, snapshot, name string) error {
+	src, err := OpenBlockVolume(srv, source)
+	if err != nil {
+		return err
+	}
+	if src.volume.Type != VolumeType {
+		return fmt.Errorf("volume %s is not a block volume", source)
+	}
+	snap, err := src.snapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	inode, err := src.getOrCreateBlockINode(torus.INodeRefFromBytes(snap.INodeRef))
+	if err != nil {
+		return err
+	}
+	opts, err := src.mds.GetVolumeOptions()
+	if err != nil {
+		return err
+	}
+	opts.Origin = source + "@" + snapshot
+	opts.Labels = nil
+	err = CreateBlockVolumeWithOptions(srv.MDS, name, inode.Filesize, opts)
+	if err != nil {
+		return err
+	}
+	clone, err := OpenBlockVolume(srv, name)
+	if err == nil {
+		err = clone.adopt(inode)
+	}
+	if err != nil {
+		// Don't leave an empty volume where the clone should be.
+		if derr := DeleteBlockVolume(srv.MDS, name); derr != nil {
+			clog.Errorf("couldn't delete incomplete clone %s: %v", name, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// adopt makes a copy of inode, from another volume, the volume's current
+// INode, sharing its blocks.
+func (s *BlockVolume) adopt(inode *models.INode) error {
+	err := s.mds.Lock(s.srv.Lease())
+	if err != nil {
+		return err
+	}
+	defer s.mds.Unlock()
+
+	vid := torus.VolumeID(s.volume.Id)
+	var id torus.INodeID
+	for {
+		id, err = s.srv.MDS.CommitINodeIndex(vid)
+		if err != torus.ErrAgain {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	ref := torus.NewINodeRef(vid, id)
+	adopted := *inode
+	adopted.Volume = s.volume.Id
+	adopted.INode = uint64(id)
+	ctx := context.WithValue(context.TODO(), torus.CtxWriteLevel, torus.WriteAll)
+	if err := s.srv.INodes.WriteINode(ctx, ref, &adopted); err != nil {
+		return err
+	}
+	if err := s.srv.INodes.Flush(); err != nil {
+		return err
+	}
+	return s.mds.SyncINode(ref)
+}
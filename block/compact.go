@@ -0,0 +1,275 @@
+package block
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+// CompactStats reports what a call to Compact achieved.
+type CompactStats struct {
+	// Allocated block references before and after compaction.
+	BlocksBefore int
+	BlocksAfter  int
+	// Distinct INodes still referenced by the blockset.
+	INodesBefore uint64
+	INodesAfter  uint64
+	// Size, in bytes, of the serialized blockset.
+	MetadataBefore int
+	MetadataAfter  int
+}
+
+// Compaction asks the writer of an attached volume to compact it, and holds
+// the writer's answer.
+type Compaction struct {
+	ID string `json:"id"`
+	// Zeroes holds the refs of the blocks found to hold only zeroes, by
+	// index, as of the volume's last commit. Those which haven't been
+	// rewritten since are released.
+	Zeroes map[int][]byte `json:"zeroes,omitempty"`
+
+	Done  bool         `json:"done,omitempty"`
+	Stats CompactStats `json:"stats"`
+	Error string       `json:"error,omitempty"`
+}
+
+func (c *Compaction) copy() *Compaction {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	out.Zeroes = make(map[int][]byte, len(c.Zeroes))
+	for i, ref := range c.Zeroes {
+		out.Zeroes[i] = ref
+	}
+	return &out
+}
+
+// compactTimeout is how long Compact waits for the writer of an attached
+// volume to compact it.
+const compactTimeout = time.Minute
+
+// Compact rewrites the volume's blockset, releasing blocks which only hold
+// zeroes and any entries past the end of the volume. The logical contents of
+// the volume are unchanged. If the volume is attached, the blocks are found
+// from its last commit, and the writer is asked to release those which it
+// hasn't rewritten since, fencing its writes while it does; if it doesn't
+// answer, Compact fails with torus.ErrLocked.
+func (s *BlockVolume) Compact() (*CompactStats, error) {
+	f, err := s.OpenBlockFile()
+	if err == torus.ErrLocked {
+		return s.compactAttached()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zeroes, err := f.findZeroes()
+	if err != nil {
+		return nil, err
+	}
+	return f.compact(zeroes)
+}
+
+// findZeroes returns the refs of f's blocks which hold only zeroes, by
+// index.
+func (f *BlockFile) findZeroes() (map[int]torus.BlockRef, error) {
+	bs := f.Blocks()
+	refs := bs.GetAllBlockRefs()
+	zeroes := make(map[int]torus.BlockRef)
+	for i := 0; i < bs.Length(); i++ {
+		if refs[i].IsZero() {
+			continue
+		}
+		data, err := bs.GetBlock(f.vol.getContext(), i)
+		if err != nil {
+			return nil, err
+		}
+		if isZeroes(data) {
+			zeroes[i] = refs[i]
+		}
+	}
+	return zeroes, nil
+}
+
+// compact releases the blocks in zeroes which still have the refs given,
+// and any past the end of the volume, then syncs f. Writes must be fenced
+// off while it runs.
+func (f *BlockFile) compact(zeroes map[int]torus.BlockRef) (*CompactStats, error) {
+	gmd, err := f.vol.mds.GlobalMetadata()
+	if err != nil {
+		return nil, err
+	}
+	blkSize := int64(gmd.BlockSize)
+
+	// Anything written but not yet stored must be in the blockset first.
+	if err := f.File.SyncBlocks(); err != nil {
+		return nil, err
+	}
+	stats := &CompactStats{}
+	stats.BlocksBefore, stats.INodesBefore, stats.MetadataBefore, err = blocksetUsage(f.Blocks())
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(f.Size())
+	nBlocks := int((size + blkSize - 1) / blkSize)
+	if f.Blocks().Length() > nBlocks {
+		clog.Infof("compact: dropping %d trailing blocks", f.Blocks().Length()-nBlocks)
+		err = f.Truncate(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	refs := f.Blocks().GetAllBlockRefs()
+	for i, ref := range zeroes {
+		if i >= len(refs) || refs[i] != ref {
+			continue
+		}
+		err = f.File.Trim(int64(i)*blkSize, blkSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = f.sync()
+	if err != nil {
+		return nil, err
+	}
+	stats.BlocksAfter, stats.INodesAfter, stats.MetadataAfter, err = blocksetUsage(f.Blocks())
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// compactAttached finds the zeroed blocks of an attached volume and asks its
+// writer to release them.
+func (s *BlockVolume) compactAttached() (*CompactStats, error) {
+	ro, err := s.OpenReadOnlyBlockFile()
+	if err != nil {
+		return nil, err
+	}
+	zeroes, err := ro.findZeroes()
+	ro.Close()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	req := &Compaction{ID: hex.EncodeToString(id), Zeroes: make(map[int][]byte)}
+	for i, ref := range zeroes {
+		req.Zeroes[i] = ref.ToBytes()
+	}
+	_, err = s.mds.UpdateCompaction(func(cur *Compaction) (*Compaction, error) {
+		if cur != nil && !cur.Done {
+			return nil, torus.ErrExists
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer s.mds.UpdateCompaction(func(cur *Compaction) (*Compaction, error) {
+		if cur == nil || cur.ID != req.ID {
+			return cur, nil
+		}
+		return nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), compactTimeout)
+	defer cancel()
+	res, err := s.mds.WaitCompaction(ctx, func(cur *Compaction) bool {
+		return cur == nil || cur.ID != req.ID || cur.Done
+	})
+	if err == context.DeadlineExceeded {
+		// Nothing is serving compactions for the writer.
+		return nil, torus.ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || res.ID != req.ID {
+		return nil, errors.New("compaction request was replaced")
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return &res.Stats, nil
+}
+
+// serveCompactions compacts f whenever Compact asks, until ctx is done.
+func (f *BlockFile) serveCompactions(ctx context.Context) {
+	defer close(f.compacting)
+	for {
+		req, err := f.vol.mds.WaitCompaction(ctx, func(cur *Compaction) bool {
+			return cur != nil && !cur.Done
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			clog.Warningf("couldn't wait for compaction of volume %s: %v", f.vol.volume.Name, err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		zeroes := make(map[int]torus.BlockRef, len(req.Zeroes))
+		for i, ref := range req.Zeroes {
+			zeroes[i] = torus.BlockRefFromBytes(ref)
+		}
+		f.fence.Lock()
+		stats, err := f.compact(zeroes)
+		f.fence.Unlock()
+		req.Done = true
+		if err != nil {
+			req.Error = err.Error()
+		} else {
+			req.Stats = *stats
+		}
+		_, err = f.vol.mds.UpdateCompaction(func(cur *Compaction) (*Compaction, error) {
+			if cur == nil || cur.ID != req.ID {
+				return cur, nil
+			}
+			return req, nil
+		})
+		if err != nil {
+			clog.Warningf("couldn't answer compaction of volume %s: %v", f.vol.volume.Name, err)
+		}
+	}
+}
+
+func blocksetUsage(bs torus.Blockset) (blocks int, inodes uint64, size int, err error) {
+	for _, ref := range bs.GetAllBlockRefs() {
+		if !ref.IsZero() {
+			blocks++
+		}
+	}
+	layers, err := torus.MarshalBlocksetToProto(bs)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, l := range layers {
+		size += len(l.Content)
+	}
+	return blocks, bs.GetLiveINodes().GetCardinality(), size, nil
+}
+
+func isZeroes(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package block
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchDays bounds how far back cronSpec.prev looks for a match. It
+// covers a leap day falling on any given weekday.
+const cronSearchDays = 366 * 8
+
+// cronSpec is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week. Each field is a bitmask of the values it
+// matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record which day fields were "*". As in cron, a
+	// day matches either restricted day field when both are restricted.
+	domStar, dowStar bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronSpec parses an expression such as "30 2 * * 1-5". Fields may be
+// "*", a value, a range "a-b", any of those followed by a step "/n", or a
+// comma separated list of them. A value with a step, "a/n", runs from a to
+// the end of the field's range. Day of week 0 and 7 are both Sunday.
+func parseCronSpec(s string) (*cronSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron spec %q doesn't have %d fields", s, len(cronFields))
+	}
+	var masks [5]uint64
+	for i, f := range fields {
+		m, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron spec %q: %s: %v", s, cronFields[i].name, err)
+		}
+		masks[i] = m
+	}
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+	return &cronSpec{
+		minute:  masks[0],
+		hour:    masks[1],
+		dom:     masks[2],
+		month:   masks[3],
+		dow:     masks[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		i := strings.Index(part, "/")
+		if i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 1 && i >= 0 {
+				// "a/n" steps from a to the end of the range.
+				hi = max
+			}
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q is outside %d-%d", rng, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func (c *cronSpec) matchesDay(t time.Time) bool {
+	if c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// prev returns the latest time at or before t, in UTC, that the spec
+// matches, or the zero time if it hasn't matched for years.
+func (c *cronSpec) prev(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	for i := 0; i < cronSearchDays; i++ {
+		if c.matchesDay(day) {
+			lastHour := 23
+			if i == 0 {
+				lastHour = t.Hour()
+			}
+			for h := lastHour; h >= 0; h-- {
+				if c.hour&(1<<uint(h)) == 0 {
+					continue
+				}
+				lastMinute := 59
+				if i == 0 && h == t.Hour() {
+					lastMinute = t.Minute()
+				}
+				for m := lastMinute; m >= 0; m-- {
+					if c.minute&(1<<uint(m)) != 0 {
+						return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+					}
+				}
+			}
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	return time.Time{}
+}
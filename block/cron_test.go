@@ -0,0 +1,114 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+// bits returns the mask of a cron field matching vals.
+func bits(vals ...int) uint64 {
+	var m uint64
+	for _, v := range vals {
+		m |= 1 << uint(v)
+	}
+	return m
+}
+
+// span returns the mask of a cron field matching lo to hi.
+func span(lo, hi int) uint64 {
+	var m uint64
+	for v := lo; v <= hi; v++ {
+		m |= 1 << uint(v)
+	}
+	return m
+}
+
+func TestParseCronSpec(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want cronSpec
+	}{
+		{"* * * * *", cronSpec{span(0, 59), span(0, 23), span(1, 31), span(1, 12), span(0, 7), true, true}},
+		{"30 2 * * 1-5", cronSpec{bits(30), bits(2), span(1, 31), span(1, 12), span(1, 5), true, false}},
+		{"*/15 0-6/2 1,15 1-3,12 *", cronSpec{bits(0, 15, 30, 45), bits(0, 2, 4, 6), bits(1, 15), bits(1, 2, 3, 12), span(0, 7), false, true}},
+		{"5/20 0,12 */10 */5 1,3-4", cronSpec{bits(5, 25, 45), bits(0, 12), bits(1, 11, 21, 31), bits(1, 6, 11), bits(1, 3, 4), false, false}},
+		// Sunday is 0 or 7.
+		{"0 0 * * 7", cronSpec{bits(0), bits(0), span(1, 31), span(1, 12), bits(0, 7), true, false}},
+		{"0 0 * * 0", cronSpec{bits(0), bits(0), span(1, 31), span(1, 12), bits(0), true, false}},
+	} {
+		c, err := parseCronSpec(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if *c != tt.want {
+			t.Errorf("%q: parsed as %+v, expected %+v", tt.spec, *c, tt.want)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"-1 * * * *",
+		"5-3 * * * *",
+		"1-x * * * *",
+		"x * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"0-60/5 * * * *",
+	} {
+		if _, err := parseCronSpec(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestCronSpecPrev(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		spec      string
+		now, want time.Time
+	}{
+		// The current minute counts, whatever the seconds.
+		{"30 2 * * *", date(2017, 3, 10, 2, 30).Add(59 * time.Second), date(2017, 3, 10, 2, 30)},
+		{"30 2 * * *", date(2017, 3, 10, 2, 29), date(2017, 3, 9, 2, 30)},
+		{"*/15 * * * *", date(2017, 3, 10, 14, 44), date(2017, 3, 10, 14, 30)},
+		{"0 9-17 * * *", date(2017, 3, 10, 8, 0), date(2017, 3, 9, 17, 0)},
+		// Across months and years.
+		{"0 0 1 * *", date(2017, 3, 10, 12, 0), date(2017, 3, 1, 0, 0)},
+		{"0 12 31 * *", date(2017, 3, 10, 0, 0), date(2017, 1, 31, 12, 0)},
+		{"45 23 * 12 *", date(2017, 1, 5, 0, 0), date(2016, 12, 31, 23, 45)},
+		{"0 0 1 1 *", date(2017, 1, 1, 0, 0), date(2017, 1, 1, 0, 0)},
+		{"0 0 1 1 *", date(2016, 12, 31, 23, 59), date(2016, 1, 1, 0, 0)},
+		{"0 0 29 2 *", date(2017, 3, 1, 0, 0), date(2016, 2, 29, 0, 0)},
+		// Days of the week, and either day field when both are restricted:
+		// 2017-01-12 is a Thursday.
+		{"0 9 * * 1", date(2017, 1, 1, 0, 0), date(2016, 12, 26, 9, 0)},
+		{"0 0 * * 7", date(2017, 1, 3, 0, 0), date(2017, 1, 1, 0, 0)},
+		{"0 0 13 * 5", date(2017, 1, 12, 12, 0), date(2017, 1, 6, 0, 0)},
+		{"0 0 6 * 4", date(2017, 1, 12, 12, 0), date(2017, 1, 12, 0, 0)},
+		// The result is in UTC.
+		{"0 * * * *", time.Date(2017, 1, 1, 0, 30, 0, 0, time.FixedZone("CET", 3600)), date(2016, 12, 31, 23, 0)},
+		// A spec that never matches.
+		{"0 0 31 2 *", date(2017, 3, 1, 0, 0), time.Time{}},
+	} {
+		c, err := parseCronSpec(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := c.prev(tt.now); !got.Equal(tt.want) || got.Location() != tt.want.Location() {
+			t.Errorf("%q before %v: got %v, expected %v", tt.spec, tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package block
+
+import (
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+// contentStore keeps the content index of deduplicated volumes in the
+// metadata service, with its pins held under the server's lease, so that
+// those of a node which dies are released with it.
+type contentStore struct {
+	mds   blockMetadata
+	lease int64
+}
+
+var _ blockset.ContentStore = contentStore{}
+
+func (c contentStore) LookupContent(hash []byte) (torus.BlockRef, bool, error) {
+	return c.mds.LookupContent(hash)
+}
+
+func (c contentStore) AddContent(hash []byte, ref torus.BlockRef) error {
+	return c.mds.AddContent(hash, ref)
+}
+
+func (c contentStore) ForgetContent(hash []byte, ref torus.BlockRef) error {
+	return c.mds.ForgetContent(hash, ref)
+}
+
+func (c contentStore) PinBlock(ref torus.BlockRef) (string, error) {
+	return c.mds.PinBlock(ref, c.lease)
+}
+
+func (c contentStore) UnpinBlock(ref torus.BlockRef, pin string) error {
+	return c.mds.UnpinBlock(ref, pin)
+}
@@ -0,0 +1,107 @@
+package block
+
+import (
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+// Extent is a range of a volume's contents.
+type Extent struct {
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+	// Zero is set if the range now reads as zeroes, having been trimmed
+	// or never written, so a backup can punch a hole instead of copying
+	// it.
+	Zero bool `json:"zero,omitempty"`
+}
+
+// ChangedExtents returns the ranges of the volume which have been written or
+// trimmed between the snapshot from and the snapshot to, in order. An empty
+// from compares against an empty volume, giving every range which has data,
+// and an empty to compares with the volume's current contents.
+//
+// Nothing needs to be tracked for this: every write gives the blocks it
+// changes new refs, so the blocks which differ between two versions of a
+// volume are those whose refs differ. A block rewritten with the same data
+// is still listed.
+func (s *BlockVolume) ChangedExtents(from, to string) ([]Extent, error) {
+	var fromRefs []torus.BlockRef
+	if from != "" {
+		_, refs, err := s.versionRefs(from)
+		if err != nil {
+			return nil, err
+		}
+		fromRefs = refs
+	}
+	size, toRefs, err := s.versionRefs(to)
+	if err != nil {
+		return nil, err
+	}
+	gmd, err := s.mds.GlobalMetadata()
+	if err != nil {
+		return nil, err
+	}
+	bs := gmd.BlockSize
+
+	var out []Extent
+	n := len(toRefs)
+	if len(fromRefs) > n {
+		n = len(fromRefs)
+	}
+	for i := 0; i < n; i++ {
+		var ref, was torus.BlockRef
+		if i < len(toRefs) {
+			ref = toRefs[i]
+		}
+		if i < len(fromRefs) {
+			was = fromRefs[i]
+		}
+		if ref == was {
+			continue
+		}
+		off := uint64(i) * bs
+		if off >= size {
+			break
+		}
+		length := bs
+		if size-off < length {
+			length = size - off
+		}
+		zero := ref.IsZero()
+		if l := len(out) - 1; l >= 0 && out[l].Offset+out[l].Length == off && out[l].Zero == zero {
+			out[l].Length += length
+			continue
+		}
+		out = append(out, Extent{Offset: off, Length: length, Zero: zero})
+	}
+	return out, nil
+}
+
+// versionRefs returns the size of the snapshot called name, or of the
+// volume's current contents if name is empty, and the refs of its blocks.
+func (s *BlockVolume) versionRefs(name string) (uint64, []torus.BlockRef, error) {
+	var ref torus.INodeRef
+	if name == "" {
+		var err error
+		ref, err = s.mds.GetINode()
+		if err != nil {
+			return 0, nil, err
+		}
+	} else {
+		snap, err := s.snapshot(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		ref = torus.INodeRefFromBytes(snap.INodeRef)
+	}
+	inode, err := s.getOrCreateBlockINode(ref)
+	if err != nil {
+		return 0, nil, err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Some layers list more refs than blocks, after the blocks' own.
+	return inode.Filesize, bs.GetAllBlockRefs()[:bs.Length()], nil
+}
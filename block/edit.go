@@ -0,0 +1,86 @@
+package block
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/coreos/torus"
+)
+
+// VolumeEdit is a change to a block volume's name, description and labels,
+// made all at once by EditBlockVolume.
+type VolumeEdit struct {
+	// Name is the volume's new name, if set.
+	Name string
+	// Description is the volume's new description, if set. An empty one
+	// removes it.
+	Description *string
+	// Labels replace the volume's labels, if not nil. An empty map
+	// removes them all.
+	Labels map[string]string
+}
+
+// EditBlockVolume changes the name, description and labels of a block volume
+// in one transaction, so that nothing sees it half changed. A renamed volume
+// keeps its ID, and with it its data, snapshots, settings and any
+// attachments, which go on working; its consistency groups list it under the
+// new name. Only hosts opening the volume afresh need to use the new name.
+//
+// It fails with torus.ErrExists if another volume already has the new name.
+// Mirrored volumes can't be renamed, as the mirror finds the remote copy by
+// name.
+func EditBlockVolume(mds torus.MetadataService, volume string, e VolumeEdit) error {
+	if e.Name == volume {
+		e.Name = ""
+	}
+	if e.Labels != nil {
+		if err := ValidateLabels(e.Labels); err != nil {
+			return err
+		}
+	}
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	if e.Name != "" {
+		m, err := bmds.GetMirror()
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			return errors.New("mirrored volumes can't be renamed; stop mirroring it first")
+		}
+	}
+	return bmds.EditVolume(e)
+}
+
+// RenameBlockVolume renames a block volume; see EditBlockVolume.
+func RenameBlockVolume(mds torus.MetadataService, volume, name string) error {
+	if name == "" {
+		return errors.New("volume name cannot be empty")
+	}
+	return EditBlockVolume(mds, volume, VolumeEdit{Name: name})
+}
+
+// GetVolumeDescription returns the description of the named volume, which is
+// empty if it has none.
+func GetVolumeDescription(mds torus.MetadataService, volume string) (string, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return "", err
+	}
+	return bmds.GetDescription()
+}
+
+// renameMember replaces the volume from with to in the members of a
+// consistency group, reporting whether it was a member.
+func (g *ConsistencyGroup) renameMember(from, to string) bool {
+	for i, v := range g.Volumes {
+		if v == from {
+			g.Volumes[i] = to
+			sort.Strings(g.Volumes)
+			return true
+		}
+	}
+	return false
+}
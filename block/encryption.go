@@ -0,0 +1,184 @@
+package block
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/coreos/torus/blockset"
+)
+
+// EncryptionAESGCM is the cipher encrypted volumes use: AES-256 in GCM mode.
+const EncryptionAESGCM = "aes-256-gcm"
+
+var (
+	// ErrNoKey is returned when an encrypted volume is opened and no key
+	// provider has been set.
+	ErrNoKey = errors.New("block: volume is encrypted and no key provider is set")
+	// ErrWrongKey is returned when the key provider gives a key which isn't
+	// the one the volume was created with.
+	ErrWrongKey = errors.New("block: wrong key for encrypted volume")
+)
+
+// VolumeEncryption records how a volume is encrypted. The key itself is never
+// stored in the metadata, only a check value to catch the wrong key being
+// supplied before anything is written with it.
+type VolumeEncryption struct {
+	Cipher   string
+	KeyID    string
+	KeyCheck string
+}
+
+// KeyProvider supplies the keys of encrypted volumes. VolumeKey returns the
+// blockset.KeySize byte key named keyID, for the volume called volume.
+type KeyProvider interface {
+	VolumeKey(volume, keyID string) ([]byte, error)
+}
+
+var (
+	keyProviderMut sync.RWMutex
+	keyProvider    KeyProvider
+)
+
+// SetKeyProvider sets where the keys of encrypted volumes come from, for the
+// life of the process. Keys are fetched as volumes are created and opened.
+func SetKeyProvider(p KeyProvider) {
+	keyProviderMut.Lock()
+	defer keyProviderMut.Unlock()
+	keyProvider = p
+}
+
+func getKeyProvider() KeyProvider {
+	keyProviderMut.RLock()
+	defer keyProviderMut.RUnlock()
+	return keyProvider
+}
+
+type staticKey []byte
+
+func (k staticKey) VolumeKey(volume, keyID string) ([]byte, error) { return k, nil }
+
+// StaticKey returns a KeyProvider which gives the same key for every volume,
+// such as one supplied when the volume is attached.
+func StaticKey(key []byte) KeyProvider {
+	return staticKey(key)
+}
+
+type keyCommand string
+
+func (c keyCommand) VolumeKey(volume, keyID string) ([]byte, error) {
+	cmd := exec.Command("/bin/sh", "-c", string(c))
+	cmd.Env = append(os.Environ(), "TORUS_VOLUME="+volume, "TORUS_KEY_ID="+keyID)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("key command for volume %s failed: %v", volume, err)
+	}
+	return ParseKey(out)
+}
+
+// KeyCommand returns a KeyProvider which runs command with the shell to fetch
+// each key, for example from a key management service. The volume name and
+// key ID are passed in the TORUS_VOLUME and TORUS_KEY_ID environment
+// variables, and the key is read from its output, as ParseKey accepts.
+func KeyCommand(command string) KeyProvider {
+	return keyCommand(command)
+}
+
+// ParseKey parses a key given either as blockset.KeySize raw bytes or as
+// their hex encoding. Surrounding whitespace is ignored in the hex form.
+func ParseKey(data []byte) ([]byte, error) {
+	if len(data) == blockset.KeySize {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if len(s) == hex.EncodedLen(blockset.KeySize) {
+		if key, err := hex.DecodeString(s); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("keys must be %d bytes, or %d hex digits", blockset.KeySize, hex.EncodedLen(blockset.KeySize))
+}
+
+// NewVolumeEncryption picks a new key ID for the volume, fetches its key from
+// the key provider and returns the settings to create the volume with.
+func NewVolumeEncryption(volume string) (*VolumeEncryption, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	e := &VolumeEncryption{
+		Cipher: EncryptionAESGCM,
+		KeyID:  hex.EncodeToString(id),
+	}
+	key, err := e.fetchKey(volume)
+	if err != nil {
+		return nil, err
+	}
+	e.KeyCheck = keyCheck(key, e.KeyID)
+	return e, nil
+}
+
+func (e *VolumeEncryption) validate() error {
+	if e.Cipher != EncryptionAESGCM {
+		return fmt.Errorf("unknown volume cipher %q", e.Cipher)
+	}
+	if e.KeyID == "" || len(e.KeyID) > 255 {
+		return fmt.Errorf("invalid key ID %q", e.KeyID)
+	}
+	if e.KeyCheck == "" {
+		return errors.New("volume encryption has no key check")
+	}
+	return nil
+}
+
+func (e *VolumeEncryption) fetchKey(volume string) ([]byte, error) {
+	p := getKeyProvider()
+	if p == nil {
+		return nil, ErrNoKey
+	}
+	key, err := p.VolumeKey(volume, e.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != blockset.KeySize {
+		return nil, fmt.Errorf("key for volume %s must be %d bytes, not %d", volume, blockset.KeySize, len(key))
+	}
+	return key, nil
+}
+
+// keyCheck derives a value from key which shows whether a key is the right
+// one without giving the key away.
+func keyCheck(key []byte, keyID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("torus-key-check:" + keyID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// loadKey makes sure the volume's key, if it's encrypted, is in the blockset
+// keyring before its blocks are read or written.
+func (s *BlockVolume) loadKey() error {
+	opts, err := s.mds.GetVolumeOptions()
+	if err != nil {
+		return err
+	}
+	e := opts.Encryption
+	if e == nil || blockset.HasKey(e.KeyID) {
+		return nil
+	}
+	key, err := e.fetchKey(s.volume.Name)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(e.KeyCheck), []byte(keyCheck(key, e.KeyID))) {
+		return ErrWrongKey
+	}
+	return blockset.AddKey(e.KeyID, key)
+}
@@ -0,0 +1,89 @@
+package block
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+// Reconstruct rebuilds the lost data and parity blocks of an erasure coded
+// volume, including those held only by its snapshots, and returns how many
+// were rebuilt. Volumes which aren't erasure coded have nothing to do.
+func (s *BlockVolume) Reconstruct(ctx context.Context) (int, error) {
+	refs := []torus.INodeRef{}
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return 0, err
+	}
+	refs = append(refs, ref)
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return 0, err
+	}
+	for _, x := range snaps {
+		refs = append(refs, torus.INodeRefFromBytes(x.INodeRef))
+	}
+	rebuilt := 0
+	for _, ref := range refs {
+		if ref.INode <= 1 {
+			// Nothing has been written yet.
+			continue
+		}
+		inode, err := s.srv.INodes.GetINode(ctx, ref)
+		if err != nil {
+			return rebuilt, err
+		}
+		bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), s.srv.Blocks)
+		if err != nil {
+			return rebuilt, err
+		}
+		n, err := blockset.Reconstruct(ctx, bs)
+		rebuilt += n
+		if err != nil {
+			return rebuilt, err
+		}
+	}
+	return rebuilt, nil
+}
+
+// RunErasureReconstruction reconstructs every erasure coded block volume in
+// the cluster, reporting how many volumes it's been through. Errors on one
+// volume are logged and don't stop the others.
+func RunErasureReconstruction(ctx context.Context, srv *torus.Server, progress func(int, int)) error {
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		return err
+	}
+	for i, v := range vols {
+		progress(i, len(vols))
+		if v.Type != VolumeType {
+			continue
+		}
+		bv, err := OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			clog.Errorf("erasure reconstruct: couldn't open volume %s: %v", v.Name, err)
+			continue
+		}
+		opts, err := bv.mds.GetVolumeOptions()
+		if err != nil {
+			clog.Errorf("erasure reconstruct: volume %s: %v", v.Name, err)
+			continue
+		}
+		if opts.Erasure == "" {
+			continue
+		}
+		n, err := bv.Reconstruct(ctx)
+		if n != 0 {
+			clog.Infof("erasure reconstruct: rebuilt %d blocks of volume %s", n, v.Name)
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		if err != nil {
+			clog.Errorf("erasure reconstruct: volume %s: %v", v.Name, err)
+		}
+	}
+	progress(len(vols), len(vols))
+	return nil
+}
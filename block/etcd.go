@@ -1,8 +1,14 @@
 package block
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	etcdv3 "github.com/coreos/etcd/clientv3"
 	"golang.org/x/net/context"
@@ -18,7 +24,7 @@ type blockEtcd struct {
 	vid  torus.VolumeID
 }
 
-func (b *blockEtcd) CreateBlockVolume(volume *models.Volume) error {
+func (b *blockEtcd) CreateBlockVolume(volume *models.Volume, opts VolumeOptions) error {
 	new, err := b.AtomicModifyKey([]byte(etcd.MkKey("meta", "volumeminter")), etcd.BytesAddOne)
 	volume.Id = new.(uint64)
 	if err != nil {
@@ -29,15 +35,30 @@ func (b *blockEtcd) CreateBlockVolume(volume *models.Volume) error {
 		return err
 	}
 	inodeBytes := torus.NewINodeRef(torus.VolumeID(volume.Id), 1).ToBytes()
+	optBytes, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
 
-	do := b.Etcd.Client.Txn(b.getContext()).If(
-		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumes", volume.Name)), "=", 0),
-	).Then(
+	ops := []etcdv3.Op{
 		etcdv3.OpPut(etcd.MkKey("volumes", volume.Name), string(etcd.Uint64ToBytes(volume.Id))),
 		etcdv3.OpPut(etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id)), string(vbytes)),
 		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "inode"), string(etcd.Uint64ToBytes(1))),
 		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "blockinode"), string(inodeBytes)),
-	)
+		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "options"), string(optBytes)),
+	}
+	if len(opts.Labels) != 0 {
+		lbytes, err := json.Marshal(opts.Labels)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "labels"), string(lbytes)))
+		ops = append(ops, labelIndexPuts(volume.Name, volume.Id, opts.Labels)...)
+	}
+
+	do := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumes", volume.Name)), "=", 0),
+	).Then(ops...)
 	resp, err := do.Commit()
 	if err != nil {
 		return err
@@ -48,24 +69,386 @@ func (b *blockEtcd) CreateBlockVolume(volume *models.Volume) error {
 	return nil
 }
 
+func (b *blockEtcd) GetVolumeOptions() (VolumeOptions, error) {
+	var opts VolumeOptions
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "options"))
+	if err != nil {
+		return opts, err
+	}
+	// Volumes created before options existed have none.
+	if len(resp.Kvs) == 0 {
+		return opts, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &opts)
+	return opts, err
+}
+
+func (b *blockEtcd) getVolumeRecord() (*models.Volume, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumeid", etcd.Uint64ToHex(uint64(b.vid))))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, torus.ErrNotExist
+	}
+	vol := &models.Volume{}
+	if err := vol.Unmarshal(resp.Kvs[0].Value); err != nil {
+		return nil, 0, err
+	}
+	return vol, resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) GetVolumeSize() (uint64, error) {
+	vol, _, err := b.getVolumeRecord()
+	if err != nil {
+		return 0, err
+	}
+	return vol.MaxBytes, nil
+}
+
+func (b *blockEtcd) UpdateVolumeSize(fn func(cur uint64) (uint64, error)) (uint64, error) {
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(uint64(b.vid)))
+	for {
+		vol, rev, err := b.getVolumeRecord()
+		if err != nil {
+			return 0, err
+		}
+		next, err := fn(vol.MaxBytes)
+		if err != nil {
+			return vol.MaxBytes, err
+		}
+		vol.MaxBytes = next
+		vbytes, err := vol.Marshal()
+		if err != nil {
+			return 0, err
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(idKey), "=", rev),
+		).Then(
+			etcdv3.OpPut(idKey, string(vbytes)),
+		).Commit()
+		if err != nil {
+			return 0, err
+		}
+		if resp.Succeeded {
+			return next, nil
+		}
+		// The volume was resized or deleted first; look again.
+	}
+}
+
 func (b *blockEtcd) DeleteVolume() error {
 	vid := uint64(b.vid)
-	tx := b.Etcd.Client.Txn(b.getContext()).If(
-		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")), "=", 0),
+	lockKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	for {
+		labels, rev, err := b.getLabels()
+		if err != nil {
+			return err
+		}
+		ops := []etcdv3.Op{
+			etcdv3.OpDelete(etcd.MkKey("volumes", b.name)),
+			etcdv3.OpDelete(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))),
+			etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
+			etcdv3.OpDelete(etcd.VolumeReplicationKey(vid)),
+		}
+		ops = append(ops, labelIndexDeletes(b.name, labels)...)
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(lockKey), "=", 0),
+			etcdv3.Compare(etcdv3.ModRevision(b.labelsKey()), "=", rev),
+		).Then(ops...).Else(
+			etcdv3.OpGet(lockKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrLocked
+		}
+		// The labels changed under us; try again with the new ones.
+	}
+}
+
+func (b *blockEtcd) trashKey() string {
+	return etcd.MkKey("trash", etcd.Uint64ToHex(uint64(b.vid)))
+}
+
+func (b *blockEtcd) TrashVolume(deleted, expires time.Time) error {
+	vid := uint64(b.vid)
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	lockKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blocklock")
+	for {
+		labels, rev, err := b.getLabels()
+		if err != nil {
+			return err
+		}
+		vol, volRev, err := b.getVolumeRecord()
+		if err != nil {
+			return err
+		}
+		tbytes, err := json.Marshal(TrashedVolume{
+			Name:    b.name,
+			ID:      vid,
+			Size:    vol.MaxBytes,
+			Deleted: deleted,
+			Expires: expires,
+		})
+		if err != nil {
+			return err
+		}
+		// The volume's metadata stays where it is, so that its blocks
+		// aren't collected and it can be restored as it was.
+		ops := []etcdv3.Op{
+			etcdv3.OpDelete(etcd.MkKey("volumes", b.name)),
+			etcdv3.OpDelete(idKey),
+			etcdv3.OpPut(b.trashKey(), string(tbytes)),
+		}
+		ops = append(ops, labelIndexDeletes(b.name, labels)...)
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(lockKey), "=", 0),
+			etcdv3.Compare(etcdv3.ModRevision(b.labelsKey()), "=", rev),
+			etcdv3.Compare(etcdv3.ModRevision(idKey), "=", volRev),
+		).Then(ops...).Else(
+			etcdv3.OpGet(lockKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrLocked
+		}
+		// The labels or size changed under us; try again with the new
+		// ones.
+	}
+}
+
+func (b *blockEtcd) GetTrash() ([]TrashedVolume, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("trash")+"/", etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]TrashedVolume, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		err := json.Unmarshal(kv.Value, &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// getTrash returns the volume's trash record and the revision it was written
+// at.
+func (b *blockEtcd) getTrash() (*TrashedVolume, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.trashKey())
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, torus.ErrNotExist
+	}
+	t := &TrashedVolume{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, t); err != nil {
+		return nil, 0, err
+	}
+	return t, resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) RestoreVolume(name string) error {
+	vid := uint64(b.vid)
+	nameKey := etcd.MkKey("volumes", name)
+	for {
+		t, rev, err := b.getTrash()
+		if err != nil {
+			return err
+		}
+		labels, lrev, err := b.getLabels()
+		if err != nil {
+			return err
+		}
+		vbytes, err := t.volume(name).Marshal()
+		if err != nil {
+			return err
+		}
+		ops := []etcdv3.Op{
+			etcdv3.OpPut(nameKey, string(etcd.Uint64ToBytes(vid))),
+			etcdv3.OpPut(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid)), string(vbytes)),
+			etcdv3.OpDelete(b.trashKey()),
+		}
+		ops = append(ops, labelIndexPuts(name, vid, labels)...)
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(nameKey), "=", 0),
+			etcdv3.Compare(etcdv3.ModRevision(b.trashKey()), "=", rev),
+			etcdv3.Compare(etcdv3.ModRevision(b.labelsKey()), "=", lrev),
+		).Then(ops...).Else(
+			etcdv3.OpGet(nameKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrExists
+		}
+		// It was restored, purged or relabelled under us; look again.
+	}
+}
+
+func (b *blockEtcd) PurgeVolume() error {
+	_, rev, err := b.getTrash()
+	if err != nil {
+		return err
+	}
+	tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.ModRevision(b.trashKey()), "=", rev),
 	).Then(
-		etcdv3.OpDelete(etcd.MkKey("volumes", b.name)),
-		etcdv3.OpDelete(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))),
-		etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
-	)
-	resp, err := tx.Commit()
+		etcdv3.OpDelete(b.trashKey()),
+		etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)))+"/", etcdv3.WithPrefix()),
+		etcdv3.OpDelete(etcd.VolumeReplicationKey(uint64(b.vid))),
+	).Commit()
 	if err != nil {
 		return err
 	}
-	if !resp.Succeeded {
-		return torus.ErrLocked
+	if !tx.Succeeded {
+		return torus.ErrNotExist
 	}
 	return nil
+}
+
+func (b *blockEtcd) descriptionKey() string {
+	return etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "description")
+}
 
+func (b *blockEtcd) GetDescription() (string, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.descriptionKey())
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+func (b *blockEtcd) EditVolume(e VolumeEdit) error {
+	vid := uint64(b.vid)
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	groupsKey := etcd.MkKey("meta", "consistencygroups") + "/"
+	for {
+		vol, volRev, err := b.getVolumeRecord()
+		if err != nil {
+			return err
+		}
+		labels, lrev, err := b.getLabels()
+		if err != nil {
+			return err
+		}
+		desc, err := b.Etcd.Client.Get(b.getContext(), b.descriptionKey())
+		if err != nil {
+			return err
+		}
+		var drev int64
+		if len(desc.Kvs) != 0 {
+			drev = desc.Kvs[0].ModRevision
+		}
+		// The record's name is the current one, whatever the metadata
+		// was opened with.
+		from, to := vol.Name, vol.Name
+		if e.Name != "" {
+			to = e.Name
+		}
+		newLabels := labels
+		if e.Labels != nil {
+			newLabels = e.Labels
+		}
+		vol.Name = to
+		vbytes, err := vol.Marshal()
+		if err != nil {
+			return err
+		}
+		toKey := etcd.MkKey("volumes", to)
+		cmps := []etcdv3.Cmp{
+			etcdv3.Compare(etcdv3.ModRevision(idKey), "=", volRev),
+			etcdv3.Compare(etcdv3.ModRevision(b.labelsKey()), "=", lrev),
+			etcdv3.Compare(etcdv3.ModRevision(b.descriptionKey()), "=", drev),
+		}
+		ops := []etcdv3.Op{
+			etcdv3.OpPut(idKey, string(vbytes)),
+		}
+		// The label index is keyed by name, so it's rewritten on a
+		// rename as well as when the labels change.
+		ops = append(ops, labelIndexDeletes(from, labels)...)
+		ops = append(ops, labelIndexPuts(to, vid, newLabels)...)
+		if e.Labels != nil {
+			if len(e.Labels) == 0 {
+				ops = append(ops, etcdv3.OpDelete(b.labelsKey()))
+			} else {
+				lbytes, err := json.Marshal(e.Labels)
+				if err != nil {
+					return err
+				}
+				ops = append(ops, etcdv3.OpPut(b.labelsKey(), string(lbytes)))
+			}
+		}
+		if e.Description != nil {
+			if *e.Description == "" {
+				ops = append(ops, etcdv3.OpDelete(b.descriptionKey()))
+			} else {
+				ops = append(ops, etcdv3.OpPut(b.descriptionKey(), *e.Description))
+			}
+		}
+		if to != from {
+			cmps = append(cmps, etcdv3.Compare(etcdv3.Version(toKey), "=", 0))
+			ops = append(ops,
+				etcdv3.OpDelete(etcd.MkKey("volumes", from)),
+				etcdv3.OpPut(toKey, string(etcd.Uint64ToBytes(vid))),
+			)
+			groups, err := b.Etcd.Client.Get(b.getContext(), groupsKey, etcdv3.WithPrefix())
+			if err != nil {
+				return err
+			}
+			for _, kv := range groups.Kvs {
+				g := &ConsistencyGroup{}
+				if err := json.Unmarshal(kv.Value, g); err != nil {
+					return err
+				}
+				if !g.renameMember(from, to) {
+					continue
+				}
+				gbytes, err := json.Marshal(g)
+				if err != nil {
+					return err
+				}
+				cmps = append(cmps, etcdv3.Compare(etcdv3.ModRevision(string(kv.Key)), "=", kv.ModRevision))
+				ops = append(ops, etcdv3.OpPut(string(kv.Key), string(gbytes)))
+			}
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Else(
+			etcdv3.OpGet(toKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if to != from && len(resp.Responses[0].GetResponseRange().Kvs) != 0 {
+			return torus.ErrExists
+		}
+		// The volume, its labels or description, or one of its groups
+		// changed under us; try again.
+	}
 }
 
 func (b *blockEtcd) getContext() context.Context {
@@ -92,6 +475,76 @@ func (b *blockEtcd) Lock(lease int64) error {
 	return nil
 }
 
+func (b *blockEtcd) Fence(lease int64) error {
+	if lease == 0 {
+		return torus.ErrInvalid
+	}
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blocklock")
+	_, err := b.Etcd.Client.Put(b.getContext(), k, b.Etcd.UUID(), etcdv3.WithLease(etcdv3.LeaseID(lease)))
+	return err
+}
+
+func (b *blockEtcd) WaitUnlocked(ctx context.Context) error {
+	return b.waitKeyFree(ctx, etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blocklock"))
+}
+
+// waitKeyFree blocks until k doesn't exist or ctx is done, watching k.
+func (b *blockEtcd) waitKeyFree(ctx context.Context, k string) error {
+	for {
+		resp, err := b.Etcd.Client.Get(ctx, k)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return nil
+		}
+		if b.watchForDelete(ctx, k, resp.Header.Revision+1) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The watch broke off; look again.
+	}
+}
+
+func (b *blockEtcd) rangeKey(n uint64) string {
+	return etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "ranges", etcd.Uint64ToHex(n))
+}
+
+func (b *blockEtcd) LeaseRange(n uint64, lease int64) error {
+	if lease == 0 {
+		return torus.ErrInvalid
+	}
+	k := b.rangeKey(n)
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, b.Etcd.UUID(), etcdv3.WithLease(etcdv3.LeaseID(lease))),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrLocked
+	}
+	return nil
+}
+
+func (b *blockEtcd) ReleaseRange(n uint64) error {
+	k := b.rangeKey(n)
+	_, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Value(k), "=", b.Etcd.UUID()),
+	).Then(
+		etcdv3.OpDelete(k),
+	).Commit()
+	return err
+}
+
+func (b *blockEtcd) WaitRangeFree(ctx context.Context, n uint64) error {
+	return b.waitKeyFree(ctx, b.rangeKey(n))
+}
+
 func (b *blockEtcd) GetINode() (torus.INodeRef, error) {
 	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "blockinode"))
 	if err != nil {
@@ -142,7 +595,7 @@ func (b *blockEtcd) Unlock() error {
 	return nil
 }
 
-func (b *blockEtcd) SaveSnapshot(name string) error {
+func (b *blockEtcd) SaveSnapshot(name string, annotations map[string]string) error {
 	vid := uint64(b.vid)
 	for {
 		sshotKey := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "snapshots", name)
@@ -161,8 +614,9 @@ func (b *blockEtcd) SaveSnapshot(name string) error {
 		}
 		v := resp.Responses[0].GetResponseRange().Kvs[0]
 		inode := Snapshot{
-			Name:     name,
-			INodeRef: v.Value,
+			Name:        name,
+			INodeRef:    v.Value,
+			Annotations: annotations,
 		}
 		bytes, err := json.Marshal(inode)
 		if err != nil {
@@ -220,6 +674,53 @@ func (b *blockEtcd) DeleteSnapshot(name string) error {
 	return nil
 }
 
+func (b *blockEtcd) RollbackSnapshot(name string, force bool) error {
+	vid := etcd.Uint64ToHex(uint64(b.vid))
+	sshotKey := etcd.MkKey("volumemeta", vid, "snapshots", name)
+	lockKey := etcd.MkKey("volumemeta", vid, "blocklock")
+	for {
+		resp, err := b.Etcd.Client.Get(b.getContext(), sshotKey)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return torus.ErrNotExist
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(resp.Kvs[0].Value, &snap); err != nil {
+			return err
+		}
+		rev := resp.Kvs[0].ModRevision
+		cmps := []etcdv3.Cmp{
+			etcdv3.Compare(etcdv3.ModRevision(sshotKey), "=", rev),
+		}
+		ops := []etcdv3.Op{
+			etcdv3.OpPut(etcd.MkKey("volumemeta", vid, "blockinode"), string(snap.INodeRef)),
+		}
+		if force {
+			// Whoever has the volume attached finds the lock gone the
+			// next time it syncs, and stops writing.
+			ops = append(ops, etcdv3.OpDelete(lockKey))
+		} else {
+			cmps = append(cmps, etcdv3.Compare(etcdv3.Version(lockKey), "=", 0))
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Else(
+			etcdv3.OpGet(sshotKey),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if tx.Succeeded {
+			return nil
+		}
+		kvs := tx.Responses[0].GetResponseRange().Kvs
+		if len(kvs) != 0 && kvs[0].ModRevision == rev {
+			return torus.ErrLocked
+		}
+		// The snapshot was deleted or replaced under us; look again.
+	}
+}
+
 func createBlockEtcdMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
 	if e, ok := mds.(*etcd.Etcd); ok {
 		return &blockEtcd{
@@ -230,3 +731,1634 @@ func createBlockEtcdMetadata(mds torus.MetadataService, name string, vid torus.V
 	}
 	panic("how are we creating an etcd metadata that doesn't implement it but reports as being etcd")
 }
+
+func (b *blockEtcd) GetSnapshotPolicy() (*SnapshotPolicy, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "snapshotpolicy"))
+	if err != nil {
+		return nil, err
+	}
+	p := &SnapshotPolicy{}
+	if len(resp.Kvs) == 0 {
+		return p, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (b *blockEtcd) SetSnapshotPolicy(p *SnapshotPolicy) error {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "snapshotpolicy")
+	if len(p.Schedules) == 0 {
+		_, err := b.Etcd.Client.Delete(b.getContext(), k)
+		return err
+	}
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	// Guard against racing a volume delete, which would leave the policy
+	// orphaned under a stale volume ID.
+	tx := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))), ">", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes)),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+// checkpointBatch bounds the volumes handled in each etcd transaction of a
+// checkpoint, which has a compare or two and an op for each, so that it stays
+// within etcd's limit on operations per transaction (--max-txn-ops, 128 by
+// default) however many volumes there are.
+const checkpointBatch = 32
+
+// checkpointBatches splits the sorted names of vols into checkpointBatch
+// sized runs.
+func checkpointBatches(vols map[string][]byte) [][]string {
+	names := make([]string, 0, len(vols))
+	for vol := range vols {
+		names = append(names, vol)
+	}
+	sort.Strings(names)
+	var out [][]string
+	for len(names) > checkpointBatch {
+		out = append(out, names[:checkpointBatch])
+		names = names[checkpointBatch:]
+	}
+	if len(names) > 0 {
+		out = append(out, names)
+	}
+	return out
+}
+
+func checkpointSnapshotKey(c *Checkpoint, vol string) string {
+	vid := torus.INodeRefFromBytes(c.Volumes[vol]).Volume()
+	return etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(vid)), "snapshots", c.SnapshotName())
+}
+
+// SaveCheckpoint snapshots the volumes a batch at a time, then writes the
+// checkpoint itself, so that it only exists once all of its snapshots do. If
+// it fails part way, the snapshots already written are deleted again.
+func (b *blockEtcd) SaveCheckpoint(name string, now time.Time) (*Checkpoint, error) {
+	ckKey := etcd.MkKey("meta", "checkpoints", name)
+	volsKey := etcd.MkKey("volumes") + "/"
+	resp, err := b.Etcd.Client.Get(b.getContext(), volsKey, etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	// Every volume is read as of the same revision, whatever has been
+	// written since.
+	c := &Checkpoint{
+		Name:     name,
+		Created:  now,
+		Revision: resp.Header.Revision,
+		Volumes:  make(map[string][]byte),
+	}
+	for _, kv := range resp.Kvs {
+		vol := strings.TrimPrefix(string(kv.Key), volsKey)
+		vid := etcd.BytesToUint64(kv.Value)
+		ino, err := b.Etcd.Client.Get(b.getContext(),
+			etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "blockinode"),
+			etcdv3.WithRev(c.Revision))
+		if err != nil {
+			return nil, err
+		}
+		if len(ino.Kvs) == 0 {
+			// Not a block volume.
+			continue
+		}
+		c.Volumes[vol] = ino.Kvs[0].Value
+	}
+	cbytes, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.getCheckpoint(name); err != torus.ErrNotExist {
+		if err == nil {
+			err = torus.ErrExists
+		}
+		return nil, err
+	}
+
+	var saved []string
+	for _, batch := range checkpointBatches(c.Volumes) {
+		var (
+			cmps []etcdv3.Cmp
+			ops  []etcdv3.Op
+		)
+		for _, vol := range batch {
+			sbytes, err := json.Marshal(Snapshot{
+				Name:     c.SnapshotName(),
+				INodeRef: c.Volumes[vol],
+			})
+			if err != nil {
+				return nil, err
+			}
+			k := checkpointSnapshotKey(c, vol)
+			cmps = append(cmps, etcdv3.Compare(etcdv3.Version(k), "=", 0))
+			ops = append(ops, etcdv3.OpPut(k, string(sbytes)))
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Commit()
+		if err == nil && !tx.Succeeded {
+			err = torus.ErrExists
+		}
+		if err != nil {
+			b.deleteCheckpointSnapshots(c, saved)
+			return nil, err
+		}
+		saved = append(saved, batch...)
+	}
+	tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(ckKey), "=", 0),
+	).Then(
+		etcdv3.OpPut(ckKey, string(cbytes)),
+	).Commit()
+	if err == nil && !tx.Succeeded {
+		err = torus.ErrExists
+	}
+	if err != nil {
+		b.deleteCheckpointSnapshots(c, saved)
+		return nil, err
+	}
+	return c, nil
+}
+
+// deleteCheckpointSnapshots deletes the snapshots c took of vols, a batch at
+// a time.
+func (b *blockEtcd) deleteCheckpointSnapshots(c *Checkpoint, vols []string) error {
+	for len(vols) > 0 {
+		n := len(vols)
+		if n > checkpointBatch {
+			n = checkpointBatch
+		}
+		var ops []etcdv3.Op
+		for _, vol := range vols[:n] {
+			ops = append(ops, etcdv3.OpDelete(checkpointSnapshotKey(c, vol)))
+		}
+		if _, err := b.Etcd.Client.Txn(b.getContext()).Then(ops...).Commit(); err != nil {
+			return err
+		}
+		vols = vols[n:]
+	}
+	return nil
+}
+
+func (b *blockEtcd) getCheckpoint(name string) (*Checkpoint, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("meta", "checkpoints", name))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, torus.ErrNotExist
+	}
+	c := &Checkpoint{}
+	err = json.Unmarshal(resp.Kvs[0].Value, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (b *blockEtcd) GetCheckpoints() ([]Checkpoint, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("meta", "checkpoints")+"/", etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Checkpoint, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		err := json.Unmarshal(kv.Value, &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// DeleteCheckpoint deletes the checkpoint itself first, so that nothing can
+// restore it once its snapshots start going.
+func (b *blockEtcd) DeleteCheckpoint(name string) error {
+	c, err := b.getCheckpoint(name)
+	if err != nil {
+		return err
+	}
+	if _, err := b.Etcd.Client.Delete(b.getContext(), etcd.MkKey("meta", "checkpoints", name)); err != nil {
+		return err
+	}
+	var vols []string
+	for _, batch := range checkpointBatches(c.Volumes) {
+		vols = append(vols, batch...)
+	}
+	return b.deleteCheckpointSnapshots(c, vols)
+}
+
+// RestoreCheckpoint takes the lock of every volume in the checkpoint, a batch
+// at a time, under a lease of its own, then swaps their INodes a batch at a
+// time. Revoking the lease releases the locks. If restoring is cut short, the
+// volumes swapped so far stay restored, and the rest are left as they were;
+// the locks are released when the lease expires.
+func (b *blockEtcd) RestoreCheckpoint(name string) ([]string, error) {
+	c, err := b.getCheckpoint(name)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		vols    = make(map[string][]byte)
+		skipped []string
+	)
+	for vol, ino := range c.Volumes {
+		vid := etcd.Uint64ToHex(uint64(torus.INodeRefFromBytes(ino).Volume()))
+		resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("volumeid", vid))
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Kvs) == 0 {
+			skipped = append(skipped, vol)
+			continue
+		}
+		vols[vol] = ino
+	}
+	if len(vols) == 0 {
+		return skipped, nil
+	}
+	lease, err := b.GetLease()
+	if err != nil {
+		return nil, err
+	}
+	defer b.Etcd.Client.Revoke(b.getContext(), etcdv3.LeaseID(lease))
+
+	batches := checkpointBatches(vols)
+	lockKey := func(vol string) string {
+		vid := etcd.Uint64ToHex(uint64(torus.INodeRefFromBytes(vols[vol]).Volume()))
+		return etcd.MkKey("volumemeta", vid, "blocklock")
+	}
+	for _, batch := range batches {
+		var (
+			cmps []etcdv3.Cmp
+			ops  []etcdv3.Op
+		)
+		for _, vol := range batch {
+			vid := etcd.Uint64ToHex(uint64(torus.INodeRefFromBytes(vols[vol]).Volume()))
+			cmps = append(cmps,
+				etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumeid", vid)), ">", 0),
+				etcdv3.Compare(etcdv3.Version(lockKey(vol)), "=", 0),
+			)
+			ops = append(ops, etcdv3.OpPut(lockKey(vol), b.Etcd.UUID(), etcdv3.WithLease(etcdv3.LeaseID(lease))))
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if !tx.Succeeded {
+			// Either a volume is attached or one was deleted under
+			// us; both leave the cluster in a state we shouldn't
+			// restore over.
+			return nil, torus.ErrLocked
+		}
+	}
+	for _, batch := range batches {
+		var (
+			cmps []etcdv3.Cmp
+			ops  []etcdv3.Op
+		)
+		for _, vol := range batch {
+			vid := etcd.Uint64ToHex(uint64(torus.INodeRefFromBytes(vols[vol]).Volume()))
+			cmps = append(cmps, etcdv3.Compare(etcdv3.Value(lockKey(vol)), "=", b.Etcd.UUID()))
+			ops = append(ops, etcdv3.OpPut(etcd.MkKey("volumemeta", vid, "blockinode"), string(vols[vol])))
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if !tx.Succeeded {
+			// The lease ran out and someone else took a lock.
+			return nil, torus.ErrLocked
+		}
+	}
+	return skipped, nil
+}
+
+func (b *blockEtcd) CreateConsistencyGroup(g ConsistencyGroup) error {
+	k := etcd.MkKey("meta", "consistencygroups", g.Name)
+	bytes, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !tx.Succeeded {
+		return torus.ErrExists
+	}
+	return nil
+}
+
+func (b *blockEtcd) GetConsistencyGroups() ([]ConsistencyGroup, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("meta", "consistencygroups")+"/", etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ConsistencyGroup, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		err := json.Unmarshal(kv.Value, &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// getConsistencyGroup returns the named group and the revision it was last
+// changed at.
+func (b *blockEtcd) getConsistencyGroup(name string) (*ConsistencyGroup, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("meta", "consistencygroups", name))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, torus.ErrNotExist
+	}
+	g := &ConsistencyGroup{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, g); err != nil {
+		return nil, 0, err
+	}
+	return g, resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) UpdateConsistencyGroup(name string, fn func(g *ConsistencyGroup) error) (*ConsistencyGroup, error) {
+	k := etcd.MkKey("meta", "consistencygroups", name)
+	for {
+		g, rev, err := b.getConsistencyGroup(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(g); err != nil {
+			return nil, err
+		}
+		bytes, err := json.Marshal(g)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+		).Then(
+			etcdv3.OpPut(k, string(bytes)),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if tx.Succeeded {
+			return g, nil
+		}
+		// The group changed or was deleted under us; look again.
+	}
+}
+
+func (b *blockEtcd) DeleteConsistencyGroup(name string) error {
+	k := etcd.MkKey("meta", "consistencygroups", name)
+	tx, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), ">", 0),
+	).Then(
+		etcdv3.OpDelete(k),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !tx.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+func (b *blockEtcd) SaveGroupSnapshot(group, name string, annotations map[string]string) (int64, error) {
+	for {
+		rev, sshotKeys, err := b.saveGroupSnapshot(group, name, annotations)
+		if err != nil || rev != 0 {
+			return rev, err
+		}
+		for _, k := range sshotKeys {
+			resp, err := b.Etcd.Client.Get(b.getContext(), k)
+			if err != nil {
+				return 0, err
+			}
+			if len(resp.Kvs) != 0 {
+				return 0, torus.ErrExists
+			}
+		}
+		// The group or one of its members changed since we read them;
+		// try again as they are now.
+	}
+}
+
+// saveGroupSnapshot tries to take a group snapshot once. If the transaction
+// fails, it returns a zero revision and the keys of the snapshots it tried to
+// save.
+func (b *blockEtcd) saveGroupSnapshot(group, name string, annotations map[string]string) (int64, []string, error) {
+	groupKey := etcd.MkKey("meta", "consistencygroups", group)
+	resp, err := b.Etcd.Client.Get(b.getContext(), groupKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil, torus.ErrNotExist
+	}
+	// As with checkpoints, every member is read as of the same revision,
+	// whatever is synced to them meanwhile.
+	rev := resp.Header.Revision
+	g := &ConsistencyGroup{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, g); err != nil {
+		return 0, nil, err
+	}
+	cmps := []etcdv3.Cmp{
+		etcdv3.Compare(etcdv3.ModRevision(groupKey), "=", resp.Kvs[0].ModRevision),
+	}
+	var (
+		ops       []etcdv3.Op
+		sshotKeys []string
+	)
+	for _, vol := range g.Volumes {
+		volKey := etcd.MkKey("volumes", vol)
+		idResp, err := b.Etcd.Client.Get(b.getContext(), volKey, etcdv3.WithRev(rev))
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(idResp.Kvs) == 0 {
+			return 0, nil, fmt.Errorf("volume %s: %v", vol, torus.ErrNotExist)
+		}
+		vid := etcd.Uint64ToHex(etcd.BytesToUint64(idResp.Kvs[0].Value))
+		ino, err := b.Etcd.Client.Get(b.getContext(),
+			etcd.MkKey("volumemeta", vid, "blockinode"),
+			etcdv3.WithRev(rev))
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(ino.Kvs) == 0 {
+			return 0, nil, fmt.Errorf("volume %s is not a block volume", vol)
+		}
+		sbytes, err := json.Marshal(Snapshot{
+			Name:        name,
+			INodeRef:    ino.Kvs[0].Value,
+			Annotations: annotations,
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		sshotKey := etcd.MkKey("volumemeta", vid, "snapshots", name)
+		cmps = append(cmps,
+			etcdv3.Compare(etcdv3.ModRevision(volKey), "=", idResp.Kvs[0].ModRevision),
+			etcdv3.Compare(etcdv3.Version(sshotKey), "=", 0),
+		)
+		ops = append(ops, etcdv3.OpPut(sshotKey, string(sbytes)))
+		sshotKeys = append(sshotKeys, sshotKey)
+	}
+	tx, err := b.Etcd.Client.Txn(b.getContext()).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return 0, nil, err
+	}
+	if !tx.Succeeded {
+		return 0, sshotKeys, nil
+	}
+	return rev, nil, nil
+}
+
+func (b *blockEtcd) labelsKey() string {
+	return etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "labels")
+}
+
+func labelIndexKey(k, v, volume string) string {
+	return etcd.MkKey("volumelabels", k, v, volume)
+}
+
+func labelIndexPuts(volume string, vid uint64, labels map[string]string) []etcdv3.Op {
+	var ops []etcdv3.Op
+	for k, v := range labels {
+		ops = append(ops, etcdv3.OpPut(labelIndexKey(k, v, volume), etcd.Uint64ToHex(vid)))
+	}
+	return ops
+}
+
+func labelIndexDeletes(volume string, labels map[string]string) []etcdv3.Op {
+	var ops []etcdv3.Op
+	for k, v := range labels {
+		ops = append(ops, etcdv3.OpDelete(labelIndexKey(k, v, volume)))
+	}
+	return ops
+}
+
+// getLabels returns the volume's labels and the revision they were last
+// changed at, which is zero if they've never been set.
+func (b *blockEtcd) getLabels() (map[string]string, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.labelsKey())
+	if err != nil {
+		return nil, 0, err
+	}
+	labels := make(map[string]string)
+	if len(resp.Kvs) == 0 {
+		return labels, 0, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &labels)
+	if err != nil {
+		return nil, 0, err
+	}
+	return labels, resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) GetLabels() (map[string]string, error) {
+	labels, _, err := b.getLabels()
+	return labels, err
+}
+
+func (b *blockEtcd) SetLabels(labels map[string]string) error {
+	vid := uint64(b.vid)
+	lbytes, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	for {
+		old, rev, err := b.getLabels()
+		if err != nil {
+			return err
+		}
+		// The index changes with the labels, in the same transaction, so
+		// lookups never see one without the other.
+		ops := labelIndexDeletes(b.name, old)
+		ops = append(ops, labelIndexPuts(b.name, vid, labels)...)
+		if len(labels) == 0 {
+			ops = append(ops, etcdv3.OpDelete(b.labelsKey()))
+		} else {
+			ops = append(ops, etcdv3.OpPut(b.labelsKey(), string(lbytes)))
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))), ">", 0),
+			etcdv3.Compare(etcdv3.ModRevision(b.labelsKey()), "=", rev),
+		).Then(ops...).Else(
+			etcdv3.OpGet(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return torus.ErrNotExist
+		}
+	}
+}
+
+func (b *blockEtcd) FindVolumes(sel Selector) ([]string, error) {
+	var (
+		found map[string]bool
+		rev   int64
+	)
+	for k, v := range sel {
+		prefix := etcd.MkKey("volumelabels", k) + "/"
+		if v != "" {
+			prefix = etcd.MkKey("volumelabels", k, v) + "/"
+		}
+		opts := []etcdv3.OpOption{etcdv3.WithPrefix(), etcdv3.WithKeysOnly()}
+		if rev != 0 {
+			// Read every requirement as of the same revision.
+			opts = append(opts, etcdv3.WithRev(rev))
+		}
+		resp, err := b.Etcd.Client.Get(b.getContext(), prefix, opts...)
+		if err != nil {
+			return nil, err
+		}
+		rev = resp.Header.Revision
+		matched := make(map[string]bool)
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)
+			name := key[strings.LastIndex(key, "/")+1:]
+			if found == nil || found[name] {
+				matched[name] = true
+			}
+		}
+		found = matched
+		if len(found) == 0 {
+			break
+		}
+	}
+	var out []string
+	for name := range found {
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+func (b *blockEtcd) GetVolumeTuning() (*VolumeTuning, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "tuning"))
+	if err != nil {
+		return nil, err
+	}
+	t := &VolumeTuning{}
+	if len(resp.Kvs) == 0 {
+		return t, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (b *blockEtcd) SetVolumeTuning(t *VolumeTuning) error {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "tuning")
+	bytes, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	// As with the snapshot policy, don't leave settings behind for a
+	// volume deleted in the meantime.
+	tx := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))), ">", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes)),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+func (b *blockEtcd) GetMACMask() ([]string, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "macmask"))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var mask []string
+	err = json.Unmarshal(resp.Kvs[0].Value, &mask)
+	if err != nil {
+		return nil, err
+	}
+	return mask, nil
+}
+
+func (b *blockEtcd) SetMACMask(mask []string) error {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "macmask")
+	if len(mask) == 0 {
+		_, err := b.Etcd.Client.Delete(b.getContext(), k)
+		return err
+	}
+	bytes, err := json.Marshal(mask)
+	if err != nil {
+		return err
+	}
+	tx := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))), ">", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes)),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+func (b *blockEtcd) GetReservation() ([]string, error) {
+	cur, _, err := b.getReservation()
+	return cur, err
+}
+
+func (b *blockEtcd) getReservation() ([]string, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "reservation"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	var holders []string
+	err = json.Unmarshal(resp.Kvs[0].Value, &holders)
+	if err != nil {
+		return nil, 0, err
+	}
+	return holders, resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) UpdateReservation(fn func(cur []string) ([]string, error)) ([]string, error) {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "reservation")
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	for {
+		cur, rev, err := b.getReservation()
+		if err != nil {
+			return nil, err
+		}
+		next, err := fn(cur)
+		if err != nil {
+			return cur, err
+		}
+		op := etcdv3.OpDelete(k)
+		if len(next) != 0 {
+			bytes, err := json.Marshal(next)
+			if err != nil {
+				return nil, err
+			}
+			op = etcdv3.OpPut(k, string(bytes))
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+			etcdv3.Compare(etcdv3.Version(idKey), ">", 0),
+		).Then(op).Else(
+			etcdv3.OpGet(idKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return next, nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return nil, torus.ErrNotExist
+		}
+		// Another host changed the reservation first; decide again
+		// against what it holds now.
+	}
+}
+
+func (b *blockEtcd) GetAoEConfig() (string, error) {
+	cur, _, err := b.getAoEConfig()
+	return cur, err
+}
+
+func (b *blockEtcd) getAoEConfig() (string, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "aoeconfig"))
+	if err != nil {
+		return "", 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", 0, nil
+	}
+	return string(resp.Kvs[0].Value), resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) UpdateAoEConfig(fn func(cur string) (string, error)) (string, error) {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "aoeconfig")
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	for {
+		cur, rev, err := b.getAoEConfig()
+		if err != nil {
+			return "", err
+		}
+		next, err := fn(cur)
+		if err != nil {
+			return cur, err
+		}
+		op := etcdv3.OpDelete(k)
+		if next != "" {
+			op = etcdv3.OpPut(k, next)
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+			etcdv3.Compare(etcdv3.Version(idKey), ">", 0),
+		).Then(op).Else(
+			etcdv3.OpGet(idKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return "", err
+		}
+		if resp.Succeeded {
+			return next, nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return "", torus.ErrNotExist
+		}
+		// Another host changed it first; decide again against what
+		// it is now.
+	}
+}
+
+func (b *blockEtcd) GetMirror() (*Mirror, error) {
+	m, _, err := b.getMirror()
+	return m, err
+}
+
+func (b *blockEtcd) getMirror() (*Mirror, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "mirror"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	m := &Mirror{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, m); err != nil {
+		return nil, 0, err
+	}
+	return m, resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) UpdateMirror(fn func(cur *Mirror) (*Mirror, error)) (*Mirror, error) {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "mirror")
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	for {
+		cur, rev, err := b.getMirror()
+		if err != nil {
+			return nil, err
+		}
+		next, err := fn(cur.copy())
+		if err != nil {
+			return cur, err
+		}
+		op := etcdv3.OpDelete(k)
+		if next != nil {
+			bytes, err := json.Marshal(next)
+			if err != nil {
+				return nil, err
+			}
+			op = etcdv3.OpPut(k, string(bytes))
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+			etcdv3.Compare(etcdv3.Version(idKey), ">", 0),
+		).Then(op).Else(
+			etcdv3.OpGet(idKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return next, nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return nil, torus.ErrNotExist
+		}
+	}
+}
+
+// getCompaction returns the volume's pending compaction, its key's mod
+// revision and the revision it was read at.
+func (b *blockEtcd) getCompaction(ctx context.Context) (*Compaction, int64, int64, error) {
+	resp, err := b.Etcd.Client.Get(ctx,
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "compaction"))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, resp.Header.Revision, nil
+	}
+	c := &Compaction{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, c); err != nil {
+		return nil, 0, 0, err
+	}
+	return c, resp.Kvs[0].ModRevision, resp.Header.Revision, nil
+}
+
+func (b *blockEtcd) UpdateCompaction(fn func(cur *Compaction) (*Compaction, error)) (*Compaction, error) {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "compaction")
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	for {
+		cur, rev, _, err := b.getCompaction(b.getContext())
+		if err != nil {
+			return nil, err
+		}
+		next, err := fn(cur.copy())
+		if err != nil {
+			return cur, err
+		}
+		op := etcdv3.OpDelete(k)
+		if next != nil {
+			bytes, err := json.Marshal(next)
+			if err != nil {
+				return nil, err
+			}
+			op = etcdv3.OpPut(k, string(bytes))
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+			etcdv3.Compare(etcdv3.Version(idKey), ">", 0),
+		).Then(op).Else(
+			etcdv3.OpGet(idKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return next, nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return nil, torus.ErrNotExist
+		}
+	}
+}
+
+func (b *blockEtcd) WaitCompaction(ctx context.Context, fn func(cur *Compaction) bool) (*Compaction, error) {
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "compaction")
+	for {
+		cur, _, rev, err := b.getCompaction(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if fn(cur) {
+			return cur, nil
+		}
+		// Wait for the next change to it, then look again.
+		wctx, cancel := context.WithCancel(ctx)
+		select {
+		case <-b.Etcd.Client.Watch(wctx, k, etcdv3.WithRev(rev+1)):
+		case <-ctx.Done():
+		}
+		cancel()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (b *blockEtcd) GetPersistentReservations() ([]byte, error) {
+	cur, _, err := b.getPersistentReservations()
+	return cur, err
+}
+
+func (b *blockEtcd) getPersistentReservations() ([]byte, int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(),
+		etcd.MkKey("volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "persistentreservations"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	return resp.Kvs[0].Value, resp.Kvs[0].ModRevision, nil
+}
+
+func (b *blockEtcd) UpdatePersistentReservations(fn func(cur []byte) ([]byte, error)) ([]byte, error) {
+	vid := uint64(b.vid)
+	k := etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid), "persistentreservations")
+	idKey := etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))
+	for {
+		cur, rev, err := b.getPersistentReservations()
+		if err != nil {
+			return nil, err
+		}
+		next, err := fn(cur)
+		if err != nil {
+			return cur, err
+		}
+		op := etcdv3.OpDelete(k)
+		if len(next) != 0 {
+			op = etcdv3.OpPut(k, string(next))
+		}
+		tx := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+			etcdv3.Compare(etcdv3.Version(idKey), ">", 0),
+		).Then(op).Else(
+			etcdv3.OpGet(idKey),
+		)
+		resp, err := tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return next, nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return nil, torus.ErrNotExist
+		}
+		// Another gateway changed them first; decide again against
+		// what they are now.
+	}
+}
+
+func aoeExportKey(major uint16, minor uint8) string {
+	return etcd.MkKey("meta", "aoeexports", fmt.Sprintf("%d.%d", major, minor))
+}
+
+func (b *blockEtcd) RegisterAoEExport(e AoEExport, lease int64) error {
+	k := aoeExportKey(e.Major, e.Minor)
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var opts []etcdv3.OpOption
+	if lease != 0 {
+		opts = append(opts, etcdv3.WithLease(etcdv3.LeaseID(lease)))
+	}
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes), opts...),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrExists
+	}
+	return nil
+}
+
+func (b *blockEtcd) UnregisterAoEExport(e AoEExport) error {
+	k := aoeExportKey(e.Major, e.Minor)
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// Leave the address alone if it has been taken over since.
+	_, err = b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Value(k), "=", string(bytes)),
+	).Then(
+		etcdv3.OpDelete(k),
+	).Commit()
+	return err
+}
+
+func (b *blockEtcd) GetAoEExports() ([]AoEExport, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("meta", "aoeexports")+"/", etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]AoEExport, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		err := json.Unmarshal(kv.Value, &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (b *blockEtcd) WaitAoEExportFree(ctx context.Context, major uint16, minor uint8) error {
+	return b.waitKeyFree(ctx, aoeExportKey(major, minor))
+}
+
+// watchForDelete watches k from revision rev, reporting whether it was
+// deleted before the watch ended.
+func (b *blockEtcd) watchForDelete(ctx context.Context, k string, rev int64) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for resp := range b.Etcd.Client.Watch(ctx, k, etcdv3.WithRev(rev)) {
+		if err := resp.Err(); err != nil {
+			clog.Warningf("error watching %s: %v", k, err)
+			return false
+		}
+		for _, ev := range resp.Events {
+			if ev.Type == etcdv3.EventTypeDelete {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *blockEtcd) CampaignSnapshotScheduler(lease int64) (bool, error) {
+	k := etcd.MkKey("meta", "snapshotscheduler")
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, b.Etcd.UUID(), etcdv3.WithLease(etcdv3.LeaseID(lease))),
+	).Else(
+		etcdv3.OpGet(k),
+	).Commit()
+	if err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	// The key may have expired in between; the next campaign will tell.
+	return len(kvs) != 0 && string(kvs[0].Value) == b.Etcd.UUID(), nil
+}
+
+func bucketKey(name string) string {
+	return etcd.MkKey("meta", "buckets", name)
+}
+
+// objectKey is built by hand, as MkKey would clean the paths in the key.
+func objectKey(bucket, key string) string {
+	return etcd.MkKey("meta", "objects", bucket) + "/" + key
+}
+
+func uploadKey(bucket, id string) string {
+	return etcd.MkKey("meta", "uploads", bucket, id)
+}
+
+// prefixEnd returns the key just past every key starting with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// Every key sorts before "\x00" taken as a range end.
+	return "\x00"
+}
+
+// getJSON unmarshals the value of k into v, returning its ModRevision, or
+// zero if there is no such key.
+func (b *blockEtcd) getJSON(k string, v interface{}) (int64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), k)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return resp.Kvs[0].ModRevision, json.Unmarshal(resp.Kvs[0].Value, v)
+}
+
+func (b *blockEtcd) CreateBucket(bk Bucket) error {
+	k := bucketKey(bk.Name)
+	bytes, err := json.Marshal(bk)
+	if err != nil {
+		return err
+	}
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrExists
+	}
+	return nil
+}
+
+func (b *blockEtcd) GetBucket(name string) (*Bucket, error) {
+	bk := &Bucket{}
+	rev, err := b.getJSON(bucketKey(name), bk)
+	if err != nil {
+		return nil, err
+	}
+	if rev == 0 {
+		return nil, torus.ErrNotExist
+	}
+	return bk, nil
+}
+
+func (b *blockEtcd) GetBuckets() ([]Bucket, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), etcd.MkKey("meta", "buckets")+"/", etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Bucket, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		err := json.Unmarshal(kv.Value, &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (b *blockEtcd) DeleteBucket(name string) error {
+	for _, prefix := range []string{objectKey(name, ""), uploadKey(name, "") + "/"} {
+		resp, err := b.Etcd.Client.Get(b.getContext(), prefix, etcdv3.WithPrefix(), etcdv3.WithLimit(1))
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) != 0 {
+			return ErrBucketNotEmpty
+		}
+	}
+	resp, err := b.Etcd.Client.Delete(b.getContext(), bucketKey(name))
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
+func (b *blockEtcd) GetObject(bucket, key string) (*Object, error) {
+	o := &Object{}
+	rev, err := b.getJSON(objectKey(bucket, key), o)
+	if err != nil {
+		return nil, err
+	}
+	if rev == 0 {
+		return nil, torus.ErrNotExist
+	}
+	return o, nil
+}
+
+func (b *blockEtcd) ListObjects(bucket, prefix, after string, max int) ([]Object, error) {
+	start := objectKey(bucket, prefix)
+	if from := objectKey(bucket, after) + "\x00"; from > start {
+		start = from
+	}
+	opts := []etcdv3.OpOption{etcdv3.WithRange(prefixEnd(objectKey(bucket, prefix)))}
+	if max > 0 {
+		opts = append(opts, etcdv3.WithLimit(int64(max)))
+	}
+	resp, err := b.Etcd.Client.Get(b.getContext(), start, opts...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Object, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		err := json.Unmarshal(kv.Value, &out[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (b *blockEtcd) PutObject(o *Object) (*Object, error) {
+	k := objectKey(o.Bucket, o.Key)
+	bk := bucketKey(o.Bucket)
+	bytes, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		old := &Object{}
+		rev, err := b.getJSON(k, old)
+		if err != nil {
+			return nil, err
+		}
+		if rev == 0 {
+			old = nil
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+			etcdv3.Compare(etcdv3.Version(bk), ">", 0),
+		).Then(
+			etcdv3.OpPut(k, string(bytes)),
+		).Else(
+			etcdv3.OpGet(bk),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return old, nil
+		}
+		if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return nil, torus.ErrNotExist
+		}
+		// The object was replaced first; whatever replaced it is what
+		// this replaces.
+	}
+}
+
+func (b *blockEtcd) DeleteObject(bucket, key string) (*Object, error) {
+	k := objectKey(bucket, key)
+	for {
+		o := &Object{}
+		rev, err := b.getJSON(k, o)
+		if err != nil {
+			return nil, err
+		}
+		if rev == 0 {
+			return nil, torus.ErrNotExist
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+		).Then(
+			etcdv3.OpDelete(k),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return o, nil
+		}
+	}
+}
+
+func (b *blockEtcd) CreateUpload(u *Upload) error {
+	k := uploadKey(u.Bucket, u.ID)
+	bk := bucketKey(u.Bucket)
+	bytes, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+		etcdv3.Compare(etcdv3.Version(bk), ">", 0),
+	).Then(
+		etcdv3.OpPut(k, string(bytes)),
+	).Else(
+		etcdv3.OpGet(bk),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if resp.Succeeded {
+		return nil
+	}
+	if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+		return torus.ErrNotExist
+	}
+	return torus.ErrExists
+}
+
+func (b *blockEtcd) getUpload(bucket, id string) (*Upload, int64, error) {
+	u := &Upload{}
+	rev, err := b.getJSON(uploadKey(bucket, id), u)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rev == 0 {
+		return nil, 0, torus.ErrNotExist
+	}
+	return u, rev, nil
+}
+
+func (b *blockEtcd) GetUpload(bucket, id string) (*Upload, error) {
+	u, _, err := b.getUpload(bucket, id)
+	return u, err
+}
+
+func (b *blockEtcd) UpdateUpload(bucket, id string, fn func(u *Upload) error) (*Upload, error) {
+	k := uploadKey(bucket, id)
+	for {
+		u, rev, err := b.getUpload(bucket, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(u); err != nil {
+			return nil, err
+		}
+		bytes, err := json.Marshal(u)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+		).Then(
+			etcdv3.OpPut(k, string(bytes)),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return u, nil
+		}
+		// Another part was added first; add this one to it.
+	}
+}
+
+func (b *blockEtcd) CompleteUpload(bucket, id string, fn func(u *Upload) (*Object, error)) (*Object, error) {
+	k := uploadKey(bucket, id)
+	for {
+		u, rev, err := b.getUpload(bucket, id)
+		if err != nil {
+			return nil, err
+		}
+		o, err := fn(u)
+		if err != nil {
+			return nil, err
+		}
+		ok := objectKey(o.Bucket, o.Key)
+		old := &Object{}
+		orev, err := b.getJSON(ok, old)
+		if err != nil {
+			return nil, err
+		}
+		if orev == 0 {
+			old = nil
+		}
+		bytes, err := json.Marshal(o)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+			etcdv3.Compare(etcdv3.ModRevision(ok), "=", orev),
+		).Then(
+			etcdv3.OpDelete(k),
+			etcdv3.OpPut(ok, string(bytes)),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return old, nil
+		}
+	}
+}
+
+func (b *blockEtcd) DeleteUpload(bucket, id string) (*Upload, error) {
+	k := uploadKey(bucket, id)
+	for {
+		u, rev, err := b.getUpload(bucket, id)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+			etcdv3.Compare(etcdv3.ModRevision(k), "=", rev),
+		).Then(
+			etcdv3.OpDelete(k),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Succeeded {
+			return u, nil
+		}
+	}
+}
+
+func contentKey(hash []byte) string {
+	return etcd.MkKey("meta", "dedup", "content", hex.EncodeToString(hash))
+}
+
+// hashKey maps a block in the content index back to its hash, so that its
+// entry can be dropped when the block is collected.
+func hashKey(ref torus.BlockRef) string {
+	return etcd.MkKey("meta", "dedup", "hashes", hex.EncodeToString(ref.ToBytes()))
+}
+
+func pinsKey(ref torus.BlockRef) string {
+	return etcd.MkKey("meta", "dedup", "pins", hex.EncodeToString(ref.ToBytes())) + "/"
+}
+
+func condemnedKey(ref torus.BlockRef) string {
+	return etcd.MkKey("meta", "dedup", "condemned", hex.EncodeToString(ref.ToBytes()))
+}
+
+func (b *blockEtcd) LookupContent(hash []byte) (torus.BlockRef, bool, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), contentKey(hash))
+	if err != nil {
+		return torus.BlockRef{}, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return torus.BlockRef{}, false, nil
+	}
+	return torus.BlockRefFromBytes(resp.Kvs[0].Value), true, nil
+}
+
+func (b *blockEtcd) AddContent(hash []byte, ref torus.BlockRef) error {
+	k := contentKey(hash)
+	_, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, string(ref.ToBytes())),
+		etcdv3.OpPut(hashKey(ref), string(hash)),
+	).Commit()
+	return err
+}
+
+func (b *blockEtcd) ForgetContent(hash []byte, ref torus.BlockRef) error {
+	k := contentKey(hash)
+	_, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Value(k), "=", string(ref.ToBytes())),
+	).Then(
+		etcdv3.OpDelete(k),
+		etcdv3.OpDelete(hashKey(ref)),
+	).Commit()
+	return err
+}
+
+func (b *blockEtcd) PinBlock(ref torus.BlockRef, lease int64) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	pin := hex.EncodeToString(id)
+	var opts []etcdv3.OpOption
+	if lease != 0 {
+		opts = append(opts, etcdv3.WithLease(etcdv3.LeaseID(lease)))
+	}
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(condemnedKey(ref)), "=", 0),
+	).Then(
+		etcdv3.OpPut(pinsKey(ref)+pin, "", opts...),
+	).Commit()
+	if err != nil {
+		return "", err
+	}
+	if !resp.Succeeded {
+		return "", torus.ErrBlockNotExist
+	}
+	return pin, nil
+}
+
+func (b *blockEtcd) UnpinBlock(ref torus.BlockRef, pin string) error {
+	_, err := b.Etcd.Client.Delete(b.getContext(), pinsKey(ref)+pin)
+	return err
+}
+
+func (b *blockEtcd) CondemnBlock(ref torus.BlockRef, now time.Time) (bool, error) {
+	k := condemnedKey(ref)
+	stamp := now.UTC().Format(time.RFC3339Nano)
+	resp, err := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(k), "=", 0),
+	).Then(
+		etcdv3.OpPut(k, stamp),
+	).Commit()
+	if err != nil || !resp.Succeeded {
+		// Already condemned.
+		return err == nil, err
+	}
+	// A pin taken before the mark was made keeps the block. Any taken
+	// since failed.
+	pins, err := b.Etcd.Client.Get(b.getContext(), pinsKey(ref), etcdv3.WithPrefix(), etcdv3.WithCountOnly())
+	if err == nil && pins.Count == 0 {
+		return true, nil
+	}
+	_, derr := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Value(k), "=", stamp),
+	).Then(
+		etcdv3.OpDelete(k),
+	).Commit()
+	if err == nil {
+		err = derr
+	}
+	return false, err
+}
+
+func (b *blockEtcd) GetCondemnedBlocks() (map[torus.BlockRef]time.Time, error) {
+	prefix := etcd.MkKey("meta", "dedup", "condemned") + "/"
+	resp, err := b.Etcd.Client.Get(b.getContext(), prefix, etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[torus.BlockRef]time.Time)
+	for _, kv := range resp.Kvs {
+		refBytes, err := hex.DecodeString(strings.TrimPrefix(string(kv.Key), prefix))
+		if err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, string(kv.Value))
+		if err != nil {
+			return nil, err
+		}
+		out[torus.BlockRefFromBytes(refBytes)] = t
+	}
+	return out, nil
+}
+
+func (b *blockEtcd) PardonBlock(ref torus.BlockRef) error {
+	_, err := b.Etcd.Client.Delete(b.getContext(), condemnedKey(ref))
+	return err
+}
+
+func (b *blockEtcd) CollectBlock(ref torus.BlockRef) error {
+	hk := hashKey(ref)
+	resp, err := b.Etcd.Client.Get(b.getContext(), hk)
+	if err != nil {
+		return err
+	}
+	ops := []etcdv3.Op{
+		etcdv3.OpDelete(condemnedKey(ref)),
+		etcdv3.OpDelete(hk),
+	}
+	if len(resp.Kvs) == 0 {
+		_, err = b.Etcd.Client.Txn(b.getContext()).Then(ops...).Commit()
+		return err
+	}
+	// The entry goes with the mark, so that the block can't be pinned
+	// through it once it's no longer condemned.
+	k := contentKey(resp.Kvs[0].Value)
+	_, err = b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Value(k), "=", string(ref.ToBytes())),
+	).Then(
+		append(ops, etcdv3.OpDelete(k))...,
+	).Else(
+		ops...,
+	).Commit()
+	return err
+}
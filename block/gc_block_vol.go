@@ -22,8 +22,33 @@ type blockvolGC struct {
 	set        map[torus.BlockRef]bool
 	highwaters map[torus.VolumeID]torus.INodeID
 	curINodes  []torus.INodeRef
+	// others holds the volumes of other types, whose blocks are left to
+	// their own GCs.
+	others map[torus.VolumeID]bool
+	// trashPrepped is set once the volumes in the trash, which the
+	// distributor doesn't know about, have been prepared. If that failed,
+	// trashErr is set and nothing is dead.
+	trashPrepped bool
+	trashErr     error
+
+	// Blocks of deduplicated volumes may be taken up by another volume,
+	// whose inode hasn't been synced yet, at any time, so they're only
+	// collected two passes after they're found dead. The first condemns
+	// them, which fails if they're pinned, and stops them being pinned
+	// from then on; the next, prepared since, collects them if they're
+	// still dead. dedup holds the deduplicated volumes, and condemned the
+	// blocks condemned before this pass, and condemning those condemned
+	// during it.
+	mds        blockMetadata
+	dedup      map[torus.VolumeID]bool
+	condemned  map[torus.BlockRef]time.Time
+	condemning map[torus.BlockRef]bool
 }
 
+// condemnedExpiry is how long a block stays condemned. Every node's GC has
+// long since had a pass in which to collect it by then.
+const condemnedExpiry = 24 * time.Hour
+
 func NewBlockVolGC(srv *torus.Server, inodes gc.INodeFetcher) (gc.GC, error) {
 	b := &blockvolGC{
 		srv:    srv,
@@ -39,7 +64,58 @@ func (b *blockvolGC) getContext() context.Context {
 }
 
 func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
+	if err := b.prepTrash(); err != nil {
+		return err
+	}
+	return b.prepVolume(vol)
+}
+
+// prepTrash prepares the volumes in the trash, whose blocks must be kept
+// until they're purged, the first time it's called after Clear.
+func (b *blockvolGC) prepTrash() error {
+	if b.trashPrepped {
+		return b.trashErr
+	}
+	b.trashPrepped = true
+	mds, err := createBlockMetadata(b.srv.MDS, "", 0)
+	if err != nil {
+		b.trashErr = err
+		return err
+	}
+	b.mds = mds
+	// The blocks condemned so far are loaded before any volume is
+	// prepared, so that no volume can have taken them up since.
+	condemned, err := mds.GetCondemnedBlocks()
+	if err != nil {
+		b.trashErr = err
+		return err
+	}
+	for ref, t := range condemned {
+		if time.Since(t) > condemnedExpiry {
+			if err := mds.PardonBlock(ref); err != nil {
+				clog.Warningf("couldn't pardon expired condemned block %s: %v", ref, err)
+			}
+			continue
+		}
+		b.condemned[ref] = t
+	}
+	trash, err := mds.GetTrash()
+	if err != nil {
+		b.trashErr = err
+		return err
+	}
+	for _, t := range trash {
+		if err := b.prepVolume(t.volume(t.Name)); err != nil {
+			b.trashErr = err
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *blockvolGC) prepVolume(vol *models.Volume) error {
 	if vol.Type != VolumeType {
+		b.others[torus.VolumeID(vol.Id)] = true
 		return nil
 	}
 	mds, err := createBlockMetadata(b.srv.MDS, vol.Name, torus.VolumeID(vol.Id))
@@ -50,7 +126,11 @@ func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
 	if err != nil {
 		return err
 	}
-	b.highwaters[curRef.Volume()] = 0
+	// A clone's blocks may have been written by the volume it was cloned
+	// from, which may be prepared either side of it.
+	if _, ok := b.highwaters[curRef.Volume()]; !ok {
+		b.highwaters[curRef.Volume()] = 0
+	}
 	if curRef.INode <= 1 {
 		return nil
 	}
@@ -75,6 +155,9 @@ func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
 		if err != nil {
 			return err
 		}
+		if blockset.IsDeduplicated(set) {
+			b.dedup[curRef.Volume()] = true
+		}
 		refs := set.GetAllBlockRefs()
 		for _, ref := range refs {
 			if ref.IsZero() {
@@ -91,6 +174,61 @@ func (b *blockvolGC) PrepVolume(vol *models.Volume) error {
 }
 
 func (b *blockvolGC) IsDead(ref torus.BlockRef) bool {
+	if err := b.prepTrash(); err != nil {
+		return false
+	}
+	if b.others[ref.Volume()] {
+		return false
+	}
+	dead := b.isDead(ref)
+	// The blocks of volumes since deleted may have been taken up too,
+	// though inodes never are.
+	_, exists := b.highwaters[ref.Volume()]
+	if (exists && !b.dedup[ref.Volume()]) || ref.BlockType() == torus.TypeINode {
+		return dead
+	}
+	return b.sweep(ref, dead)
+}
+
+// sweep decides whether a block which may have been taken up by a
+// deduplicated volume is dead, given whether it's dead as far as this pass
+// can tell.
+func (b *blockvolGC) sweep(ref torus.BlockRef, dead bool) bool {
+	_, condemned := b.condemned[ref]
+	if !dead {
+		if condemned {
+			// It was taken up before it was condemned.
+			if err := b.mds.PardonBlock(ref); err != nil {
+				clog.Warningf("couldn't pardon condemned block %s: %v", ref, err)
+			}
+			delete(b.condemned, ref)
+		}
+		return false
+	}
+	if condemned {
+		// Once it's gone, so is its mark and its entry in the content
+		// index. If they can't be dropped, it's left for the next pass.
+		if err := b.mds.CollectBlock(ref); err != nil {
+			clog.Warningf("couldn't collect condemned block %s: %v", ref, err)
+			return false
+		}
+		delete(b.condemned, ref)
+		return true
+	}
+	if !b.condemning[ref] {
+		b.condemning[ref] = true
+		if _, err := b.mds.CondemnBlock(ref, time.Now()); err != nil {
+			clog.Warningf("couldn't condemn block %s: %v", ref, err)
+		}
+	}
+	return false
+}
+
+func (b *blockvolGC) isDead(ref torus.BlockRef) bool {
+	// Blocks shared with clones outlive the volume that wrote them.
+	if b.set[ref] {
+		return false
+	}
 	v, ok := b.highwaters[ref.Volume()]
 	if !ok {
 		if clog.LevelAt(capnslog.TRACE) {
@@ -135,4 +273,10 @@ func (b *blockvolGC) Clear() {
 	b.highwaters = make(map[torus.VolumeID]torus.INodeID)
 	b.curINodes = make([]torus.INodeRef, 0, len(b.curINodes))
 	b.set = make(map[torus.BlockRef]bool)
+	b.others = make(map[torus.VolumeID]bool)
+	b.trashPrepped = false
+	b.trashErr = nil
+	b.dedup = make(map[torus.VolumeID]bool)
+	b.condemned = make(map[torus.BlockRef]time.Time)
+	b.condemning = make(map[torus.BlockRef]bool)
 }
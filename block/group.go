@@ -0,0 +1,218 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/coreos/torus"
+)
+
+// GroupAnnotation is the annotation recording which consistency group a
+// snapshot was taken for.
+const GroupAnnotation = "consistency-group"
+
+// ConsistencyGroup is a set of block volumes, such as the data and log
+// volumes of one database, which are snapshotted together.
+type ConsistencyGroup struct {
+	Name    string
+	Volumes []string
+}
+
+func (g *ConsistencyGroup) has(volume string) bool {
+	for _, v := range g.Volumes {
+		if v == volume {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateConsistencyGroup creates a consistency group of block volumes.
+func CreateConsistencyGroup(mds torus.MetadataService, name string, volumes []string) error {
+	if name == "" {
+		return errors.New("consistency group name cannot be empty")
+	}
+	g := ConsistencyGroup{Name: name}
+	for _, v := range volumes {
+		if err := checkGroupMember(mds, v); err != nil {
+			return err
+		}
+		if !g.has(v) {
+			g.Volumes = append(g.Volumes, v)
+		}
+	}
+	sort.Strings(g.Volumes)
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return err
+	}
+	return bmds.CreateConsistencyGroup(g)
+}
+
+// GetConsistencyGroups returns the consistency groups in the cluster, ordered
+// by name.
+func GetConsistencyGroups(mds torus.MetadataService) ([]ConsistencyGroup, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	out, err := bmds.GetConsistencyGroups()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(groupsByName(out))
+	return out, nil
+}
+
+// GetConsistencyGroup returns the named consistency group.
+func GetConsistencyGroup(mds torus.MetadataService, name string) (*ConsistencyGroup, error) {
+	groups, err := GetConsistencyGroups(mds)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.Name == name {
+			return &g, nil
+		}
+	}
+	return nil, torus.ErrNotExist
+}
+
+// AddToConsistencyGroup adds block volumes to a consistency group. Volumes
+// already in it are left alone.
+func AddToConsistencyGroup(mds torus.MetadataService, name string, volumes []string) (*ConsistencyGroup, error) {
+	for _, v := range volumes {
+		if err := checkGroupMember(mds, v); err != nil {
+			return nil, err
+		}
+	}
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.UpdateConsistencyGroup(name, func(g *ConsistencyGroup) error {
+		for _, v := range volumes {
+			if !g.has(v) {
+				g.Volumes = append(g.Volumes, v)
+			}
+		}
+		sort.Strings(g.Volumes)
+		return nil
+	})
+}
+
+// RemoveFromConsistencyGroup removes volumes from a consistency group. The
+// snapshots already taken of them for the group are kept.
+func RemoveFromConsistencyGroup(mds torus.MetadataService, name string, volumes []string) (*ConsistencyGroup, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.UpdateConsistencyGroup(name, func(g *ConsistencyGroup) error {
+		var keep []string
+		for _, v := range g.Volumes {
+			drop := false
+			for _, x := range volumes {
+				if v == x {
+					drop = true
+					break
+				}
+			}
+			if !drop {
+				keep = append(keep, v)
+			}
+		}
+		g.Volumes = keep
+		return nil
+	})
+}
+
+// DeleteConsistencyGroup deletes a consistency group. Its volumes, and the
+// snapshots taken of them for it, are kept.
+func DeleteConsistencyGroup(mds torus.MetadataService, name string) error {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return err
+	}
+	return bmds.DeleteConsistencyGroup(name)
+}
+
+// SaveGroupSnapshot takes a snapshot called name of every volume in a
+// consistency group, recording annotations and GroupAnnotation with each.
+// The group is quiesced for the snapshot by reading every member as of the
+// same metadata revision and saving all the snapshots in one transaction, so
+// no member is snapshotted before or after a write synced to another. As
+// attached volumes only acknowledge flushes once they're synced, that makes
+// the snapshots crash-consistent with one another, as if every host had lost
+// power at the same instant. It returns the revision they were taken at,
+// which the temp metadata service leaves zero.
+//
+// If any member already has a snapshot called name, or has been deleted,
+// none are taken.
+func SaveGroupSnapshot(mds torus.MetadataService, group, name string, annotations map[string]string) (int64, error) {
+	if name == "" {
+		return 0, errors.New("snapshot name cannot be empty")
+	}
+	notes := make(map[string]string)
+	for k, v := range annotations {
+		if !labelRegexp.MatchString(k) {
+			return 0, fmt.Errorf("invalid annotation key %q", k)
+		}
+		notes[k] = v
+	}
+	notes[GroupAnnotation] = group
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return 0, err
+	}
+	return bmds.SaveGroupSnapshot(group, name, notes)
+}
+
+// DeleteGroupSnapshot deletes the snapshots called name which were taken of
+// the members of a consistency group for it. Snapshots of the same name not
+// taken for the group are left alone. It returns the volumes which had one.
+func DeleteGroupSnapshot(mds torus.MetadataService, group, name string) ([]string, error) {
+	g, err := GetConsistencyGroup(mds, group)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, vol := range g.Volumes {
+		snaps, err := GetSnapshots(mds, vol)
+		if err == torus.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		for _, s := range snaps {
+			if s.Name != name || s.Annotations[GroupAnnotation] != group {
+				continue
+			}
+			if err := DeleteSnapshot(mds, vol, name); err != nil {
+				return deleted, fmt.Errorf("volume %s: %v", vol, err)
+			}
+			deleted = append(deleted, vol)
+		}
+	}
+	return deleted, nil
+}
+
+// checkGroupMember checks that volume exists and is a block volume.
+func checkGroupMember(mds torus.MetadataService, volume string) error {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return fmt.Errorf("volume %s: %v", volume, err)
+	}
+	if vol.Type != VolumeType {
+		return fmt.Errorf("volume %s is not a block volume", volume)
+	}
+	return nil
+}
+
+type groupsByName []ConsistencyGroup
+
+func (g groupsByName) Len() int           { return len(g) }
+func (g groupsByName) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g groupsByName) Less(i, j int) bool { return g[i].Name < g[j].Name }
@@ -0,0 +1,156 @@
+package iscsi
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Limits this target declares or negotiates down to.
+const (
+	// maxRecvDataSegment is the longest data segment accepted in a PDU.
+	maxRecvDataSegment = 64 << 10
+	maxBurstLength     = 256 << 10
+	firstBurstLength   = 64 << 10
+
+	// defaultRecvDataSegment is what an initiator accepts if it doesn't
+	// say.
+	defaultRecvDataSegment = 8192
+)
+
+// param is a key=value pair of a login or text request, in the order given.
+type param struct {
+	key, value string
+}
+
+// parseParams decodes the NUL separated key=value pairs of a text data
+// segment.
+func parseParams(data []byte) []param {
+	var out []param
+	for _, kv := range bytes.Split(data, []byte{0}) {
+		if len(kv) == 0 {
+			continue
+		}
+		i := bytes.IndexByte(kv, '=')
+		if i < 0 {
+			out = append(out, param{key: string(kv)})
+			continue
+		}
+		out = append(out, param{key: string(kv[:i]), value: string(kv[i+1:])})
+	}
+	return out
+}
+
+// encodeParams encodes params as a text data segment.
+func encodeParams(params []param) []byte {
+	var buf bytes.Buffer
+	for _, p := range params {
+		buf.WriteString(p.key)
+		buf.WriteByte('=')
+		buf.WriteString(p.value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// sessionParams are the operational parameters of a session, as
+// negotiated.
+type sessionParams struct {
+	initiatorName string
+	targetName    string
+	discovery     bool
+
+	// maxSendData is the longest data segment the initiator accepts.
+	maxSendData      int
+	maxBurstLength   int
+	firstBurstLength int
+	immediateData    bool
+}
+
+func defaultSessionParams() sessionParams {
+	return sessionParams{
+		maxSendData:      defaultRecvDataSegment,
+		maxBurstLength:   maxBurstLength,
+		firstBurstLength: firstBurstLength,
+		immediateData:    true,
+	}
+}
+
+// negotiate takes the keys an initiator offered in a login request and
+// returns the answers to send back. It returns false if the login must fail
+// because no acceptable authentication method was offered.
+func (sp *sessionParams) negotiate(offered []param) ([]param, bool) {
+	var reply []param
+	answer := func(k, v string) {
+		reply = append(reply, param{k, v})
+	}
+	for _, p := range offered {
+		switch p.key {
+		case "InitiatorName":
+			sp.initiatorName = p.value
+		case "TargetName":
+			sp.targetName = p.value
+		case "SessionType":
+			sp.discovery = p.value == "Discovery"
+		case "InitiatorAlias":
+		case "AuthMethod":
+			if !listContains(p.value, "None") {
+				answer(p.key, "Reject")
+				return reply, false
+			}
+			answer(p.key, "None")
+		case "HeaderDigest", "DataDigest":
+			answer(p.key, "None")
+		case "MaxRecvDataSegmentLength":
+			if n, err := strconv.Atoi(p.value); err == nil && n >= 512 {
+				sp.maxSendData = n
+			}
+		case "MaxBurstLength":
+			sp.maxBurstLength = minParam(p.value, maxBurstLength)
+			answer(p.key, strconv.Itoa(sp.maxBurstLength))
+		case "FirstBurstLength":
+			sp.firstBurstLength = minParam(p.value, firstBurstLength)
+			answer(p.key, strconv.Itoa(sp.firstBurstLength))
+		case "InitialR2T":
+			// Data is only ever sent unsolicited as immediate data.
+			answer(p.key, "Yes")
+		case "ImmediateData":
+			sp.immediateData = p.value == "Yes"
+			answer(p.key, p.value)
+		case "MaxConnections":
+			answer(p.key, "1")
+		case "MaxOutstandingR2T":
+			answer(p.key, "1")
+		case "DataPDUInOrder", "DataSequenceInOrder":
+			answer(p.key, "Yes")
+		case "DefaultTime2Wait":
+			answer(p.key, p.value)
+		case "DefaultTime2Retain":
+			answer(p.key, "0")
+		case "ErrorRecoveryLevel":
+			answer(p.key, "0")
+		case "IFMarker", "OFMarker":
+			answer(p.key, "No")
+		default:
+			answer(p.key, "NotUnderstood")
+		}
+	}
+	return reply, true
+}
+
+func listContains(list, v string) bool {
+	for _, s := range strings.Split(list, ",") {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func minParam(offered string, limit int) int {
+	n, err := strconv.Atoi(offered)
+	if err != nil || n <= 0 || n > limit {
+		return limit
+	}
+	return n
+}
@@ -0,0 +1,148 @@
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Opcodes of the PDUs sent by initiators.
+const (
+	opNOPOut    = 0x00
+	opSCSICmd   = 0x01
+	opTaskMgmt  = 0x02
+	opLogin     = 0x03
+	opText      = 0x04
+	opDataOut   = 0x05
+	opLogout    = 0x06
+	opSNACK     = 0x10
+	opImmediate = 0x40
+)
+
+// Opcodes of the PDUs sent by targets.
+const (
+	opNOPIn        = 0x20
+	opSCSIResp     = 0x21
+	opTaskMgmtResp = 0x22
+	opLoginResp    = 0x23
+	opTextResp     = 0x24
+	opDataIn       = 0x25
+	opLogoutResp   = 0x26
+	opR2T          = 0x31
+	opReject       = 0x3f
+)
+
+const (
+	flagFinal    = 0x80
+	flagContinue = 0x40 // login and text requests
+	flagRead     = 0x40 // SCSI commands
+	flagWrite    = 0x20 // SCSI commands
+	flagStatus   = 0x01 // Data-In
+	flagUnder    = 0x02 // SCSI responses and Data-In
+	flagOver     = 0x04 // SCSI responses and Data-In
+
+	// reservedTag is the initiator or target task tag that refers to no
+	// task.
+	reservedTag = 0xffffffff
+)
+
+// Reasons for rejecting a PDU.
+const (
+	rejectProtocol     = 0x04
+	rejectNotSupported = 0x05
+	rejectInvalid      = 0x09
+)
+
+const bhsLength = 48
+
+// pdu is an iSCSI protocol data unit: the 48 byte basic header segment,
+// additional header segments and data. Digests are never negotiated.
+type pdu struct {
+	bhs  [bhsLength]byte
+	ahs  []byte
+	data []byte
+}
+
+func (p *pdu) opcode() byte {
+	return p.bhs[0] & 0x3f
+}
+
+func (p *pdu) immediate() bool {
+	return p.bhs[0]&opImmediate != 0
+}
+
+func (p *pdu) flags() byte {
+	return p.bhs[1]
+}
+
+func (p *pdu) lun() uint16 {
+	// Single level LUNs with peripheral or flat space addressing.
+	return uint16(p.bhs[8]&0x3f)<<8 | uint16(p.bhs[9])
+}
+
+func (p *pdu) itt() uint32 {
+	return binary.BigEndian.Uint32(p.bhs[16:20])
+}
+
+func (p *pdu) field(off int) uint32 {
+	return binary.BigEndian.Uint32(p.bhs[off : off+4])
+}
+
+func (p *pdu) setField(off int, v uint32) {
+	binary.BigEndian.PutUint32(p.bhs[off:off+4], v)
+}
+
+// newPDU returns a PDU with the given opcode and flags, answering the task
+// tagged itt.
+func newPDU(op, flags byte, itt uint32) *pdu {
+	p := &pdu{}
+	p.bhs[0] = op
+	p.bhs[1] = flags
+	p.setField(16, itt)
+	return p
+}
+
+// readPDU reads a PDU from r, refusing data segments longer than maxData.
+func readPDU(r io.Reader, maxData int) (*pdu, error) {
+	p := &pdu{}
+	if _, err := io.ReadFull(r, p.bhs[:]); err != nil {
+		return nil, err
+	}
+	if n := int(p.bhs[4]) * 4; n > 0 {
+		p.ahs = make([]byte, n)
+		if _, err := io.ReadFull(r, p.ahs); err != nil {
+			return nil, err
+		}
+	}
+	n := int(p.bhs[5])<<16 | int(p.bhs[6])<<8 | int(p.bhs[7])
+	if n > maxData {
+		return nil, fmt.Errorf("iscsi: PDU data segment too long: %d bytes", n)
+	}
+	if n > 0 {
+		buf := make([]byte, pad(n))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		p.data = buf[:n]
+	}
+	return p, nil
+}
+
+// write writes the PDU to w in a single write.
+func (p *pdu) write(w io.Writer) error {
+	n := len(p.data)
+	p.bhs[4] = 0
+	p.bhs[5] = byte(n >> 16)
+	p.bhs[6] = byte(n >> 8)
+	p.bhs[7] = byte(n)
+	buf := make([]byte, bhsLength+pad(n))
+	copy(buf, p.bhs[:])
+	copy(buf[bhsLength:], p.data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// pad rounds n up to the 4 byte boundary data segments are padded to.
+func pad(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,535 @@
+// Package iscsi implements an iSCSI target serving torus block volumes, so
+// that initiators such as VMware, Windows or open-iscsi can use them without
+// AoE or NBD.
+//
+// Each volume is a target of its own with a single LUN. Sessions have one
+// connection, digests and authentication aren't supported, and errors end
+// the session (error recovery level 0).
+package iscsi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/coreos/torus/block/scsi"
+)
+
+// DefaultPort is the TCP port iSCSI targets are served on.
+const DefaultPort = 3260
+
+// cmdWindow is how many commands an initiator may have outstanding.
+const cmdWindow = 32
+
+// Target is a disk exported as LUN 0 of the iSCSI target Name.
+type Target struct {
+	// Name is the iSCSI qualified name of the target, such as
+	// iqn.2016-06.com.coreos.torus:vol01.
+	Name string
+	Disk *scsi.Disk
+}
+
+// Server serves targets to initiators over TCP.
+type Server struct {
+	targets map[string]*Target
+	names   []string
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	tsih     uint16
+}
+
+// NewServer creates a Server for the given targets. Their names must be
+// distinct.
+func NewServer(targets ...*Target) (*Server, error) {
+	s := &Server{
+		targets: make(map[string]*Target),
+		conns:   make(map[net.Conn]bool),
+	}
+	for _, t := range targets {
+		if t.Disk.Size < scsi.SectorSize {
+			return nil, fmt.Errorf("iscsi: target %s is too small", t.Name)
+		}
+		if _, ok := s.targets[t.Name]; ok {
+			return nil, fmt.Errorf("iscsi: more than one target named %q", t.Name)
+		}
+		s.targets[t.Name] = t
+		s.names = append(s.names, t.Name)
+	}
+	return s, nil
+}
+
+// Serve accepts connections on l, serving each in its own goroutine, until
+// the Server is closed or l fails.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil && err != io.EOF {
+				log.Printf("iscsi: %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a session on conn, from login to logout.
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return conn.Close()
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	sess := &session{
+		srv:    s,
+		conn:   conn,
+		params: defaultSessionParams(),
+	}
+	return sess.serve()
+}
+
+// Close stops accepting connections and drops every session.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *Server) nextTSIH() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tsih++
+	if s.tsih == 0 {
+		s.tsih++
+	}
+	return s.tsih
+}
+
+var errLogout = errors.New("iscsi: logged out")
+
+// session is the state of a single connection session.
+type session struct {
+	srv    *Server
+	conn   net.Conn
+	params sessionParams
+	target *Target
+	// isid is the initiator's half of the session ID.
+	isid [6]byte
+
+	statSN   uint32
+	expCmdSN uint32
+
+	// PDUs received while waiting for the data of a write, to be served
+	// after it.
+	pending []*pdu
+}
+
+func (sess *session) serve() error {
+	if err := sess.login(); err != nil {
+		return err
+	}
+	for {
+		p, err := sess.next()
+		if err != nil {
+			return err
+		}
+		if err := sess.handle(p); err != nil {
+			if err == errLogout {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// next returns the next PDU to serve.
+func (sess *session) next() (*pdu, error) {
+	if len(sess.pending) > 0 {
+		p := sess.pending[0]
+		sess.pending = sess.pending[1:]
+		return p, nil
+	}
+	return sess.read()
+}
+
+func (sess *session) read() (*pdu, error) {
+	p, err := readPDU(sess.conn, maxRecvDataSegment)
+	if err != nil {
+		return nil, err
+	}
+	switch p.opcode() {
+	case opNOPOut, opSCSICmd, opTaskMgmt, opText, opLogout:
+		if !p.immediate() && p.field(24) == sess.expCmdSN {
+			sess.expCmdSN++
+		}
+	}
+	return p, nil
+}
+
+// send fills in the sequence numbers of p and sends it. Responses carrying
+// status take the next StatSN.
+func (sess *session) send(p *pdu, status bool) error {
+	p.setField(24, sess.statSN)
+	if status {
+		sess.statSN++
+	}
+	p.setField(28, sess.expCmdSN)
+	p.setField(32, sess.expCmdSN+cmdWindow-1)
+	return p.write(sess.conn)
+}
+
+func (sess *session) handle(p *pdu) error {
+	switch p.opcode() {
+	case opNOPOut:
+		if p.itt() == reservedTag {
+			// An answer to a NOP-In, which is never sent.
+			return nil
+		}
+		resp := newPDU(opNOPIn, flagFinal, p.itt())
+		copy(resp.bhs[8:16], p.bhs[8:16])
+		resp.setField(20, reservedTag)
+		resp.data = p.data
+		return sess.send(resp, true)
+	case opSCSICmd:
+		return sess.scsiCommand(p)
+	case opTaskMgmt:
+		// Commands are served one at a time, so by now there is
+		// nothing left to abort or reset.
+		resp := newPDU(opTaskMgmtResp, flagFinal, p.itt())
+		return sess.send(resp, true)
+	case opText:
+		return sess.text(p)
+	case opLogout:
+		resp := newPDU(opLogoutResp, flagFinal, p.itt())
+		if err := sess.send(resp, true); err != nil {
+			return err
+		}
+		return errLogout
+	case opDataOut:
+		// Data for a write is read along with its command, so this is
+		// for one that failed.
+		return nil
+	}
+	return sess.reject(p, rejectNotSupported)
+}
+
+func (sess *session) reject(p *pdu, reason byte) error {
+	resp := newPDU(opReject, flagFinal, reservedTag)
+	resp.bhs[2] = reason
+	resp.data = p.bhs[:]
+	return sess.send(resp, true)
+}
+
+// login runs the login phase, up to full feature phase.
+func (sess *session) login() error {
+	var text []byte
+	for first := true; ; first = false {
+		p, err := readPDU(sess.conn, maxRecvDataSegment)
+		if err != nil {
+			return err
+		}
+		if p.opcode() != opLogin {
+			return fmt.Errorf("iscsi: expected a login request, got opcode %#x", p.opcode())
+		}
+		if first {
+			copy(sess.isid[:], p.bhs[8:14])
+			sess.statSN = p.field(28)
+			sess.expCmdSN = p.field(24)
+		}
+		text = append(text, p.data...)
+
+		flags := p.flags()
+		transit := flags&flagFinal != 0
+		csg := (flags >> 2) & 0x3
+		nsg := flags & 0x3
+		resp := newPDU(opLoginResp, 0, p.itt())
+		copy(resp.bhs[8:14], p.bhs[8:14])
+		resp.bhs[3] = 0 // version active
+
+		if flags&flagContinue != 0 {
+			// Wait for the rest of the text.
+			resp.bhs[1] = csg << 2
+			if err := sess.send(resp, false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		reply, ok := sess.params.negotiate(parseParams(text))
+		text = nil
+		if !ok {
+			return sess.loginFailed(resp, 0x0201)
+		}
+		if csg == 0 && transit && nsg == 3 {
+			// Operational parameters can't be left out.
+			nsg = 1
+		}
+		if sess.params.initiatorName == "" {
+			return sess.loginFailed(resp, 0x0207)
+		}
+		if !sess.params.discovery && sess.target == nil {
+			t, ok := sess.srv.targets[sess.params.targetName]
+			if !ok {
+				return sess.loginFailed(resp, 0x0203)
+			}
+			sess.target = t
+			reply = append(reply, param{"TargetPortalGroupTag", "1"})
+		}
+		if csg == 1 {
+			reply = append(reply, param{"MaxRecvDataSegmentLength", fmt.Sprint(maxRecvDataSegment)})
+		}
+
+		resp.data = encodeParams(reply)
+		resp.bhs[1] = csg << 2
+		if transit {
+			resp.bhs[1] |= flagFinal | nsg
+		}
+		if transit && nsg == 3 {
+			binary.BigEndian.PutUint16(resp.bhs[14:16], sess.srv.nextTSIH())
+		}
+		if err := sess.send(resp, true); err != nil {
+			return err
+		}
+		if transit && nsg == 3 {
+			return nil
+		}
+	}
+}
+
+// initiatorPort names the initiator port of the session, which persistent
+// reservations are registered for.
+func (sess *session) initiatorPort() string {
+	return fmt.Sprintf("%s,i,0x%x", sess.params.initiatorName, sess.isid[:])
+}
+
+// loginFailed answers the login request with the status class and detail
+// in status, ending the session.
+func (sess *session) loginFailed(resp *pdu, status uint16) error {
+	resp.bhs[1] = 0
+	binary.BigEndian.PutUint16(resp.bhs[36:38], status)
+	if err := sess.send(resp, true); err != nil {
+		return err
+	}
+	return fmt.Errorf("iscsi: login from %q to %q failed with status %#04x", sess.params.initiatorName, sess.params.targetName, status)
+}
+
+// text answers a text request, which is only used for SendTargets.
+func (sess *session) text(p *pdu) error {
+	resp := newPDU(opTextResp, flagFinal, p.itt())
+	resp.setField(20, reservedTag)
+	var reply []param
+	for _, kv := range parseParams(p.data) {
+		if kv.key != "SendTargets" {
+			reply = append(reply, param{kv.key, "NotUnderstood"})
+			continue
+		}
+		var names []string
+		switch {
+		case kv.value == "All" && sess.params.discovery:
+			names = sess.srv.names
+		case kv.value == "" && sess.target != nil:
+			names = []string{sess.target.Name}
+		case sess.srv.targets[kv.value] != nil:
+			names = []string{kv.value}
+		}
+		for _, name := range names {
+			reply = append(reply,
+				param{"TargetName", name},
+				param{"TargetAddress", portal(sess.conn.LocalAddr()) + ",1"},
+			)
+		}
+	}
+	resp.data = encodeParams(reply)
+	return sess.send(resp, true)
+}
+
+// portal returns the address initiators should connect to for the
+// connection's local address.
+func portal(addr net.Addr) string {
+	s := addr.String()
+	if host, port, err := net.SplitHostPort(s); err == nil && strings.Contains(host, ":") {
+		// IPv6 addresses are bracketed.
+		return "[" + host + "]:" + port
+	}
+	return s
+}
+
+// scsiCommand serves a SCSI command, reading any data it writes first.
+func (sess *session) scsiCommand(p *pdu) error {
+	if sess.target == nil {
+		return sess.reject(p, rejectProtocol)
+	}
+	edtl := int(p.field(20))
+	cdb := p.bhs[32:48]
+	if scsi.TransferTooLong(edtl) {
+		return sess.respond(p, scsi.InvalidCDB(), 0)
+	}
+
+	var out []byte
+	if p.flags()&flagWrite != 0 {
+		if scsi.DataOutLength(cdb) != edtl {
+			return sess.respond(p, scsi.InvalidCDB(), 0)
+		}
+		var err error
+		out, err = sess.dataOut(p, edtl)
+		if err != nil {
+			return err
+		}
+	}
+
+	res := sess.target.Disk.Execute(sess.initiatorPort(), p.lun(), cdb, out)
+	if res.Status != scsi.StatusGood || p.flags()&flagRead == 0 {
+		return sess.respond(p, res, edtl-len(out))
+	}
+	return sess.dataIn(p, res.Data, edtl)
+}
+
+// dataOut gathers the n bytes of data for the write command p: its
+// immediate data, then whatever is solicited with R2Ts.
+func (sess *session) dataOut(p *pdu, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	got := copy(buf, p.data)
+	itt := p.itt()
+	var r2tsn uint32
+	for got < n {
+		length := n - got
+		if length > sess.params.maxBurstLength {
+			length = sess.params.maxBurstLength
+		}
+		r2t := newPDU(opR2T, flagFinal, itt)
+		copy(r2t.bhs[8:16], p.bhs[8:16])
+		ttt := r2tsn
+		r2t.setField(20, ttt)
+		r2t.setField(36, r2tsn)
+		r2t.setField(40, uint32(got))
+		r2t.setField(44, uint32(length))
+		r2tsn++
+		if err := sess.send(r2t, false); err != nil {
+			return nil, err
+		}
+
+		end := got + length
+		for got < end {
+			d, err := sess.read()
+			if err != nil {
+				return nil, err
+			}
+			if d.opcode() != opDataOut || d.itt() != itt {
+				sess.pending = append(sess.pending, d)
+				continue
+			}
+			off := int(d.field(40))
+			if d.field(20) != ttt || off < got || off+len(d.data) > end {
+				return nil, fmt.Errorf("iscsi: unexpected Data-Out for task %#x at offset %d", itt, off)
+			}
+			copy(buf[off:], d.data)
+			if off+len(d.data) > got {
+				got = off + len(d.data)
+			}
+			if d.flags()&flagFinal != 0 && got < end {
+				return nil, fmt.Errorf("iscsi: short data burst for task %#x", itt)
+			}
+		}
+	}
+	return buf, nil
+}
+
+// dataIn sends data for the read command p, at most edtl bytes of it, with
+// the status in the last Data-In PDU.
+func (sess *session) dataIn(p *pdu, data []byte, edtl int) error {
+	var flags byte
+	residual := 0
+	if len(data) > edtl {
+		flags = flagOver
+		residual = len(data) - edtl
+		data = data[:edtl]
+	} else if len(data) < edtl {
+		flags = flagUnder
+		residual = edtl - len(data)
+	}
+	if len(data) == 0 {
+		return sess.respond(p, scsi.Result{}, edtl)
+	}
+
+	var datasn uint32
+	for off := 0; off < len(data); {
+		n := len(data) - off
+		if n > sess.params.maxSendData {
+			n = sess.params.maxSendData
+		}
+		d := newPDU(opDataIn, 0, p.itt())
+		copy(d.bhs[8:16], p.bhs[8:16])
+		d.setField(20, reservedTag)
+		d.setField(36, datasn)
+		d.setField(40, uint32(off))
+		d.data = data[off : off+n]
+		datasn++
+		off += n
+		last := off == len(data)
+		if last {
+			d.bhs[1] = flagFinal | flagStatus | flags
+			d.bhs[3] = scsi.StatusGood
+			d.setField(44, uint32(residual))
+		}
+		if err := sess.send(d, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respond sends the SCSI response for the command p.
+func (sess *session) respond(p *pdu, res scsi.Result, residual int) error {
+	resp := newPDU(opSCSIResp, flagFinal, p.itt())
+	resp.bhs[3] = res.Status
+	if residual > 0 {
+		resp.bhs[1] |= flagUnder
+		resp.setField(44, uint32(residual))
+	}
+	if res.Sense != nil {
+		resp.data = make([]byte, 2+len(res.Sense))
+		binary.BigEndian.PutUint16(resp.data[0:2], uint16(len(res.Sense)))
+		copy(resp.data[2:], res.Sense)
+	}
+	return sess.send(resp, true)
+}
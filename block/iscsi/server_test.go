@@ -0,0 +1,409 @@
+package iscsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/torus/block/scsi"
+)
+
+type memDevice []byte
+
+func (m memDevice) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(b []byte, off int64) (int, error) {
+	return copy(m[off:], b), nil
+}
+
+func (m memDevice) Sync() error { return nil }
+
+func (m memDevice) Trim(off, length int64) error {
+	for i := off; i < off+length; i++ {
+		m[i] = 0
+	}
+	return nil
+}
+
+// initiator drives a session from the other end of a pipe.
+type initiator struct {
+	t      *testing.T
+	conn   net.Conn
+	itt    uint32
+	cmdSN  uint32
+	statSN uint32
+	// isid is the last byte of the session ID.
+	isid byte
+}
+
+func newInitiator(t *testing.T, srv *Server) *initiator {
+	client, conn := net.Pipe()
+	go srv.ServeConn(conn)
+	return &initiator{t: t, conn: client}
+}
+
+func (in *initiator) send(p *pdu) {
+	if p.opcode() != opDataOut {
+		in.itt++
+		p.setField(16, in.itt)
+		p.setField(24, in.cmdSN)
+		p.setField(28, in.statSN)
+	}
+	if err := p.write(in.conn); err != nil {
+		in.t.Fatal(err)
+	}
+}
+
+func (in *initiator) recv() *pdu {
+	p, err := readPDU(in.conn, 1<<20)
+	if err != nil {
+		in.t.Fatal(err)
+	}
+	in.statSN = p.field(24) + 1
+	return p
+}
+
+func (in *initiator) login(params ...param) *pdu {
+	p := newPDU(opLogin|opImmediate, flagFinal|1<<2|3, 0)
+	p.bhs[8] = 0x40 // ISID
+	p.bhs[13] = in.isid
+	p.data = encodeParams(append([]param{{"InitiatorName", "iqn.2016-06.test:initiator"}}, params...))
+	in.send(p)
+	resp := in.recv()
+	if resp.opcode() != opLoginResp {
+		in.t.Fatalf("expected a login response, got opcode %#x", resp.opcode())
+	}
+	return resp
+}
+
+// command sends a SCSI command with the data out, returning its data in and
+// the response.
+func (in *initiator) command(cdb []byte, out []byte, edtl int) ([]byte, *pdu) {
+	flags := byte(flagFinal)
+	if out != nil {
+		flags |= flagWrite
+	} else if edtl > 0 {
+		flags |= flagRead
+	}
+	p := newPDU(opSCSICmd, flags, 0)
+	p.setField(20, uint32(edtl))
+	copy(p.bhs[32:], cdb)
+	imm := out
+	if len(imm) > 1024 {
+		imm = imm[:1024]
+	}
+	p.data = imm
+	in.send(p)
+	in.cmdSN++
+	itt := in.itt
+
+	var data []byte
+	for {
+		resp := in.recv()
+		switch resp.opcode() {
+		case opR2T:
+			off := int(resp.field(40))
+			n := int(resp.field(44))
+			d := newPDU(opDataOut, flagFinal, itt)
+			d.setField(20, resp.field(20))
+			d.setField(40, uint32(off))
+			d.data = out[off : off+n]
+			in.send(d)
+		case opDataIn:
+			data = append(data, resp.data...)
+			if resp.flags()&flagStatus != 0 {
+				return data, resp
+			}
+		case opSCSIResp:
+			return data, resp
+		default:
+			in.t.Fatalf("unexpected opcode %#x", resp.opcode())
+		}
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	srv, err := NewServer(
+		&Target{Name: "iqn.2016-06.test:a", Disk: &scsi.Disk{Device: make(memDevice, 4096), Size: 4096}},
+		&Target{Name: "iqn.2016-06.test:b", Disk: &scsi.Disk{Device: make(memDevice, 4096), Size: 4096}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInitiator(t, srv)
+	defer in.conn.Close()
+	resp := in.login(param{"SessionType", "Discovery"})
+	if status := binary.BigEndian.Uint16(resp.bhs[36:38]); status != 0 {
+		t.Fatalf("discovery login failed with status %#x", status)
+	}
+
+	p := newPDU(opText, flagFinal, 0)
+	p.data = encodeParams([]param{{"SendTargets", "All"}})
+	in.send(p)
+	resp = in.recv()
+	var names []string
+	for _, kv := range parseParams(resp.data) {
+		if kv.key == "TargetName" {
+			names = append(names, kv.value)
+		}
+	}
+	if strings.Join(names, " ") != "iqn.2016-06.test:a iqn.2016-06.test:b" {
+		t.Fatalf("discovered %v", names)
+	}
+}
+
+func TestLoginUnknownTarget(t *testing.T) {
+	srv, err := NewServer(&Target{Name: "iqn.2016-06.test:a", Disk: &scsi.Disk{Device: make(memDevice, 4096), Size: 4096}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInitiator(t, srv)
+	defer in.conn.Close()
+	resp := in.login(param{"TargetName", "iqn.2016-06.test:missing"})
+	if status := binary.BigEndian.Uint16(resp.bhs[36:38]); status != 0x0203 {
+		t.Fatalf("login to a missing target answered with status %#x", status)
+	}
+}
+
+func TestReadWriteUnmap(t *testing.T) {
+	dev := make(memDevice, 1<<20)
+	srv, err := NewServer(&Target{Name: "iqn.2016-06.test:a", Disk: &scsi.Disk{Device: dev, Size: int64(len(dev)), PhysicalBlockSize: 4096}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInitiator(t, srv)
+	defer in.conn.Close()
+	resp := in.login(param{"TargetName", "iqn.2016-06.test:a"}, param{"MaxRecvDataSegmentLength", "4096"})
+	if status := binary.BigEndian.Uint16(resp.bhs[36:38]); status != 0 {
+		t.Fatalf("login failed with status %#x", status)
+	}
+	if resp.flags()&flagFinal == 0 || resp.flags()&0x3 != 3 {
+		t.Fatalf("login didn't move to full feature phase: flags %#x", resp.flags())
+	}
+
+	// READ CAPACITY (16)
+	data, resp := in.command([]byte{0x9e, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32, 0, 0}, nil, 32)
+	if resp.bhs[3] != scsi.StatusGood {
+		t.Fatalf("READ CAPACITY failed with status %#x", resp.bhs[3])
+	}
+	if last := binary.BigEndian.Uint64(data[0:8]); last != 2047 {
+		t.Fatalf("last LBA %d, expected 2047", last)
+	}
+	if data[13] != 3 {
+		t.Fatalf("reported %d logical blocks per physical block exponent, expected 3", data[13])
+	}
+
+	// WRITE (10) of 16KiB at LBA 8, most of it solicited with R2Ts.
+	payload := bytes.Repeat([]byte("torus!!!"), 2048)
+	_, resp = in.command([]byte{0x2a, 0, 0, 0, 0, 8, 0, 0, 32, 0}, payload, len(payload))
+	if resp.bhs[3] != scsi.StatusGood {
+		t.Fatalf("WRITE failed with status %#x", resp.bhs[3])
+	}
+	if !bytes.Equal(dev[8*512:8*512+len(payload)], payload) {
+		t.Fatal("write didn't reach the device")
+	}
+
+	// READ (10) it back, in several Data-In PDUs.
+	data, resp = in.command([]byte{0x28, 0, 0, 0, 0, 8, 0, 0, 32, 0}, nil, len(payload))
+	if resp.bhs[3] != scsi.StatusGood {
+		t.Fatalf("READ failed with status %#x", resp.bhs[3])
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatal("read back different data")
+	}
+
+	// Out of range.
+	_, resp = in.command([]byte{0x28, 0, 0, 0, 0x07, 0xff, 0, 0, 2, 0}, nil, 1024)
+	if resp.bhs[3] != scsi.StatusCheckCondition || resp.data[2+12] != 0x21 {
+		t.Fatalf("read past the end answered with status %#x", resp.bhs[3])
+	}
+
+	// UNMAP the first 8 blocks written.
+	params := make([]byte, 24)
+	binary.BigEndian.PutUint16(params[0:2], 22)
+	binary.BigEndian.PutUint16(params[2:4], 16)
+	binary.BigEndian.PutUint64(params[8:16], 8)
+	binary.BigEndian.PutUint32(params[16:20], 8)
+	_, resp = in.command([]byte{0x42, 0, 0, 0, 0, 0, 0, 0, 24, 0}, params, len(params))
+	if resp.bhs[3] != scsi.StatusGood {
+		t.Fatalf("UNMAP failed with status %#x", resp.bhs[3])
+	}
+	if !bytes.Equal(dev[8*512:16*512], make([]byte, 8*512)) {
+		t.Fatal("unmapped blocks weren't trimmed")
+	}
+	if !bytes.Equal(dev[16*512:8*512+len(payload)], payload[8*512:]) {
+		t.Fatal("unmap trimmed too much")
+	}
+
+	// Unsupported commands fail with ILLEGAL REQUEST.
+	_, resp = in.command([]byte{0xc0, 0, 0, 0, 0, 0}, nil, 0)
+	if resp.bhs[3] != scsi.StatusCheckCondition || resp.data[2+2] != 0x05 {
+		t.Fatalf("unknown command answered with status %#x", resp.bhs[3])
+	}
+
+	p := newPDU(opLogout|opImmediate, flagFinal, 0)
+	in.send(p)
+	if resp := in.recv(); resp.opcode() != opLogoutResp {
+		t.Fatalf("expected a logout response, got opcode %#x", resp.opcode())
+	}
+}
+
+func TestReadOnlyTarget(t *testing.T) {
+	srv, err := NewServer(&Target{Name: "iqn.2016-06.test:a", Disk: &scsi.Disk{Device: make(memDevice, 4096), Size: 4096, ReadOnly: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInitiator(t, srv)
+	defer in.conn.Close()
+	in.login(param{"TargetName", "iqn.2016-06.test:a"})
+	_, resp := in.command([]byte{0x2a, 0, 0, 0, 0, 0, 0, 0, 1, 0}, make([]byte, 512), 512)
+	if resp.bhs[3] != scsi.StatusCheckCondition || resp.data[2+2] != 0x07 {
+		t.Fatalf("write to a read-only target answered with status %#x", resp.bhs[3])
+	}
+}
+
+func TestTransferTooLong(t *testing.T) {
+	srv, err := NewServer(&Target{Name: "iqn.2016-06.test:a", Disk: &scsi.Disk{Device: make(memDevice, 4096), Size: 4096}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInitiator(t, srv)
+	defer in.conn.Close()
+	in.login(param{"TargetName", "iqn.2016-06.test:a"})
+	// 0xffff blocks is far more than MaxTransferLength.
+	n := 0xffff * scsi.SectorSize
+	_, resp := in.command([]byte{0x2a, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0}, make([]byte, 1024), n)
+	if resp.opcode() != opSCSIResp || resp.bhs[3] != scsi.StatusCheckCondition || resp.data[2+2] != 0x05 {
+		t.Fatalf("overlong write answered with status %#x", resp.bhs[3])
+	}
+	_, resp = in.command([]byte{0x28, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0}, nil, n)
+	if resp.bhs[3] != scsi.StatusCheckCondition || resp.data[2+2] != 0x05 {
+		t.Fatalf("overlong read answered with status %#x", resp.bhs[3])
+	}
+	// Commands within the limit still work.
+	if status := in.write(0); status != scsi.StatusGood {
+		t.Fatalf("write answered with status %#x", status)
+	}
+}
+
+// memStore holds persistent reservations in memory, for every server
+// sharing it.
+type memStore struct {
+	mu  sync.Mutex
+	prs []byte
+}
+
+func (m *memStore) PersistentReservations() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.prs, nil
+}
+
+func (m *memStore) UpdatePersistentReservations(fn func(cur []byte) ([]byte, error)) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, err := fn(m.prs)
+	if err != nil {
+		return m.prs, err
+	}
+	m.prs = next
+	return next, nil
+}
+
+// reserveOut sends PERSISTENT RESERVE OUT, returning its status.
+func (in *initiator) reserveOut(action, typ byte, key, saKey uint64) byte {
+	cdb := []byte{0x5f, action, typ, 0, 0, 0, 0, 0, 24, 0}
+	params := make([]byte, 24)
+	binary.BigEndian.PutUint64(params[0:8], key)
+	binary.BigEndian.PutUint64(params[8:16], saKey)
+	_, resp := in.command(cdb, params, len(params))
+	return resp.bhs[3]
+}
+
+func (in *initiator) write(lba byte) byte {
+	_, resp := in.command([]byte{0x2a, 0, 0, 0, 0, lba, 0, 0, 1, 0}, make([]byte, 512), 512)
+	return resp.bhs[3]
+}
+
+// waitConflict waits for the gateway of in to refuse its writes.
+func waitConflict(t *testing.T, in *initiator) {
+	deadline := time.Now().Add(5 * time.Second)
+	for in.write(0) != scsi.StatusReservationConflict {
+		if time.Now().After(deadline) {
+			t.Fatal("reservation not enforced")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestPersistentReservations(t *testing.T) {
+	dev := make(memDevice, 1<<20)
+	store := &memStore{}
+	var inits []*initiator
+	for i := 0; i < 2; i++ {
+		// Each initiator connects through a gateway of its own.
+		srv, err := NewServer(&Target{Name: "iqn.2016-06.test:a", Disk: &scsi.Disk{Device: dev, Size: int64(len(dev)), Reservations: store}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := newInitiator(t, srv)
+		defer in.conn.Close()
+		in.isid = byte(i)
+		in.login(param{"TargetName", "iqn.2016-06.test:a"})
+		inits = append(inits, in)
+	}
+	a, b := inits[0], inits[1]
+
+	if st := a.reserveOut(0x00, 0, 0, 0xa); st != scsi.StatusGood {
+		t.Fatalf("register answered with status %#x", st)
+	}
+	if st := b.reserveOut(0x00, 0, 0, 0xb); st != scsi.StatusGood {
+		t.Fatalf("register answered with status %#x", st)
+	}
+	if st := b.reserveOut(0x01, 0x01, 0xa, 0); st != scsi.StatusReservationConflict {
+		t.Fatalf("reserve with another's key answered with status %#x", st)
+	}
+	if st := a.reserveOut(0x01, 0x01, 0xa, 0); st != scsi.StatusGood {
+		t.Fatalf("reserve answered with status %#x", st)
+	}
+
+	if st := a.write(0); st != scsi.StatusGood {
+		t.Fatalf("write from the holder answered with status %#x", st)
+	}
+	// b's gateway enforces the reservation once it rereads it.
+	waitConflict(t, b)
+	if _, resp := b.command([]byte{0x28, 0, 0, 0, 0, 0, 0, 0, 1, 0}, nil, 512); resp.bhs[3] != scsi.StatusGood {
+		t.Fatalf("read under a write exclusive reservation answered with status %#x", resp.bhs[3])
+	}
+	if scsi.NewFence(store).Allows("", true) {
+		t.Fatal("write from an initiator which can't register allowed")
+	}
+
+	keys, _ := b.command([]byte{0x5e, 0x00, 0, 0, 0, 0, 0, 1, 0, 0}, nil, 256)
+	if len(keys) != 24 || binary.BigEndian.Uint32(keys[0:4]) != 2 ||
+		binary.BigEndian.Uint64(keys[8:16]) != 0xa || binary.BigEndian.Uint64(keys[16:24]) != 0xb {
+		t.Fatalf("READ KEYS returned % x", keys)
+	}
+	res, _ := b.command([]byte{0x5e, 0x01, 0, 0, 0, 0, 0, 1, 0, 0}, nil, 256)
+	if len(res) != 24 || binary.BigEndian.Uint64(res[8:16]) != 0xa || res[21] != 0x01 {
+		t.Fatalf("READ RESERVATION returned % x", res)
+	}
+
+	// Once b preempts a, a's writes are refused.
+	if st := b.reserveOut(0x04, 0x01, 0xb, 0xa); st != scsi.StatusGood {
+		t.Fatalf("preempt answered with status %#x", st)
+	}
+	if st := b.write(0); st != scsi.StatusGood {
+		t.Fatalf("write from the new holder answered with status %#x", st)
+	}
+	waitConflict(t, a)
+	if st := a.reserveOut(0x00, 0, 0xa, 0xc); st != scsi.StatusReservationConflict {
+		t.Fatalf("register of a preempted key answered with status %#x", st)
+	}
+}
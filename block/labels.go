@@ -0,0 +1,144 @@
+package block
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/coreos/torus"
+)
+
+// Labels and their values are restricted so that they can be used directly
+// in metadata keys.
+var labelRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// ValidateLabels checks that all the keys and values of labels are well
+// formed: up to 63 letters, digits, '.', '_' or '-', starting with a letter or
+// digit.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelRegexp.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if !labelRegexp.MatchString(v) {
+			return fmt.Errorf("invalid value %q for label %s", v, k)
+		}
+	}
+	return nil
+}
+
+// ParseLabels parses a comma separated list of KEY=VALUE labels.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("label %q must be KEY=VALUE", part)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, ValidateLabels(labels)
+}
+
+// Selector picks volumes by their labels. A volume matches if it has every
+// label in the selector with the given value; an empty value matches any
+// value.
+type Selector map[string]string
+
+// ParseSelector parses a comma separated list of KEY=VALUE requirements, or
+// just KEY to require the label be present.
+func ParseSelector(s string) (Selector, error) {
+	sel := make(Selector)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		k := kv[0]
+		if !labelRegexp.MatchString(k) {
+			return nil, fmt.Errorf("invalid label key %q in selector", k)
+		}
+		if len(kv) == 1 {
+			sel[k] = ""
+			continue
+		}
+		if !labelRegexp.MatchString(kv[1]) {
+			return nil, fmt.Errorf("invalid value %q for label %s in selector", kv[1], k)
+		}
+		sel[k] = kv[1]
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return sel, nil
+}
+
+func (s Selector) String() string {
+	var parts []string
+	for k, v := range s {
+		if v == "" {
+			parts = append(parts, k)
+		} else {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// Matches reports whether a volume with labels is selected.
+func (s Selector) Matches(labels map[string]string) bool {
+	for k, v := range s {
+		lv, ok := labels[k]
+		if !ok || (v != "" && lv != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetVolumeLabels returns the labels of the named volume.
+func GetVolumeLabels(mds torus.MetadataService, volume string) (map[string]string, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetLabels()
+}
+
+// SetVolumeLabels replaces the labels of the named volume.
+func SetVolumeLabels(mds torus.MetadataService, volume string, labels map[string]string) error {
+	if err := ValidateLabels(labels); err != nil {
+		return err
+	}
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.SetLabels(labels)
+}
+
+// FindVolumes returns the names of the block volumes matching sel, sorted.
+// The metadata service keeps an index of labels, so this doesn't have to look
+// at every volume.
+func FindVolumes(mds torus.MetadataService, sel Selector) ([]string, error) {
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	out, err := bmds.FindVolumes(sel)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(out)
+	return out, nil
+}
@@ -0,0 +1,52 @@
+package block
+
+import (
+	"net"
+
+	"github.com/coreos/torus"
+)
+
+// A volume's MAC mask lists the hardware addresses of the initiators allowed
+// to use it when it is exported over AoE. An empty mask allows any initiator.
+// It is kept with the volume, so it applies wherever and whenever the volume
+// is exported.
+
+// GetMACMask returns the MAC mask of the named volume.
+func GetMACMask(mds torus.MetadataService, volume string) ([]net.HardwareAddr, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	return getMACMask(bmds)
+}
+
+// SetMACMask replaces the MAC mask of the named volume.
+func SetMACMask(mds torus.MetadataService, volume string, mask []net.HardwareAddr) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return setMACMask(bmds, mask)
+}
+
+// MACMask returns the volume's MAC mask.
+func (s *BlockVolume) MACMask() ([]net.HardwareAddr, error) {
+	return getMACMask(s.mds)
+}
+
+// SetMACMask replaces the volume's MAC mask.
+func (s *BlockVolume) SetMACMask(mask []net.HardwareAddr) error {
+	return setMACMask(s.mds, mask)
+}
+
+func getMACMask(bmds blockMetadata) ([]net.HardwareAddr, error) {
+	strs, err := bmds.GetMACMask()
+	if err != nil {
+		return nil, err
+	}
+	return parseMACs(strs)
+}
+
+func setMACMask(bmds blockMetadata, mask []net.HardwareAddr) error {
+	return bmds.SetMACMask(formatMACs(mask))
+}
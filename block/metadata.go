@@ -2,10 +2,12 @@ package block
 
 import (
 	"errors"
+	"time"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/models"
 	"github.com/coreos/pkg/capnslog"
+	"golang.org/x/net/context"
 )
 
 var clog = capnslog.NewPackageLogger("github.com/coreos/torus", "block")
@@ -13,6 +15,9 @@ var clog = capnslog.NewPackageLogger("github.com/coreos/torus", "block")
 type Snapshot struct {
 	Name     string
 	INodeRef []byte
+	// Annotations are free-form notes recorded when the snapshot was
+	// taken, such as why it was taken.
+	Annotations map[string]string `json:",omitempty"`
 }
 
 type blockMetadata interface {
@@ -20,16 +25,178 @@ type blockMetadata interface {
 
 	Lock(lease int64) error
 	Unlock() error
+	// Fence takes the volume lock regardless of its current holder. The
+	// previous holder's next SyncINode fails with torus.ErrLocked.
+	Fence(lease int64) error
+	// WaitUnlocked blocks until the volume lock is free or ctx is done.
+	WaitUnlocked(ctx context.Context) error
+
+	// LeaseRange takes the lease on range n of a shared volume for this
+	// node, for as long as lease is kept alive or until it's released,
+	// failing with torus.ErrLocked if the range is leased already.
+	LeaseRange(n uint64, lease int64) error
+	ReleaseRange(n uint64) error
+	// WaitRangeFree blocks until range n isn't leased or ctx is done.
+	WaitRangeFree(ctx context.Context, n uint64) error
 
 	GetINode() (torus.INodeRef, error)
 	SyncINode(torus.INodeRef) error
 
-	CreateBlockVolume(vol *models.Volume) error
+	CreateBlockVolume(vol *models.Volume, opts VolumeOptions) error
+	GetVolumeOptions() (VolumeOptions, error)
+	// GetVolumeSize returns the volume's size as currently recorded,
+	// rather than as it was when the volume was opened.
+	GetVolumeSize() (uint64, error)
+	// UpdateVolumeSize changes the volume's size as UpdateReservation
+	// changes its reservation. It doesn't touch the volume's data.
+	UpdateVolumeSize(fn func(cur uint64) (uint64, error)) (uint64, error)
+
+	GetLabels() (map[string]string, error)
+	SetLabels(labels map[string]string) error
+	// FindVolumes looks up volumes across the cluster by label.
+	FindVolumes(sel Selector) ([]string, error)
 	DeleteVolume() error
+	// TrashVolume moves the volume into the trash, keeping its metadata
+	// under its ID, until it expires. It fails as DeleteVolume does.
+	TrashVolume(deleted, expires time.Time) error
+	// GetTrash returns every volume in the trash, ignoring the volume the
+	// metadata was created for.
+	GetTrash() ([]TrashedVolume, error)
+	// RestoreVolume moves the volume back out of the trash under name.
+	RestoreVolume(name string) error
+	// PurgeVolume deletes the volume from the trash for good.
+	PurgeVolume() error
+	// GetDescription returns the volume's description, or "" if it has
+	// none.
+	GetDescription() (string, error)
+	// EditVolume makes the changes in e to the volume at once, renaming
+	// it in its consistency groups too. It fails with torus.ErrExists if
+	// the new name is taken.
+	EditVolume(e VolumeEdit) error
 
-	SaveSnapshot(name string) error
+	SaveSnapshot(name string, annotations map[string]string) error
 	GetSnapshots() ([]Snapshot, error)
 	DeleteSnapshot(name string) error
+	// RollbackSnapshot makes the named snapshot the volume's current
+	// state, failing with torus.ErrLocked if the volume is attached unless
+	// force is set, in which case the lock is broken.
+	RollbackSnapshot(name string, force bool) error
+
+	GetSnapshotPolicy() (*SnapshotPolicy, error)
+	SetSnapshotPolicy(p *SnapshotPolicy) error
+
+	GetVolumeTuning() (*VolumeTuning, error)
+	SetVolumeTuning(t *VolumeTuning) error
+
+	GetMACMask() ([]string, error)
+	SetMACMask(mask []string) error
+	GetReservation() ([]string, error)
+	// UpdateReservation atomically replaces the volume's reservation with
+	// what fn returns for the current one, across the cluster. If fn
+	// fails, the reservation is left alone, and is returned with fn's
+	// error.
+	UpdateReservation(fn func(cur []string) ([]string, error)) ([]string, error)
+	GetAoEConfig() (string, error)
+	// UpdateAoEConfig changes the volume's AoE config string as
+	// UpdateReservation changes its reservation.
+	UpdateAoEConfig(fn func(cur string) (string, error)) (string, error)
+	// GetPersistentReservations returns the volume's encoded SCSI
+	// persistent reservations, or nil if there are none.
+	GetPersistentReservations() ([]byte, error)
+	// UpdatePersistentReservations changes them as UpdateReservation
+	// changes its reservation.
+	UpdatePersistentReservations(fn func(cur []byte) ([]byte, error)) ([]byte, error)
+	// GetMirror returns where the volume is mirrored to and how far the
+	// mirror has got, or nil if it isn't mirrored.
+	GetMirror() (*Mirror, error)
+	// UpdateMirror changes the volume's mirror as UpdateReservation
+	// changes its reservation. Returning nil from fn stops the mirroring.
+	UpdateMirror(fn func(cur *Mirror) (*Mirror, error)) (*Mirror, error)
+	// UpdateCompaction changes the volume's pending compaction as
+	// UpdateReservation changes its reservation. Returning nil from fn
+	// removes it.
+	UpdateCompaction(fn func(cur *Compaction) (*Compaction, error)) (*Compaction, error)
+	// WaitCompaction blocks until fn reports true of the volume's pending
+	// compaction, which may be nil, and returns it, or until ctx is done.
+	WaitCompaction(ctx context.Context, fn func(cur *Compaction) bool) (*Compaction, error)
+
+	// Checkpoints cover every block volume, so these ignore the volume the
+	// metadata was created for.
+	SaveCheckpoint(name string, now time.Time) (*Checkpoint, error)
+	GetCheckpoints() ([]Checkpoint, error)
+	DeleteCheckpoint(name string) error
+	RestoreCheckpoint(name string) ([]string, error)
+
+	// So do consistency groups.
+	CreateConsistencyGroup(g ConsistencyGroup) error
+	GetConsistencyGroups() ([]ConsistencyGroup, error)
+	// UpdateConsistencyGroup atomically changes a group with fn, as
+	// UpdateReservation changes a reservation.
+	UpdateConsistencyGroup(name string, fn func(g *ConsistencyGroup) error) (*ConsistencyGroup, error)
+	DeleteConsistencyGroup(name string) error
+	// SaveGroupSnapshot snapshots every member of the group as it was at
+	// a single revision, returning the revision, or none of them.
+	SaveGroupSnapshot(group, name string, annotations map[string]string) (int64, error)
+
+	// So do AoE exports. An export is registered until it is
+	// unregistered or the lease expires.
+	RegisterAoEExport(e AoEExport, lease int64) error
+	UnregisterAoEExport(e AoEExport) error
+	GetAoEExports() ([]AoEExport, error)
+	// WaitAoEExportFree blocks until nothing is exported at major.minor
+	// or ctx is done.
+	WaitAoEExportFree(ctx context.Context, major uint16, minor uint8) error
+
+	// And the election of the node which runs snapshot policies and
+	// mirrors.
+	// CampaignSnapshotScheduler elects this node if no other live node
+	// holds the election, for as long as lease is kept alive, and reports
+	// whether this node is elected.
+	CampaignSnapshotScheduler(lease int64) (bool, error)
+
+	// So does deduplication: the index of block contents shared by every
+	// deduplicated volume, and the pins which keep the blocks matched in
+	// it from the GC; see blockset.ContentStore. A pin lasts until it's
+	// released or the lease expires.
+	LookupContent(hash []byte) (torus.BlockRef, bool, error)
+	AddContent(hash []byte, ref torus.BlockRef) error
+	ForgetContent(hash []byte, ref torus.BlockRef) error
+	PinBlock(ref torus.BlockRef, lease int64) (string, error)
+	UnpinBlock(ref torus.BlockRef, pin string) error
+	// CondemnBlock marks a block the GC has found dead, so that it can't
+	// be pinned any more, unless it's pinned already, and reports whether
+	// it's marked.
+	CondemnBlock(ref torus.BlockRef, now time.Time) (bool, error)
+	// GetCondemnedBlocks returns the marked blocks, with when they were
+	// marked.
+	GetCondemnedBlocks() (map[torus.BlockRef]time.Time, error)
+	// PardonBlock removes the mark CondemnBlock made.
+	PardonBlock(ref torus.BlockRef) error
+	// CollectBlock drops what's held for a condemned block the GC is
+	// collecting: its mark, and its entry in the content index if it has
+	// one.
+	CollectBlock(ref torus.BlockRef) error
+
+	// So does the index of buckets and objects.
+	CreateBucket(b Bucket) error
+	GetBucket(name string) (*Bucket, error)
+	GetBuckets() ([]Bucket, error)
+	DeleteBucket(name string) error
+	GetObject(bucket, key string) (*Object, error)
+	ListObjects(bucket, prefix, after string, max int) ([]Object, error)
+	// PutObject stores o in its bucket, returning the object it replaced,
+	// if any.
+	PutObject(o *Object) (*Object, error)
+	DeleteObject(bucket, key string) (*Object, error)
+	CreateUpload(u *Upload) error
+	GetUpload(bucket, id string) (*Upload, error)
+	// UpdateUpload atomically changes an upload with fn, as
+	// UpdateReservation changes a reservation.
+	UpdateUpload(bucket, id string, fn func(u *Upload) error) (*Upload, error)
+	// CompleteUpload atomically replaces an upload with the object fn
+	// makes of it, returning the object that replaced, if any.
+	CompleteUpload(bucket, id string, fn func(u *Upload) (*Object, error)) (*Object, error)
+	DeleteUpload(bucket, id string) (*Upload, error)
 }
 
 func createBlockMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
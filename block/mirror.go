@@ -0,0 +1,522 @@
+package block
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// mirrorSnapshotPrefix starts the name of every snapshot taken to mirror a
+// volume. Each copy to the remote cluster is of one of them, so that it's
+// consistent however the volume is written meanwhile.
+const mirrorSnapshotPrefix = "mirror-"
+
+const (
+	// mirrorChunk is how much is read and written at a time when copying.
+	mirrorChunk = 1024 * 1024
+	// mirrorCheckpoint is how often an interrupted copy's progress is
+	// saved, so that it needn't start over.
+	mirrorCheckpoint = 30 * time.Second
+)
+
+var promMirrorLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "torus_block_mirror_lag_seconds",
+	Help: "How far behind the volume its mirror on the remote cluster is, as of the last mirroring run",
+}, []string{"volume"})
+
+func init() {
+	prometheus.MustRegister(promMirrorLag)
+}
+
+// Mirror is where a block volume is mirrored to, and how far the mirror has
+// got. Mirroring is asynchronous: each run copies what has changed since the
+// last one to a volume of the same name on the remote cluster, which then
+// holds the volume as it was when the run started.
+type Mirror struct {
+	// Target is the etcd address of the remote cluster.
+	Target string `json:"target"`
+
+	// Snapshot names the snapshot last copied in full, which both
+	// clusters keep until the next copy completes, and Synced is when
+	// it was taken. The remote volume is a consistent copy of the volume
+	// as of Synced, and can be attached in its place if this cluster is
+	// lost. Both are empty until the first copy completes.
+	Snapshot string    `json:"snapshot,omitempty"`
+	Synced   time.Time `json:"synced,omitempty"`
+
+	// Pending names the snapshot being copied, and Base the one it's
+	// being copied on top of, empty for a full copy. Copied is how much
+	// of the volume has been, so that an interrupted copy resumes from
+	// there.
+	Pending string `json:"pending,omitempty"`
+	Base    string `json:"base,omitempty"`
+	Copied  uint64 `json:"copied,omitempty"`
+
+	// Error is why the last run failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+func (m *Mirror) copy() *Mirror {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	return &c
+}
+
+// Lag is how far behind the volume its mirror is at time now, or zero if
+// nothing has been copied yet.
+func (m *Mirror) Lag(now time.Time) time.Duration {
+	if m.Synced.IsZero() {
+		return 0
+	}
+	return now.Sub(m.Synced)
+}
+
+// errMirrorChanged is returned by a mirroring run whose volume stopped being
+// mirrored, started being mirrored elsewhere, or was mirrored by another run,
+// while it ran.
+var errMirrorChanged = errors.New("block: volume's mirror changed while copying")
+
+// GetMirror returns the mirror of the named volume, or nil if it isn't
+// mirrored.
+func GetMirror(mds torus.MetadataService, volume string) (*Mirror, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetMirror()
+}
+
+// SetMirror mirrors the named volume to the cluster whose etcd is at target,
+// from the next mirroring run. A volume already mirrored there carries on
+// where it got to. Encrypted volumes can't be mirrored.
+func SetMirror(mds torus.MetadataService, volume string, target string) error {
+	if target == "" {
+		return errors.New("a mirror needs a target cluster")
+	}
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	opts, err := bmds.GetVolumeOptions()
+	if err != nil {
+		return err
+	}
+	if opts.Encryption != nil {
+		// Mirroring runs in torusd, which doesn't have the key.
+		return errors.New("encrypted volumes can't be mirrored")
+	}
+	_, err = bmds.UpdateMirror(func(cur *Mirror) (*Mirror, error) {
+		if cur != nil && cur.Target == target {
+			return cur, nil
+		}
+		return &Mirror{Target: target}, nil
+	})
+	return err
+}
+
+// ClearMirror stops mirroring the named volume, and deletes the snapshots
+// this cluster kept for it. The copy on the remote cluster is left alone.
+func ClearMirror(mds torus.MetadataService, volume string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	if _, err := bmds.UpdateMirror(func(*Mirror) (*Mirror, error) { return nil, nil }); err != nil {
+		return err
+	}
+	promMirrorLag.DeleteLabelValues(volume)
+	snaps, err := bmds.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, x := range snaps {
+		if !strings.HasPrefix(x.Name, mirrorSnapshotPrefix) {
+			continue
+		}
+		if err := bmds.DeleteSnapshot(x.Name); err != nil && err != torus.ErrNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateMirror changes the volume's mirror with fn, as long as it is still
+// mirrored to target and copying pending; another run may have taken over.
+func (s *BlockVolume) updateMirror(target, pending string, fn func(m *Mirror)) (*Mirror, error) {
+	return s.mds.UpdateMirror(func(cur *Mirror) (*Mirror, error) {
+		if cur == nil || cur.Target != target || cur.Pending != pending {
+			return cur, errMirrorChanged
+		}
+		fn(cur)
+		return cur, nil
+	})
+}
+
+// MirrorTo copies what has changed in the volume since its last mirroring
+// run to its mirror on remote, a client of the mirror's target cluster,
+// creating the remote volume the first time. If the run is interrupted, or
+// ctx is done, the next one resumes it. progress is called with how many
+// bytes have been copied out of how many need to be.
+//
+// The remote volume is locked while it's written, and its contents between
+// runs must be left alone: if they have changed since the last run, or it's
+// missing the last run's snapshot, it's copied over in full.
+func (s *BlockVolume) MirrorTo(ctx context.Context, remote *torus.Server, progress func(int, int)) error {
+	m, err := s.mds.GetMirror()
+	if err != nil || m == nil {
+		return err
+	}
+	target := m.Target
+	name := s.volume.Name
+
+	if m.Pending == "" {
+		now := time.Now().UTC()
+		snap := mirrorSnapshotPrefix + now.Format(autoSnapshotTimeFormat)
+		err := s.mds.SaveSnapshot(snap, map[string]string{"mirror": target})
+		if err != nil {
+			return err
+		}
+		base, err := s.mirrorBase(remote, m.Snapshot)
+		if err != nil {
+			s.mds.DeleteSnapshot(snap)
+			return err
+		}
+		m, err = s.updateMirror(target, "", func(m *Mirror) {
+			m.Pending, m.Base, m.Copied = snap, base, 0
+		})
+		if err != nil {
+			s.mds.DeleteSnapshot(snap)
+			return err
+		}
+	}
+
+	extents, err := s.ChangedExtents(m.Base, m.Pending)
+	if err != nil {
+		return err
+	}
+	src, err := s.OpenSnapshot(m.Pending)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	created, err := s.prepareMirror(remote, src.Size())
+	if err != nil {
+		return err
+	}
+	if created && (m.Base != "" || m.Copied != 0) {
+		// The remote volume has gone since the copy started.
+		m, err = s.updateMirror(target, m.Pending, func(m *Mirror) { m.Base, m.Copied = "", 0 })
+		if err != nil {
+			return err
+		}
+		if extents, err = s.ChangedExtents("", m.Pending); err != nil {
+			return err
+		}
+	}
+	rv, err := OpenBlockVolume(remote, name)
+	if err != nil {
+		return err
+	}
+	dst, err := rv.OpenBlockFile()
+	if err != nil {
+		return err
+	}
+	if m.Base == "" && m.Copied == 0 {
+		// A full copy starts from nothing.
+		if err := dst.Trim(0, int64(dst.Size())); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+
+	total := 0
+	for _, e := range extents {
+		if !e.Zero {
+			total += int(e.Length)
+		}
+	}
+	done := 0
+	checkpoint := func(copied uint64) error {
+		if err := dst.Sync(); err != nil {
+			return err
+		}
+		_, err := s.updateMirror(target, m.Pending, func(m *Mirror) { m.Copied = copied })
+		return err
+	}
+	err = s.copyExtents(ctx, src, dst, extents, m.Copied, func(n int) {
+		done += n
+		if progress != nil {
+			progress(done, total)
+		}
+	}, checkpoint)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// Keep the copy as a snapshot of the same name on the remote cluster,
+	// which stays consistent whatever the next run is in the middle of.
+	err = rv.mds.SaveSnapshot(m.Pending, map[string]string{"mirror": "copy"})
+	if err != nil && err != torus.ErrExists {
+		return err
+	}
+	synced, err := time.Parse(autoSnapshotTimeFormat, strings.TrimPrefix(m.Pending, mirrorSnapshotPrefix))
+	if err != nil {
+		return err
+	}
+	prev := m.Snapshot
+	m, err = s.updateMirror(target, m.Pending, func(m *Mirror) {
+		m.Snapshot, m.Synced = m.Pending, synced
+		m.Pending, m.Base, m.Copied, m.Error = "", "", 0, ""
+	})
+	if err != nil {
+		return err
+	}
+	if prev != "" && prev != m.Snapshot {
+		if err := rv.mds.DeleteSnapshot(prev); err != nil && err != torus.ErrNotExist {
+			clog.Warningf("mirror: couldn't delete snapshot %s of remote volume %s: %v", prev, name, err)
+		}
+		if err := s.mds.DeleteSnapshot(prev); err != nil && err != torus.ErrNotExist {
+			clog.Warningf("mirror: couldn't delete snapshot %s of volume %s: %v", prev, name, err)
+		}
+	}
+	clog.Infof("mirrored volume %s to %s as of %s", name, target, m.Synced.Format(time.RFC3339))
+	return nil
+}
+
+// mirrorBase returns the snapshot a new copy can be made on top of: the last
+// one copied, if the remote volume still holds exactly that. Otherwise it
+// returns "", for a full copy.
+func (s *BlockVolume) mirrorBase(remote *torus.Server, last string) (string, error) {
+	if last == "" {
+		return "", nil
+	}
+	vol, err := findVolume(remote.MDS, s.volume.Name)
+	if err != nil || vol == nil {
+		return "", err
+	}
+	rv, err := OpenBlockVolume(remote, vol.Name)
+	if err != nil {
+		return "", err
+	}
+	changed, err := rv.ChangedExtents(last, "")
+	switch {
+	case err == torus.ErrNotExist:
+		clog.Warningf("mirror: remote volume %s has lost snapshot %s; copying it over in full", s.volume.Name, last)
+		return "", nil
+	case err != nil:
+		return "", err
+	case len(changed) != 0:
+		clog.Warningf("mirror: remote volume %s was written since snapshot %s; copying it over in full", s.volume.Name, last)
+		return "", nil
+	}
+	return last, nil
+}
+
+// prepareMirror creates the remote volume, reporting whether it did, or
+// resizes it, to match the volume's size.
+func (s *BlockVolume) prepareMirror(remote *torus.Server, size uint64) (bool, error) {
+	name := s.volume.Name
+	vol, err := findVolume(remote.MDS, name)
+	if err != nil {
+		return false, err
+	}
+	if vol == nil {
+		opts, err := s.mds.GetVolumeOptions()
+		if err != nil {
+			return false, err
+		}
+		// The copy isn't a clone of anything on the remote cluster.
+		opts.Origin = ""
+		opts.Labels, err = s.mds.GetLabels()
+		if err != nil {
+			return false, err
+		}
+		return true, CreateBlockVolumeWithOptions(remote.MDS, name, size, opts)
+	}
+	if vol.Type != VolumeType {
+		return false, torus.ErrWrongVolumeType
+	}
+	bmds, err := createBlockMetadata(remote.MDS, name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return false, err
+	}
+	cur, err := bmds.GetVolumeSize()
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case size > cur:
+		return false, GrowBlockVolume(remote, name, size)
+	case size < cur:
+		_, err := ShrinkBlockVolume(remote, name, size, true)
+		return false, err
+	}
+	return false, nil
+}
+
+// findVolume returns the named volume, or nil if there's no such volume.
+func findVolume(mds torus.MetadataService, name string) (*models.Volume, error) {
+	vols, _, err := mds.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vols {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// copyExtents copies extents from src to dst, skipping those before copied,
+// which were copied by an interrupted run. checkpoint is called with how far
+// the copy has got every mirrorCheckpoint, and when ctx is done.
+func (s *BlockVolume) copyExtents(ctx context.Context, src, dst *BlockFile, extents []Extent, copied uint64, wrote func(int), checkpoint func(uint64) error) error {
+	buf := make([]byte, mirrorChunk)
+	last := time.Now()
+	for _, e := range extents {
+		end := e.Offset + e.Length
+		if end <= copied {
+			continue
+		}
+		start := e.Offset
+		if copied > start {
+			start = copied
+		}
+		if e.Zero {
+			if err := dst.Trim(int64(start), int64(end-start)); err != nil {
+				return err
+			}
+			continue
+		}
+		for off := start; off < end; {
+			if ctx.Err() != nil {
+				if err := checkpoint(off); err != nil {
+					return err
+				}
+				return ctx.Err()
+			}
+			n := uint64(len(buf))
+			if end-off < n {
+				n = end - off
+			}
+			if _, err := src.ReadAt(buf[:n], int64(off)); err != nil {
+				return err
+			}
+			if _, err := dst.WriteAt(buf[:n], int64(off)); err != nil {
+				return err
+			}
+			wrote(int(n))
+			off += n
+			if time.Since(last) > mirrorCheckpoint {
+				if err := checkpoint(off); err != nil {
+					return err
+				}
+				last = time.Now()
+			}
+		}
+	}
+	return nil
+}
+
+// RunMirrors runs the mirror of every mirrored block volume in the cluster,
+// if this node is elected to. connect returns a client of the cluster whose
+// etcd is at the given address; each is closed when the run is done. Errors
+// on one volume are recorded in its mirror and logged, and don't stop the
+// others.
+func RunMirrors(ctx context.Context, srv *torus.Server, connect func(target string) (*torus.Server, error), progress func(int, int)) error {
+	// Mirrors are run by the node which runs the snapshot policies. A
+	// remote volume can only be written by one node at a time, so a node
+	// without a lease running them too is safe.
+	if lease := srv.Lease(); lease != 0 {
+		bmds, err := createBlockMetadata(srv.MDS, "", 0)
+		if err != nil {
+			return err
+		}
+		elected, err := bmds.CampaignSnapshotScheduler(lease)
+		if err != nil {
+			return err
+		}
+		if !elected {
+			return nil
+		}
+	}
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		return err
+	}
+	var mirrored []*BlockVolume
+	for _, v := range vols {
+		if v.Type != VolumeType {
+			continue
+		}
+		bv, err := OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			clog.Errorf("mirror: couldn't open volume %s: %v", v.Name, err)
+			continue
+		}
+		m, err := bv.mds.GetMirror()
+		if err != nil {
+			clog.Errorf("mirror: volume %s: %v", v.Name, err)
+			continue
+		}
+		if m != nil {
+			mirrored = append(mirrored, bv)
+		}
+	}
+
+	remotes := make(map[string]*torus.Server)
+	defer func() {
+		for _, r := range remotes {
+			r.Close()
+		}
+	}()
+	for i, bv := range mirrored {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name := bv.volume.Name
+		m, err := bv.mds.GetMirror()
+		if err != nil || m == nil {
+			continue
+		}
+		remote, ok := remotes[m.Target]
+		if !ok {
+			remote, err = connect(m.Target)
+			if err == nil {
+				remotes[m.Target] = remote
+			}
+		}
+		if err == nil {
+			err = bv.MirrorTo(ctx, remote, nil)
+		}
+		if err != nil && ctx.Err() == nil {
+			clog.Errorf("mirror: volume %s: %v", name, err)
+			msg := err.Error()
+			bv.mds.UpdateMirror(func(cur *Mirror) (*Mirror, error) {
+				if cur != nil && cur.Target == m.Target {
+					cur.Error = msg
+				}
+				return cur, nil
+			})
+		}
+		if m, err := bv.mds.GetMirror(); err == nil && m != nil && !m.Synced.IsZero() {
+			promMirrorLag.WithLabelValues(name).Set(m.Lag(time.Now()).Seconds())
+		}
+		if progress != nil {
+			progress(i+1, len(mirrored))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package nvme
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// Admin command opcodes.
+const (
+	adminGetLogPage   = 0x02
+	adminIdentify     = 0x06
+	adminAbort        = 0x08
+	adminSetFeatures  = 0x09
+	adminGetFeatures  = 0x0a
+	adminAsyncEvent   = 0x0c
+	adminKeepAlive    = 0x18
+	identifyNamespace = 0x00
+	identifyCtrl      = 0x01
+	identifyNSList    = 0x02
+	identifyNSDescs   = 0x03
+	featureVWC        = 0x06
+	featureNumQueues  = 0x07
+	featureAsyncEvent = 0x0b
+	featureKeepAlive  = 0x0f
+	logError          = 0x01
+	logHealth         = 0x02
+	logFirmware       = 0x03
+	logChangedNS      = 0x04
+	logDiscovery      = 0x70
+)
+
+// admin serves a command on the admin queue. It returns true if the command
+// is held without being completed.
+func (q *queue) admin(cmd command, data []byte) (completion, bool) {
+	ctrl := q.ctrl
+	switch cmd.opcode() {
+	case adminIdentify:
+		return q.identify(cmd), false
+	case adminGetLogPage:
+		return q.logPage(cmd), false
+	case adminSetFeatures:
+		return ctrl.setFeature(cmd), false
+	case adminGetFeatures:
+		return ctrl.getFeature(cmd), false
+	case adminKeepAlive:
+		return completion{}, false
+	case adminAsyncEvent:
+		// There are never any events to report, so the request is held
+		// until the controller goes away.
+		return completion{}, true
+	case adminAbort:
+		// Commands are served one at a time, so by now there is
+		// nothing left to abort.
+		return completion{dw0: 1}, false
+	}
+	return failed(statusInvalidOpcode), false
+}
+
+func (q *queue) identify(cmd command) completion {
+	ctrl := q.ctrl
+	switch byte(cmd.cdw(10)) {
+	case identifyCtrl:
+		return success(ctrl.identify())
+	}
+	sub := ctrl.sub
+	if sub == nil {
+		return failed(statusInvalidField)
+	}
+	switch byte(cmd.cdw(10)) {
+	case identifyNamespace:
+		if cmd.nsid() != 1 {
+			return failed(statusInvalidNamespace)
+		}
+		return success(sub.identify())
+	case identifyNSList:
+		buf := make([]byte, 4096)
+		if cmd.nsid() < 1 {
+			binary.LittleEndian.PutUint32(buf[0:4], 1)
+		}
+		return success(buf)
+	case identifyNSDescs:
+		if cmd.nsid() != 1 {
+			return failed(statusInvalidNamespace)
+		}
+		buf := make([]byte, 4096)
+		// The namespace's NGUID.
+		buf[0] = 0x02
+		buf[1] = 16
+		copy(buf[4:20], sub.nguid())
+		return success(buf)
+	}
+	return failed(statusInvalidField)
+}
+
+// identify returns the controller's Identify Controller data structure.
+func (c *controller) identify() []byte {
+	buf := make([]byte, 4096)
+	serial, model := "", "TORUS DISCOVERY"
+	if c.sub != nil {
+		serial, model = c.sub.Serial, "TORUS BLOCK VOLUME"
+	}
+	copy(buf[4:24], padded(serial, 20))
+	copy(buf[24:64], padded(model, 40))
+	copy(buf[64:72], padded("0001", 8))
+	binary.LittleEndian.PutUint16(buf[78:80], c.id)
+	binary.LittleEndian.PutUint32(buf[80:84], version)
+	buf[258] = 3 // abort command limit, 0's based
+	buf[259] = 3 // asynchronous event request limit, 0's based
+	buf[261] = 0x04
+	binary.LittleEndian.PutUint16(buf[320:322], 10) // keep alive granularity, in 100ms
+	binary.LittleEndian.PutUint16(buf[514:516], queueEntries)
+	binary.LittleEndian.PutUint32(buf[536:540], 0x00100001) // SGLs, with offsets
+	if c.sub == nil {
+		buf[111] = 2 // discovery controller
+		copy(buf[768:1024], DiscoveryNQN)
+		return buf
+	}
+
+	buf[76] = 0x02 // the subsystem may have several controllers
+	buf[77] = 6    // 256KiB maximum transfer
+	buf[111] = 1   // IO controller
+	buf[260] = 0x03
+	buf[512] = 0x66 // submission queue entries are 64 bytes
+	buf[513] = 0x44 // completion queue entries are 16 bytes
+	binary.LittleEndian.PutUint32(buf[516:520], 1)
+	// Dataset Management and Write Zeroes.
+	binary.LittleEndian.PutUint16(buf[520:522], 0x04|0x08)
+	buf[525] = 0x01 // volatile write cache
+	copy(buf[768:1024], c.sub.NQN)
+	binary.LittleEndian.PutUint32(buf[1792:1796], (sqeLength+inCapsuleSize)/16)
+	binary.LittleEndian.PutUint32(buf[1796:1800], cqeLength/16)
+	buf[1803] = 1 // one SGL descriptor per command
+	return buf
+}
+
+// identify returns the Identify Namespace data structure of namespace 1.
+func (s *Subsystem) identify() []byte {
+	buf := make([]byte, 4096)
+	blocks := uint64(s.Size / BlockSize)
+	binary.LittleEndian.PutUint64(buf[0:8], blocks)
+	binary.LittleEndian.PutUint64(buf[8:16], blocks)
+	binary.LittleEndian.PutUint64(buf[16:24], blocks)
+	buf[24] = 0x01 // thin provisioned
+	if s.PhysicalBlockSize > BlockSize {
+		buf[24] |= 0x10
+		per := uint16(s.PhysicalBlockSize/BlockSize - 1)
+		for off := 64; off <= 72; off += 2 {
+			binary.LittleEndian.PutUint16(buf[off:off+2], per)
+		}
+	}
+	buf[30] = 0x01 // may be shared between controllers
+	if s.ReadOnly {
+		buf[99] = 0x01 // write protected
+	}
+	// Deallocated blocks read as zeros, and Write Zeroes may deallocate.
+	buf[33] = 0x08 | 0x01
+	copy(buf[104:120], s.nguid())
+	// One LBA format, of 512 byte blocks.
+	binary.LittleEndian.PutUint32(buf[128:132], 9<<16)
+	return buf
+}
+
+// nguid returns the namespace's globally unique identifier, which is the
+// same wherever the subsystem is served, so that hosts can find several
+// paths to it.
+func (s *Subsystem) nguid() []byte {
+	sum := sha1.Sum([]byte(s.NQN))
+	return sum[:16]
+}
+
+// logPage returns the part of a log page asked for.
+func (q *queue) logPage(cmd command) completion {
+	lid := byte(cmd.cdw(10))
+	dwords := uint64(cmd.cdw(11)&0xffff)<<16 | uint64(cmd.cdw(10)>>16) + 1
+	off := uint64(cmd.cdw(13))<<32 | uint64(cmd.cdw(12))
+
+	var page []byte
+	switch {
+	case lid == logDiscovery && q.ctrl.sub == nil:
+		page = q.discoveryLog()
+	case lid == logError && q.ctrl.sub != nil:
+		page = make([]byte, 64)
+	case lid == logHealth && q.ctrl.sub != nil, lid == logFirmware && q.ctrl.sub != nil:
+		page = make([]byte, 512)
+	case lid == logChangedNS && q.ctrl.sub != nil:
+		page = make([]byte, 4096)
+	default:
+		return failed(statusInvalidLogPage)
+	}
+	if off%4 != 0 || off > uint64(len(page)) {
+		return failed(statusInvalidField)
+	}
+	buf := make([]byte, dwords*4)
+	copy(buf, page[off:])
+	return success(buf)
+}
+
+// discoveryLog returns the discovery log page, listing every subsystem at
+// the address the host connected to.
+func (q *queue) discoveryLog() []byte {
+	buf := make([]byte, 1024*(1+len(q.srv.nqns)))
+	binary.LittleEndian.PutUint64(buf[0:8], 1)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(len(q.srv.nqns)))
+
+	host, port, adrfam := "", strconv.Itoa(DefaultPort), byte(1)
+	if addr, ok := q.conn.LocalAddr().(*net.TCPAddr); ok {
+		host, port = addr.IP.String(), strconv.Itoa(addr.Port)
+		if addr.IP.To4() == nil {
+			adrfam = 2
+		}
+	}
+	for i, nqn := range q.srv.nqns {
+		e := buf[1024*(i+1):]
+		e[0] = 3 // TCP
+		e[1] = adrfam
+		e[2] = 2    // NVM subsystem
+		e[3] = 0x04 // submission queue flow control may be disabled
+		binary.LittleEndian.PutUint16(e[4:6], 1)
+		binary.LittleEndian.PutUint16(e[6:8], 0xffff) // dynamic controllers
+		binary.LittleEndian.PutUint16(e[8:10], queueEntries)
+		copy(e[32:64], padded(port, 32))
+		copy(e[256:512], padded(host, 256))
+		copy(e[512:768], nqn)
+	}
+	return buf
+}
+
+func (c *controller) setFeature(cmd command) completion {
+	if cmd.cdw(10)&(1<<31) != 0 {
+		return failed(statusFeatureNotSaveable)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch byte(cmd.cdw(10)) {
+	case featureNumQueues:
+		if c.sub == nil {
+			return failed(statusInvalidField)
+		}
+		n := int(cmd.cdw(11)&0xffff) + 1
+		if m := int(cmd.cdw(11)>>16) + 1; m < n {
+			n = m
+		}
+		if n > maxIOQueues {
+			n = maxIOQueues
+		}
+		c.ioQueues = n
+		return completion{dw0: uint32(n-1) | uint32(n-1)<<16}
+	case featureKeepAlive:
+		c.kato = cmd.cdw(11)
+		return completion{}
+	case featureAsyncEvent:
+		return completion{}
+	case featureVWC:
+		// The cache can't be turned off, as torus writes are only
+		// durable once synced.
+		if c.sub == nil || cmd.cdw(11)&0x1 == 0 {
+			return failed(statusInvalidField)
+		}
+		return completion{}
+	}
+	return failed(statusInvalidField)
+}
+
+func (c *controller) getFeature(cmd command) completion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch byte(cmd.cdw(10)) {
+	case featureNumQueues:
+		if c.sub == nil {
+			return failed(statusInvalidField)
+		}
+		n := uint32(maxIOQueues)
+		if c.ioQueues > 0 {
+			n = uint32(c.ioQueues)
+		}
+		return completion{dw0: (n - 1) | (n-1)<<16}
+	case featureKeepAlive:
+		return completion{dw0: c.kato}
+	case featureAsyncEvent:
+		return completion{}
+	case featureVWC:
+		if c.sub == nil {
+			return failed(statusInvalidField)
+		}
+		return completion{dw0: 1}
+	}
+	return failed(statusInvalidField)
+}
+
+// padded returns s padded with spaces to n bytes, as identify strings are.
+func padded(s string, n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = ' '
+	}
+	copy(buf, s)
+	return buf
+}
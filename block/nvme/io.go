@@ -0,0 +1,163 @@
+package nvme
+
+import (
+	"encoding/binary"
+	"log"
+)
+
+// NVM command set opcodes.
+const (
+	ioFlush       = 0x00
+	ioWrite       = 0x01
+	ioRead        = 0x02
+	ioWriteZeroes = 0x08
+	ioDSM         = 0x09
+)
+
+// io serves a command on an IO queue.
+func (q *queue) io(cmd command, data []byte) completion {
+	sub := q.ctrl.sub
+	if cmd.nsid() != 1 {
+		return failed(statusInvalidNamespace)
+	}
+	switch cmd.opcode() {
+	case ioRead:
+		return sub.read(cmd)
+	case ioWrite:
+		return sub.write(cmd, data)
+	case ioFlush:
+		return sub.flush()
+	case ioWriteZeroes:
+		if sub.ReadOnly {
+			return failed(statusWriteProtected)
+		}
+		lba, n := blockRange(cmd)
+		return sub.trim([][2]uint64{{lba, uint64(n)}})
+	case ioDSM:
+		return sub.dsm(cmd, data)
+	}
+	return failed(statusInvalidOpcode)
+}
+
+// blockRange returns the starting LBA and number of blocks of a read,
+// write or Write Zeroes command.
+func blockRange(cmd command) (lba uint64, n uint32) {
+	lba = uint64(cmd.cdw(11))<<32 | uint64(cmd.cdw(10))
+	n = cmd.cdw(12)&0xffff + 1
+	return lba, n
+}
+
+// fua returns whether the write cmd must be durable before it completes.
+func fua(cmd command) bool {
+	return cmd.cdw(12)&(1<<30) != 0
+}
+
+func (s *Subsystem) inRange(lba, n uint64) bool {
+	blocks := uint64(s.Size / BlockSize)
+	return lba <= blocks && n <= blocks-lba
+}
+
+func (s *Subsystem) read(cmd command) completion {
+	lba, n := blockRange(cmd)
+	if !s.inRange(lba, uint64(n)) {
+		return failed(statusLBAOutOfRange)
+	}
+	if int(n)*BlockSize != cmd.dataLength() {
+		return failed(statusSGLLengthInvalid)
+	}
+	buf := make([]byte, int(n)*BlockSize)
+	s.mu.Lock()
+	_, err := s.Device.ReadAt(buf, int64(lba)*BlockSize)
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("nvme: %s: read error: %s", s.Serial, err)
+		return failed(statusUnrecoveredRead)
+	}
+	return success(buf)
+}
+
+func (s *Subsystem) write(cmd command, data []byte) completion {
+	if s.ReadOnly {
+		return failed(statusWriteProtected)
+	}
+	lba, n := blockRange(cmd)
+	if !s.inRange(lba, uint64(n)) {
+		return failed(statusLBAOutOfRange)
+	}
+	if int(n)*BlockSize != len(data) {
+		return failed(statusSGLLengthInvalid)
+	}
+	s.mu.Lock()
+	_, err := s.Device.WriteAt(data, int64(lba)*BlockSize)
+	if err == nil && fua(cmd) {
+		err = s.Device.Sync()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("nvme: %s: write error: %s", s.Serial, err)
+		return failed(statusWriteFault)
+	}
+	return completion{}
+}
+
+func (s *Subsystem) flush() completion {
+	s.mu.Lock()
+	err := s.Device.Sync()
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("nvme: %s: sync error: %s", s.Serial, err)
+		return failed(statusWriteFault)
+	}
+	return completion{}
+}
+
+// dsm serves a Dataset Management command, deallocating the ranges given
+// if asked to. Other attributes are only hints.
+func (s *Subsystem) dsm(cmd command, data []byte) completion {
+	if cmd.cdw(11)&0x4 == 0 {
+		return completion{}
+	}
+	if s.ReadOnly {
+		return failed(statusWriteProtected)
+	}
+	n := int(cmd.cdw(10)&0xff) + 1
+	if len(data) < n*16 {
+		return failed(statusSGLLengthInvalid)
+	}
+	ranges := make([][2]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		r := data[i*16 : (i+1)*16]
+		count := binary.LittleEndian.Uint32(r[4:8])
+		lba := binary.LittleEndian.Uint64(r[8:16])
+		ranges = append(ranges, [2]uint64{lba, uint64(count)})
+	}
+	return s.trim(ranges)
+}
+
+// trim deallocates the ranges of blocks given as LBA and count, which
+// then read as zeros.
+func (s *Subsystem) trim(ranges [][2]uint64) completion {
+	for _, r := range ranges {
+		if !s.inRange(r[0], r[1]) {
+			return failed(statusLBAOutOfRange)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range ranges {
+		if r[1] == 0 {
+			continue
+		}
+		if err := s.Device.Trim(int64(r[0])*BlockSize, int64(r[1])*BlockSize); err != nil {
+			log.Printf("nvme: %s: trim error: %s", s.Serial, err)
+			return failed(statusWriteFault)
+		}
+	}
+	// As for NBD trims, sync so that the blocks released can be
+	// collected.
+	if err := s.Device.Sync(); err != nil {
+		log.Printf("nvme: %s: sync error: %s", s.Serial, err)
+		return failed(statusWriteFault)
+	}
+	return completion{}
+}
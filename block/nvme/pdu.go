@@ -0,0 +1,160 @@
+package nvme
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Types of NVMe/TCP PDUs.
+const (
+	pduICReq       = 0x00
+	pduICResp      = 0x01
+	pduH2CTermReq  = 0x02
+	pduC2HTermReq  = 0x03
+	pduCapsuleCmd  = 0x04
+	pduCapsuleResp = 0x05
+	pduH2CData     = 0x06
+	pduC2HData     = 0x07
+	pduR2T         = 0x09
+)
+
+const (
+	flagLastPDU = 0x04 // H2C and C2H data
+)
+
+// Header lengths of the PDU types sent or received.
+const (
+	icLength      = 128
+	cmdHeaderLen  = 8 + sqeLength
+	respHeaderLen = 8 + cqeLength
+	dataHeaderLen = 24
+)
+
+const (
+	sqeLength = 64
+	cqeLength = 16
+)
+
+// pdu is an NVMe/TCP PDU: its header, including the 8 byte common header,
+// and data. Digests are never enabled, and data immediately follows the
+// header.
+type pdu struct {
+	hdr  []byte
+	data []byte
+}
+
+func (p *pdu) typ() byte {
+	return p.hdr[0]
+}
+
+func (p *pdu) flags() byte {
+	return p.hdr[1]
+}
+
+func (p *pdu) u16(off int) uint16 {
+	return binary.LittleEndian.Uint16(p.hdr[off : off+2])
+}
+
+func (p *pdu) u32(off int) uint32 {
+	return binary.LittleEndian.Uint32(p.hdr[off : off+4])
+}
+
+func (p *pdu) put16(off int, v uint16) {
+	binary.LittleEndian.PutUint16(p.hdr[off:off+2], v)
+}
+
+func (p *pdu) put32(off int, v uint32) {
+	binary.LittleEndian.PutUint32(p.hdr[off:off+4], v)
+}
+
+// newPDU returns a PDU of the given type with a header hlen bytes long.
+func newPDU(typ byte, hlen int) *pdu {
+	p := &pdu{hdr: make([]byte, hlen)}
+	p.hdr[0] = typ
+	p.hdr[2] = byte(hlen)
+	return p
+}
+
+// readPDU reads a PDU from r, refusing any longer than maxLen in all.
+func readPDU(r io.Reader, maxLen int) (*pdu, error) {
+	var ch [8]byte
+	if _, err := io.ReadFull(r, ch[:]); err != nil {
+		return nil, err
+	}
+	hlen := int(ch[2])
+	pdo := int(ch[3])
+	plen := int(binary.LittleEndian.Uint32(ch[4:8]))
+	if hlen < len(ch) || plen < hlen || plen > maxLen {
+		return nil, fmt.Errorf("nvme: invalid PDU lengths: header %d, total %d", hlen, plen)
+	}
+	if ch[1]&0x3 != 0 {
+		return nil, fmt.Errorf("nvme: PDU has digests, which weren't negotiated")
+	}
+	buf := make([]byte, plen)
+	copy(buf, ch[:])
+	if _, err := io.ReadFull(r, buf[len(ch):]); err != nil {
+		return nil, err
+	}
+	p := &pdu{hdr: buf[:hlen]}
+	if plen > hlen {
+		if pdo < hlen || pdo > plen {
+			return nil, fmt.Errorf("nvme: invalid PDU data offset %d", pdo)
+		}
+		p.data = buf[pdo:]
+	}
+	return p, nil
+}
+
+// write writes the PDU to w in a single write.
+func (p *pdu) write(w io.Writer) error {
+	hlen := len(p.hdr)
+	p.hdr[2] = byte(hlen)
+	if len(p.data) > 0 {
+		p.hdr[3] = byte(hlen)
+	}
+	binary.LittleEndian.PutUint32(p.hdr[4:8], uint32(hlen+len(p.data)))
+	buf := make([]byte, hlen+len(p.data))
+	copy(buf, p.hdr)
+	copy(buf[hlen:], p.data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// command is a submission queue entry.
+type command []byte
+
+func (c command) opcode() byte {
+	return c[0]
+}
+
+func (c command) cid() uint16 {
+	return binary.LittleEndian.Uint16(c[2:4])
+}
+
+func (c command) nsid() uint32 {
+	return binary.LittleEndian.Uint32(c[4:8])
+}
+
+// cdw returns command dword n, of 10 to 15.
+func (c command) cdw(n int) uint32 {
+	off := 40 + (n-10)*4
+	return binary.LittleEndian.Uint32(c[off : off+4])
+}
+
+// sglType returns the type and subtype of the command's data descriptor.
+func (c command) sglType() byte {
+	return c[39]
+}
+
+// dataLength returns the length of the command's data.
+func (c command) dataLength() int {
+	return int(binary.LittleEndian.Uint32(c[32:36]))
+}
+
+// SGL descriptor types for data in the capsule, and for data transferred
+// with C2H and H2C data PDUs.
+const (
+	sglInCapsule = 0x01
+	sglTransport = 0x5a
+)
@@ -0,0 +1,615 @@
+// Package nvme implements an NVMe over TCP target serving torus block
+// volumes as NVMe namespaces, for initiators such as Linux's nvme-tcp that
+// want lower latency than NBD or iSCSI, and native multipath.
+//
+// Each volume is a subsystem of its own with a single namespace, ID 1. A
+// discovery controller lists the subsystems. Each TCP connection is one
+// queue, and serves its commands in order; digests, TLS and in-band
+// authentication aren't supported.
+package nvme
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DefaultPort is the TCP port NVMe/TCP subsystems are served on.
+const DefaultPort = 4420
+
+// DiscoveryNQN is the name of the discovery subsystem.
+const DiscoveryNQN = "nqn.2014-08.org.nvmexpress.discovery"
+
+// BlockSize is the size of the namespaces' logical blocks.
+const BlockSize = 512
+
+// Limits this target declares.
+const (
+	// queueEntries is the most entries a submission queue may have.
+	queueEntries = 128
+	// maxIOQueues is how many IO queues a controller may have.
+	maxIOQueues = 16
+	// inCapsuleSize is the most data a command capsule may carry.
+	inCapsuleSize = 8192
+	// maxTransfer is the longest transfer of a single command, which
+	// must be a power of two multiple of 4KiB.
+	maxTransfer = 256 << 10
+	// maxH2CData is the most data in an H2C data PDU, and the most sent
+	// in each C2H data PDU.
+	maxH2CData = 128 << 10
+)
+
+// Device is the storage behind a Subsystem. A block.BlockFile is a Device.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Trim(off, length int64) error
+}
+
+// Subsystem is a disk exported as namespace 1 of the NVM subsystem NQN.
+type Subsystem struct {
+	// NQN is the NVMe qualified name of the subsystem, such as
+	// nqn.2016-06.com.coreos.torus:vol01.
+	NQN      string
+	Device   Device
+	Size     int64
+	ReadOnly bool
+	// Serial is reported as the controllers' serial number, and names the
+	// subsystem in logs.
+	Serial string
+	// PhysicalBlockSize, if larger than 512 bytes, is reported as the
+	// namespace's preferred write granularity.
+	PhysicalBlockSize int
+
+	// The device may be shared by several queues, and isn't safe for
+	// concurrent use.
+	mu sync.Mutex
+}
+
+// Server serves subsystems to hosts over TCP.
+type Server struct {
+	subsystems map[string]*Subsystem
+	nqns       []string
+
+	mu          sync.Mutex
+	listener    net.Listener
+	conns       map[net.Conn]bool
+	closed      bool
+	controllers map[uint16]*controller
+	cntlid      uint16
+}
+
+// NewServer creates a Server for the given subsystems. Their NQNs must be
+// distinct.
+func NewServer(subsystems ...*Subsystem) (*Server, error) {
+	s := &Server{
+		subsystems:  make(map[string]*Subsystem),
+		conns:       make(map[net.Conn]bool),
+		controllers: make(map[uint16]*controller),
+	}
+	for _, sub := range subsystems {
+		if sub.Size < BlockSize {
+			return nil, fmt.Errorf("nvme: subsystem %s is too small", sub.NQN)
+		}
+		if sub.NQN == DiscoveryNQN || len(sub.NQN) > 223 {
+			return nil, fmt.Errorf("nvme: invalid subsystem NQN %q", sub.NQN)
+		}
+		if _, ok := s.subsystems[sub.NQN]; ok {
+			return nil, fmt.Errorf("nvme: more than one subsystem named %q", sub.NQN)
+		}
+		s.subsystems[sub.NQN] = sub
+		s.nqns = append(s.nqns, sub.NQN)
+	}
+	return s, nil
+}
+
+// Serve accepts connections on l, serving each in its own goroutine, until
+// the Server is closed or l fails.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil && err != io.EOF {
+				log.Printf("nvme: %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves a queue on conn until the host disconnects.
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return conn.Close()
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+
+	q := &queue{srv: s, conn: conn}
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		if q.ctrl != nil && q.qid == 0 {
+			// The controller goes with its admin queue.
+			delete(s.controllers, q.ctrl.id)
+		}
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	return q.serve()
+}
+
+// Close stops accepting connections and drops every queue.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// newController creates a controller of sub, or the discovery controller
+// if sub is nil, for the host hostNQN.
+func (s *Server) newController(sub *Subsystem, hostNQN string) *controller {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		s.cntlid++
+		// 0xfff0 and up are reserved.
+		if s.cntlid == 0 || s.cntlid >= 0xfff0 {
+			s.cntlid = 1
+		}
+		if _, ok := s.controllers[s.cntlid]; !ok {
+			break
+		}
+	}
+	c := &controller{id: s.cntlid, sub: sub, hostNQN: hostNQN}
+	s.controllers[c.id] = c
+	return c
+}
+
+func (s *Server) controller(id uint16) *controller {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.controllers[id]
+}
+
+// controller is the state shared by the admin and IO queues of a host's
+// association with a subsystem.
+type controller struct {
+	id      uint16
+	sub     *Subsystem
+	hostNQN string
+
+	mu       sync.Mutex
+	cc       uint32
+	csts     uint32
+	ioQueues int
+	kato     uint32
+}
+
+func (c *controller) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.csts&cstsReady != 0
+}
+
+// Controller properties, and their bits.
+const (
+	propCAP  = 0x00
+	propVS   = 0x08
+	propCC   = 0x14
+	propCSTS = 0x1c
+
+	ccEnable     = 0x1
+	ccShutdown   = 0x3 << 14
+	cstsReady    = 0x1
+	cstsShutdown = 0x2 << 2
+
+	// version is NVMe 1.3.
+	version = 0x00010300
+)
+
+// capabilities returns the CAP property: queues of up to queueEntries,
+// which must be contiguous, a 7.5 second timeout, and the NVM command set.
+func capabilities() uint64 {
+	return uint64(queueEntries-1) | 1<<16 | 15<<24 | 1<<37
+}
+
+// queue is the state of a single connection, which is one of a
+// controller's queues.
+type queue struct {
+	srv  *Server
+	conn net.Conn
+	ctrl *controller
+	qid  uint16
+
+	size uint16
+	head uint16
+	// noFlowControl is set if the host disabled submission queue flow
+	// control, when the queue head isn't reported.
+	noFlowControl bool
+	ttag          uint16
+
+	// Capsules received while waiting for the data of a write, to be
+	// served after it.
+	pending []*pdu
+}
+
+func (q *queue) serve() error {
+	if err := q.initialize(); err != nil {
+		return err
+	}
+	for {
+		p, err := q.next()
+		if err != nil {
+			return err
+		}
+		switch p.typ() {
+		case pduCapsuleCmd:
+			if err := q.command(p); err != nil {
+				return err
+			}
+		case pduH2CData:
+			// Data is read along with its command, so this is for one
+			// that already failed.
+		case pduH2CTermReq:
+			return io.EOF
+		default:
+			return fmt.Errorf("nvme: unexpected PDU type %#x", p.typ())
+		}
+	}
+}
+
+// initialize exchanges the ICReq and ICResp that start a connection.
+func (q *queue) initialize() error {
+	p, err := readPDU(q.conn, icLength)
+	if err != nil {
+		return err
+	}
+	if p.typ() != pduICReq || len(p.hdr) != icLength {
+		return fmt.Errorf("nvme: expected an ICReq, got PDU type %#x", p.typ())
+	}
+	if pfv := p.u16(8); pfv != 0 {
+		return fmt.Errorf("nvme: unsupported PDU format version %d", pfv)
+	}
+	resp := newPDU(pduICResp, icLength)
+	// Version 0, no data alignment and no digests, whatever was asked
+	// for.
+	resp.put32(12, maxH2CData)
+	return resp.write(q.conn)
+}
+
+// next returns the next PDU to serve.
+func (q *queue) next() (*pdu, error) {
+	if len(q.pending) > 0 {
+		p := q.pending[0]
+		q.pending = q.pending[1:]
+		return p, nil
+	}
+	return readPDU(q.conn, dataHeaderLen+maxH2CData)
+}
+
+// completion is the outcome of a command.
+type completion struct {
+	status status
+	// dw0 and dw1 are the command specific dwords of the response.
+	dw0, dw1 uint32
+	// data is sent to the host before the response.
+	data []byte
+}
+
+func success(data []byte) completion {
+	return completion{data: data}
+}
+
+func failed(s status) completion {
+	return completion{status: s}
+}
+
+// command serves the command in capsule p, reading any data it sends
+// first.
+func (q *queue) command(p *pdu) error {
+	if len(p.hdr) != cmdHeaderLen {
+		return fmt.Errorf("nvme: command capsule header is %d bytes", len(p.hdr))
+	}
+	cmd := command(p.hdr[8:])
+
+	var data []byte
+	if dataDirection(cmd) == dirHostToController && cmd.dataLength() > 0 {
+		switch cmd.sglType() {
+		case sglInCapsule:
+			if len(p.data) < cmd.dataLength() {
+				return q.respond(cmd, failed(statusSGLLengthInvalid))
+			}
+			data = p.data[:cmd.dataLength()]
+		case sglTransport:
+			if cmd.dataLength() > maxTransfer {
+				return q.respond(cmd, failed(statusSGLLengthInvalid))
+			}
+			var err error
+			data, err = q.dataOut(cmd)
+			if err != nil {
+				return err
+			}
+		default:
+			return q.respond(cmd, failed(statusSGLTypeInvalid))
+		}
+	}
+
+	var c completion
+	switch {
+	case cmd.opcode() == opFabrics:
+		c = q.fabrics(cmd, data)
+	case q.ctrl == nil:
+		// Nothing but Connect before Connect.
+		c = failed(statusCommandSequence)
+	case q.qid == 0:
+		var hold bool
+		c, hold = q.admin(cmd, data)
+		if hold {
+			return nil
+		}
+	default:
+		c = q.io(cmd, data)
+	}
+	return q.respond(cmd, c)
+}
+
+// Directions of commands' data transfer.
+const (
+	dirHostToController = 1
+	dirControllerToHost = 2
+)
+
+func dataDirection(cmd command) byte {
+	if cmd.opcode() == opFabrics {
+		return cmd[4] & 0x3
+	}
+	return cmd.opcode() & 0x3
+}
+
+// dataOut solicits the data of the write cmd with an R2T, and gathers it
+// from the H2C data PDUs the host answers with.
+func (q *queue) dataOut(cmd command) ([]byte, error) {
+	n := cmd.dataLength()
+	q.ttag++
+	r2t := newPDU(pduR2T, dataHeaderLen)
+	r2t.put16(8, cmd.cid())
+	r2t.put16(10, q.ttag)
+	r2t.put32(12, 0)
+	r2t.put32(16, uint32(n))
+	if err := r2t.write(q.conn); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, n)
+	got := 0
+	for got < n {
+		p, err := readPDU(q.conn, dataHeaderLen+maxH2CData)
+		if err != nil {
+			return nil, err
+		}
+		if p.typ() == pduCapsuleCmd {
+			q.pending = append(q.pending, p)
+			continue
+		}
+		if p.typ() != pduH2CData {
+			return nil, fmt.Errorf("nvme: expected H2C data, got PDU type %#x", p.typ())
+		}
+		off := int(p.u32(12))
+		if p.u16(8) != cmd.cid() || p.u16(10) != q.ttag || off != got || len(p.data) != int(p.u32(16)) || got+len(p.data) > n {
+			return nil, fmt.Errorf("nvme: H2C data for command %d doesn't match the R2T", cmd.cid())
+		}
+		got += copy(buf[off:], p.data)
+		if got < n && p.flags()&flagLastPDU != 0 {
+			return nil, fmt.Errorf("nvme: H2C data for command %d ended early", cmd.cid())
+		}
+	}
+	return buf, nil
+}
+
+// respond sends the data of completion c, if any, and its response.
+func (q *queue) respond(cmd command, c completion) error {
+	if c.status == statusSuccess && len(c.data) > 0 && dataDirection(cmd) == dirControllerToHost {
+		data := c.data
+		if n := cmd.dataLength(); len(data) > n {
+			data = data[:n]
+		}
+		for off := 0; off < len(data); off += maxH2CData {
+			end := off + maxH2CData
+			if end > len(data) {
+				end = len(data)
+			}
+			p := newPDU(pduC2HData, dataHeaderLen)
+			p.put16(8, cmd.cid())
+			p.put32(12, uint32(off))
+			p.put32(16, uint32(end-off))
+			if end == len(data) {
+				p.hdr[1] = flagLastPDU
+			}
+			p.data = data[off:end]
+			if err := p.write(q.conn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if q.size > 0 {
+		q.head = (q.head + 1) % q.size
+	}
+	resp := newPDU(pduCapsuleResp, respHeaderLen)
+	cqe := resp.hdr[8:]
+	binary.LittleEndian.PutUint32(cqe[0:4], c.dw0)
+	binary.LittleEndian.PutUint32(cqe[4:8], c.dw1)
+	sqhd := q.head
+	if q.noFlowControl {
+		sqhd = 0xffff
+	}
+	binary.LittleEndian.PutUint16(cqe[8:10], sqhd)
+	binary.LittleEndian.PutUint16(cqe[10:12], q.qid)
+	binary.LittleEndian.PutUint16(cqe[12:14], cmd.cid())
+	binary.LittleEndian.PutUint16(cqe[14:16], c.status.field())
+	return resp.write(q.conn)
+}
+
+// Fabrics command types.
+const (
+	opFabrics = 0x7f
+
+	fctPropertySet = 0x00
+	fctConnect     = 0x01
+	fctPropertyGet = 0x04
+)
+
+func (q *queue) fabrics(cmd command, data []byte) completion {
+	switch cmd[4] {
+	case fctConnect:
+		return q.connect(cmd, data)
+	case fctPropertyGet, fctPropertySet:
+		if q.ctrl == nil || q.qid != 0 {
+			return failed(statusCommandSequence)
+		}
+		return q.property(cmd)
+	}
+	return failed(statusInvalidOpcode)
+}
+
+// connect creates a controller for an admin queue, or adds an IO queue to
+// one.
+func (q *queue) connect(cmd command, data []byte) completion {
+	if q.ctrl != nil {
+		return failed(statusCommandSequence)
+	}
+	if len(data) < 1024 {
+		return failed(statusSGLLengthInvalid)
+	}
+	recfmt := binary.LittleEndian.Uint16(cmd[40:42])
+	qid := binary.LittleEndian.Uint16(cmd[42:44])
+	sqsize := int(binary.LittleEndian.Uint16(cmd[44:46])) + 1
+	cattr := cmd[46]
+	if recfmt != 0 {
+		return failed(statusConnectIncompatibleFormat)
+	}
+	if sqsize < 2 || sqsize > queueEntries {
+		return invalidConnectParam(false, 44)
+	}
+	cntlid := binary.LittleEndian.Uint16(data[16:18])
+	subNQN := cstring(data[256:512])
+	hostNQN := cstring(data[512:768])
+
+	var ctrl *controller
+	if qid == 0 {
+		var sub *Subsystem
+		if subNQN != DiscoveryNQN {
+			sub = q.srv.subsystems[subNQN]
+			if sub == nil {
+				return invalidConnectParam(true, 256)
+			}
+		}
+		ctrl = q.srv.newController(sub, hostNQN)
+		ctrl.kato = binary.LittleEndian.Uint32(cmd[48:52])
+	} else {
+		ctrl = q.srv.controller(cntlid)
+		if ctrl == nil || ctrl.hostNQN != hostNQN || ctrl.sub == nil || ctrl.sub.NQN != subNQN || !ctrl.enabled() {
+			return invalidConnectParam(true, 16)
+		}
+		ctrl.mu.Lock()
+		granted := ctrl.ioQueues
+		ctrl.mu.Unlock()
+		if int(qid) > granted {
+			return invalidConnectParam(false, 42)
+		}
+	}
+	q.ctrl = ctrl
+	q.qid = qid
+	q.size = uint16(sqsize)
+	q.noFlowControl = cattr&0x04 != 0
+	return completion{dw0: uint32(ctrl.id)}
+}
+
+// invalidConnectParam fails a Connect command, pointing at the invalid
+// parameter at offset off of the command, or of its data.
+func invalidConnectParam(inData bool, off uint16) completion {
+	dw0 := uint32(off) << 16
+	if inData {
+		dw0 |= 1
+	}
+	return completion{status: statusConnectInvalidParam, dw0: dw0}
+}
+
+func (q *queue) property(cmd command) completion {
+	off := binary.LittleEndian.Uint32(cmd[44:48])
+	ctrl := q.ctrl
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+
+	if cmd[4] == fctPropertySet {
+		if off != propCC {
+			return failed(statusInvalidField)
+		}
+		cc := binary.LittleEndian.Uint32(cmd[48:52])
+		switch {
+		case cc&ccShutdown != 0:
+			ctrl.csts = cstsShutdown
+		case cc&ccEnable != 0:
+			ctrl.csts = cstsReady
+		default:
+			ctrl.csts = 0
+		}
+		ctrl.cc = cc
+		return completion{}
+	}
+
+	var v uint64
+	switch off {
+	case propCAP:
+		v = capabilities()
+	case propVS:
+		v = version
+	case propCC:
+		v = uint64(ctrl.cc)
+	case propCSTS:
+		v = uint64(ctrl.csts)
+	default:
+		return failed(statusInvalidField)
+	}
+	return completion{dw0: uint32(v), dw1: uint32(v >> 32)}
+}
+
+// cstring returns the NUL terminated string at the start of b.
+func cstring(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
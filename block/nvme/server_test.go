@@ -0,0 +1,332 @@
+package nvme
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+type memDevice []byte
+
+func (m memDevice) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(b []byte, off int64) (int, error) {
+	return copy(m[off:], b), nil
+}
+
+func (m memDevice) Sync() error { return nil }
+
+func (m memDevice) Trim(off, length int64) error {
+	for i := off; i < off+length; i++ {
+		m[i] = 0
+	}
+	return nil
+}
+
+const testHostNQN = "nqn.2016-06.test:host"
+
+// host drives a queue from the other end of a pipe.
+type host struct {
+	t    *testing.T
+	conn net.Conn
+	cid  uint16
+}
+
+func newHost(t *testing.T, srv *Server) *host {
+	client, conn := net.Pipe()
+	go srv.ServeConn(conn)
+	h := &host{t: t, conn: client}
+	req := newPDU(pduICReq, icLength)
+	if err := req.write(client); err != nil {
+		t.Fatal(err)
+	}
+	resp := h.recv()
+	if resp.typ() != pduICResp || resp.u32(12) != maxH2CData {
+		t.Fatalf("bad ICResp: %v", resp.hdr)
+	}
+	return h
+}
+
+func (h *host) recv() *pdu {
+	p, err := readPDU(h.conn, 1<<20)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return p
+}
+
+func newCommand(opcode byte, nsid uint32, cdws ...uint32) command {
+	cmd := make(command, sqeLength)
+	cmd[0] = opcode
+	binary.LittleEndian.PutUint32(cmd[4:8], nsid)
+	for i, v := range cdws {
+		binary.LittleEndian.PutUint32(cmd[40+i*4:], v)
+	}
+	return cmd
+}
+
+// exec sends cmd with the data out, in the capsule if inCapsule, and
+// returns the response's status and dword 0, with the data read in.
+func (h *host) exec(cmd command, out []byte, inCapsule bool, in int) (status, uint32, []byte) {
+	h.cid++
+	binary.LittleEndian.PutUint16(cmd[2:4], h.cid)
+	p := newPDU(pduCapsuleCmd, cmdHeaderLen)
+	copy(p.hdr[8:], cmd)
+	n := in
+	if out != nil {
+		n = len(out)
+	}
+	binary.LittleEndian.PutUint32(p.hdr[8+32:], uint32(n))
+	p.hdr[8+39] = sglTransport
+	if inCapsule {
+		p.hdr[8+39] = sglInCapsule
+		p.data = out
+	}
+	if err := p.write(h.conn); err != nil {
+		h.t.Fatal(err)
+	}
+
+	var data []byte
+	for {
+		resp := h.recv()
+		switch resp.typ() {
+		case pduR2T:
+			off, length := int(resp.u32(12)), int(resp.u32(16))
+			for sent := 0; sent < length; sent += 4096 {
+				d := newPDU(pduH2CData, dataHeaderLen)
+				d.put16(8, resp.u16(8))
+				d.put16(10, resp.u16(10))
+				d.put32(12, uint32(off+sent))
+				d.put32(16, 4096)
+				if sent+4096 >= length {
+					d.hdr[1] = flagLastPDU
+				}
+				d.data = out[off+sent : off+sent+4096]
+				if err := d.write(h.conn); err != nil {
+					h.t.Fatal(err)
+				}
+			}
+		case pduC2HData:
+			if int(resp.u32(12)) != len(data) {
+				h.t.Fatalf("C2H data at offset %d, expected %d", resp.u32(12), len(data))
+			}
+			data = append(data, resp.data...)
+		case pduCapsuleResp:
+			cqe := resp.hdr[8:]
+			if cid := binary.LittleEndian.Uint16(cqe[12:14]); cid != h.cid {
+				h.t.Fatalf("response for command %d, expected %d", cid, h.cid)
+			}
+			s := status(binary.LittleEndian.Uint16(cqe[14:16]) >> 1 & 0x7ff)
+			return s, binary.LittleEndian.Uint32(cqe[0:4]), data
+		default:
+			h.t.Fatalf("unexpected PDU type %#x", resp.typ())
+		}
+	}
+}
+
+func (h *host) connect(qid uint16, nqn string, cntlid uint16) (status, uint32) {
+	cmd := newCommand(opFabrics, 0)
+	cmd[4] = fctConnect
+	binary.LittleEndian.PutUint16(cmd[42:44], qid)
+	binary.LittleEndian.PutUint16(cmd[44:46], 31)
+	data := make([]byte, 1024)
+	binary.LittleEndian.PutUint16(data[16:18], cntlid)
+	copy(data[256:], nqn)
+	copy(data[512:], testHostNQN)
+	s, dw0, _ := h.exec(cmd, data, true, 0)
+	return s, dw0
+}
+
+func (h *host) setProperty(off, v uint32) status {
+	cmd := newCommand(opFabrics, 0)
+	cmd[4] = fctPropertySet
+	binary.LittleEndian.PutUint32(cmd[44:48], off)
+	binary.LittleEndian.PutUint32(cmd[48:52], v)
+	s, _, _ := h.exec(cmd, nil, false, 0)
+	return s
+}
+
+func (h *host) getProperty(off uint32) uint32 {
+	cmd := newCommand(opFabrics, 0)
+	cmd[4] = fctPropertyGet
+	binary.LittleEndian.PutUint32(cmd[44:48], off)
+	s, dw0, _ := h.exec(cmd, nil, false, 0)
+	if s != statusSuccess {
+		h.t.Fatalf("property get failed with status %#x", s)
+	}
+	return dw0
+}
+
+func TestDiscovery(t *testing.T) {
+	srv, err := NewServer(
+		&Subsystem{NQN: "nqn.2016-06.test:a", Device: make(memDevice, 4096), Size: 4096},
+		&Subsystem{NQN: "nqn.2016-06.test:b", Device: make(memDevice, 4096), Size: 4096},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHost(t, srv)
+	defer h.conn.Close()
+	if s, _ := h.connect(0, DiscoveryNQN, 0xffff); s != statusSuccess {
+		t.Fatalf("discovery connect failed with status %#x", s)
+	}
+	s, _, log := h.exec(newCommand(adminGetLogPage, 0, logDiscovery|(3*1024/4-1)<<16), nil, false, 3*1024)
+	if s != statusSuccess {
+		t.Fatalf("get log page failed with status %#x", s)
+	}
+	if n := binary.LittleEndian.Uint64(log[8:16]); n != 2 {
+		t.Fatalf("discovered %d subsystems, expected 2", n)
+	}
+	for i, nqn := range []string{"nqn.2016-06.test:a", "nqn.2016-06.test:b"} {
+		e := log[1024*(i+1):]
+		if got := cstring(e[512:768]); got != nqn {
+			t.Fatalf("entry %d is for %q, expected %q", i, got, nqn)
+		}
+		if e[0] != 3 {
+			t.Fatalf("entry %d has transport type %d", i, e[0])
+		}
+	}
+}
+
+func TestConnectUnknownSubsystem(t *testing.T) {
+	srv, err := NewServer(&Subsystem{NQN: "nqn.2016-06.test:a", Device: make(memDevice, 4096), Size: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHost(t, srv)
+	defer h.conn.Close()
+	s, dw0 := h.connect(0, "nqn.2016-06.test:missing", 0xffff)
+	if s != statusConnectInvalidParam || dw0 != 256<<16|1 {
+		t.Fatalf("connect to a missing subsystem answered with status %#x, %#x", s, dw0)
+	}
+}
+
+func TestReadWriteDeallocate(t *testing.T) {
+	dev := make(memDevice, 1<<20)
+	const nqn = "nqn.2016-06.test:a"
+	srv, err := NewServer(&Subsystem{NQN: nqn, Device: dev, Size: int64(len(dev)), Serial: "a", PhysicalBlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newHost(t, srv)
+	defer admin.conn.Close()
+	s, dw0 := admin.connect(0, nqn, 0xffff)
+	if s != statusSuccess {
+		t.Fatalf("admin connect failed with status %#x", s)
+	}
+	cntlid := uint16(dw0)
+	if s := admin.setProperty(propCC, ccEnable); s != statusSuccess {
+		t.Fatalf("enabling the controller failed with status %#x", s)
+	}
+	if csts := admin.getProperty(propCSTS); csts&cstsReady == 0 {
+		t.Fatalf("controller isn't ready: CSTS %#x", csts)
+	}
+
+	s, _, id := admin.exec(newCommand(adminIdentify, 0, identifyCtrl), nil, false, 4096)
+	if s != statusSuccess {
+		t.Fatalf("identify controller failed with status %#x", s)
+	}
+	if got := binary.LittleEndian.Uint16(id[78:80]); got != cntlid {
+		t.Fatalf("controller ID %d, expected %d", got, cntlid)
+	}
+	if nn := binary.LittleEndian.Uint32(id[516:520]); nn != 1 {
+		t.Fatalf("%d namespaces, expected 1", nn)
+	}
+	s, _, id = admin.exec(newCommand(adminIdentify, 1, identifyNamespace), nil, false, 4096)
+	if s != statusSuccess {
+		t.Fatalf("identify namespace failed with status %#x", s)
+	}
+	if nsze := binary.LittleEndian.Uint64(id[0:8]); nsze != 2048 {
+		t.Fatalf("namespace has %d blocks, expected 2048", nsze)
+	}
+	if npwg := binary.LittleEndian.Uint16(id[64:66]); npwg != 7 {
+		t.Fatalf("preferred write granularity %d, expected 7", npwg)
+	}
+	if s, dw0, _ := admin.exec(newCommand(adminSetFeatures, 0, featureNumQueues, 3|3<<16), nil, false, 0); s != statusSuccess || dw0 != 3|3<<16 {
+		t.Fatalf("set number of queues answered with status %#x, %#x", s, dw0)
+	}
+
+	ioq := newHost(t, srv)
+	defer ioq.conn.Close()
+	if s, _ := ioq.connect(1, nqn, cntlid+1); s != statusConnectInvalidParam {
+		t.Fatalf("IO connect to a missing controller answered with status %#x", s)
+	}
+	ioq.conn.Close()
+	ioq = newHost(t, srv)
+	if s, _ := ioq.connect(1, nqn, cntlid); s != statusSuccess {
+		t.Fatalf("IO connect failed with status %#x", s)
+	}
+
+	// A 4KiB write in the capsule, at LBA 8.
+	small := bytes.Repeat([]byte("nvme"), 1024)
+	if s, _, _ := ioq.exec(newCommand(ioWrite, 1, 8, 0, 7), small, true, 0); s != statusSuccess {
+		t.Fatalf("in-capsule write failed with status %#x", s)
+	}
+	// A 16KiB write at LBA 16, solicited with an R2T.
+	payload := bytes.Repeat([]byte("torus!!!"), 2048)
+	if s, _, _ := ioq.exec(newCommand(ioWrite, 1, 16, 0, 31|1<<30), payload, false, 0); s != statusSuccess {
+		t.Fatalf("write failed with status %#x", s)
+	}
+	if !bytes.Equal(dev[8*512:16*512], small) || !bytes.Equal(dev[16*512:48*512], payload) {
+		t.Fatal("writes didn't reach the device")
+	}
+
+	s, _, data := ioq.exec(newCommand(ioRead, 1, 16, 0, 31), nil, false, len(payload))
+	if s != statusSuccess {
+		t.Fatalf("read failed with status %#x", s)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatal("read back different data")
+	}
+
+	if s, _, _ := ioq.exec(newCommand(ioRead, 1, 2047, 0, 1), nil, false, 1024); s != statusLBAOutOfRange {
+		t.Fatalf("read past the end answered with status %#x", s)
+	}
+
+	// Deallocate the first 8 blocks written.
+	ranges := make([]byte, 16)
+	binary.LittleEndian.PutUint32(ranges[4:8], 8)
+	binary.LittleEndian.PutUint64(ranges[8:16], 16)
+	if s, _, _ := ioq.exec(newCommand(ioDSM, 1, 0, 0x4), ranges, true, 0); s != statusSuccess {
+		t.Fatalf("deallocate failed with status %#x", s)
+	}
+	if !bytes.Equal(dev[16*512:24*512], make([]byte, 8*512)) {
+		t.Fatal("deallocated blocks weren't trimmed")
+	}
+	if !bytes.Equal(dev[24*512:48*512], payload[8*512:]) {
+		t.Fatal("deallocate trimmed too much")
+	}
+
+	if s, _, _ := ioq.exec(newCommand(ioRead, 2, 0, 0, 0), nil, false, 512); s != statusInvalidNamespace {
+		t.Fatalf("read from namespace 2 answered with status %#x", s)
+	}
+	if s, _, _ := ioq.exec(newCommand(0x7e, 1), nil, false, 0); s != statusInvalidOpcode {
+		t.Fatalf("unknown command answered with status %#x", s)
+	}
+}
+
+func TestReadOnlySubsystem(t *testing.T) {
+	const nqn = "nqn.2016-06.test:a"
+	srv, err := NewServer(&Subsystem{NQN: nqn, Device: make(memDevice, 4096), Size: 4096, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := newHost(t, srv)
+	defer admin.conn.Close()
+	_, dw0 := admin.connect(0, nqn, 0xffff)
+	admin.setProperty(propCC, ccEnable)
+	admin.exec(newCommand(adminSetFeatures, 0, featureNumQueues, 0), nil, false, 0)
+
+	ioq := newHost(t, srv)
+	defer ioq.conn.Close()
+	if s, _ := ioq.connect(1, nqn, uint16(dw0)); s != statusSuccess {
+		t.Fatalf("IO connect failed with status %#x", s)
+	}
+	if s, _, _ := ioq.exec(newCommand(ioWrite, 1, 0, 0, 0), make([]byte, 512), true, 0); s != statusWriteProtected {
+		t.Fatalf("write to a read-only namespace answered with status %#x", s)
+	}
+}
@@ -0,0 +1,37 @@
+package nvme
+
+// status is a completion's status code type, in the high byte, and status
+// code.
+type status uint16
+
+const (
+	statusSuccess          status = 0x000
+	statusInvalidOpcode    status = 0x001
+	statusInvalidField     status = 0x002
+	statusInternal         status = 0x006
+	statusInvalidNamespace status = 0x00b
+	statusCommandSequence  status = 0x00c
+	statusSGLLengthInvalid status = 0x00f
+	statusSGLTypeInvalid   status = 0x011
+	statusWriteProtected   status = 0x020
+	statusLBAOutOfRange    status = 0x080
+
+	statusInvalidLogPage            status = 0x109
+	statusFeatureNotSaveable        status = 0x10d
+	statusConnectIncompatibleFormat status = 0x180
+	statusConnectInvalidParam       status = 0x182
+
+	statusWriteFault      status = 0x280
+	statusUnrecoveredRead status = 0x281
+)
+
+// field returns the status field of a completion queue entry, with the
+// phase tag clear. Commands that failed for anything but a media error
+// aren't worth retrying.
+func (s status) field() uint16 {
+	v := uint16(s&0xff)<<1 | uint16(s>>8&0x7)<<9
+	if s != statusSuccess && s>>8 != 0x2 && s != statusInternal {
+		v |= 1 << 15
+	}
+	return v
+}
@@ -0,0 +1,502 @@
+package block
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// Objects, as served by the S3 gateway, are named by a key in a bucket. The
+// data of each object is kept in block volumes, one per part, named after
+// the bucket and labelled with it; the index of buckets, objects and
+// multipart uploads is kept in the cluster metadata and, like checkpoints,
+// isn't tied to any one volume.
+
+// objectBucketLabel labels the volumes holding objects with their bucket.
+const objectBucketLabel = "object-bucket"
+
+var (
+	// ErrBucketNotEmpty is returned when deleting a bucket which still holds
+	// objects or uploads.
+	ErrBucketNotEmpty = errors.New("block: bucket is not empty")
+	// ErrInvalidPart is returned when completing an upload with a part which
+	// wasn't uploaded, or whose ETag doesn't match.
+	ErrInvalidPart = errors.New("block: upload part is missing or has a different ETag")
+	// ErrInvalidPartOrder is returned when completing an upload with parts
+	// out of order.
+	ErrInvalidPartOrder = errors.New("block: upload parts are not in ascending order")
+)
+
+// Bucket names follow the rules S3 has for new buckets, which also keeps
+// them usable as label values and in volume names.
+var bucketRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// MaxPartNumber is the highest part number of a multipart upload.
+const MaxPartNumber = 10000
+
+type Bucket struct {
+	Name    string
+	Created time.Time
+}
+
+// ObjectPart is a piece of an object's data, stored in a volume of its own.
+type ObjectPart struct {
+	// Number is the part's number in the upload it came from, if any.
+	Number int `json:",omitempty"`
+	// Volume holds the data. Empty parts have none.
+	Volume string `json:",omitempty"`
+	Size   int64
+	// ETag is the hex MD5 of the data.
+	ETag string
+}
+
+type Object struct {
+	Bucket      string
+	Key         string
+	Size        int64
+	ETag        string
+	ContentType string `json:",omitempty"`
+	Modified    time.Time
+	// Parts are the object's data, in order.
+	Parts []ObjectPart
+}
+
+// Upload is a multipart upload in progress.
+type Upload struct {
+	Bucket      string
+	Key         string
+	ID          string
+	ContentType string `json:",omitempty"`
+	Initiated   time.Time
+	// Parts are those uploaded so far, by number.
+	Parts []ObjectPart
+}
+
+// ValidateBucketName checks that name is 3 to 63 lower case letters, digits,
+// '.' or '-', starting and ending with a letter or digit.
+func ValidateBucketName(name string) error {
+	if !bucketRegexp.MatchString(name) {
+		return fmt.Errorf("invalid bucket name %q", name)
+	}
+	return nil
+}
+
+// CreateBucket creates an empty bucket. It fails with torus.ErrExists if the
+// bucket already exists.
+func CreateBucket(mds torus.MetadataService, name string) error {
+	if err := ValidateBucketName(name); err != nil {
+		return err
+	}
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return err
+	}
+	return bmds.CreateBucket(Bucket{Name: name, Created: time.Now()})
+}
+
+// GetBucket returns the named bucket, or torus.ErrNotExist.
+func GetBucket(mds torus.MetadataService, name string) (*Bucket, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetBucket(name)
+}
+
+// GetBuckets returns every bucket, by name.
+func GetBuckets(mds torus.MetadataService) ([]Bucket, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	out, err := bmds.GetBuckets()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(bucketsByName(out))
+	return out, nil
+}
+
+// DeleteBucket deletes an empty bucket. It fails with ErrBucketNotEmpty if
+// the bucket holds objects or unfinished uploads.
+func DeleteBucket(mds torus.MetadataService, name string) error {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return err
+	}
+	return bmds.DeleteBucket(name)
+}
+
+// GetObject returns the object at key in bucket, or torus.ErrNotExist.
+func GetObject(mds torus.MetadataService, bucket, key string) (*Object, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetObject(bucket, key)
+}
+
+// ListObjects returns up to max objects in bucket whose keys start with
+// prefix and sort after after, in key order. A max of 0 returns them all.
+func ListObjects(mds torus.MetadataService, bucket, prefix, after string, max int) ([]Object, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.ListObjects(bucket, prefix, after, max)
+}
+
+// PutObject stores size bytes read from r as the object at key in bucket,
+// replacing any object already there once they're all written.
+func PutObject(srv *torus.Server, bucket, key, contentType string, r io.Reader, size int64) (*Object, error) {
+	bmds, err := createBlockMetadata(srv.MDS, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bmds.GetBucket(bucket); err != nil {
+		return nil, err
+	}
+	part, err := writeObjectPart(srv, bucket, r, size)
+	if err != nil {
+		return nil, err
+	}
+	o := &Object{
+		Bucket:      bucket,
+		Key:         key,
+		Size:        size,
+		ETag:        part.ETag,
+		ContentType: contentType,
+		Modified:    time.Now(),
+		Parts:       []ObjectPart{*part},
+	}
+	old, err := bmds.PutObject(o)
+	if err != nil {
+		deleteObjectParts(srv, []ObjectPart{*part})
+		return nil, err
+	}
+	if old != nil {
+		deleteObjectParts(srv, old.Parts)
+	}
+	return o, nil
+}
+
+// DeleteObject deletes the object at key in bucket and its data.
+func DeleteObject(srv *torus.Server, bucket, key string) error {
+	bmds, err := createBlockMetadata(srv.MDS, "", 0)
+	if err != nil {
+		return err
+	}
+	o, err := bmds.DeleteObject(bucket, key)
+	if err != nil {
+		return err
+	}
+	deleteObjectParts(srv, o.Parts)
+	return nil
+}
+
+// CreateUpload starts a multipart upload of the object at key in bucket.
+func CreateUpload(mds torus.MetadataService, bucket, key, contentType string) (*Upload, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomObjectID()
+	if err != nil {
+		return nil, err
+	}
+	u := &Upload{
+		Bucket:      bucket,
+		Key:         key,
+		ID:          id,
+		ContentType: contentType,
+		Initiated:   time.Now(),
+	}
+	if err := bmds.CreateUpload(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetUpload returns the upload with the given ID in bucket, or
+// torus.ErrNotExist.
+func GetUpload(mds torus.MetadataService, bucket, id string) (*Upload, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetUpload(bucket, id)
+}
+
+// PutUploadPart stores size bytes read from r as part number n of an upload,
+// replacing any part uploaded with that number before.
+func PutUploadPart(srv *torus.Server, bucket, id string, n int, r io.Reader, size int64) (*ObjectPart, error) {
+	if n < 1 || n > MaxPartNumber {
+		return nil, fmt.Errorf("part numbers must be between 1 and %d", MaxPartNumber)
+	}
+	bmds, err := createBlockMetadata(srv.MDS, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bmds.GetUpload(bucket, id); err != nil {
+		return nil, err
+	}
+	part, err := writeObjectPart(srv, bucket, r, size)
+	if err != nil {
+		return nil, err
+	}
+	part.Number = n
+	var replaced []ObjectPart
+	_, err = bmds.UpdateUpload(bucket, id, func(u *Upload) error {
+		replaced = nil
+		i := sort.Search(len(u.Parts), func(i int) bool { return u.Parts[i].Number >= n })
+		switch {
+		case i < len(u.Parts) && u.Parts[i].Number == n:
+			replaced = append(replaced, u.Parts[i])
+			u.Parts[i] = *part
+		default:
+			u.Parts = append(u.Parts, ObjectPart{})
+			copy(u.Parts[i+1:], u.Parts[i:])
+			u.Parts[i] = *part
+		}
+		return nil
+	})
+	if err != nil {
+		deleteObjectParts(srv, []ObjectPart{*part})
+		return nil, err
+	}
+	deleteObjectParts(srv, replaced)
+	return part, nil
+}
+
+// CompleteUpload finishes an upload, storing the parts given, which must be
+// in ascending order and match the numbers and ETags of parts uploaded, as
+// the object. Parts uploaded but not given are deleted. The data isn't
+// copied; the object keeps the volumes the parts were uploaded to.
+func CompleteUpload(srv *torus.Server, bucket, id string, parts []ObjectPart) (*Object, error) {
+	bmds, err := createBlockMetadata(srv.MDS, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, ErrInvalidPart
+	}
+	var o *Object
+	var unused []ObjectPart
+	old, err := bmds.CompleteUpload(bucket, id, func(u *Upload) (*Object, error) {
+		o = &Object{
+			Bucket:      u.Bucket,
+			Key:         u.Key,
+			ContentType: u.ContentType,
+			Modified:    time.Now(),
+		}
+		uploaded := make(map[int]ObjectPart)
+		for _, p := range u.Parts {
+			uploaded[p.Number] = p
+		}
+		sums := md5.New()
+		for i, want := range parts {
+			if i > 0 && want.Number <= parts[i-1].Number {
+				return nil, ErrInvalidPartOrder
+			}
+			p, ok := uploaded[want.Number]
+			if !ok || p.ETag != want.ETag {
+				return nil, ErrInvalidPart
+			}
+			delete(uploaded, want.Number)
+			sum, err := hex.DecodeString(p.ETag)
+			if err != nil {
+				return nil, err
+			}
+			sums.Write(sum)
+			o.Parts = append(o.Parts, p)
+			o.Size += p.Size
+		}
+		// The ETag of an object uploaded in parts is the MD5 of their
+		// MD5s, followed by how many there are, as S3 has it.
+		o.ETag = fmt.Sprintf("%x-%d", sums.Sum(nil), len(parts))
+		unused = unused[:0]
+		for _, p := range uploaded {
+			unused = append(unused, p)
+		}
+		return o, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	deleteObjectParts(srv, unused)
+	if old != nil {
+		deleteObjectParts(srv, old.Parts)
+	}
+	return o, nil
+}
+
+// AbortUpload cancels an upload and deletes the parts uploaded.
+func AbortUpload(srv *torus.Server, bucket, id string) error {
+	bmds, err := createBlockMetadata(srv.MDS, "", 0)
+	if err != nil {
+		return err
+	}
+	u, err := bmds.DeleteUpload(bucket, id)
+	if err != nil {
+		return err
+	}
+	deleteObjectParts(srv, u.Parts)
+	return nil
+}
+
+// ObjectReader reads the data of an object, as it was when it was opened.
+type ObjectReader struct {
+	files []*BlockFile
+	parts []ObjectPart
+	size  int64
+}
+
+// OpenObject opens the data of o for reading.
+func OpenObject(srv *torus.Server, o *Object) (*ObjectReader, error) {
+	r := &ObjectReader{parts: o.Parts, size: o.Size}
+	for _, p := range o.Parts {
+		var f *BlockFile
+		if p.Volume != "" {
+			vol, err := OpenBlockVolume(srv, p.Volume)
+			if err == nil {
+				f, err = vol.OpenReadOnlyBlockFile()
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		r.files = append(r.files, f)
+	}
+	return r, nil
+}
+
+func (r *ObjectReader) Size() int64 { return r.size }
+
+func (r *ObjectReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, torus.ErrInvalid
+	}
+	n := 0
+	start := int64(0)
+	for i, p := range r.parts {
+		if len(b) == 0 {
+			break
+		}
+		end := start + p.Size
+		if off < end {
+			want := b
+			if int64(len(want)) > end-off {
+				want = want[:end-off]
+			}
+			c, err := r.files[i].ReadAt(want, off-start)
+			n += c
+			off += int64(c)
+			b = b[c:]
+			if err != nil && !(err == io.EOF && c == len(want)) {
+				return n, err
+			}
+		}
+		start = end
+	}
+	if len(b) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *ObjectReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// writeObjectPart stores size bytes read from r in a new volume.
+func writeObjectPart(srv *torus.Server, bucket string, r io.Reader, size int64) (*ObjectPart, error) {
+	h := md5.New()
+	if size == 0 {
+		return &ObjectPart{ETag: hex.EncodeToString(h.Sum(nil))}, nil
+	}
+	id, err := randomObjectID()
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("object-%s-%s", bucket, id)
+	err = CreateBlockVolumeWithOptions(srv.MDS, name, uint64(size), VolumeOptions{
+		Labels: map[string]string{objectBucketLabel: bucket},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part := &ObjectPart{Volume: name, Size: size}
+	if err := writeObjectVolume(srv, name, io.TeeReader(r, h), size); err != nil {
+		deleteObjectParts(srv, []ObjectPart{*part})
+		return nil, err
+	}
+	part.ETag = hex.EncodeToString(h.Sum(nil))
+	return part, nil
+}
+
+func writeObjectVolume(srv *torus.Server, name string, r io.Reader, size int64) error {
+	vol, err := OpenBlockVolume(srv, name)
+	if err != nil {
+		return err
+	}
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		return err
+	}
+	// Unlike io.CopyN, this fails with an error reading the last of the
+	// data, such as a checksum mismatch.
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// deleteObjectParts deletes the volumes of parts no longer in use. Failures
+// are only logged; the volumes are labelled with their bucket, and can be
+// found and deleted by hand.
+func deleteObjectParts(srv *torus.Server, parts []ObjectPart) {
+	for _, p := range parts {
+		if p.Volume == "" {
+			continue
+		}
+		if err := DeleteBlockVolume(srv.MDS, p.Volume); err != nil {
+			clog.Errorf("couldn't delete object volume %s: %v", p.Volume, err)
+		}
+	}
+}
+
+func randomObjectID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type bucketsByName []Bucket
+
+func (b bucketsByName) Len() int           { return len(b) }
+func (b bucketsByName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bucketsByName) Less(i, j int) bool { return b[i].Name < b[j].Name }
@@ -0,0 +1,71 @@
+package block
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate tokens a second, with up to a second's worth saved
+// up for bursts. Tokens may be borrowed against the future, so a request
+// bigger than the burst still goes through, and whoever asks next waits for
+// the debt to be repaid.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens and returns how long to wait before using them.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttle holds IO to a volume to its tuning's IOPS and Bandwidth limits.
+type throttle struct {
+	mut   sync.Mutex
+	ops   tokenBucket
+	bytes tokenBucket
+}
+
+// set changes the limits. Zero lifts either.
+func (t *throttle) set(iops, bandwidth uint64) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	now := time.Now()
+	for _, x := range []struct {
+		b    *tokenBucket
+		rate uint64
+	}{{&t.ops, iops}, {&t.bytes, bandwidth}} {
+		if float64(x.rate) == x.b.rate {
+			continue
+		}
+		// Start full, so that a new limit doesn't stall IO in flight.
+		*x.b = tokenBucket{rate: float64(x.rate), tokens: float64(x.rate), last: now}
+	}
+}
+
+// wait blocks until an operation on n bytes is allowed.
+func (t *throttle) wait(n int) {
+	t.mut.Lock()
+	now := time.Now()
+	d := t.ops.take(1, now)
+	if bd := t.bytes.take(float64(n), now); bd > d {
+		d = bd
+	}
+	t.mut.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,128 @@
+package block
+
+import (
+	"net"
+
+	"github.com/coreos/torus"
+)
+
+// A volume's reservation names the AoE initiators which have claimed it for
+// their exclusive use; while any do, others are refused. It is kept in the
+// cluster metadata and changed atomically, so two hosts exporting the volume
+// can't hand it to different initiators.
+
+// GetReservation returns the initiators holding the named volume's
+// reservation.
+func GetReservation(mds torus.MetadataService, volume string) ([]net.HardwareAddr, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	strs, err := bmds.GetReservation()
+	if err != nil {
+		return nil, err
+	}
+	return parseMACs(strs)
+}
+
+// BreakReservation releases the named volume's reservation, whoever holds
+// it.
+func BreakReservation(mds torus.MetadataService, volume string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	_, err = bmds.UpdateReservation(func([]string) ([]string, error) {
+		return nil, nil
+	})
+	return err
+}
+
+// Reservation returns the initiators holding the volume's reservation.
+func (s *BlockVolume) Reservation() ([]net.HardwareAddr, error) {
+	strs, err := s.mds.GetReservation()
+	if err != nil {
+		return nil, err
+	}
+	return parseMACs(strs)
+}
+
+// UpdateReservation atomically replaces the volume's reservation with what
+// fn returns for the current one. If fn fails, the reservation is left as it
+// is, and returned with fn's error.
+func (s *BlockVolume) UpdateReservation(fn func(cur []net.HardwareAddr) ([]net.HardwareAddr, error)) ([]net.HardwareAddr, error) {
+	var out []net.HardwareAddr
+	_, err := s.mds.UpdateReservation(func(strs []string) ([]string, error) {
+		cur, err := parseMACs(strs)
+		if err != nil {
+			return nil, err
+		}
+		next, err := fn(cur)
+		if err != nil {
+			out = cur
+			return nil, err
+		}
+		out = next
+		return formatMACs(next), nil
+	})
+	return out, err
+}
+
+func parseMACs(strs []string) ([]net.HardwareAddr, error) {
+	var out []net.HardwareAddr
+	for _, str := range strs {
+		addr, err := net.ParseMAC(str)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, addr)
+	}
+	return out, nil
+}
+
+func formatMACs(addrs []net.HardwareAddr) []string {
+	var out []string
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+// A volume also holds the SCSI persistent reservations of the initiators
+// sharing it, encoded by the scsi package, which every gateway enforces.
+
+// GetPersistentReservations returns the named volume's encoded persistent
+// reservations, or nil if there are none.
+func GetPersistentReservations(mds torus.MetadataService, volume string) ([]byte, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetPersistentReservations()
+}
+
+// ClearPersistentReservations drops the named volume's persistent
+// reservations and every registration, whoever made them.
+func ClearPersistentReservations(mds torus.MetadataService, volume string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	_, err = bmds.UpdatePersistentReservations(func([]byte) ([]byte, error) {
+		return nil, nil
+	})
+	return err
+}
+
+// PersistentReservations returns the volume's encoded persistent
+// reservations, or nil if there are none.
+func (s *BlockVolume) PersistentReservations() ([]byte, error) {
+	return s.mds.GetPersistentReservations()
+}
+
+// UpdatePersistentReservations atomically replaces the volume's persistent
+// reservations with what fn returns for the current ones. If fn fails,
+// they're left as they are, and returned with fn's error.
+func (s *BlockVolume) UpdatePersistentReservations(fn func(cur []byte) ([]byte, error)) ([]byte, error) {
+	return s.mds.UpdatePersistentReservations(fn)
+}
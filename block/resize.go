@@ -0,0 +1,160 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coreos/torus"
+)
+
+// ErrShrinkData is returned when shrinking a block volume would discard data
+// written past its new end.
+var ErrShrinkData = errors.New("block: volume has data past the new size")
+
+// GrowBlockVolume raises the size of a block volume to size bytes. The new
+// space reads as zeroes. A volume which is attached is grown by the host
+// attaching it, which picks the new size up within a few seconds; the size it
+// reports to the kernel or initiator follows, and the guest sees it once it
+// rescans the device.
+func GrowBlockVolume(srv *torus.Server, volume string, size uint64) error {
+	bv, err := OpenBlockVolume(srv, volume)
+	if err != nil {
+		return err
+	}
+	if bv.volume.Type != VolumeType {
+		return torus.ErrWrongVolumeType
+	}
+	_, err = bv.mds.UpdateVolumeSize(func(cur uint64) (uint64, error) {
+		if size < cur {
+			return cur, fmt.Errorf("volume is %d bytes, which is larger than %d", cur, size)
+		}
+		return size, nil
+	})
+	if err != nil {
+		return err
+	}
+	// Extend the volume's data now if it isn't attached. If it is, or is
+	// attached before we get to it, its host does so instead.
+	f, err := bv.OpenBlockFile()
+	if err == torus.ErrLocked {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// RefreshSize extends f to its volume's recorded size, if the volume has been
+// grown since f was opened, and returns f's size. Read-only files, including
+// snapshots, keep their size. The extension is stored with the next Sync.
+func (f *BlockFile) RefreshSize() (uint64, error) {
+	if f.IsReadOnly() {
+		return f.Size(), nil
+	}
+	if f.shared != nil {
+		return f.refreshSharedSize()
+	}
+	size, err := f.vol.mds.GetVolumeSize()
+	if err != nil {
+		return f.Size(), err
+	}
+	if size <= f.Size() {
+		return f.Size(), nil
+	}
+	if err := f.Grow(int64(size)); err != nil {
+		return f.Size(), err
+	}
+	clog.Infof("volume %s grew to %d bytes", f.vol.volume.Name, size)
+	return size, nil
+}
+
+// ShrinkBlockVolume reduces the size of a block volume to size bytes, and
+// returns how many allocated blocks were dropped from it. Those are
+// collected by the cluster's garbage collection once no snapshot refers to
+// them. The volume must be detached. If any data has been written past the
+// new end, ErrShrinkData is returned unless force is set, in which case the
+// data is discarded.
+func ShrinkBlockVolume(srv *torus.Server, volume string, size uint64, force bool) (int, error) {
+	if size == 0 {
+		return 0, errors.New("a volume can't be shrunk to nothing")
+	}
+	bv, err := OpenBlockVolume(srv, volume)
+	if err != nil {
+		return 0, err
+	}
+	if bv.volume.Type != VolumeType {
+		return 0, torus.ErrWrongVolumeType
+	}
+	f, err := bv.OpenBlockFile()
+	if err != nil {
+		return 0, err
+	}
+	old := f.Size()
+	if size > old {
+		f.Close()
+		return 0, fmt.Errorf("volume is %d bytes, which is smaller than %d", old, size)
+	}
+	gmd, err := bv.mds.GlobalMetadata()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	dropped, written, err := f.tail(size, gmd.BlockSize)
+	if err == nil && written && !force {
+		err = ErrShrinkData
+	}
+	if err == nil {
+		err = f.Truncate(int64(size))
+	}
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	// Store the truncated volume before recording the new size, so that
+	// a failure in between leaves the volume its old size, with the tail
+	// reading as zeroes.
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	_, err = bv.mds.UpdateVolumeSize(func(cur uint64) (uint64, error) {
+		if cur != old {
+			return cur, fmt.Errorf("volume was resized to %d bytes while being shrunk", cur)
+		}
+		return size, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	clog.Infof("volume %s shrunk from %d to %d bytes, dropping %d blocks", volume, old, size, dropped)
+	return dropped, nil
+}
+
+// tail reports on the part of f past size: how many allocated blocks lie
+// wholly beyond it, and whether anything past it has been written. Blocks
+// which were written with zeroes count as written.
+func (f *BlockFile) tail(size, blockSize uint64) (blocks int, written bool, err error) {
+	first := int(size / blockSize)
+	// Some layers list more refs than blocks, after the blocks' own.
+	refs := f.Blocks().GetAllBlockRefs()[:f.Blocks().Length()]
+	for i := first; i < len(refs); i++ {
+		if refs[i].IsZero() {
+			continue
+		}
+		if i == first && size%blockSize != 0 {
+			// The block straddling size is kept, so only its data
+			// after size matters.
+			data, err := f.Blocks().GetBlock(f.vol.getContext(), i)
+			if err != nil {
+				return 0, false, err
+			}
+			if !isZeroes(data[size%blockSize:]) {
+				written = true
+			}
+			continue
+		}
+		blocks++
+		written = true
+	}
+	return blocks, written, nil
+}
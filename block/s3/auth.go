@@ -0,0 +1,322 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests are authenticated with AWS Signature Version 4.
+const (
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+	// maxSkew is how far the time a request was signed may be from ours.
+	maxSkew = 15 * time.Minute
+	// maxExpires is the longest a presigned URL may be valid for.
+	maxExpires = 7 * 24 * time.Hour
+)
+
+// now is the time requests are checked against.
+var now = time.Now
+
+var (
+	errAccessDenied          = errorf(http.StatusForbidden, "AccessDenied", "Access Denied")
+	errInvalidAccessKeyID    = errorf(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.")
+	errSignatureMismatch     = errorf(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	errTimeSkewed            = errorf(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.")
+	errExpired               = errorf(http.StatusForbidden, "AccessDenied", "Request has expired")
+	errAuthorizationHeader   = errorf(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed.")
+	errAuthorizationQuery    = errorf(http.StatusBadRequest, "AuthorizationQueryParametersError", "Error parsing the X-Amz-Credential parameter.")
+	errContentSHA256Mismatch = errorf(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+)
+
+// signature is what a request was signed with.
+type signature struct {
+	accessKey string
+	// scope is the credential scope, DATE/REGION/SERVICE/aws4_request.
+	scope         string
+	date          time.Time
+	signedHeaders []string
+	payloadHash   string
+	signature     string
+}
+
+// authenticate checks the request's signature, returning its body, which
+// checks the payload hash signed if there is one as it's read.
+func (h *Handler) authenticate(r *http.Request) (io.ReadCloser, error) {
+	if len(h.keys) == 0 {
+		return r.Body, nil
+	}
+	var sig *signature
+	var err error
+	query := r.URL.Query()
+	switch {
+	case strings.HasPrefix(r.Header.Get("Authorization"), signAlgorithm+" "):
+		sig, err = parseAuthorization(r)
+	case query.Get("X-Amz-Algorithm") == signAlgorithm:
+		sig, err = parsePresigned(query)
+	default:
+		return nil, errAccessDenied
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := h.keys[sig.accessKey]
+	if !ok {
+		return nil, errInvalidAccessKeyID
+	}
+	want := sig.sign(secret, canonicalRequest(r, sig))
+	if !hmac.Equal([]byte(want), []byte(sig.signature)) {
+		return nil, errSignatureMismatch
+	}
+	if sig.payloadHash == unsignedPayload {
+		return r.Body, nil
+	}
+	sum, err := hex.DecodeString(sig.payloadHash)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errContentSHA256Mismatch
+	}
+	return &hashedBody{
+		ReadCloser: r.Body,
+		hash:       sha256.New(),
+		want:       sum,
+		left:       r.ContentLength,
+	}, nil
+}
+
+// parseCredential parses the access key ID and scope of a signature.
+func parseCredential(sig *signature, cred string) bool {
+	parts := strings.SplitN(cred, "/", 2)
+	if len(parts) != 2 || strings.Count(parts[1], "/") != 3 || !strings.HasSuffix(parts[1], "/aws4_request") {
+		return false
+	}
+	sig.accessKey, sig.scope = parts[0], parts[1]
+	return true
+}
+
+func parseAuthorization(r *http.Request) (*signature, error) {
+	sig := &signature{}
+	fields := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), signAlgorithm+" "), ",")
+	for _, f := range fields {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, errAuthorizationHeader
+		}
+		switch kv[0] {
+		case "Credential":
+			if !parseCredential(sig, kv[1]) {
+				return nil, errAuthorizationHeader
+			}
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			sig.signature = kv[1]
+		}
+	}
+	if sig.accessKey == "" || sig.signedHeaders == nil || sig.signature == "" {
+		return nil, errAuthorizationHeader
+	}
+
+	var err error
+	if d := r.Header.Get("X-Amz-Date"); d != "" {
+		sig.date, err = time.Parse(amzDateFormat, d)
+	} else {
+		sig.date, err = http.ParseTime(r.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, errAccessDenied
+	}
+	if skew := now().Sub(sig.date); skew > maxSkew || skew < -maxSkew {
+		return nil, errTimeSkewed
+	}
+
+	sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case sig.payloadHash == "":
+		return nil, errorf(http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+	case strings.HasPrefix(sig.payloadHash, "STREAMING-"):
+		// Payloads signed chunk by chunk.
+		return nil, errNotImplemented
+	}
+	return sig, nil
+}
+
+func parsePresigned(q url.Values) (*signature, error) {
+	sig := &signature{
+		signedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     q.Get("X-Amz-Signature"),
+		payloadHash:   unsignedPayload,
+	}
+	if !parseCredential(sig, q.Get("X-Amz-Credential")) || sig.signature == "" {
+		return nil, errAuthorizationQuery
+	}
+	var err error
+	sig.date, err = time.Parse(amzDateFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationQuery
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxExpires {
+		return nil, errAuthorizationQuery
+	}
+	if t := now(); t.Before(sig.date.Add(-maxSkew)) {
+		return nil, errTimeSkewed
+	} else if t.After(sig.date.Add(time.Duration(expires) * time.Second)) {
+		return nil, errExpired
+	}
+	return sig, nil
+}
+
+// canonicalRequest returns the canonical form of r which is signed.
+func canonicalRequest(r *http.Request, sig *signature) string {
+	var b bytes.Buffer
+	b.WriteString(r.Method + "\n")
+	b.WriteString(uriEncode(r.URL.Path, false) + "\n")
+
+	var params [][2]string
+	for _, p := range strings.Split(r.URL.RawQuery, "&") {
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		k, _ := url.QueryUnescape(kv[0])
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		v := ""
+		if len(kv) == 2 {
+			v, _ = url.QueryUnescape(kv[1])
+		}
+		params = append(params, [2]string{uriEncode(k, true), uriEncode(v, true)})
+	}
+	// Sorted by name, then value.
+	sort.Sort(paramsByName(params))
+	for i, p := range params {
+		if i > 0 {
+			b.WriteString("&")
+		}
+		b.WriteString(p[0] + "=" + p[1])
+	}
+	b.WriteString("\n")
+
+	for _, name := range sig.signedHeaders {
+		var v string
+		switch name {
+		case "host":
+			v = r.Host
+		case "content-length":
+			v = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			v = strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(v), " ") + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.Join(sig.signedHeaders, ";") + "\n")
+	b.WriteString(sig.payloadHash)
+	return b.String()
+}
+
+type paramsByName [][2]string
+
+func (p paramsByName) Len() int      { return len(p) }
+func (p paramsByName) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p paramsByName) Less(i, j int) bool {
+	if p[i][0] != p[j][0] {
+		return p[i][0] < p[j][0]
+	}
+	return p[i][1] < p[j][1]
+}
+
+// sign returns the signature of a canonical request with secret.
+func (sig *signature) sign(secret, request string) string {
+	sum := sha256.Sum256([]byte(request))
+	toSign := strings.Join([]string{
+		signAlgorithm,
+		sig.date.UTC().Format(amzDateFormat),
+		sig.scope,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(sig.scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// uriEncode escapes every byte of s but the unreserved characters, and '/'
+// unless encodeSlash is set, as signatures require.
+func uriEncode(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hashedBody is a request body which fails, once it has been read, if it
+// doesn't have the SHA256 sum signed.
+type hashedBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	want []byte
+	// left is how much of the body is still to be read, or -1 if that's
+	// unknown.
+	left int64
+}
+
+func (b *hashedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if b.left >= 0 {
+		b.left -= int64(n)
+	}
+	if (b.left == 0 || err == io.EOF) && !hmac.Equal(b.hash.Sum(nil), b.want) {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// ReadCredentials reads access keys, one "ACCESS_KEY_ID SECRET_ACCESS_KEY"
+// pair per line. Blank lines and lines starting with '#' are skipped.
+func ReadCredentials(r io.Reader) (map[string]string, error) {
+	keys := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("s3: credentials line %d isn't an access key ID and secret key", line)
+		}
+		keys[fields[0]] = fields[1]
+	}
+	return keys, s.Err()
+}
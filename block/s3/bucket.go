@@ -0,0 +1,333 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+)
+
+// timeFormat is how times are given in response documents.
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// defaultMaxKeys is how many keys are listed at most unless the client
+// asks for fewer.
+const defaultMaxKeys = 1000
+
+// maxDeleteObjects is the most objects deleted by one request.
+const maxDeleteObjects = 1000
+
+func (h *Handler) listBuckets(w http.ResponseWriter, r *http.Request) error {
+	buckets, err := block.GetBuckets(h.srv.MDS)
+	if err != nil {
+		return err
+	}
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	resp := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: xmlns}
+	resp.Owner.ID = "torus"
+	for _, b := range buckets {
+		resp.Buckets = append(resp.Buckets, bucket{
+			Name:         b.Name,
+			CreationDate: b.Created.UTC().Format(timeFormat),
+		})
+	}
+	writeXML(w, resp)
+	return nil
+}
+
+func (h *Handler) createBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if err := block.ValidateBucketName(bucket); err != nil {
+		return errorf(http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+	}
+	// The body may name a region, which is ignored.
+	io.Copy(ioutil.Discard, r.Body)
+	err := block.CreateBucket(h.srv.MDS, bucket)
+	if err == torus.ErrExists {
+		return errBucketAlreadyOwned
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+bucket)
+	return nil
+}
+
+func (h *Handler) deleteBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	switch err := block.DeleteBucket(h.srv.MDS, bucket); err {
+	case nil:
+	case torus.ErrNotExist:
+		return errNoSuchBucket
+	case block.ErrBucketNotEmpty:
+		return errBucketNotEmpty
+	default:
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *Handler) getBucketLocation(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := h.getBucket(bucket); err != nil {
+		return err
+	}
+	// Buckets aren't in any region; an empty constraint is the default
+	// one.
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"LocationConstraint"`
+		Xmlns   string   `xml:"xmlns,attr"`
+	}{Xmlns: xmlns})
+	return nil
+}
+
+// isListQuery reports whether q holds only the parameters of a listing.
+func isListQuery(q url.Values) bool {
+	for k := range q {
+		switch k {
+		case "prefix", "delimiter", "marker", "max-keys", "list-type",
+			"continuation-token", "start-after", "fetch-owner", "encoding-type":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// listing is a page of a bucket's contents.
+type listing struct {
+	objects  []block.Object
+	prefixes []string
+	// next is the last key or common prefix listed, to continue from.
+	next      string
+	truncated bool
+}
+
+// list lists up to max objects in bucket with keys starting with prefix and
+// after after, rolling those with delim after the prefix up into common
+// prefixes.
+func (h *Handler) list(bucket, prefix, delim, after string, max int) (*listing, error) {
+	l := &listing{}
+	// A common prefix given to continue from covers the keys under it.
+	if delim != "" && strings.HasPrefix(after, prefix) {
+		if i := strings.Index(after[len(prefix):], delim); i >= 0 && len(prefix)+i+len(delim) == len(after) {
+			after += "\xff"
+		}
+	}
+	for {
+		n := max - len(l.objects) - len(l.prefixes) + 1
+		objs, err := block.ListObjects(h.srv.MDS, bucket, prefix, after, n)
+		if err != nil {
+			return nil, err
+		}
+		if len(objs) == 0 {
+			return l, nil
+		}
+	batch:
+		for _, o := range objs {
+			if len(l.objects)+len(l.prefixes) == max {
+				l.truncated = true
+				return l, nil
+			}
+			if delim != "" {
+				if i := strings.Index(o.Key[len(prefix):], delim); i >= 0 {
+					cp := o.Key[:len(prefix)+i+len(delim)]
+					l.prefixes = append(l.prefixes, cp)
+					l.next = cp
+					// Nothing in a key sorts after 0xff, so this
+					// skips every key under cp.
+					after = cp + "\xff"
+					break batch
+				}
+			}
+			l.objects = append(l.objects, o)
+			l.next = o.Key
+			after = o.Key
+		}
+	}
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+func (h *Handler) listObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := h.getBucket(bucket); err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	max := defaultMaxKeys
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errorf(http.StatusBadRequest, "InvalidArgument", "Invalid max-keys %q.", s)
+		}
+		if n < max {
+			max = n
+		}
+	}
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	v2 := q.Get("list-type") == "2"
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return errorf(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect.")
+			}
+			after = string(b)
+		}
+	}
+	l := &listing{}
+	if max > 0 {
+		var err error
+		l, err = h.list(bucket, prefix, delim, after, max)
+		if err != nil {
+			return err
+		}
+	}
+	var contents []listEntry
+	for _, o := range l.objects {
+		contents = append(contents, listEntry{
+			Key:          o.Key,
+			LastModified: o.Modified.UTC().Format(timeFormat),
+			ETag:         `"` + o.ETag + `"`,
+			Size:         o.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	var prefixes []commonPrefix
+	for _, p := range l.prefixes {
+		prefixes = append(prefixes, commonPrefix{p})
+	}
+
+	if v2 {
+		resp := struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			Xmlns                 string   `xml:"xmlns,attr"`
+			Name                  string
+			Prefix                string
+			Delimiter             string `xml:",omitempty"`
+			StartAfter            string `xml:",omitempty"`
+			ContinuationToken     string `xml:",omitempty"`
+			NextContinuationToken string `xml:",omitempty"`
+			KeyCount              int
+			MaxKeys               int
+			IsTruncated           bool
+			Contents              []listEntry
+			CommonPrefixes        []commonPrefix
+		}{
+			Xmlns:             xmlns,
+			Name:              bucket,
+			Prefix:            prefix,
+			Delimiter:         delim,
+			StartAfter:        q.Get("start-after"),
+			ContinuationToken: q.Get("continuation-token"),
+			KeyCount:          len(contents) + len(prefixes),
+			MaxKeys:           max,
+			IsTruncated:       l.truncated,
+			Contents:          contents,
+			CommonPrefixes:    prefixes,
+		}
+		if l.truncated {
+			resp.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(l.next))
+		}
+		writeXML(w, resp)
+		return nil
+	}
+	resp := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Xmlns          string   `xml:"xmlns,attr"`
+		Name           string
+		Prefix         string
+		Marker         string
+		NextMarker     string `xml:",omitempty"`
+		Delimiter      string `xml:",omitempty"`
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []listEntry
+		CommonPrefixes []commonPrefix
+	}{
+		Xmlns:          xmlns,
+		Name:           bucket,
+		Prefix:         prefix,
+		Marker:         q.Get("marker"),
+		Delimiter:      delim,
+		MaxKeys:        max,
+		IsTruncated:    l.truncated,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	}
+	if l.truncated {
+		resp.NextMarker = l.next
+	}
+	writeXML(w, resp)
+	return nil
+}
+
+// deleteObjects serves a multi-object delete.
+func (h *Handler) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := h.getBucket(bucket); err != nil {
+		return err
+	}
+	var req struct {
+		Quiet  bool
+		Object []struct {
+			Key string
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil {
+		return errMalformedXML
+	}
+	if len(req.Object) > maxDeleteObjects {
+		return errMalformedXML
+	}
+	type deleted struct {
+		Key string
+	}
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	resp := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Deleted []deleted
+		Error   []deleteError
+	}{Xmlns: xmlns}
+	for _, o := range req.Object {
+		err := block.DeleteObject(h.srv, bucket, o.Key)
+		if err != nil && err != torus.ErrNotExist {
+			resp.Error = append(resp.Error, deleteError{o.Key, "InternalError", err.Error()})
+			continue
+		}
+		if !req.Quiet {
+			resp.Deleted = append(resp.Deleted, deleted{o.Key})
+		}
+	}
+	writeXML(w, resp)
+	return nil
+}
@@ -0,0 +1,238 @@
+package s3
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+)
+
+// defaultContentType is the content type of objects uploaded without one.
+const defaultContentType = "binary/octet-stream"
+
+// storeError maps the errors of storing an object onto API errors. Those
+// from reading the body, such as a payload hash mismatch, already are.
+func storeError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return errIncompleteBody
+	}
+	return err
+}
+
+func (h *Handler) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	size, err := contentLength(r)
+	if err != nil {
+		return err
+	}
+	if _, err := h.getBucket(bucket); err != nil {
+		return err
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	o, err := block.PutObject(h.srv, bucket, key, contentType, r.Body, size)
+	if err == torus.ErrNotExist {
+		// The bucket was deleted underneath us.
+		return errNoSuchBucket
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	w.Header().Set("ETag", `"`+o.ETag+`"`)
+	return nil
+}
+
+func (h *Handler) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	o, err := block.GetObject(h.srv.MDS, bucket, key)
+	if err == torus.ErrNotExist {
+		if _, err := h.getBucket(bucket); err != nil {
+			return err
+		}
+		return errNoSuchKey
+	}
+	if err != nil {
+		return err
+	}
+	f, err := block.OpenObject(h.srv, o)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("ETag", `"`+o.ETag+`"`)
+	w.Header().Set("Content-Type", o.ContentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, key, o.Modified, io.NewSectionReader(f, 0, f.Size()))
+	return nil
+}
+
+func (h *Handler) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	if _, err := h.getBucket(bucket); err != nil {
+		return err
+	}
+	// Deleting what isn't there succeeds, as in S3.
+	if err := block.DeleteObject(h.srv, bucket, key); err != nil && err != torus.ErrNotExist {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *Handler) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	u, err := block.CreateUpload(h.srv.MDS, bucket, key, contentType)
+	if err == torus.ErrNotExist {
+		return errNoSuchBucket
+	}
+	if err != nil {
+		return err
+	}
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: xmlns, Bucket: bucket, Key: key, UploadId: u.ID})
+	return nil
+}
+
+// getUpload returns an upload of key, or the API error for a missing one.
+func (h *Handler) getUpload(bucket, key, id string) (*block.Upload, error) {
+	u, err := block.GetUpload(h.srv.MDS, bucket, id)
+	if err == torus.ErrNotExist {
+		if _, err := h.getBucket(bucket); err != nil {
+			return nil, err
+		}
+		return nil, errNoSuchUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Key != key {
+		return nil, errNoSuchUpload
+	}
+	return u, nil
+}
+
+func (h *Handler) putPart(w http.ResponseWriter, r *http.Request, bucket, id string) error {
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > block.MaxPartNumber {
+		return errorf(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and %d, inclusive.", block.MaxPartNumber)
+	}
+	size, err := contentLength(r)
+	if err != nil {
+		return err
+	}
+	part, err := block.PutUploadPart(h.srv, bucket, id, n, r.Body, size)
+	if err == torus.ErrNotExist {
+		return errNoSuchUpload
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	w.Header().Set("ETag", `"`+part.ETag+`"`)
+	return nil
+}
+
+func (h *Handler) listParts(w http.ResponseWriter, r *http.Request, bucket, key, id string) error {
+	u, err := h.getUpload(bucket, key, id)
+	if err != nil {
+		return err
+	}
+	type part struct {
+		PartNumber   int
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	resp := struct {
+		XMLName      xml.Name `xml:"ListPartsResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		Bucket       string
+		Key          string
+		UploadId     string
+		StorageClass string
+		MaxParts     int
+		IsTruncated  bool
+		Part         []part
+	}{
+		Xmlns:        xmlns,
+		Bucket:       bucket,
+		Key:          key,
+		UploadId:     id,
+		StorageClass: "STANDARD",
+		MaxParts:     block.MaxPartNumber,
+	}
+	for _, p := range u.Parts {
+		resp.Part = append(resp.Part, part{
+			PartNumber:   p.Number,
+			LastModified: u.Initiated.UTC().Format(timeFormat),
+			ETag:         `"` + p.ETag + `"`,
+			Size:         p.Size,
+		})
+	}
+	writeXML(w, resp)
+	return nil
+}
+
+func (h *Handler) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) error {
+	if _, err := h.getUpload(bucket, key, id); err != nil {
+		return err
+	}
+	var req struct {
+		Part []struct {
+			PartNumber int
+			ETag       string
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil {
+		return errMalformedXML
+	}
+	var parts []block.ObjectPart
+	for _, p := range req.Part {
+		parts = append(parts, block.ObjectPart{
+			Number: p.PartNumber,
+			ETag:   strings.Trim(p.ETag, `"`),
+		})
+	}
+	o, err := block.CompleteUpload(h.srv, bucket, id, parts)
+	switch err {
+	case nil:
+	case torus.ErrNotExist:
+		return errNoSuchUpload
+	case block.ErrInvalidPart:
+		return errInvalidPart
+	case block.ErrInvalidPartOrder:
+		return errInvalidPartOrder
+	default:
+		return err
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Xmlns: xmlns, Bucket: bucket, Key: key, ETag: `"` + o.ETag + `"`})
+	return nil
+}
+
+func (h *Handler) abortUpload(w http.ResponseWriter, r *http.Request, bucket, id string) error {
+	err := block.AbortUpload(h.srv, bucket, id)
+	if err == torus.ErrNotExist {
+		return errNoSuchUpload
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,221 @@
+// Package s3 serves buckets and objects kept in torus over the S3 REST API,
+// so that applications written for S3 can use a torus cluster as object
+// storage.
+//
+// Buckets and objects are stored by the block package: the data of each
+// object is kept in block volumes, one per uploaded part, and the index in
+// the cluster metadata. Any number of gateways can serve the same cluster.
+//
+// Only path-style requests (http://HOST/BUCKET/KEY) are understood. Requests
+// are authenticated with AWS Signature Version 4, in the Authorization header
+// or in a presigned URL; chunked uploads signed per chunk aren't supported.
+// Beyond the object's content type, user metadata, ACLs, versioning and the
+// like are not kept.
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+)
+
+// xmlns is the namespace of S3 response documents.
+const xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// MaxObjectSize is the largest object, or part of one, which may be uploaded
+// in one request.
+const MaxObjectSize = 5 << 30
+
+// Handler serves the S3 API for a torus server.
+type Handler struct {
+	srv *torus.Server
+	// keys maps access key IDs to their secret keys. If it's empty,
+	// requests aren't authenticated.
+	keys map[string]string
+}
+
+// NewHandler creates a Handler serving the buckets of srv. Requests must be
+// signed with one of the secret keys in keys, by access key ID, unless keys
+// is empty.
+func NewHandler(srv *torus.Server, keys map[string]string) *Handler {
+	return &Handler{srv: srv, keys: keys}
+}
+
+// apiError is an error response.
+type apiError struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string { return e.Code + ": " + e.Message }
+
+func errorf(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errNoSuchBucket       = errorf(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+	errNoSuchKey          = errorf(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	errNoSuchUpload       = errorf(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+	errNotImplemented     = errorf(http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented.")
+	errMethodNotAllowed   = errorf(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	errMalformedXML       = errorf(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate.")
+	errMissingLength      = errorf(http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header.")
+	errEntityTooLarge     = errorf(http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.")
+	errIncompleteBody     = errorf(http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.")
+	errInvalidPart        = errorf(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+	errInvalidPartOrder   = errorf(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+	errBucketNotEmpty     = errorf(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.")
+	errBucketAlreadyOwned = errorf(http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket you tried to create already exists.")
+)
+
+// writeError sends err as an S3 error document. Errors which aren't API
+// errors are logged and sent as internal errors.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		log.Printf("s3: %s %s error: %s", r.Method, r.URL.Path, err)
+		e = errorf(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	if r.Method == "HEAD" {
+		return
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+// writeXML sends v as the response document.
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("s3: error writing response: %s", err)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	r.Body = body
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	switch {
+	case bucket == "":
+		err = h.serveService(w, r)
+	case key == "":
+		err = h.serveBucket(w, r, bucket)
+	default:
+		err = h.serveObject(w, r, bucket, key)
+	}
+	if err != nil {
+		writeError(w, r, err)
+	}
+}
+
+func (h *Handler) serveService(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return errMethodNotAllowed
+	}
+	return h.listBuckets(w, r)
+}
+
+func (h *Handler) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	q := r.URL.Query()
+	switch r.Method {
+	case "PUT":
+		return h.createBucket(w, r, bucket)
+	case "DELETE":
+		return h.deleteBucket(w, r, bucket)
+	case "HEAD":
+		_, err := h.getBucket(bucket)
+		return err
+	case "GET":
+		if _, ok := q["location"]; ok {
+			return h.getBucketLocation(w, r, bucket)
+		}
+		if len(q) != 0 && !isListQuery(q) {
+			return errNotImplemented
+		}
+		return h.listObjects(w, r, bucket)
+	case "POST":
+		if _, ok := q["delete"]; ok {
+			return h.deleteObjects(w, r, bucket)
+		}
+		return errNotImplemented
+	}
+	return errMethodNotAllowed
+}
+
+func (h *Handler) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return errNotImplemented
+		}
+		if uploadID != "" {
+			return h.putPart(w, r, bucket, uploadID)
+		}
+		return h.putObject(w, r, bucket, key)
+	case "GET", "HEAD":
+		if uploadID != "" {
+			return h.listParts(w, r, bucket, key, uploadID)
+		}
+		return h.getObject(w, r, bucket, key)
+	case "DELETE":
+		if uploadID != "" {
+			return h.abortUpload(w, r, bucket, uploadID)
+		}
+		return h.deleteObject(w, r, bucket, key)
+	case "POST":
+		if _, ok := q["uploads"]; ok {
+			return h.createUpload(w, r, bucket, key)
+		}
+		if uploadID != "" {
+			return h.completeUpload(w, r, bucket, key, uploadID)
+		}
+		return errNotImplemented
+	}
+	return errMethodNotAllowed
+}
+
+// getBucket returns the named bucket, or the API error for a missing one.
+func (h *Handler) getBucket(name string) (*block.Bucket, error) {
+	b, err := block.GetBucket(h.srv.MDS, name)
+	if err == torus.ErrNotExist {
+		return nil, errNoSuchBucket
+	}
+	return b, err
+}
+
+// contentLength returns the length of the request's body, which must be
+// given and may not be more than MaxObjectSize.
+func contentLength(r *http.Request) (int64, error) {
+	if r.ContentLength < 0 {
+		return 0, errMissingLength
+	}
+	if r.ContentLength > MaxObjectSize {
+		return 0, errEntityTooLarge
+	}
+	return r.ContentLength, nil
+}
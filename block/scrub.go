@@ -0,0 +1,104 @@
+package block
+
+import (
+	"bytes"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+func init() {
+	torus.RegisterBlockChecks("blockvol", blockVolumeChecks)
+}
+
+// blockVolumeChecks gives the scrubber the blocks of every block volume, and
+// of their snapshots, with the checksums their checksum layers hold for them.
+func blockVolumeChecks(ctx context.Context, srv *torus.Server, fn func(torus.BlockRef, func([]byte) bool) error) error {
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		return err
+	}
+	for _, vol := range vols {
+		if vol.Type != VolumeType {
+			continue
+		}
+		err := volumeChecks(ctx, srv, vol.Name, torus.VolumeID(vol.Id), fn)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// It may have been deleted since it was listed.
+			clog.Errorf("scrub: volume %s: %v", vol.Name, err)
+		}
+	}
+	return nil
+}
+
+func volumeChecks(ctx context.Context, srv *torus.Server, name string, vid torus.VolumeID, fn func(torus.BlockRef, func([]byte) bool) error) error {
+	mds, err := createBlockMetadata(srv.MDS, name, vid)
+	if err != nil {
+		return err
+	}
+	ref, err := mds.GetINode()
+	if err != nil {
+		return err
+	}
+	refs := []torus.INodeRef{ref}
+	snaps, err := mds.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, x := range snaps {
+		refs = append(refs, torus.INodeRefFromBytes(x.INodeRef))
+	}
+	for _, ref := range refs {
+		if ref.INode <= 1 {
+			// Nothing has been written yet.
+			continue
+		}
+		if err := inodeChecks(ctx, srv, ref, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inodeChecks calls fn with the blocks of the INode at ref and their checks.
+func inodeChecks(ctx context.Context, srv *torus.Server, ref torus.INodeRef, fn func(torus.BlockRef, func([]byte) bool) error) error {
+	inode, err := srv.INodes.GetINode(ctx, ref)
+	if err != nil {
+		return err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), nil)
+	if err != nil {
+		return err
+	}
+	algo, sums, err := blockset.Checksums(bs)
+	if err == blockset.ErrNoChecksums || len(sums) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, r := range bs.GetAllBlockRefs() {
+		if r.IsZero() {
+			continue
+		}
+		if _, _, shard := r.Shard(); shard && i >= len(sums) {
+			// Erasure coding's parity has no checksum.
+			continue
+		}
+		// A replication layer lists its copies after the blocks
+		// themselves, in the same order.
+		want := sums[i%len(sums)]
+		err := fn(r, func(data []byte) bool {
+			return bytes.Equal(algo.Sum(data), want)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+// Package scsi serves SCSI commands from a block device, for the block
+// volume gateways which speak SCSI: the iSCSI target and the kernel's LIO
+// target through TCMU.
+package scsi
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+)
+
+// SectorSize is the block size disks are addressed in.
+const SectorSize = 512
+
+// MaxTransferLength is the most data a single command may transfer, as
+// reported to initiators. Longer reads and writes are refused.
+const MaxTransferLength = 256 << 10
+
+// Device is the storage behind a Disk. A block.BlockFile is a Device.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Trim(off, length int64) error
+}
+
+// Disk is a direct access block device served from a Device.
+type Disk struct {
+	Device   Device
+	Size     int64
+	ReadOnly bool
+	// Serial is reported as the disk's serial number and device
+	// identifier, and names it in logs.
+	Serial string
+	// PhysicalBlockSize, if larger than 512 bytes, is reported to
+	// initiators so that they align their IO to it.
+	PhysicalBlockSize int
+	// Reservations, if set, holds the disk's persistent reservations,
+	// which are served and enforced for the initiators which register
+	// through it.
+	Reservations ReservationStore
+
+	fenceOnce sync.Once
+	prs       *Fence
+
+	// The device may be shared by several sessions, and isn't safe for
+	// concurrent use.
+	mu sync.Mutex
+}
+
+// SCSI operation codes served.
+const (
+	scsiTestUnitReady   = 0x00
+	scsiRequestSense    = 0x03
+	scsiRead6           = 0x08
+	scsiWrite6          = 0x0a
+	scsiInquiry         = 0x12
+	scsiModeSense6      = 0x1a
+	scsiStartStop       = 0x1b
+	scsiPreventAllow    = 0x1e
+	scsiReadCapacity10  = 0x25
+	scsiRead10          = 0x28
+	scsiWrite10         = 0x2a
+	scsiVerify10        = 0x2f
+	scsiSyncCache10     = 0x35
+	scsiUnmap           = 0x42
+	scsiModeSense10     = 0x5a
+	scsiRead16          = 0x88
+	scsiWrite16         = 0x8a
+	scsiVerify16        = 0x8f
+	scsiSyncCache16     = 0x91
+	scsiServiceActionIn = 0x9e
+	scsiReportLUNs      = 0xa0
+
+	// The service action of SERVICE ACTION IN for READ CAPACITY (16).
+	saReadCapacity16 = 0x10
+)
+
+const (
+	StatusGood           = 0x00
+	StatusCheckCondition = 0x02
+)
+
+// Sense keys.
+const (
+	senseMediumError    = 0x03
+	senseHardwareError  = 0x04
+	senseIllegalRequest = 0x05
+	senseDataProtect    = 0x07
+)
+
+// Additional sense codes, with their qualifiers.
+const (
+	ascWriteError       = 0x0c00
+	ascReadError        = 0x1100
+	ascInvalidOpcode    = 0x2000
+	ascLBAOutOfRange    = 0x2100
+	ascInvalidCDBField  = 0x2400
+	ascInvalidParam     = 0x2600
+	ascLUNNotSupported  = 0x2500
+	ascWriteProtected   = 0x2700
+	ascParamListLength  = 0x1a00
+	ascSavingNotAllowed = 0x3900
+	ascInvalidRelease   = 0x2604
+	ascInternalFailure  = 0x4400
+)
+
+// Limits reported in the block limits VPD page.
+const (
+	maxUnmapLBAs        = 1 << 22
+	maxUnmapDescriptors = 64
+)
+
+// Result is the outcome of a SCSI command: data for the initiator, and
+// the status with sense data if it failed.
+type Result struct {
+	Data   []byte
+	Status byte
+	Sense  []byte
+}
+
+func checkCondition(key byte, asc uint16) Result {
+	// Fixed format sense data.
+	sense := make([]byte, 18)
+	sense[0] = 0x70
+	sense[2] = key
+	sense[7] = 10
+	sense[12] = byte(asc >> 8)
+	sense[13] = byte(asc)
+	return Result{Status: StatusCheckCondition, Sense: sense}
+}
+
+// InvalidCDB is the result of a command whose CDB is invalid, such as one
+// whose transfer length disagrees with the data sent for it.
+func InvalidCDB() Result {
+	return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+}
+
+func good(data []byte) Result {
+	return Result{Data: data}
+}
+
+// DataOutLength returns how many bytes of data the command in cdb expects
+// from the initiator.
+func DataOutLength(cdb []byte) int {
+	switch cdb[0] {
+	case scsiWrite6, scsiWrite10, scsiWrite16:
+		_, n := transferRange(cdb)
+		return int(n) * SectorSize
+	case scsiUnmap:
+		return int(binary.BigEndian.Uint16(cdb[7:9]))
+	case scsiPersistentReserveOut:
+		return int(binary.BigEndian.Uint32(cdb[5:9]))
+	}
+	return 0
+}
+
+// transferRange returns the first block and the number of blocks read or
+// written by the command in cdb.
+func transferRange(cdb []byte) (lba uint64, n uint32) {
+	switch cdb[0] {
+	case scsiRead6, scsiWrite6:
+		lba = uint64(cdb[1]&0x1f)<<16 | uint64(cdb[2])<<8 | uint64(cdb[3])
+		n = uint32(cdb[4])
+		if n == 0 {
+			n = 256
+		}
+	case scsiRead10, scsiWrite10:
+		lba = uint64(binary.BigEndian.Uint32(cdb[2:6]))
+		n = uint32(binary.BigEndian.Uint16(cdb[7:9]))
+	case scsiRead16, scsiWrite16:
+		lba = binary.BigEndian.Uint64(cdb[2:10])
+		n = binary.BigEndian.Uint32(cdb[10:14])
+	}
+	return lba, n
+}
+
+// cdbLength returns the length of the command descriptor block for the
+// operation code op, from its group code.
+func cdbLength(op byte) int {
+	switch op >> 5 {
+	case 0:
+		return 6
+	case 1, 2:
+		return 10
+	case 4:
+		return 16
+	case 5:
+		return 12
+	}
+	return 16
+}
+
+// Execute runs the command in cdb against the LUN addressed, with the data
+// the initiator sent for it. The disk is LUN 0; other LUNs only answer
+// INQUIRY and REPORT LUNS, to say that they don't exist. The command is
+// from the initiator port named by initiator, which is empty if the
+// initiator can't take part in persistent reservations.
+func (d *Disk) Execute(initiator string, lun uint16, cdb []byte, out []byte) Result {
+	if len(cdb) < cdbLength(cdb[0]) {
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+	}
+	switch cdb[0] {
+	case scsiInquiry:
+		return d.inquiry(lun, cdb)
+	case scsiReportLUNs:
+		return d.reportLUNs(cdb)
+	case scsiRequestSense:
+		// Sense data is always returned with the failed command.
+		sense := checkCondition(0, 0).Sense
+		return good(truncate(sense, int(cdb[4])))
+	}
+	if lun != 0 {
+		return checkCondition(senseIllegalRequest, ascLUNNotSupported)
+	}
+
+	if d.fenced(initiator, cdb) {
+		return reservationConflict()
+	}
+	switch cdb[0] {
+	case scsiTestUnitReady, scsiStartStop, scsiPreventAllow:
+		return good(nil)
+	case scsiReadCapacity10:
+		buf := make([]byte, 8)
+		last := uint64(d.Size/SectorSize) - 1
+		if last > 0xffffffff {
+			last = 0xffffffff
+		}
+		binary.BigEndian.PutUint32(buf[0:4], uint32(last))
+		binary.BigEndian.PutUint32(buf[4:8], SectorSize)
+		return good(buf)
+	case scsiServiceActionIn:
+		if cdb[1]&0x1f != saReadCapacity16 {
+			return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+		}
+		return d.readCapacity16(cdb)
+	case scsiModeSense6, scsiModeSense10:
+		return d.modeSense(cdb)
+	case scsiRead6, scsiRead10, scsiRead16:
+		return d.read(cdb)
+	case scsiWrite6, scsiWrite10, scsiWrite16:
+		return d.write(cdb, out)
+	case scsiVerify10, scsiVerify16:
+		// Every block is checksummed as it's read anyway.
+		return good(nil)
+	case scsiSyncCache10, scsiSyncCache16:
+		if err := d.sync(); err != nil {
+			log.Printf("scsi: %s: sync error: %s", d.Serial, err)
+			return checkCondition(senseMediumError, ascWriteError)
+		}
+		return good(nil)
+	case scsiUnmap:
+		return d.unmap(out)
+	case scsiPersistentReserveIn, scsiPersistentReserveOut:
+		if d.Reservations == nil || initiator == "" {
+			break
+		}
+		if cdb[0] == scsiPersistentReserveIn {
+			return d.persistentReserveIn(cdb)
+		}
+		return d.persistentReserveOut(initiator, cdb, out)
+	}
+	return checkCondition(senseIllegalRequest, ascInvalidOpcode)
+}
+
+func truncate(data []byte, alloc int) []byte {
+	if len(data) > alloc {
+		return data[:alloc]
+	}
+	return data
+}
+
+// TransferTooLong reports whether a command transferring n bytes should be
+// refused with InvalidCDB, before its data is gathered.
+func TransferTooLong(n int) bool {
+	return n > MaxTransferLength
+}
+
+// inRange reports whether n blocks from lba lie within the LUN.
+func (d *Disk) inRange(lba uint64, n uint32) bool {
+	blocks := uint64(d.Size / SectorSize)
+	return lba <= blocks && uint64(n) <= blocks-lba
+}
+
+func (d *Disk) read(cdb []byte) Result {
+	lba, n := transferRange(cdb)
+	if uint64(n)*SectorSize > MaxTransferLength {
+		return InvalidCDB()
+	}
+	if !d.inRange(lba, n) {
+		return checkCondition(senseIllegalRequest, ascLBAOutOfRange)
+	}
+	buf := make([]byte, int(n)*SectorSize)
+	d.mu.Lock()
+	_, err := d.Device.ReadAt(buf, int64(lba)*SectorSize)
+	d.mu.Unlock()
+	if err != nil {
+		log.Printf("scsi: %s: read error: %s", d.Serial, err)
+		return checkCondition(senseMediumError, ascReadError)
+	}
+	return good(buf)
+}
+
+func (d *Disk) write(cdb []byte, data []byte) Result {
+	if d.ReadOnly {
+		return checkCondition(senseDataProtect, ascWriteProtected)
+	}
+	lba, n := transferRange(cdb)
+	if uint64(n)*SectorSize > MaxTransferLength {
+		return InvalidCDB()
+	}
+	if !d.inRange(lba, n) {
+		return checkCondition(senseIllegalRequest, ascLBAOutOfRange)
+	}
+	d.mu.Lock()
+	_, err := d.Device.WriteAt(data, int64(lba)*SectorSize)
+	if err == nil && cdb[0] != scsiWrite6 && cdb[1]&0x08 != 0 {
+		// Force unit access.
+		err = d.Device.Sync()
+	}
+	d.mu.Unlock()
+	if err != nil {
+		log.Printf("scsi: %s: write error: %s", d.Serial, err)
+		return checkCondition(senseMediumError, ascWriteError)
+	}
+	return good(nil)
+}
+
+func (d *Disk) sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Device.Sync()
+}
+
+// unmap trims the ranges in the parameter list of an UNMAP command.
+func (d *Disk) unmap(params []byte) Result {
+	if d.ReadOnly {
+		return checkCondition(senseDataProtect, ascWriteProtected)
+	}
+	if len(params) == 0 {
+		return good(nil)
+	}
+	if len(params) < 8 {
+		return checkCondition(senseIllegalRequest, ascParamListLength)
+	}
+	n := int(binary.BigEndian.Uint16(params[2:4]))
+	if 8+n > len(params) || n%16 != 0 {
+		return checkCondition(senseIllegalRequest, ascParamListLength)
+	}
+	if n/16 > maxUnmapDescriptors {
+		return checkCondition(senseIllegalRequest, ascInvalidParam)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for desc := params[8 : 8+n]; len(desc) > 0; desc = desc[16:] {
+		lba := binary.BigEndian.Uint64(desc[0:8])
+		count := binary.BigEndian.Uint32(desc[8:12])
+		if count == 0 {
+			continue
+		}
+		if count > maxUnmapLBAs {
+			return checkCondition(senseIllegalRequest, ascInvalidParam)
+		}
+		if !d.inRange(lba, count) {
+			return checkCondition(senseIllegalRequest, ascLBAOutOfRange)
+		}
+		if err := d.Device.Trim(int64(lba)*SectorSize, int64(count)*SectorSize); err != nil {
+			log.Printf("scsi: %s: unmap error: %s", d.Serial, err)
+			return checkCondition(senseMediumError, ascWriteError)
+		}
+	}
+	// As for NBD trims, sync so that the blocks released can be
+	// collected.
+	if err := d.Device.Sync(); err != nil {
+		log.Printf("scsi: %s: sync error: %s", d.Serial, err)
+		return checkCondition(senseMediumError, ascWriteError)
+	}
+	return good(nil)
+}
+
+func (d *Disk) readCapacity16(cdb []byte) Result {
+	buf := make([]byte, 32)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(d.Size/SectorSize)-1)
+	binary.BigEndian.PutUint32(buf[8:12], SectorSize)
+	buf[13] = d.physicalExponent()
+	// Thin provisioned, reading zeros where unmapped.
+	buf[14] = 0x80 | 0x40
+	return good(truncate(buf, int(binary.BigEndian.Uint32(cdb[10:14]))))
+}
+
+// physicalExponent returns log2 of the logical blocks per physical block,
+// the volume's block size.
+func (d *Disk) physicalExponent() byte {
+	var e byte
+	for bs := d.PhysicalBlockSize; bs > SectorSize; bs >>= 1 {
+		e++
+	}
+	return e
+}
+
+func (d *Disk) inquiry(lun uint16, cdb []byte) Result {
+	alloc := int(binary.BigEndian.Uint16(cdb[3:5]))
+	var qualifier byte
+	if lun != 0 {
+		// No device at this LUN.
+		qualifier = 0x7f
+	}
+	if cdb[1]&0x01 == 0 {
+		if cdb[2] != 0 {
+			return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+		}
+		buf := make([]byte, 36)
+		buf[0] = qualifier
+		buf[2] = 0x05 // SPC-3
+		buf[3] = 0x02
+		buf[4] = byte(len(buf) - 5)
+		buf[7] = 0x02 // command queueing
+		copy(buf[8:16], padded("TORUS", 8))
+		copy(buf[16:32], padded("BLOCK VOLUME", 16))
+		copy(buf[32:36], padded("0001", 4))
+		return good(truncate(buf, alloc))
+	}
+
+	var page []byte
+	switch cdb[2] {
+	case 0x00:
+		page = []byte{0x00, 0x80, 0x83, 0xb0, 0xb2}
+	case 0x80:
+		page = []byte(d.Serial)
+	case 0x83:
+		// A T10 vendor ID designator for the logical unit.
+		id := append(padded("TORUS", 8), d.Serial...)
+		page = append([]byte{0x02, 0x01, 0x00, byte(len(id))}, id...)
+	case 0xb0:
+		page = make([]byte, 0x3c)
+		binary.BigEndian.PutUint32(page[4:8], MaxTransferLength/SectorSize)
+		binary.BigEndian.PutUint32(page[16:20], maxUnmapLBAs)
+		binary.BigEndian.PutUint32(page[20:24], maxUnmapDescriptors)
+		binary.BigEndian.PutUint32(page[24:28], uint32(1)<<d.physicalExponent())
+	case 0xb2:
+		page = make([]byte, 4)
+		// UNMAP is supported, and unmapped blocks read as zeros.
+		page[1] = 0x80 | 0x04
+		// Thin provisioned.
+		page[2] = 0x02
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+	}
+	buf := make([]byte, 4+len(page))
+	buf[0] = qualifier
+	buf[1] = cdb[2]
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(page)))
+	copy(buf[4:], page)
+	return good(truncate(buf, alloc))
+}
+
+func padded(s string, n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = ' '
+	}
+	copy(buf, s)
+	return buf
+}
+
+func (d *Disk) reportLUNs(cdb []byte) Result {
+	// LUN 0 is the only one.
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:4], 8)
+	return good(truncate(buf, int(binary.BigEndian.Uint32(cdb[6:10]))))
+}
+
+func (d *Disk) modeSense(cdb []byte) Result {
+	pc := cdb[2] >> 6
+	code := cdb[2] & 0x3f
+	if pc == 3 {
+		return checkCondition(senseIllegalRequest, ascSavingNotAllowed)
+	}
+
+	var pages []byte
+	if code == 0x08 || code == 0x3f {
+		// Caching: the write cache is enabled, so initiators flush.
+		caching := make([]byte, 20)
+		caching[0] = 0x08
+		caching[1] = 0x12
+		if pc != 1 {
+			caching[2] = 0x04
+		} else {
+			// Nothing can be changed.
+			caching[2] = 0
+		}
+		pages = append(pages, caching...)
+	}
+	if code == 0x0a || code == 0x3f {
+		control := make([]byte, 12)
+		control[0] = 0x0a
+		control[1] = 0x0a
+		pages = append(pages, control...)
+	}
+	if pages == nil && code != 0x3f {
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+	}
+
+	var specific byte = 0x10 // DPO and FUA are supported
+	if d.ReadOnly {
+		specific |= 0x80
+	}
+	if cdb[0] == scsiModeSense6 {
+		buf := append(make([]byte, 4), pages...)
+		buf[0] = byte(len(buf) - 1)
+		buf[2] = specific
+		return good(truncate(buf, int(cdb[4])))
+	}
+	buf := append(make([]byte, 8), pages...)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(buf)-2))
+	buf[3] = specific
+	return good(truncate(buf, int(binary.BigEndian.Uint16(cdb[7:9]))))
+}
@@ -0,0 +1,579 @@
+package scsi
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Persistent reservations let the initiators sharing a disk, such as the
+// nodes of a failover cluster, fence each other off it. Initiators register
+// a key, and one reserves the disk for itself or for every registrant; IO
+// the reservation excludes is refused with RESERVATION CONFLICT until it's
+// released or preempted.
+//
+// They're kept in a ReservationStore shared by every gateway serving the
+// volume, so that they hold wherever an initiator connects. Registrations
+// apply to every target port, and persist through power loss, as if APTPL
+// were always set. Each gateway caches them, reading them again in the
+// background once they're older than reservationRefresh, so a change made
+// through one gateway is enforced by the others within about that long.
+// PREEMPT AND ABORT can't abort commands running on other gateways, and
+// serves as PREEMPT.
+
+// reservationRefresh is how long a gateway enforces the reservations it
+// last read before reading them again.
+var reservationRefresh = time.Second
+
+// StatusReservationConflict is the status of a command refused because of
+// a persistent reservation.
+const StatusReservationConflict = 0x18
+
+const (
+	scsiPersistentReserveIn  = 0x5e
+	scsiPersistentReserveOut = 0x5f
+)
+
+// Service actions of PERSISTENT RESERVE IN.
+const (
+	prReadKeys           = 0x00
+	prReadReservation    = 0x01
+	prReportCapabilities = 0x02
+)
+
+// Service actions of PERSISTENT RESERVE OUT.
+const (
+	prRegister       = 0x00
+	prReserve        = 0x01
+	prRelease        = 0x02
+	prClear          = 0x03
+	prPreempt        = 0x04
+	prPreemptAbort   = 0x05
+	prRegisterIgnore = 0x06
+)
+
+// prParamsLength is the length of the parameter list of PERSISTENT RESERVE
+// OUT, without SPEC_I_PT.
+const prParamsLength = 24
+
+// ReservationType is the type of a persistent reservation, which decides
+// whose IO it excludes.
+type ReservationType byte
+
+const (
+	WriteExclusive                 ReservationType = 0x1
+	ExclusiveAccess                ReservationType = 0x3
+	WriteExclusiveRegistrantsOnly  ReservationType = 0x5
+	ExclusiveAccessRegistrantsOnly ReservationType = 0x6
+	WriteExclusiveAllRegistrants   ReservationType = 0x7
+	ExclusiveAccessAllRegistrants  ReservationType = 0x8
+)
+
+func (t ReservationType) String() string {
+	switch t {
+	case WriteExclusive:
+		return "write exclusive"
+	case ExclusiveAccess:
+		return "exclusive access"
+	case WriteExclusiveRegistrantsOnly:
+		return "write exclusive, registrants only"
+	case ExclusiveAccessRegistrantsOnly:
+		return "exclusive access, registrants only"
+	case WriteExclusiveAllRegistrants:
+		return "write exclusive, all registrants"
+	case ExclusiveAccessAllRegistrants:
+		return "exclusive access, all registrants"
+	}
+	return fmt.Sprintf("type %#x", byte(t))
+}
+
+func (t ReservationType) valid() bool {
+	switch t {
+	case WriteExclusive, ExclusiveAccess,
+		WriteExclusiveRegistrantsOnly, ExclusiveAccessRegistrantsOnly,
+		WriteExclusiveAllRegistrants, ExclusiveAccessAllRegistrants:
+		return true
+	}
+	return false
+}
+
+// allRegistrants reports whether reservations of the type are held by every
+// registrant, rather than by one.
+func (t ReservationType) allRegistrants() bool {
+	return t == WriteExclusiveAllRegistrants || t == ExclusiveAccessAllRegistrants
+}
+
+// ReservationStore holds a disk's persistent reservations, encoded, for
+// every gateway serving it. A block.BlockVolume is a ReservationStore.
+type ReservationStore interface {
+	// PersistentReservations returns the encoded reservations, or nil if
+	// there are none.
+	PersistentReservations() ([]byte, error)
+	// UpdatePersistentReservations atomically replaces them with what fn
+	// returns for the current ones. If fn fails, they're left as they
+	// are, and returned with fn's error.
+	UpdatePersistentReservations(fn func(cur []byte) ([]byte, error)) ([]byte, error)
+}
+
+// PersistentReservations are the registrations and reservation of a disk.
+type PersistentReservations struct {
+	// Generation counts the changes to the registrations.
+	Generation    uint32
+	Registrations []Registration `json:",omitempty"`
+	// Type is the type of the reservation, if the disk is reserved.
+	Type ReservationType `json:",omitempty"`
+	// Holder is the initiator port holding the reservation, unless it's
+	// held by every registrant.
+	Holder string `json:",omitempty"`
+}
+
+// Registration is the key an initiator port registered.
+type Registration struct {
+	// Initiator names the initiator port: for iSCSI, the initiator name
+	// and session ID.
+	Initiator string
+	Key       uint64
+}
+
+// ParsePersistentReservations decodes reservations from a
+// ReservationStore.
+func ParsePersistentReservations(b []byte) (*PersistentReservations, error) {
+	r := &PersistentReservations{}
+	if len(b) == 0 {
+		return r, nil
+	}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("scsi: bad persistent reservations: %v", err)
+	}
+	return r, nil
+}
+
+func (r *PersistentReservations) encode() ([]byte, error) {
+	if r.Generation == 0 && len(r.Registrations) == 0 && r.Type == 0 {
+		return nil, nil
+	}
+	return json.Marshal(r)
+}
+
+// key returns the key registered by initiator, if it has registered.
+func (r *PersistentReservations) key(initiator string) (uint64, bool) {
+	if initiator == "" {
+		return 0, false
+	}
+	for _, reg := range r.Registrations {
+		if reg.Initiator == initiator {
+			return reg.Key, true
+		}
+	}
+	return 0, false
+}
+
+// holds reports whether initiator holds the reservation.
+func (r *PersistentReservations) holds(initiator string) bool {
+	if r.Type == 0 {
+		return false
+	}
+	if r.Type.allRegistrants() {
+		_, ok := r.key(initiator)
+		return ok
+	}
+	return initiator != "" && r.Holder == initiator
+}
+
+// Allows reports whether IO from initiator, or from an initiator which
+// can't register if it's empty, is allowed by the reservation: reads, or
+// writes if write is set.
+func (r *PersistentReservations) Allows(initiator string, write bool) bool {
+	if r.Type == 0 || r.holds(initiator) {
+		return true
+	}
+	_, registered := r.key(initiator)
+	switch r.Type {
+	case WriteExclusive:
+		return !write
+	case WriteExclusiveRegistrantsOnly, WriteExclusiveAllRegistrants:
+		return !write || registered
+	case ExclusiveAccessRegistrantsOnly, ExclusiveAccessAllRegistrants:
+		return registered
+	}
+	return false
+}
+
+// unregister drops the registrations drop matches, and the reservation if
+// no one is left holding it.
+func (r *PersistentReservations) unregister(drop func(Registration) bool) int {
+	var kept []Registration
+	for _, reg := range r.Registrations {
+		if !drop(reg) {
+			kept = append(kept, reg)
+		}
+	}
+	n := len(r.Registrations) - len(kept)
+	r.Registrations = kept
+	_, held := r.key(r.Holder)
+	if r.Type.allRegistrants() {
+		held = len(kept) != 0
+	}
+	if !held {
+		r.Type, r.Holder = 0, ""
+	}
+	return n
+}
+
+// reserve makes initiator the holder of a reservation of type t.
+func (r *PersistentReservations) reserve(initiator string, t ReservationType) {
+	r.Type, r.Holder = t, ""
+	if !t.allRegistrants() {
+		r.Holder = initiator
+	}
+}
+
+// ErrReservationConflict is returned for IO which a persistent reservation
+// refuses.
+var ErrReservationConflict = errors.New("scsi: reservation conflict")
+
+// Fence refuses the IO which conflicts with a disk's persistent
+// reservations. Every Disk serving reservations keeps one, as do gateways
+// whose initiators can't register, whose IO is refused as if from
+// initiator ports which haven't.
+type Fence struct {
+	store ReservationStore
+
+	mu  sync.Mutex
+	cur *PersistentReservations
+	// loaded is when cur was read, and version counts its changes, so
+	// that a read racing with a change doesn't undo it.
+	loaded  time.Time
+	version uint64
+	loading bool
+}
+
+// NewFence creates a Fence enforcing the reservations in store.
+func NewFence(store ReservationStore) *Fence {
+	return &Fence{store: store}
+}
+
+// Allows reports whether the reservations allow IO from initiator, as
+// PersistentReservations.Allows does. If they've never been read, and
+// can't be, it's refused.
+func (f *Fence) Allows(initiator string, write bool) bool {
+	r, err := f.current()
+	if err != nil {
+		return false
+	}
+	return r.Allows(initiator, write)
+}
+
+// current returns the reservations, reading them in the background if
+// they're stale, and waiting for them the first time.
+func (f *Fence) current() (*PersistentReservations, error) {
+	f.mu.Lock()
+	cur := f.cur
+	if cur != nil && !f.loading && time.Since(f.loaded) > reservationRefresh {
+		f.loading = true
+		go f.load()
+	}
+	f.mu.Unlock()
+	if cur != nil {
+		return cur, nil
+	}
+	return f.load()
+}
+
+// load reads the reservations from the store.
+func (f *Fence) load() (*PersistentReservations, error) {
+	f.mu.Lock()
+	version := f.version
+	f.mu.Unlock()
+
+	b, err := f.store.PersistentReservations()
+	var r *PersistentReservations
+	if err == nil {
+		r, err = ParsePersistentReservations(b)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loading = false
+	if err != nil {
+		log.Printf("scsi: reading persistent reservations: %s", err)
+		return f.cur, err
+	}
+	if f.version == version {
+		f.cur, f.loaded = r, time.Now()
+		f.version++
+	}
+	return r, nil
+}
+
+// set replaces the reservations cached with r, just read or written.
+func (f *Fence) set(r *PersistentReservations) {
+	f.mu.Lock()
+	f.cur, f.loaded = r, time.Now()
+	f.version++
+	f.mu.Unlock()
+}
+
+// Device returns dev, failing the IO the reservations refuse an initiator
+// which can't register with ErrReservationConflict.
+func (f *Fence) Device(dev Device) Device {
+	return fencedDevice{Device: dev, fence: f}
+}
+
+type fencedDevice struct {
+	Device
+	fence *Fence
+}
+
+func (d fencedDevice) ReadAt(b []byte, off int64) (int, error) {
+	if !d.fence.Allows("", false) {
+		return 0, ErrReservationConflict
+	}
+	return d.Device.ReadAt(b, off)
+}
+
+func (d fencedDevice) WriteAt(b []byte, off int64) (int, error) {
+	if !d.fence.Allows("", true) {
+		return 0, ErrReservationConflict
+	}
+	return d.Device.WriteAt(b, off)
+}
+
+func (d fencedDevice) Sync() error {
+	if !d.fence.Allows("", true) {
+		return ErrReservationConflict
+	}
+	return d.Device.Sync()
+}
+
+func (d fencedDevice) Trim(off, length int64) error {
+	if !d.fence.Allows("", true) {
+		return ErrReservationConflict
+	}
+	return d.Device.Trim(off, length)
+}
+
+// fence returns the disk's Fence, or nil if it doesn't serve reservations.
+func (d *Disk) fence() *Fence {
+	if d.Reservations == nil {
+		return nil
+	}
+	d.fenceOnce.Do(func() {
+		d.prs = NewFence(d.Reservations)
+	})
+	return d.prs
+}
+
+// fenced reports whether the reservations refuse the command in cdb from
+// initiator. Only commands which access the medium conflict.
+func (d *Disk) fenced(initiator string, cdb []byte) bool {
+	f := d.fence()
+	if f == nil {
+		return false
+	}
+	switch cdb[0] {
+	case scsiRead6, scsiRead10, scsiRead16, scsiVerify10, scsiVerify16:
+		return !f.Allows(initiator, false)
+	case scsiWrite6, scsiWrite10, scsiWrite16, scsiUnmap,
+		scsiSyncCache10, scsiSyncCache16:
+		return !f.Allows(initiator, true)
+	}
+	return false
+}
+
+func reservationConflict() Result {
+	return Result{Status: StatusReservationConflict}
+}
+
+// persistentReserveIn serves PERSISTENT RESERVE IN, from the reservations
+// as the store holds them now.
+func (d *Disk) persistentReserveIn(cdb []byte) Result {
+	alloc := int(binary.BigEndian.Uint16(cdb[7:9]))
+	if cdb[1]&0x1f == prReportCapabilities {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint16(buf[0:2], 8)
+		// Persist through power loss is supported, and always
+		// active.
+		buf[2] = 0x01
+		buf[3] = 0x80 | 0x01
+		// Every type of reservation is supported.
+		buf[4] = 0x80 | 0x40 | 0x20 | 0x08 | 0x02
+		buf[5] = 0x01
+		return good(truncate(buf, alloc))
+	}
+
+	f := d.fence()
+	r, err := f.load()
+	if err != nil {
+		return checkCondition(senseHardwareError, ascInternalFailure)
+	}
+	var buf []byte
+	switch cdb[1] & 0x1f {
+	case prReadKeys:
+		buf = make([]byte, 8, 8+8*len(r.Registrations))
+		for _, reg := range r.Registrations {
+			var key [8]byte
+			binary.BigEndian.PutUint64(key[:], reg.Key)
+			buf = append(buf, key[:]...)
+		}
+	case prReadReservation:
+		buf = make([]byte, 8)
+		if r.Type != 0 {
+			desc := make([]byte, 16)
+			if !r.Type.allRegistrants() {
+				key, _ := r.key(r.Holder)
+				binary.BigEndian.PutUint64(desc[0:8], key)
+			}
+			desc[13] = byte(r.Type)
+			buf = append(buf, desc...)
+		}
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+	}
+	binary.BigEndian.PutUint32(buf[0:4], r.Generation)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(buf)-8))
+	return good(truncate(buf, alloc))
+}
+
+// prResult ends an update of the reservations with a result, leaving them
+// as they were.
+type prResult Result
+
+func (prResult) Error() string { return "persistent reservation refused" }
+
+// persistentReserveOut serves PERSISTENT RESERVE OUT from initiator,
+// changing the reservations atomically in the store.
+func (d *Disk) persistentReserveOut(initiator string, cdb, params []byte) Result {
+	action := cdb[1] & 0x1f
+	scope, t := cdb[2]>>4, ReservationType(cdb[2]&0x0f)
+	switch action {
+	case prRegister, prRegisterIgnore, prClear:
+	case prReserve, prRelease, prPreempt, prPreemptAbort:
+		if scope != 0 || !t.valid() {
+			return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+		}
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidCDBField)
+	}
+	if int(binary.BigEndian.Uint32(cdb[5:9])) != prParamsLength || len(params) != prParamsLength {
+		return checkCondition(senseIllegalRequest, ascParamListLength)
+	}
+	resKey := binary.BigEndian.Uint64(params[0:8])
+	saKey := binary.BigEndian.Uint64(params[8:16])
+	if params[20]&0x08 != 0 {
+		// Registering other initiator ports isn't supported.
+		return checkCondition(senseIllegalRequest, ascInvalidParam)
+	}
+
+	f := d.fence()
+	var next *PersistentReservations
+	_, err := d.Reservations.UpdatePersistentReservations(func(b []byte) ([]byte, error) {
+		r, err := ParsePersistentReservations(b)
+		if err != nil {
+			return nil, err
+		}
+		if res := r.apply(initiator, action, t, resKey, saKey); res != nil {
+			return nil, prResult(*res)
+		}
+		next = r
+		return r.encode()
+	})
+	if res, ok := err.(prResult); ok {
+		return Result(res)
+	}
+	if err != nil {
+		log.Printf("scsi: %s: updating persistent reservations: %s", d.Serial, err)
+		return checkCondition(senseHardwareError, ascInternalFailure)
+	}
+	f.set(next)
+	return good(nil)
+}
+
+// apply applies the PERSISTENT RESERVE OUT service action to r, returning
+// the result if it fails.
+func (r *PersistentReservations) apply(initiator string, action byte, t ReservationType, resKey, saKey uint64) *Result {
+	conflict := reservationConflict()
+	key, registered := r.key(initiator)
+	if action != prRegisterIgnore && (registered && resKey != key || !registered && resKey != 0) {
+		return &conflict
+	}
+
+	switch action {
+	case prRegister, prRegisterIgnore:
+		switch {
+		case saKey == 0 && !registered:
+		case saKey == 0:
+			r.unregister(func(reg Registration) bool { return reg.Initiator == initiator })
+			r.Generation++
+		case !registered:
+			r.Registrations = append(r.Registrations, Registration{initiator, saKey})
+			r.Generation++
+		default:
+			for i := range r.Registrations {
+				if r.Registrations[i].Initiator == initiator {
+					r.Registrations[i].Key = saKey
+				}
+			}
+			r.Generation++
+		}
+		return nil
+	}
+
+	if !registered {
+		return &conflict
+	}
+	switch action {
+	case prReserve:
+		switch {
+		case r.Type == 0:
+			r.reserve(initiator, t)
+		case !r.holds(initiator) || r.Type != t:
+			return &conflict
+		}
+	case prRelease:
+		if !r.holds(initiator) {
+			return nil
+		}
+		if r.Type != t {
+			res := checkCondition(senseIllegalRequest, ascInvalidRelease)
+			return &res
+		}
+		r.Type, r.Holder = 0, ""
+	case prClear:
+		r.Registrations = nil
+		r.Type, r.Holder = 0, ""
+		r.Generation++
+	case prPreempt, prPreemptAbort:
+		if r.Type.allRegistrants() && saKey == 0 {
+			// Everyone else is dropped, and the reservation
+			// replaced.
+			r.unregister(func(reg Registration) bool { return reg.Initiator != initiator })
+			r.reserve(initiator, t)
+			r.Generation++
+			return nil
+		}
+		holderKey, _ := r.key(r.Holder)
+		if r.Type == 0 || r.Type.allRegistrants() || holderKey != saKey {
+			// Only registrations are removed.
+			if saKey == 0 {
+				res := checkCondition(senseIllegalRequest, ascInvalidParam)
+				return &res
+			}
+			if r.unregister(func(reg Registration) bool { return reg.Key == saKey }) == 0 {
+				return &conflict
+			}
+			r.Generation++
+			return nil
+		}
+		r.unregister(func(reg Registration) bool {
+			return reg.Key == saKey && reg.Initiator != initiator
+		})
+		r.reserve(initiator, t)
+		r.Generation++
+	}
+	return nil
+}
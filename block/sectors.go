@@ -0,0 +1,75 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SectorFormat describes the sector geometry a volume is exported with.
+type SectorFormat int
+
+const (
+	// Sector512 advertises 512 byte logical and physical sectors.
+	Sector512 SectorFormat = iota
+	// Sector512e advertises 512 byte logical sectors on top of 4096 byte
+	// physical sectors (512-byte emulation).
+	Sector512e
+	// Sector4Kn advertises 4096 byte logical and physical sectors.
+	Sector4Kn
+)
+
+func ParseSectorFormat(s string) (SectorFormat, error) {
+	switch s {
+	case "", "512":
+		return Sector512, nil
+	case "512e":
+		return Sector512e, nil
+	case "4k", "4kn", "4096":
+		return Sector4Kn, nil
+	}
+	return Sector512, fmt.Errorf("block: unknown sector format %q (try \"512\", \"512e\" or \"4kn\")", s)
+}
+
+func (f SectorFormat) String() string {
+	switch f {
+	case Sector512:
+		return "512"
+	case Sector512e:
+		return "512e"
+	case Sector4Kn:
+		return "4kn"
+	}
+	return "unknown"
+}
+
+func (f SectorFormat) LogicalSize() uint64 {
+	if f == Sector4Kn {
+		return 4096
+	}
+	return 512
+}
+
+func (f SectorFormat) PhysicalSize() uint64 {
+	if f == Sector512 {
+		return 512
+	}
+	return 4096
+}
+
+// CheckSectorFormat verifies that the volume can be exported with the given
+// sector format. A physical sector that doesn't evenly divide the torus block
+// size would have guests issuing writes which straddle blocks, turning every
+// aligned write into a read-modify-write.
+func (s *BlockVolume) CheckSectorFormat(f SectorFormat) error {
+	gmd, err := s.mds.GlobalMetadata()
+	if err != nil {
+		return err
+	}
+	if gmd.BlockSize%f.PhysicalSize() != 0 {
+		return fmt.Errorf("block: block size %d is not a multiple of the %d byte physical sector", gmd.BlockSize, f.PhysicalSize())
+	}
+	if s.volume.MaxBytes%f.LogicalSize() != 0 {
+		return errors.New("block: volume size is not a whole number of logical sectors")
+	}
+	return nil
+}
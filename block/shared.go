@@ -0,0 +1,411 @@
+package block
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+// ErrNotShared is returned when a volume which wasn't created shared is
+// opened as one.
+var ErrNotShared = errors.New("block: volume isn't shared")
+
+// sharedRangeSize is the size of the ranges of a shared volume which are
+// leased to the hosts writing them.
+const sharedRangeSize = 1 << 20
+
+// sharedRangeIdle is how long a host keeps the lease on a range after it
+// stops writing there, in case it writes there again.
+const sharedRangeIdle = 100 * time.Millisecond
+
+// sharedWaitTimeout is the longest a change to a shared volume waits for the
+// ranges it writes, or to be committed.
+const sharedWaitTimeout = 30 * time.Second
+
+// sharedFile is the state of a BlockFile attached to a shared volume.
+type sharedFile struct {
+	// mut guards the BlockFile's File, which is replaced whenever
+	// another host has committed a change. Changes hold it shared while
+	// they write, and commits exclusively.
+	mut sync.RWMutex
+
+	// ctx is cancelled when the file is closed, ending any waits.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// rmut guards the rest.
+	rmut sync.Mutex
+	// ranges holds the ranges leased to this host, by number.
+	ranges map[uint64]*sharedRange
+	// queue holds the changes waiting to be committed. While committing
+	// is set, a change committing them takes any queued since with it.
+	queue      []*sharedWrite
+	committing bool
+}
+
+type sharedRange struct {
+	// users counts the changes writing the range. Once there are none,
+	// idle releases the lease.
+	users int
+	idle  *time.Timer
+	// taken is closed once the lease has been taken, or err set.
+	taken chan struct{}
+	err   error
+}
+
+// sharedWrite is a change written to file, waiting to be committed.
+type sharedWrite struct {
+	fn   func() error
+	file *torus.File
+	done chan error
+}
+
+// OpenSharedBlockFile opens a shared volume read-write without holding its
+// lock, so that it may be attached on several hosts at once. Each write or
+// trim takes the volume lock only for as long as it runs: it catches up
+// with what the other hosts have committed, and commits its change before
+// returning. Reads first check for changes committed elsewhere. Every write
+// is therefore as durable as a synced one, and seen by reads anywhere once
+// it has returned, as a cluster filesystem expects of a shared disk.
+//
+// Writers lease the ranges of the volume they write, so that hosts writing
+// different ranges write at once, and only take the volume lock to commit.
+// A host's changes waiting to be committed are committed together.
+//
+// Other than ReadAt, WriteAt, Trim, Sync, RefreshSize and Close, the file's
+// methods mustn't be used while it is being read or written.
+func (s *BlockVolume) OpenSharedBlockFile() (*BlockFile, error) {
+	if s.volume.Type != VolumeType {
+		panic("wrong type")
+	}
+	opts, err := s.mds.GetVolumeOptions()
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Shared {
+		return nil, ErrNotShared
+	}
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.openINode(ref)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.shared = &sharedFile{
+		ctx:    ctx,
+		cancel: cancel,
+		ranges: make(map[uint64]*sharedRange),
+	}
+	if _, err := f.RefreshSize(); err != nil {
+		cancel()
+		f.File.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenAttachment opens the volume read-write for an export: with
+// OpenSharedBlockFile if it is shared, and otherwise with OpenBlockFile.
+func (s *BlockVolume) OpenAttachment() (*BlockFile, error) {
+	opts, err := s.mds.GetVolumeOptions()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Shared {
+		return s.OpenSharedBlockFile()
+	}
+	return s.OpenBlockFile()
+}
+
+// catchUp moves f to the version of the volume last committed, if another
+// host has committed one since. f.shared.mut must be held exclusively.
+func (f *BlockFile) catchUp() error {
+	ref, err := f.vol.mds.GetINode()
+	if err != nil {
+		return err
+	}
+	if ref.Equals(f.INodeRef()) {
+		return nil
+	}
+	nf, err := f.vol.openINode(ref)
+	if err != nil {
+		return err
+	}
+	old := f.File
+	f.File = nf.File
+	// Anything old had written but not committed is dropped with it.
+	return old.Close()
+}
+
+// sharedChange makes a change to a shared volume with fn, which writes
+// length bytes at off, and commits it. It leases the ranges written for the
+// while, so that no other host writes them at once, then makes the change to
+// the version of the volume it has, and commits it with any other changes
+// waiting. If another host has committed since, the change is made again to
+// the volume as that host left it before it's committed. A negative length
+// changes the volume as a whole, leasing nothing.
+func (f *BlockFile) sharedChange(off, length int64, fn func() error) error {
+	ctx, cancel := context.WithTimeout(f.shared.ctx, sharedWaitTimeout)
+	defer cancel()
+	if length >= 0 {
+		from := uint64(off) / sharedRangeSize
+		to := from
+		if length > 0 {
+			to = uint64(off+length-1) / sharedRangeSize
+		}
+		var leased []*sharedRange
+		defer func() {
+			for i, r := range leased {
+				f.unleaseRange(from+uint64(i), r)
+			}
+		}()
+		for n := from; n <= to; n++ {
+			r, err := f.leaseRange(ctx, n)
+			if err != nil {
+				return err
+			}
+			leased = append(leased, r)
+		}
+	}
+	f.shared.mut.RLock()
+	w := &sharedWrite{fn: fn, file: f.File, done: make(chan error, 1)}
+	err := fn()
+	f.shared.mut.RUnlock()
+	if err != nil {
+		return err
+	}
+	return f.sharedCommit(w)
+}
+
+// leaseRange takes the lease on range n for a change, waiting for another
+// host to let it go if need be. The ranges are always leased in order, so
+// that hosts waiting for each other's ranges don't deadlock.
+func (f *BlockFile) leaseRange(ctx context.Context, n uint64) (*sharedRange, error) {
+	s := f.shared
+	s.rmut.Lock()
+	r, ok := s.ranges[n]
+	if ok {
+		r.users++
+		if r.idle != nil {
+			r.idle.Stop()
+			r.idle = nil
+		}
+		s.rmut.Unlock()
+		select {
+		case <-r.taken:
+		case <-ctx.Done():
+			f.unleaseRange(n, r)
+			return nil, ctx.Err()
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r, nil
+	}
+	r = &sharedRange{users: 1, taken: make(chan struct{})}
+	s.ranges[n] = r
+	s.rmut.Unlock()
+	var err error
+	for {
+		err = f.vol.mds.LeaseRange(n, f.vol.srv.Lease())
+		if err != torus.ErrLocked {
+			break
+		}
+		if err = f.vol.mds.WaitRangeFree(ctx, n); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		s.rmut.Lock()
+		r.err = err
+		if s.ranges[n] == r {
+			delete(s.ranges, n)
+		}
+		s.rmut.Unlock()
+	}
+	close(r.taken)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// unleaseRange ends a change's use of range n, leased as r, whose lease is
+// released once it has been idle for a while.
+func (f *BlockFile) unleaseRange(n uint64, r *sharedRange) {
+	s := f.shared
+	s.rmut.Lock()
+	defer s.rmut.Unlock()
+	r.users--
+	if r.users > 0 || r.err != nil || s.ranges[n] != r {
+		return
+	}
+	r.idle = time.AfterFunc(sharedRangeIdle, func() {
+		s.rmut.Lock()
+		if s.ranges[n] != r || r.users > 0 {
+			s.rmut.Unlock()
+			return
+		}
+		delete(s.ranges, n)
+		s.rmut.Unlock()
+		if err := f.vol.mds.ReleaseRange(n); err != nil {
+			clog.Warningf("couldn't release range %d of volume %s: %v", n, f.vol.volume.Name, err)
+		}
+	})
+}
+
+// sharedCommit commits w, with any other changes waiting, unless a change
+// already committing takes it along.
+func (f *BlockFile) sharedCommit(w *sharedWrite) error {
+	s := f.shared
+	s.rmut.Lock()
+	s.queue = append(s.queue, w)
+	if s.committing {
+		s.rmut.Unlock()
+		return <-w.done
+	}
+	s.committing = true
+	for len(s.queue) != 0 {
+		batch := s.queue
+		s.queue = nil
+		s.rmut.Unlock()
+		err := f.commitShared(batch)
+		for _, x := range batch {
+			x.done <- err
+		}
+		s.rmut.Lock()
+	}
+	s.committing = false
+	s.rmut.Unlock()
+	return <-w.done
+}
+
+// commitShared commits a batch of changes as the only host changing the
+// volume: it waits for the volume lock, catches up, makes again any changes
+// made to an older version of the volume, and commits them, then lets the
+// lock go.
+func (f *BlockFile) commitShared(batch []*sharedWrite) error {
+	ctx, cancel := context.WithTimeout(f.shared.ctx, sharedWaitTimeout)
+	defer cancel()
+	f.shared.mut.Lock()
+	defer f.shared.mut.Unlock()
+	for {
+		err := f.vol.mds.Lock(f.vol.srv.Lease())
+		if err == nil {
+			break
+		}
+		if err != torus.ErrLocked {
+			return err
+		}
+		if err := f.vol.mds.WaitUnlocked(ctx); err != nil {
+			return err
+		}
+	}
+	err := f.catchUp()
+	for _, w := range batch {
+		if err == nil && w.file != f.File {
+			err = w.fn()
+		}
+	}
+	if err == nil && f.WriteOpen() {
+		err = f.File.SyncBlocks()
+		for err == nil {
+			var ref torus.INodeRef
+			ref, err = f.File.SyncINode(f.inodeContext())
+			if err == nil {
+				err = f.vol.mds.SyncINode(ref)
+			}
+			if err != nil {
+				break
+			}
+			// As in Sync.
+			var again bool
+			again, err = blockset.ConfirmDeduplicated(f.inodeContext(), f.File.Blocks())
+			if err != nil || !again {
+				break
+			}
+			err = f.File.SyncBlocks()
+		}
+	}
+	if uerr := f.vol.mds.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// closeShared ends any waits and releases the ranges leased to this host.
+func (f *BlockFile) closeShared() {
+	s := f.shared
+	s.cancel()
+	s.rmut.Lock()
+	ranges := s.ranges
+	s.ranges = make(map[uint64]*sharedRange)
+	s.rmut.Unlock()
+	for n, r := range ranges {
+		if r.idle != nil {
+			r.idle.Stop()
+		}
+		if r.err != nil {
+			continue
+		}
+		if err := f.vol.mds.ReleaseRange(n); err != nil {
+			clog.Warningf("couldn't release range %d of volume %s: %v", n, f.vol.volume.Name, err)
+		}
+	}
+}
+
+// sharedRead runs fn, which reads from f, once f has caught up with the
+// changes committed by other hosts.
+func (f *BlockFile) sharedRead(fn func()) error {
+	ref, err := f.vol.mds.GetINode()
+	if err != nil {
+		return err
+	}
+	f.shared.mut.RLock()
+	if ref.Equals(f.INodeRef()) {
+		fn()
+		f.shared.mut.RUnlock()
+		return nil
+	}
+	f.shared.mut.RUnlock()
+	f.shared.mut.Lock()
+	err = f.catchUp()
+	f.shared.mut.Unlock()
+	if err != nil {
+		return err
+	}
+	// Another host may have committed again in the meantime, but this
+	// read began before that.
+	f.shared.mut.RLock()
+	defer f.shared.mut.RUnlock()
+	fn()
+	return nil
+}
+
+// refreshSharedSize is RefreshSize for a shared volume, which any of its
+// hosts may extend.
+func (f *BlockFile) refreshSharedSize() (uint64, error) {
+	f.shared.mut.RLock()
+	cur := f.Size()
+	f.shared.mut.RUnlock()
+	size, err := f.vol.mds.GetVolumeSize()
+	if err != nil || size <= cur {
+		return cur, err
+	}
+	err = f.sharedChange(0, -1, func() error {
+		return f.File.Grow(int64(size))
+	})
+	if err != nil {
+		return cur, err
+	}
+	clog.Infof("volume %s grew to %d bytes", f.vol.volume.Name, size)
+	return size, nil
+}
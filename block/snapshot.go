@@ -0,0 +1,83 @@
+package block
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/torus"
+)
+
+// ParseAnnotation parses a KEY=VALUE snapshot annotation. Keys follow the
+// same rules as labels; values may be any text.
+func ParseAnnotation(s string) (key, value string, err error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("annotation %q must be KEY=VALUE", s)
+	}
+	if !labelRegexp.MatchString(kv[0]) {
+		return "", "", fmt.Errorf("invalid annotation key %q", kv[0])
+	}
+	return kv[0], kv[1], nil
+}
+
+// SaveSnapshot snapshots the current state of a volume under name, recording
+// annotations with it. The volume need not be attached.
+func SaveSnapshot(mds torus.MetadataService, volume, name string, annotations map[string]string) error {
+	if name == "" {
+		return fmt.Errorf("snapshot name cannot be empty")
+	}
+	for k := range annotations {
+		if !labelRegexp.MatchString(k) {
+			return fmt.Errorf("invalid annotation key %q", k)
+		}
+	}
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.SaveSnapshot(name, annotations)
+}
+
+// GetSnapshots returns the snapshots of a volume, ordered by name.
+func GetSnapshots(mds torus.MetadataService, volume string) ([]Snapshot, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := bmds.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(snapshotsByName(snaps))
+	return snaps, nil
+}
+
+// DeleteSnapshot deletes a snapshot of a volume. Its blocks are collected
+// once nothing else refers to them.
+func DeleteSnapshot(mds torus.MetadataService, volume, name string) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.DeleteSnapshot(name)
+}
+
+// RollbackSnapshot atomically returns a volume to the state it was in when
+// the named snapshot was taken, discarding whatever was written since. It
+// fails with torus.ErrLocked if the volume is attached, unless force is set:
+// then the volume's lock is broken, so that the host which has it attached
+// can't write to it again, and should detach it. The snapshot is kept.
+func RollbackSnapshot(mds torus.MetadataService, volume, name string, force bool) error {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.RollbackSnapshot(name, force)
+}
+
+type snapshotsByName []Snapshot
+
+func (s snapshotsByName) Len() int           { return len(s) }
+func (s snapshotsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s snapshotsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
@@ -0,0 +1,264 @@
+package block
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// autoSnapshotPrefix starts the name of every snapshot taken by a policy.
+// Snapshots without it are never pruned.
+const autoSnapshotPrefix = "auto-"
+
+const autoSnapshotTimeFormat = "20060102T150405Z"
+
+var namedSnapshotIntervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// SnapshotSchedule takes a snapshot every Interval, or whenever the cron
+// expression Cron matches if it is set, and keeps the most recent Keep of
+// them.
+type SnapshotSchedule struct {
+	Name     string        `json:"name"`
+	Interval time.Duration `json:"interval"`
+	Cron     string        `json:"cron,omitempty"`
+	Keep     int           `json:"keep"`
+}
+
+// SnapshotPolicy is the set of schedules for a volume.
+type SnapshotPolicy struct {
+	Schedules []SnapshotSchedule `json:"schedules"`
+}
+
+// ParseSnapshotSchedule parses a schedule of the form INTERVAL=KEEP, where
+// INTERVAL is one of hourly, daily, weekly or a duration such as 15m, or of
+// the form NAME@CRON=KEEP, where CRON is a five field cron expression in UTC
+// such as "30 2 * * 1-5".
+func ParseSnapshotSchedule(s string) (SnapshotSchedule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return SnapshotSchedule{}, fmt.Errorf("schedule %q is not of the form INTERVAL=KEEP or NAME@CRON=KEEP", s)
+	}
+	keep, err := strconv.Atoi(parts[1])
+	if err != nil || keep < 1 {
+		return SnapshotSchedule{}, fmt.Errorf("invalid number of snapshots to keep %q", parts[1])
+	}
+	name := parts[0]
+	if i := strings.Index(name, "@"); i >= 0 {
+		return parseCronSnapshotSchedule(name[:i], name[i+1:], keep)
+	}
+	interval, ok := namedSnapshotIntervals[name]
+	if !ok {
+		var err error
+		interval, err = time.ParseDuration(name)
+		if err != nil {
+			return SnapshotSchedule{}, fmt.Errorf("unknown snapshot interval %q", name)
+		}
+		if interval < time.Minute {
+			return SnapshotSchedule{}, fmt.Errorf("snapshot interval %s is shorter than a minute", interval)
+		}
+		name = interval.String()
+	}
+	return SnapshotSchedule{
+		Name:     name,
+		Interval: interval,
+		Keep:     keep,
+	}, nil
+}
+
+func parseCronSnapshotSchedule(name, spec string, keep int) (SnapshotSchedule, error) {
+	// Snapshots are matched to their schedule by name prefix, so a name
+	// mustn't be able to extend another's.
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_')
+	}) >= 0 {
+		return SnapshotSchedule{}, fmt.Errorf("schedule name %q must be letters, digits and underscores", name)
+	}
+	if _, ok := namedSnapshotIntervals[name]; ok {
+		return SnapshotSchedule{}, fmt.Errorf("schedule name %q is taken by an interval", name)
+	}
+	c, err := parseCronSpec(spec)
+	if err != nil {
+		return SnapshotSchedule{}, err
+	}
+	if c.prev(time.Now()).IsZero() {
+		return SnapshotSchedule{}, fmt.Errorf("cron spec %q never matches", spec)
+	}
+	return SnapshotSchedule{
+		Name: name,
+		Cron: strings.Join(strings.Fields(spec), " "),
+		Keep: keep,
+	}, nil
+}
+
+func (s SnapshotSchedule) String() string {
+	if s.Cron != "" {
+		return fmt.Sprintf("%s@%s=%d", s.Name, s.Cron, s.Keep)
+	}
+	return fmt.Sprintf("%s=%d", s.Name, s.Keep)
+}
+
+func (s SnapshotSchedule) prefix() string {
+	return autoSnapshotPrefix + s.Name + "-"
+}
+
+// snapshotName names the snapshot for the period containing t, which for a
+// cron schedule starts at its latest match. Every node running the schedule
+// agrees on the name, so only one of them succeeds in taking it.
+func (s SnapshotSchedule) snapshotName(t time.Time) (string, error) {
+	start := t.UTC().Truncate(s.Interval)
+	if s.Cron != "" {
+		c, err := parseCronSpec(s.Cron)
+		if err != nil {
+			return "", err
+		}
+		start = c.prev(t)
+		if start.IsZero() {
+			return "", fmt.Errorf("cron spec %q never matches", s.Cron)
+		}
+	}
+	return s.prefix() + start.Format(autoSnapshotTimeFormat), nil
+}
+
+// GetSnapshotPolicy returns the snapshot policy of the named volume. A volume
+// without one has an empty policy.
+func GetSnapshotPolicy(mds torus.MetadataService, volume string) (*SnapshotPolicy, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetSnapshotPolicy()
+}
+
+// SetSnapshotPolicy replaces the snapshot policy of the named volume.
+// Snapshots already taken under a schedule which is removed are kept.
+func SetSnapshotPolicy(mds torus.MetadataService, volume string, p *SnapshotPolicy) error {
+	seen := make(map[string]bool)
+	for _, s := range p.Schedules {
+		if seen[s.Name] {
+			return fmt.Errorf("duplicate snapshot schedule %q", s.Name)
+		}
+		seen[s.Name] = true
+	}
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.SetSnapshotPolicy(p)
+}
+
+func openBlockMetadata(mds torus.MetadataService, volume string) (blockMetadata, error) {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return nil, err
+	}
+	if vol.Type != VolumeType {
+		return nil, torus.ErrWrongVolumeType
+	}
+	return createBlockMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+}
+
+// RunSnapshotPolicy takes any snapshots due at time now under the volume's
+// policy and prunes those past their retention. It is safe to run
+// concurrently from several nodes.
+func (s *BlockVolume) RunSnapshotPolicy(now time.Time) error {
+	p, err := s.mds.GetSnapshotPolicy()
+	if err != nil {
+		return err
+	}
+	if len(p.Schedules) == 0 {
+		return nil
+	}
+	for _, sched := range p.Schedules {
+		name, err := sched.snapshotName(now)
+		if err != nil {
+			clog.Errorf("snapshot policy: volume %s: schedule %s: %v", s.volume.Name, sched.Name, err)
+			continue
+		}
+		err = s.mds.SaveSnapshot(name, nil)
+		switch err {
+		case nil:
+			clog.Infof("took scheduled snapshot %s of volume %s", name, s.volume.Name)
+		case torus.ErrExists:
+			// Already taken for this period, by us or another node.
+		default:
+			return err
+		}
+	}
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, sched := range p.Schedules {
+		var names []string
+		for _, x := range snaps {
+			if strings.HasPrefix(x.Name, sched.prefix()) {
+				names = append(names, x.Name)
+			}
+		}
+		if len(names) <= sched.Keep {
+			continue
+		}
+		// The timestamps sort lexically, oldest first.
+		sort.Strings(names)
+		for _, name := range names[:len(names)-sched.Keep] {
+			err := s.mds.DeleteSnapshot(name)
+			switch err {
+			case nil:
+				clog.Infof("pruned scheduled snapshot %s of volume %s", name, s.volume.Name)
+			case torus.ErrNotExist, torus.ErrLocked:
+				// Someone else pruned it first.
+			default:
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunSnapshotPolicies runs the snapshot policy of every block volume in the
+// cluster, if this node is elected to. Errors on one volume are logged and
+// don't stop the others.
+func RunSnapshotPolicies(srv *torus.Server, now time.Time) error {
+	// A node without a lease can't hold the election, and runs the
+	// policies regardless; the snapshot names keep that safe.
+	if lease := srv.Lease(); lease != 0 {
+		bmds, err := createBlockMetadata(srv.MDS, "", 0)
+		if err != nil {
+			return err
+		}
+		elected, err := bmds.CampaignSnapshotScheduler(lease)
+		if err != nil {
+			return err
+		}
+		if !elected {
+			return nil
+		}
+	}
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range vols {
+		if v.Type != VolumeType {
+			continue
+		}
+		bv, err := OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			clog.Errorf("snapshot policy: couldn't open volume %s: %v", v.Name, err)
+			continue
+		}
+		err = bv.RunSnapshotPolicy(now)
+		if err != nil {
+			clog.Errorf("snapshot policy: volume %s: %v", v.Name, err)
+		}
+	}
+	return nil
+}
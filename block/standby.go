@@ -0,0 +1,245 @@
+package block
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// DefaultStandbyInterval is how often a Standby checks for a new version of
+// the volume it follows.
+const DefaultStandbyInterval = time.Second
+
+// maxWarmBlocks bounds how many changed blocks are pulled into the read
+// cache on each refresh, so a burst of writes on the active side doesn't
+// turn the standby into a full copy.
+const maxWarmBlocks = 1024
+
+// Standby follows a block volume without taking its lock. It serves
+// read-only views of the latest committed INode and warms the local read
+// cache with blocks that change, so that it can take over quickly when the
+// active writer goes away.
+type Standby struct {
+	vol      *BlockVolume
+	interval time.Duration
+
+	mut      sync.RWMutex
+	f        *BlockFile
+	ref      torus.INodeRef
+	promoted bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenStandby starts following the volume, checking for new versions every
+// interval.
+func (s *BlockVolume) OpenStandby(interval time.Duration) (*Standby, error) {
+	if interval <= 0 {
+		interval = DefaultStandbyInterval
+	}
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.openINode(ref)
+	if err != nil {
+		return nil, err
+	}
+	f.ReadOnly = true
+	sb := &Standby{
+		vol:      s,
+		interval: interval,
+		f:        f,
+		ref:      ref,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go sb.follow()
+	return sb, nil
+}
+
+func (sb *Standby) follow() {
+	defer close(sb.done)
+	t := time.NewTicker(sb.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-sb.stop:
+			return
+		case <-t.C:
+		}
+		err := sb.refresh()
+		if err != nil {
+			clog.Warningf("standby for %s: couldn't refresh: %v", sb.vol.volume.Name, err)
+		}
+	}
+}
+
+func (sb *Standby) refresh() error {
+	ref, err := sb.vol.mds.GetINode()
+	if err != nil {
+		return err
+	}
+	sb.mut.RLock()
+	cur := sb.ref
+	old := sb.f
+	sb.mut.RUnlock()
+	if ref.Equals(cur) {
+		return nil
+	}
+	f, err := sb.vol.openINode(ref)
+	if err != nil {
+		return err
+	}
+	f.ReadOnly = true
+	sb.warm(old.Blocks(), f.Blocks())
+
+	sb.mut.Lock()
+	if sb.promoted {
+		sb.mut.Unlock()
+		return f.Close()
+	}
+	sb.f = f
+	sb.ref = ref
+	sb.mut.Unlock()
+	clog.Debugf("standby for %s: now at inode %s", sb.vol.volume.Name, ref)
+	return old.Close()
+}
+
+// warm reads the blocks of next which differ from prev, so that they land in
+// the read cache before anyone asks for them.
+func (sb *Standby) warm(prev, next torus.Blockset) {
+	prevRefs := prev.GetAllBlockRefs()
+	nextRefs := next.GetAllBlockRefs()
+	n := 0
+	for i, ref := range nextRefs {
+		if n >= maxWarmBlocks {
+			clog.Debugf("standby for %s: warmed %d blocks, skipping the rest", sb.vol.volume.Name, n)
+			return
+		}
+		if ref.IsZero() {
+			continue
+		}
+		if i < len(prevRefs) && prevRefs[i] == ref {
+			continue
+		}
+		_, err := next.GetBlock(sb.vol.getContext(), i)
+		if err != nil {
+			clog.Debugf("standby for %s: couldn't warm block %d: %v", sb.vol.volume.Name, i, err)
+		}
+		n++
+	}
+}
+
+// ReadAt reads from the most recently committed version of the volume.
+func (sb *Standby) ReadAt(p []byte, off int64) (int, error) {
+	sb.mut.RLock()
+	defer sb.mut.RUnlock()
+	return sb.f.ReadAt(p, off)
+}
+
+// File returns the file the standby is currently serving: a read-only view
+// until it is promoted, and the writable file afterwards.
+func (sb *Standby) File() *BlockFile {
+	sb.mut.RLock()
+	defer sb.mut.RUnlock()
+	return sb.f
+}
+
+// Promote turns the standby into the writer for the volume and returns the
+// writable file. If the volume is still locked, Promote fails with
+// torus.ErrLocked unless force is set, in which case the lock is taken from
+// its holder. The previous holder's next sync then fails, after which it
+// refuses further writes, so the two can never both commit.
+//
+// After Promote, the standby stops following the volume; closing the
+// returned file releases the lock.
+func (sb *Standby) Promote(force bool) (*BlockFile, error) {
+	sb.mut.Lock()
+	defer sb.mut.Unlock()
+	if sb.promoted {
+		return nil, torus.ErrInvalid
+	}
+	v := sb.vol
+	lease := v.srv.Lease()
+	err := v.mds.Lock(lease)
+	if err == torus.ErrLocked && force {
+		clog.Noticef("standby for %s: fencing the current holder", v.volume.Name)
+		err = v.mds.Fence(lease)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Now that nobody else can commit, reopen from whatever was last
+	// committed, which may be newer than what we've been following.
+	ref, err := v.mds.GetINode()
+	if err == nil {
+		var f *BlockFile
+		f, err = v.openINode(ref)
+		if err == nil {
+			err = sb.checkPromoted(f, ref)
+			if err != nil {
+				f.File.Close()
+			}
+		}
+		if err == nil {
+			sb.promoted = true
+			close(sb.stop)
+			sb.f.Close()
+			sb.f = f
+			sb.ref = ref
+			clog.Noticef("standby for %s: promoted at inode %s", v.volume.Name, ref)
+			return f, nil
+		}
+	}
+	v.mds.Unlock()
+	return nil, err
+}
+
+// checkPromoted sanity checks the INode a standby is about to start writing
+// to, committed at ref. It must be the INode stored there, and if it's the
+// one the standby has been following, it must hold the same blocks.
+func (sb *Standby) checkPromoted(f *BlockFile, ref torus.INodeRef) error {
+	name := sb.vol.volume.Name
+	if f.Size() != sb.vol.volume.MaxBytes {
+		clog.Errorf("standby for %s: inode is %d bytes, expected %d", name, f.Size(), sb.vol.volume.MaxBytes)
+		return torus.ErrInvalid
+	}
+	if got := f.INodeRef(); !got.Equals(ref) {
+		clog.Errorf("standby for %s: inode %s is stored as %s", name, ref, got)
+		return torus.ErrInvalid
+	}
+	if !ref.Equals(sb.ref) {
+		return nil
+	}
+	want := sb.f.Blocks().GetAllBlockRefs()
+	got := f.Blocks().GetAllBlockRefs()
+	if len(got) != len(want) {
+		clog.Errorf("standby for %s: inode %s has %d blocks, expected %d", name, ref, len(got), len(want))
+		return torus.ErrInvalid
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			clog.Errorf("standby for %s: inode %s has block %d at %s, expected %s", name, ref, i, got[i], want[i])
+			return torus.ErrInvalid
+		}
+	}
+	return nil
+}
+
+// Close stops following the volume. It does not close a file returned by
+// Promote.
+func (sb *Standby) Close() error {
+	sb.mut.Lock()
+	if sb.promoted {
+		sb.mut.Unlock()
+		return nil
+	}
+	sb.promoted = true
+	close(sb.stop)
+	sb.mut.Unlock()
+	<-sb.done
+	return sb.f.Close()
+}
@@ -0,0 +1,144 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/coreos/torus/block/scsi"
+)
+
+// Offsets into the mailbox at the start of the shared memory region.
+const (
+	mbCmdrOff  = 4
+	mbCmdrSize = 8
+	mbCmdHead  = 12
+	mbCmdTail  = 64
+)
+
+// Offsets into a command ring entry. The header is followed by the request,
+// which the kernel fills in, or by the response, which overwrites it.
+const (
+	entLenOp   = 0
+	entUFlags  = 7
+	entIovCnt  = 8
+	entCdbOff  = 24
+	entIovecs  = 48
+	entStatus  = 8
+	entSense   = 16
+	senseSize  = 96
+	iovecSize  = 16
+	opMask     = 0x7
+	opPad      = 0
+	opCmd      = 1
+	maxCDBSize = 16
+)
+
+// ring is the command ring shared with the kernel: a mailbox, the ring of
+// command entries, and the data area their iovecs point into. Offsets in
+// entries are relative to the start of mem.
+type ring struct {
+	mem []byte
+}
+
+func (r *ring) u32(off int) uint32 {
+	return binary.LittleEndian.Uint32(r.mem[off : off+4])
+}
+
+// head returns where the kernel will queue its next command.
+func (r *ring) head() uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.mem[mbCmdHead])))
+}
+
+func (r *ring) tail() uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.mem[mbCmdTail])))
+}
+
+// setTail hands back the entries before tail to the kernel.
+func (r *ring) setTail(tail uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&r.mem[mbCmdTail])), tail)
+}
+
+// process executes the commands queued on the ring against disk, returning
+// how many entries it completed.
+func (r *ring) process(disk *scsi.Disk) int {
+	cmdrOff := r.u32(mbCmdrOff)
+	cmdrSize := r.u32(mbCmdrSize)
+	head := r.head()
+	tail := r.tail()
+	n := 0
+	for tail != head {
+		ent := int(cmdrOff + tail)
+		lenOp := r.u32(ent + entLenOp)
+		if lenOp&^opMask == 0 {
+			// A corrupt entry; nothing after it can be found.
+			break
+		}
+		if lenOp&opMask == opCmd {
+			r.execute(ent, disk)
+		}
+		tail = (tail + lenOp&^opMask) % cmdrSize
+		n++
+	}
+	r.setTail(tail)
+	return n
+}
+
+// execute runs the command in the entry at ent and writes its response in
+// place.
+func (r *ring) execute(ent int, disk *scsi.Disk) {
+	iovs := r.iovecs(ent)
+	cdbOff := int(binary.LittleEndian.Uint64(r.mem[ent+entCdbOff:]))
+	end := cdbOff + maxCDBSize
+	if end > len(r.mem) {
+		end = len(r.mem)
+	}
+	cdb := r.mem[cdbOff:end]
+
+	var out []byte
+	if n := scsi.DataOutLength(cdb); n > 0 && !scsi.TransferTooLong(n) {
+		out = make([]byte, 0, n)
+		for _, iov := range iovs {
+			out = append(out, iov...)
+		}
+		if len(out) > n {
+			out = out[:n]
+		}
+	}
+	// LIO serves persistent reservations itself, without passing on
+	// the initiator, so commands are fenced as if from one which hasn't
+	// registered.
+	res := disk.Execute("", 0, cdb, out)
+	if res.Status == scsi.StatusGood {
+		data := res.Data
+		for _, iov := range iovs {
+			if len(data) == 0 {
+				break
+			}
+			data = data[copy(iov, data):]
+		}
+	}
+
+	r.mem[ent+entUFlags] = 0
+	for i := ent + entStatus; i < ent+entSense+senseSize; i++ {
+		r.mem[i] = 0
+	}
+	r.mem[ent+entStatus] = res.Status
+	copy(r.mem[ent+entSense:ent+entSense+senseSize], res.Sense)
+}
+
+// iovecs returns the data buffers of the entry at ent.
+func (r *ring) iovecs(ent int) [][]byte {
+	cnt := int(r.u32(ent + entIovCnt))
+	iovs := make([][]byte, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		off := ent + entIovecs + i*iovecSize
+		base := binary.LittleEndian.Uint64(r.mem[off:])
+		length := binary.LittleEndian.Uint64(r.mem[off+8:])
+		if base+length > uint64(len(r.mem)) {
+			continue
+		}
+		iovs = append(iovs, r.mem[base:base+length])
+	}
+	return iovs
+}
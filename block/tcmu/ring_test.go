@@ -0,0 +1,106 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/coreos/torus/block/scsi"
+)
+
+type memDevice []byte
+
+func (m memDevice) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(b []byte, off int64) (int, error) {
+	return copy(m[off:], b), nil
+}
+
+func (m memDevice) Sync() error { return nil }
+
+func (m memDevice) Trim(off, length int64) error {
+	for i := off; i < off+length; i++ {
+		m[i] = 0
+	}
+	return nil
+}
+
+// Layout of the test ring.
+const (
+	testCmdrOff  = 128
+	testCmdrSize = 1024
+	testDataOff  = testCmdrOff + testCmdrSize
+)
+
+// queue appends an entry to the ring as the kernel would, returning its
+// offset. Each iovec is given by its offset into mem and its length.
+func queue(r *ring, op uint32, cdb []byte, iovs ...[2]uint64) int {
+	head := r.u32(mbCmdHead)
+	ent := testCmdrOff + int(head)
+	// The entry's header and request or response, the iovecs, and the CDB.
+	base := entSense + senseSize + len(iovs)*iovecSize
+	length := uint32(base + maxCDBSize)
+	if op == opPad {
+		length = uint32(len(cdb))
+	}
+	binary.LittleEndian.PutUint32(r.mem[ent+entLenOp:], length|op)
+	if op == opCmd {
+		binary.LittleEndian.PutUint32(r.mem[ent+entIovCnt:], uint32(len(iovs)))
+		for i, iov := range iovs {
+			off := ent + entIovecs + i*iovecSize
+			binary.LittleEndian.PutUint64(r.mem[off:], iov[0])
+			binary.LittleEndian.PutUint64(r.mem[off+8:], iov[1])
+		}
+		cdbOff := ent + base
+		copy(r.mem[cdbOff:], cdb)
+		binary.LittleEndian.PutUint64(r.mem[ent+entCdbOff:], uint64(cdbOff))
+	}
+	binary.LittleEndian.PutUint32(r.mem[mbCmdHead:], (head+length)%testCmdrSize)
+	return ent
+}
+
+func TestRingProcess(t *testing.T) {
+	r := &ring{mem: make([]byte, testDataOff+4096)}
+	binary.LittleEndian.PutUint32(r.mem[mbCmdrOff:], testCmdrOff)
+	binary.LittleEndian.PutUint32(r.mem[mbCmdrSize:], testCmdrSize)
+	dev := make(memDevice, 1<<20)
+	disk := &scsi.Disk{Device: dev, Size: int64(len(dev)), Serial: "test"}
+
+	// WRITE (10) of two blocks at LBA 4, split over two iovecs.
+	payload := bytes.Repeat([]byte("torus!!!"), 128)
+	copy(r.mem[testDataOff:], payload)
+	write := queue(r, opCmd, []byte{0x2a, 0, 0, 0, 0, 4, 0, 0, 2, 0},
+		[2]uint64{testDataOff, 512}, [2]uint64{testDataOff + 512, 512})
+	// A pad, which must be skipped.
+	queue(r, opPad, make([]byte, 64))
+	// READ (10) of the same blocks into a single iovec.
+	read := queue(r, opCmd, []byte{0x28, 0, 0, 0, 0, 4, 0, 0, 2, 0},
+		[2]uint64{testDataOff + 2048, 1024})
+	// READ (10) past the end of the disk.
+	bad := queue(r, opCmd, []byte{0x28, 0, 0, 0, 0x08, 0, 0, 0, 1, 0},
+		[2]uint64{testDataOff + 2048, 512})
+
+	if n := r.process(disk); n != 4 {
+		t.Fatalf("processed %d entries, expected 4", n)
+	}
+	if r.tail() != r.head() {
+		t.Fatalf("tail %d wasn't moved to the head %d", r.tail(), r.head())
+	}
+	if r.mem[write+entStatus] != scsi.StatusGood {
+		t.Fatalf("write failed with status %#x", r.mem[write+entStatus])
+	}
+	if !bytes.Equal(dev[4*512:6*512], payload) {
+		t.Fatal("write didn't reach the device")
+	}
+	if r.mem[read+entStatus] != scsi.StatusGood {
+		t.Fatalf("read failed with status %#x", r.mem[read+entStatus])
+	}
+	if !bytes.Equal(r.mem[testDataOff+2048:testDataOff+3072], payload) {
+		t.Fatal("read didn't fill the iovec")
+	}
+	if r.mem[bad+entStatus] != scsi.StatusCheckCondition || r.mem[bad+entSense+12] != 0x21 {
+		t.Fatalf("read past the end answered with status %#x", r.mem[bad+entStatus])
+	}
+}
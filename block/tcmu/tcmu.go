@@ -0,0 +1,207 @@
+// Package tcmu registers torus block volumes with the kernel's LIO SCSI
+// target as TCMU (TCM in userspace) backstores. LIO handles the fabrics —
+// iSCSI, Fibre Channel, iSER, vhost-scsi or the loopback — along with
+// persistent reservations and ALUA, while commands for the backstore's data
+// are passed up to this process through a ring in shared memory and served
+// from the volume, as tcmu-runner does for its handlers.
+//
+// Backstores only need mapping to a fabric once registered, which is done
+// with targetcli or by writing to configfs as usual.
+package tcmu
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/torus/block/scsi"
+)
+
+// Subtype is the handler name backstores are configured with, the first
+// component of their dev_config.
+const Subtype = "torus"
+
+var (
+	// configfsCore is where LIO's backstores are configured.
+	configfsCore = "/sys/kernel/config/target/core"
+	// sysClassUIO is where Linux lists UIO devices, which TCMU creates
+	// for each backstore.
+	sysClassUIO = "/sys/class/uio"
+	devDir      = "/dev"
+
+	// uioTimeout is how long to wait for a backstore's UIO device to
+	// appear once it is enabled.
+	uioTimeout = 5 * time.Second
+)
+
+// ErrExported is returned by Close if the backstore can't be removed
+// because it is still exported as a LUN.
+var ErrExported = errors.New("tcmu: backstore is still exported by a target")
+
+// Backstore is a TCMU backstore whose commands are served from a disk.
+type Backstore struct {
+	Name string
+	Disk *scsi.Disk
+
+	dir  string
+	uio  *os.File
+	ring *ring
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Register creates the backstore user_<hba>/<name> and returns it, ready to
+// Serve. The kernel's target_core_user module must be loaded, and configfs
+// mounted.
+func Register(hba int, name string, disk *scsi.Disk) (*Backstore, error) {
+	if disk.Size < scsi.SectorSize {
+		return nil, fmt.Errorf("tcmu: %s is too small", name)
+	}
+	if strings.ContainsAny(name, "/ ") {
+		return nil, fmt.Errorf("tcmu: invalid backstore name %q", name)
+	}
+	hbaName := "user_" + strconv.Itoa(hba)
+	dir := filepath.Join(configfsCore, hbaName, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("tcmu: can't create backstore %s: %s", name, err)
+	}
+	b := &Backstore{Name: name, Disk: disk, dir: dir}
+	err := b.setup(hbaName)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Backstore) setup(hbaName string) error {
+	config := Subtype + "/" + b.Name
+	control := []string{
+		"dev_config=" + config,
+		"dev_size=" + strconv.FormatInt(b.Disk.Size, 10),
+		"hw_block_size=" + strconv.Itoa(scsi.SectorSize),
+	}
+	for _, opt := range control {
+		if err := writeAttr(filepath.Join(b.dir, "control"), opt); err != nil {
+			return err
+		}
+	}
+	if err := writeAttr(filepath.Join(b.dir, "enable"), "1"); err != nil {
+		return err
+	}
+
+	uioName := strings.Join([]string{"tcm-user", strings.TrimPrefix(hbaName, "user_"), b.Name, config}, "/")
+	uio, err := findUIO(uioName)
+	if err != nil {
+		return err
+	}
+	size, err := readUint(filepath.Join(sysClassUIO, uio, "maps", "map0", "size"))
+	if err != nil {
+		return fmt.Errorf("tcmu: can't find the size of %s's ring: %s", b.Name, err)
+	}
+	f, err := os.OpenFile(filepath.Join(devDir, uio), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("tcmu: can't open %s's ring: %s", b.Name, err)
+	}
+	mem, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("tcmu: can't map %s's ring: %s", b.Name, err)
+	}
+	b.uio = f
+	b.ring = &ring{mem: mem}
+	return nil
+}
+
+// Serve executes the commands the kernel queues for the backstore until it
+// is closed.
+func (b *Backstore) Serve() error {
+	defer func() {
+		syscall.Munmap(b.ring.mem)
+		b.uio.Close()
+	}()
+	// Reading from the UIO device blocks until the kernel has queued
+	// commands; writing to it says they are done.
+	buf := make([]byte, 4)
+	for {
+		if b.ring.process(b.Disk) > 0 {
+			if _, err := b.uio.Write(buf); err != nil {
+				return b.closedOr(err)
+			}
+		}
+		if _, err := b.uio.Read(buf); err != nil {
+			return b.closedOr(err)
+		}
+	}
+}
+
+func (b *Backstore) closedOr(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	return fmt.Errorf("tcmu: %s: %s", b.Name, err)
+}
+
+// Close removes the backstore, which stops Serve. It fails with ErrExported
+// while the backstore is mapped to a LUN.
+func (b *Backstore) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	if err := syscall.Rmdir(b.dir); err != nil {
+		if err == syscall.EBUSY {
+			return ErrExported
+		}
+		return fmt.Errorf("tcmu: can't remove backstore %s: %s", b.Name, err)
+	}
+	b.closed = true
+	return nil
+}
+
+// findUIO returns the UIO device named name, waiting for it to appear.
+func findUIO(name string) (string, error) {
+	deadline := time.Now().Add(uioTimeout)
+	for {
+		devs, err := ioutil.ReadDir(sysClassUIO)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("tcmu: can't list UIO devices: %s", err)
+		}
+		for _, dev := range devs {
+			b, err := ioutil.ReadFile(filepath.Join(sysClassUIO, dev.Name(), "name"))
+			if err == nil && strings.TrimSpace(string(b)) == name {
+				return dev.Name(), nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("tcmu: no UIO device for %s; is target_core_user loaded?", name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func writeAttr(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("tcmu: can't write %s to %s: %s", value, path, err)
+	}
+	return nil
+}
+
+func readUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 0, 64)
+}
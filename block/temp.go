@@ -2,10 +2,14 @@ package block
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/metadata/temp"
 	"github.com/coreos/torus/models"
+	"golang.org/x/net/context"
 )
 
 type blockTempMetadata struct {
@@ -15,12 +19,25 @@ type blockTempMetadata struct {
 }
 
 type blockTempVolumeData struct {
-	locked string
-	id     torus.INodeRef
-	snaps  []Snapshot
+	locked     string
+	id         torus.INodeRef
+	snaps      []Snapshot
+	policy     SnapshotPolicy
+	tuning     VolumeTuning
+	mask       []string
+	holds      []string
+	config     string
+	prs        []byte
+	mirror     *Mirror
+	compaction *Compaction
+	opts       VolumeOptions
+	labels     map[string]string
+	desc       string
+	// ranges holds the node leasing each leased range.
+	ranges map[uint64]string
 }
 
-func (b *blockTempMetadata) CreateBlockVolume(volume *models.Volume) error {
+func (b *blockTempMetadata) CreateBlockVolume(volume *models.Volume, opts VolumeOptions) error {
 	b.LockData()
 	defer b.UnlockData()
 	_, ok := b.GetData(fmt.Sprint(volume.Id))
@@ -31,10 +48,96 @@ func (b *blockTempMetadata) CreateBlockVolume(volume *models.Volume) error {
 	b.SetData(fmt.Sprint(volume.Id), &blockTempVolumeData{
 		locked: "",
 		id:     torus.NewINodeRef(torus.VolumeID(volume.Id), 1),
+		opts:   opts,
+		labels: copyLabels(opts.Labels),
 	})
 	return nil
 }
 
+func (b *blockTempMetadata) GetVolumeOptions() (VolumeOptions, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return VolumeOptions{}, torus.ErrNotExist
+	}
+	return v.(*blockTempVolumeData).opts, nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string)
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+func (b *blockTempMetadata) GetVolumeSize() (uint64, error) {
+	vol, err := b.GetVolume(b.name)
+	if err != nil {
+		return 0, torus.ErrNotExist
+	}
+	return vol.MaxBytes, nil
+}
+
+func (b *blockTempMetadata) UpdateVolumeSize(fn func(cur uint64) (uint64, error)) (uint64, error) {
+	var cur, next uint64
+	err := b.UpdateVolume(b.name, func(v *models.Volume) error {
+		var err error
+		cur = v.MaxBytes
+		next, err = fn(cur)
+		v.MaxBytes = next
+		return err
+	})
+	if err != nil {
+		return cur, err
+	}
+	return next, nil
+}
+
+func (b *blockTempMetadata) GetLabels() (map[string]string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return copyLabels(v.(*blockTempVolumeData).labels), nil
+}
+
+func (b *blockTempMetadata) SetLabels(labels map[string]string) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	v.(*blockTempVolumeData).labels = copyLabels(labels)
+	return nil
+}
+
+// FindVolumes has no index to use in the temp metadata, and just checks every
+// volume.
+func (b *blockTempMetadata) FindVolumes(sel Selector) ([]string, error) {
+	vols, _, err := b.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	b.LockData()
+	defer b.UnlockData()
+	var out []string
+	for _, vol := range vols {
+		v, ok := b.GetData(fmt.Sprint(vol.Id))
+		if !ok {
+			continue
+		}
+		if sel.Matches(v.(*blockTempVolumeData).labels) {
+			out = append(out, vol.Name)
+		}
+	}
+	return out, nil
+}
+
 func (b *blockTempMetadata) Lock(lease int64) error {
 	b.LockData()
 	defer b.UnlockData()
@@ -50,6 +153,92 @@ func (b *blockTempMetadata) Lock(lease int64) error {
 	return nil
 }
 
+func (b *blockTempMetadata) Fence(lease int64) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	d.locked = b.UUID()
+	return nil
+}
+
+// waitFor blocks until done reports true, with the data lock held, or ctx is
+// done. The temp metadata service has no watches, so it polls.
+func (b *blockTempMetadata) waitFor(ctx context.Context, done func() (bool, error)) error {
+	for {
+		b.LockData()
+		ok, err := done()
+		b.UnlockData()
+		if ok || err != nil {
+			return err
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *blockTempMetadata) volumeData() (*blockTempVolumeData, error) {
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return v.(*blockTempVolumeData), nil
+}
+
+func (b *blockTempMetadata) WaitUnlocked(ctx context.Context) error {
+	return b.waitFor(ctx, func() (bool, error) {
+		d, err := b.volumeData()
+		return err == nil && d.locked == "", err
+	})
+}
+
+func (b *blockTempMetadata) LeaseRange(n uint64, lease int64) error {
+	b.LockData()
+	defer b.UnlockData()
+	d, err := b.volumeData()
+	if err != nil {
+		return err
+	}
+	if _, ok := d.ranges[n]; ok {
+		return torus.ErrLocked
+	}
+	if d.ranges == nil {
+		d.ranges = make(map[uint64]string)
+	}
+	d.ranges[n] = b.UUID()
+	return nil
+}
+
+func (b *blockTempMetadata) ReleaseRange(n uint64) error {
+	b.LockData()
+	defer b.UnlockData()
+	d, err := b.volumeData()
+	if err != nil {
+		return err
+	}
+	if d.ranges[n] == b.UUID() {
+		delete(d.ranges, n)
+	}
+	return nil
+}
+
+func (b *blockTempMetadata) WaitRangeFree(ctx context.Context, n uint64) error {
+	return b.waitFor(ctx, func() (bool, error) {
+		d, err := b.volumeData()
+		if err != nil {
+			return false, err
+		}
+		_, ok := d.ranges[n]
+		return !ok, nil
+	})
+}
+
 func (b *blockTempMetadata) GetINode() (torus.INodeRef, error) {
 	b.LockData()
 	defer b.UnlockData()
@@ -93,19 +282,22 @@ func (b *blockTempMetadata) Unlock() error {
 
 func (b *blockTempMetadata) DeleteVolume() error {
 	b.LockData()
-	defer b.UnlockData()
 	v, ok := b.GetData(fmt.Sprint(b.vid))
 	if !ok {
+		b.UnlockData()
 		return torus.ErrNotExist
 	}
-	d := v.(*blockTempVolumeData)
-	if d.locked != b.UUID() {
+	// As with etcd, attached volumes can't be deleted.
+	if v.(*blockTempVolumeData).locked != "" {
+		b.UnlockData()
 		return torus.ErrLocked
 	}
+	b.UnlockData()
+	// The client takes the data lock itself.
 	return b.Client.DeleteVolume(b.name)
 }
 
-func (b *blockTempMetadata) SaveSnapshot(name string) error {
+func (b *blockTempMetadata) SaveSnapshot(name string, annotations map[string]string) error {
 	b.LockData()
 	defer b.UnlockData()
 	v, ok := b.GetData(fmt.Sprint(b.vid))
@@ -119,12 +311,37 @@ func (b *blockTempMetadata) SaveSnapshot(name string) error {
 		}
 	}
 	snap := Snapshot{
-		Name:     name,
-		INodeRef: d.id.ToBytes(),
+		Name:        name,
+		INodeRef:    d.id.ToBytes(),
+		Annotations: annotations,
 	}
 	d.snaps = append(d.snaps, snap)
 	return nil
 }
+func (b *blockTempMetadata) RollbackSnapshot(name string, force bool) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	for _, x := range d.snaps {
+		if x.Name != name {
+			continue
+		}
+		if d.locked != "" {
+			if !force {
+				return torus.ErrLocked
+			}
+			d.locked = ""
+		}
+		d.id = torus.INodeRefFromBytes(x.INodeRef)
+		return nil
+	}
+	return torus.ErrNotExist
+}
+
 func (b *blockTempMetadata) GetSnapshots() ([]Snapshot, error) {
 	b.LockData()
 	defer b.UnlockData()
@@ -154,6 +371,34 @@ func (b *blockTempMetadata) DeleteSnapshot(name string) error {
 	return torus.ErrNotExist
 }
 
+func (b *blockTempMetadata) GetSnapshotPolicy() (*SnapshotPolicy, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	p := &SnapshotPolicy{
+		Schedules: make([]SnapshotSchedule, len(d.policy.Schedules)),
+	}
+	copy(p.Schedules, d.policy.Schedules)
+	return p, nil
+}
+
+func (b *blockTempMetadata) SetSnapshotPolicy(p *SnapshotPolicy) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	d.policy.Schedules = make([]SnapshotSchedule, len(p.Schedules))
+	copy(d.policy.Schedules, p.Schedules)
+	return nil
+}
+
 func createBlockTempMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (blockMetadata, error) {
 	if t, ok := mds.(*temp.Client); ok {
 		return &blockTempMetadata{
@@ -164,3 +409,957 @@ func createBlockTempMetadata(mds torus.MetadataService, name string, vid torus.V
 	}
 	panic("how are we creating a temp metadata that doesn't implement it but reports as being temp")
 }
+
+// checkpoints returns the checkpoints in the cluster, keyed by name. The data
+// lock must be held.
+func (b *blockTempMetadata) checkpoints() map[string]*Checkpoint {
+	v, ok := b.GetData("checkpoints")
+	if !ok {
+		v = make(map[string]*Checkpoint)
+		b.SetData("checkpoints", v)
+	}
+	return v.(map[string]*Checkpoint)
+}
+
+// aoeExports returns the AoE exports in the cluster, keyed by address. The
+// data lock must be held.
+func (b *blockTempMetadata) aoeExports() map[string]AoEExport {
+	v, ok := b.GetData("aoeexports")
+	if !ok {
+		v = make(map[string]AoEExport)
+		b.SetData("aoeexports", v)
+	}
+	return v.(map[string]AoEExport)
+}
+
+func (b *blockTempMetadata) RegisterAoEExport(e AoEExport, lease int64) error {
+	b.LockData()
+	defer b.UnlockData()
+	exports := b.aoeExports()
+	if _, ok := exports[e.Address()]; ok {
+		return torus.ErrExists
+	}
+	exports[e.Address()] = e
+	return nil
+}
+
+func (b *blockTempMetadata) UnregisterAoEExport(e AoEExport) error {
+	b.LockData()
+	defer b.UnlockData()
+	exports := b.aoeExports()
+	if cur, ok := exports[e.Address()]; ok && cur.Node == e.Node && cur.Volume == e.Volume {
+		delete(exports, e.Address())
+	}
+	return nil
+}
+
+func (b *blockTempMetadata) GetAoEExports() ([]AoEExport, error) {
+	b.LockData()
+	defer b.UnlockData()
+	var out []AoEExport
+	for _, e := range b.aoeExports() {
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (b *blockTempMetadata) WaitAoEExportFree(ctx context.Context, major uint16, minor uint8) error {
+	addr := AoEExport{Major: major, Minor: minor}.Address()
+	for {
+		b.LockData()
+		_, ok := b.aoeExports()[addr]
+		b.UnlockData()
+		if !ok {
+			return nil
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CampaignSnapshotScheduler elects the first node to ask. The temp metadata
+// service has no leases, so it stays elected.
+func (b *blockTempMetadata) CampaignSnapshotScheduler(lease int64) (bool, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData("snapshotscheduler")
+	if !ok {
+		b.SetData("snapshotscheduler", b.UUID())
+		return true, nil
+	}
+	return v.(string) == b.UUID(), nil
+}
+
+func (b *blockTempMetadata) SaveCheckpoint(name string, now time.Time) (*Checkpoint, error) {
+	vols, _, err := b.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	b.LockData()
+	defer b.UnlockData()
+	cps := b.checkpoints()
+	if _, ok := cps[name]; ok {
+		return nil, torus.ErrExists
+	}
+	c := &Checkpoint{
+		Name:    name,
+		Created: now,
+		Volumes: make(map[string][]byte),
+	}
+	var datas []*blockTempVolumeData
+	for _, vol := range vols {
+		v, ok := b.GetData(fmt.Sprint(vol.Id))
+		if !ok {
+			continue
+		}
+		d := v.(*blockTempVolumeData)
+		for _, x := range d.snaps {
+			if x.Name == c.SnapshotName() {
+				return nil, torus.ErrExists
+			}
+		}
+		c.Volumes[vol.Name] = d.id.ToBytes()
+		datas = append(datas, d)
+	}
+	for _, d := range datas {
+		d.snaps = append(d.snaps, Snapshot{
+			Name:     c.SnapshotName(),
+			INodeRef: d.id.ToBytes(),
+		})
+	}
+	cps[name] = c
+	return c, nil
+}
+
+func (b *blockTempMetadata) GetCheckpoints() ([]Checkpoint, error) {
+	b.LockData()
+	defer b.UnlockData()
+	var out []Checkpoint
+	for _, c := range b.checkpoints() {
+		out = append(out, *c)
+	}
+	return out, nil
+}
+
+func (b *blockTempMetadata) DeleteCheckpoint(name string) error {
+	b.LockData()
+	defer b.UnlockData()
+	cps := b.checkpoints()
+	c, ok := cps[name]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	for _, ino := range c.Volumes {
+		v, ok := b.GetData(fmt.Sprint(uint64(torus.INodeRefFromBytes(ino).Volume())))
+		if !ok {
+			continue
+		}
+		d := v.(*blockTempVolumeData)
+		for i, x := range d.snaps {
+			if x.Name == c.SnapshotName() {
+				d.snaps = append(d.snaps[:i], d.snaps[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(cps, name)
+	return nil
+}
+
+func (b *blockTempMetadata) RestoreCheckpoint(name string) ([]string, error) {
+	vols, _, err := b.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	// Deleting a volume leaves its data behind, so look for the volume
+	// itself.
+	exists := make(map[uint64]bool)
+	for _, vol := range vols {
+		exists[vol.Id] = true
+	}
+	b.LockData()
+	defer b.UnlockData()
+	c, ok := b.checkpoints()[name]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	var skipped []string
+	restore := make(map[*blockTempVolumeData]torus.INodeRef)
+	for vol, ino := range c.Volumes {
+		ref := torus.INodeRefFromBytes(ino)
+		v, ok := b.GetData(fmt.Sprint(uint64(ref.Volume())))
+		if !ok || !exists[uint64(ref.Volume())] {
+			skipped = append(skipped, vol)
+			continue
+		}
+		d := v.(*blockTempVolumeData)
+		if d.locked != "" {
+			return nil, torus.ErrLocked
+		}
+		restore[d] = ref
+	}
+	for d, ref := range restore {
+		d.id = ref
+	}
+	return skipped, nil
+}
+
+func (b *blockTempMetadata) GetVolumeTuning() (*VolumeTuning, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	t := v.(*blockTempVolumeData).tuning
+	return &t, nil
+}
+
+func (b *blockTempMetadata) GetMACMask() ([]string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return append([]string(nil), v.(*blockTempVolumeData).mask...), nil
+}
+
+func (b *blockTempMetadata) SetMACMask(mask []string) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	v.(*blockTempVolumeData).mask = append([]string(nil), mask...)
+	return nil
+}
+
+func (b *blockTempMetadata) GetReservation() ([]string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return append([]string(nil), v.(*blockTempVolumeData).holds...), nil
+}
+
+func (b *blockTempMetadata) UpdateReservation(fn func(cur []string) ([]string, error)) ([]string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	cur := append([]string(nil), d.holds...)
+	next, err := fn(cur)
+	if err != nil {
+		return cur, err
+	}
+	d.holds = append([]string(nil), next...)
+	return next, nil
+}
+
+func (b *blockTempMetadata) GetAoEConfig() (string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return "", torus.ErrNotExist
+	}
+	return v.(*blockTempVolumeData).config, nil
+}
+
+func (b *blockTempMetadata) UpdateAoEConfig(fn func(cur string) (string, error)) (string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return "", torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	next, err := fn(d.config)
+	if err != nil {
+		return d.config, err
+	}
+	d.config = next
+	return next, nil
+}
+
+func (b *blockTempMetadata) GetMirror() (*Mirror, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return v.(*blockTempVolumeData).mirror.copy(), nil
+}
+
+func (b *blockTempMetadata) UpdateMirror(fn func(cur *Mirror) (*Mirror, error)) (*Mirror, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	next, err := fn(d.mirror.copy())
+	if err != nil {
+		return d.mirror.copy(), err
+	}
+	d.mirror = next.copy()
+	return next, nil
+}
+
+func (b *blockTempMetadata) UpdateCompaction(fn func(cur *Compaction) (*Compaction, error)) (*Compaction, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d, err := b.volumeData()
+	if err != nil {
+		return nil, err
+	}
+	next, err := fn(d.compaction.copy())
+	if err != nil {
+		return d.compaction.copy(), err
+	}
+	d.compaction = next.copy()
+	return next, nil
+}
+
+func (b *blockTempMetadata) WaitCompaction(ctx context.Context, fn func(cur *Compaction) bool) (*Compaction, error) {
+	var cur *Compaction
+	err := b.waitFor(ctx, func() (bool, error) {
+		d, err := b.volumeData()
+		if err != nil {
+			return false, err
+		}
+		cur = d.compaction.copy()
+		return fn(cur), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+func (b *blockTempMetadata) GetPersistentReservations() ([]byte, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return append([]byte(nil), v.(*blockTempVolumeData).prs...), nil
+}
+
+func (b *blockTempMetadata) UpdatePersistentReservations(fn func(cur []byte) ([]byte, error)) ([]byte, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	cur := append([]byte(nil), d.prs...)
+	next, err := fn(cur)
+	if err != nil {
+		return cur, err
+	}
+	d.prs = append([]byte(nil), next...)
+	return next, nil
+}
+
+func (b *blockTempMetadata) SetVolumeTuning(t *VolumeTuning) error {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	v.(*blockTempVolumeData).tuning = *t
+	return nil
+}
+
+type blockTempBucket struct {
+	bucket  Bucket
+	objects map[string]Object
+	uploads map[string]Upload
+}
+
+// buckets returns the buckets in the cluster, keyed by name. The data lock
+// must be held.
+func (b *blockTempMetadata) buckets() map[string]*blockTempBucket {
+	v, ok := b.GetData("buckets")
+	if !ok {
+		v = make(map[string]*blockTempBucket)
+		b.SetData("buckets", v)
+	}
+	return v.(map[string]*blockTempBucket)
+}
+
+func copyUpload(u Upload) *Upload {
+	u.Parts = append([]ObjectPart(nil), u.Parts...)
+	return &u
+}
+
+func (b *blockTempMetadata) CreateBucket(bk Bucket) error {
+	b.LockData()
+	defer b.UnlockData()
+	buckets := b.buckets()
+	if _, ok := buckets[bk.Name]; ok {
+		return torus.ErrExists
+	}
+	buckets[bk.Name] = &blockTempBucket{
+		bucket:  bk,
+		objects: make(map[string]Object),
+		uploads: make(map[string]Upload),
+	}
+	return nil
+}
+
+func (b *blockTempMetadata) GetBucket(name string) (*Bucket, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, ok := b.buckets()[name]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	out := bk.bucket
+	return &out, nil
+}
+
+func (b *blockTempMetadata) GetBuckets() ([]Bucket, error) {
+	b.LockData()
+	defer b.UnlockData()
+	var out []Bucket
+	for _, bk := range b.buckets() {
+		out = append(out, bk.bucket)
+	}
+	return out, nil
+}
+
+func (b *blockTempMetadata) DeleteBucket(name string) error {
+	b.LockData()
+	defer b.UnlockData()
+	buckets := b.buckets()
+	bk, ok := buckets[name]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	if len(bk.objects) != 0 || len(bk.uploads) != 0 {
+		return ErrBucketNotEmpty
+	}
+	delete(buckets, name)
+	return nil
+}
+
+func (b *blockTempMetadata) GetObject(bucket, key string) (*Object, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, ok := b.buckets()[bucket]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	o, ok := bk.objects[key]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return &o, nil
+}
+
+func (b *blockTempMetadata) ListObjects(bucket, prefix, after string, max int) ([]Object, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, ok := b.buckets()[bucket]
+	if !ok {
+		return nil, nil
+	}
+	var keys []string
+	for k := range bk.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if max > 0 && len(keys) > max {
+		keys = keys[:max]
+	}
+	out := make([]Object, len(keys))
+	for i, k := range keys {
+		out[i] = bk.objects[k]
+	}
+	return out, nil
+}
+
+func (b *blockTempMetadata) PutObject(o *Object) (*Object, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, ok := b.buckets()[o.Bucket]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	old, ok := bk.objects[o.Key]
+	bk.objects[o.Key] = *o
+	if !ok {
+		return nil, nil
+	}
+	return &old, nil
+}
+
+func (b *blockTempMetadata) DeleteObject(bucket, key string) (*Object, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, ok := b.buckets()[bucket]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	o, ok := bk.objects[key]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	delete(bk.objects, key)
+	return &o, nil
+}
+
+func (b *blockTempMetadata) CreateUpload(u *Upload) error {
+	b.LockData()
+	defer b.UnlockData()
+	bk, ok := b.buckets()[u.Bucket]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	if _, ok := bk.uploads[u.ID]; ok {
+		return torus.ErrExists
+	}
+	bk.uploads[u.ID] = *copyUpload(*u)
+	return nil
+}
+
+// upload returns an upload. The data lock must be held.
+func (b *blockTempMetadata) upload(bucket, id string) (*blockTempBucket, *Upload, error) {
+	bk, ok := b.buckets()[bucket]
+	if !ok {
+		return nil, nil, torus.ErrNotExist
+	}
+	u, ok := bk.uploads[id]
+	if !ok {
+		return nil, nil, torus.ErrNotExist
+	}
+	return bk, copyUpload(u), nil
+}
+
+func (b *blockTempMetadata) GetUpload(bucket, id string) (*Upload, error) {
+	b.LockData()
+	defer b.UnlockData()
+	_, u, err := b.upload(bucket, id)
+	return u, err
+}
+
+func (b *blockTempMetadata) UpdateUpload(bucket, id string, fn func(u *Upload) error) (*Upload, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, u, err := b.upload(bucket, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(u); err != nil {
+		return nil, err
+	}
+	bk.uploads[id] = *copyUpload(*u)
+	return u, nil
+}
+
+func (b *blockTempMetadata) CompleteUpload(bucket, id string, fn func(u *Upload) (*Object, error)) (*Object, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, u, err := b.upload(bucket, id)
+	if err != nil {
+		return nil, err
+	}
+	o, err := fn(u)
+	if err != nil {
+		return nil, err
+	}
+	delete(bk.uploads, id)
+	old, ok := bk.objects[o.Key]
+	bk.objects[o.Key] = *o
+	if !ok {
+		return nil, nil
+	}
+	return &old, nil
+}
+
+func (b *blockTempMetadata) DeleteUpload(bucket, id string) (*Upload, error) {
+	b.LockData()
+	defer b.UnlockData()
+	bk, u, err := b.upload(bucket, id)
+	if err != nil {
+		return nil, err
+	}
+	delete(bk.uploads, id)
+	return u, nil
+}
+
+// groups returns the consistency groups in the cluster, keyed by name. The
+// data lock must be held.
+func (b *blockTempMetadata) groups() map[string]*ConsistencyGroup {
+	v, ok := b.GetData("consistencygroups")
+	if !ok {
+		v = make(map[string]*ConsistencyGroup)
+		b.SetData("consistencygroups", v)
+	}
+	return v.(map[string]*ConsistencyGroup)
+}
+
+func copyGroup(g ConsistencyGroup) *ConsistencyGroup {
+	g.Volumes = append([]string(nil), g.Volumes...)
+	return &g
+}
+
+func (b *blockTempMetadata) CreateConsistencyGroup(g ConsistencyGroup) error {
+	b.LockData()
+	defer b.UnlockData()
+	groups := b.groups()
+	if _, ok := groups[g.Name]; ok {
+		return torus.ErrExists
+	}
+	groups[g.Name] = copyGroup(g)
+	return nil
+}
+
+func (b *blockTempMetadata) GetConsistencyGroups() ([]ConsistencyGroup, error) {
+	b.LockData()
+	defer b.UnlockData()
+	var out []ConsistencyGroup
+	for _, g := range b.groups() {
+		out = append(out, *copyGroup(*g))
+	}
+	return out, nil
+}
+
+func (b *blockTempMetadata) UpdateConsistencyGroup(name string, fn func(g *ConsistencyGroup) error) (*ConsistencyGroup, error) {
+	b.LockData()
+	defer b.UnlockData()
+	groups := b.groups()
+	cur, ok := groups[name]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	g := copyGroup(*cur)
+	if err := fn(g); err != nil {
+		return nil, err
+	}
+	groups[name] = copyGroup(*g)
+	return g, nil
+}
+
+func (b *blockTempMetadata) DeleteConsistencyGroup(name string) error {
+	b.LockData()
+	defer b.UnlockData()
+	groups := b.groups()
+	if _, ok := groups[name]; !ok {
+		return torus.ErrNotExist
+	}
+	delete(groups, name)
+	return nil
+}
+
+func (b *blockTempMetadata) SaveGroupSnapshot(group, name string, annotations map[string]string) (int64, error) {
+	vols, _, err := b.GetVolumes()
+	if err != nil {
+		return 0, err
+	}
+	ids := make(map[string]uint64)
+	for _, vol := range vols {
+		ids[vol.Name] = vol.Id
+	}
+	b.LockData()
+	defer b.UnlockData()
+	g, ok := b.groups()[group]
+	if !ok {
+		return 0, torus.ErrNotExist
+	}
+	// The data lock is held throughout, so nothing is synced to any member
+	// until they've all been snapshotted.
+	var datas []*blockTempVolumeData
+	for _, vol := range g.Volumes {
+		id, ok := ids[vol]
+		if !ok {
+			return 0, fmt.Errorf("volume %s: %v", vol, torus.ErrNotExist)
+		}
+		v, ok := b.GetData(fmt.Sprint(id))
+		if !ok {
+			return 0, fmt.Errorf("volume %s is not a block volume", vol)
+		}
+		d := v.(*blockTempVolumeData)
+		for _, x := range d.snaps {
+			if x.Name == name {
+				return 0, torus.ErrExists
+			}
+		}
+		datas = append(datas, d)
+	}
+	for _, d := range datas {
+		d.snaps = append(d.snaps, Snapshot{
+			Name:        name,
+			INodeRef:    d.id.ToBytes(),
+			Annotations: annotations,
+		})
+	}
+	return 0, nil
+}
+
+// trash returns the volumes in the trash, keyed by ID. The data lock must be
+// held.
+func (b *blockTempMetadata) trash() map[uint64]*TrashedVolume {
+	v, ok := b.GetData("trash")
+	if !ok {
+		v = make(map[uint64]*TrashedVolume)
+		b.SetData("trash", v)
+	}
+	return v.(map[uint64]*TrashedVolume)
+}
+
+func (b *blockTempMetadata) TrashVolume(deleted, expires time.Time) error {
+	vol, err := b.GetVolume(b.name)
+	if err != nil {
+		return torus.ErrNotExist
+	}
+	b.LockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		b.UnlockData()
+		return torus.ErrNotExist
+	}
+	if v.(*blockTempVolumeData).locked != "" {
+		b.UnlockData()
+		return torus.ErrLocked
+	}
+	// The volume's data stays where it is, so that it can be restored as
+	// it was.
+	b.trash()[uint64(b.vid)] = &TrashedVolume{
+		Name:    b.name,
+		ID:      uint64(b.vid),
+		Size:    vol.MaxBytes,
+		Deleted: deleted,
+		Expires: expires,
+	}
+	b.UnlockData()
+	// The client takes the data lock itself, and only drops the name.
+	return b.Client.DeleteVolume(b.name)
+}
+
+func (b *blockTempMetadata) GetTrash() ([]TrashedVolume, error) {
+	b.LockData()
+	defer b.UnlockData()
+	var out []TrashedVolume
+	for _, t := range b.trash() {
+		out = append(out, *t)
+	}
+	return out, nil
+}
+
+func (b *blockTempMetadata) RestoreVolume(name string) error {
+	if _, err := b.GetVolume(name); err == nil {
+		return torus.ErrExists
+	}
+	b.LockData()
+	defer b.UnlockData()
+	trash := b.trash()
+	t, ok := trash[uint64(b.vid)]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	b.IndexVolume(t.volume(name))
+	delete(trash, uint64(b.vid))
+	return nil
+}
+
+func (b *blockTempMetadata) PurgeVolume() error {
+	b.LockData()
+	defer b.UnlockData()
+	trash := b.trash()
+	if _, ok := trash[uint64(b.vid)]; !ok {
+		return torus.ErrNotExist
+	}
+	// Nothing finds the volume's data by its ID once it's out of the
+	// trash, so it's left for the service to drop when it closes.
+	delete(trash, uint64(b.vid))
+	return nil
+}
+
+func (b *blockTempMetadata) GetDescription() (string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return "", torus.ErrNotExist
+	}
+	return v.(*blockTempVolumeData).desc, nil
+}
+
+func (b *blockTempMetadata) EditVolume(e VolumeEdit) error {
+	// The client takes the data lock itself.
+	vol, err := b.GetVolume(b.name)
+	if err != nil {
+		return torus.ErrNotExist
+	}
+	b.LockData()
+	defer b.UnlockData()
+	v, ok := b.GetData(fmt.Sprint(b.vid))
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d := v.(*blockTempVolumeData)
+	if e.Name != "" && e.Name != vol.Name {
+		if err := b.RenameVolume(vol.Name, e.Name); err != nil {
+			return err
+		}
+		for _, g := range b.groups() {
+			g.renameMember(vol.Name, e.Name)
+		}
+	}
+	if e.Labels != nil {
+		d.labels = copyLabels(e.Labels)
+	}
+	if e.Description != nil {
+		d.desc = *e.Description
+	}
+	return nil
+}
+
+// blockTempDedup holds the deduplication metadata of the cluster.
+type blockTempDedup struct {
+	content map[string]torus.BlockRef
+	// hashes maps the blocks in content back to their hashes.
+	hashes    map[torus.BlockRef]string
+	pins      map[torus.BlockRef]map[string]bool
+	condemned map[torus.BlockRef]time.Time
+	next      int
+}
+
+// dedup returns the cluster's deduplication metadata. The data lock must be
+// held.
+func (b *blockTempMetadata) dedup() *blockTempDedup {
+	v, ok := b.GetData("dedup")
+	if !ok {
+		v = &blockTempDedup{
+			content:   make(map[string]torus.BlockRef),
+			hashes:    make(map[torus.BlockRef]string),
+			pins:      make(map[torus.BlockRef]map[string]bool),
+			condemned: make(map[torus.BlockRef]time.Time),
+		}
+		b.SetData("dedup", v)
+	}
+	return v.(*blockTempDedup)
+}
+
+func (b *blockTempMetadata) LookupContent(hash []byte) (torus.BlockRef, bool, error) {
+	b.LockData()
+	defer b.UnlockData()
+	ref, ok := b.dedup().content[string(hash)]
+	return ref, ok, nil
+}
+
+func (b *blockTempMetadata) AddContent(hash []byte, ref torus.BlockRef) error {
+	b.LockData()
+	defer b.UnlockData()
+	d := b.dedup()
+	if _, ok := d.content[string(hash)]; !ok {
+		d.content[string(hash)] = ref
+		d.hashes[ref] = string(hash)
+	}
+	return nil
+}
+
+func (b *blockTempMetadata) ForgetContent(hash []byte, ref torus.BlockRef) error {
+	b.LockData()
+	defer b.UnlockData()
+	d := b.dedup()
+	if d.content[string(hash)] == ref {
+		delete(d.content, string(hash))
+		delete(d.hashes, ref)
+	}
+	return nil
+}
+
+// PinBlock pins ref until it's unpinned. The temp metadata service has no
+// leases.
+func (b *blockTempMetadata) PinBlock(ref torus.BlockRef, lease int64) (string, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d := b.dedup()
+	if _, ok := d.condemned[ref]; ok {
+		return "", torus.ErrBlockNotExist
+	}
+	if d.pins[ref] == nil {
+		d.pins[ref] = make(map[string]bool)
+	}
+	d.next++
+	pin := fmt.Sprint(d.next)
+	d.pins[ref][pin] = true
+	return pin, nil
+}
+
+func (b *blockTempMetadata) UnpinBlock(ref torus.BlockRef, pin string) error {
+	b.LockData()
+	defer b.UnlockData()
+	d := b.dedup()
+	delete(d.pins[ref], pin)
+	if len(d.pins[ref]) == 0 {
+		delete(d.pins, ref)
+	}
+	return nil
+}
+
+func (b *blockTempMetadata) CondemnBlock(ref torus.BlockRef, now time.Time) (bool, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d := b.dedup()
+	if _, ok := d.condemned[ref]; ok {
+		return true, nil
+	}
+	if len(d.pins[ref]) != 0 {
+		return false, nil
+	}
+	d.condemned[ref] = now
+	return true, nil
+}
+
+func (b *blockTempMetadata) GetCondemnedBlocks() (map[torus.BlockRef]time.Time, error) {
+	b.LockData()
+	defer b.UnlockData()
+	out := make(map[torus.BlockRef]time.Time)
+	for ref, t := range b.dedup().condemned {
+		out[ref] = t
+	}
+	return out, nil
+}
+
+func (b *blockTempMetadata) PardonBlock(ref torus.BlockRef) error {
+	b.LockData()
+	defer b.UnlockData()
+	delete(b.dedup().condemned, ref)
+	return nil
+}
+
+func (b *blockTempMetadata) CollectBlock(ref torus.BlockRef) error {
+	b.LockData()
+	defer b.UnlockData()
+	d := b.dedup()
+	if h, ok := d.hashes[ref]; ok {
+		if d.content[h] == ref {
+			delete(d.content, h)
+		}
+		delete(d.hashes, ref)
+	}
+	delete(d.condemned, ref)
+	return nil
+}
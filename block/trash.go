@@ -0,0 +1,162 @@
+package block
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/models"
+)
+
+// TrashedVolume is a block volume which has been deleted into the trash. Its
+// data, snapshots and settings are kept, and it can be restored, until it
+// expires and is purged.
+type TrashedVolume struct {
+	Name    string
+	ID      uint64
+	Size    uint64
+	Deleted time.Time
+	// Expires is when the volume is purged and its blocks collected.
+	Expires time.Time
+}
+
+func (t *TrashedVolume) volume(name string) *models.Volume {
+	return &models.Volume{
+		Name:     name,
+		Id:       t.ID,
+		Type:     VolumeType,
+		MaxBytes: t.Size,
+	}
+}
+
+// TrashBlockVolume deletes a block volume into the trash, where it's kept for
+// retain before being purged. Until then, RestoreBlockVolume brings it back,
+// and a new volume may be created with its name. Like DeleteBlockVolume, it
+// fails with torus.ErrLocked if the volume is attached.
+func TrashBlockVolume(mds torus.MetadataService, volume string, retain time.Duration) error {
+	if retain <= 0 {
+		return errors.New("trash retention must be positive")
+	}
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return err
+	}
+	bmds, err := createBlockMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return bmds.TrashVolume(now, now.Add(retain))
+}
+
+// GetTrash returns the block volumes in the trash, most recently deleted
+// first.
+func GetTrash(mds torus.MetadataService) ([]TrashedVolume, error) {
+	bmds, err := createBlockMetadata(mds, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	out, err := bmds.GetTrash()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(trashByDeleted(out))
+	return out, nil
+}
+
+// findTrash returns the most recently deleted volume called name in the
+// trash.
+func findTrash(mds torus.MetadataService, name string) (*TrashedVolume, error) {
+	trash, err := GetTrash(mds)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range trash {
+		if t.Name == name {
+			return &t, nil
+		}
+	}
+	return nil, torus.ErrNotExist
+}
+
+// RestoreBlockVolume brings the most recently deleted volume called name
+// back out of the trash as it was when it was deleted, snapshots, labels and
+// all, under the name as, or its own name if as is empty. It fails with
+// torus.ErrExists if a volume already has that name.
+func RestoreBlockVolume(mds torus.MetadataService, name, as string) error {
+	if as == "" {
+		as = name
+	}
+	t, err := findTrash(mds, name)
+	if err != nil {
+		return err
+	}
+	bmds, err := createBlockMetadata(mds, name, torus.VolumeID(t.ID))
+	if err != nil {
+		return err
+	}
+	return bmds.RestoreVolume(as)
+}
+
+// PurgeBlockVolume deletes the most recently deleted volume called name from
+// the trash for good, without waiting for it to expire.
+func PurgeBlockVolume(mds torus.MetadataService, name string) error {
+	t, err := findTrash(mds, name)
+	if err != nil {
+		return err
+	}
+	bmds, err := createBlockMetadata(mds, name, torus.VolumeID(t.ID))
+	if err != nil {
+		return err
+	}
+	return bmds.PurgeVolume()
+}
+
+// PurgeTrash purges the volumes in the trash which have expired by now, if
+// this node is elected to run snapshot policies.
+func PurgeTrash(srv *torus.Server, now time.Time) error {
+	bmds, err := createBlockMetadata(srv.MDS, "", 0)
+	if err != nil {
+		return err
+	}
+	// Purging twice is harmless, so a node without a lease purges
+	// regardless.
+	if lease := srv.Lease(); lease != 0 {
+		elected, err := bmds.CampaignSnapshotScheduler(lease)
+		if err != nil {
+			return err
+		}
+		if !elected {
+			return nil
+		}
+	}
+	trash, err := bmds.GetTrash()
+	if err != nil {
+		return err
+	}
+	for _, t := range trash {
+		if now.Before(t.Expires) {
+			continue
+		}
+		tmds, err := createBlockMetadata(srv.MDS, t.Name, torus.VolumeID(t.ID))
+		if err != nil {
+			return err
+		}
+		switch err := tmds.PurgeVolume(); err {
+		case nil:
+			clog.Infof("purged volume %s from the trash", t.Name)
+		case torus.ErrNotExist:
+			// Restored or purged under us.
+		default:
+			clog.Errorf("trash: couldn't purge volume %s: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+type trashByDeleted []TrashedVolume
+
+func (t trashByDeleted) Len() int           { return len(t) }
+func (t trashByDeleted) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t trashByDeleted) Less(i, j int) bool { return t[i].Deleted.After(t[j].Deleted) }
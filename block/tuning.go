@@ -0,0 +1,77 @@
+package block
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// tuningRefresh is how often an open volume picks up changes to its tuning.
+const tuningRefresh = 30 * time.Second
+
+// VolumeTuning holds a volume's IO pipeline settings. They can be changed at
+// any time; volumes which are attached pick the change up within
+// tuningRefresh.
+type VolumeTuning struct {
+	// ReadAhead is how many bytes past a sequential read to fetch in the
+	// background, up to torus.MaxReadAhead. Zero turns read-ahead off.
+	ReadAhead uint64 `json:"readahead,omitempty"`
+	// WriteWindow is how many bytes of written blocks may be stored in the
+	// background, after the write has returned but before the next sync,
+	// up to torus.MaxWriteBehind. Zero stores each block before its write
+	// returns.
+	WriteWindow uint64 `json:"write_window,omitempty"`
+	// IOPS and Bandwidth, in bytes a second, limit the reads and writes
+	// of each attachment of the volume, so that one busy volume can't
+	// starve the rest of the cluster. Zero leaves either unlimited.
+	IOPS      uint64 `json:"iops,omitempty"`
+	Bandwidth uint64 `json:"bandwidth,omitempty"`
+}
+
+// GetVolumeTuning returns a volume's tuning.
+func GetVolumeTuning(mds torus.MetadataService, volume string) (*VolumeTuning, error) {
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return nil, err
+	}
+	return bmds.GetVolumeTuning()
+}
+
+// SetVolumeTuning replaces a volume's tuning.
+func SetVolumeTuning(mds torus.MetadataService, volume string, t *VolumeTuning) error {
+	if t.ReadAhead > torus.MaxReadAhead {
+		return fmt.Errorf("readahead can be at most %d bytes", torus.MaxReadAhead)
+	}
+	if t.WriteWindow > torus.MaxWriteBehind {
+		return fmt.Errorf("write window can be at most %d bytes", torus.MaxWriteBehind)
+	}
+	bmds, err := openBlockMetadata(mds, volume)
+	if err != nil {
+		return err
+	}
+	return bmds.SetVolumeTuning(t)
+}
+
+// applyTuning reads the volume's tuning and applies it to f. If the tuning
+// can't be read, the current settings are kept. The error returned is from
+// storing blocks queued under the old write window.
+func (f *BlockFile) applyTuning() error {
+	f.tuned = time.Now()
+	t, err := f.vol.mds.GetVolumeTuning()
+	if err != nil {
+		clog.Warningf("couldn't get tuning of volume %s: %v", f.vol.volume.Name, err)
+		return nil
+	}
+	f.SetReadAhead(t.ReadAhead)
+	f.throttle.set(t.IOPS, t.Bandwidth)
+	return f.SetWriteBehind(t.WriteWindow)
+}
+
+// refreshTuning applies the volume's tuning if it hasn't been for a while.
+func (f *BlockFile) refreshTuning() error {
+	if time.Since(f.tuned) < tuningRefresh {
+		return nil
+	}
+	return f.applyTuning()
+}
@@ -0,0 +1,106 @@
+package block
+
+import (
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+)
+
+// VolumeUsage compares the space a block volume was provisioned with to the
+// space its blocks take up. Blocks are allocated as they're first written, so
+// a volume usually takes up far less than its size.
+type VolumeUsage struct {
+	// Provisioned is the size of the volume.
+	Provisioned uint64
+	// Allocated is the size of the blocks the volume refers to now.
+	Allocated uint64
+	// Compressed is what Allocated comes to once the blocks are compressed.
+	// It's the same as Allocated for volumes which aren't compressed.
+	Compressed uint64
+	// Snapshots is the size of the blocks which only its snapshots refer
+	// to, and which are freed when they are deleted.
+	Snapshots uint64
+}
+
+// Usage works out how much space the volume takes up. Each block is counted
+// once, at the cluster's block size, before replication but with the parity
+// of erasure coding. A clone counts the blocks it still shares with the
+// volume it was cloned from.
+func (s *BlockVolume) Usage() (*VolumeUsage, error) {
+	gmd, err := s.mds.GlobalMetadata()
+	if err != nil {
+		return nil, err
+	}
+	size, err := s.mds.GetVolumeSize()
+	if err != nil {
+		return nil, err
+	}
+	u := &VolumeUsage{Provisioned: size}
+	ref, err := s.mds.GetINode()
+	if err != nil {
+		return nil, err
+	}
+	cur, err := s.blockRefs(ref)
+	if err != nil {
+		return nil, err
+	}
+	u.Allocated = uint64(len(cur)) * gmd.BlockSize
+	for _, n := range cur {
+		if n == 0 {
+			n = gmd.BlockSize
+		}
+		u.Compressed += n
+	}
+	snaps, err := s.mds.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[torus.BlockRef]bool)
+	for _, x := range snaps {
+		refs, err := s.blockRefs(torus.INodeRefFromBytes(x.INodeRef))
+		if err != nil {
+			return nil, err
+		}
+		for r := range refs {
+			if _, ok := cur[r]; !ok {
+				held[r] = true
+			}
+		}
+	}
+	u.Snapshots = uint64(len(held)) * gmd.BlockSize
+	return u, nil
+}
+
+// blockRefs returns the allocated blocks of the volume's INode at ref, with
+// the length each is stored in once compressed, or zero if it isn't.
+func (s *BlockVolume) blockRefs(ref torus.INodeRef) (map[torus.BlockRef]uint64, error) {
+	out := make(map[torus.BlockRef]uint64)
+	if ref.INode <= 1 {
+		// Nothing has been written yet.
+		return out, nil
+	}
+	inode, err := s.srv.INodes.GetINode(s.getContext(), ref)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), nil)
+	if err != nil {
+		return nil, err
+	}
+	lens := blockset.StoredLengths(bs)
+	for i, r := range bs.GetAllBlockRefs() {
+		if r.IsZero() {
+			continue
+		}
+		out[r] = 0
+		if _, _, shard := r.Shard(); shard && i >= len(lens) {
+			// Erasure coding's parity isn't compressed.
+			continue
+		}
+		if len(lens) != 0 {
+			// A replication layer lists its copies after the
+			// blocks themselves, in the same order.
+			out[r] = uint64(lens[i%len(lens)])
+		}
+	}
+	return out, nil
+}
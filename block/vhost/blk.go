@@ -0,0 +1,258 @@
+package vhost
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+)
+
+// virtio-blk request types.
+const (
+	blkIn          = 0
+	blkOut         = 1
+	blkFlush       = 4
+	blkGetID       = 8
+	blkDiscard     = 11
+	blkWriteZeroes = 13
+)
+
+// virtio-blk request statuses.
+const (
+	statusOK     = 0
+	statusIOErr  = 1
+	statusUnsupp = 2
+)
+
+// SectorSize is the unit virtio-blk requests are addressed in.
+const SectorSize = 512
+
+// Limits this backend declares.
+const (
+	// maxSegments is the most data descriptors in a request.
+	maxSegments = 128
+	// maxDiscardSectors is the most sectors trimmed by one range of a
+	// discard or write zeroes request.
+	maxDiscardSectors = 1 << 22
+	// maxDiscardSegments is the most ranges in a discard or write
+	// zeroes request.
+	maxDiscardSegments = 64
+)
+
+// Device is the storage behind a Disk. A block.BlockFile is a Device.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Trim(off, length int64) error
+}
+
+// Disk is a virtio-blk device served from a Device.
+type Disk struct {
+	Device   Device
+	Size     int64
+	ReadOnly bool
+	// Serial is returned to the guest as the device's ID, and names it in
+	// logs.
+	Serial string
+	// PhysicalBlockSize, if larger than 512 bytes, is reported to the
+	// guest so that it aligns its IO to it.
+	PhysicalBlockSize int
+
+	// The device is shared by every virtqueue, and isn't safe for
+	// concurrent use.
+	mu sync.Mutex
+}
+
+// config returns the virtio-blk configuration space.
+func (d *Disk) config(queues int) []byte {
+	buf := make([]byte, 60)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(d.Size/SectorSize))
+	binary.LittleEndian.PutUint32(buf[12:16], maxSegments)
+	binary.LittleEndian.PutUint32(buf[20:24], SectorSize)
+	per := 1
+	if d.PhysicalBlockSize > SectorSize {
+		per = d.PhysicalBlockSize / SectorSize
+	}
+	for exp := uint(0); 1<<exp < per; exp++ {
+		buf[24] = byte(exp + 1)
+	}
+	binary.LittleEndian.PutUint16(buf[26:28], uint16(per))
+	buf[32] = 1 // writeback cache
+	binary.LittleEndian.PutUint16(buf[34:36], uint16(queues))
+	binary.LittleEndian.PutUint32(buf[36:40], maxDiscardSectors)
+	binary.LittleEndian.PutUint32(buf[40:44], maxDiscardSegments)
+	binary.LittleEndian.PutUint32(buf[44:48], uint32(per))
+	binary.LittleEndian.PutUint32(buf[48:52], maxDiscardSectors)
+	binary.LittleEndian.PutUint32(buf[52:56], maxDiscardSegments)
+	buf[56] = 1 // write zeroes may unmap
+	return buf
+}
+
+// serve executes the request whose descriptor chain starts at head,
+// returning how many bytes it wrote to the guest.
+func (d *Disk) serve(mem *memory, desc []byte, head, num uint16) (uint32, error) {
+	var out []byte
+	var in [][]byte
+	i := head
+	for n := 0; ; n++ {
+		if n >= int(num) || i >= num {
+			return 0, errRingBroken
+		}
+		e := desc[16*int(i):]
+		addr := binary.LittleEndian.Uint64(e[0:8])
+		length := binary.LittleEndian.Uint32(e[8:12])
+		flags := binary.LittleEndian.Uint16(e[12:14])
+		if flags&descIndirect != 0 {
+			return 0, errRingBroken
+		}
+		buf := mem.guest(addr, uint64(length))
+		if buf == nil {
+			return 0, errRingBroken
+		}
+		if flags&descWrite != 0 {
+			in = append(in, buf)
+		} else if len(in) > 0 {
+			// Readable buffers come first.
+			return 0, errRingBroken
+		} else {
+			out = append(out, buf...)
+		}
+		if flags&descNext == 0 {
+			break
+		}
+		i = binary.LittleEndian.Uint16(e[14:16])
+	}
+	if len(out) < 16 || len(in) == 0 || len(in[len(in)-1]) == 0 {
+		return 0, errRingBroken
+	}
+	last := in[len(in)-1]
+	status := &last[len(last)-1]
+	in[len(in)-1] = last[:len(last)-1]
+
+	typ := binary.LittleEndian.Uint32(out[0:4])
+	sector := binary.LittleEndian.Uint64(out[8:16])
+	data := out[16:]
+	var written uint32
+	switch typ {
+	case blkIn:
+		n := 0
+		for _, b := range in {
+			n += len(b)
+		}
+		buf, st := d.read(sector, n)
+		*status = st
+		if st == statusOK {
+			for _, b := range in {
+				buf = buf[copy(b, buf):]
+			}
+			written = uint32(n)
+		}
+	case blkOut:
+		*status = d.write(sector, data)
+	case blkFlush:
+		*status = d.flush()
+	case blkGetID:
+		id := []byte(d.Serial)
+		if len(id) > 20 {
+			id = id[:20]
+		}
+		for _, b := range in {
+			c := copy(b, id)
+			id = id[c:]
+			written += uint32(c)
+		}
+		*status = statusOK
+	case blkDiscard, blkWriteZeroes:
+		*status = d.trim(data)
+	default:
+		*status = statusUnsupp
+	}
+	return written + 1, nil
+}
+
+func (d *Disk) inRange(sector, n uint64) bool {
+	sectors := uint64(d.Size / SectorSize)
+	return sector <= sectors && n <= sectors-sector
+}
+
+func (d *Disk) read(sector uint64, n int) ([]byte, byte) {
+	if n%SectorSize != 0 || !d.inRange(sector, uint64(n/SectorSize)) {
+		return nil, statusIOErr
+	}
+	buf := make([]byte, n)
+	d.mu.Lock()
+	_, err := d.Device.ReadAt(buf, int64(sector)*SectorSize)
+	d.mu.Unlock()
+	if err != nil {
+		log.Printf("vhost: %s: read error: %s", d.Serial, err)
+		return nil, statusIOErr
+	}
+	return buf, statusOK
+}
+
+func (d *Disk) write(sector uint64, data []byte) byte {
+	if d.ReadOnly {
+		return statusIOErr
+	}
+	if len(data)%SectorSize != 0 || !d.inRange(sector, uint64(len(data)/SectorSize)) {
+		return statusIOErr
+	}
+	d.mu.Lock()
+	_, err := d.Device.WriteAt(data, int64(sector)*SectorSize)
+	d.mu.Unlock()
+	if err != nil {
+		log.Printf("vhost: %s: write error: %s", d.Serial, err)
+		return statusIOErr
+	}
+	return statusOK
+}
+
+func (d *Disk) flush() byte {
+	d.mu.Lock()
+	err := d.Device.Sync()
+	d.mu.Unlock()
+	if err != nil {
+		log.Printf("vhost: %s: sync error: %s", d.Serial, err)
+		return statusIOErr
+	}
+	return statusOK
+}
+
+// trim serves a discard or write zeroes request, trimming the ranges in
+// data. Trimmed blocks read as zeros.
+func (d *Disk) trim(data []byte) byte {
+	if d.ReadOnly {
+		return statusIOErr
+	}
+	if len(data)%16 != 0 || len(data)/16 > maxDiscardSegments {
+		return statusUnsupp
+	}
+	for seg := data; len(seg) > 0; seg = seg[16:] {
+		sector := binary.LittleEndian.Uint64(seg[0:8])
+		n := binary.LittleEndian.Uint32(seg[8:12])
+		if n > maxDiscardSectors || !d.inRange(sector, uint64(n)) {
+			return statusIOErr
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for seg := data; len(seg) > 0; seg = seg[16:] {
+		sector := binary.LittleEndian.Uint64(seg[0:8])
+		n := binary.LittleEndian.Uint32(seg[8:12])
+		if n == 0 {
+			continue
+		}
+		if err := d.Device.Trim(int64(sector)*SectorSize, int64(n)*SectorSize); err != nil {
+			log.Printf("vhost: %s: trim error: %s", d.Serial, err)
+			return statusIOErr
+		}
+	}
+	// As for NBD trims, sync so that the blocks released can be
+	// collected.
+	if err := d.Device.Sync(); err != nil {
+		log.Printf("vhost: %s: sync error: %s", d.Serial, err)
+		return statusIOErr
+	}
+	return statusOK
+}
@@ -0,0 +1,86 @@
+package vhost
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// region is a region of guest memory, mapped from a file the frontend
+// shared.
+type region struct {
+	guestAddr uint64
+	userAddr  uint64
+	size      uint64
+	mapping   []byte
+	data      []byte
+}
+
+// memory is the guest's memory, as given by the last memory table.
+type memory struct {
+	regions []region
+}
+
+// mapMemory maps the regions of a SET_MEM_TABLE message.
+func mapMemory(m *message) (*memory, error) {
+	if len(m.payload) < 8 {
+		return nil, fmt.Errorf("vhost: short memory table")
+	}
+	n := int(m.u32(0))
+	if n > maxFDs || len(m.payload) < 8+n*32 || len(m.fds) < n {
+		return nil, fmt.Errorf("vhost: memory table with %d regions and %d descriptors", n, len(m.fds))
+	}
+	mem := &memory{}
+	for i := 0; i < n; i++ {
+		desc := m.payload[8+i*32:]
+		r := region{
+			guestAddr: binary.LittleEndian.Uint64(desc[0:8]),
+			size:      binary.LittleEndian.Uint64(desc[8:16]),
+			userAddr:  binary.LittleEndian.Uint64(desc[16:24]),
+		}
+		offset := binary.LittleEndian.Uint64(desc[24:32])
+		fd := m.fd()
+		mapping, err := syscall.Mmap(fd, 0, int(offset+r.size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		// The mapping keeps the memory, whether it worked or not.
+		syscall.Close(fd)
+		if err != nil {
+			mem.unmap()
+			return nil, fmt.Errorf("vhost: can't map guest memory: %s", err)
+		}
+		r.mapping = mapping
+		r.data = mapping[offset:]
+		mem.regions = append(mem.regions, r)
+	}
+	return mem, nil
+}
+
+func (mem *memory) unmap() {
+	for _, r := range mem.regions {
+		syscall.Munmap(r.mapping)
+	}
+	mem.regions = nil
+}
+
+// guest returns the n bytes of guest memory at the guest physical address
+// addr, or nil if they aren't all in one region.
+func (mem *memory) guest(addr, n uint64) []byte {
+	for _, r := range mem.regions {
+		if addr >= r.guestAddr && addr-r.guestAddr <= r.size && n <= r.size-(addr-r.guestAddr) {
+			off := addr - r.guestAddr
+			return r.data[off : off+n]
+		}
+	}
+	return nil
+}
+
+// user returns the n bytes of guest memory at addr in the frontend's
+// address space, as vring addresses are given.
+func (mem *memory) user(addr, n uint64) []byte {
+	for _, r := range mem.regions {
+		if addr >= r.userAddr && addr-r.userAddr <= r.size && n <= r.size-(addr-r.userAddr) {
+			off := addr - r.userAddr
+			return r.data[off : off+n]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package vhost
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Requests from the frontend.
+const (
+	reqGetFeatures         = 1
+	reqSetFeatures         = 2
+	reqSetOwner            = 3
+	reqResetOwner          = 4
+	reqSetMemTable         = 5
+	reqSetLogBase          = 6
+	reqSetLogFD            = 7
+	reqSetVringNum         = 8
+	reqSetVringAddr        = 9
+	reqSetVringBase        = 10
+	reqGetVringBase        = 11
+	reqSetVringKick        = 12
+	reqSetVringCall        = 13
+	reqSetVringErr         = 14
+	reqGetProtocolFeatures = 15
+	reqSetProtocolFeatures = 16
+	reqGetQueueNum         = 17
+	reqSetVringEnable      = 18
+	reqGetConfig           = 24
+	reqSetConfig           = 25
+)
+
+const (
+	flagVersion   = 0x1
+	flagReply     = 0x4
+	flagNeedReply = 0x8
+
+	headerLength = 12
+	// maxPayload is larger than any message understood.
+	maxPayload = 4096
+	// maxFDs is the most file descriptors sent with a message, one for
+	// each memory region.
+	maxFDs = 8
+)
+
+// message is a vhost-user message, with any file descriptors sent with it.
+type message struct {
+	request uint32
+	flags   uint32
+	payload []byte
+	fds     []int
+}
+
+func (m *message) u64(off int) uint64 {
+	return binary.LittleEndian.Uint64(m.payload[off : off+8])
+}
+
+func (m *message) u32(off int) uint32 {
+	return binary.LittleEndian.Uint32(m.payload[off : off+4])
+}
+
+// fd returns the first file descriptor sent with the message, taking
+// ownership of it, or -1.
+func (m *message) fd() int {
+	if len(m.fds) == 0 {
+		return -1
+	}
+	fd := m.fds[0]
+	m.fds = m.fds[1:]
+	return fd
+}
+
+// closeFDs closes the descriptors of the message that weren't taken.
+func (m *message) closeFDs() {
+	for _, fd := range m.fds {
+		syscall.Close(fd)
+	}
+	m.fds = nil
+}
+
+// readMessage reads a message from conn.
+func readMessage(conn *net.UnixConn) (*message, error) {
+	hdr := make([]byte, headerLength)
+	oob := make([]byte, syscall.CmsgSpace(maxFDs*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(hdr, oob)
+	if err != nil {
+		return nil, err
+	}
+	m := &message{}
+	if oobn > 0 {
+		cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		for _, cmsg := range cmsgs {
+			fds, err := syscall.ParseUnixRights(&cmsg)
+			if err == nil {
+				m.fds = append(m.fds, fds...)
+			}
+		}
+	}
+	if n == 0 {
+		m.closeFDs()
+		return nil, io.EOF
+	}
+	if _, err := io.ReadFull(conn, hdr[n:]); err != nil {
+		m.closeFDs()
+		return nil, err
+	}
+	m.request = binary.LittleEndian.Uint32(hdr[0:4])
+	m.flags = binary.LittleEndian.Uint32(hdr[4:8])
+	size := binary.LittleEndian.Uint32(hdr[8:12])
+	if size > maxPayload {
+		m.closeFDs()
+		return nil, fmt.Errorf("vhost: message %d has a %d byte payload", m.request, size)
+	}
+	m.payload = make([]byte, size)
+	if _, err := io.ReadFull(conn, m.payload); err != nil {
+		m.closeFDs()
+		return nil, err
+	}
+	return m, nil
+}
+
+// reply answers the message m with payload.
+func reply(conn *net.UnixConn, m *message, payload []byte) error {
+	buf := make([]byte, headerLength+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], m.request)
+	binary.LittleEndian.PutUint32(buf[4:8], flagVersion|flagReply)
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(payload)))
+	copy(buf[headerLength:], payload)
+	_, err := conn.Write(buf)
+	return err
+}
+
+func u64Payload(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return buf
+}
@@ -0,0 +1,370 @@
+// Package vhost implements a vhost-user-blk backend, so that QEMU can do
+// the IO of a virtio-blk device directly against a torus block volume,
+// without the round trips through the kernel of an NBD device.
+//
+// QEMU connects to the backend's unix socket and shares the guest's
+// memory with it; each virtqueue is served by a goroutine of its own.
+// Only split virtqueues, without indirect descriptors or event indexes,
+// are supported, and dirty page logging for live migration isn't.
+package vhost
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Virtio and vhost-user feature bits.
+const (
+	featureSegMax           = 1 << 2
+	featureRO               = 1 << 5
+	featureBlkSize          = 1 << 6
+	featureFlush            = 1 << 9
+	featureTopology         = 1 << 10
+	featureMQ               = 1 << 12
+	featureDiscard          = 1 << 13
+	featureWriteZeroes      = 1 << 14
+	featureProtocolFeatures = 1 << 30
+	featureVersion1         = 1 << 32
+
+	protocolMQ       = 1 << 0
+	protocolReplyAck = 1 << 3
+	protocolConfig   = 1 << 9
+)
+
+// maxQueues is how many virtqueues a guest may use.
+const maxQueues = 8
+
+// Server serves a Disk to one frontend at a time over a unix socket.
+type Server struct {
+	disk *Disk
+
+	mu       sync.Mutex
+	listener *net.UnixListener
+	conn     *net.UnixConn
+	closed   bool
+}
+
+// NewServer creates a Server for disk.
+func NewServer(disk *Disk) (*Server, error) {
+	if disk.Size < SectorSize {
+		return nil, fmt.Errorf("vhost: %s is too small", disk.Serial)
+	}
+	return &Server{disk: disk}, nil
+}
+
+// Serve accepts frontends on l, serving each until it disconnects before
+// accepting the next, until the Server is closed or l fails. QEMU
+// reconnects this way when it's configured to.
+func (s *Server) Serve(l *net.UnixListener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if err := s.ServeConn(conn); err != nil && err != io.EOF {
+			log.Printf("vhost: %s: %s", s.disk.Serial, err)
+		}
+	}
+}
+
+// ServeConn serves the frontend on conn until it disconnects.
+func (s *Server) ServeConn(conn *net.UnixConn) error {
+	s.mu.Lock()
+	if s.closed || s.conn != nil {
+		s.mu.Unlock()
+		return conn.Close()
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	f := &frontend{disk: s.disk, conn: conn}
+	for i := range f.vrings {
+		f.vrings[i] = &vring{index: i}
+	}
+	defer func() {
+		f.reset()
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	return f.serve()
+}
+
+// Close stops accepting frontends and drops the one connected.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
+
+// frontend is the state of a connection from QEMU.
+type frontend struct {
+	disk *Disk
+	conn *net.UnixConn
+
+	features         uint64
+	protocolFeatures uint64
+
+	// memMu is held for reading while virtqueues are served, and for
+	// writing while the memory table changes.
+	memMu sync.RWMutex
+	mem   *memory
+
+	vrings [maxQueues]*vring
+}
+
+func (f *frontend) serve() error {
+	for {
+		m, err := readMessage(f.conn)
+		if err != nil {
+			return err
+		}
+		payload, err := f.handle(m)
+		m.closeFDs()
+		switch {
+		case payload != nil:
+			if rerr := reply(f.conn, m, payload); rerr != nil {
+				return rerr
+			}
+		case m.flags&flagNeedReply != 0 && f.protocolFeatures&protocolReplyAck != 0:
+			var status uint64
+			if err != nil {
+				status = 1
+			}
+			if rerr := reply(f.conn, m, u64Payload(status)); rerr != nil {
+				return rerr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// offered returns the virtio features offered.
+func (f *frontend) offered() uint64 {
+	features := uint64(featureSegMax | featureBlkSize | featureFlush | featureTopology |
+		featureMQ | featureDiscard | featureWriteZeroes | featureProtocolFeatures | featureVersion1)
+	if f.disk.ReadOnly {
+		features |= featureRO
+	}
+	return features
+}
+
+// handle serves the message m, returning the payload of its reply if it
+// has one.
+func (f *frontend) handle(m *message) ([]byte, error) {
+	short := func(n int) error {
+		if len(m.payload) < n {
+			return fmt.Errorf("vhost: request %d has a %d byte payload", m.request, len(m.payload))
+		}
+		return nil
+	}
+	switch m.request {
+	case reqGetFeatures:
+		return u64Payload(f.offered()), nil
+	case reqSetFeatures:
+		if err := short(8); err != nil {
+			return nil, err
+		}
+		if features := m.u64(0); features&^f.offered() != 0 {
+			return nil, fmt.Errorf("vhost: unsupported features %#x", features&^f.offered())
+		}
+		f.features = m.u64(0)
+		return nil, nil
+	case reqGetProtocolFeatures:
+		return u64Payload(protocolMQ | protocolReplyAck | protocolConfig), nil
+	case reqSetProtocolFeatures:
+		if err := short(8); err != nil {
+			return nil, err
+		}
+		f.protocolFeatures = m.u64(0) & (protocolMQ | protocolReplyAck | protocolConfig)
+		return nil, nil
+	case reqSetOwner:
+		return nil, nil
+	case reqResetOwner:
+		f.reset()
+		return nil, nil
+	case reqGetQueueNum:
+		return u64Payload(maxQueues), nil
+	case reqSetMemTable:
+		mem, err := mapMemory(m)
+		if err != nil {
+			return nil, err
+		}
+		f.memMu.Lock()
+		old := f.mem
+		f.mem = mem
+		f.memMu.Unlock()
+		if old != nil {
+			old.unmap()
+		}
+		return nil, nil
+	case reqGetConfig:
+		if err := short(12); err != nil {
+			return nil, err
+		}
+		off, size := int(m.u32(0)), int(m.u32(4))
+		config := f.disk.config(maxQueues)
+		if off > len(config) || size > len(config)-off {
+			return nil, fmt.Errorf("vhost: config space read of %d bytes at %d", size, off)
+		}
+		resp := make([]byte, 12+size)
+		copy(resp, m.payload[:12])
+		copy(resp[12:], config[off:off+size])
+		return resp, nil
+	case reqSetConfig:
+		// The cache mode can't be changed; torus writes are only
+		// durable once flushed.
+		return nil, nil
+	case reqSetVringErr:
+		return nil, nil
+	}
+
+	// The rest are about a virtqueue.
+	if err := short(8); err != nil {
+		return nil, err
+	}
+	index := int(m.u32(0) & 0xff)
+	if m.request == reqSetVringKick || m.request == reqSetVringCall {
+		index = int(m.u64(0) & 0xff)
+	}
+	if index >= maxQueues {
+		return nil, fmt.Errorf("vhost: no virtqueue %d", index)
+	}
+	vr := f.vrings[index]
+	switch m.request {
+	case reqSetVringNum:
+		num := m.u32(4)
+		if num == 0 || num > maxQueueSize || num&(num-1) != 0 {
+			return nil, fmt.Errorf("vhost: invalid virtqueue size %d", num)
+		}
+		vr.num = uint16(num)
+		return nil, nil
+	case reqSetVringAddr:
+		if err := short(40); err != nil {
+			return nil, err
+		}
+		vr.descAddr = m.u64(8)
+		vr.usedAddr = m.u64(16)
+		vr.availAddr = m.u64(24)
+		return nil, nil
+	case reqSetVringBase:
+		vr.lastAvail = uint16(m.u32(4))
+		return nil, nil
+	case reqGetVringBase:
+		f.stop(vr)
+		resp := make([]byte, 8)
+		binary.LittleEndian.PutUint32(resp[0:4], uint32(index))
+		binary.LittleEndian.PutUint32(resp[4:8], uint32(vr.lastAvail))
+		return resp, nil
+	case reqSetVringKick:
+		fd := m.fd()
+		if fd < 0 {
+			return nil, fmt.Errorf("vhost: polling virtqueue %d isn't supported", index)
+		}
+		f.stop(vr)
+		// Non-blocking, so that closing the kick file interrupts the
+		// goroutine reading it.
+		syscall.SetNonblock(fd, true)
+		vr.kick = os.NewFile(uintptr(fd), "kick")
+		if f.features&featureProtocolFeatures == 0 {
+			// Otherwise the ring waits for SET_VRING_ENABLE.
+			vr.setEnabled(true)
+		}
+		f.start(vr)
+		return nil, nil
+	case reqSetVringCall:
+		if fd := m.fd(); fd >= 0 {
+			vr.setCall(os.NewFile(uintptr(fd), "call"))
+		} else {
+			vr.setCall(nil)
+		}
+		return nil, nil
+	case reqSetVringEnable:
+		vr.setEnabled(m.u32(4) == 1)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("vhost: unsupported request %d", m.request)
+}
+
+// start starts serving vr in a goroutine of its own.
+func (f *frontend) start(vr *vring) {
+	done := make(chan struct{})
+	vr.done = done
+	kick := vr.kick
+	go func() {
+		defer close(done)
+		buf := make([]byte, 8)
+		for {
+			f.memMu.RLock()
+			var err error
+			if f.mem != nil && vr.num > 0 {
+				_, err = vr.process(f.mem, f.disk)
+			}
+			f.memMu.RUnlock()
+			if err != nil {
+				log.Printf("vhost: %s: virtqueue %d: %s", f.disk.Serial, vr.index, err)
+				return
+			}
+			if _, err := kick.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// stop stops serving vr, if it's started.
+func (f *frontend) stop(vr *vring) {
+	if vr.done == nil {
+		return
+	}
+	vr.kick.Close()
+	<-vr.done
+	vr.done = nil
+	vr.kick = nil
+}
+
+// reset stops every virtqueue and unmaps the guest's memory.
+func (f *frontend) reset() {
+	for _, vr := range f.vrings {
+		f.stop(vr)
+		vr.setCall(nil)
+		vr.setEnabled(false)
+	}
+	f.memMu.Lock()
+	if f.mem != nil {
+		f.mem.unmap()
+		f.mem = nil
+	}
+	f.memMu.Unlock()
+}
@@ -0,0 +1,312 @@
+package vhost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type memDevice []byte
+
+func (m memDevice) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(b []byte, off int64) (int, error) {
+	return copy(m[off:], b), nil
+}
+
+func (m memDevice) Sync() error { return nil }
+
+func (m memDevice) Trim(off, length int64) error {
+	for i := off; i < off+length; i++ {
+		m[i] = 0
+	}
+	return nil
+}
+
+// Layout of the test guest's memory, which QEMU would see at userBase.
+const (
+	guestSize  = 1 << 20
+	userBase   = 0x7f0000000000
+	queueSize  = 8
+	descAddr   = 0x0
+	availAddr  = 0x1000
+	usedAddr   = 0x2000
+	headerAddr = 0x3000
+	statusAddr = 0x4000
+	dataAddr   = 0x10000
+)
+
+// qemu drives a frontend connection from the other end of a socket pair.
+type qemu struct {
+	t    *testing.T
+	conn *net.UnixConn
+	mem  []byte
+	kick *os.File
+	call *os.File
+	// avail is the next index in the available ring.
+	avail uint16
+}
+
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socket")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func (q *qemu) send(req uint32, payload []byte, fds ...int) {
+	buf := make([]byte, headerLength+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], req)
+	binary.LittleEndian.PutUint32(buf[4:8], flagVersion|flagNeedReply)
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(payload)))
+	copy(buf[headerLength:], payload)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	if _, _, err := q.conn.WriteMsgUnix(buf, oob, nil); err != nil {
+		q.t.Fatal(err)
+	}
+}
+
+func (q *qemu) recv(req uint32) []byte {
+	m, err := readMessage(q.conn)
+	if err != nil {
+		q.t.Fatal(err)
+	}
+	if m.request != req || m.flags&flagReply == 0 {
+		q.t.Fatalf("expected a reply to request %d, got %d with flags %#x", req, m.request, m.flags)
+	}
+	return m.payload
+}
+
+// set sends a request without a reply of its own, and checks the
+// acknowledgement.
+func (q *qemu) set(req uint32, payload []byte, fds ...int) {
+	q.send(req, payload, fds...)
+	if ack := q.recv(req); binary.LittleEndian.Uint64(ack) != 0 {
+		q.t.Fatalf("request %d failed", req)
+	}
+}
+
+func state(index, num uint32) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:4], index)
+	binary.LittleEndian.PutUint32(buf[4:8], num)
+	return buf
+}
+
+func newQEMU(t *testing.T, srv *Server) *qemu {
+	client, conn := unixPair(t)
+	go srv.ServeConn(conn)
+	q := &qemu{t: t, conn: client}
+
+	q.send(reqGetFeatures, nil)
+	features := binary.LittleEndian.Uint64(q.recv(reqGetFeatures))
+	if features&featureProtocolFeatures == 0 || features&featureDiscard == 0 {
+		t.Fatalf("offered features %#x", features)
+	}
+	q.send(reqGetProtocolFeatures, nil)
+	q.recv(reqGetProtocolFeatures)
+	// Without REPLY_ACK, nothing answers the first two.
+	buf := make([]byte, headerLength+8)
+	for _, req := range []uint32{reqSetFeatures, reqSetProtocolFeatures} {
+		binary.LittleEndian.PutUint32(buf[0:4], req)
+		binary.LittleEndian.PutUint32(buf[4:8], flagVersion)
+		binary.LittleEndian.PutUint32(buf[8:12], 8)
+		v := features
+		if req == reqSetProtocolFeatures {
+			v = protocolReplyAck | protocolConfig | protocolMQ
+		}
+		binary.LittleEndian.PutUint64(buf[headerLength:], v)
+		if _, err := client.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "vhost-guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+	if err := f.Truncate(guestSize); err != nil {
+		t.Fatal(err)
+	}
+	q.mem, err = syscall.Mmap(int(f.Fd()), 0, guestSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := make([]byte, 8+32)
+	binary.LittleEndian.PutUint32(table[0:4], 1)
+	binary.LittleEndian.PutUint64(table[16:24], guestSize)
+	binary.LittleEndian.PutUint64(table[24:32], userBase)
+	q.set(reqSetMemTable, table, int(f.Fd()))
+
+	q.set(reqSetVringNum, state(0, queueSize))
+	addr := make([]byte, 40)
+	binary.LittleEndian.PutUint64(addr[8:16], userBase+descAddr)
+	binary.LittleEndian.PutUint64(addr[16:24], userBase+usedAddr)
+	binary.LittleEndian.PutUint64(addr[24:32], userBase+availAddr)
+	q.set(reqSetVringAddr, addr)
+	q.set(reqSetVringBase, state(0, 0))
+
+	callR, callW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kickR, kickW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.call, q.kick = callR, kickW
+	q.set(reqSetVringCall, u64Payload(0), int(callW.Fd()))
+	q.set(reqSetVringKick, u64Payload(0), int(kickR.Fd()))
+	callW.Close()
+	kickR.Close()
+	q.set(reqSetVringEnable, state(0, 1))
+	return q
+}
+
+// request makes a virtio-blk request available with the data given, and
+// returns its status and the data read, once it's used.
+func (q *qemu) request(typ uint32, sector uint64, out []byte, in int) (byte, []byte) {
+	hdr := q.mem[headerAddr:]
+	binary.LittleEndian.PutUint32(hdr[0:4], typ)
+	binary.LittleEndian.PutUint64(hdr[8:16], sector)
+	q.mem[statusAddr] = 0xff
+
+	desc := func(i int, addr uint64, length uint32, flags uint16) {
+		d := q.mem[descAddr+16*i:]
+		binary.LittleEndian.PutUint64(d[0:8], addr)
+		binary.LittleEndian.PutUint32(d[8:12], length)
+		binary.LittleEndian.PutUint16(d[12:14], flags|descNext)
+		binary.LittleEndian.PutUint16(d[14:16], uint16(i+1))
+	}
+	n := 0
+	desc(n, headerAddr, 16, 0)
+	n++
+	if out != nil {
+		copy(q.mem[dataAddr:], out)
+		desc(n, dataAddr, uint32(len(out)), 0)
+		n++
+	}
+	if in > 0 {
+		desc(n, dataAddr, uint32(in), descWrite)
+		n++
+	}
+	desc(n, statusAddr, 1, descWrite)
+	binary.LittleEndian.PutUint16(q.mem[descAddr+16*n+12:], descWrite)
+
+	avail := q.mem[availAddr:]
+	binary.LittleEndian.PutUint16(avail[4+2*int(q.avail%queueSize):], 0)
+	q.avail++
+	binary.LittleEndian.PutUint16(avail[2:4], q.avail)
+	if _, err := q.kick.Write(u64Payload(1)); err != nil {
+		q.t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if _, err := q.call.Read(buf); err != nil {
+		q.t.Fatal(err)
+	}
+	used := q.mem[usedAddr:]
+	if idx := binary.LittleEndian.Uint16(used[2:4]); idx != q.avail {
+		q.t.Fatalf("used index %d, expected %d", idx, q.avail)
+	}
+	elem := used[4+8*int((q.avail-1)%queueSize):]
+	if written := binary.LittleEndian.Uint32(elem[4:8]); typ == blkIn && q.mem[statusAddr] == statusOK && written != uint32(in)+1 {
+		q.t.Fatalf("%d bytes written, expected %d", written, in+1)
+	}
+	data := append([]byte(nil), q.mem[dataAddr:dataAddr+in]...)
+	return q.mem[statusAddr], data
+}
+
+func TestReadWriteDiscard(t *testing.T) {
+	dev := make(memDevice, 1<<20)
+	srv, err := NewServer(&Disk{Device: dev, Size: int64(len(dev)), Serial: "vol01", PhysicalBlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newQEMU(t, srv)
+	defer q.conn.Close()
+
+	get := make([]byte, 12)
+	binary.LittleEndian.PutUint32(get[4:8], 60)
+	q.send(reqGetConfig, get)
+	config := q.recv(reqGetConfig)[12:]
+	if capacity := binary.LittleEndian.Uint64(config[0:8]); capacity != 2048 {
+		t.Fatalf("capacity %d sectors, expected 2048", capacity)
+	}
+	if config[24] != 3 {
+		t.Fatalf("physical block exponent %d, expected 3", config[24])
+	}
+
+	payload := bytes.Repeat([]byte("torus!!!"), 1024)
+	if status, _ := q.request(blkOut, 8, payload, 0); status != statusOK {
+		t.Fatalf("write failed with status %d", status)
+	}
+	if !bytes.Equal(dev[8*512:24*512], payload) {
+		t.Fatal("write didn't reach the device")
+	}
+	// Scribble over the buffer, so the read must fill it.
+	copy(q.mem[dataAddr:], make([]byte, len(payload)))
+	status, data := q.request(blkIn, 8, nil, len(payload))
+	if status != statusOK || !bytes.Equal(data, payload) {
+		t.Fatalf("read back different data, status %d", status)
+	}
+	if status, _ := q.request(blkIn, 2047, nil, 1024); status != statusIOErr {
+		t.Fatalf("read past the end answered with status %d", status)
+	}
+
+	seg := make([]byte, 16)
+	binary.LittleEndian.PutUint64(seg[0:8], 8)
+	binary.LittleEndian.PutUint32(seg[8:12], 8)
+	if status, _ := q.request(blkDiscard, 0, seg, 0); status != statusOK {
+		t.Fatalf("discard failed with status %d", status)
+	}
+	if !bytes.Equal(dev[8*512:16*512], make([]byte, 8*512)) || !bytes.Equal(dev[16*512:24*512], payload[8*512:]) {
+		t.Fatal("discard didn't trim exactly the blocks asked for")
+	}
+
+	if status, id := q.request(blkGetID, 0, nil, 20); status != statusOK || string(id[:5]) != "vol01" {
+		t.Fatalf("get ID answered %q with status %d", id, status)
+	}
+	if status, _ := q.request(0x42, 0, nil, 0); status != statusUnsupp {
+		t.Fatalf("unknown request answered with status %d", status)
+	}
+
+	q.send(reqGetVringBase, state(0, 0))
+	if base := binary.LittleEndian.Uint32(q.recv(reqGetVringBase)[4:8]); base != uint32(q.avail) {
+		t.Fatalf("virtqueue stopped at %d, expected %d", base, q.avail)
+	}
+}
+
+func TestReadOnlyDisk(t *testing.T) {
+	dev := make(memDevice, 4096)
+	srv, err := NewServer(&Disk{Device: dev, Size: int64(len(dev)), ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newQEMU(t, srv)
+	defer q.conn.Close()
+	if status, _ := q.request(blkOut, 0, make([]byte, 512), 0); status != statusIOErr {
+		t.Fatalf("write to a read-only disk answered with status %d", status)
+	}
+}
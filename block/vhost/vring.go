@@ -0,0 +1,137 @@
+package vhost
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Flags of split virtqueue descriptors and rings.
+const (
+	descNext     = 0x1
+	descWrite    = 0x2
+	descIndirect = 0x4
+
+	availNoInterrupt = 0x1
+
+	// maxQueueSize is the largest a split virtqueue may be.
+	maxQueueSize = 32768
+)
+
+var errRingBroken = errors.New("vhost: malformed descriptor chain")
+
+// vring is the state of a virtqueue, whose requests are served by a
+// goroutine of its own while it's started.
+type vring struct {
+	index int
+	num   uint16
+	// Addresses of the descriptor table, available ring and used ring in
+	// the frontend's address space.
+	descAddr, availAddr, usedAddr uint64
+	lastAvail                     uint16
+
+	kick *os.File
+	// done is closed when the goroutine serving the ring exits, and is
+	// nil while it's stopped.
+	done chan struct{}
+
+	mu      sync.Mutex
+	call    *os.File
+	enabled bool
+}
+
+func (vr *vring) setCall(f *os.File) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	if vr.call != nil {
+		vr.call.Close()
+	}
+	vr.call = f
+}
+
+func (vr *vring) setEnabled(enabled bool) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	vr.enabled = enabled
+}
+
+func (vr *vring) isEnabled() bool {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	return vr.enabled
+}
+
+// notify signals the guest that requests have been used.
+func (vr *vring) notify() {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	if vr.call != nil {
+		vr.call.Write(u64Payload(1))
+	}
+}
+
+// rings returns the virtqueue's descriptor table and rings, or nil if
+// they aren't all in guest memory.
+func (vr *vring) rings(mem *memory) (desc, avail, used []byte) {
+	n := uint64(vr.num)
+	desc = mem.user(vr.descAddr, 16*n)
+	avail = mem.user(vr.availAddr, 4+2*n)
+	used = mem.user(vr.usedAddr, 4+8*n)
+	if desc == nil || avail == nil || used == nil {
+		return nil, nil, nil
+	}
+	return desc, avail, used
+}
+
+// process serves the requests the guest has made available, returning
+// how many it served.
+func (vr *vring) process(mem *memory, disk *Disk) (int, error) {
+	if !vr.isEnabled() {
+		return 0, nil
+	}
+	desc, avail, used := vr.rings(mem)
+	if desc == nil {
+		return 0, errors.New("vhost: virtqueue isn't in guest memory")
+	}
+	n := 0
+	for {
+		// The index is read before the entries it covers.
+		availIdx := uint16(atomicLoad32(avail) >> 16)
+		if vr.lastAvail == availIdx {
+			break
+		}
+		slot := 4 + 2*int(vr.lastAvail%vr.num)
+		head := binary.LittleEndian.Uint16(avail[slot : slot+2])
+		written, err := disk.serve(mem, desc, head, vr.num)
+		if err != nil {
+			return n, err
+		}
+
+		usedIdx := uint16(atomicLoad32(used) >> 16)
+		elem := used[4+8*int(usedIdx%vr.num):]
+		binary.LittleEndian.PutUint32(elem[0:4], uint32(head))
+		binary.LittleEndian.PutUint32(elem[4:8], written)
+		// The entry is written before the index which publishes it.
+		atomicStore32(used, uint32(usedIdx+1)<<16)
+		vr.lastAvail++
+		n++
+	}
+	if n > 0 && binary.LittleEndian.Uint16(avail[0:2])&availNoInterrupt == 0 {
+		vr.notify()
+	}
+	return n, nil
+}
+
+// atomicLoad32 loads the flags and index at the start of a ring as one
+// word, with the index in the high half as vhost-user hosts are little
+// endian.
+func atomicLoad32(ring []byte) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&ring[0])))
+}
+
+func atomicStore32(ring []byte, v uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&ring[0])), v)
+}
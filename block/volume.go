@@ -1,6 +1,9 @@
 package block
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/blockset"
 	"github.com/coreos/torus/models"
@@ -15,7 +18,94 @@ type BlockVolume struct {
 	volume *models.Volume
 }
 
+// VolumeOptions are the settings a block volume is created with.
+type VolumeOptions struct {
+	// Checksum names the algorithm blocks are checksummed with, one of
+	// those accepted by blockset.ParseChecksumAlgorithm. Empty uses the
+	// cluster's default block layers. It can't be changed later.
+	Checksum string `json:",omitempty"`
+
+	// Origin is the snapshot a clone was made from, as VOLUME@SNAPSHOT.
+	// It's only a record: the clone doesn't depend on either existing.
+	Origin string `json:",omitempty"`
+
+	// Erasure, as K+M, protects the volume's blocks with M parity blocks
+	// for every K, in place of the cluster's replication; see
+	// blockset.ParseErasureCode. Empty replicates them as usual. It can't
+	// be changed later.
+	Erasure string `json:",omitempty"`
+
+	// Compression names the algorithm blocks are compressed with, one of
+	// those accepted by blockset.ParseCompressionAlgorithm. Empty leaves
+	// them uncompressed. It can't be changed later.
+	Compression string `json:",omitempty"`
+
+	// Encryption, if set, encrypts the volume's blocks before they leave
+	// the node; see NewVolumeEncryption. It can't be changed later, and
+	// clones share it.
+	Encryption *VolumeEncryption `json:",omitempty"`
+
+	// Shared lets the volume be attached read-write on several hosts at
+	// once, for cluster filesystems such as OCFS2 and GFS2, which
+	// coordinate their own writes; see OpenSharedBlockFile. Clones are
+	// shared too. It can't be changed later.
+	Shared bool `json:",omitempty"`
+
+	// Dedup stores blocks whose contents are already stored, by this or
+	// any other deduplicated volume, only once; see blockset.Dedup. It
+	// can't be combined with erasure coding or encryption, and can't be
+	// changed later.
+	Dedup bool `json:",omitempty"`
+
+	// Labels are the volume's initial labels; see SetVolumeLabels. They're
+	// stored and indexed separately from the other options.
+	Labels map[string]string `json:"-"`
+
+	// Replication, if set, is how many copies of the volume's blocks to
+	// keep, in place of the ring's replication factor. It's stored apart
+	// from the other options, and can be changed with SetReplication.
+	Replication int `json:"-"`
+}
+
 func CreateBlockVolume(mds torus.MetadataService, volume string, size uint64) error {
+	return CreateBlockVolumeWithOptions(mds, volume, size, VolumeOptions{})
+}
+
+// CreateBlockVolumeWithOptions is like CreateBlockVolume, with non-default
+// settings for the volume.
+func CreateBlockVolumeWithOptions(mds torus.MetadataService, volume string, size uint64, opts VolumeOptions) error {
+	if opts.Checksum != "" {
+		if _, err := blockset.ParseChecksumAlgorithm(opts.Checksum); err != nil {
+			return err
+		}
+	}
+	if opts.Erasure != "" {
+		if _, _, err := blockset.ParseErasureCode(opts.Erasure); err != nil {
+			return err
+		}
+	}
+	if opts.Compression != "" {
+		if _, err := blockset.ParseCompressionAlgorithm(opts.Compression); err != nil {
+			return err
+		}
+	}
+	if opts.Encryption != nil {
+		if err := opts.Encryption.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Dedup && opts.Erasure != "" {
+		return errors.New("erasure coded volumes can't be deduplicated")
+	}
+	if opts.Dedup && opts.Encryption != nil {
+		return errors.New("encrypted volumes can't be deduplicated")
+	}
+	if err := ValidateLabels(opts.Labels); err != nil {
+		return err
+	}
+	if err := opts.validateReplication(opts.Replication); err != nil {
+		return err
+	}
 	id, err := mds.NewVolumeID()
 	if err != nil {
 		return err
@@ -24,12 +114,63 @@ func CreateBlockVolume(mds torus.MetadataService, volume string, size uint64) er
 	if err != nil {
 		return err
 	}
-	return blkmd.CreateBlockVolume(&models.Volume{
+	err = blkmd.CreateBlockVolume(&models.Volume{
 		Name:     volume,
 		Id:       uint64(id),
 		Type:     VolumeType,
 		MaxBytes: size,
-	})
+	}, opts)
+	if err != nil || opts.Replication == 0 {
+		return err
+	}
+	return mds.SetVolumeReplication(id, opts.Replication)
+}
+
+// SetReplication changes how many copies of a block volume's blocks are
+// kept. Zero goes back to the ring's replication factor. Every node picks up
+// the change within a heartbeat, and the rebalancer then makes or drops
+// copies of the blocks already written to match.
+func SetReplication(mds torus.MetadataService, volume string, r int) error {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return err
+	}
+	bmds, err := createBlockMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return err
+	}
+	opts, err := bmds.GetVolumeOptions()
+	if err != nil {
+		return err
+	}
+	if err := opts.validateReplication(r); err != nil {
+		return err
+	}
+	return mds.SetVolumeReplication(torus.VolumeID(vol.Id), r)
+}
+
+// GetReplication returns how many copies of a volume's blocks are kept, or
+// zero if it follows the ring.
+func GetReplication(mds torus.MetadataService, volume string) (int, error) {
+	vol, err := mds.GetVolume(volume)
+	if err != nil {
+		return 0, err
+	}
+	reps, err := mds.GetVolumeReplication()
+	if err != nil {
+		return 0, err
+	}
+	return reps[torus.VolumeID(vol.Id)], nil
+}
+
+func (o VolumeOptions) validateReplication(r int) error {
+	if r < 0 {
+		return errors.New("replication cannot be negative")
+	}
+	if r != 0 && o.Erasure != "" {
+		return errors.New("erasure coded volumes aren't replicated")
+	}
+	return nil
 }
 
 func OpenBlockVolume(s *torus.Server, volume string) (*BlockVolume, error) {
@@ -60,7 +201,7 @@ func DeleteBlockVolume(mds torus.MetadataService, volume string) error {
 	return bmds.DeleteVolume()
 }
 
-func (s *BlockVolume) SaveSnapshot(name string) error    { return s.mds.SaveSnapshot(name) }
+func (s *BlockVolume) SaveSnapshot(name string) error    { return s.mds.SaveSnapshot(name, nil) }
 func (s *BlockVolume) GetSnapshots() ([]Snapshot, error) { return s.mds.GetSnapshots() }
 func (s *BlockVolume) DeleteSnapshot(name string) error  { return s.mds.DeleteSnapshot(name) }
 
@@ -79,7 +220,15 @@ func (s *BlockVolume) getOrCreateBlockINode(ref torus.INodeRef) (*models.INode,
 	if err != nil {
 
 	}
-	bs, err := blockset.CreateBlocksetFromSpec(globals.DefaultBlockSpec, nil)
+	opts, err := s.mds.GetVolumeOptions()
+	if err != nil {
+		return nil, err
+	}
+	spec, err := opts.blockSpec(globals.DefaultBlockSpec)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := blockset.CreateBlocksetFromSpec(spec, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -98,3 +247,94 @@ func (s *BlockVolume) getOrCreateBlockINode(ref torus.INodeRef) (*models.INode,
 	inode.Blocks, err = torus.MarshalBlocksetToProto(bs)
 	return inode, err
 }
+
+// blockSpec returns the block layers for a new volume with these options,
+// based on the cluster default. A chosen checksum algorithm replaces the crc
+// layer, or sits on top if there isn't one. Encryption goes on top of that,
+// so that checksums are of the ciphertext, and compression on top of
+// everything, as ciphertext doesn't compress. Erasure coding replaces any
+// replication layer, and sits directly on the base layer, as does
+// deduplication.
+func (o VolumeOptions) blockSpec(def torus.BlockLayerSpec) (torus.BlockLayerSpec, error) {
+	spec, err := o.checksumSpec(def)
+	if err != nil {
+		return nil, err
+	}
+	if o.Erasure != "" {
+		spec, err = o.erasureSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Dedup {
+		spec, err = dedupSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Encryption != nil {
+		enc := torus.BlockLayer{Kind: blockset.Encrypt, Options: o.Encryption.KeyID}
+		spec = append(torus.BlockLayerSpec{enc}, spec...)
+	}
+	if o.Compression != "" {
+		if _, err := blockset.ParseCompressionAlgorithm(o.Compression); err != nil {
+			return nil, fmt.Errorf("volume has an invalid compression: %v", err)
+		}
+		c := torus.BlockLayer{Kind: blockset.Compress, Options: o.Compression}
+		spec = append(torus.BlockLayerSpec{c}, spec...)
+	}
+	return spec, nil
+}
+
+func (o VolumeOptions) erasureSpec(def torus.BlockLayerSpec) (torus.BlockLayerSpec, error) {
+	if _, _, err := blockset.ParseErasureCode(o.Erasure); err != nil {
+		return nil, fmt.Errorf("volume has an invalid erasure code: %v", err)
+	}
+	var out torus.BlockLayerSpec
+	for _, l := range def {
+		switch l.Kind {
+		case blockset.Replication:
+			continue
+		case blockset.Base:
+			out = append(out, torus.BlockLayer{Kind: blockset.Erasure, Options: o.Erasure})
+		}
+		out = append(out, l)
+	}
+	if len(out) == 0 || out[len(out)-1].Kind != blockset.Base {
+		return nil, errors.New("erasure coding needs block layers ending with base")
+	}
+	return out, nil
+}
+
+func dedupSpec(def torus.BlockLayerSpec) (torus.BlockLayerSpec, error) {
+	n := len(def)
+	if n == 0 || def[n-1].Kind != blockset.Base {
+		return nil, errors.New("deduplication needs block layers ending with base")
+	}
+	out := append(torus.BlockLayerSpec(nil), def[:n-1]...)
+	return append(out, torus.BlockLayer{Kind: blockset.Dedup}, def[n-1]), nil
+}
+
+func (o VolumeOptions) checksumSpec(def torus.BlockLayerSpec) (torus.BlockLayerSpec, error) {
+	if o.Checksum == "" {
+		return def, nil
+	}
+	if _, err := blockset.ParseChecksumAlgorithm(o.Checksum); err != nil {
+		return nil, fmt.Errorf("volume has an invalid checksum: %v", err)
+	}
+	sum := torus.BlockLayer{Kind: blockset.Checksum, Options: o.Checksum}
+	var out torus.BlockLayerSpec
+	replaced := false
+	for _, l := range def {
+		if l.Kind == blockset.CRC || l.Kind == blockset.Checksum {
+			out = append(out, sum)
+			replaced = true
+			continue
+		}
+		out = append(out, l)
+	}
+	if !replaced {
+		out = append(torus.BlockLayerSpec{sum}, out...)
+	}
+	return out, nil
+}
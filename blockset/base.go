@@ -1,6 +1,7 @@
 package blockset
 
 import (
+	"sync"
 	"sync/atomic"
 
 	"golang.org/x/net/context"
@@ -11,7 +12,10 @@ import (
 )
 
 type baseBlockset struct {
-	ids       uint64
+	ids uint64
+	// mut guards blocks, which a file's write-behind and read-ahead
+	// change and read alongside its foreground reads and writes.
+	mut       sync.RWMutex
 	blocks    []torus.BlockRef
 	store     torus.BlockStore
 	blocksize uint64
@@ -37,24 +41,43 @@ func newBaseBlockset(store torus.BlockStore) *baseBlockset {
 }
 
 func (b *baseBlockset) Length() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
 	return len(b.blocks)
 }
 
+// ref returns the ref of block i, or the zero ref if there's no block i.
+func (b *baseBlockset) ref(i int) torus.BlockRef {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= len(b.blocks) {
+		return torus.ZeroBlock()
+	}
+	return b.blocks[i]
+}
+
 func (b *baseBlockset) Kind() uint32 {
 	return uint32(Base)
 }
 
 func (b *baseBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	b.mut.RLock()
 	if i >= len(b.blocks) {
+		b.mut.RUnlock()
 		return nil, torus.ErrBlockNotExist
 	}
-	if b.blocks[i].IsZero() {
+	ref := b.blocks[i]
+	b.mut.RUnlock()
+	if ref.IsZero() {
+		if torus.UnwrittenReadsFail(ctx) {
+			return nil, torus.ErrUnwritten
+		}
 		return make([]byte, b.store.BlockSize()), nil
 	}
 	if torus.BlockLog.LevelAt(capnslog.TRACE) {
-		torus.BlockLog.Tracef("base: getting block %d at BlockID %s", i, b.blocks[i])
+		torus.BlockLog.Tracef("base: getting block %d at BlockID %s", i, ref)
 	}
-	bytes, err := b.store.GetBlock(ctx, b.blocks[i])
+	bytes, err := b.store.GetBlock(ctx, ref)
 	if err != nil {
 		promBaseFail.Inc()
 		return nil, err
@@ -63,7 +86,7 @@ func (b *baseBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
 }
 
 func (b *baseBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
-	if i > len(b.blocks) {
+	if i > b.Length() {
 		return torus.ErrBlockNotExist
 	}
 	// if v, ok := ctx.Value("isEmpty").(bool); ok && v {
@@ -75,22 +98,44 @@ func (b *baseBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int
 	// 	}
 	// 	return nil
 	// }
-	newBlockID := b.makeID(inode)
+	return b.putRef(ctx, i, b.makeID(inode), data)
+}
+
+// putRef writes block i as the new block ref. Layers which pick the refs of
+// their blocks themselves use it in place of PutBlock.
+func (b *baseBlockset) putRef(ctx context.Context, i int, ref torus.BlockRef, data []byte) error {
 	if torus.BlockLog.LevelAt(capnslog.TRACE) {
-		torus.BlockLog.Tracef("base: writing block %d at BlockID %s", i, newBlockID)
+		torus.BlockLog.Tracef("base: writing block %d at BlockID %s", i, ref)
 	}
-	err := b.store.WriteBlock(ctx, newBlockID, data)
+	err := b.store.WriteBlock(ctx, ref, data)
 	if err != nil {
 		return err
 	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > len(b.blocks) {
+		// Truncated while it was being written.
+		return torus.ErrBlockNotExist
+	}
 	if i == len(b.blocks) {
-		b.blocks = append(b.blocks, newBlockID)
+		b.blocks = append(b.blocks, ref)
 	} else {
-		b.blocks[i] = newBlockID
+		b.blocks[i] = ref
 	}
 	return nil
 }
 
+// setRef makes block i the existing block ref, without writing anything.
+func (b *baseBlockset) setRef(i int, ref torus.BlockRef) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i == len(b.blocks) {
+		b.blocks = append(b.blocks, ref)
+	} else {
+		b.blocks[i] = ref
+	}
+}
+
 func (b *baseBlockset) makeID(i torus.INodeRef) torus.BlockRef {
 	id := atomic.AddUint64(&b.ids, 1)
 	return torus.BlockRef{
@@ -100,6 +145,8 @@ func (b *baseBlockset) makeID(i torus.INodeRef) torus.BlockRef {
 }
 
 func (b *baseBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
 	buf := make([]byte, len(b.blocks)*torus.BlockRefByteSize)
 	for i, x := range b.blocks {
 		x.ToBytesBuf(buf[(i * torus.BlockRefByteSize) : (i+1)*torus.BlockRefByteSize])
@@ -122,6 +169,8 @@ func (b *baseBlockset) Unmarshal(data []byte) error {
 	for i := 0; i < l; i++ {
 		out[i] = torus.BlockRefFromBytes(data[(i * torus.BlockRefByteSize) : (i+1)*torus.BlockRefByteSize])
 	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
 	b.blocks = out
 	return nil
 }
@@ -129,6 +178,8 @@ func (b *baseBlockset) Unmarshal(data []byte) error {
 func (b *baseBlockset) GetSubBlockset() torus.Blockset { return nil }
 
 func (b *baseBlockset) GetLiveINodes() *roaring.Bitmap {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
 	out := roaring.NewBitmap()
 	for _, blk := range b.blocks {
 		if blk.IsZero() {
@@ -140,6 +191,8 @@ func (b *baseBlockset) GetLiveINodes() *roaring.Bitmap {
 }
 
 func (b *baseBlockset) Truncate(lastIndex int, _ uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
 	if lastIndex <= len(b.blocks) {
 		b.blocks = b.blocks[:lastIndex]
 		return nil
@@ -153,6 +206,8 @@ func (b *baseBlockset) Truncate(lastIndex int, _ uint64) error {
 }
 
 func (b *baseBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
 	if from >= len(b.blocks) {
 		return nil
 	}
@@ -166,12 +221,16 @@ func (b *baseBlockset) Trim(from, to int) error {
 }
 
 func (b *baseBlockset) GetAllBlockRefs() []torus.BlockRef {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
 	out := make([]torus.BlockRef, len(b.blocks))
 	copy(out, b.blocks)
 	return out
 }
 
 func (b *baseBlockset) String() string {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
 	out := "[\n"
 	for _, x := range b.blocks {
 		out += x.String() + "\n"
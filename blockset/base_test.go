@@ -1,6 +1,7 @@
 package blockset
 
 import (
+	"bytes"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -72,3 +73,30 @@ func marshalTest(t *testing.T, s torus.BlockStore, spec torus.BlockLayerSpec) {
 		t.Error("data not retrieved")
 	}
 }
+
+func TestUnwrittenBlocks(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newCRCBlockset(newBaseBlockset(s))
+	inode := torus.NewINodeRef(1, 1)
+	b.Truncate(4, 1024)
+	b.PutBlock(context.TODO(), inode, 1, bytes.Repeat([]byte{'x'}, 1024))
+	b.PutBlock(context.TODO(), inode, 2, bytes.Repeat([]byte{'y'}, 1024))
+	b.Trim(2, 3)
+	strict := context.WithValue(context.TODO(), torus.CtxUnwrittenReads, torus.UnwrittenReadError)
+	for _, i := range []int{0, 2, 3} {
+		data, err := b.GetBlock(context.TODO(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, make([]byte, 1024)) {
+			t.Fatalf("unwritten block %d isn't zeros", i)
+		}
+		_, err = b.GetBlock(strict, i)
+		if err != torus.ErrUnwritten {
+			t.Fatalf("expected ErrUnwritten for block %d, got %v", i, err)
+		}
+	}
+	if _, err := b.GetBlock(strict, 1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -22,11 +22,31 @@ var (
 		Name: "torus_blockset_base_failed_blocks",
 		Help: "Number of blocks that failed",
 	})
+	promCompressIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_compress_bytes_in_total",
+		Help: "Bytes of non-zero blocks written to compressed volumes, before compression",
+	})
+	promCompressOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_compress_bytes_out_total",
+		Help: "Bytes of non-zero blocks written to compressed volumes, as stored",
+	})
+	promErasureDegradedReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_erasure_degraded_reads_total",
+		Help: "Number of erasure coded blocks which had to be reconstructed to be read",
+	})
+	promErasureRebuilt = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_blockset_erasure_rebuilt_shards_total",
+		Help: "Number of lost erasure coded shards rebuilt and written back",
+	})
 )
 
 func init() {
 	prometheus.MustRegister(promCRCFail)
 	prometheus.MustRegister(promBaseFail)
+	prometheus.MustRegister(promCompressIn)
+	prometheus.MustRegister(promCompressOut)
+	prometheus.MustRegister(promErasureDegradedReads)
+	prometheus.MustRegister(promErasureRebuilt)
 }
 
 type blockset interface {
@@ -41,6 +61,11 @@ const (
 	Base torus.BlockLayerKind = iota
 	CRC
 	Replication
+	Checksum
+	Encrypt
+	Compress
+	Erasure
+	Dedup
 )
 
 // CreateBlocksetFunc is the signature of a constructor used to create
@@ -121,6 +146,16 @@ func ParseBlockLayerKind(s string) (torus.BlockLayerKind, error) {
 		return CRC, nil
 	case "rep", "r":
 		return Replication, nil
+	case "checksum", "sum":
+		return Checksum, nil
+	case "encrypt":
+		return Encrypt, nil
+	case "compress":
+		return Compress, nil
+	case "erasure", "ec":
+		return Erasure, nil
+	case "dedup":
+		return Dedup, nil
 	default:
 		return torus.BlockLayerKind(-1), fmt.Errorf("no such block layer type: %s", s)
 	}
@@ -0,0 +1,436 @@
+package blockset
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/pkg/capnslog"
+	"github.com/coreos/torus"
+)
+
+// ChecksumAlgorithm identifies the function a checksum layer verifies its
+// blocks with. The values are serialized, so they must not change.
+type ChecksumAlgorithm byte
+
+const (
+	// ChecksumCRC32 is the IEEE CRC32 used by the crc layer.
+	ChecksumCRC32 ChecksumAlgorithm = iota
+	// ChecksumCRC32C is the Castagnoli CRC32, which most modern CPUs
+	// compute in hardware.
+	ChecksumCRC32C
+	// ChecksumXXHash is the 64 bit xxHash; fast in software, with far fewer
+	// collisions than a CRC.
+	ChecksumXXHash
+	// ChecksumSHA256 is cryptographically collision resistant, at a cost.
+	ChecksumSHA256
+)
+
+var checksumNames = []string{"crc32", "crc32c", "xxhash", "sha256"}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ParseChecksumAlgorithm returns the algorithm with the given name, one of
+// crc32, crc32c, xxhash or sha256.
+func ParseChecksumAlgorithm(s string) (ChecksumAlgorithm, error) {
+	for i, n := range checksumNames {
+		if s == n {
+			return ChecksumAlgorithm(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown checksum algorithm %q", s)
+}
+
+func (a ChecksumAlgorithm) String() string {
+	if int(a) < len(checksumNames) {
+		return checksumNames[a]
+	}
+	return fmt.Sprintf("checksum(%d)", byte(a))
+}
+
+// Size is the length in bytes of the algorithm's checksums.
+func (a ChecksumAlgorithm) Size() int {
+	switch a {
+	case ChecksumCRC32, ChecksumCRC32C:
+		return 4
+	case ChecksumXXHash:
+		return 8
+	case ChecksumSHA256:
+		return sha256.Size
+	}
+	panic("unknown checksum algorithm")
+}
+
+// Sum returns the checksum of data.
+func (a ChecksumAlgorithm) Sum(data []byte) []byte {
+	out := make([]byte, a.Size())
+	switch a {
+	case ChecksumCRC32:
+		binary.LittleEndian.PutUint32(out, crc32.ChecksumIEEE(data))
+	case ChecksumCRC32C:
+		binary.LittleEndian.PutUint32(out, crc32.Checksum(data, castagnoli))
+	case ChecksumXXHash:
+		binary.LittleEndian.PutUint64(out, xxhash64(data))
+	case ChecksumSHA256:
+		h := sha256.Sum256(data)
+		copy(out, h[:])
+	}
+	return out
+}
+
+// Format renders a checksum the way other tools print the algorithm's
+// checksums: as a hex number for the CRCs and xxHash, and as hex bytes for
+// SHA-256.
+func (a ChecksumAlgorithm) Format(sum []byte) string {
+	switch a {
+	case ChecksumCRC32, ChecksumCRC32C:
+		return fmt.Sprintf("%08x", binary.LittleEndian.Uint32(sum))
+	case ChecksumXXHash:
+		return fmt.Sprintf("%016x", binary.LittleEndian.Uint64(sum))
+	}
+	return fmt.Sprintf("%x", sum)
+}
+
+// Parse reads a checksum printed by Format.
+func (a ChecksumAlgorithm) Parse(s string) ([]byte, error) {
+	out := make([]byte, a.Size())
+	switch a {
+	case ChecksumCRC32, ChecksumCRC32C:
+		v, err := strconv.ParseUint(s, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint32(out, uint32(v))
+	case ChecksumXXHash:
+		v, err := strconv.ParseUint(s, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(out, v)
+	default:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != len(out) {
+			return nil, fmt.Errorf("%s checksum %q has the wrong length", a, s)
+		}
+		copy(out, b)
+	}
+	return out, nil
+}
+
+// ErrNoChecksums is returned by Checksums for blocksets without a checksum
+// layer.
+var ErrNoChecksums = errors.New("blockset: no checksum layer")
+
+// Checksums returns the algorithm and the stored per-block checksums of the
+// outermost crc or checksum layer of bs.
+func Checksums(bs torus.Blockset) (ChecksumAlgorithm, [][]byte, error) {
+	for ; bs != nil; bs = bs.GetSubBlockset() {
+		switch b := bs.(type) {
+		case *checksumBlockset:
+			b.mut.RLock()
+			defer b.mut.RUnlock()
+			out := make([][]byte, b.count())
+			for i := range out {
+				out[i] = append([]byte(nil), b.at(i)...)
+			}
+			return b.algo, out, nil
+		case *crcBlockset:
+			b.mut.RLock()
+			defer b.mut.RUnlock()
+			out := make([][]byte, len(b.crcs))
+			for i, crc := range b.crcs {
+				out[i] = make([]byte, 4)
+				binary.LittleEndian.PutUint32(out[i], crc)
+			}
+			return ChecksumCRC32, out, nil
+		}
+	}
+	return 0, nil, ErrNoChecksums
+}
+
+// checksumBlockset is the crc layer generalized over the checksum algorithm.
+// Its serialized form starts with the algorithm, so blocksets read back always
+// verify with the algorithm they were written with.
+type checksumBlockset struct {
+	sub      blockset
+	algo     ChecksumAlgorithm
+	sums     []byte
+	mut      sync.RWMutex
+	emptySum []byte
+}
+
+var _ blockset = &checksumBlockset{}
+
+func init() {
+	RegisterBlockset(Checksum, func(opts string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		// Unmarshalled layers have no options; the algorithm comes with
+		// the data.
+		if opts == "" {
+			return newChecksumBlockset(sub, ChecksumCRC32C), nil
+		}
+		algo, err := ParseChecksumAlgorithm(opts)
+		if err != nil {
+			return nil, err
+		}
+		return newChecksumBlockset(sub, algo), nil
+	})
+}
+
+func newChecksumBlockset(sub blockset, algo ChecksumAlgorithm) *checksumBlockset {
+	return &checksumBlockset{
+		sub:  sub,
+		algo: algo,
+	}
+}
+
+func (b *checksumBlockset) count() int {
+	return len(b.sums) / b.algo.Size()
+}
+
+func (b *checksumBlockset) at(i int) []byte {
+	n := b.algo.Size()
+	return b.sums[i*n : (i+1)*n]
+}
+
+func (b *checksumBlockset) Length() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if b.sub.Length() != b.count() {
+		panic("checksums should always be as long as the sub blockset")
+	}
+	return b.count()
+}
+
+func (b *checksumBlockset) Kind() uint32 {
+	return uint32(Checksum)
+}
+
+func (b *checksumBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= b.count() {
+		clog.Trace("checksum: requesting block off the edge of known blocks")
+		return nil, torus.ErrBlockNotExist
+	}
+	want := b.at(i)
+	ctx = torus.WithBlockCheck(ctx, func(data []byte) bool {
+		return bytes.Equal(b.algo.Sum(data), want)
+	})
+	data, err := b.sub.GetBlock(ctx, i)
+	if err != nil {
+		clog.Trace("checksum: error requesting subblock")
+		return nil, err
+	}
+	sum := b.algo.Sum(data)
+	if !bytes.Equal(sum, b.at(i)) {
+		clog.Warningf("checksum: block %d did not pass %s", i, b.algo)
+		clog.Debugf("checksum: %x should be %x", sum, b.at(i))
+		promCRCFail.Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	return data, nil
+}
+
+func (b *checksumBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > b.count() {
+		return torus.ErrBlockNotExist
+	}
+	sum := b.algo.Sum(data)
+	if bytes.Equal(sum, b.emptySum) {
+		ctx = context.WithValue(ctx, "isEmpty", true)
+	}
+	err := b.sub.PutBlock(ctx, inode, i, data)
+	if err != nil {
+		return err
+	}
+	if i == b.count() {
+		b.sums = append(b.sums, sum...)
+	} else {
+		copy(b.at(i), sum)
+	}
+	if clog.LevelAt(capnslog.TRACE) {
+		clog.Tracef("checksum: setting %s %x at index %d", b.algo, sum, i)
+	}
+	return nil
+}
+
+func (b *checksumBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *checksumBlockset) setStore(s torus.BlockStore) {
+	b.emptySum = b.algo.Sum(make([]byte, s.BlockSize()))
+	b.sub.setStore(s)
+}
+
+func (b *checksumBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+func (b *checksumBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	buf := make([]byte, 1+len(b.sums))
+	buf[0] = byte(b.algo)
+	copy(buf[1:], b.sums)
+	return buf, nil
+}
+
+func (b *checksumBlockset) Unmarshal(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if len(data) == 0 {
+		return fmt.Errorf("checksum: missing algorithm")
+	}
+	algo := ChecksumAlgorithm(data[0])
+	if int(algo) >= len(checksumNames) {
+		return fmt.Errorf("checksum: unknown algorithm %d", data[0])
+	}
+	if (len(data)-1)%algo.Size() != 0 {
+		return fmt.Errorf("checksum: corrupt %s checksums", algo)
+	}
+	b.algo = algo
+	b.sums = append([]byte(nil), data[1:]...)
+	return nil
+}
+
+func (b *checksumBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *checksumBlockset) GetLiveINodes() *roaring.Bitmap {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return b.sub.GetLiveINodes()
+}
+
+func (b *checksumBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Truncate(lastIndex, blocksize)
+	if err != nil {
+		return err
+	}
+	if lastIndex <= b.count() {
+		b.sums = b.sums[:lastIndex*b.algo.Size()]
+		return nil
+	}
+	sum := b.algo.Sum(make([]byte, blocksize))
+	for toadd := lastIndex - b.count(); toadd != 0; toadd-- {
+		b.sums = append(b.sums, sum...)
+	}
+	return nil
+}
+
+func (b *checksumBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Trim(from, to)
+	if err != nil {
+		return err
+	}
+	if from >= b.count() {
+		return nil
+	}
+	if to > b.count() {
+		to = b.count()
+	}
+	b.emptySum = b.algo.Sum(make([]byte, b.getStore().BlockSize()))
+	for i := from; i < to; i++ {
+		copy(b.at(i), b.emptySum)
+	}
+	return nil
+}
+
+func (b *checksumBlockset) GetAllBlockRefs() []torus.BlockRef {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *checksumBlockset) String() string {
+	return "checksum(" + b.algo.String() + ")\n" + b.sub.String()
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func rotl64(x uint64, r uint) uint64 {
+	return x<<r | x>>(64-r)
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = rotl64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// xxhash64 is XXH64 with a zero seed.
+func xxhash64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		// The initial accumulators wrap around, which constants can't.
+		p1, p2 := xxPrime1, xxPrime2
+		v1 := p1 + p2
+		v2 := p2
+		v3 := uint64(0)
+		v4 := -p1
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+			b = b[32:]
+		}
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for ; len(b) > 0; b = b[1:] {
+		h ^= uint64(b[0]) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
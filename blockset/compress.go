@@ -0,0 +1,297 @@
+package blockset
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/torus"
+)
+
+// CompressionAlgorithm identifies how a compression layer compresses its
+// blocks. The values are serialized, so they must not change.
+type CompressionAlgorithm byte
+
+const (
+	// CompressLZ4 is fast enough to sit in the write path at little cost.
+	CompressLZ4 CompressionAlgorithm = iota
+	// CompressDeflate compresses further than LZ4, for more CPU time.
+	CompressDeflate
+)
+
+var compressionNames = []string{"lz4", "deflate"}
+
+// ParseCompressionAlgorithm returns the algorithm with the given name, lz4 or
+// deflate.
+func ParseCompressionAlgorithm(s string) (CompressionAlgorithm, error) {
+	for i, n := range compressionNames {
+		if s == n {
+			return CompressionAlgorithm(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression algorithm %q", s)
+}
+
+func (a CompressionAlgorithm) String() string {
+	if int(a) < len(compressionNames) {
+		return compressionNames[a]
+	}
+	return fmt.Sprintf("compression(%d)", byte(a))
+}
+
+func (a CompressionAlgorithm) compress(data []byte) []byte {
+	switch a {
+	case CompressLZ4:
+		return lz4Compress(data)
+	case CompressDeflate:
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	panic("unknown compression algorithm")
+}
+
+// decompress decompresses data, which is at most max bytes uncompressed.
+func (a CompressionAlgorithm) decompress(data []byte, max int) ([]byte, error) {
+	switch a {
+	case CompressLZ4:
+		out := make([]byte, max)
+		n, err := lz4Decompress(out, data)
+		if err != nil {
+			return nil, err
+		}
+		return out[:n], nil
+	case CompressDeflate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > max {
+			return nil, errors.New("compress: block decompresses too large")
+		}
+		return out, nil
+	}
+	panic("unknown compression algorithm")
+}
+
+// compressBlockset compresses blocks before handing them to the layer below,
+// so that less is sent to, cached and held by the storage nodes. It records
+// how long each stored block is; zero means the block is stored as it is,
+// which is the case for blocks of zeroes and ones which don't compress.
+type compressBlockset struct {
+	sub  blockset
+	alg  CompressionAlgorithm
+	lens []uint32
+	mut  sync.RWMutex
+}
+
+var _ blockset = &compressBlockset{}
+
+func init() {
+	RegisterBlockset(Compress, func(opts string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		// Unmarshalled layers have no options; the algorithm comes
+		// with the data.
+		alg := CompressLZ4
+		if opts != "" {
+			var err error
+			alg, err = ParseCompressionAlgorithm(opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &compressBlockset{
+			sub: sub,
+			alg: alg,
+		}, nil
+	})
+}
+
+func (b *compressBlockset) Length() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if b.sub.Length() != len(b.lens) {
+		panic("lengths should always be as long as the sub blockset")
+	}
+	return len(b.lens)
+}
+
+func (b *compressBlockset) Kind() uint32 {
+	return uint32(Compress)
+}
+
+func (b *compressBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= len(b.lens) {
+		clog.Trace("compress: requesting block off the edge of known blocks")
+		return nil, torus.ErrBlockNotExist
+	}
+	data, err := b.sub.GetBlock(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	n := int(b.lens[i])
+	if n == 0 {
+		return data, nil
+	}
+	if n > len(data) {
+		clog.Warningf("compress: block %d is shorter than its compressed length", i)
+		return nil, torus.ErrBlockUnavailable
+	}
+	out, err := b.alg.decompress(data[:n], int(b.getStore().BlockSize()))
+	if err != nil {
+		clog.Warningf("compress: block %d failed to decompress: %v", i, err)
+		return nil, torus.ErrBlockUnavailable
+	}
+	return out, nil
+}
+
+func (b *compressBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > len(b.lens) {
+		return torus.ErrBlockNotExist
+	}
+	var n uint32
+	// Zeroes are stored as they are, so that the layers below can still
+	// tell them apart.
+	if !isZeroes(data) {
+		c := b.alg.compress(data)
+		promCompressIn.Add(float64(len(data)))
+		if len(c) < len(data) {
+			data = c
+			n = uint32(len(c))
+		}
+		promCompressOut.Add(float64(len(data)))
+	}
+	err := b.sub.PutBlock(ctx, inode, i, data)
+	if err != nil {
+		return err
+	}
+	if i == len(b.lens) {
+		b.lens = append(b.lens, n)
+	} else {
+		b.lens[i] = n
+	}
+	return nil
+}
+
+func (b *compressBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *compressBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *compressBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+func (b *compressBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	buf := make([]byte, 1+len(b.lens)*4)
+	buf[0] = byte(b.alg)
+	for i, x := range b.lens {
+		binary.LittleEndian.PutUint32(buf[1+i*4:], x)
+	}
+	return buf, nil
+}
+
+func (b *compressBlockset) Unmarshal(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if len(data) < 1 || (len(data)-1)%4 != 0 {
+		return errors.New("compress: corrupt layer")
+	}
+	alg := CompressionAlgorithm(data[0])
+	if int(alg) >= len(compressionNames) {
+		return fmt.Errorf("compress: unknown algorithm %d", data[0])
+	}
+	lens := make([]uint32, (len(data)-1)/4)
+	for i := range lens {
+		lens[i] = binary.LittleEndian.Uint32(data[1+i*4:])
+	}
+	b.alg = alg
+	b.lens = lens
+	return nil
+}
+
+func (b *compressBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *compressBlockset) GetLiveINodes() *roaring.Bitmap {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return b.sub.GetLiveINodes()
+}
+
+func (b *compressBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Truncate(lastIndex, blocksize)
+	if err != nil {
+		return err
+	}
+	if lastIndex <= len(b.lens) {
+		b.lens = b.lens[:lastIndex]
+		return nil
+	}
+	b.lens = append(b.lens, make([]uint32, lastIndex-len(b.lens))...)
+	return nil
+}
+
+func (b *compressBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Trim(from, to)
+	if err != nil {
+		return err
+	}
+	if from >= len(b.lens) {
+		return nil
+	}
+	if to > len(b.lens) {
+		to = len(b.lens)
+	}
+	for i := from; i < to; i++ {
+		b.lens[i] = 0
+	}
+	return nil
+}
+
+func (b *compressBlockset) GetAllBlockRefs() []torus.BlockRef {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *compressBlockset) String() string {
+	return "compress(" + b.alg.String() + ")\n" + b.sub.String()
+}
+
+// StoredLengths returns how many bytes each block of bs takes up once
+// compressed, or nil if bs isn't compressed. Blocks which are stored as they
+// are have a length of zero.
+func StoredLengths(bs torus.Blockset) []uint32 {
+	for ; bs != nil; bs = bs.GetSubBlockset() {
+		if c, ok := bs.(*compressBlockset); ok {
+			c.mut.RLock()
+			defer c.mut.RUnlock()
+			return append([]uint32(nil), c.lens...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package blockset
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func TestCompressReadWrite(t *testing.T) {
+	for _, alg := range []CompressionAlgorithm{CompressLZ4, CompressDeflate} {
+		s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		readWriteTest(t, &compressBlockset{sub: newBaseBlockset(s), alg: alg})
+		marshalTest(t, s, MustParseBlockLayerSpec("compress="+alg.String()+",crc,base"))
+	}
+}
+
+func TestCompressStored(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b := newBaseBlockset(s)
+	c := &compressBlockset{sub: b, alg: CompressLZ4}
+	inode := torus.NewINodeRef(1, 1)
+	text := bytes.Repeat([]byte("compressible "), 1024/13+1)[:1024]
+	random := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	for i, data := range [][]byte{text, random, make([]byte, 1024)} {
+		if err := c.PutBlock(context.TODO(), inode, i, data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.GetBlock(context.TODO(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("block %d didn't read back", i)
+		}
+	}
+	lens := StoredLengths(&crcBlockset{sub: c})
+	if lens[0] == 0 || lens[0] >= 1024/4 {
+		t.Errorf("text stored in %d bytes", lens[0])
+	}
+	if lens[1] != 0 || lens[2] != 0 {
+		t.Errorf("random data and zeroes were compressed: %v", lens)
+	}
+	if StoredLengths(b) != nil {
+		t.Error("uncompressed blockset has stored lengths")
+	}
+
+	s.WriteBlock(context.TODO(), b.blocks[0], []byte("Evil Corruption!!"))
+	if _, err := c.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatal("no corruption detection")
+	}
+}
+
+func TestLZ4(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	long := make([]byte, 70000)
+	for i := range long {
+		// Runs of repeated bytes make long matches and long literals.
+		if i%5000 < 300 {
+			long[i] = byte(r.Intn(256))
+		} else {
+			long[i] = byte(i / 1000)
+		}
+	}
+	for _, in := range [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabcabcabc"),
+		bytes.Repeat([]byte{0}, 4096),
+		long,
+	} {
+		c := lz4Compress(in)
+		out := make([]byte, len(in))
+		n, err := lz4Decompress(out, c)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", len(in), err)
+		}
+		if !bytes.Equal(out[:n], in) {
+			t.Fatalf("%d bytes didn't round trip", len(in))
+		}
+	}
+	if _, err := lz4Decompress(make([]byte, 10), []byte{0x1f, 'a', 5, 0}); err != errLZ4Corrupt {
+		t.Error("accepted an offset past the start")
+	}
+}
@@ -0,0 +1,109 @@
+package blockset
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var promHashCollisions = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "torus_blockset_hash_collisions",
+	Help: "Number of writes whose content hash matched a stored block with different contents",
+})
+
+func init() {
+	prometheus.MustRegister(promHashCollisions)
+}
+
+type contentHash [sha256.Size]byte
+
+func sha256Hash(data []byte) contentHash {
+	return sha256.Sum256(data)
+}
+
+// ContentStore holds the index of block contents shared by every
+// deduplicated volume in the cluster, and the pins which keep the blocks
+// matched in it from the GC until the inodes naming them are synced. Hashes
+// are those of the blocks' contents.
+type ContentStore interface {
+	// LookupContent returns the block indexed as holding contents with
+	// the hash, if there is one.
+	LookupContent(hash []byte) (torus.BlockRef, bool, error)
+	// AddContent indexes ref as holding contents with the hash, unless
+	// another block already is.
+	AddContent(hash []byte, ref torus.BlockRef) error
+	// ForgetContent drops the entry for the hash if it's still ref.
+	ForgetContent(hash []byte, ref torus.BlockRef) error
+	// PinBlock keeps ref from the GC until the pin it returns is
+	// released. It fails with torus.ErrBlockNotExist if the GC has
+	// already condemned the block.
+	PinBlock(ref torus.BlockRef) (string, error)
+	UnpinBlock(ref torus.BlockRef, pin string) error
+}
+
+// contentIndex maps block contents to a block already holding them, for
+// content-addressed storage. A match on the hash alone is never trusted:
+// the stored block is read back and compared byte-for-byte before its ref is
+// handed out, and a mismatch fails with torus.ErrHashCollision rather than
+// aliasing two different blocks.
+type contentIndex struct {
+	store   torus.BlockStore
+	content ContentStore
+	hash    func([]byte) contentHash
+}
+
+func newContentIndex(store torus.BlockStore, content ContentStore) *contentIndex {
+	return &contentIndex{
+		store:   store,
+		content: content,
+		hash:    sha256Hash,
+	}
+}
+
+// lookup returns the ref of a stored block whose contents are exactly data,
+// if there is one, pinned with the pin it returns.
+func (c *contentIndex) lookup(ctx context.Context, data []byte) (torus.BlockRef, string, bool, error) {
+	h := c.hash(data)
+	ref, ok, err := c.content.LookupContent(h[:])
+	if err != nil || !ok {
+		return torus.BlockRef{}, "", false, err
+	}
+	// Pin the block before reading it back, so that it can't be collected
+	// once it has been found.
+	pin, err := c.content.PinBlock(ref)
+	if err == torus.ErrBlockNotExist {
+		// The block is being collected.
+		return torus.BlockRef{}, "", false, c.content.ForgetContent(h[:], ref)
+	}
+	if err != nil {
+		return torus.BlockRef{}, "", false, err
+	}
+	stored, err := c.store.GetBlock(ctx, ref)
+	if err == nil && !bytes.Equal(stored, data) {
+		promHashCollisions.Inc()
+		clog.Errorf("content hash %x of a new block matches block %s, which holds different data", h[:], ref)
+		err = torus.ErrHashCollision
+	}
+	if err != nil {
+		c.content.UnpinBlock(ref, pin)
+	}
+	if err == torus.ErrBlockNotExist {
+		// The block has been collected since it was indexed.
+		return torus.BlockRef{}, "", false, c.content.ForgetContent(h[:], ref)
+	}
+	if err != nil {
+		return torus.BlockRef{}, "", false, err
+	}
+	return ref, pin, true, nil
+}
+
+// add records that ref holds data. An existing entry for the same contents
+// is kept.
+func (c *contentIndex) add(ref torus.BlockRef, data []byte) error {
+	h := c.hash(data)
+	return c.content.AddContent(h[:], ref)
+}
@@ -0,0 +1,169 @@
+package blockset
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+// memContentStore is a ContentStore for tests, which can condemn blocks as
+// the GC would.
+type memContentStore struct {
+	refs      map[string]torus.BlockRef
+	pins      map[torus.BlockRef]map[string]bool
+	condemned map[torus.BlockRef]bool
+	next      int
+}
+
+func newMemContentStore() *memContentStore {
+	return &memContentStore{
+		refs:      make(map[string]torus.BlockRef),
+		pins:      make(map[torus.BlockRef]map[string]bool),
+		condemned: make(map[torus.BlockRef]bool),
+	}
+}
+
+func (m *memContentStore) LookupContent(hash []byte) (torus.BlockRef, bool, error) {
+	ref, ok := m.refs[string(hash)]
+	return ref, ok, nil
+}
+
+func (m *memContentStore) AddContent(hash []byte, ref torus.BlockRef) error {
+	if _, ok := m.refs[string(hash)]; !ok {
+		m.refs[string(hash)] = ref
+	}
+	return nil
+}
+
+func (m *memContentStore) ForgetContent(hash []byte, ref torus.BlockRef) error {
+	if m.refs[string(hash)] == ref {
+		delete(m.refs, string(hash))
+	}
+	return nil
+}
+
+func (m *memContentStore) PinBlock(ref torus.BlockRef) (string, error) {
+	if m.condemned[ref] {
+		return "", torus.ErrBlockNotExist
+	}
+	if m.pins[ref] == nil {
+		m.pins[ref] = make(map[string]bool)
+	}
+	m.next++
+	pin := fmt.Sprint(m.next)
+	m.pins[ref][pin] = true
+	return pin, nil
+}
+
+func (m *memContentStore) UnpinBlock(ref torus.BlockRef, pin string) error {
+	delete(m.pins[ref], pin)
+	if len(m.pins[ref]) == 0 {
+		delete(m.pins, ref)
+	}
+	return nil
+}
+
+// condemn condemns ref unless it's pinned, as the GC does.
+func (m *memContentStore) condemn(ref torus.BlockRef) bool {
+	if len(m.pins[ref]) != 0 {
+		return false
+	}
+	m.condemned[ref] = true
+	return true
+}
+
+func TestContentIndexMatch(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	c := newContentIndex(s, newMemContentStore())
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 1}
+	data := []byte("Some data")
+	s.WriteBlock(context.TODO(), ref, data)
+	c.add(ref, data)
+
+	got, _, ok, err := c.lookup(context.TODO(), []byte("Some data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || got != ref {
+		t.Fatalf("expected a match on %s, got %s (%v)", ref, got, ok)
+	}
+	_, _, ok, err = c.lookup(context.TODO(), []byte("Other data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("unexpected match for different contents")
+	}
+}
+
+func TestContentIndexCollision(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	c := newContentIndex(s, newMemContentStore())
+	// Hash everything to the same address, so that any two different blocks
+	// collide.
+	c.hash = func([]byte) contentHash { return contentHash{} }
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 1}
+	data := []byte("Some data")
+	s.WriteBlock(context.TODO(), ref, data)
+	c.add(ref, data)
+
+	_, _, ok, err := c.lookup(context.TODO(), []byte("Evil twin"))
+	if err != torus.ErrHashCollision {
+		t.Fatalf("expected a hash collision, got %v", err)
+	}
+	if ok {
+		t.Fatal("colliding block was deduplicated")
+	}
+	got, _, ok, err := c.lookup(context.TODO(), data)
+	if err != nil || !ok || got != ref {
+		t.Fatalf("identical contents should still match: %s %v %v", got, ok, err)
+	}
+}
+
+func TestContentIndexStale(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	content := newMemContentStore()
+	c := newContentIndex(s, content)
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 1}
+	data := []byte("Some data")
+	c.add(ref, data)
+
+	_, _, ok, err := c.lookup(context.TODO(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("matched a block which isn't stored")
+	}
+	if len(content.refs) != 0 {
+		t.Fatal("stale entry wasn't dropped")
+	}
+	if len(content.pins) != 0 {
+		t.Fatal("pin on a block which isn't stored was kept")
+	}
+}
+
+func TestContentIndexCondemned(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	content := newMemContentStore()
+	c := newContentIndex(s, content)
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: 1}
+	data := []byte("Some data")
+	s.WriteBlock(context.TODO(), ref, data)
+	c.add(ref, data)
+	content.condemn(ref)
+
+	_, _, ok, err := c.lookup(context.TODO(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("matched a block condemned by the GC")
+	}
+	if len(content.refs) != 0 {
+		t.Fatal("condemned entry wasn't dropped")
+	}
+}
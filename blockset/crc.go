@@ -55,6 +55,10 @@ func (b *crcBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
 		clog.Trace("crc: requesting block off the edge of known blocks")
 		return nil, torus.ErrBlockNotExist
 	}
+	want := b.crcs[i]
+	ctx = torus.WithBlockCheck(ctx, func(data []byte) bool {
+		return crc32.ChecksumIEEE(data) == want
+	})
 	data, err := b.sub.GetBlock(ctx, i)
 	if err != nil {
 		clog.Trace("crc: error requesting subblock")
@@ -1,6 +1,9 @@
 package blockset
 
 import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -35,3 +38,108 @@ func TestCRCCorruption(t *testing.T) {
 		t.Fatal("No corruption detection")
 	}
 }
+
+func TestXXHash64(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"abc", 0x44bc2cf5ad770999},
+	} {
+		if got := xxhash64([]byte(tt.in)); got != tt.want {
+			t.Errorf("xxhash64(%q) = %x, want %x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumAlgorithms(t *testing.T) {
+	for _, algo := range []string{"crc32", "crc32c", "xxhash", "sha256"} {
+		s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		marshalTest(t, s, MustParseBlockLayerSpec("checksum="+algo+",base"))
+
+		a, _ := ParseChecksumAlgorithm(algo)
+		b := newBaseBlockset(s)
+		sum := newChecksumBlockset(b, a)
+		sum.setStore(s)
+		inode := torus.NewINodeRef(1, 1)
+		sum.PutBlock(context.TODO(), inode, 0, []byte("Some data"))
+		s.WriteBlock(context.TODO(), b.blocks[0], []byte("Evil Corruption!!"))
+		_, err := sum.GetBlock(context.TODO(), 0)
+		if err != torus.ErrBlockUnavailable {
+			t.Fatalf("%s: no corruption detection", algo)
+		}
+	}
+}
+
+func TestExportChecksums(t *testing.T) {
+	data := []byte("Some data")
+	for _, spec := range []string{"crc,base", "checksum=crc32c,base", "checksum=xxhash,base", "checksum=sha256,base"} {
+		s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		bs, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec(spec), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs.PutBlock(context.TODO(), torus.NewINodeRef(1, 1), 0, data)
+		algo, sums, err := Checksums(bs)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if len(sums) != 1 || !bytes.Equal(sums[0], algo.Sum(data)) {
+			t.Fatalf("%s: got %x, want the %s of the block", spec, sums, algo)
+		}
+		parsed, err := algo.Parse(algo.Format(sums[0]))
+		if err != nil || !bytes.Equal(parsed, sums[0]) {
+			t.Errorf("%s: %s didn't parse back: %x, %v", spec, algo.Format(sums[0]), parsed, err)
+		}
+	}
+	if got := ChecksumCRC32.Format(ChecksumCRC32.Sum(data)); got != fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) {
+		t.Errorf("crc32 formatted as %s", got)
+	}
+}
+
+// replicaStore holds a corrupt copy of some blocks besides the good one, and
+// reads blocks as the distributor does, passing over copies which fail the
+// reader's check.
+type replicaStore struct {
+	torus.BlockStore
+	corrupt map[torus.BlockRef][]byte
+}
+
+func (s *replicaStore) GetBlock(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	if data, ok := s.corrupt[ref]; ok && torus.CheckBlock(ctx, data) {
+		return data, nil
+	}
+	data, err := s.BlockStore.GetBlock(ctx, ref)
+	if err != nil || !torus.CheckBlock(ctx, data) {
+		return nil, torus.ErrBlockUnavailable
+	}
+	return data, nil
+}
+
+func TestChecksumRefetch(t *testing.T) {
+	data := bytes.Repeat([]byte("Some data"), 100)
+	for _, spec := range []string{"crc,base", "checksum=xxhash,base", "checksum=sha256,erasure=2+1,base"} {
+		temp, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+		s := &replicaStore{temp, make(map[torus.BlockRef][]byte)}
+		bs, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec(spec), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inode := torus.NewINodeRef(1, 1)
+		for i := 0; i < 2; i++ {
+			if err := bs.PutBlock(context.TODO(), inode, i, data); err != nil {
+				t.Fatalf("%s: %v", spec, err)
+			}
+		}
+		for _, ref := range bs.GetAllBlockRefs() {
+			s.corrupt[ref] = []byte("Evil Corruption!!")
+		}
+		for i := 0; i < 2; i++ {
+			got, err := bs.GetBlock(context.TODO(), i)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s: block %d read back as %.20q, %v", spec, i, got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package blockset
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/torus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var promDedupBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "torus_blockset_dedup_blocks_total",
+	Help: "Number of blocks written to deduplicated volumes which were already stored, and weren't stored again",
+})
+
+func init() {
+	prometheus.MustRegister(promDedupBlocks)
+}
+
+// dedupBlockset stores each block's contents once. A block whose contents are
+// already held by a block of any deduplicated volume takes that block's ref
+// rather than being written; the GC keeps a block while any volume's blocks
+// or snapshots refer to it.
+//
+// It must sit directly on the base layer, whose refs it chooses. The index of
+// contents, and the pins which keep a matched block from the GC until the
+// inode naming it is synced, are in the ContentStore set with
+// SetContentStore; until one is set, blocks are written without being
+// matched.
+type dedupBlockset struct {
+	sub     *baseBlockset
+	content ContentStore
+	// pending holds the blocks which took an existing ref since the
+	// blockset was last confirmed, with the pin on that ref and what was
+	// written to them, in case the ref was collected regardless.
+	pending map[int]dedupWrite
+	// released holds the pins of blocks overwritten or trimmed since,
+	// which are released at the next confirm.
+	released []dedupPin
+	mut      sync.Mutex
+}
+
+type dedupPin struct {
+	ref torus.BlockRef
+	pin string
+}
+
+type dedupWrite struct {
+	dedupPin
+	inode torus.INodeRef
+	data  []byte
+}
+
+var _ blockset = &dedupBlockset{}
+
+func init() {
+	RegisterBlockset(Dedup, func(_ string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		base, ok := sub.(*baseBlockset)
+		if !ok {
+			return nil, errors.New("dedup: must sit directly on the base layer")
+		}
+		return &dedupBlockset{sub: base, pending: make(map[int]dedupWrite)}, nil
+	})
+}
+
+// SetContentStore sets the content store of a deduplicated blockset. It does
+// nothing for other blocksets.
+func SetContentStore(bs torus.Blockset, content ContentStore) {
+	for ; bs != nil; bs = bs.GetSubBlockset() {
+		if d, ok := bs.(*dedupBlockset); ok {
+			d.mut.Lock()
+			d.content = content
+			d.mut.Unlock()
+			return
+		}
+	}
+}
+
+// IsDeduplicated reports whether bs has a deduplication layer.
+func IsDeduplicated(bs torus.Blockset) bool {
+	for ; bs != nil; bs = bs.GetSubBlockset() {
+		if _, ok := bs.(*dedupBlockset); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *dedupBlockset) Length() int {
+	return b.sub.Length()
+}
+
+func (b *dedupBlockset) Kind() uint32 {
+	return uint32(Dedup)
+}
+
+func (b *dedupBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	return b.sub.GetBlock(ctx, i)
+}
+
+func (b *dedupBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > b.sub.Length() {
+		return torus.ErrBlockNotExist
+	}
+	b.release(i)
+	if b.content == nil {
+		return b.sub.putRef(ctx, i, b.sub.makeID(inode), data)
+	}
+	index := newContentIndex(b.sub.store, b.content)
+	ref, pin, ok, err := index.lookup(ctx, data)
+	collided := err == torus.ErrHashCollision
+	if err != nil && !collided {
+		return err
+	}
+	if ok {
+		promDedupBlocks.Inc()
+		b.sub.setRef(i, ref)
+		b.pending[i] = dedupWrite{dedupPin{ref, pin}, inode, append([]byte(nil), data...)}
+		return nil
+	}
+	ref = b.sub.makeID(inode)
+	if err := b.sub.putRef(ctx, i, ref, data); err != nil {
+		return err
+	}
+	// A colliding block is stored, but not indexed in place of the block
+	// it collided with.
+	if collided {
+		return nil
+	}
+	return index.add(ref, data)
+}
+
+// release drops block i from pending, keeping its pin to be released at the
+// next confirm. It must be called with the lock held.
+func (b *dedupBlockset) release(i int) {
+	if w, ok := b.pending[i]; ok {
+		b.released = append(b.released, w.dedupPin)
+		delete(b.pending, i)
+	}
+}
+
+// confirm releases the pins of the blocks which took existing refs since it
+// was last called, once the inode naming them has been synced, and of those
+// overwritten since. The pins should have kept the refs from being
+// collected; any block found collected regardless is written afresh. It
+// reports whether it wrote any, in which case the inode must be synced
+// again.
+func (b *dedupBlockset) confirm(ctx context.Context) (bool, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	rewrote := false
+	for i, w := range b.pending {
+		_, err := b.sub.store.GetBlock(ctx, w.ref)
+		if err != nil && err != torus.ErrBlockNotExist {
+			return rewrote, err
+		}
+		if err == torus.ErrBlockNotExist {
+			clog.Warningf("dedup: block %s was collected before it could be kept; rewriting block %d", w.ref, i)
+			if err := b.sub.putRef(ctx, i, b.sub.makeID(w.inode), w.data); err != nil {
+				return rewrote, err
+			}
+			rewrote = true
+		}
+		b.release(i)
+	}
+	for len(b.released) != 0 {
+		p := b.released[0]
+		if err := b.content.UnpinBlock(p.ref, p.pin); err != nil {
+			return rewrote, err
+		}
+		b.released = b.released[1:]
+	}
+	return rewrote, nil
+}
+
+// ConfirmDeduplicated must be called once the inode of a deduplicated
+// blockset has been synced, and reports whether that inode must be synced
+// again. A block which took the ref of another block with the same contents
+// is pinned, so that the GC keeps the block even if nothing else refers to
+// it, until the inode naming it is synced; ConfirmDeduplicated releases the
+// pins, writing any blocks collected regardless again from the data kept for
+// them. It does nothing for other blocksets.
+func ConfirmDeduplicated(ctx context.Context, bs torus.Blockset) (bool, error) {
+	for ; bs != nil; bs = bs.GetSubBlockset() {
+		if d, ok := bs.(*dedupBlockset); ok {
+			return d.confirm(ctx)
+		}
+	}
+	return false, nil
+}
+
+func (b *dedupBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *dedupBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *dedupBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+// The layer keeps nothing of its own; the refs it chose are the base
+// layer's.
+func (b *dedupBlockset) Marshal() ([]byte, error) {
+	return nil, nil
+}
+
+func (b *dedupBlockset) Unmarshal(data []byte) error {
+	return nil
+}
+
+func (b *dedupBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *dedupBlockset) GetLiveINodes() *roaring.Bitmap {
+	return b.sub.GetLiveINodes()
+}
+
+func (b *dedupBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for i := range b.pending {
+		if i >= lastIndex {
+			b.release(i)
+		}
+	}
+	return b.sub.Truncate(lastIndex, blocksize)
+}
+
+func (b *dedupBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for i := range b.pending {
+		if i >= from && i < to {
+			b.release(i)
+		}
+	}
+	return b.sub.Trim(from, to)
+}
+
+func (b *dedupBlockset) GetAllBlockRefs() []torus.BlockRef {
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *dedupBlockset) String() string {
+	return "dedup\n" + b.sub.String()
+}
@@ -0,0 +1,102 @@
+package blockset
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func TestDedupReadWrite(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	readWriteTest(t, &dedupBlockset{sub: newBaseBlockset(s), content: newMemContentStore(), pending: make(map[int]dedupWrite)})
+	marshalTest(t, s, MustParseBlockLayerSpec("crc,dedup,base"))
+}
+
+func TestDedupShared(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	a, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec("dedup,base"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec("dedup,base"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := newMemContentStore()
+	SetContentStore(a, content)
+	SetContentStore(b, content)
+	data := []byte("Some data")
+	if err := a.PutBlock(context.TODO(), torus.NewINodeRef(1, 1), 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutBlock(context.TODO(), torus.NewINodeRef(2, 1), 0, data); err != nil {
+		t.Fatal(err)
+	}
+	ra, rb := a.GetAllBlockRefs()[0], b.GetAllBlockRefs()[0]
+	if ra != rb {
+		t.Fatalf("identical blocks stored twice, as %s and %s", ra, rb)
+	}
+
+	// The GC can't condemn the block while b's inode isn't synced.
+	if content.condemn(ra) {
+		t.Fatal("block shared by an unsynced inode was condemned")
+	}
+	// Were it collected regardless, it would be written again.
+	s.DeleteBlock(context.TODO(), ra)
+	again, err := ConfirmDeduplicated(context.TODO(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again {
+		t.Fatal("collected block wasn't rewritten")
+	}
+	if b.GetAllBlockRefs()[0] == ra {
+		t.Fatal("rewritten block kept the collected ref")
+	}
+	got, err := b.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("rewritten block didn't read back")
+	}
+	if again, _ := ConfirmDeduplicated(context.TODO(), b); again {
+		t.Fatal("confirmed blocks were rewritten twice")
+	}
+	if len(content.pins) != 0 {
+		t.Fatal("confirmed blocks are still pinned")
+	}
+}
+
+func TestDedupOverwriteReleasesPin(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	b, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec("dedup,base"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := newMemContentStore()
+	SetContentStore(b, content)
+	inode := torus.NewINodeRef(1, 1)
+	data := []byte("Some data")
+	if err := b.PutBlock(context.TODO(), inode, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutBlock(context.TODO(), inode, 1, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutBlock(context.TODO(), inode, 1, []byte("Other data")); err != nil {
+		t.Fatal(err)
+	}
+	if len(content.pins) != 1 {
+		t.Fatal("matched block wasn't pinned")
+	}
+	if _, err := ConfirmDeduplicated(context.TODO(), b); err != nil {
+		t.Fatal(err)
+	}
+	if len(content.pins) != 0 {
+		t.Fatal("overwritten block is still pinned")
+	}
+}
@@ -0,0 +1,302 @@
+package blockset
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/torus"
+)
+
+// KeySize is the length of the keys the encryption layer takes: AES-256.
+const KeySize = 32
+
+const (
+	encryptNonceSize = 12
+	encryptTagSize   = 16
+	// encryptSealSize is what the layer keeps for each block: the nonce
+	// it was sealed with and the GCM tag. A block whose seal is all zeroes
+	// holds zeroes, stored in the clear.
+	encryptSealSize = encryptNonceSize + encryptTagSize
+
+	// encryptAESGCM is the only cipher so far. It heads the serialized
+	// layer, so that others can be added.
+	encryptAESGCM byte = 0
+)
+
+// ErrNoKey is returned when an encrypted block is read or written without its
+// key having been added with AddKey.
+var ErrNoKey = errors.New("blockset: the key for the encrypted blockset hasn't been added")
+
+var (
+	keyringMut sync.RWMutex
+	keyring    = make(map[string]cipher.AEAD)
+)
+
+// AddKey makes key available to encryption layers which name id as their key,
+// for the life of the process.
+func AddKey(id string, key []byte) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("blockset: keys must be %d bytes, not %d", KeySize, len(key))
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return err
+	}
+	keyringMut.Lock()
+	defer keyringMut.Unlock()
+	keyring[id] = aead
+	return nil
+}
+
+// HasKey reports whether the key named id has been added.
+func HasKey(id string) bool {
+	keyringMut.RLock()
+	defer keyringMut.RUnlock()
+	_, ok := keyring[id]
+	return ok
+}
+
+func getKey(id string) (cipher.AEAD, error) {
+	keyringMut.RLock()
+	defer keyringMut.RUnlock()
+	aead, ok := keyring[id]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	return aead, nil
+}
+
+// encryptBlockset encrypts each block with AES-GCM before handing it to the
+// layer below, so that only ciphertext leaves the node. The key is named by
+// the layer's options and looked up in the keyring when blocks are read or
+// written; the layer can be unmarshalled, and its blocks found, without it.
+type encryptBlockset struct {
+	sub   blockset
+	keyID string
+	seals []byte
+	mut   sync.RWMutex
+}
+
+var _ blockset = &encryptBlockset{}
+
+func init() {
+	RegisterBlockset(Encrypt, func(opts string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		// Unmarshalled layers have no options; the key ID comes with
+		// the data.
+		return &encryptBlockset{
+			sub:   sub,
+			keyID: opts,
+		}, nil
+	})
+}
+
+func (b *encryptBlockset) count() int {
+	return len(b.seals) / encryptSealSize
+}
+
+func (b *encryptBlockset) seal(i int) []byte {
+	return b.seals[i*encryptSealSize : (i+1)*encryptSealSize]
+}
+
+// additionalData binds a block's ciphertext to its index, so that blocks
+// can't be swapped around undetected.
+func encryptAdditionalData(i int) []byte {
+	ad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ad, uint64(i))
+	return ad
+}
+
+func (b *encryptBlockset) Length() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if b.sub.Length() != b.count() {
+		panic("seals should always be as long as the sub blockset")
+	}
+	return b.count()
+}
+
+func (b *encryptBlockset) Kind() uint32 {
+	return uint32(Encrypt)
+}
+
+func (b *encryptBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= b.count() {
+		clog.Trace("encrypt: requesting block off the edge of known blocks")
+		return nil, torus.ErrBlockNotExist
+	}
+	data, err := b.sub.GetBlock(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	seal := b.seal(i)
+	if isZeroes(seal) {
+		return data, nil
+	}
+	aead, err := getKey(b.keyID)
+	if err != nil {
+		return nil, err
+	}
+	// Copy rather than append the tag, as the data may be the store's.
+	buf := make([]byte, len(data)+encryptTagSize)
+	copy(buf, data)
+	copy(buf[len(data):], seal[encryptNonceSize:])
+	out, err := aead.Open(buf[:0], seal[:encryptNonceSize], buf, encryptAdditionalData(i))
+	if err != nil {
+		clog.Warningf("encrypt: block %d failed authentication", i)
+		promCRCFail.Inc()
+		return nil, torus.ErrBlockUnavailable
+	}
+	return out, nil
+}
+
+func (b *encryptBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > b.count() {
+		return torus.ErrBlockNotExist
+	}
+	seal := make([]byte, encryptSealSize)
+	// Zeroes are stored as they are, like unwritten and trimmed blocks,
+	// so that the layers below can still tell them apart.
+	if !isZeroes(data) {
+		aead, err := getKey(b.keyID)
+		if err != nil {
+			return err
+		}
+		if _, err := rand.Read(seal[:encryptNonceSize]); err != nil {
+			return err
+		}
+		sealed := aead.Seal(nil, seal[:encryptNonceSize], data, encryptAdditionalData(i))
+		copy(seal[encryptNonceSize:], sealed[len(data):])
+		data = sealed[:len(data)]
+	}
+	err := b.sub.PutBlock(ctx, inode, i, data)
+	if err != nil {
+		return err
+	}
+	if i == b.count() {
+		b.seals = append(b.seals, seal...)
+	} else {
+		copy(b.seal(i), seal)
+	}
+	return nil
+}
+
+func (b *encryptBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *encryptBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *encryptBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+func (b *encryptBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if len(b.keyID) > 255 {
+		return nil, fmt.Errorf("encrypt: key ID %q is too long", b.keyID)
+	}
+	buf := make([]byte, 0, 2+len(b.keyID)+len(b.seals))
+	buf = append(buf, encryptAESGCM, byte(len(b.keyID)))
+	buf = append(buf, b.keyID...)
+	buf = append(buf, b.seals...)
+	return buf, nil
+}
+
+func (b *encryptBlockset) Unmarshal(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if len(data) < 2 {
+		return errors.New("encrypt: missing header")
+	}
+	if data[0] != encryptAESGCM {
+		return fmt.Errorf("encrypt: unknown cipher %d", data[0])
+	}
+	n := int(data[1])
+	data = data[2:]
+	if len(data) < n || (len(data)-n)%encryptSealSize != 0 {
+		return errors.New("encrypt: corrupt layer")
+	}
+	b.keyID = string(data[:n])
+	b.seals = append([]byte(nil), data[n:]...)
+	return nil
+}
+
+func (b *encryptBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *encryptBlockset) GetLiveINodes() *roaring.Bitmap {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return b.sub.GetLiveINodes()
+}
+
+func (b *encryptBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Truncate(lastIndex, blocksize)
+	if err != nil {
+		return err
+	}
+	if lastIndex <= b.count() {
+		b.seals = b.seals[:lastIndex*encryptSealSize]
+		return nil
+	}
+	b.seals = append(b.seals, make([]byte, (lastIndex-b.count())*encryptSealSize)...)
+	return nil
+}
+
+func (b *encryptBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	err := b.sub.Trim(from, to)
+	if err != nil {
+		return err
+	}
+	if from >= b.count() {
+		return nil
+	}
+	if to > b.count() {
+		to = b.count()
+	}
+	for i := from; i < to; i++ {
+		copy(b.seal(i), make([]byte, encryptSealSize))
+	}
+	return nil
+}
+
+func (b *encryptBlockset) GetAllBlockRefs() []torus.BlockRef {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.sub.GetAllBlockRefs()
+}
+
+func (b *encryptBlockset) String() string {
+	return "encrypt(" + b.keyID + ")\n" + b.sub.String()
+}
+
+func isZeroes(data []byte) bool {
+	for _, x := range data {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package blockset
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func TestEncryptReadWrite(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	if err := AddKey("test-rw", bytes.Repeat([]byte{1}, KeySize)); err != nil {
+		t.Fatal(err)
+	}
+	readWriteTest(t, &encryptBlockset{sub: newBaseBlockset(s), keyID: "test-rw"})
+}
+
+func TestEncryptMarshal(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	if err := AddKey("test-marshal", bytes.Repeat([]byte{2}, KeySize)); err != nil {
+		t.Fatal(err)
+	}
+	marshalTest(t, s, MustParseBlockLayerSpec("encrypt=test-marshal,crc,base"))
+}
+
+func TestEncryptCiphertext(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	if err := AddKey("test-cipher", bytes.Repeat([]byte{3}, KeySize)); err != nil {
+		t.Fatal(err)
+	}
+	b := newBaseBlockset(s)
+	enc := &encryptBlockset{sub: b, keyID: "test-cipher"}
+	inode := torus.NewINodeRef(1, 1)
+	data := []byte("Some secret data")
+	if err := enc.PutBlock(context.TODO(), inode, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := b.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(data) || bytes.Contains(stored, []byte("secret")) {
+		t.Fatalf("stored %q in the clear", stored)
+	}
+
+	// Blocks can't be moved to another index.
+	enc.PutBlock(context.TODO(), inode, 1, []byte("Other secret data"))
+	copy(enc.seal(1), enc.seal(0))
+	b.blocks[1] = b.blocks[0]
+	if _, err := enc.GetBlock(context.TODO(), 1); err != torus.ErrBlockUnavailable {
+		t.Fatalf("moved block read back with %v", err)
+	}
+
+	s.WriteBlock(context.TODO(), b.blocks[0], []byte("Evil Corruption!"))
+	if _, err := enc.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatal("no tampering detection")
+	}
+
+	other := &encryptBlockset{sub: newBaseBlockset(s), keyID: "test-missing"}
+	if err := other.PutBlock(context.TODO(), inode, 0, data); err != ErrNoKey {
+		t.Fatalf("wrote without a key: %v", err)
+	}
+}
+
+func TestEncryptZeroes(t *testing.T) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	// Zeroes need no key, so none is added.
+	enc := &encryptBlockset{sub: newBaseBlockset(s), keyID: "test-zeroes"}
+	if err := enc.Truncate(2, 1024); err != nil {
+		t.Fatal(err)
+	}
+	zeroes := make([]byte, 1024)
+	if err := enc.PutBlock(context.TODO(), torus.NewINodeRef(1, 1), 0, zeroes); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		data, err := enc.GetBlock(context.TODO(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, zeroes) {
+			t.Fatalf("block %d isn't zeroes", i)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package blockset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/coreos/torus"
+)
+
+// ParseErasureCode parses an erasure code given as K+M: K data blocks
+// protected by M parity blocks, any M of which can be lost.
+func ParseErasureCode(s string) (k, m int, err error) {
+	parts := strings.SplitN(s, "+", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("erasure code %q must be K+M", s)
+	}
+	k, err = strconv.Atoi(parts[0])
+	if err == nil {
+		m, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || k < 1 || m < 1 {
+		return 0, 0, fmt.Errorf("erasure code %q must be K+M, with both at least 1", s)
+	}
+	if k+m > torus.MaxShards {
+		return 0, 0, fmt.Errorf("erasure code %q has more than %d blocks per stripe", s, torus.MaxShards)
+	}
+	return k, m, nil
+}
+
+// erasureBlockset protects blocks with parity rather than copies. Every k
+// consecutive blocks form a stripe, with m parity blocks computed from them,
+// and any k of those k+m shards recover the others. Each shard is stored
+// once, on its own peer where there are enough; see torus.BlockRef.SetShard.
+//
+// It must sit directly on the base layer, whose refs it chooses. Writing a
+// block reads the rest of its stripe to compute the new parity.
+type erasureBlockset struct {
+	k, m int
+	rs   *reedSolomon
+	sub  *baseBlockset
+	// parity holds the m parity refs of each stripe, in order. A stripe
+	// which has only ever held zeroes has zero refs.
+	parity []torus.BlockRef
+	// covered holds the refs of blocks which were trimmed or truncated
+	// since their stripe's parity was computed. They're kept, and read in
+	// their place to reconstruct the stripe, until it is next written.
+	covered map[int]torus.BlockRef
+	mut     sync.RWMutex
+}
+
+var _ blockset = &erasureBlockset{}
+
+func init() {
+	RegisterBlockset(Erasure, func(opts string, _ torus.BlockStore, sub blockset) (blockset, error) {
+		base, ok := sub.(*baseBlockset)
+		if !ok {
+			return nil, errors.New("erasure: must sit directly on the base layer")
+		}
+		b := &erasureBlockset{sub: base, covered: make(map[int]torus.BlockRef)}
+		// Unmarshalled layers have no options; the code comes with the
+		// data.
+		if opts != "" {
+			k, m, err := ParseErasureCode(opts)
+			if err != nil {
+				return nil, err
+			}
+			b.setCode(k, m)
+		}
+		return b, nil
+	})
+}
+
+func (b *erasureBlockset) setCode(k, m int) {
+	b.k, b.m = k, m
+	b.rs = newReedSolomon(k, m)
+}
+
+func (b *erasureBlockset) stripes() int {
+	return (b.sub.Length() + b.k - 1) / b.k
+}
+
+// stripeKey is what the shards of stripe s are placed by.
+func (b *erasureBlockset) stripeKey(s int) uint64 {
+	return uint64(s)
+}
+
+// stripeRefs returns the refs the parity of stripe s was computed from: its
+// data blocks, or the blocks they replaced, followed by its parity.
+func (b *erasureBlockset) stripeRefs(s int) []torus.BlockRef {
+	refs := make([]torus.BlockRef, b.k+b.m)
+	for j := 0; j < b.k; j++ {
+		i := s*b.k + j
+		if ref, ok := b.covered[i]; ok {
+			refs[j] = ref
+		} else {
+			refs[j] = b.sub.ref(i)
+		}
+	}
+	if (s+1)*b.m <= len(b.parity) {
+		copy(refs[b.k:], b.parity[s*b.m:(s+1)*b.m])
+	}
+	return refs
+}
+
+// readStripe reads the shards of stripe s, reconstructing any which can't be
+// read. It returns the refs of the shards, the shards, and the positions of
+// those it reconstructed.
+func (b *erasureBlockset) readStripe(ctx context.Context, s int) ([]torus.BlockRef, [][]byte, []int, error) {
+	refs := b.stripeRefs(s)
+	size := int(b.sub.blocksize)
+	// A check from the layers above is for the block being read, not the
+	// rest of its stripe.
+	ctx = torus.WithBlockCheck(ctx, nil)
+	shards := make([][]byte, len(refs))
+	var missing []int
+	for j, ref := range refs {
+		if ref.IsZero() {
+			// Unwritten blocks, and the parity of stripes which
+			// are all zeroes, aren't stored.
+			shards[j] = []byte{}
+			continue
+		}
+		data, err := b.sub.store.GetBlock(ctx, ref)
+		if err != nil {
+			missing = append(missing, j)
+			continue
+		}
+		shards[j] = data
+	}
+	if len(missing) == 0 {
+		return refs, shards, nil, nil
+	}
+	if err := b.rs.reconstruct(shards, size); err != nil {
+		clog.Errorf("erasure: stripe %d has lost %d of %d shards", s, len(missing), len(refs))
+		return nil, nil, nil, torus.ErrBlockUnavailable
+	}
+	return refs, shards, missing, nil
+}
+
+// repair writes reconstructed shards back under their own refs, which puts
+// them where they belong.
+func (b *erasureBlockset) repair(ctx context.Context, refs []torus.BlockRef, shards [][]byte, missing []int) int {
+	n := 0
+	for _, j := range missing {
+		err := b.sub.store.WriteBlock(ctx, refs[j], shards[j])
+		if err != nil {
+			clog.Warningf("erasure: couldn't rewrite shard %s: %v", refs[j], err)
+			continue
+		}
+		promErasureRebuilt.Inc()
+		n++
+	}
+	return n
+}
+
+func (b *erasureBlockset) Length() int {
+	return b.sub.Length()
+}
+
+func (b *erasureBlockset) Kind() uint32 {
+	return uint32(Erasure)
+}
+
+func (b *erasureBlockset) GetBlock(ctx context.Context, i int) ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if i >= b.sub.Length() {
+		return nil, torus.ErrBlockNotExist
+	}
+	// A lost block reads as not existing, just as one off the end does.
+	data, err := b.sub.GetBlock(ctx, i)
+	if err == nil || err == torus.ErrUnwritten {
+		return data, err
+	}
+	clog.Warningf("erasure: block %d unavailable, reconstructing it: %v", i, err)
+	promErasureDegradedReads.Inc()
+	refs, shards, missing, err := b.readStripe(ctx, i/b.k)
+	if err != nil {
+		return nil, err
+	}
+	// Put the lost shards back in the background, rather than hold up
+	// the read.
+	go b.repair(context.TODO(), refs, shards, missing)
+	return append([]byte(nil), shards[i%b.k]...), nil
+}
+
+func (b *erasureBlockset) PutBlock(ctx context.Context, inode torus.INodeRef, i int, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if i > b.sub.Length() {
+		return torus.ErrBlockNotExist
+	}
+	s, pos := i/b.k, i%b.k
+	// Parity is computed from the blocks as they are now, so whatever
+	// covered blocks the stripe had are no longer needed.
+	stripe := make([][]byte, b.k)
+	zero := isZeroes(data)
+	for j := range stripe {
+		n := s*b.k + j
+		if n == i {
+			stripe[j] = data
+			continue
+		}
+		if n >= b.sub.Length() || b.sub.ref(n).IsZero() {
+			continue
+		}
+		d, err := b.getBlockLocked(ctx, n)
+		if err != nil {
+			return err
+		}
+		stripe[j] = d
+		if zero && !isZeroes(d) {
+			zero = false
+		}
+	}
+	parity := make([]torus.BlockRef, b.m)
+	if !zero {
+		for r, p := range b.rs.encode(stripe, int(b.sub.blocksize)) {
+			ref := b.sub.makeID(inode)
+			ref.SetShard(b.stripeKey(s), b.k+r)
+			if err := b.sub.store.WriteBlock(ctx, ref, p); err != nil {
+				return err
+			}
+			parity[r] = ref
+		}
+	}
+	ref := b.sub.makeID(inode)
+	ref.SetShard(b.stripeKey(s), pos)
+	if err := b.sub.putRef(ctx, i, ref, data); err != nil {
+		return err
+	}
+	b.resizeParity()
+	copy(b.parity[s*b.m:], parity)
+	for j := 0; j < b.k; j++ {
+		delete(b.covered, s*b.k+j)
+	}
+	return nil
+}
+
+// getBlockLocked reads block i, reconstructing it if need be.
+func (b *erasureBlockset) getBlockLocked(ctx context.Context, i int) ([]byte, error) {
+	ctx = torus.WithBlockCheck(ctx, nil)
+	data, err := b.sub.store.GetBlock(ctx, b.sub.ref(i))
+	if err == nil {
+		return data, nil
+	}
+	promErasureDegradedReads.Inc()
+	_, shards, _, err := b.readStripe(ctx, i/b.k)
+	if err != nil {
+		return nil, err
+	}
+	return shards[i%b.k], nil
+}
+
+// resizeParity makes room for the parity of every stripe.
+func (b *erasureBlockset) resizeParity() {
+	n := b.stripes() * b.m
+	if n <= len(b.parity) {
+		b.parity = b.parity[:n]
+		return
+	}
+	b.parity = append(b.parity, make([]torus.BlockRef, n-len(b.parity))...)
+}
+
+func (b *erasureBlockset) makeID(i torus.INodeRef) torus.BlockRef {
+	return b.sub.makeID(i)
+}
+
+func (b *erasureBlockset) setStore(s torus.BlockStore) {
+	b.sub.setStore(s)
+}
+
+func (b *erasureBlockset) getStore() torus.BlockStore {
+	return b.sub.getStore()
+}
+
+// Marshal writes k and m, the parity refs, and the covered blocks as pairs
+// of index and ref.
+func (b *erasureBlockset) Marshal() ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	buf := new(bytes.Buffer)
+	for _, x := range []uint32{uint32(b.k), uint32(b.m), uint32(len(b.parity))} {
+		binary.Write(buf, binary.LittleEndian, x)
+	}
+	for _, ref := range b.parity {
+		buf.Write(ref.ToBytes())
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(b.covered)))
+	for _, i := range b.coveredIndices() {
+		binary.Write(buf, binary.LittleEndian, uint64(i))
+		buf.Write(b.covered[i].ToBytes())
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *erasureBlockset) Unmarshal(data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	corrupt := errors.New("erasure: corrupt layer")
+	r := bytes.NewReader(data)
+	var hdr [3]uint32
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return corrupt
+	}
+	k, m := int(hdr[0]), int(hdr[1])
+	if k < 1 || m < 1 || k+m > torus.MaxShards {
+		return corrupt
+	}
+	b.setCode(k, m)
+	buf := make([]byte, torus.BlockRefByteSize)
+	readRef := func() (torus.BlockRef, error) {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return torus.BlockRef{}, corrupt
+		}
+		return torus.BlockRefFromBytes(buf), nil
+	}
+	if uint64(hdr[2])*torus.BlockRefByteSize > uint64(r.Len()) {
+		return corrupt
+	}
+	b.parity = make([]torus.BlockRef, hdr[2])
+	for i := range b.parity {
+		ref, err := readRef()
+		if err != nil {
+			return err
+		}
+		b.parity[i] = ref
+	}
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return corrupt
+	}
+	if uint64(n)*(8+torus.BlockRefByteSize) != uint64(r.Len()) {
+		return corrupt
+	}
+	b.covered = make(map[int]torus.BlockRef, n)
+	for j := uint32(0); j < n; j++ {
+		var i uint64
+		binary.Read(r, binary.LittleEndian, &i)
+		ref, err := readRef()
+		if err != nil {
+			return err
+		}
+		b.covered[int(i)] = ref
+	}
+	return nil
+}
+
+func (b *erasureBlockset) GetSubBlockset() torus.Blockset { return b.sub }
+
+func (b *erasureBlockset) GetLiveINodes() *roaring.Bitmap {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	out := b.sub.GetLiveINodes()
+	for _, ref := range b.extraRefs() {
+		if !ref.IsZero() {
+			out.Add(uint32(ref.INode))
+		}
+	}
+	return out
+}
+
+// extraRefs are the blocks the layer keeps beyond those of the base layer.
+func (b *erasureBlockset) extraRefs() []torus.BlockRef {
+	out := append([]torus.BlockRef(nil), b.parity...)
+	for _, i := range b.coveredIndices() {
+		out = append(out, b.covered[i])
+	}
+	return out
+}
+
+func (b *erasureBlockset) coveredIndices() []int {
+	out := make([]int, 0, len(b.covered))
+	for i := range b.covered {
+		out = append(out, i)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// cover keeps the refs of blocks from to to, which are about to be dropped
+// or trimmed, so that their stripes can still be reconstructed.
+func (b *erasureBlockset) cover(from, to int) {
+	refs := b.sub.GetAllBlockRefs()
+	if to > len(refs) {
+		to = len(refs)
+	}
+	for i := from; i < to; i++ {
+		ref := refs[i]
+		if _, ok := b.covered[i]; ok || ref.IsZero() {
+			continue
+		}
+		b.covered[i] = ref
+	}
+}
+
+func (b *erasureBlockset) Truncate(lastIndex int, blocksize uint64) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if lastIndex < b.sub.Length() {
+		// Only the stripe left partly in the volume still needs the
+		// blocks dropped from it.
+		end := (lastIndex + b.k - 1) / b.k * b.k
+		b.cover(lastIndex, end)
+		for i := range b.covered {
+			if i >= end {
+				delete(b.covered, i)
+			}
+		}
+	}
+	err := b.sub.Truncate(lastIndex, blocksize)
+	if err != nil {
+		return err
+	}
+	b.resizeParity()
+	return nil
+}
+
+func (b *erasureBlockset) Trim(from, to int) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.cover(from, to)
+	return b.sub.Trim(from, to)
+}
+
+// GetAllBlockRefs returns the refs of the base layer, followed by the parity
+// and covered blocks.
+func (b *erasureBlockset) GetAllBlockRefs() []torus.BlockRef {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return append(b.sub.GetAllBlockRefs(), b.extraRefs()...)
+}
+
+func (b *erasureBlockset) String() string {
+	return fmt.Sprintf("erasure(%d+%d)\n", b.k, b.m) + b.sub.String()
+}
+
+// Reconstruct checks that every shard of the erasure coded blockset bs can be
+// read, and rebuilds those which can't, writing them back where they belong.
+// It returns how many it rebuilt. Blocksets which aren't erasure coded are
+// left alone.
+func Reconstruct(ctx context.Context, bs torus.Blockset) (int, error) {
+	var b *erasureBlockset
+	for ; bs != nil; bs = bs.GetSubBlockset() {
+		if e, ok := bs.(*erasureBlockset); ok {
+			b = e
+			break
+		}
+	}
+	if b == nil {
+		return 0, nil
+	}
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	rebuilt := 0
+	for s := 0; s < b.stripes(); s++ {
+		if err := ctx.Err(); err != nil {
+			return rebuilt, err
+		}
+		refs, shards, missing, err := b.readStripe(ctx, s)
+		if err != nil {
+			return rebuilt, err
+		}
+		rebuilt += b.repair(ctx, refs, shards, missing)
+	}
+	return rebuilt, nil
+}
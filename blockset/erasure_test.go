@@ -0,0 +1,151 @@
+package blockset
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func newErasureTest(t *testing.T, spec string) (torus.BlockStore, *erasureBlockset) {
+	s, _ := torus.CreateBlockStore("temp", "test", torus.Config{StorageSize: 300 * 1024}, torus.GlobalMetadata{BlockSize: 1024})
+	bs, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec(spec), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, bs.(*erasureBlockset)
+}
+
+func TestErasureReadWrite(t *testing.T) {
+	s, b := newErasureTest(t, "erasure=2+1,base")
+	readWriteTest(t, b)
+	marshalTest(t, s, MustParseBlockLayerSpec("crc,erasure=4+2,base"))
+	if _, err := CreateBlocksetFromSpec(MustParseBlockLayerSpec("erasure=2+1,crc,base"), s); err == nil {
+		t.Error("erasure layer accepted a sub layer other than base")
+	}
+}
+
+func TestParseErasureCode(t *testing.T) {
+	for _, s := range []string{"4", "0+2", "4+0", "a+b", "20+20"} {
+		if _, _, err := ParseErasureCode(s); err == nil {
+			t.Errorf("accepted %q", s)
+		}
+	}
+	if k, m, err := ParseErasureCode("4+2"); err != nil || k != 4 || m != 2 {
+		t.Errorf("got %d+%d, %v", k, m, err)
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	rs := newReedSolomon(5, 3)
+	data := make([][]byte, 5)
+	for i := range data {
+		data[i] = make([]byte, 64)
+		r.Read(data[i])
+	}
+	shards := append(append([][]byte(nil), data...), rs.encode(data, 64)...)
+	for trial := 0; trial < 50; trial++ {
+		damaged := append([][]byte(nil), shards...)
+		for _, j := range r.Perm(len(shards))[:3] {
+			damaged[j] = nil
+		}
+		if err := rs.reconstruct(damaged, 64); err != nil {
+			t.Fatal(err)
+		}
+		for j := range shards {
+			if !bytes.Equal(damaged[j], shards[j]) {
+				t.Fatalf("trial %d: shard %d reconstructed wrongly", trial, j)
+			}
+		}
+	}
+	damaged := append([][]byte(nil), shards...)
+	for j := 0; j < 4; j++ {
+		damaged[j] = nil
+	}
+	if err := rs.reconstruct(damaged, 64); err != errTooFewShards {
+		t.Fatal("reconstructed from too few shards")
+	}
+}
+
+func TestErasureDegraded(t *testing.T) {
+	s, b := newErasureTest(t, "erasure=2+2,base")
+	b.Truncate(5, 1024)
+	r := rand.New(rand.NewSource(1))
+	inode := torus.NewINodeRef(1, 1)
+	blocks := make([][]byte, 5)
+	for i := range blocks {
+		blocks[i] = make([]byte, 1024)
+		r.Read(blocks[i])
+		if err := b.PutBlock(context.TODO(), inode, i, blocks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lose a data block and a parity block of the first stripe.
+	s.DeleteBlock(context.TODO(), b.sub.blocks[0])
+	s.DeleteBlock(context.TODO(), b.parity[1])
+	data, err := b.GetBlock(context.TODO(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, blocks[0]) {
+		t.Fatal("block 0 reconstructed wrongly")
+	}
+	// The lost shards are put back in the background.
+	for _, ref := range []torus.BlockRef{b.sub.blocks[0], b.parity[1]} {
+		for i := 0; ; i++ {
+			if _, err := s.GetBlock(context.TODO(), ref); err == nil {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("%s wasn't put back", ref)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Rewriting the stripe reads through the loss.
+	if err := b.PutBlock(context.TODO(), inode, 1, blocks[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trimmed block still protects the rest of its stripe.
+	b.Trim(2, 3)
+	s.DeleteBlock(context.TODO(), b.sub.blocks[3])
+	s.DeleteBlock(context.TODO(), b.parity[2])
+	if data, err := b.GetBlock(context.TODO(), 3); err != nil || !bytes.Equal(data, blocks[3]) {
+		t.Fatalf("block 3 wasn't reconstructed after a trim: %v", err)
+	}
+
+	// Reconstruct puts back what's lost.
+	marshal, err := torus.MarshalBlocksetToProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newb, err := UnmarshalFromProto(marshal, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DeleteBlock(context.TODO(), b.sub.blocks[4])
+	n, err := Reconstruct(context.TODO(), newb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("nothing was rebuilt")
+	}
+	if data, err := s.GetBlock(context.TODO(), b.sub.blocks[4]); err != nil || !bytes.Equal(data, blocks[4]) {
+		t.Fatalf("block 4 wasn't rebuilt: %v", err)
+	}
+
+	// Too many losses are an error, not wrong data.
+	s.DeleteBlock(context.TODO(), b.sub.blocks[0])
+	s.DeleteBlock(context.TODO(), b.sub.blocks[1])
+	s.DeleteBlock(context.TODO(), b.parity[0])
+	if _, err := b.GetBlock(context.TODO(), 0); err != torus.ErrBlockUnavailable {
+		t.Fatalf("read a stripe missing three shards: %v", err)
+	}
+}
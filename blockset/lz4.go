@@ -0,0 +1,159 @@
+package blockset
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// An implementation of the LZ4 block format, as documented at
+// https://github.com/lz4/lz4/blob/master/doc/lz4_Block_format.md. Only single
+// blocks are (de)compressed, so the frame format isn't needed.
+
+const (
+	lz4MinMatch = 4
+	lz4HashLog  = 12
+	// The last match must start at least lz4MFLimit bytes before the end
+	// of the input, and the last lz4LastLiterals bytes are always
+	// literals.
+	lz4MFLimit      = 12
+	lz4LastLiterals = 5
+	lz4MaxOffset    = 65535
+)
+
+var errLZ4Corrupt = errors.New("lz4: corrupt input")
+
+// lz4Compress compresses src, greedily taking the first match found at each
+// position. The result may be longer than src if it doesn't compress.
+func lz4Compress(src []byte) []byte {
+	var table [1 << lz4HashLog]int32
+	out := make([]byte, 0, len(src))
+	anchor := 0
+	for i := 0; i+lz4MFLimit < len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		// Positions are stored plus one, so that zero is empty.
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[ref+n] == src[i+n] {
+			n++
+		}
+		out = lz4AppendSequence(out, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(out, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends literals followed by a match of length n at
+// offset back. The last sequence of a block has no match, and n is 0.
+func lz4AppendSequence(out, literals []byte, offset, n int) []byte {
+	token := byte(15 << 4)
+	if len(literals) < 15 {
+		token = byte(len(literals) << 4)
+	}
+	if n != 0 {
+		if n-lz4MinMatch < 15 {
+			token |= byte(n - lz4MinMatch)
+		} else {
+			token |= 15
+		}
+	}
+	out = append(out, token)
+	if len(literals) >= 15 {
+		out = lz4AppendLength(out, len(literals)-15)
+	}
+	out = append(out, literals...)
+	if n == 0 {
+		return out
+	}
+	out = append(out, byte(offset), byte(offset>>8))
+	if n-lz4MinMatch >= 15 {
+		out = lz4AppendLength(out, n-lz4MinMatch-15)
+	}
+	return out
+}
+
+func lz4AppendLength(out []byte, l int) []byte {
+	for ; l >= 255; l -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(l))
+}
+
+// lz4Decompress decompresses src into dst, which must be large enough to
+// hold the result, and returns the length of the result.
+func lz4Decompress(dst, src []byte) (int, error) {
+	si, di := 0, 0
+	for {
+		if si >= len(src) {
+			return 0, errLZ4Corrupt
+		}
+		token := src[si]
+		si++
+		l := int(token >> 4)
+		if l == 15 {
+			var err error
+			l, si, err = lz4ReadLength(src, si, l)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if si+l > len(src) || di+l > len(dst) {
+			return 0, errLZ4Corrupt
+		}
+		copy(dst[di:], src[si:si+l])
+		si += l
+		di += l
+		if si == len(src) {
+			return di, nil
+		}
+		if si+2 > len(src) {
+			return 0, errLZ4Corrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return 0, errLZ4Corrupt
+		}
+		n := int(token & 15)
+		if n == 15 {
+			var err error
+			n, si, err = lz4ReadLength(src, si, n)
+			if err != nil {
+				return 0, err
+			}
+		}
+		n += lz4MinMatch
+		if di+n > len(dst) {
+			return 0, errLZ4Corrupt
+		}
+		if offset >= n {
+			copy(dst[di:di+n], dst[di-offset:])
+		} else {
+			// The match overlaps what it's copying, repeating it.
+			for k := 0; k < n; k++ {
+				dst[di+k] = dst[di-offset+k]
+			}
+		}
+		di += n
+	}
+}
+
+func lz4ReadLength(src []byte, si, l int) (int, int, error) {
+	for {
+		if si >= len(src) {
+			return 0, 0, errLZ4Corrupt
+		}
+		b := src[si]
+		si++
+		l += int(b)
+		if b != 255 {
+			return l, si, nil
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package blockset
+
+import "errors"
+
+// A systematic Reed-Solomon code over GF(2^8). The k data shards are stored
+// as they are; each of the m parity shards is a combination of them given by
+// a row of a Cauchy matrix, so that any k of the k+m shards recover the rest.
+
+var errTooFewShards = errors.New("reedsolomon: too few shards to reconstruct")
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// Generated by x, with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times src to dst. src may be shorter than dst, as if
+// padded with zeroes.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	var table [256]byte
+	for i := range table {
+		table[i] = gfMul(byte(i), c)
+	}
+	for i, x := range src {
+		dst[i] ^= table[x]
+	}
+}
+
+type reedSolomon struct {
+	k, m int
+	// parity is the m by k matrix of coefficients of the parity shards.
+	parity [][]byte
+}
+
+func newReedSolomon(k, m int) *reedSolomon {
+	rs := &reedSolomon{k: k, m: m, parity: make([][]byte, m)}
+	for r := range rs.parity {
+		rs.parity[r] = make([]byte, k)
+		for c := 0; c < k; c++ {
+			// Row and column values are all different, so no
+			// denominator is zero.
+			rs.parity[r][c] = gfInv(byte(k+r) ^ byte(c))
+		}
+	}
+	return rs
+}
+
+// row returns the coefficients of shard i in terms of the data shards.
+func (rs *reedSolomon) row(i int) []byte {
+	if i >= rs.k {
+		return rs.parity[i-rs.k]
+	}
+	out := make([]byte, rs.k)
+	out[i] = 1
+	return out
+}
+
+// encode returns the parity shards of data, each size bytes long. Missing or
+// short data shards count as zeroes.
+func (rs *reedSolomon) encode(data [][]byte, size int) [][]byte {
+	out := make([][]byte, rs.m)
+	for r := range out {
+		out[r] = make([]byte, size)
+		for c, d := range data {
+			gfMulAdd(out[r], d, rs.parity[r][c])
+		}
+	}
+	return out
+}
+
+// reconstruct fills in the nil entries of shards, the k data shards followed
+// by the m parity shards, from any k of the others. Shards are size bytes
+// long; shorter ones count as padded with zeroes.
+func (rs *reedSolomon) reconstruct(shards [][]byte, size int) error {
+	var have []int
+	for i, s := range shards {
+		if s != nil && len(have) < rs.k {
+			have = append(have, i)
+		}
+	}
+	if len(have) < rs.k {
+		return errTooFewShards
+	}
+	matrix := make([][]byte, rs.k)
+	for i, s := range have {
+		matrix[i] = append([]byte(nil), rs.row(s)...)
+	}
+	inv, err := gfInvert(matrix)
+	if err != nil {
+		return err
+	}
+	for c := 0; c < rs.k; c++ {
+		if shards[c] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for i, s := range have {
+			gfMulAdd(out, shards[s], inv[c][i])
+		}
+		shards[c] = out
+	}
+	for r := 0; r < rs.m; r++ {
+		if shards[rs.k+r] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for c := 0; c < rs.k; c++ {
+			gfMulAdd(out, shards[c], rs.parity[r][c])
+		}
+		shards[rs.k+r] = out
+	}
+	return nil
+}
+
+// gfInvert inverts a square matrix by Gauss-Jordan elimination, destroying
+// it in the process.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("reedsolomon: singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if c := m[col][col]; c != 1 {
+			ci := gfInv(c)
+			for j := 0; j < n; j++ {
+				m[col][j] = gfMul(m[col][j], ci)
+				inv[col][j] = gfMul(inv[col][j], ci)
+			}
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			f := m[row][col]
+			for j := 0; j < n; j++ {
+				m[row][j] ^= gfMul(f, m[col][j])
+				inv[row][j] ^= gfMul(f, inv[col][j])
+			}
+		}
+	}
+	return inv, nil
+}
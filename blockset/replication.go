@@ -59,7 +59,7 @@ func (b *replicationBlockset) GetBlock(ctx context.Context, i int) ([]byte, erro
 	}
 	newctx := context.WithValue(ctx, "replication", b.rep)
 	bytes, err := b.sub.GetBlock(newctx, i)
-	if err == nil || err == torus.ErrBlockNotExist {
+	if err == nil || err == torus.ErrBlockNotExist || err == torus.ErrUnwritten {
 		return bytes, err
 	}
 	for rep := 0; rep < (b.rep - 1); rep++ {
@@ -2,12 +2,16 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/mdlayher/ethernet"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
@@ -15,7 +19,7 @@ import (
 )
 
 var aoeCommand = &cobra.Command{
-	Use:   "aoe VOLUME INTERFACE MAJOR MINOR",
+	Use:   "aoe VOLUME[,VOLUME...] INTERFACE MAJOR MINOR|auto",
 	Short: "serve a volume over AoE [EXPERIMENTAL]",
 	Long: strings.TrimSpace(`
 Serve a volume over AoE using the specified network interface and AoE
@@ -29,10 +33,88 @@ eth0 network interface:
 
 	torusblk aoe vol01 eth0 1 1
 	torusblk aoe vol02 eth0 1 2
+
+Pass "auto" as the minor address to take the lowest one free under the major
+address across the cluster. Either way, the export is listed by
+"torusctl aoe list" while it runs, and an address already exported elsewhere
+in the cluster is refused.
+
+To export several volumes from one process, reading each interface once,
+list them separated by commas. They take consecutive minor addresses from
+MINOR, or free ones with "auto":
+
+	torusblk aoe vol01,vol02,vol03 eth0 1 1
+
+To export a volume on several interfaces at once, such as the members of a
+bond or links to separate storage networks, list them separated by commas:
+
+	torusblk aoe vol01 eth0,eth1 1 1
+
+To serve on a tagged VLAN without a VLAN interface, pass the VLAN ID with
+--vlan along with the untagged interface; the network card mustn't strip VLAN
+tags from received frames.
+
+To run on a protocol number other than the standard AoE ethertype (0x88a2),
+for instance to keep clear of other AoE devices on the same network, pass
+--ethertype. Initiators must be configured to use the same value.
 `),
 	Run: aoeAction,
 }
 
+var (
+	aoeDeviceTimeout time.Duration
+	aoeSectorFormat  string
+	aoeEtherType     string
+	aoeSendRetries   int
+	aoeAdvertise     time.Duration
+	aoeFailFast      bool
+	aoeSkipSync      bool
+	aoeMaxInFlight   int
+	aoeWorkers       int
+	aoeMaxSectors    int
+	aoeSyncInterval  time.Duration
+	aoeIgnoreFlush   bool
+	aoeBadFrameLimit int
+	aoeBadFrameBan   time.Duration
+
+	aoeAdvertiseTo        []string
+	aoeAdvertiseBroadcast bool
+	aoeControlAddress     string
+	aoeShutdownTimeout    time.Duration
+	aoeStandby            bool
+	aoeAllowInitiators    []string
+	aoeRefuseDisallowed   bool
+	aoeVLAN               int
+	aoeVLANPriority       int
+)
+
+func init() {
+	aoeCommand.Flags().DurationVar(&aoeDeviceTimeout, "device-timeout", 0, "maximum time to wait on the volume for a single ATA command (0 waits forever)")
+	aoeCommand.Flags().StringVar(&aoeSectorFormat, "sector-format", "512", "sector geometry to advertise: 512 or 512e")
+	aoeCommand.Flags().StringVar(&aoeEtherType, "ethertype", "0x88a2", "ethertype to send and receive AoE frames with")
+	aoeCommand.Flags().IntVar(&aoeVLAN, "vlan", 0, "802.1Q VLAN ID to serve on, tagging and untagging frames on the interface (0 for untagged)")
+	aoeCommand.Flags().IntVar(&aoeVLANPriority, "vlan-priority", 0, "802.1p priority to tag frames sent on --vlan with")
+	aoeCommand.Flags().IntVar(&aoeSendRetries, "send-retries", aoe.DefaultSendRetries, "times to resend a response after a transient transmit error")
+	aoeCommand.Flags().DurationVar(&aoeAdvertise, "advertise-interval", aoe.DefaultAdvertiseInterval, "how often to re-announce the target on the network (0 announces only at startup)")
+	aoeCommand.Flags().StringSliceVar(&aoeAdvertiseTo, "advertise-to", nil, "MAC addresses of initiators to announce the target to by unicast, instead of broadcasting")
+	aoeCommand.Flags().BoolVar(&aoeAdvertiseBroadcast, "advertise-broadcast", false, "also broadcast announcements when --advertise-to is set")
+	aoeCommand.Flags().StringSliceVar(&aoeAllowInitiators, "allow-initiator", nil, "MAC addresses of the only initiators to accept, in addition to the volume's MAC mask list")
+	aoeCommand.Flags().BoolVar(&aoeRefuseDisallowed, "refuse-disallowed", false, "answer ATA commands from initiators which aren't allowed with an error, instead of ignoring them")
+	aoeCommand.Flags().StringVar(&aoeControlAddress, "control-address", "", "address to serve the HTTP API for quiescing and transferring initiators on, such as 127.0.0.1:4322 (default none)")
+	aoeCommand.Flags().DurationVar(&aoeShutdownTimeout, "shutdown-timeout", 30*time.Second, "on interrupt, how long to wait for commands being served to complete and the volume to sync")
+	aoeCommand.Flags().BoolVar(&aoeStandby, "standby", false, "wait for the address to be given up by the node exporting it, then take the export over")
+	aoeCommand.Flags().BoolVar(&aoeFailFast, "fail-fast", false, "exit on the first network error instead of waiting for the interface to recover")
+	aoeCommand.Flags().DurationVar(&aoeSyncInterval, "sync-interval", aoe.DefaultSyncInterval, "how often to sync the volume (0 only syncs when the initiator flushes)")
+	aoeCommand.Flags().BoolVar(&aoeIgnoreFlush, "ignore-flush", false, "don't sync the volume when the initiator flushes, only periodically (writes since the last sync may be lost)")
+	aoeCommand.Flags().BoolVar(&aoeSkipSync, "skip-initial-sync", false, "start serving without first syncing the volume, leaving it to the periodic sync")
+	aoeCommand.Flags().IntVar(&aoeBadFrameLimit, "bad-frame-limit", 0, "ignore a source which sends more than this many oversized or malformed frames in 10s (0 never ignores one)")
+	aoeCommand.Flags().DurationVar(&aoeBadFrameBan, "bad-frame-ban", aoe.DefaultBadFrameBan, "how long to ignore a source which exceeded --bad-frame-limit")
+	aoeCommand.Flags().IntVar(&aoeMaxInFlight, "max-inflight", 0, "maximum ATA commands each initiator may have outstanding, served in turn (0 for no limit)")
+	aoeCommand.Flags().IntVar(&aoeMaxSectors, "max-sectors", 0, "most 512 byte sectors initiators may read or write per frame (0 for as many as the MTU allows)")
+	aoeCommand.Flags().IntVar(&aoeWorkers, "workers", 0, "number of ATA commands to serve concurrently (0 serves them one at a time)")
+	addReplicaFlags(aoeCommand)
+}
+
 func aoeAction(cmd *cobra.Command, args []string) {
 	if len(args) != 4 {
 		cmd.Usage()
@@ -41,58 +123,230 @@ func aoeAction(cmd *cobra.Command, args []string) {
 
 	srv := createServer()
 
-	vol := args[0]
-	ifname := args[1]
+	vols := strings.Split(args[0], ",")
+	ifnames := strings.Split(args[1], ",")
 	maj := args[2]
 	min := args[3]
 
+	format, err := block.ParseSectorFormat(aoeSectorFormat)
+	if err != nil {
+		die("%v", err)
+	}
+
 	major, err := strconv.ParseUint(maj, 10, 16)
 	if err != nil {
 		die("Failed to parse major address %q: %v\n", maj, err)
 	}
 
-	minor, err := strconv.ParseUint(min, 10, 8)
-	if err != nil {
-		die("Failed to parse minor address %q: %v\n", min, err)
+	var minor uint64
+	autoMinor := min == "auto"
+	if !autoMinor {
+		minor, err = strconv.ParseUint(min, 10, 8)
+		if err != nil {
+			die("Failed to parse minor address %q: %v\n", min, err)
+		}
+		if last := minor + uint64(len(vols)) - 1; last > 254 {
+			die("Minor addresses from %d for %d volumes run past 254\n", minor, len(vols))
+		}
+	}
+	if len(vols) > 1 && aoeControlAddress != "" {
+		die("--control-address can only be used when exporting one volume\n")
+	}
+	if aoeStandby && (len(vols) > 1 || autoMinor) {
+		die("--standby takes one volume and its minor address\n")
 	}
 
-	blockvol, err := block.OpenBlockVolume(srv, vol)
+	et, err := strconv.ParseUint(aoeEtherType, 0, 16)
 	if err != nil {
-		fmt.Println("server doesn't support block volumes:", err)
-		os.Exit(1)
+		die("Failed to parse ethertype %q: %v\n", aoeEtherType, err)
 	}
 
-	ai, err := aoe.NewInterface(ifname)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to set up interface %q: %v\n", ifname, err)
-		os.Exit(1)
+	if aoeVLAN < 0 || aoeVLAN > 4094 {
+		die("--vlan must be a VLAN ID from 1 to 4094\n")
+	}
+	if aoeVLANPriority < 0 || aoeVLANPriority > 7 {
+		die("--vlan-priority must be from 0 to 7\n")
 	}
 
-	as, err := aoe.NewServer(blockvol, &aoe.ServerOptions{
-		Major: uint16(major),
-		Minor: uint8(minor),
-	})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to crate AoE server: %v\n", err)
-		os.Exit(1)
+	var advertiseTo []net.HardwareAddr
+	for _, s := range aoeAdvertiseTo {
+		addr, err := net.ParseMAC(s)
+		if err != nil {
+			die("Failed to parse --advertise-to address %q: %v\n", s, err)
+		}
+		advertiseTo = append(advertiseTo, addr)
+	}
+
+	var allow []net.HardwareAddr
+	for _, s := range aoeAllowInitiators {
+		addr, err := net.ParseMAC(s)
+		if err != nil {
+			die("Failed to parse --allow-initiator address %q: %v\n", s, err)
+		}
+		allow = append(allow, addr)
+	}
+
+	// ServerOptions treats zero as "use the default".
+	if aoeSendRetries == 0 {
+		aoeSendRetries = -1
+	}
+	if aoeAdvertise == 0 {
+		aoeAdvertise = -1
+	}
+	if aoeSyncInterval == 0 {
+		aoeSyncInterval = -1
+	}
+
+	var ifaces []*aoe.Interface
+	for _, ifname := range ifnames {
+		var ai *aoe.Interface
+		if aoeVLAN != 0 {
+			ai, err = aoe.NewVLANInterface(ifname, ethernet.EtherType(et), ethernet.VLAN{
+				ID:       uint16(aoeVLAN),
+				Priority: ethernet.Priority(aoeVLANPriority),
+			})
+		} else {
+			ai, err = aoe.NewInterfaceWithEtherType(ifname, ethernet.EtherType(et))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up interface %q: %v\n", ifname, err)
+			os.Exit(1)
+		}
+		ifaces = append(ifaces, ai)
 	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt)
 
-	go func(sv *torus.Server, iface *aoe.Interface) {
-		for _ = range signalChan {
-			fmt.Println("\nReceived an interrupt, stopping services...")
+	var servers []*aoe.Server
+	for i, vol := range vols {
+		blockvol, err := block.OpenBlockVolume(srv, vol)
+		if err != nil {
+			fmt.Println("server doesn't support block volumes:", err)
+			os.Exit(1)
+		}
+
+		opts := &aoe.ServerOptions{
+			Major:                   uint16(major),
+			Minor:                   uint8(minor) + uint8(i),
+			AllocateMinor:           autoMinor,
+			DeviceTimeout:           aoeDeviceTimeout,
+			SectorFormat:            format,
+			EtherType:               ethernet.EtherType(et),
+			SendRetries:             aoeSendRetries,
+			AdvertiseInterval:       aoeAdvertise,
+			AdvertiseTo:             advertiseTo,
+			AdvertiseBroadcast:      aoeAdvertiseBroadcast,
+			FailFast:                aoeFailFast,
+			SyncInterval:            aoeSyncInterval,
+			IgnoreFlush:             aoeIgnoreFlush,
+			SkipInitialSync:         aoeSkipSync,
+			MaxInFlightPerInitiator: aoeMaxInFlight,
+			Workers:                 aoeWorkers,
+			MaxSectorsPerFrame:      aoeMaxSectors,
+			ReadOnly:                checkReplicas(srv, blockvol),
+			BadFrameLimit:           aoeBadFrameLimit,
+			BadFrameBan:             aoeBadFrameBan,
+			AllowInitiators:         allow,
+			RefuseDisallowed:        aoeRefuseDisallowed,
+		}
+		var as *aoe.Server
+		if aoeStandby {
+			as, err = standbyAoE(blockvol, opts, signalChan)
+		} else {
+			as, err = aoe.NewServer(blockvol, opts)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create AoE server for %s: %v\n", vol, err)
+			for _, as := range servers {
+				as.Close()
+			}
+			os.Exit(1)
+		}
+		if autoMinor || len(vols) > 1 {
+			major, minor := as.Address()
+			fmt.Printf("Exporting %s as AoE %d.%d\n", vol, major, minor)
+		}
+		servers = append(servers, as)
+	}
 
+	// Several volumes share the interfaces through a MultiServer.
+	var as aoeServer = servers[0]
+	if len(servers) > 1 {
+		as, err = aoe.NewMultiServer(servers...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create AoE server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func(sv *torus.Server, ifaces []*aoe.Interface) {
+		<-signalChan
+		fmt.Println("\nReceived an interrupt, stopping services...")
+
+		ctx, cancel := context.WithTimeout(context.Background(), aoeShutdownTimeout)
+		if err := as.Shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "AoE server didn't shut down cleanly: %v\n", err)
+		}
+		cancel()
+		for _, iface := range ifaces {
 			iface.Close()
-			sv.Close()
-			as.Close()
-			os.Exit(0)
 		}
-	}(srv, ai)
+		sv.Close()
+		close(stopped)
+	}(srv, ifaces)
 
-	if err = as.Serve(ai); err != nil {
+	if aoeControlAddress != "" {
+		go func() {
+			if err := serveAoEControl(aoeControlAddress, servers[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to serve control API: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if err = as.ServeInterfaces(ifaces...); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to serve AoE: %v\n", err)
 		os.Exit(1)
 	}
+	// Serve only returns nil once the server has been shut down.
+	<-stopped
+}
+
+// aoeServer is an aoe.Server or an aoe.MultiServer.
+type aoeServer interface {
+	ServeInterfaces(ifaces ...*aoe.Interface) error
+	Shutdown(ctx context.Context) error
+}
+
+// standbyAoE stands by to take over the export of vol at the address in opts,
+// exiting if interrupted first.
+func standbyAoE(vol *block.BlockVolume, opts *aoe.ServerOptions, signalChan chan os.Signal) (*aoe.Server, error) {
+	fmt.Printf("Standing by to export AoE %d.%d\n", opts.Major, opts.Minor)
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-signalChan:
+			close(interrupted)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	as, err := aoe.NewStandbyServer(ctx, vol, opts)
+	cancel()
+	select {
+	case <-interrupted:
+		if as != nil {
+			as.Close()
+		}
+		fmt.Println("\nReceived an interrupt while standing by, exiting")
+		os.Exit(0)
+	default:
+	}
+	if err == nil {
+		fmt.Printf("Took over AoE %d.%d\n", opts.Major, opts.Minor)
+	}
+	return as, err
 }
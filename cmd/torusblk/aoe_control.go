@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/torus/block/aoe"
+)
+
+// serveAoEControl serves the HTTP API for quiescing and transferring the
+// initiators of as:
+//
+//	GET  /v1/initiators/quiesced
+//	POST /v1/initiators/MAC/quiesce
+//	POST /v1/initiators/MAC/resume
+//	POST /v1/initiators/MAC/transfer?to=MAC
+//
+// Quiesce only responds once the initiator's commands have drained and the
+// volume is synced.
+func serveAoEControl(addr string, as *aoe.Server) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/initiators/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/initiators/"), "/")
+		if len(parts) == 1 && parts[0] == "quiesced" && r.Method == "GET" {
+			var out []string
+			for _, hw := range as.Quiesced() {
+				out = append(out, hw.String())
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(out)
+			return
+		}
+		if len(parts) != 2 || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		hw, err := net.ParseMAC(parts[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch parts[1] {
+		case "quiesce":
+			err = as.Quiesce(hw)
+		case "resume":
+			as.Resume(hw)
+		case "transfer":
+			var to net.HardwareAddr
+			to, err = net.ParseMAC(r.URL.Query().Get("to"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("bad ?to= address: %v", err), http.StatusBadRequest)
+				return
+			}
+			err = as.Transfer(hw, to)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.ListenAndServe(addr, mux)
+}
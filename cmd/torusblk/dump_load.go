@@ -27,13 +27,16 @@ var (
 		Run:   loadAction,
 	}
 
-	progress bool
+	progress  bool
+	checksums string
 )
 
 func init() {
 	dumpCommand.Flags().BoolVarP(&progress, "progress", "p", false, "show progress")
+	dumpCommand.Flags().StringVar(&checksums, "checksums", "", "also write the checksum of every block to this file")
 	rootCommand.AddCommand(dumpCommand)
 	loadCommand.Flags().BoolVarP(&progress, "progress", "p", false, "show progress")
+	loadCommand.Flags().StringVar(&checksums, "checksums", "", "verify every block against the checksums written by dump --checksums, and checksum the volume the same way")
 	rootCommand.AddCommand(loadCommand)
 }
 
@@ -60,6 +63,9 @@ func dumpAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("couldn't open snapshot: %v", err)
 	}
+	if checksums != "" {
+		writeChecksums(bf, checksums)
+	}
 
 	size := int64(bf.Size())
 	if progress {
@@ -128,7 +134,18 @@ func loadAction(cmd *cobra.Command, args []string) {
 		size = expSize
 	}
 
-	err = block.CreateBlockVolume(srv.MDS, args[1], size)
+	var opts block.VolumeOptions
+	var reader io.Reader = input
+	if checksums != "" {
+		c := readChecksums(checksums)
+		if c.Size != uint64(fi.Size()) {
+			die("input is %d bytes, but the checksums are for %d", fi.Size(), c.Size)
+		}
+		opts.Checksum = c.Algorithm.String()
+		reader = block.VerifyReader(input, c)
+	}
+
+	err = block.CreateBlockVolumeWithOptions(srv.MDS, args[1], size, opts)
 	if err != nil {
 		die("couldn't create block volume %s: %v", args[1], err)
 	}
@@ -143,13 +160,13 @@ func loadAction(cmd *cobra.Command, args []string) {
 
 	if progress {
 		pb := new(progressutil.CopyProgressPrinter)
-		pb.AddCopy(input, path.Base(args[0]), fi.Size(), f)
+		pb.AddCopy(reader, path.Base(args[0]), fi.Size(), f)
 		err := pb.PrintAndWait(os.Stdout, 500*time.Millisecond, nil)
 		if err != nil {
 			die("couldn't copy: %v", err)
 		}
 	} else {
-		_, err := io.Copy(f, input)
+		_, err := io.Copy(f, reader)
 		if err != nil {
 			die("couldn't copy: %v", err)
 		}
@@ -165,3 +182,32 @@ func loadAction(cmd *cobra.Command, args []string) {
 	}
 	fmt.Printf("copied %d bytes\n", fi.Size())
 }
+
+func writeChecksums(bf *block.BlockFile, path string) {
+	c, err := bf.Checksums()
+	if err != nil {
+		die("couldn't get checksums: %v", err)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		die("couldn't create %s: %v", path, err)
+	}
+	defer out.Close()
+	err = c.Write(out)
+	if err != nil {
+		die("couldn't write checksums: %v", err)
+	}
+}
+
+func readChecksums(path string) *block.Checksums {
+	in, err := os.Open(path)
+	if err != nil {
+		die("couldn't open %s: %v", path, err)
+	}
+	defer in.Close()
+	c, err := block.ReadChecksums(in)
+	if err != nil {
+		die("couldn't read checksums: %v", err)
+	}
+	return c
+}
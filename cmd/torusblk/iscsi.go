@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/iscsi"
+	"github.com/coreos/torus/block/scsi"
+)
+
+var iscsiCommand = &cobra.Command{
+	Use:   "iscsi VOLUME [VOLUME...]",
+	Short: "serve block volumes as iSCSI targets [EXPERIMENTAL]",
+	Long: strings.TrimSpace(`
+Serve block volumes as iSCSI targets, so that initiators such as VMware ESXi,
+Windows or open-iscsi can use them. Each volume is a target of its own, named
+IQN-PREFIX:VOLUME, with a single LUN. For example:
+
+	torusblk iscsi vol01 vol02
+
+and, on a Linux initiator:
+
+	iscsiadm -m discovery -t sendtargets -p torus-gateway
+	iscsiadm -m node -T iqn.2016-06.com.coreos.torus:vol01 -l
+
+Authentication (CHAP) and header and data digests aren't supported, so serve
+only on a trusted storage network. Each volume is locked while it's served, as
+with "torusblk nbd".
+`),
+	Run: iscsiAction,
+}
+
+var (
+	iscsiListen    string
+	iscsiIQNPrefix string
+)
+
+func init() {
+	iscsiCommand.Flags().StringVar(&iscsiListen, "listen", fmt.Sprintf(":%d", iscsi.DefaultPort), "address to accept iSCSI connections on")
+	iscsiCommand.Flags().StringVar(&iscsiIQNPrefix, "iqn-prefix", "iqn.2016-06.com.coreos.torus", "prefix of the target names, which are PREFIX:VOLUME")
+	addReplicaFlags(iscsiCommand)
+}
+
+func iscsiAction(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	srv := createServer()
+	defer srv.Close()
+
+	gmd, err := srv.MDS.GlobalMetadata()
+	if err != nil {
+		die("couldn't get the cluster's metadata: %s", err)
+	}
+
+	var targets []*iscsi.Target
+	for _, name := range args {
+		blockvol, err := block.OpenBlockVolume(srv, name)
+		if err != nil {
+			die("server doesn't support block volumes: %s", err)
+		}
+		readOnly := checkReplicas(srv, blockvol)
+		var f *block.BlockFile
+		if readOnly {
+			f, err = blockvol.OpenReadOnlyAttachment()
+		} else {
+			f, err = blockvol.OpenAttachment()
+		}
+		if err != nil {
+			if err == torus.ErrLocked {
+				die("volume %s is already mounted on another host", name)
+			}
+			die("can't open block volume %s: %s", name, err)
+		}
+		defer f.Close()
+		targets = append(targets, &iscsi.Target{
+			Name: iscsiIQNPrefix + ":" + name,
+			Disk: &scsi.Disk{
+				Device:            f,
+				Size:              int64(f.Size()),
+				ReadOnly:          readOnly,
+				Serial:            name,
+				PhysicalBlockSize: int(gmd.BlockSize),
+				Reservations:      blockvol,
+			},
+		})
+	}
+
+	handle, err := iscsi.NewServer(targets...)
+	if err != nil {
+		die("%s", err)
+	}
+	l, err := net.Listen("tcp", iscsiListen)
+	if err != nil {
+		die("can't listen for iSCSI initiators: %s", err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		fmt.Println("\nReceived an interrupt, disconnecting...")
+		handle.Close()
+	}()
+
+	for _, t := range targets {
+		fmt.Println("Serving", t.Name)
+	}
+	if err := handle.Serve(l); err != nil {
+		fmt.Fprintf(os.Stderr, "error from iscsi server: %s\n", err)
+		os.Exit(1)
+	}
+}
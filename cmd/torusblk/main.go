@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/coreos/pkg/capnslog"
@@ -9,6 +10,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
 	"github.com/coreos/torus/distributor"
 	"github.com/coreos/torus/internal/http"
 
@@ -23,10 +25,15 @@ var (
 	localBlockSize    uint64
 	readCacheSizeStr  string
 	readCacheSize     uint64
+	memoryLimitStr    string
+	topologyStr       string
 	readLevel         string
 	writeLevel        string
+	unwrittenReads    string
 	logpkg            string
 	httpAddr          string
+	keyFile           string
+	keyCommand        string
 
 	cfg torus.Config
 )
@@ -53,8 +60,14 @@ var versionCommand = &cobra.Command{
 
 func init() {
 	rootCommand.AddCommand(aoeCommand)
+	rootCommand.AddCommand(iscsiCommand)
+	rootCommand.AddCommand(tcmuCommand)
+	rootCommand.AddCommand(nvmeCommand)
+	rootCommand.AddCommand(vhostUserCommand)
 	rootCommand.AddCommand(nbdCommand)
+	rootCommand.AddCommand(nbdServeCommand)
 	rootCommand.AddCommand(volumeCommand)
+	rootCommand.AddCommand(snapshotCommand)
 	rootCommand.AddCommand(versionCommand)
 
 	// Flexvolume commands
@@ -68,10 +81,15 @@ func init() {
 	rootCommand.PersistentFlags().StringVarP(&etcdAddress, "etcd", "C", "127.0.0.1:2379", "hostname:port to the etcd instance storing the metadata")
 	rootCommand.PersistentFlags().StringVarP(&localBlockSizeStr, "write-cache-size", "", "128MiB", "Maximum amount of memory to use for the local write cache")
 	rootCommand.PersistentFlags().StringVarP(&readCacheSizeStr, "read-cache-size", "", "50MiB", "Amount of memory to use for read cache")
+	rootCommand.PersistentFlags().StringVarP(&topologyStr, "topology", "", "", "Where this client sits in the network, as LEVEL=VALUE[,...] with levels region, zone and rack; reads prefer the nearest replicas")
+	rootCommand.PersistentFlags().StringVarP(&memoryLimitStr, "memory-limit", "", "", "Total memory the read and write caches may use between them; the read cache shrinks to make room (default unlimited)")
 	rootCommand.PersistentFlags().StringVarP(&logpkg, "logpkg", "", "", "Specific package logging")
 	rootCommand.PersistentFlags().StringVarP(&readLevel, "read-level", "", "block", "Read replication level")
 	rootCommand.PersistentFlags().StringVarP(&writeLevel, "write-level", "", "all", "Write replication level")
+	rootCommand.PersistentFlags().StringVarP(&unwrittenReads, "unwritten-reads", "", "zeros", "What reading never-written data returns: zeros, or an error")
 	rootCommand.PersistentFlags().StringVarP(&httpAddr, "http", "", "", "HTTP endpoint for debug and stats")
+	rootCommand.PersistentFlags().StringVarP(&keyFile, "key-file", "", "", "file holding the key of encrypted volumes, as 32 raw bytes or 64 hex digits")
+	rootCommand.PersistentFlags().StringVarP(&keyCommand, "key-command", "", "", "shell command printing the key of an encrypted volume, given TORUS_VOLUME and TORUS_KEY_ID in its environment")
 }
 
 func configureServer(cmd *cobra.Command, args []string) {
@@ -97,6 +115,19 @@ func configureServer(cmd *cobra.Command, args []string) {
 		fmt.Fprintf(os.Stderr, "error parsing write-cache-size: %s\n", err)
 		os.Exit(1)
 	}
+	var memoryLimit uint64
+	if memoryLimitStr != "" {
+		memoryLimit, err = humanize.ParseBytes(memoryLimitStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing memory-limit: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	topology, err := torus.ParseTopology(topologyStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing topology: %s\n", err)
+		os.Exit(1)
+	}
 
 	var rl torus.ReadLevel
 	switch readLevel {
@@ -117,12 +148,41 @@ func configureServer(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	ur, err := torus.ParseUnwrittenReadPolicy(unwrittenReads)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case keyFile != "" && keyCommand != "":
+		fmt.Fprintf(os.Stderr, "only one of --key-file and --key-command may be given\n")
+		os.Exit(1)
+	case keyFile != "":
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading key-file: %s\n", err)
+			os.Exit(1)
+		}
+		key, err := block.ParseKey(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing key-file: %s\n", err)
+			os.Exit(1)
+		}
+		block.SetKeyProvider(block.StaticKey(key))
+	case keyCommand != "":
+		block.SetKeyProvider(block.KeyCommand(keyCommand))
+	}
+
 	cfg = torus.Config{
 		StorageSize:     localBlockSize,
 		MetadataAddress: etcdAddress,
 		ReadCacheSize:   readCacheSize,
 		WriteLevel:      wl,
 		ReadLevel:       rl,
+		Memory:          torus.NewMemoryBudget(memoryLimit),
+		Topology:        topology,
+		UnwrittenReads:  ur,
 	}
 }
 
@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/scsi"
 	"github.com/coreos/torus/internal/nbd"
 
 	"github.com/spf13/cobra"
@@ -15,7 +19,36 @@ import (
 var nbdCommand = &cobra.Command{
 	Use:   "nbd VOLUME [NBD-DEV]",
 	Short: "attach a block volume to an NBD device",
-	Run:   nbdAction,
+	Long: strings.TrimSpace(`
+Attach a block volume to an NBD device.
+
+With --standby, the device is attached read-only without locking the volume,
+and follows writes made by whichever host has it attached. Sending SIGUSR1 to
+a standby promotes it to read-write once the volume is no longer locked; with
+--force-promote, the lock is taken over from the current holder, which stops
+accepting writes the next time it syncs.
+
+With --read-only, the device is attached read-only without locking the volume,
+showing its contents as they were when it was attached, for backups to read
+while the volume stays in use elsewhere. The contents are held in a
+temp-attach-* snapshot until the device is detached.
+`),
+	Run: nbdAction,
+}
+
+var (
+	nbdSectorFormat    string
+	nbdStandby         bool
+	nbdStandbyInterval time.Duration
+	nbdForcePromote    bool
+)
+
+func init() {
+	nbdCommand.Flags().StringVar(&nbdSectorFormat, "sector-format", "", "sector geometry to advertise: 512, 512e or 4kn (default is the volume block size)")
+	nbdCommand.Flags().BoolVar(&nbdStandby, "standby", false, "attach as a read-only warm standby; SIGUSR1 promotes it")
+	nbdCommand.Flags().DurationVar(&nbdStandbyInterval, "standby-interval", block.DefaultStandbyInterval, "how often a standby checks for new writes")
+	nbdCommand.Flags().BoolVar(&nbdForcePromote, "force-promote", false, "on promotion, take the volume lock from its current holder")
+	addReplicaFlags(nbdCommand)
 }
 
 func nbdAction(cmd *cobra.Command, args []string) {
@@ -25,6 +58,10 @@ func nbdAction(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	if nbdStandby && readOnlyExport {
+		die("--standby and --read-only can't be used together")
+	}
+
 	var knownDev string
 	if len(args) == 2 {
 		knownDev = args[1]
@@ -49,7 +86,54 @@ func nbdAction(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	f, err := blockvol.OpenBlockFile()
+	blocksize := int64(0)
+	if nbdSectorFormat != "" {
+		format, err := block.ParseSectorFormat(nbdSectorFormat)
+		if err != nil {
+			die("%v", err)
+		}
+		if err := blockvol.CheckSectorFormat(format); err != nil {
+			die("can't export with sector format %s: %v", format, err)
+		}
+		// The kernel driver takes a single block size, so 512e is exported
+		// with 512 byte sectors.
+		blocksize = int64(format.LogicalSize())
+	}
+
+	if nbdStandby {
+		sd, err := openStandbyDevice(blockvol, nbdStandbyInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't follow block volume: %s\n", err)
+			os.Exit(1)
+		}
+		defer sd.Close()
+		promoteChan := make(chan os.Signal, 1)
+		signal.Notify(promoteChan, syscall.SIGUSR1)
+		go func() {
+			for _ = range promoteChan {
+				err := sd.promote(nbdForcePromote)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "couldn't promote standby: %s\n", err)
+					continue
+				}
+				fmt.Println("Promoted to read-write")
+			}
+		}()
+		err = connectNBD(srv, scsi.NewFence(blockvol).Device(sd), sd.Size(), nil, knownDev, blocksize, false, closer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	readOnly := checkReplicas(srv, blockvol)
+	var f *block.BlockFile
+	if readOnly {
+		f, err = blockvol.OpenReadOnlyAttachment()
+	} else {
+		f, err = blockvol.OpenAttachment()
+	}
 	if err != nil {
 		if err == torus.ErrLocked {
 			fmt.Fprintf(os.Stderr, "volume %s is already mounted on another host\n", args[0])
@@ -59,23 +143,26 @@ func nbdAction(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 	defer f.Close()
-	err = connectNBD(srv, f, knownDev, closer)
+	err = connectNBD(srv, scsi.NewFence(blockvol).Device(f), f.Size(), f.RefreshSize, knownDev, blocksize, readOnly, closer)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 }
 
-func connectNBD(srv *torus.Server, f *block.BlockFile, target string, closer chan bool) error {
-	defer f.Close()
-	size := f.Size()
-
+// connectNBD serves f on an NBD device until closer is closed. If refresh is
+// given, it's polled for changes to the size of the volume.
+func connectNBD(srv *torus.Server, f nbd.Device, size uint64, refresh func() (uint64, error), target string, blocksize int64, readOnly bool, closer chan bool) error {
 	gmd, err := srv.MDS.GlobalMetadata()
 	if err != nil {
 		return err
 	}
+	if blocksize == 0 {
+		blocksize = int64(gmd.BlockSize)
+	}
 
-	handle := nbd.Create(f, int64(size), int64(gmd.BlockSize))
+	handle := nbd.Create(f, int64(size), blocksize)
+	handle.SetReadOnly(readOnly)
 
 	if target == "" {
 		target, err = nbd.FindDevice()
@@ -96,6 +183,9 @@ func connectNBD(srv *torus.Server, f *block.BlockFile, target string, closer cha
 		<-closer
 		n.Disconnect()
 	}(handle)
+	if refresh != nil {
+		go followSize(handle, refresh, closer)
+	}
 
 	err = handle.Serve()
 	if err != nil {
@@ -104,3 +194,34 @@ func connectNBD(srv *torus.Server, f *block.BlockFile, target string, closer cha
 	}
 	return handle.Close()
 }
+
+// volumeSizeRefresh is how often an attached volume is checked for having
+// been grown.
+const volumeSizeRefresh = 5 * time.Second
+
+// followSize resizes n whenever refresh reports a new size for the volume
+// behind it, until closer is closed.
+func followSize(n *nbd.NBD, refresh func() (uint64, error), closer chan bool) {
+	t := time.NewTicker(volumeSizeRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-closer:
+			return
+		}
+		size, err := refresh()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't refresh volume size: %s\n", err)
+			continue
+		}
+		if int64(size) == n.Size() {
+			continue
+		}
+		if err := n.Resize(int64(size)); err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't resize nbd device: %s\n", err)
+			continue
+		}
+		fmt.Println("Resized device to", size, "bytes")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/scsi"
+	"github.com/coreos/torus/internal/nbd"
+)
+
+var nbdServeCommand = &cobra.Command{
+	Use:   "nbd-serve [VOLUME...]",
+	Short: "serve block volumes to remote NBD clients",
+	Long: strings.TrimSpace(`
+Serve block volumes over the network with the NBD protocol, so that hosts
+without torus can attach them with nbd-client or qemu. Each volume is
+exported under its own name. For example:
+
+	torusblk nbd-serve --listen :10809 vol01 vol02
+
+and, on another host:
+
+	nbd-client -N vol01 torus-gateway /dev/nbd0
+
+Without any volumes named, every block volume in the cluster is exported, or
+with --selector, those whose labels match. Clients can list the exports
+(nbd-client -l torus-gateway) and choose among them.
+
+A volume is opened, and locked as with "torusblk nbd", when the first client
+attaches to it, and closed when the last one disconnects. Clients must support
+fixed newstyle negotiation, as any recent nbd-client or qemu does.
+
+To serve across networks that aren't trusted, pass --tls-cert and --tls-key.
+Clients must then start TLS (nbd-client -certfile/-cacertfile, or qemu's
+tls-creds) before they can see the exports. With --tls-client-ca, clients must
+also present a certificate signed by one of the CAs in that file.
+`),
+	Run: nbdServeAction,
+}
+
+var (
+	nbdServeListen   string
+	nbdServeSelector string
+	nbdServeTLSCert  string
+	nbdServeTLSKey   string
+	nbdServeClientCA string
+)
+
+func init() {
+	nbdServeCommand.Flags().StringVar(&nbdServeListen, "listen", ":10809", "address to accept NBD connections on")
+	nbdServeCommand.Flags().StringVarP(&nbdServeSelector, "selector", "l", "", "export only the volumes with these labels, as KEY[=VALUE][,...]")
+	nbdServeCommand.Flags().StringVar(&nbdServeTLSCert, "tls-cert", "", "PEM certificate to serve TLS with; clients must then start TLS")
+	nbdServeCommand.Flags().StringVar(&nbdServeTLSKey, "tls-key", "", "PEM private key for --tls-cert")
+	nbdServeCommand.Flags().StringVar(&nbdServeClientCA, "tls-client-ca", "", "PEM file of CAs to verify client certificates with; clients without one are refused")
+	addReplicaFlags(nbdServeCommand)
+}
+
+func nbdServeAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 && nbdServeSelector != "" {
+		die("name the volumes to export or pass --selector, not both")
+	}
+	tlsConfig, err := nbdServeTLSConfig()
+	if err != nil {
+		die("%s", err)
+	}
+
+	srv := createServer()
+	defer srv.Close()
+
+	src := &volumeExports{
+		srv:     srv,
+		volumes: args,
+		files:   make(map[*nbd.Export]*block.BlockFile),
+	}
+	if nbdServeSelector != "" {
+		src.selector, err = block.ParseSelector(nbdServeSelector)
+		if err != nil {
+			die("%v", err)
+		}
+	}
+	for _, name := range args {
+		if _, err := block.OpenBlockVolume(srv, name); err != nil {
+			die("can't export volume %s: %s", name, err)
+		}
+	}
+
+	handle := nbd.NewSourceServer(src)
+	if tlsConfig != nil {
+		handle.SetTLSConfig(tlsConfig)
+	}
+	l, err := net.Listen("tcp", nbdServeListen)
+	if err != nil {
+		die("can't listen for NBD clients: %s", err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		fmt.Println("\nReceived an interrupt, disconnecting...")
+		handle.Close()
+	}()
+
+	fmt.Println("Serving NBD on", l.Addr())
+	err = handle.Serve(l)
+	// Wait for the clients to be disconnected and their volumes closed.
+	src.wait()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error from nbd server: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// volumeExports offers block volumes of the cluster as NBD exports: the
+// volumes named, or without any, every block volume matching selector.
+type volumeExports struct {
+	srv      *torus.Server
+	volumes  []string
+	selector block.Selector
+
+	mu    sync.Mutex
+	files map[*nbd.Export]*block.BlockFile
+	wg    sync.WaitGroup
+}
+
+func (src *volumeExports) Names() ([]string, error) {
+	if len(src.volumes) != 0 {
+		return src.volumes, nil
+	}
+	if src.selector != nil {
+		return block.FindVolumes(src.srv.MDS, src.selector)
+	}
+	vols, _, err := src.srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, v := range vols {
+		if v.Type == block.VolumeType {
+			names = append(names, v.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (src *volumeExports) Open(name string) (*nbd.Export, error) {
+	names, err := src.Names()
+	if err != nil {
+		return nil, err
+	}
+	if indexOf(names, name) < 0 {
+		return nil, nbd.ErrNoExport
+	}
+
+	blockvol, err := block.OpenBlockVolume(src.srv, name)
+	if err != nil {
+		return nil, err
+	}
+	readOnly, err := replicaPolicy(src.srv, blockvol)
+	if err != nil {
+		return nil, err
+	}
+	var f *block.BlockFile
+	if readOnly {
+		f, err = blockvol.OpenReadOnlyAttachment()
+	} else {
+		f, err = blockvol.OpenAttachment()
+	}
+	if err == torus.ErrLocked {
+		return nil, fmt.Errorf("volume %s is already mounted on another host", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &nbd.Export{
+		Name:     name,
+		Device:   scsi.NewFence(blockvol).Device(f),
+		Size:     int64(f.Size()),
+		ReadOnly: readOnly,
+	}
+	src.mu.Lock()
+	src.files[e] = f
+	src.mu.Unlock()
+	src.wg.Add(1)
+	fmt.Println("Opened", name)
+	return e, nil
+}
+
+func (src *volumeExports) Close(e *nbd.Export) error {
+	src.mu.Lock()
+	f := src.files[e]
+	delete(src.files, e)
+	src.mu.Unlock()
+	defer src.wg.Done()
+	fmt.Println("Closed", e.Name)
+	return f.Close()
+}
+
+// wait waits for every volume opened to be closed.
+func (src *volumeExports) wait() {
+	src.wg.Wait()
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// nbdServeTLSConfig returns the TLS configuration the flags ask for, or nil
+// to serve without TLS.
+func nbdServeTLSConfig() (*tls.Config, error) {
+	if nbdServeTLSCert == "" && nbdServeTLSKey == "" {
+		if nbdServeClientCA != "" {
+			return nil, errors.New("--tls-client-ca needs --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	if nbdServeTLSCert == "" || nbdServeTLSKey == "" {
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(nbdServeTLSCert, nbdServeTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't load TLS certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if nbdServeClientCA != "" {
+		pem, err := ioutil.ReadFile(nbdServeClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("can't read client CAs: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", nbdServeClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
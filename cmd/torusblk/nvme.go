@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/nvme"
+	"github.com/coreos/torus/block/scsi"
+)
+
+var nvmeCommand = &cobra.Command{
+	Use:   "nvme VOLUME [VOLUME...]",
+	Short: "serve block volumes as NVMe/TCP subsystems [EXPERIMENTAL]",
+	Long: strings.TrimSpace(`
+Serve block volumes over NVMe/TCP, so that hosts can attach them with their
+NVMe driver. Each volume is a subsystem of its own, named NQN-PREFIX:VOLUME,
+with a single namespace. For example:
+
+	torusblk nvme vol01 vol02
+
+and, on a Linux host:
+
+	modprobe nvme-tcp
+	nvme discover -t tcp -a torus-gateway -s 4420
+	nvme connect -t tcp -a torus-gateway -s 4420 -n nqn.2016-06.com.coreos.torus:vol01
+
+Authentication, TLS and digests aren't supported, so serve only on a trusted
+storage network. Each volume is locked while it's served, as with "torusblk
+nbd".
+`),
+	Run: nvmeAction,
+}
+
+var (
+	nvmeListen    string
+	nvmeNQNPrefix string
+)
+
+func init() {
+	nvmeCommand.Flags().StringVar(&nvmeListen, "listen", fmt.Sprintf(":%d", nvme.DefaultPort), "address to accept NVMe/TCP connections on")
+	nvmeCommand.Flags().StringVar(&nvmeNQNPrefix, "nqn-prefix", "nqn.2016-06.com.coreos.torus", "prefix of the subsystem names, which are PREFIX:VOLUME")
+	addReplicaFlags(nvmeCommand)
+}
+
+func nvmeAction(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	srv := createServer()
+	defer srv.Close()
+
+	gmd, err := srv.MDS.GlobalMetadata()
+	if err != nil {
+		die("couldn't get the cluster's metadata: %s", err)
+	}
+
+	var subsystems []*nvme.Subsystem
+	for _, name := range args {
+		blockvol, err := block.OpenBlockVolume(srv, name)
+		if err != nil {
+			die("server doesn't support block volumes: %s", err)
+		}
+		readOnly := checkReplicas(srv, blockvol)
+		var f *block.BlockFile
+		if readOnly {
+			f, err = blockvol.OpenReadOnlyAttachment()
+		} else {
+			f, err = blockvol.OpenAttachment()
+		}
+		if err != nil {
+			if err == torus.ErrLocked {
+				die("volume %s is already mounted on another host", name)
+			}
+			die("can't open block volume %s: %s", name, err)
+		}
+		defer f.Close()
+		subsystems = append(subsystems, &nvme.Subsystem{
+			NQN:               nvmeNQNPrefix + ":" + name,
+			Device:            scsi.NewFence(blockvol).Device(f),
+			Size:              int64(f.Size()),
+			ReadOnly:          readOnly,
+			Serial:            name,
+			PhysicalBlockSize: int(gmd.BlockSize),
+		})
+	}
+
+	handle, err := nvme.NewServer(subsystems...)
+	if err != nil {
+		die("%s", err)
+	}
+	l, err := net.Listen("tcp", nvmeListen)
+	if err != nil {
+		die("can't listen for NVMe/TCP hosts: %s", err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		fmt.Println("\nReceived an interrupt, disconnecting...")
+		handle.Close()
+	}()
+
+	for _, sub := range subsystems {
+		fmt.Println("Serving", sub.NQN)
+	}
+	if err := handle.Serve(l); err != nil {
+		fmt.Fprintf(os.Stderr, "error from nvme server: %s\n", err)
+		os.Exit(1)
+	}
+}
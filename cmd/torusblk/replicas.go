@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+var (
+	minReplicas     int
+	underReplicated string
+	readOnlyExport  bool
+)
+
+// addReplicaFlags adds the flags guarding against exporting an
+// under-replicated volume to an export command, and --read-only.
+func addReplicaFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&readOnlyExport, "read-only", false, "export the volume as it is now, read-only and without locking it, alongside any writer")
+	cmd.Flags().IntVar(&minReplicas, "min-replicas", 0, "refuse to export the volume read-write if any of its blocks has fewer replicas (0 skips the check)")
+	cmd.Flags().StringVar(&underReplicated, "under-replicated", "refuse", "what to do when the volume has too few replicas: refuse, or export it read-only")
+}
+
+// checkReplicas decides, according to the flags, whether vol may be exported
+// read-write; it never is with --read-only. It returns true if the volume should be exported read-only
+// instead, and exits if it shouldn't be exported at all.
+func checkReplicas(srv *torus.Server, vol *block.BlockVolume) (readOnly bool) {
+	readOnly, err := replicaPolicy(srv, vol)
+	if err != nil {
+		die("%v", err)
+	}
+	return readOnly
+}
+
+// replicaPolicy is checkReplicas for exports opened while serving, returning
+// an error instead of exiting.
+func replicaPolicy(srv *torus.Server, vol *block.BlockVolume) (readOnly bool, err error) {
+	if readOnlyExport {
+		return true, nil
+	}
+	if minReplicas <= 0 {
+		return false, nil
+	}
+	if underReplicated != "refuse" && underReplicated != "read-only" {
+		return false, fmt.Errorf("--under-replicated must be refuse or read-only, not %q", underReplicated)
+	}
+	f, err := vol.OpenReadOnlyBlockFile()
+	if err != nil {
+		return false, fmt.Errorf("can't open block volume: %v", err)
+	}
+	refs := f.Blocks().GetAllBlockRefs()
+	f.Close()
+	rc, err := distributor.CountReplicas(srv, refs)
+	if err != nil {
+		return false, fmt.Errorf("couldn't check the volume's replicas: %v", err)
+	}
+	if rc.Blocks == 0 || rc.Min >= minReplicas {
+		return false, nil
+	}
+	msg := fmt.Sprintf("volume has blocks with only %d replicas where %d are required (%d of %d blocks are below the ring's %d)",
+		rc.Min, minReplicas, rc.UnderReplicated, rc.Blocks, rc.Target)
+	if underReplicated == "refuse" {
+		return false, fmt.Errorf("%s; refusing to export it", msg)
+	}
+	fmt.Printf("%s; exporting it read-only\n", msg)
+	return true, nil
+}
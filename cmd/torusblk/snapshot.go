@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+)
+
+var snapshotCommand = &cobra.Command{
+	Use:   "snapshot",
+	Short: "manage snapshots of block volumes",
+	Run:   snapshotAction,
+}
+
+var snapshotRollbackCommand = &cobra.Command{
+	Use:   "rollback VOLUME SNAPSHOT",
+	Short: "return a block volume to a snapshot",
+	Long: strings.TrimSpace(`
+Return VOLUME to its state when SNAPSHOT was taken, discarding everything
+written to it since, in one step. The snapshot is kept.
+
+The volume must not be attached. With --force, it's rolled back anyway, and
+the host which has it attached is fenced off it: its writes fail from then on,
+and it should detach the volume, unmounting any filesystem on it first, before
+attaching it again.
+`),
+	Run: snapshotRollbackAction,
+}
+
+var snapshotRollbackForce bool
+
+func init() {
+	snapshotCommand.AddCommand(snapshotRollbackCommand)
+	snapshotRollbackCommand.Flags().BoolVar(&snapshotRollbackForce, "force", false, "roll back even if the volume is attached")
+}
+
+func snapshotAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func snapshotRollbackAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.RollbackSnapshot(mds, args[0], args[1], snapshotRollbackForce)
+	switch err {
+	case nil:
+	case torus.ErrLocked:
+		die("volume %s is attached; detach it first, or use --force", args[0])
+	case torus.ErrNotExist:
+		die("volume %s has no snapshot named %s", args[0], args[1])
+	default:
+		die("error rolling back volume %s: %v", args[0], err)
+	}
+}
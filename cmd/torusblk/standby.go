@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+)
+
+// standbyDevice serves reads from a block.Standby until it is promoted, and
+// from the writable file afterwards.
+type standbyDevice struct {
+	mu sync.RWMutex
+	sb *block.Standby
+	f  *block.BlockFile
+}
+
+func openStandbyDevice(vol *block.BlockVolume, interval time.Duration) (*standbyDevice, error) {
+	sb, err := vol.OpenStandby(interval)
+	if err != nil {
+		return nil, err
+	}
+	return &standbyDevice{sb: sb}, nil
+}
+
+func (d *standbyDevice) promote(force bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f != nil {
+		return nil
+	}
+	f, err := d.sb.Promote(force)
+	if err != nil {
+		return err
+	}
+	d.f = f
+	return nil
+}
+
+func (d *standbyDevice) Size() uint64 {
+	return d.sb.File().Size()
+}
+
+func (d *standbyDevice) ReadAt(b []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.f != nil {
+		return d.f.ReadAt(b, off)
+	}
+	return d.sb.ReadAt(b, off)
+}
+
+func (d *standbyDevice) WriteAt(b []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.f == nil {
+		return 0, torus.ErrLocked
+	}
+	return d.f.WriteAt(b, off)
+}
+
+func (d *standbyDevice) Sync() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.f == nil {
+		return nil
+	}
+	return d.f.Sync()
+}
+
+func (d *standbyDevice) Trim(off, length int64) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.f == nil {
+		return torus.ErrLocked
+	}
+	return d.f.Trim(off, length)
+}
+
+func (d *standbyDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f != nil {
+		return d.f.Close()
+	}
+	return d.sb.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/scsi"
+	"github.com/coreos/torus/block/tcmu"
+)
+
+var tcmuCommand = &cobra.Command{
+	Use:   "tcmu VOLUME [VOLUME...]",
+	Short: "register block volumes as LIO backstores through TCMU [EXPERIMENTAL]",
+	Long: strings.TrimSpace(`
+Register block volumes with the kernel's LIO SCSI target as TCMU backstores,
+named user_HBA/VOLUME, and serve their IO. LIO exports them over any fabric it
+supports and handles SCSI persistent reservations itself. Map a backstore to a
+fabric with targetcli once it's registered, for example:
+
+	torusblk tcmu vol01 &
+	targetcli /iscsi create iqn.2016-06.com.coreos.torus:vol01
+	targetcli /iscsi/iqn.2016-06.com.coreos.torus:vol01/tpg1/luns create /backstores/user:torus/vol01
+
+The target_core_user module must be loaded and configfs mounted. Backstores
+are removed on an interrupt, which fails while they are still mapped to a
+LUN. Each volume is locked while it's served, as with "torusblk nbd".
+`),
+	Run: tcmuAction,
+}
+
+var tcmuHBA int
+
+func init() {
+	tcmuCommand.Flags().IntVar(&tcmuHBA, "hba", 0, "number of the user_HBA the backstores are created in")
+	addReplicaFlags(tcmuCommand)
+}
+
+func tcmuAction(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	srv := createServer()
+	defer srv.Close()
+
+	gmd, err := srv.MDS.GlobalMetadata()
+	if err != nil {
+		die("couldn't get the cluster's metadata: %s", err)
+	}
+
+	var backstores []*tcmu.Backstore
+	closeAll := func() {
+		for _, b := range backstores {
+			if err := b.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "can't remove backstore %s: %s\n", b.Name, err)
+			}
+		}
+	}
+	for _, name := range args {
+		blockvol, err := block.OpenBlockVolume(srv, name)
+		if err != nil {
+			closeAll()
+			die("server doesn't support block volumes: %s", err)
+		}
+		readOnly := checkReplicas(srv, blockvol)
+		var f *block.BlockFile
+		if readOnly {
+			f, err = blockvol.OpenReadOnlyAttachment()
+		} else {
+			f, err = blockvol.OpenAttachment()
+		}
+		if err != nil {
+			closeAll()
+			if err == torus.ErrLocked {
+				die("volume %s is already mounted on another host", name)
+			}
+			die("can't open block volume %s: %s", name, err)
+		}
+		defer f.Close()
+		b, err := tcmu.Register(tcmuHBA, name, &scsi.Disk{
+			Device:            f,
+			Size:              int64(f.Size()),
+			ReadOnly:          readOnly,
+			Serial:            name,
+			PhysicalBlockSize: int(gmd.BlockSize),
+			Reservations:      blockvol,
+		})
+		if err != nil {
+			closeAll()
+			die("%s", err)
+		}
+		backstores = append(backstores, b)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(backstores))
+	for i, b := range backstores {
+		wg.Add(1)
+		go func(i int, b *tcmu.Backstore) {
+			defer wg.Done()
+			errs[i] = b.Serve()
+		}(i, b)
+		fmt.Printf("Serving /backstores/user:%s/%s\n", tcmu.Subtype, b.Name)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		for range signalChan {
+			fmt.Println("\nReceived an interrupt, removing backstores...")
+			closeAll()
+		}
+	}()
+
+	wg.Wait()
+	failed := false
+	for _, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error serving backstore: %s\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/scsi"
+	"github.com/coreos/torus/block/vhost"
+)
+
+var vhostUserCommand = &cobra.Command{
+	Use:   "vhost-user VOLUME SOCKET",
+	Short: "serve a block volume to QEMU as a vhost-user-blk device [EXPERIMENTAL]",
+	Long: strings.TrimSpace(`
+Serve a block volume to QEMU as a vhost-user-blk device on the unix socket
+SOCKET, so that the VM's IO goes straight to torus. The guest's memory must be
+shared with the backend, for example:
+
+	torusblk vhost-user vol01 /run/torus/vol01.sock &
+	qemu-system-x86_64 ... \
+		-object memory-backend-memfd,id=mem,size=4G,share=on \
+		-numa node,memdev=mem \
+		-chardev socket,id=vol01,path=/run/torus/vol01.sock,reconnect=1 \
+		-device vhost-user-blk-pci,chardev=vol01
+
+One QEMU process is served at a time; if it disconnects, the next to connect
+is served. The volume is locked while it's served, as with "torusblk nbd".
+`),
+	Run: vhostUserAction,
+}
+
+func init() {
+	addReplicaFlags(vhostUserCommand)
+}
+
+func vhostUserAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name, path := args[0], args[1]
+
+	srv := createServer()
+	defer srv.Close()
+
+	gmd, err := srv.MDS.GlobalMetadata()
+	if err != nil {
+		die("couldn't get the cluster's metadata: %s", err)
+	}
+	blockvol, err := block.OpenBlockVolume(srv, name)
+	if err != nil {
+		die("server doesn't support block volumes: %s", err)
+	}
+	readOnly := checkReplicas(srv, blockvol)
+	var f *block.BlockFile
+	if readOnly {
+		f, err = blockvol.OpenReadOnlyAttachment()
+	} else {
+		f, err = blockvol.OpenAttachment()
+	}
+	if err != nil {
+		if err == torus.ErrLocked {
+			die("volume %s is already mounted on another host", name)
+		}
+		die("can't open block volume %s: %s", name, err)
+	}
+	defer f.Close()
+
+	handle, err := vhost.NewServer(&vhost.Disk{
+		Device:            scsi.NewFence(blockvol).Device(f),
+		Size:              int64(f.Size()),
+		ReadOnly:          readOnly,
+		Serial:            name,
+		PhysicalBlockSize: int(gmd.BlockSize),
+	})
+	if err != nil {
+		die("%s", err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		die("can't listen on %s: %s", path, err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		fmt.Println("\nReceived an interrupt, disconnecting...")
+		handle.Close()
+	}()
+
+	fmt.Printf("Serving %s on %s\n", name, path)
+	if err := handle.Serve(l); err != nil {
+		fmt.Fprintf(os.Stderr, "error from vhost-user server: %s\n", err)
+		os.Exit(1)
+	}
+}
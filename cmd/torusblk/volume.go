@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
@@ -22,8 +24,61 @@ var volumeCreateCommand = &cobra.Command{
 	Run:   volumeCreateAction,
 }
 
+var volumeGrowCommand = &cobra.Command{
+	Use:   "grow NAME SIZE",
+	Short: "enlarge a block volume",
+	Long: strings.TrimSpace(`
+Enlarge the block volume NAME to SIZE bytes (G,GiB,M,MiB,etc suffixes
+accepted). The new space reads as zeroes.
+
+The volume may be attached. Its host picks the new size up within a few
+seconds and passes it on to the NBD device, or to AoE initiators, which see
+it once they rescan the device. The partition table or filesystem on the
+volume must then be grown separately.
+`),
+	Run: volumeGrowAction,
+}
+
+var volumeShrinkCommand = &cobra.Command{
+	Use:   "shrink NAME SIZE",
+	Short: "reduce the size of a block volume",
+	Long: strings.TrimSpace(`
+Reduce the block volume NAME to SIZE bytes (G,GiB,M,MiB,etc suffixes
+accepted). Shrink the filesystem and partition table on the volume first.
+
+The volume must be detached. If anything has been written past SIZE, the
+volume is left alone unless --force is given, which discards it. The blocks
+cut off are freed by the cluster's garbage collection, unless a snapshot of
+the volume still holds them.
+`),
+	Run: volumeShrinkAction,
+}
+
+var (
+	volumeChecksum    string
+	volumeCompression string
+	volumeDedup       bool
+	volumeEncrypt     bool
+	volumeErasure     string
+	volumeLabels      string
+	volumeReplication int
+	volumeShared      bool
+	volumeShrinkForce bool
+)
+
 func init() {
 	volumeCommand.AddCommand(volumeCreateCommand)
+	volumeCommand.AddCommand(volumeGrowCommand)
+	volumeCommand.AddCommand(volumeShrinkCommand)
+	volumeShrinkCommand.Flags().BoolVar(&volumeShrinkForce, "force", false, "discard data written past the new size")
+	volumeCreateCommand.Flags().StringVar(&volumeChecksum, "checksum", "", "checksum algorithm for the volume's blocks: crc32, crc32c, xxhash or sha256 (default: the cluster's)")
+	volumeCreateCommand.Flags().StringVar(&volumeCompression, "compress", "", "compress the volume's blocks with lz4 or deflate")
+	volumeCreateCommand.Flags().BoolVar(&volumeDedup, "dedup", false, "store blocks already stored by this or another deduplicated volume only once")
+	volumeCreateCommand.Flags().BoolVar(&volumeEncrypt, "encrypt", false, "encrypt the volume's blocks with the key from --key-file or --key-command")
+	volumeCreateCommand.Flags().StringVar(&volumeErasure, "erasure", "", "erasure code the volume's blocks as K+M, such as 4+2, instead of replicating them")
+	volumeCreateCommand.Flags().BoolVar(&volumeShared, "shared", false, "let the volume be attached read-write on several hosts at once, for cluster filesystems")
+	volumeCreateCommand.Flags().StringVar(&volumeLabels, "labels", "", "labels for the volume, as KEY=VALUE[,KEY=VALUE...]")
+	volumeCreateCommand.Flags().IntVar(&volumeReplication, "replication", 0, "copies to keep of the volume's blocks (default: the ring's replication)")
 }
 
 func volumeAction(cmd *cobra.Command, args []string) {
@@ -41,12 +96,75 @@ func volumeCreateAction(cmd *cobra.Command, args []string) {
 	if err != nil {
 		die("error parsing size %s: %v", args[1], err)
 	}
-	err = block.CreateBlockVolume(mds, args[0], size)
+	labels, err := block.ParseLabels(volumeLabels)
+	if err != nil {
+		die("%v", err)
+	}
+	opts := block.VolumeOptions{
+		Checksum:    volumeChecksum,
+		Compression: volumeCompression,
+		Dedup:       volumeDedup,
+		Erasure:     volumeErasure,
+		Shared:      volumeShared,
+		Labels:      labels,
+		Replication: volumeReplication,
+	}
+	if volumeEncrypt {
+		opts.Encryption, err = block.NewVolumeEncryption(args[0])
+		if err == block.ErrNoKey {
+			die("--encrypt needs a key, from --key-file or --key-command")
+		}
+		if err != nil {
+			die("error getting key for volume %s: %v", args[0], err)
+		}
+	}
+	err = block.CreateBlockVolumeWithOptions(mds, args[0], size, opts)
 	if err != nil {
 		die("error creating volume %s: %v", args[0], err)
 	}
 }
 
+func volumeGrowAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	size, err := humanize.ParseBytes(args[1])
+	if err != nil {
+		die("error parsing size %s: %v", args[1], err)
+	}
+	srv := createServer()
+	defer srv.Close()
+	err = block.GrowBlockVolume(srv, args[0], size)
+	if err != nil {
+		die("error growing volume %s: %v", args[0], err)
+	}
+}
+
+func volumeShrinkAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	size, err := humanize.ParseBytes(args[1])
+	if err != nil {
+		die("error parsing size %s: %v", args[1], err)
+	}
+	srv := createServer()
+	defer srv.Close()
+	dropped, err := block.ShrinkBlockVolume(srv, args[0], size, volumeShrinkForce)
+	switch err {
+	case nil:
+	case torus.ErrLocked:
+		die("volume %s is attached; detach it first", args[0])
+	case block.ErrShrinkData:
+		die("volume %s has data past %s; use --force to discard it", args[0], args[1])
+	default:
+		die("error shrinking volume %s: %v", args[0], err)
+	}
+	fmt.Printf("dropped %d blocks\n", dropped)
+}
+
 func mustConnectToMDS() torus.MetadataService {
 	cfg := torus.Config{
 		MetadataAddress: etcdAddress,
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus/block"
+)
+
+var aoeCommand = &cobra.Command{
+	Use:   "aoe",
+	Short: "inspect volumes exported over AoE",
+	Run:   aoeAction,
+}
+
+var aoeListCommand = &cobra.Command{
+	Use:   "list",
+	Short: "list the volumes exported over AoE across the cluster",
+	Long: strings.TrimSpace(`
+List the AoE exports running in the cluster, by major.minor address, with the
+volume each serves and the node serving it. Exports are listed for as long as
+their torusblk aoe process is alive.
+`),
+	Run: aoeListAction,
+}
+
+func init() {
+	aoeCommand.AddCommand(aoeListCommand)
+	aoeListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+}
+
+func aoeAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func aoeListAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	exports, err := block.GetAoEExports(mds)
+	if err != nil {
+		die("couldn't list AoE exports: %v", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	if outputAsCSV {
+		table.SetBorder(false)
+		table.SetColumnSeparator(",")
+	} else {
+		table.SetHeader([]string{"Address", "Volume", "Node", "Started"})
+	}
+	for _, e := range exports {
+		started := e.Started.Format(time.RFC3339)
+		if !outputAsCSV {
+			started = humanize.Time(e.Started)
+		}
+		table.Append([]string{e.Address(), e.Volume, e.Node, started})
+	}
+	table.Render()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+)
+
+// bulkFlags lets a volume command act on every volume matching a label
+// selector rather than on one named volume.
+type bulkFlags struct {
+	selector string
+	dryRun   bool
+	yes      bool
+}
+
+var volumeBulk bulkFlags
+
+func (b *bulkFlags) add(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&b.selector, "selector", "l", "", "act on every volume with these labels, as KEY[=VALUE][,...], instead of a named one")
+	cmd.Flags().BoolVarP(&b.dryRun, "dry-run", "", false, "with --selector, only list the volumes which would be affected")
+	cmd.Flags().BoolVarP(&b.yes, "yes", "y", false, "with --selector, don't ask for confirmation")
+}
+
+// volumes lists the volumes matching the selector and asks whether to verb
+// them. It returns them if the user agrees, and nothing for a dry run.
+func (b *bulkFlags) volumes(mds torus.MetadataService, verb string) []string {
+	sel, err := block.ParseSelector(b.selector)
+	if err != nil {
+		die("invalid selector: %v", err)
+	}
+	names, err := block.FindVolumes(mds, sel)
+	if err != nil {
+		die("cannot find volumes: %v", err)
+	}
+	if len(names) == 0 {
+		fmt.Printf("no volumes match %s\n", sel)
+		return nil
+	}
+	if b.dryRun {
+		for _, name := range names {
+			fmt.Printf("would %s %s\n", verb, name)
+		}
+		return nil
+	}
+	if !b.yes {
+		fmt.Printf("This will %s %d volumes:\n", verb, len(names))
+		for _, name := range names {
+			fmt.Printf("  %s\n", name)
+		}
+		fmt.Print("Continue? [y/N] ")
+		text, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(text)) {
+		case "y", "yes":
+		default:
+			die("not confirmed, exiting")
+		}
+	}
+	return names
+}
+
+// runBulk calls fn on each of names, carrying on past failures. It reports
+// how each volume fared and exits non-zero if any failed.
+func runBulk(names []string, fn func(name string) error) {
+	failed := 0
+	for _, name := range names {
+		if err := fn(name); err != nil {
+			fmt.Printf("%s: failed: %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: ok\n", name)
+	}
+	if failed != 0 {
+		die("%d of %d volumes failed", failed, len(names))
+	}
+}
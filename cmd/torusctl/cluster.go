@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var clusterCommand = &cobra.Command{
+	Use:   "cluster",
+	Short: "manage the cluster as a whole",
+	Run:   clusterAction,
+}
+
+var clusterCheckpointCommand = &cobra.Command{
+	Use:   "checkpoint NAME",
+	Short: "snapshot every block volume at a single point in time",
+	Long: strings.TrimSpace(`
+Snapshot every block volume in the cluster as it was at a single metadata
+revision, so that the volumes can later be restored together to a coherent
+instant. Volumes don't need to be detached; each is recorded with the last
+data it had synced at that revision.
+
+Each volume gets a snapshot named checkpoint-NAME.
+`),
+	Run: clusterCheckpointAction,
+}
+
+var clusterListCheckpointsCommand = &cobra.Command{
+	Use:   "list-checkpoints",
+	Short: "list the checkpoints in the cluster",
+	Run:   clusterListCheckpointsAction,
+}
+
+var clusterDeleteCheckpointCommand = &cobra.Command{
+	Use:   "delete-checkpoint NAME",
+	Short: "delete a checkpoint and its snapshots",
+	Run:   clusterDeleteCheckpointAction,
+}
+
+var clusterRestoreCommand = &cobra.Command{
+	Use:   "restore NAME",
+	Short: "return every volume to a checkpoint",
+	Long: strings.TrimSpace(`
+Return every block volume recorded in a checkpoint to the state it had then.
+All of them must be detached. Volumes deleted since the checkpoint can't be
+restored and are reported; volumes created since are left as they are.
+`),
+	Run: clusterRestoreAction,
+}
+
+func init() {
+	clusterCommand.AddCommand(clusterCheckpointCommand)
+	clusterCommand.AddCommand(clusterListCheckpointsCommand)
+	clusterCommand.AddCommand(clusterDeleteCheckpointCommand)
+	clusterCommand.AddCommand(clusterRestoreCommand)
+}
+
+func clusterAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func clusterCheckpointAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	c, err := block.SaveCheckpoint(mds, args[0])
+	if err == torus.ErrExists {
+		die("checkpoint %s already exists", args[0])
+	}
+	if err != nil {
+		die("cannot checkpoint cluster: %v", err)
+	}
+	fmt.Printf("checkpoint %s: %d volumes at revision %d\n", c.Name, len(c.Volumes), c.Revision)
+}
+
+func clusterListCheckpointsAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	cps, err := block.GetCheckpoints(mds)
+	if err != nil {
+		die("error listing checkpoints: %v", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	if outputAsCSV {
+		table.SetBorder(false)
+		table.SetColumnSeparator(",")
+	} else {
+		table.SetHeader([]string{"Checkpoint", "Created", "Revision", "Volumes"})
+	}
+	for _, c := range cps {
+		var vols []string
+		for v := range c.Volumes {
+			vols = append(vols, v)
+		}
+		sort.Strings(vols)
+		table.Append([]string{
+			c.Name,
+			c.Created.Format("2006-01-02 15:04:05"),
+			strconv.FormatInt(c.Revision, 10),
+			strings.Join(vols, " "),
+		})
+	}
+	table.Render()
+}
+
+func clusterDeleteCheckpointAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.DeleteCheckpoint(mds, args[0])
+	if err != nil {
+		die("cannot delete checkpoint: %v", err)
+	}
+}
+
+func clusterRestoreAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	skipped, err := block.RestoreCheckpoint(mds, args[0])
+	if err == torus.ErrLocked {
+		die("some volumes are attached; detach them all before restoring")
+	}
+	if err != nil {
+		die("cannot restore checkpoint: %v", err)
+	}
+	for _, v := range skipped {
+		fmt.Fprintf(os.Stderr, "volume %s was deleted after the checkpoint and was not restored\n", v)
+	}
+}
@@ -5,6 +5,10 @@ import (
 	"os"
 
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/distributor"
+
+	// Register the local storage driver used by client-only servers.
+	_ "github.com/coreos/torus/storage"
 )
 
 func die(why string, args ...interface{}) {
@@ -22,3 +26,32 @@ func mustConnectToMDS() torus.MetadataService {
 	}
 	return mds
 }
+
+// mustCreateServer connects to the cluster as a client, for commands which
+// need to read or write volume data rather than just metadata.
+func mustCreateServer() *torus.Server {
+	srv, err := createServer(etcdAddress)
+	if err != nil {
+		die("%v", err)
+	}
+	return srv
+}
+
+// createServer connects to the cluster whose etcd is at address as a client.
+func createServer(address string) (*torus.Server, error) {
+	cfg := torus.Config{
+		MetadataAddress: address,
+		ReadLevel:       torus.ReadBlock,
+		WriteLevel:      torus.WriteAll,
+	}
+	srv, err := torus.NewServer(cfg, "etcd", "temp")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start client: %v", err)
+	}
+	err = distributor.OpenReplication(srv)
+	if err != nil {
+		srv.Close()
+		return nil, fmt.Errorf("couldn't connect to the cluster: %v", err)
+	}
+	return srv, nil
+}
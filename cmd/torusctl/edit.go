@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/spf13/cobra"
+)
+
+var volumeRenameCommand = &cobra.Command{
+	Use:   "rename NAME NEW_NAME",
+	Short: "rename a block volume",
+	Long: strings.TrimSpace(`
+Rename a block volume. It keeps its data, snapshots and settings, and hosts
+which have it attached carry on using it; only those attaching it afresh need
+the new name. Consistency groups list it under the new name.
+`),
+	Run: volumeRenameAction,
+}
+
+var volumeEditCommand = &cobra.Command{
+	Use:   "edit NAME [--name NEW_NAME] [--description TEXT] [KEY=VALUE|KEY-...]",
+	Short: "show or change the name, description and labels of a block volume",
+	Long: strings.TrimSpace(`
+With just a volume name, print its description. Otherwise rename it, replace
+its description, and set each KEY=VALUE label and remove each KEY- given, all
+at once:
+
+	torusctl volume edit vol01 --name db01-data --description "db01 data" app=db
+`),
+	Run: volumeEditAction,
+}
+
+var (
+	volumeEditName        string
+	volumeEditDescription string
+)
+
+func init() {
+	volumeCommand.AddCommand(volumeRenameCommand)
+	volumeCommand.AddCommand(volumeEditCommand)
+	volumeEditCommand.Flags().StringVar(&volumeEditName, "name", "", "rename the volume")
+	volumeEditCommand.Flags().StringVar(&volumeEditDescription, "description", "", "replace the volume's description; empty removes it")
+}
+
+func volumeRenameAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.RenameBlockVolume(mds, args[0], args[1])
+	if err == torus.ErrExists {
+		die("a volume named %s already exists", args[1])
+	}
+	if err != nil {
+		die("cannot rename volume %s: %v", args[0], err)
+	}
+}
+
+func volumeEditAction(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	descChanged := cmd.Flags().Changed("description")
+	if len(args) == 1 && volumeEditName == "" && !descChanged {
+		desc, err := block.GetVolumeDescription(mds, name)
+		if err != nil {
+			die("cannot get description of volume %s: %v", name, err)
+		}
+		fmt.Println(desc)
+		return
+	}
+	e := block.VolumeEdit{Name: volumeEditName}
+	if descChanged {
+		e.Description = &volumeEditDescription
+	}
+	if len(args) > 1 {
+		labels, err := block.GetVolumeLabels(mds, name)
+		if err != nil {
+			die("cannot get labels of volume %s: %v", name, err)
+		}
+		if err := applyLabelChanges(labels, args[1:]); err != nil {
+			die("%v", err)
+		}
+		e.Labels = labels
+	}
+	err := block.EditBlockVolume(mds, name, e)
+	if err == torus.ErrExists {
+		die("a volume named %s already exists", volumeEditName)
+	}
+	if err != nil {
+		die("cannot edit volume %s: %v", name, err)
+	}
+}
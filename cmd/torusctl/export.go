@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/internal/qcow2"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportTo       string
+	exportFormat   string
+	exportSnapshot string
+)
+
+var volumeExportCommand = &cobra.Command{
+	Use:   "export --to=IMAGE NAME",
+	Short: "write a block volume out as a raw or qcow2 disk image",
+	Long: strings.TrimSpace(`
+Write the contents of a block volume to a new disk image, raw or, with
+--format=qcow2, qcow2. The volume is exported as it is when the command
+starts, or as it was when the snapshot given by --snapshot was taken; it may
+stay attached meanwhile. Zeroes aren't written: a raw image is left sparse
+where the volume reads as zeroes, and a qcow2 image doesn't allocate those
+clusters. IMAGE mustn't already exist.
+`),
+	Run: volumeExportAction,
+}
+
+func init() {
+	volumeExportCommand.Flags().StringVar(&exportTo, "to", "", "image file to write")
+	volumeExportCommand.Flags().StringVar(&exportFormat, "format", "raw", "format of the image: raw or qcow2")
+	volumeExportCommand.Flags().StringVar(&exportSnapshot, "snapshot", "", "export this snapshot of the volume")
+}
+
+func volumeExportAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 || exportTo == "" {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	if exportFormat != "raw" && exportFormat != "qcow2" {
+		die("unknown image format %q", exportFormat)
+	}
+	name := args[0]
+	srv := mustCreateServer()
+	defer srv.Close()
+	vol, err := block.OpenBlockVolume(srv, name)
+	if err != nil {
+		die("couldn't open block volume %s: %v", name, err)
+	}
+	var f *block.BlockFile
+	if exportSnapshot != "" {
+		f, err = vol.OpenSnapshot(exportSnapshot)
+	} else {
+		f, err = vol.OpenReadOnlyAttachment()
+	}
+	if err != nil {
+		die("couldn't open block volume %s: %v", name, err)
+	}
+	defer f.Close()
+	size := int64(f.Size())
+
+	output, err := os.OpenFile(exportTo, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		die("couldn't create image: %v", err)
+	}
+	var write func(off int64, data []byte) error
+	var finish func() error
+	if exportFormat == "qcow2" {
+		w, err := qcow2.NewWriter(output, size)
+		if err != nil {
+			die("%v", err)
+		}
+		write, finish = w.WriteCluster, w.Close
+	} else {
+		write = func(off int64, data []byte) error {
+			_, err := output.WriteAt(data, off)
+			return err
+		}
+		// The zeroes skipped at the end are left as a hole.
+		finish = func() error { return output.Truncate(size) }
+	}
+
+	// qcow2 images are written a cluster at a time, which is also small
+	// enough to leave raw images usefully sparse.
+	buf := make([]byte, qcow2.ClusterSize)
+	zero := make([]byte, qcow2.ClusterSize)
+	var written, skipped int64
+	for off := int64(0); off < size; {
+		n := int64(len(buf))
+		if size-off < n {
+			n = size - off
+		}
+		_, err := f.ReadAt(buf[:n], off)
+		if err != nil && err != io.EOF {
+			die("couldn't read volume: %v", err)
+		}
+		if bytes.Equal(buf[:n], zero[:n]) {
+			skipped += n
+		} else {
+			if err := write(off, buf[:n]); err != nil {
+				die("couldn't write image: %v", err)
+			}
+			written += n
+		}
+		off += n
+	}
+	if err := finish(); err != nil {
+		die("couldn't write image: %v", err)
+	}
+	if err := output.Close(); err != nil {
+		die("couldn't write image: %v", err)
+	}
+	fmt.Printf("exported %s: %s written, %s of zeroes skipped\n", name,
+		humanize.IBytes(uint64(written)), humanize.IBytes(uint64(skipped)))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var groupCommand = &cobra.Command{
+	Use:   "group",
+	Short: "manage consistency groups of block volumes",
+	Run:   groupAction,
+}
+
+var groupCreateCommand = &cobra.Command{
+	Use:   "create GROUP VOLUME...",
+	Short: "create a consistency group of block volumes",
+	Long: strings.TrimSpace(`
+Create a consistency group of block volumes which are snapshotted together,
+such as the data and log volumes of one database:
+
+	torusctl group create db01 db01-data db01-log
+`),
+	Run: groupCreateAction,
+}
+
+var groupAddCommand = &cobra.Command{
+	Use:   "add GROUP VOLUME...",
+	Short: "add block volumes to a consistency group",
+	Run:   groupAddAction,
+}
+
+var groupRemoveCommand = &cobra.Command{
+	Use:   "remove GROUP VOLUME...",
+	Short: "remove block volumes from a consistency group",
+	Run:   groupRemoveAction,
+}
+
+var groupListCommand = &cobra.Command{
+	Use:   "list",
+	Short: "list the consistency groups in the cluster",
+	Run:   groupListAction,
+}
+
+var groupDeleteCommand = &cobra.Command{
+	Use:   "delete GROUP",
+	Short: "delete a consistency group, keeping its volumes and snapshots",
+	Run:   groupDeleteAction,
+}
+
+var groupSnapshotCommand = &cobra.Command{
+	Use:   "snapshot GROUP SNAPSHOT",
+	Short: "snapshot every volume in a consistency group at once",
+	Long: strings.TrimSpace(`
+Take a snapshot named SNAPSHOT of every volume in GROUP, all as of a single
+metadata revision, so that together they're crash-consistent: as if every
+host using them had lost power at the same instant. Volumes don't need to be
+detached; each is recorded with the last data it had synced, which includes
+everything its host has acknowledged a flush of.
+
+Each snapshot is annotated with consistency-group=GROUP, as well as anything
+given with --annotate. If any volume already has a snapshot named SNAPSHOT,
+none are taken.
+`),
+	Run: groupSnapshotAction,
+}
+
+var groupDeleteSnapshotCommand = &cobra.Command{
+	Use:   "delete-snapshot GROUP SNAPSHOT",
+	Short: "delete the snapshots taken of a consistency group",
+	Run:   groupDeleteSnapshotAction,
+}
+
+var groupSnapshotAnnotations = annotationsFlag{}
+
+func init() {
+	groupCommand.AddCommand(groupCreateCommand)
+	groupCommand.AddCommand(groupAddCommand)
+	groupCommand.AddCommand(groupRemoveCommand)
+	groupCommand.AddCommand(groupListCommand)
+	groupCommand.AddCommand(groupDeleteCommand)
+	groupCommand.AddCommand(groupSnapshotCommand)
+	groupCommand.AddCommand(groupDeleteSnapshotCommand)
+	groupSnapshotCommand.Flags().Var(groupSnapshotAnnotations, "annotate", "record KEY=VALUE with the snapshots (repeatable)")
+	groupListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+}
+
+func groupAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func groupCreateAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.CreateConsistencyGroup(mds, args[0], args[1:])
+	if err == torus.ErrExists {
+		die("consistency group %s already exists", args[0])
+	}
+	if err != nil {
+		die("cannot create consistency group: %v", err)
+	}
+}
+
+func groupAddAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	_, err := block.AddToConsistencyGroup(mds, args[0], args[1:])
+	if err == torus.ErrNotExist {
+		die("no consistency group named %s", args[0])
+	}
+	if err != nil {
+		die("cannot add to consistency group: %v", err)
+	}
+}
+
+func groupRemoveAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	_, err := block.RemoveFromConsistencyGroup(mds, args[0], args[1:])
+	if err == torus.ErrNotExist {
+		die("no consistency group named %s", args[0])
+	}
+	if err != nil {
+		die("cannot remove from consistency group: %v", err)
+	}
+}
+
+func groupListAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	groups, err := block.GetConsistencyGroups(mds)
+	if err != nil {
+		die("error listing consistency groups: %v", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	if outputAsCSV {
+		table.SetBorder(false)
+		table.SetColumnSeparator(",")
+	} else {
+		table.SetHeader([]string{"Group", "Volumes"})
+	}
+	for _, g := range groups {
+		table.Append([]string{
+			g.Name,
+			strings.Join(g.Volumes, " "),
+		})
+	}
+	table.Render()
+}
+
+func groupDeleteAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.DeleteConsistencyGroup(mds, args[0])
+	if err == torus.ErrNotExist {
+		die("no consistency group named %s", args[0])
+	}
+	if err != nil {
+		die("cannot delete consistency group: %v", err)
+	}
+}
+
+func groupSnapshotAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	rev, err := block.SaveGroupSnapshot(mds, args[0], args[1], groupSnapshotAnnotations)
+	if err == torus.ErrNotExist {
+		die("no consistency group named %s", args[0])
+	}
+	if err == torus.ErrExists {
+		die("a volume in group %s already has a snapshot named %s", args[0], args[1])
+	}
+	if err != nil {
+		die("cannot snapshot consistency group: %v", err)
+	}
+	if rev != 0 {
+		fmt.Printf("snapshot %s of group %s taken at revision %d\n", args[1], args[0], rev)
+	}
+}
+
+func groupDeleteSnapshotAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	deleted, err := block.DeleteGroupSnapshot(mds, args[0], args[1])
+	if err == torus.ErrNotExist {
+		die("no consistency group named %s", args[0])
+	}
+	if err != nil {
+		die("cannot delete group snapshot: %v", err)
+	}
+	if len(deleted) == 0 {
+		die("no volume in group %s has a snapshot %s taken for it", args[0], args[1])
+	}
+}
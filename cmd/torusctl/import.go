@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/internal/qcow2"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importFrom   string
+	importFormat string
+	importVerify bool
+)
+
+var volumeImportCommand = &cobra.Command{
+	Use:   "import --from=IMAGE NAME",
+	Short: "create a block volume from a raw or qcow2 disk image",
+	Long: strings.TrimSpace(`
+Create a block volume the size of a disk image and copy the image into it.
+The image may be raw or qcow2, which is recognised unless --format says
+otherwise; qcow2 images with a backing file or encryption aren't supported.
+Runs of zeroes in the image, and clusters a qcow2 image doesn't allocate,
+are skipped rather than written, so sparse images stay sparse. Afterwards the
+volume is read back and its checksum compared with the image's, unless
+--verify=false is given.
+`),
+	Run: volumeImportAction,
+}
+
+func init() {
+	volumeImportCommand.Flags().StringVar(&importFrom, "from", "", "disk image to import")
+	volumeImportCommand.Flags().StringVar(&importFormat, "format", "", "format of the image: raw or qcow2 (default: recognise it)")
+	volumeImportCommand.Flags().BoolVar(&importVerify, "verify", true, "read the volume back and compare it with the image")
+}
+
+// diskImage is the virtual disk held in an image file.
+type diskImage interface {
+	io.ReaderAt
+	Size() int64
+	// Allocated reports whether any of the n bytes from off may hold
+	// data; those which don't read as zeroes.
+	Allocated(off, n int64) (bool, error)
+}
+
+type rawImage struct {
+	*os.File
+	size int64
+}
+
+func (r rawImage) Size() int64                          { return r.size }
+func (r rawImage) Allocated(off, n int64) (bool, error) { return true, nil }
+
+// openImage reads the image in f as format, or as whichever format it's in if
+// format is empty.
+func openImage(f *os.File, format string) (diskImage, error) {
+	if format == "" {
+		head := make([]byte, 4)
+		_, err := f.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		format = "raw"
+		if qcow2.IsImage(head) {
+			format = "qcow2"
+		}
+	}
+	switch format {
+	case "raw":
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return rawImage{f, fi.Size()}, nil
+	case "qcow2":
+		return qcow2.NewReader(f)
+	}
+	return nil, fmt.Errorf("unknown image format %q", format)
+}
+
+func volumeImportAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 || importFrom == "" {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	input, err := os.Open(importFrom)
+	if err != nil {
+		die("couldn't open image: %v", err)
+	}
+	defer input.Close()
+	img, err := openImage(input, importFormat)
+	if err != nil {
+		die("couldn't read image %s: %v", importFrom, err)
+	}
+	size := img.Size()
+	if size == 0 {
+		die("image %s is empty", importFrom)
+	}
+
+	srv := mustCreateServer()
+	defer srv.Close()
+	gmd, err := srv.MDS.GlobalMetadata()
+	if err != nil {
+		die("couldn't get global metadata: %v", err)
+	}
+	err = block.CreateBlockVolume(srv.MDS, name, uint64(size))
+	if err != nil {
+		die("couldn't create block volume %s: %v", name, err)
+	}
+	vol, err := block.OpenBlockVolume(srv, name)
+	if err != nil {
+		die("couldn't open block volume %s: %v", name, err)
+	}
+	f, err := vol.OpenBlockFile()
+	if err != nil {
+		die("couldn't open block volume %s: %v", name, err)
+	}
+
+	// Copying a whole block at a time means an all-zero chunk is exactly
+	// one block that never needs to exist.
+	buf := make([]byte, gmd.BlockSize)
+	zero := make([]byte, gmd.BlockSize)
+	h := sha256.New()
+	var written, skipped int64
+	for off := int64(0); off < size; {
+		n := int64(len(buf))
+		if size-off < n {
+			n = size - off
+		}
+		alloc, err := img.Allocated(off, n)
+		if err != nil {
+			die("couldn't read image: %v", err)
+		}
+		if !alloc {
+			h.Write(zero[:n])
+			skipped += n
+			off += n
+			continue
+		}
+		_, err = img.ReadAt(buf[:n], off)
+		if err != nil && err != io.EOF {
+			die("couldn't read image: %v", err)
+		}
+		h.Write(buf[:n])
+		if bytes.Equal(buf[:n], zero[:n]) {
+			skipped += n
+		} else {
+			_, err = f.WriteAt(buf[:n], off)
+			if err != nil {
+				die("couldn't write to volume: %v", err)
+			}
+			written += n
+		}
+		off += n
+	}
+	err = f.Sync()
+	if err != nil {
+		die("couldn't sync: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		die("couldn't close: %v", err)
+	}
+	fmt.Printf("imported %s: %s written, %s of zeroes skipped\n", name,
+		humanize.IBytes(uint64(written)), humanize.IBytes(uint64(skipped)))
+	want := h.Sum(nil)
+
+	if !importVerify {
+		return
+	}
+	rf, err := vol.OpenReadOnlyBlockFile()
+	if err != nil {
+		die("couldn't reopen volume to verify: %v", err)
+	}
+	defer rf.Close()
+	h = sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(rf, 0, size))
+	if err != nil {
+		die("couldn't read volume back: %v", err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		die("verification failed: volume has sha256 %x, image has %x", got, want)
+	}
+	fmt.Printf("verified sha256 %x\n", want)
+}
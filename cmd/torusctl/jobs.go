@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+)
+
+var jobsNode string
+
+var jobsCommand = &cobra.Command{
+	Use:   "jobs",
+	Short: "watch and control a node's background jobs",
+	Long: strings.TrimSpace(`
+Show the background jobs of a storage node, such as rebalancing and snapshot
+policies, and pause, resume or trigger them. Jobs are per node; the node is
+reached over its HTTP port.
+`),
+	Run: jobsListAction,
+}
+
+var jobsPauseCommand = &cobra.Command{
+	Use:   "pause NAME",
+	Short: "stop a job, and keep it from running until resumed",
+	Run:   jobsControlAction("pause"),
+}
+
+var jobsResumeCommand = &cobra.Command{
+	Use:   "resume NAME",
+	Short: "let a paused job run again",
+	Run:   jobsControlAction("resume"),
+}
+
+var jobsTriggerCommand = &cobra.Command{
+	Use:   "trigger NAME",
+	Short: "run a job now rather than at the end of its interval",
+	Run:   jobsControlAction("trigger"),
+}
+
+func init() {
+	jobsCommand.PersistentFlags().StringVar(&jobsNode, "node", "127.0.0.1:4321", "host:port of the node's HTTP server")
+	jobsCommand.AddCommand(jobsPauseCommand)
+	jobsCommand.AddCommand(jobsResumeCommand)
+	jobsCommand.AddCommand(jobsTriggerCommand)
+}
+
+func jobsListAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/v1/jobs", jobsNode))
+	if err != nil {
+		die("couldn't reach node: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		die("couldn't list jobs: %s", resp.Status)
+	}
+	var jobs []torus.JobStatus
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+		die("couldn't read jobs: %v", err)
+	}
+	now := time.Now()
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Job", "State", "Progress", "Runs", "Last Run", "Next Run", "Last Error"})
+	for _, j := range jobs {
+		state := "idle"
+		switch {
+		case j.Paused:
+			state = "paused"
+		case j.Running:
+			state = "running"
+		}
+		progress := ""
+		if j.Total > 0 {
+			progress = fmt.Sprintf("%d/%d", j.Done, j.Total)
+		}
+		last, next := "never", ""
+		if !j.LastStart.IsZero() {
+			last = j.LastStart.Format("2006-01-02 15:04:05")
+		}
+		if !j.Paused && !j.Running {
+			next = "now"
+			if j.NextRun.After(now) {
+				next = "in " + (j.NextRun.Sub(now) / time.Second * time.Second).String()
+			}
+		}
+		table.Append([]string{
+			j.Name,
+			state,
+			progress,
+			fmt.Sprint(j.Runs),
+			last,
+			next,
+			j.LastError,
+		})
+	}
+	table.Render()
+}
+
+func jobsControlAction(op string) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		url := fmt.Sprintf("http://%s/v1/jobs/%s/%s", jobsNode, args[0], op)
+		resp, err := http.Post(url, "", nil)
+		if err != nil {
+			die("couldn't reach node: %v", err)
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNoContent, http.StatusOK:
+		case http.StatusNotFound:
+			die("no job named %q", args[0])
+		default:
+			die("couldn't %s job: %s", op, resp.Status)
+		}
+	}
+}
@@ -40,6 +40,10 @@ func listPeersAction(cmd *cobra.Command, args []string) {
 		die("couldn't get ring: %v", err)
 	}
 	members := ring.Members()
+	cordoned, err := mds.GetCordoned()
+	if err != nil {
+		die("couldn't get cordoned peers: %v", err)
+	}
 	table := tablewriter.NewWriter(os.Stdout)
 	if outputAsCSV {
 		table.SetBorder(false)
@@ -55,6 +59,9 @@ func listPeersAction(cmd *cobra.Command, args []string) {
 		}
 		if members.Has(x.UUID) {
 			ringStatus = "OK"
+			if cordoned.Has(x.UUID) {
+				ringStatus = "Cordoned"
+			}
 		}
 		table.Append([]string{
 			x.Address,
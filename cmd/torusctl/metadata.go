@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+)
+
+var metadataCommand = &cobra.Command{
+	Use:   "metadata",
+	Short: "dump and load the cluster's metadata",
+	Run:   metadataAction,
+}
+
+var metadataExportCommand = &cobra.Command{
+	Use:   "export [FILE]",
+	Short: "write all the cluster's metadata to a file",
+	Long: strings.TrimSpace(`
+Write the metadata of the cluster -- volumes, their blocksets, snapshots, the
+ring and its peers -- to FILE, or to standard output if it isn't given. It is
+all read at a single metadata revision. No block data is included.
+
+Registrations of running peers and locks on attached volumes are left out.
+`),
+	Run: metadataExportAction,
+}
+
+var metadataImportCommand = &cobra.Command{
+	Use:   "import FILE",
+	Short: "load exported metadata into an empty metadata store",
+	Long: strings.TrimSpace(`
+Load metadata written by 'metadata export' into a metadata store with no
+torus metadata in it, such as a freshly created etcd. Storage nodes that still
+hold the cluster's blocks can then be started against it.
+`),
+	Run: metadataImportAction,
+}
+
+func init() {
+	metadataCommand.AddCommand(metadataExportCommand)
+	metadataCommand.AddCommand(metadataImportCommand)
+}
+
+func metadataAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func metadataExportAction(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	var w io.Writer = os.Stdout
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			die("couldn't create %s: %v", args[0], err)
+		}
+		defer f.Close()
+		w = f
+	}
+	cfg := torus.Config{
+		MetadataAddress: etcdAddress,
+	}
+	if err := torus.ExportMDS("etcd", cfg, w); err != nil {
+		die("error exporting metadata: %v", err)
+	}
+}
+
+func metadataImportAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		die("couldn't open %s: %v", args[0], err)
+	}
+	defer f.Close()
+	cfg := torus.Config{
+		MetadataAddress: etcdAddress,
+	}
+	err = torus.ImportMDS("etcd", cfg, f)
+	if err == torus.ErrExists {
+		die("the metadata store already holds torus metadata; wipe it first")
+	}
+	if err != nil {
+		die("error importing metadata: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/torus/block"
+	"github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+)
+
+var mirrorTo string
+
+var volumeMirrorCommand = &cobra.Command{
+	Use:   "mirror",
+	Short: "manage the mirroring of volumes to another cluster",
+	Run:   volumeAction,
+}
+
+var volumeMirrorSetCommand = &cobra.Command{
+	Use:   "set NAME --to=ETCD_ADDRESS",
+	Short: "mirror a block volume to another cluster",
+	Long: strings.TrimSpace(`
+Mirror a block volume to the cluster whose etcd is at ETCD_ADDRESS. The
+torusd elected to run snapshot policies copies what has changed in the
+volume to a volume of the same name there every --mirror-interval, as of a
+snapshot it takes at the start of each copy, so the remote volume is always
+a consistent, if slightly old, copy of this one. It's created by the first
+copy, which copies everything, and mustn't be written to while the volume is
+mirrored.
+`),
+	Run: volumeMirrorSetAction,
+}
+
+var volumeMirrorClearCommand = &cobra.Command{
+	Use:   "clear NAME",
+	Short: "stop mirroring a block volume",
+	Long: strings.TrimSpace(`
+Stop mirroring a block volume, deleting the snapshots kept for it in this
+cluster. The remote volume and its last snapshot are left alone, to be
+attached or deleted there.
+`),
+	Run: volumeMirrorClearAction,
+}
+
+var volumeMirrorStatusCommand = &cobra.Command{
+	Use:   "status [NAME...]",
+	Short: "show how far behind their mirrors volumes are",
+	Run:   volumeMirrorStatusAction,
+}
+
+var volumeMirrorSyncCommand = &cobra.Command{
+	Use:   "sync NAME",
+	Short: "copy a block volume's changes to its mirror now",
+	Long: strings.TrimSpace(`
+Copy what has changed in a block volume to its mirror now, rather than
+waiting for torusd to. This is useful to seed a large mirror from a host
+close to both clusters. A copy interrupted with ^C resumes where it got to
+the next time the volume is mirrored.
+`),
+	Run: volumeMirrorSyncAction,
+}
+
+func init() {
+	volumeCommand.AddCommand(volumeMirrorCommand)
+	volumeMirrorCommand.AddCommand(volumeMirrorSetCommand)
+	volumeMirrorCommand.AddCommand(volumeMirrorClearCommand)
+	volumeMirrorCommand.AddCommand(volumeMirrorStatusCommand)
+	volumeMirrorCommand.AddCommand(volumeMirrorSyncCommand)
+	volumeMirrorSetCommand.Flags().StringVar(&mirrorTo, "to", "", "etcd address of the cluster to mirror to")
+}
+
+func volumeMirrorSetAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 || mirrorTo == "" {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	if err := block.SetMirror(mds, args[0], mirrorTo); err != nil {
+		die("couldn't mirror volume %s: %v", args[0], err)
+	}
+}
+
+func volumeMirrorClearAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	if err := block.ClearMirror(mds, args[0]); err != nil {
+		die("couldn't stop mirroring volume %s: %v", args[0], err)
+	}
+}
+
+func volumeMirrorStatusAction(cmd *cobra.Command, args []string) {
+	mds := mustConnectToMDS()
+	names := args
+	if len(names) == 0 {
+		vols, _, err := mds.GetVolumes()
+		if err != nil {
+			die("couldn't list volumes: %v", err)
+		}
+		for _, v := range vols {
+			if v.Type == block.VolumeType {
+				names = append(names, v.Name)
+			}
+		}
+		sort.Strings(names)
+	}
+	now := time.Now()
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Volume", "Target", "Synced", "Lag", "Copying", "Error"})
+	for _, name := range names {
+		m, err := block.GetMirror(mds, name)
+		if err != nil {
+			die("couldn't get mirror of volume %s: %v", name, err)
+		}
+		if m == nil {
+			if len(args) != 0 {
+				table.Append([]string{name, "not mirrored", "", "", "", ""})
+			}
+			continue
+		}
+		synced, lag := "never", ""
+		if !m.Synced.IsZero() {
+			synced = m.Synced.Local().Format("2006-01-02 15:04:05")
+			lag = (m.Lag(now) / time.Second * time.Second).String()
+		}
+		copying := ""
+		if m.Pending != "" {
+			copying = m.Pending
+			if m.Copied != 0 {
+				copying += fmt.Sprintf(" (at %s)", humanize.IBytes(m.Copied))
+			}
+		}
+		table.Append([]string{name, m.Target, synced, lag, copying, m.Error})
+	}
+	table.Render()
+}
+
+func volumeMirrorSyncAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	srv := mustCreateServer()
+	defer srv.Close()
+	m, err := block.GetMirror(srv.MDS, name)
+	if err != nil {
+		die("couldn't get mirror of volume %s: %v", name, err)
+	}
+	if m == nil {
+		die("volume %s isn't mirrored", name)
+	}
+	remote, err := createServer(m.Target)
+	if err != nil {
+		die("%s: %v", m.Target, err)
+	}
+	defer remote.Close()
+	vol, err := block.OpenBlockVolume(srv, name)
+	if err != nil {
+		die("couldn't open block volume %s: %v", name, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+	err = vol.MirrorTo(ctx, remote, func(done, total int) {
+		fmt.Printf("\r%s of %s copied", humanize.IBytes(uint64(done)), humanize.IBytes(uint64(total)))
+	})
+	fmt.Println()
+	if err == context.Canceled {
+		die("interrupted; the copy will resume from where it got to")
+	}
+	if err != nil {
+		die("couldn't mirror volume %s: %v", name, err)
+	}
+	m, err = block.GetMirror(srv.MDS, name)
+	if err == nil && m != nil {
+		fmt.Printf("mirrored %s to %s as of %s\n", name, m.Target, m.Synced.Local().Format("2006-01-02 15:04:05"))
+	}
+}
@@ -38,8 +38,21 @@ var peerRemoveCommand = &cobra.Command{
 	Run:    peerRemoveAction,
 }
 
+var peerCordonCommand = &cobra.Command{
+	Use:   "cordon UUID",
+	Short: "stop placing new blocks on a peer",
+	Run:   peerCordonAction,
+}
+
+var peerUncordonCommand = &cobra.Command{
+	Use:   "uncordon UUID",
+	Short: "resume placing new blocks on a peer, without any checks",
+	Run:   peerCordonAction,
+}
+
 func init() {
 	peerCommand.AddCommand(peerAddCommand, peerRemoveCommand, peerListCommand)
+	peerCommand.AddCommand(peerCordonCommand, peerUncordonCommand, peerRejoinCommand)
 	peerAddCommand.Flags().BoolVar(&allPeers, "all-peers", false, "add all peers")
 }
 
@@ -130,3 +143,22 @@ func peerRemoveAction(cmd *cobra.Command, args []string) {
 		die("couldn't set new ring: %v", err)
 	}
 }
+
+func peerCordonAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds = mustConnectToMDS()
+	ring, err := mds.GetRing()
+	if err != nil {
+		die("couldn't get ring: %v", err)
+	}
+	if !ring.Members().Has(args[0]) {
+		die("peer %s is not a member of the ring", args[0])
+	}
+	err = mds.SetCordoned(args[0], cmd.Name() == "cordon")
+	if err != nil {
+		die("couldn't update peer %s: %v", args[0], err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+	"github.com/spf13/cobra"
+)
+
+var rejoinSample int
+
+var peerRejoinCommand = &cobra.Command{
+	Use:   "rejoin UUID",
+	Short: "check a peer and return it to service",
+	Long: strings.TrimSpace(`
+Check a peer which has been out of service and, if it passes, uncordon it.
+
+The peer must be up and a member of the ring. Rejoining then:
+
+  1. compares a random sample of the blocks it holds with another replica,
+     and stops if any of them differ;
+  2. copies any blocks it should hold but doesn't from the other replicas;
+  3. uncordons it, so that new blocks are placed on it again.
+
+The peer is cordoned for the duration.
+`),
+	Run: peerRejoinAction,
+}
+
+func init() {
+	peerRejoinCommand.Flags().IntVar(&rejoinSample, "sample", 100, "number of blocks to compare against other replicas")
+}
+
+func peerRejoinAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	uuid := args[0]
+	srv := mustCreateServer()
+	defer srv.Close()
+
+	fmt.Printf("checking peer %s is up... ", uuid)
+	ring, err := srv.MDS.GetRing()
+	if err != nil {
+		die("couldn't get ring: %v", err)
+	}
+	if !ring.Members().Has(uuid) {
+		die("not a member of the ring")
+	}
+	peers, err := srv.MDS.GetPeers()
+	if err != nil {
+		die("couldn't get peers: %v", err)
+	}
+	if i := peers.UUIDAt(uuid); i == -1 || peers[i].Address == "" {
+		die("not running")
+	}
+	fmt.Println("ok")
+
+	cordoned, err := srv.MDS.GetCordoned()
+	if err != nil {
+		die("couldn't get cordoned peers: %v", err)
+	}
+	if !cordoned.Has(uuid) {
+		fmt.Println("cordoning peer for the duration")
+		err = srv.MDS.SetCordoned(uuid, true)
+		if err != nil {
+			die("couldn't cordon peer: %v", err)
+		}
+	}
+
+	fmt.Print("collecting block references... ")
+	refs, err := allVolumeBlockRefs(srv)
+	if err != nil {
+		die("%v", err)
+	}
+	fmt.Printf("%d blocks\n", len(refs))
+
+	fmt.Print("checking stored blocks... ")
+	check, err := distributor.CheckPeer(srv, uuid, refs, rejoinSample)
+	if err != nil {
+		die("%v", err)
+	}
+	fmt.Printf("%d of %d expected blocks present, %d sampled, %d mismatched, %d unverifiable\n",
+		check.Expected-len(check.Missing), check.Expected, check.Sampled, len(check.Mismatched), check.Unverified)
+	if len(check.Mismatched) != 0 {
+		for _, ref := range check.Mismatched {
+			fmt.Fprintf(os.Stderr, "  mismatched: %s\n", ref)
+		}
+		die("peer failed the integrity check; leaving it cordoned")
+	}
+
+	if len(check.Missing) != 0 {
+		fmt.Printf("copying %d missing blocks... ", len(check.Missing))
+		n, err := distributor.CatchUpPeer(srv, uuid, check.Missing)
+		if err != nil {
+			die("%v", err)
+		}
+		fmt.Printf("%d copied\n", n)
+		if n != len(check.Missing) {
+			die("some blocks had no replica to copy from; leaving peer cordoned")
+		}
+	}
+
+	fmt.Print("uncordoning... ")
+	err = srv.MDS.SetCordoned(uuid, false)
+	if err != nil {
+		die("%v", err)
+	}
+	fmt.Println("ok")
+}
+
+// allVolumeBlockRefs returns the blocks referenced by the current version and
+// the snapshots of every block volume.
+func allVolumeBlockRefs(srv *torus.Server) ([]torus.BlockRef, error) {
+	vols, _, err := srv.MDS.GetVolumes()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[torus.BlockRef]bool)
+	var out []torus.BlockRef
+	add := func(f *block.BlockFile) {
+		for _, ref := range f.Blocks().GetAllBlockRefs() {
+			if ref.IsZero() || seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			out = append(out, ref)
+		}
+		f.Close()
+	}
+	for _, v := range vols {
+		if v.Type != block.VolumeType {
+			continue
+		}
+		bv, err := block.OpenBlockVolume(srv, v.Name)
+		if err != nil {
+			return nil, err
+		}
+		f, err := bv.OpenReadOnlyBlockFile()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open volume %s: %v", v.Name, err)
+		}
+		add(f)
+		snaps, err := bv.GetSnapshots()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range snaps {
+			f, err := bv.OpenSnapshot(s.Name)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't open snapshot %s of volume %s: %v", s.Name, v.Name, err)
+			}
+			add(f)
+		}
+	}
+	return out, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/models"
@@ -18,6 +19,8 @@ var (
 	allUUIDs  bool
 	repFactor int
 	mds       torus.MetadataService
+
+	repairRing bool
 )
 
 var ringCommand = &cobra.Command{
@@ -45,14 +48,31 @@ var ringGetCommand = &cobra.Command{
 	Run:   ringGetAction,
 }
 
+var ringVerifyCommand = &cobra.Command{
+	Use:   "verify",
+	Short: "check the ring against the live peers, optionally repairing it",
+	Long: strings.TrimSpace(`
+Cross-check the members of the ring against the peers currently registered
+with the cluster, reporting ghost peers (ring members that are no longer
+alive) and healthy peers which are not part of the ring.
+
+With --repair, ghost peers are removed from the ring and healthy peers are
+added to it. Each change produces a new ring version, which the storage
+nodes pick up and rebalance against.
+`),
+	Run: ringVerifyAction,
+}
+
 func init() {
 	ringCommand.AddCommand(ringChangeReplicationCommand)
 	ringCommand.AddCommand(ringChangeCommand)
 	ringCommand.AddCommand(ringGetCommand)
+	ringCommand.AddCommand(ringVerifyCommand)
 	ringChangeCommand.Flags().StringSliceVar(&uuids, "uuids", []string{}, "uuids to incorporate in the ring")
 	ringChangeCommand.Flags().BoolVar(&allUUIDs, "all-peers", false, "use all peers in the ring")
 	ringChangeCommand.Flags().StringVar(&ringType, "type", "single", "type of ring to create")
 	ringChangeCommand.Flags().IntVarP(&repFactor, "replication", "r", 2, "type of ring to create")
+	ringVerifyCommand.Flags().BoolVar(&repairRing, "repair", false, "reconcile the ring with the live peers")
 }
 
 func ringAction(cmd *cobra.Command, args []string) {
@@ -190,3 +210,73 @@ func ringChangeReplicationAction(cmd *cobra.Command, args []string) {
 		die("couldn't set new ring: %v", err)
 	}
 }
+
+func ringVerifyAction(cmd *cobra.Command, args []string) {
+	if mds == nil {
+		mds = mustConnectToMDS()
+	}
+	currentRing, err := mds.GetRing()
+	if err != nil {
+		die("couldn't get ring: %v", err)
+	}
+	peers, err := mds.GetPeers()
+	if err != nil {
+		die("couldn't get peer list: %v", err)
+	}
+	var live torus.PeerInfoList
+	for _, p := range peers {
+		if p.Address == "" {
+			continue
+		}
+		live = append(live, p)
+	}
+	members := currentRing.Members()
+	ghosts := members.AndNot(live.PeerList())
+	missing := live.AndNot(members)
+
+	for _, x := range ghosts {
+		fmt.Printf("ghost peer in ring: %s\n", x)
+	}
+	for _, p := range missing {
+		fmt.Printf("healthy peer missing from ring: %s (%s)\n", p.UUID, p.Address)
+	}
+	if len(ghosts) == 0 && len(missing) == 0 {
+		fmt.Printf("ring version %d is consistent with %d live peers\n", currentRing.Version(), len(live))
+		return
+	}
+	if !repairRing {
+		fmt.Println("ring is inconsistent; run with --repair to reconcile")
+		os.Exit(1)
+	}
+
+	if len(ghosts) != 0 {
+		r, ok := currentRing.(torus.RingRemover)
+		if !ok {
+			die("current ring type cannot support removal")
+		}
+		currentRing, err = r.RemovePeers(ghosts)
+		if err != nil {
+			die("couldn't remove ghost peers from ring: %v", err)
+		}
+		err = mds.SetRing(currentRing)
+		if err != nil {
+			die("couldn't set new ring: %v", err)
+		}
+		fmt.Printf("removed %d ghost peers (ring version %d)\n", len(ghosts), currentRing.Version())
+	}
+	if len(missing) != 0 {
+		r, ok := currentRing.(torus.RingAdder)
+		if !ok {
+			die("current ring type cannot support adding")
+		}
+		currentRing, err = r.AddPeers(missing)
+		if err != nil {
+			die("couldn't add peers to ring: %v", err)
+		}
+		err = mds.SetRing(currentRing)
+		if err != nil {
+			die("couldn't set new ring: %v", err)
+		}
+		fmt.Printf("added %d peers (ring version %d)\n", len(missing), currentRing.Version())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+)
+
+var scrubNode string
+
+var scrubCommand = &cobra.Command{
+	Use:   "scrub",
+	Short: "show what a node's scrubber has found",
+	Long: strings.TrimSpace(`
+Show how many of the blocks stored on a node its scrubber has checked against
+their checksums, and how many it found corrupt and repaired from a healthy
+replica, in the latest pass and since the node started. The node is reached
+over its HTTP port; 'torusctl jobs trigger scrub' starts a pass.
+`),
+	Run: scrubAction,
+}
+
+func init() {
+	scrubCommand.Flags().StringVar(&scrubNode, "node", "127.0.0.1:4321", "host:port of the node's HTTP server")
+}
+
+func scrubAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/v1/scrub", scrubNode))
+	if err != nil {
+		die("couldn't reach node: %v", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		die("node doesn't scrub its blocks")
+	default:
+		die("couldn't get scrub status: %s", resp.Status)
+	}
+	var st torus.ScrubStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		die("couldn't read scrub status: %v", err)
+	}
+	started, finished := "never", ""
+	if !st.Start.IsZero() {
+		started = st.Start.Format("2006-01-02 15:04:05")
+		finished = "not finished"
+	}
+	if !st.Finish.IsZero() {
+		finished = (st.Finish.Sub(st.Start) / time.Second * time.Second).String()
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Pass", "Started", "Took", "Checked", "Corrupt", "Repaired"})
+	table.Append([]string{"latest", started, finished, fmt.Sprint(st.Checked), fmt.Sprint(st.Corrupt), fmt.Sprint(st.Repaired)})
+	table.Append([]string{"total", "", "", "", fmt.Sprint(st.TotalCorrupt), fmt.Sprint(st.TotalRepaired)})
+	table.Render()
+}
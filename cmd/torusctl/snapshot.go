@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+)
+
+var snapshotCommand = &cobra.Command{
+	Use:   "snapshot",
+	Short: "manage snapshots of block volumes",
+	Run:   snapshotAction,
+}
+
+var snapshotCreateCommand = &cobra.Command{
+	Use:   "create VOLUME SNAPSHOT | create --selector SELECTOR SNAPSHOT",
+	Short: "snapshot a block volume",
+	Long: strings.TrimSpace(`
+Take a snapshot named SNAPSHOT of the current state of VOLUME. Notes on why it
+was taken can be recorded with it using --annotate, which may be repeated:
+
+	torusctl snapshot create vol01 pre-upgrade --annotate reason="pre-upgrade backup" --annotate run=12345
+
+With --selector, snapshot every volume with matching labels instead:
+
+	torusctl snapshot create --selector app=db nightly --dry-run
+`),
+	Run: snapshotCreateAction,
+}
+
+var snapshotListCommand = &cobra.Command{
+	Use:   "list VOLUME",
+	Short: "list the snapshots of a block volume and their annotations",
+	Run:   snapshotListAction,
+}
+
+var snapshotDeleteCommand = &cobra.Command{
+	Use:   "delete VOLUME SNAPSHOT",
+	Short: "delete a snapshot of a block volume",
+	Run:   snapshotDeleteAction,
+}
+
+var snapshotRollbackCommand = &cobra.Command{
+	Use:   "rollback VOLUME SNAPSHOT",
+	Short: "return a block volume to a snapshot",
+	Long: strings.TrimSpace(`
+Return VOLUME to its state when SNAPSHOT was taken, discarding everything
+written to it since, in one step. The snapshot is kept.
+
+The volume must not be attached. With --force, it's rolled back anyway, and
+the host which has it attached is fenced off it: its writes fail from then on,
+and it should detach the volume, unmounting any filesystem on it first, before
+attaching it again.
+`),
+	Run: snapshotRollbackAction,
+}
+
+var (
+	snapshotAnnotations   = annotationsFlag{}
+	snapshotRollbackForce bool
+)
+
+func init() {
+	snapshotCommand.AddCommand(snapshotCreateCommand)
+	snapshotCommand.AddCommand(snapshotListCommand)
+	snapshotCommand.AddCommand(snapshotDeleteCommand)
+	snapshotCommand.AddCommand(snapshotRollbackCommand)
+	snapshotRollbackCommand.Flags().BoolVar(&snapshotRollbackForce, "force", false, "roll back even if the volume is attached")
+	volumeBulk.add(snapshotCreateCommand)
+	snapshotCreateCommand.Flags().Var(snapshotAnnotations, "annotate", "record KEY=VALUE with the snapshot (repeatable)")
+	snapshotListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+}
+
+// annotationsFlag collects repeated KEY=VALUE flags. Unlike a string slice
+// flag, values may contain commas.
+type annotationsFlag map[string]string
+
+func (a annotationsFlag) String() string {
+	var kvs []string
+	for k, v := range a {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func (a annotationsFlag) Set(s string) error {
+	k, v, err := block.ParseAnnotation(s)
+	if err != nil {
+		return err
+	}
+	a[k] = v
+	return nil
+}
+
+func (a annotationsFlag) Type() string { return "KEY=VALUE" }
+
+func snapshotAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func snapshotCreateAction(cmd *cobra.Command, args []string) {
+	if volumeBulk.selector != "" {
+		if len(args) != 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		mds := mustConnectToMDS()
+		runBulk(volumeBulk.volumes(mds, "snapshot"), func(name string) error {
+			err := block.SaveSnapshot(mds, name, args[0], snapshotAnnotations)
+			if err == torus.ErrExists {
+				return fmt.Errorf("already has a snapshot named %s", args[0])
+			}
+			return err
+		})
+		return
+	}
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.SaveSnapshot(mds, args[0], args[1], snapshotAnnotations)
+	if err == torus.ErrExists {
+		die("volume %s already has a snapshot named %s", args[0], args[1])
+	}
+	if err != nil {
+		die("cannot snapshot volume: %v", err)
+	}
+}
+
+func snapshotListAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	snaps, err := block.GetSnapshots(mds, args[0])
+	if err != nil {
+		die("cannot list snapshots: %v", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	if outputAsCSV {
+		table.SetBorder(false)
+		table.SetColumnSeparator(",")
+	} else {
+		table.SetHeader([]string{"Snapshot", "Annotations"})
+	}
+	for _, s := range snaps {
+		var keys []string
+		for k := range s.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var notes []string
+		for _, k := range keys {
+			notes = append(notes, fmt.Sprintf("%s=%s", k, s.Annotations[k]))
+		}
+		table.Append([]string{
+			s.Name,
+			strings.Join(notes, "\n"),
+		})
+	}
+	table.Render()
+}
+
+func snapshotDeleteAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.DeleteSnapshot(mds, args[0], args[1])
+	if err != nil {
+		die("cannot delete snapshot: %v", err)
+	}
+}
+
+func snapshotRollbackAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.RollbackSnapshot(mds, args[0], args[1], snapshotRollbackForce)
+	if err == torus.ErrLocked {
+		die("volume %s is attached; detach it first, or use --force", args[0])
+	}
+	if err == torus.ErrNotExist {
+		die("volume %s has no snapshot named %s", args[0], args[1])
+	}
+	if err != nil {
+		die("cannot roll back volume: %v", err)
+	}
+}
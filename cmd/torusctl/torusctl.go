@@ -37,6 +37,13 @@ func init() {
 	rootCommand.AddCommand(ringCommand)
 	rootCommand.AddCommand(peerCommand)
 	rootCommand.AddCommand(volumeCommand)
+	rootCommand.AddCommand(snapshotCommand)
+	rootCommand.AddCommand(groupCommand)
+	rootCommand.AddCommand(clusterCommand)
+	rootCommand.AddCommand(metadataCommand)
+	rootCommand.AddCommand(jobsCommand)
+	rootCommand.AddCommand(scrubCommand)
+	rootCommand.AddCommand(aoeCommand)
 	rootCommand.AddCommand(versionCommand)
 }
 
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var volumeTrashCommand = &cobra.Command{
+	Use:   "trash",
+	Short: "list the block volumes in the trash",
+	Run:   volumeTrashAction,
+}
+
+var volumeRestoreCommand = &cobra.Command{
+	Use:   "restore NAME [NEW_NAME]",
+	Short: "bring a block volume back out of the trash",
+	Long: strings.TrimSpace(`
+Bring the most recently deleted block volume called NAME back out of the
+trash, as it was when it was deleted, with its snapshots, labels and other
+settings. If a volume called NAME has been created since, restore it as
+NEW_NAME instead.
+`),
+	Run: volumeRestoreAction,
+}
+
+var volumePurgeCommand = &cobra.Command{
+	Use:   "purge NAME",
+	Short: "delete a block volume in the trash for good",
+	Run:   volumePurgeAction,
+}
+
+func init() {
+	volumeCommand.AddCommand(volumeTrashCommand)
+	volumeCommand.AddCommand(volumeRestoreCommand)
+	volumeCommand.AddCommand(volumePurgeCommand)
+	volumeTrashCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
+}
+
+func volumeTrashAction(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	trash, err := block.GetTrash(mds)
+	if err != nil {
+		die("error listing the trash: %v", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	if outputAsCSV {
+		table.SetBorder(false)
+		table.SetColumnSeparator(",")
+	} else {
+		table.SetHeader([]string{"Volume", "ID", "Size", "Deleted", "Expires"})
+	}
+	for _, t := range trash {
+		table.Append([]string{
+			t.Name,
+			strconv.FormatUint(t.ID, 10),
+			humanize.IBytes(t.Size),
+			t.Deleted.Format("2006-01-02 15:04:05"),
+			humanize.Time(t.Expires),
+		})
+	}
+	table.Render()
+}
+
+func volumeRestoreAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name, as := args[0], args[0]
+	if len(args) == 2 {
+		as = args[1]
+	}
+	mds := mustConnectToMDS()
+	err := block.RestoreBlockVolume(mds, name, as)
+	if err == torus.ErrNotExist {
+		die("no volume called %s in the trash", name)
+	}
+	if err == torus.ErrExists {
+		die("a volume called %s already exists; restore it under another name", as)
+	}
+	if err != nil {
+		die("cannot restore volume %s: %v", name, err)
+	}
+}
+
+func volumePurgeAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	err := block.PurgeBlockVolume(mds, args[0])
+	if err == torus.ErrNotExist {
+		die("no volume called %s in the trash", args[0])
+	}
+	if err != nil {
+		die("cannot purge volume %s: %v", args[0], err)
+	}
+}
@@ -1,9 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/torus"
 
 	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/scsi"
+	"github.com/coreos/torus/fs"
+	"github.com/coreos/torus/models"
 	"github.com/dustin/go-humanize"
 	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
@@ -16,9 +29,41 @@ var volumeCommand = &cobra.Command{
 }
 
 var volumeDeleteCommand = &cobra.Command{
-	Use:   "delete",
+	Use:   "delete NAME | delete --selector SELECTOR",
 	Short: "delete a volume in the cluster",
-	Run:   volumeDeleteAction,
+	Long: strings.TrimSpace(`
+Delete the named volume, or with --selector, every volume with matching
+labels. Check what a selector matches first with --dry-run:
+
+	torusctl volume delete --selector team=decommissioned --dry-run
+
+With --retain, block volumes are moved into the trash instead, where they're
+kept for that long before torusd purges them, and can be brought back with
+torusctl volume restore:
+
+	torusctl volume delete vol01 --retain 72h
+`),
+	Run: volumeDeleteAction,
+}
+
+var volumeDeleteRetain time.Duration
+
+var volumeCloneCommand = &cobra.Command{
+	Use:   "clone VOLUME@SNAPSHOT NAME",
+	Short: "create a block volume from a snapshot",
+	Long: strings.TrimSpace(`
+Create the block volume NAME as a copy-on-write clone of a snapshot of
+another, for example:
+
+	torusctl volume clone vol01@pre-upgrade vol01-test
+
+The clone shares the snapshot's blocks until it overwrites them, so it's
+created at once and takes no space to begin with. It's otherwise independent
+of the volume and snapshot it came from, which may be changed or deleted
+without affecting it. It has the same size and options as the source volume,
+and no labels.
+`),
+	Run: volumeCloneAction,
 }
 
 var volumeListCommand = &cobra.Command{
@@ -27,9 +72,256 @@ var volumeListCommand = &cobra.Command{
 	Run:   volumeListAction,
 }
 
+var volumeUsageCommand = &cobra.Command{
+	Use:   "usage [NAME...]",
+	Short: "show how much space block volumes take up",
+	Long: strings.TrimSpace(`
+Show the size of each named block volume, or of every one, against the space
+its blocks take up: those it uses now, and those only its snapshots still
+hold. Blocks are counted once, before replication. For compressed volumes,
+the space the blocks it uses now come to once compressed is shown too.
+`),
+	Run: volumeUsageAction,
+}
+
+var volumeLabelCommand = &cobra.Command{
+	Use:   "label NAME [KEY=VALUE|KEY-...] | label --selector SELECTOR KEY=VALUE|KEY-...",
+	Short: "show or change the labels of a volume",
+	Long: strings.TrimSpace(`
+With just a volume name, print its labels. Otherwise set each KEY=VALUE and
+remove each KEY- given, leaving other labels as they are:
+
+	torusctl volume label vol01 app=db tier=gold
+	torusctl volume label vol01 tier-
+
+With --selector, change the labels of every volume matching it:
+
+	torusctl volume label --selector tier=cold archived=true
+`),
+	Run: volumeLabelAction,
+}
+
+var volumeSelector string
+
+var volumeReservationCommand = &cobra.Command{
+	Use:   "reservation NAME",
+	Short: "show or break the AoE reservation of a volume",
+	Long: strings.TrimSpace(`
+Print the MAC addresses of the AoE initiators which have reserved a volume for
+their exclusive use. With --break, release the reservation whoever holds it,
+for instance after the host holding it has died.
+`),
+	Run: volumeReservationAction,
+}
+
+var volumeReservationBreak bool
+
+var volumeSCSIReservationsCommand = &cobra.Command{
+	Use:   "scsi-reservations NAME",
+	Short: "show or clear the SCSI persistent reservations of a volume",
+	Long: strings.TrimSpace(`
+Print the SCSI persistent reservation of a volume, and the keys registered by
+each initiator port, as enforced by every gateway serving it. With --clear,
+drop the reservation and every registration, for instance after a cluster has
+been torn down without releasing them.
+`),
+	Run: volumeSCSIReservationsAction,
+}
+
+var volumeSCSIReservationsClear bool
+
+var volumeMACMaskCommand = &cobra.Command{
+	Use:   "mac-mask NAME [MAC|MAC-...]",
+	Short: "show or change which AoE initiators may use a volume",
+	Long: strings.TrimSpace(`
+With just a volume name, print the MAC addresses of the AoE initiators allowed
+to use it; if there are none, any initiator may. Otherwise add each MAC and
+remove each MAC- given:
+
+	torusctl volume mac-mask vol01 52:54:00:12:34:56 52:54:00:ab:cd:ef-
+`),
+	Run: volumeMACMaskAction,
+}
+
+var volumeAoEConfigCommand = &cobra.Command{
+	Use:   "aoe-config NAME [STRING]",
+	Short: "show or set the AoE config string of a volume",
+	Long: strings.TrimSpace(`
+With just a volume name, print the config string AoE initiators have set on
+it. Otherwise replace it with STRING, or with nothing if --clear is given.
+`),
+	Run: volumeAoEConfigAction,
+}
+
+var volumeAoEConfigClear bool
+
+var volumeReplicationCommand = &cobra.Command{
+	Use:   "replication NAME [COPIES] | replication --selector SELECTOR COPIES",
+	Short: "show or set how many copies of a block volume's blocks are kept",
+	Long: strings.TrimSpace(`
+With just a volume name, print how many copies of its blocks are kept.
+Otherwise keep COPIES of them from now on, in place of the ring's replication
+factor, or follow the ring again if COPIES is 0. Blocks already written are
+copied or dropped to match by the rebalancer, which can be watched with
+torusctl jobs.
+
+With --selector, set the replication of every volume matching it:
+
+	torusctl volume replication --selector tier=gold 3
+`),
+	Run: volumeReplicationAction,
+}
+
+var volumeCompactCommand = &cobra.Command{
+	Use:   "compact NAME",
+	Short: "compact the block metadata of a volume",
+	Long:  "releases blocks of the volume which only hold zeroes; if the volume is attached, its writer does so, pausing writes while it does",
+	Run:   volumeCompactAction,
+}
+
+var volumeChecksumsCommand = &cobra.Command{
+	Use:   "checksums NAME [FILE]",
+	Short: "list the checksum of every block of a volume",
+	Long: strings.TrimSpace(`
+Write the stored checksum of every block of a volume, in the volume's checksum
+algorithm, to FILE or to standard output. A copy of the volume's data, such as
+one made by 'torusblk dump', can be checked against them without Torus: block
+N is the BLOCK_SIZE bytes at offset N*BLOCK_SIZE, with the last one padded with
+zeros. The blocks themselves aren't read.
+`),
+	Run: volumeChecksumsAction,
+}
+
+var volumeDiffCommand = &cobra.Command{
+	Use:   "diff NAME [--from SNAPSHOT] [--to SNAPSHOT]",
+	Short: "list the ranges of a volume changed since a snapshot",
+	Long: strings.TrimSpace(`
+List the ranges of a volume written or trimmed between the snapshot --from and
+the snapshot --to, for incremental backups. Without --to, the volume's
+current contents are compared; without --from, every range holding data is
+listed, for a full backup. Each line is OFFSET LENGTH followed by "data" for a
+range to copy from --to, or "zero" for one which now reads as zeroes. Ranges
+are whole blocks, except at the end of the volume. With --json, they're
+printed as a JSON array instead.
+`),
+	Run: volumeDiffAction,
+}
+
+var (
+	volumeDiffFrom string
+	volumeDiffTo   string
+	volumeDiffJSON bool
+)
+
+var volumeVerifyCommand = &cobra.Command{
+	Use:   "verify NAME --against=FILE",
+	Short: "check every block of a volume against a checksum manifest",
+	Long: strings.TrimSpace(`
+Read every block of a volume and compare it against FILE, a manifest written by
+'torusctl volume checksums' or 'torusblk dump --checksums' from the volume's
+source. Every block which differs or can't be read is listed by offset, and the
+command fails if there are any. Use it after restoring a volume, before putting
+it back into service.
+`),
+	Run: volumeVerifyAction,
+}
+
+var volumeVerifyAgainst string
+
+var volumeTuneCommand = &cobra.Command{
+	Use:   "tune NAME",
+	Short: "show or change the IO tuning of a volume",
+	Long: strings.TrimSpace(`
+Show the IO tuning of a volume, or change it with the flags. Attached volumes
+pick up changes within 30 seconds, without being reattached.
+
+--readahead is how much to fetch in the background past a sequential read.
+--write-window is how much written data may be stored in the background
+between syncs, rather than before each write returns. --iops and --bandwidth
+(per second) limit the IO of each attachment of the volume. Sizes take the
+usual suffixes; 0 turns any of them off.
+`),
+	Run: volumeTuneAction,
+}
+
+var (
+	volumeReadAhead   string
+	volumeWriteWindow string
+	volumeIOPS        string
+	volumeBandwidth   string
+)
+
+var volumeSnapshotPolicyCommand = &cobra.Command{
+	Use:   "snapshot-policy",
+	Short: "manage scheduled snapshots of a volume",
+	Run:   volumeAction,
+}
+
+var volumeSnapshotPolicySetCommand = &cobra.Command{
+	Use:   "set NAME [INTERVAL=KEEP | SCHEDULE@CRON=KEEP...]",
+	Short: "set the snapshot schedules of a volume",
+	Long: strings.TrimSpace(`
+Set the snapshot schedules of a volume, replacing any existing ones. Each
+schedule is INTERVAL=KEEP, where INTERVAL is hourly, daily, weekly or a
+duration such as 30m, and KEEP is how many of its snapshots to retain. For
+example:
+
+	torusctl volume snapshot-policy set vol01 hourly=24 daily=7
+
+A schedule may instead be a name for it and a five field cron expression,
+in UTC, for when to take its snapshots:
+
+	torusctl volume snapshot-policy set vol01 'nightly@30 2 * * 1-5=10'
+
+Snapshots are taken and pruned by the torusd elected to, and are named
+auto-SCHEDULE-TIME. Giving no schedules clears the policy.
+`),
+	Run: volumeSnapshotPolicySetAction,
+}
+
+var volumeSnapshotPolicyGetCommand = &cobra.Command{
+	Use:   "get NAME",
+	Short: "show the snapshot schedules of a volume",
+	Run:   volumeSnapshotPolicyGetAction,
+}
+
 func init() {
 	volumeCommand.AddCommand(volumeDeleteCommand)
 	volumeCommand.AddCommand(volumeListCommand)
+	volumeCommand.AddCommand(volumeCloneCommand)
+	volumeCommand.AddCommand(volumeCompactCommand)
+	volumeCommand.AddCommand(volumeUsageCommand)
+	volumeCommand.AddCommand(volumeImportCommand)
+	volumeCommand.AddCommand(volumeExportCommand)
+	volumeCommand.AddCommand(volumeLabelCommand)
+	volumeCommand.AddCommand(volumeMACMaskCommand)
+	volumeCommand.AddCommand(volumeReservationCommand)
+	volumeReservationCommand.Flags().BoolVar(&volumeReservationBreak, "break", false, "release the reservation")
+	volumeCommand.AddCommand(volumeSCSIReservationsCommand)
+	volumeSCSIReservationsCommand.Flags().BoolVar(&volumeSCSIReservationsClear, "clear", false, "drop the reservation and registrations")
+	volumeCommand.AddCommand(volumeAoEConfigCommand)
+	volumeAoEConfigCommand.Flags().BoolVar(&volumeAoEConfigClear, "clear", false, "clear the config string")
+	volumeCommand.AddCommand(volumeReplicationCommand)
+	volumeBulk.add(volumeReplicationCommand)
+	volumeBulk.add(volumeDeleteCommand)
+	volumeDeleteCommand.Flags().DurationVar(&volumeDeleteRetain, "retain", 0, "move block volumes to the trash for this long rather than deleting them now")
+	volumeBulk.add(volumeLabelCommand)
+	volumeCommand.AddCommand(volumeChecksumsCommand)
+	volumeCommand.AddCommand(volumeTuneCommand)
+	volumeCommand.AddCommand(volumeVerifyCommand)
+	volumeCommand.AddCommand(volumeDiffCommand)
+	volumeDiffCommand.Flags().StringVar(&volumeDiffFrom, "from", "", "snapshot to compare from (default: an empty volume)")
+	volumeDiffCommand.Flags().StringVar(&volumeDiffTo, "to", "", "snapshot to compare to (default: the current contents)")
+	volumeDiffCommand.Flags().BoolVar(&volumeDiffJSON, "json", false, "print the ranges as JSON")
+	volumeVerifyCommand.Flags().StringVar(&volumeVerifyAgainst, "against", "", "checksum manifest to verify against")
+	volumeTuneCommand.Flags().StringVar(&volumeReadAhead, "readahead", "0", "bytes to read ahead of sequential reads")
+	volumeTuneCommand.Flags().StringVar(&volumeWriteWindow, "write-window", "0", "bytes of writes which may be stored in the background")
+	volumeTuneCommand.Flags().StringVar(&volumeIOPS, "iops", "0", "reads and writes a second each attachment may make")
+	volumeTuneCommand.Flags().StringVar(&volumeBandwidth, "bandwidth", "0", "bytes a second each attachment may read and write")
+	volumeListCommand.Flags().StringVarP(&volumeSelector, "selector", "l", "", "only list volumes with these labels, as KEY[=VALUE][,...]")
+	volumeCommand.AddCommand(volumeSnapshotPolicyCommand)
+	volumeSnapshotPolicyCommand.AddCommand(volumeSnapshotPolicySetCommand)
+	volumeSnapshotPolicyCommand.AddCommand(volumeSnapshotPolicyGetCommand)
 	volumeListCommand.Flags().BoolVarP(&outputAsCSV, "csv", "", false, "output as csv instead")
 }
 
@@ -44,9 +336,30 @@ func volumeListAction(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 	mds := mustConnectToMDS()
-	vols, _, err := mds.GetVolumes()
-	if err != nil {
-		die("error listing volumes: %v\n", err)
+	var vols []*models.Volume
+	if volumeSelector == "" {
+		var err error
+		vols, _, err = mds.GetVolumes()
+		if err != nil {
+			die("error listing volumes: %v\n", err)
+		}
+	} else {
+		sel, err := block.ParseSelector(volumeSelector)
+		if err != nil {
+			die("%v", err)
+		}
+		names, err := block.FindVolumes(mds, sel)
+		if err != nil {
+			die("error listing volumes: %v\n", err)
+		}
+		for _, name := range names {
+			vol, err := mds.GetVolume(name)
+			if err != nil {
+				// Deleted since it was found.
+				continue
+			}
+			vols = append(vols, vol)
+		}
 	}
 	table := tablewriter.NewWriter(os.Stdout)
 	if outputAsCSV {
@@ -64,24 +377,597 @@ func volumeListAction(cmd *cobra.Command, args []string) {
 	table.Render()
 }
 
+func volumeUsageAction(cmd *cobra.Command, args []string) {
+	srv := mustCreateServer()
+	defer srv.Close()
+	names := args
+	if len(names) == 0 {
+		vols, _, err := srv.MDS.GetVolumes()
+		if err != nil {
+			die("error listing volumes: %v", err)
+		}
+		for _, v := range vols {
+			if v.Type == block.VolumeType {
+				names = append(names, v.Name)
+			}
+		}
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	if outputAsCSV {
+		table.SetBorder(false)
+		table.SetColumnSeparator(",")
+	} else {
+		table.SetHeader([]string{"Volume Name", "Size", "Allocated", "Snapshots", "Used", "Compressed", "Ratio"})
+	}
+	bytes := humanize.IBytes
+	if outputAsCSV {
+		bytes = func(n uint64) string { return strconv.FormatUint(n, 10) }
+	}
+	var total block.VolumeUsage
+	for _, name := range names {
+		vol, err := block.OpenBlockVolume(srv, name)
+		if err != nil {
+			die("cannot open volume %s: %v", name, err)
+		}
+		u, err := vol.Usage()
+		if err != nil {
+			die("cannot get usage of volume %s: %v", name, err)
+		}
+		total.Provisioned += u.Provisioned
+		total.Allocated += u.Allocated
+		total.Snapshots += u.Snapshots
+		total.Compressed += u.Compressed
+		table.Append([]string{name, bytes(u.Provisioned), bytes(u.Allocated), bytes(u.Snapshots), percentUsed(u), bytes(u.Compressed), compressionRatio(u)})
+	}
+	if !outputAsCSV && len(names) > 1 {
+		table.SetFooter([]string{"Total", bytes(total.Provisioned), bytes(total.Allocated), bytes(total.Snapshots), percentUsed(&total), bytes(total.Compressed), compressionRatio(&total)})
+	}
+	table.Render()
+}
+
+// percentUsed is how much of its size a volume has allocated.
+func percentUsed(u *block.VolumeUsage) string {
+	if u.Provisioned == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(u.Allocated)/float64(u.Provisioned))
+}
+
+// compressionRatio is how many times smaller compression has made a volume's
+// allocated blocks.
+func compressionRatio(u *block.VolumeUsage) string {
+	if u.Compressed == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fx", float64(u.Allocated)/float64(u.Compressed))
+}
+
+func volumeLabelAction(cmd *cobra.Command, args []string) {
+	if volumeBulk.selector != "" {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		mds := mustConnectToMDS()
+		names := volumeBulk.volumes(mds, "relabel")
+		runBulk(names, func(name string) error {
+			labels, err := block.GetVolumeLabels(mds, name)
+			if err != nil {
+				return err
+			}
+			if err := applyLabelChanges(labels, args); err != nil {
+				return err
+			}
+			return block.SetVolumeLabels(mds, name, labels)
+		})
+		return
+	}
+	if len(args) < 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	labels, err := block.GetVolumeLabels(mds, name)
+	if err != nil {
+		die("cannot get labels of volume %s: %v", name, err)
+	}
+	if len(args) == 1 {
+		var keys []string
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s=%s\n", k, labels[k])
+		}
+		return
+	}
+	if err := applyLabelChanges(labels, args[1:]); err != nil {
+		die("%v", err)
+	}
+	err = block.SetVolumeLabels(mds, name, labels)
+	if err != nil {
+		die("cannot set labels of volume %s: %v", name, err)
+	}
+}
+
+// applyLabelChanges sets each KEY=VALUE in changes, and removes each KEY-.
+func applyLabelChanges(labels map[string]string, changes []string) error {
+	for _, arg := range changes {
+		if strings.HasSuffix(arg, "-") && !strings.Contains(arg, "=") {
+			delete(labels, strings.TrimSuffix(arg, "-"))
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("label %q must be KEY=VALUE or KEY-", arg)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+func volumeMACMaskAction(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	mask, err := block.GetMACMask(mds, name)
+	if err != nil {
+		die("cannot get MAC mask of volume %s: %v", name, err)
+	}
+	if len(args) == 1 {
+		for _, addr := range mask {
+			fmt.Println(addr)
+		}
+		return
+	}
+	for _, arg := range args[1:] {
+		remove := strings.HasSuffix(arg, "-")
+		addr, err := net.ParseMAC(strings.TrimSuffix(arg, "-"))
+		if err != nil {
+			die("invalid MAC address %q: %v", arg, err)
+		}
+		var kept []net.HardwareAddr
+		for _, m := range mask {
+			if m.String() != addr.String() {
+				kept = append(kept, m)
+			}
+		}
+		mask = kept
+		if !remove {
+			mask = append(mask, addr)
+		}
+	}
+	err = block.SetMACMask(mds, name, mask)
+	if err != nil {
+		die("cannot set MAC mask of volume %s: %v", name, err)
+	}
+}
+
+func volumeReservationAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	if volumeReservationBreak {
+		if err := block.BreakReservation(mds, name); err != nil {
+			die("cannot break reservation of volume %s: %v", name, err)
+		}
+		return
+	}
+	holders, err := block.GetReservation(mds, name)
+	if err != nil {
+		die("cannot get reservation of volume %s: %v", name, err)
+	}
+	for _, addr := range holders {
+		fmt.Println(addr)
+	}
+}
+
+func volumeSCSIReservationsAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	if volumeSCSIReservationsClear {
+		if err := block.ClearPersistentReservations(mds, name); err != nil {
+			die("cannot clear SCSI reservations of volume %s: %v", name, err)
+		}
+		return
+	}
+	b, err := block.GetPersistentReservations(mds, name)
+	if err != nil {
+		die("cannot get SCSI reservations of volume %s: %v", name, err)
+	}
+	prs, err := scsi.ParsePersistentReservations(b)
+	if err != nil {
+		die("cannot get SCSI reservations of volume %s: %v", name, err)
+	}
+	switch {
+	case prs.Type == 0:
+		fmt.Println("Reservation: none")
+	case prs.Holder == "":
+		fmt.Printf("Reservation: %s\n", prs.Type)
+	default:
+		fmt.Printf("Reservation: %s, held by %s\n", prs.Type, prs.Holder)
+	}
+	fmt.Printf("Generation: %d\n", prs.Generation)
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Initiator Port", "Key"})
+	for _, reg := range prs.Registrations {
+		table.Append([]string{reg.Initiator, fmt.Sprintf("0x%016x", reg.Key)})
+	}
+	table.Render()
+}
+
+func volumeAoEConfigAction(cmd *cobra.Command, args []string) {
+	if len(args) < 1 || len(args) > 2 || (volumeAoEConfigClear && len(args) != 1) {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	if len(args) == 2 || volumeAoEConfigClear {
+		var config string
+		if len(args) == 2 {
+			config = args[1]
+		}
+		if err := block.SetAoEConfig(mds, name, config); err != nil {
+			die("cannot set AoE config string of volume %s: %v", name, err)
+		}
+		return
+	}
+	config, err := block.GetAoEConfig(mds, name)
+	if err != nil {
+		die("cannot get AoE config string of volume %s: %v", name, err)
+	}
+	fmt.Println(config)
+}
+
+func volumeReplicationAction(cmd *cobra.Command, args []string) {
+	if volumeBulk.selector != "" {
+		if len(args) != 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		r, err := strconv.Atoi(args[0])
+		if err != nil {
+			die("error parsing copies %s: %v", args[0], err)
+		}
+		mds := mustConnectToMDS()
+		runBulk(volumeBulk.volumes(mds, "set the replication of"), func(name string) error {
+			return block.SetReplication(mds, name, r)
+		})
+		return
+	}
+	if len(args) < 1 || len(args) > 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name := args[0]
+	mds := mustConnectToMDS()
+	if len(args) == 2 {
+		r, err := strconv.Atoi(args[1])
+		if err != nil {
+			die("error parsing copies %s: %v", args[1], err)
+		}
+		if err := block.SetReplication(mds, name, r); err != nil {
+			die("cannot set replication of volume %s: %v", name, err)
+		}
+		return
+	}
+	r, err := block.GetReplication(mds, name)
+	if err != nil {
+		die("cannot get replication of volume %s: %v", name, err)
+	}
+	if r == 0 {
+		fmt.Println("0 (the ring's replication factor)")
+		return
+	}
+	fmt.Println(r)
+}
+
 func volumeDeleteAction(cmd *cobra.Command, args []string) {
+	if volumeBulk.selector != "" {
+		if len(args) != 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		mds := mustConnectToMDS()
+		runBulk(volumeBulk.volumes(mds, "delete"), func(name string) error {
+			return deleteVolume(mds, name)
+		})
+		return
+	}
 	if len(args) != 1 {
 		cmd.Usage()
 		os.Exit(1)
 	}
 	name := args[0]
 	mds := mustConnectToMDS()
+	if err := deleteVolume(mds, name); err != nil {
+		die("cannot delete volume %s: %v", name, err)
+	}
+}
+
+func deleteVolume(mds torus.MetadataService, name string) error {
 	vol, err := mds.GetVolume(name)
 	if err != nil {
-		die("cannot get volume %s (perhaps it doesn't exist): %v", name, err)
+		return fmt.Errorf("cannot get volume (perhaps it doesn't exist): %v", err)
 	}
 	switch vol.Type {
 	case "block":
-		err = block.DeleteBlockVolume(mds, name)
+		if volumeDeleteRetain > 0 {
+			return block.TrashBlockVolume(mds, name, volumeDeleteRetain)
+		}
+		return block.DeleteBlockVolume(mds, name)
+	case fs.VolumeType:
+		if volumeDeleteRetain > 0 {
+			return fmt.Errorf("filesystem volumes can't be moved to the trash")
+		}
+		err := fs.DeleteFSVolume(mds, name)
+		if err == torus.ErrLocked {
+			return fmt.Errorf("volume is being served; stop its gateways first")
+		}
+		return err
 	default:
-		die("unknown volume type %s", vol.Type)
+		return fmt.Errorf("unknown volume type %s", vol.Type)
+	}
+}
+
+func volumeCloneAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	at := strings.LastIndex(args[0], "@")
+	if at <= 0 || at == len(args[0])-1 {
+		die("clone a snapshot given as VOLUME@SNAPSHOT")
+	}
+	source, snapshot, name := args[0][:at], args[0][at+1:], args[1]
+	srv := mustCreateServer()
+	defer srv.Close()
+	err := block.CloneVolume(srv, source, snapshot, name)
+	if err == torus.ErrExists {
+		die("volume %s already exists", name)
+	}
+	if err == torus.ErrNotExist {
+		die("volume %s or its snapshot %s doesn't exist", source, snapshot)
+	}
+	if err != nil {
+		die("cannot clone %s: %v", args[0], err)
+	}
+}
+
+func volumeCompactAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	srv := mustCreateServer()
+	defer srv.Close()
+	vol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		die("cannot open volume %s: %v", args[0], err)
+	}
+	stats, err := vol.Compact()
+	if err == torus.ErrLocked {
+		die("volume %s is attached, but its writer didn't answer; detach it before compacting", args[0])
+	}
+	if err != nil {
+		die("cannot compact volume: %v", err)
+	}
+	fmt.Printf("blocks:   %d -> %d\n", stats.BlocksBefore, stats.BlocksAfter)
+	fmt.Printf("inodes:   %d -> %d\n", stats.INodesBefore, stats.INodesAfter)
+	fmt.Printf("metadata: %s -> %s\n", humanize.IBytes(uint64(stats.MetadataBefore)), humanize.IBytes(uint64(stats.MetadataAfter)))
+}
+
+func volumeChecksumsAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	var w io.Writer = os.Stdout
+	if len(args) == 2 {
+		f, err := os.Create(args[1])
+		if err != nil {
+			die("couldn't create %s: %v", args[1], err)
+		}
+		defer f.Close()
+		w = f
+	}
+	srv := mustCreateServer()
+	defer srv.Close()
+	vol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		die("cannot open volume %s: %v", args[0], err)
+	}
+	f, err := vol.OpenReadOnlyBlockFile()
+	if err != nil {
+		die("cannot open volume %s: %v", args[0], err)
+	}
+	defer f.Close()
+	c, err := f.Checksums()
+	if err != nil {
+		die("cannot get checksums: %v", err)
+	}
+	err = c.Write(w)
+	if err != nil {
+		die("cannot write checksums: %v", err)
+	}
+}
+
+func volumeVerifyAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 || volumeVerifyAgainst == "" {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	in, err := os.Open(volumeVerifyAgainst)
+	if err != nil {
+		die("couldn't open %s: %v", volumeVerifyAgainst, err)
+	}
+	c, err := block.ReadChecksums(in)
+	in.Close()
+	if err != nil {
+		die("couldn't read checksums: %v", err)
+	}
+	srv := mustCreateServer()
+	defer srv.Close()
+	vol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		die("cannot open volume %s: %v", args[0], err)
+	}
+	f, err := vol.OpenReadOnlyBlockFile()
+	if err != nil {
+		die("cannot open volume %s: %v", args[0], err)
+	}
+	defer f.Close()
+	bad, err := f.Verify(c)
+	if err != nil {
+		die("cannot verify volume %s: %v", args[0], err)
+	}
+	for _, m := range bad {
+		if m.Err != nil {
+			fmt.Printf("offset %d (block %d): unreadable: %v\n", m.Offset, m.Block, m.Err)
+		} else {
+			fmt.Printf("offset %d (block %d): checksum mismatch\n", m.Offset, m.Block)
+		}
+	}
+	if len(bad) != 0 {
+		die("%d of %d blocks of volume %s don't match %s", len(bad), len(c.Sums), args[0], volumeVerifyAgainst)
+	}
+	fmt.Printf("all %d blocks of volume %s match\n", len(c.Sums), args[0])
+}
+
+func volumeDiffAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	srv := mustCreateServer()
+	defer srv.Close()
+	vol, err := block.OpenBlockVolume(srv, args[0])
+	if err != nil {
+		die("cannot open volume %s: %v", args[0], err)
+	}
+	extents, err := vol.ChangedExtents(volumeDiffFrom, volumeDiffTo)
+	if err == torus.ErrNotExist {
+		die("volume %s has no such snapshot", args[0])
 	}
 	if err != nil {
-		die("cannot delete volume: %v", err)
+		die("cannot compare versions of volume %s: %v", args[0], err)
+	}
+	if volumeDiffJSON {
+		if extents == nil {
+			extents = []block.Extent{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(extents); err != nil {
+			die("%v", err)
+		}
+		return
+	}
+	for _, e := range extents {
+		kind := "data"
+		if e.Zero {
+			kind = "zero"
+		}
+		fmt.Printf("%d %d %s\n", e.Offset, e.Length, kind)
+	}
+}
+
+func volumeTuneAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	t, err := block.GetVolumeTuning(mds, args[0])
+	if err != nil {
+		die("cannot get tuning of volume %s: %v", args[0], err)
+	}
+	changed := false
+	parseCount := func(s string) (uint64, error) { return strconv.ParseUint(s, 10, 64) }
+	for _, x := range []struct {
+		flag  string
+		val   string
+		to    *uint64
+		parse func(string) (uint64, error)
+	}{
+		{"readahead", volumeReadAhead, &t.ReadAhead, humanize.ParseBytes},
+		{"write-window", volumeWriteWindow, &t.WriteWindow, humanize.ParseBytes},
+		{"iops", volumeIOPS, &t.IOPS, parseCount},
+		{"bandwidth", volumeBandwidth, &t.Bandwidth, humanize.ParseBytes},
+	} {
+		if !cmd.Flags().Changed(x.flag) {
+			continue
+		}
+		*x.to, err = x.parse(x.val)
+		if err != nil {
+			die("error parsing --%s %s: %v", x.flag, x.val, err)
+		}
+		changed = true
+	}
+	if changed {
+		err = block.SetVolumeTuning(mds, args[0], t)
+		if err != nil {
+			die("cannot tune volume %s: %v", args[0], err)
+		}
+	}
+	fmt.Printf("readahead:    %s\n", humanize.IBytes(t.ReadAhead))
+	fmt.Printf("write window: %s\n", humanize.IBytes(t.WriteWindow))
+	limit := func(n uint64, f func(uint64) string) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return f(n)
+	}
+	fmt.Printf("iops:         %s\n", limit(t.IOPS, func(n uint64) string { return strconv.FormatUint(n, 10) }))
+	fmt.Printf("bandwidth:    %s\n", limit(t.Bandwidth, func(n uint64) string { return humanize.IBytes(n) + "/s" }))
+}
+
+func volumeSnapshotPolicySetAction(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	p := &block.SnapshotPolicy{}
+	for _, arg := range args[1:] {
+		s, err := block.ParseSnapshotSchedule(arg)
+		if err != nil {
+			die("%v", err)
+		}
+		p.Schedules = append(p.Schedules, s)
+	}
+	mds := mustConnectToMDS()
+	err := block.SetSnapshotPolicy(mds, args[0], p)
+	if err != nil {
+		die("cannot set snapshot policy: %v", err)
+	}
+}
+
+func volumeSnapshotPolicyGetAction(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	mds := mustConnectToMDS()
+	p, err := block.GetSnapshotPolicy(mds, args[0])
+	if err != nil {
+		die("cannot get snapshot policy: %v", err)
+	}
+	for _, s := range p.Schedules {
+		if s.Cron != "" {
+			fmt.Printf("%s\tat %q, keep %d\n", s.Name, s.Cron, s.Keep)
+			continue
+		}
+		fmt.Printf("%s\tevery %s, keep %d\n", s.Name, s.Interval, s.Keep)
 	}
 }
@@ -2,26 +2,34 @@ package main
 
 import (
 	"fmt"
+	nethttp "net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 
 	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/block/s3"
 	"github.com/coreos/torus/blockset"
 	"github.com/coreos/torus/distributor"
 	"github.com/coreos/torus/internal/http"
+	"github.com/coreos/torus/internal/metrics"
 	"github.com/coreos/torus/models"
 	"github.com/coreos/torus/ring"
 
 	// Register all the possible drivers.
-	_ "github.com/coreos/torus/block"
 	_ "github.com/coreos/torus/metadata/etcd"
 	_ "github.com/coreos/torus/metadata/temp"
 	_ "github.com/coreos/torus/storage"
+
+	// Register the garbage collector of filesystem volumes.
+	_ "github.com/coreos/torus/fs"
 )
 
 var (
@@ -31,15 +39,41 @@ var (
 	peerAddress      string
 	readCacheSize    uint64
 	readCacheSizeStr string
+	memoryLimitStr   string
+	topologyStr      string
 	sizeStr          string
 	size             uint64
+	fastDataDir      string
+	fastSizeStr      string
+	fastSize         uint64
+	tierPolicy       string
+	blockDevice      string
+	formatDevice     bool
+	storageIO        string
+	storageSync      time.Duration
+	journal          bool
+	promoteReads     int
+	demoteThreshold  float64
 	host             string
 	port             int
 	debugInit        bool
 	autojoin         bool
+	snapshotSchedule bool
+	erasureInterval  time.Duration
+	mirrorInterval   time.Duration
+	scrubInterval    time.Duration
+	scrubRate        int
+	volumeGateway    bool
+	volumeToken      string
+	s3Address        string
+	s3Credentials    string
+	concurrentJobs   int
+	metricsSink      string
+	metricsInterval  time.Duration
 	logpkg           string
 	readLevel        string
 	writeLevel       string
+	unwrittenReads   string
 	cfg              torus.Config
 
 	debug   bool
@@ -63,11 +97,36 @@ func init() {
 	rootCommand.PersistentFlags().IntVarP(&port, "port", "", 4321, "Port to listen on for HTTP")
 	rootCommand.PersistentFlags().StringVarP(&peerAddress, "peer-address", "", "", "Address to listen on for intra-cluster data")
 	rootCommand.PersistentFlags().StringVarP(&sizeStr, "size", "", "1GiB", "How much disk space to use for this storage node")
-	rootCommand.PersistentFlags().StringVarP(&readCacheSizeStr, "read-cache-size", "", "20MiB", "Amount of memory to use for read cache")
+	rootCommand.PersistentFlags().StringVarP(&fastDataDir, "fast-data-dir", "", "", "Path to a data directory on fast storage, to hold the hot blocks")
+	rootCommand.PersistentFlags().StringVarP(&fastSizeStr, "fast-size", "", "", "How much disk space to use for the fast storage tier")
+	rootCommand.PersistentFlags().StringVarP(&blockDevice, "block-device", "", "", "Path to a raw disk or partition to store blocks on in place of the data directory, using --size of it if given, or all of it")
+	rootCommand.PersistentFlags().BoolVarP(&formatDevice, "format-block-device", "", false, "Format the --block-device for Torus if it isn't already, destroying anything on it")
+	rootCommand.PersistentFlags().StringVarP(&storageIO, "storage-io", "", "mmap", "How the data directory's block files are read and written: mmap, direct (O_DIRECT, bypassing the page cache), or buffered (through the page cache, synced every --storage-sync-interval)")
+	rootCommand.PersistentFlags().DurationVarP(&storageSync, "storage-sync-interval", "", torus.DefaultStorageSyncInterval, "How often buffered block files are synced to disk")
+	rootCommand.PersistentFlags().BoolVarP(&journal, "journal", "", true, "Journal block writes, and replay the journal on starting, so that a crash can't leave torn blocks")
+	rootCommand.PersistentFlags().IntVarP(&promoteReads, "tier-promote-reads", "", 0, "Reads from the slow tier after which a block is promoted to the fast tier (0 for the default)")
+	rootCommand.PersistentFlags().Float64VarP(&demoteThreshold, "tier-demote-threshold", "", 0, "Fraction of the fast tier in use above which cold blocks are demoted (0 for the default)")
+	rootCommand.PersistentFlags().StringVarP(&tierPolicy, "tier-policy", "", "move", "How the fast tier is used: move, holding the hot blocks themselves, or holding copies of them with writes reaching the slow tier before they return (write-through) or in the background (write-back)")
+	rootCommand.PersistentFlags().StringVarP(&readCacheSizeStr, "read-cache-size", "", "20MiB", "Amount of memory to use for the cache of recently read blocks, which holds as many whole blocks as fit (0 to disable)")
+	rootCommand.PersistentFlags().StringVarP(&memoryLimitStr, "memory-limit", "", "", "Total memory the caches may use between them, shrinking under pressure (default unlimited)")
 	rootCommand.PersistentFlags().StringVarP(&logpkg, "logpkg", "", "", "Specific package logging")
 	rootCommand.PersistentFlags().StringVarP(&readLevel, "readlevel", "", "block", "Read replication level")
 	rootCommand.PersistentFlags().StringVarP(&writeLevel, "writelevel", "", "all", "Write replication level")
+	rootCommand.PersistentFlags().StringVarP(&unwrittenReads, "unwritten-reads", "", "zeros", "What reading never-written volume data over HTTP returns: zeros, or an error")
 	rootCommand.PersistentFlags().BoolVarP(&autojoin, "auto-join", "", false, "Automatically join the storage pool")
+	rootCommand.PersistentFlags().StringVarP(&topologyStr, "topology", "", "", "Where this node sits in the network, as LEVEL=VALUE[,...] with levels region, zone and rack; reads prefer the nearest replicas")
+	rootCommand.PersistentFlags().IntVarP(&concurrentJobs, "concurrent-jobs", "", torus.DefaultConcurrentJobs, "Number of background jobs, such as rebalancing and snapshot policies, to run at once")
+	rootCommand.PersistentFlags().BoolVarP(&snapshotSchedule, "snapshot-scheduler", "", true, "Stand for election to take and prune the scheduled snapshots of block volumes, and purge expired volumes from the trash")
+	rootCommand.PersistentFlags().DurationVarP(&erasureInterval, "erasure-reconstruct-interval", "", 0, "How often to rebuild the lost blocks of erasure coded block volumes, on one node of the cluster (default never)")
+	rootCommand.PersistentFlags().DurationVarP(&mirrorInterval, "mirror-interval", "", defaultMirrorInterval, "How often to copy the changes to mirrored block volumes to their target clusters, if this node is elected to run snapshot policies (0 to never)")
+	rootCommand.PersistentFlags().DurationVarP(&scrubInterval, "scrub-interval", "", torus.DefaultScrubInterval, "How often to check every block stored on this node against its checksum, repairing those which fail (0 to never)")
+	rootCommand.PersistentFlags().IntVarP(&scrubRate, "scrub-rate", "", torus.DefaultScrubRate, "Blocks per second the scrubber reads")
+	rootCommand.PersistentFlags().BoolVarP(&volumeGateway, "http-volumes", "", false, "Serve the contents of block volumes, read-only, over HTTP at /v1/volumes/NAME")
+	rootCommand.PersistentFlags().StringVarP(&volumeToken, "http-volumes-token", "", "", "Bearer token required to read volumes over HTTP")
+	rootCommand.PersistentFlags().StringVarP(&s3Address, "s3-address", "", "", "Address to serve buckets and objects on over the S3 API, such as :9000")
+	rootCommand.PersistentFlags().StringVarP(&s3Credentials, "s3-credentials", "", "", "File of ACCESS_KEY_ID SECRET_ACCESS_KEY lines, one of which S3 requests must be signed with (default no authentication)")
+	rootCommand.PersistentFlags().StringVarP(&metricsSink, "metrics-sink", "", "prometheus", "Where metrics go: prometheus, to be scraped from /metrics, or statsd://HOST:PORT to push them")
+	rootCommand.PersistentFlags().DurationVarP(&metricsInterval, "metrics-interval", "", 10*time.Second, "How often to push metrics to a push sink")
 	rootCommand.PersistentFlags().BoolVarP(&version, "version", "", false, "Print version info and exit")
 }
 
@@ -104,18 +163,62 @@ func configureServer(cmd *cobra.Command, args []string) {
 		httpAddress = fmt.Sprintf("%s:%d", host, port)
 	}
 
+	if metricsInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "metrics-interval must be positive\n")
+		os.Exit(1)
+	}
+	if scrubRate <= 0 {
+		fmt.Fprintf(os.Stderr, "scrub-rate must be positive\n")
+		os.Exit(1)
+	}
+
 	var err error
 	readCacheSize, err = humanize.ParseBytes(readCacheSizeStr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error parsing read-cache-size: %s\n", err)
 		os.Exit(1)
 	}
+	var memoryLimit uint64
+	if memoryLimitStr != "" {
+		memoryLimit, err = humanize.ParseBytes(memoryLimitStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing memory-limit: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	topology, err := torus.ParseTopology(topologyStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing topology: %s\n", err)
+		os.Exit(1)
+	}
 	size, err = humanize.ParseBytes(sizeStr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error parsing size: %s\n", err)
 		os.Exit(1)
 	}
 
+	if blockDevice != "" && !cmd.Flags().Changed("size") {
+		size = 0
+	}
+
+	if fastDataDir != "" {
+		if fastSizeStr == "" {
+			fmt.Fprintf(os.Stderr, "--fast-size is required with --fast-data-dir\n")
+			os.Exit(1)
+		}
+		fastSize, err = humanize.ParseBytes(fastSizeStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing fast-size: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	tp, err := torus.ParseTierPolicy(tierPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
 	var rl torus.ReadLevel
 	switch readLevel {
 	case "spread":
@@ -141,13 +244,43 @@ func configureServer(cmd *cobra.Command, args []string) {
 		fmt.Fprintf(os.Stderr, "invalid writelevel; use one of 'one', 'all', or 'local'")
 		os.Exit(1)
 	}
+	ur, err := torus.ParseUnwrittenReadPolicy(unwrittenReads)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	sio, err := torus.ParseStorageIOMode(storageIO)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if storageSync <= 0 {
+		fmt.Fprintf(os.Stderr, "storage-sync-interval must be positive\n")
+		os.Exit(1)
+	}
 	cfg = torus.Config{
-		DataDir:         dataDir,
-		StorageSize:     size,
-		MetadataAddress: etcdAddress,
-		ReadCacheSize:   readCacheSize,
-		WriteLevel:      wl,
-		ReadLevel:       rl,
+		DataDir:             dataDir,
+		StorageSize:         size,
+		MetadataAddress:     etcdAddress,
+		ReadCacheSize:       readCacheSize,
+		WriteLevel:          wl,
+		ReadLevel:           rl,
+		FastDataDir:         fastDataDir,
+		FastStorageSize:     fastSize,
+		BlockDevice:         blockDevice,
+		FormatBlockDevice:   formatDevice,
+		StorageIO:           sio,
+		StorageSyncInterval: storageSync,
+		Journal:             journal,
+		TierPromoteReads:    promoteReads,
+		TierDemoteThreshold: demoteThreshold,
+		TierPolicy:          tp,
+		Memory:              torus.NewMemoryBudget(memoryLimit),
+		ConcurrentJobs:      concurrentJobs,
+		Topology:            topology,
+		UnwrittenReads:      ur,
+		ScrubInterval:       scrubInterval,
+		ScrubRate:           scrubRate,
 	}
 }
 
@@ -157,9 +290,16 @@ func runServer(cmd *cobra.Command, args []string) {
 		srv *torus.Server
 		err error
 	)
+	blockStore := "mfile"
+	switch {
+	case fastDataDir != "":
+		blockStore = "tiered"
+	case blockDevice != "":
+		blockStore = "blockdev"
+	}
 	switch {
 	case etcdAddress == "":
-		srv, err = torus.NewServer(cfg, "temp", "mfile")
+		srv, err = torus.NewServer(cfg, "temp", blockStore)
 	case debugInit:
 		err = torus.InitMDS("etcd", cfg, torus.GlobalMetadata{
 			BlockSize:        512 * 1024,
@@ -176,7 +316,7 @@ func runServer(cmd *cobra.Command, args []string) {
 		}
 		fallthrough
 	default:
-		srv, err = torus.NewServer(cfg, "etcd", "mfile")
+		srv, err = torus.NewServer(cfg, "etcd", blockStore)
 	}
 	if err != nil {
 		fmt.Printf("Couldn't start: %s\n", err)
@@ -219,13 +359,93 @@ func runServer(cmd *cobra.Command, args []string) {
 		fmt.Println("couldn't use server:", err)
 		os.Exit(1)
 	}
+	if snapshotSchedule {
+		err = srv.Jobs.Register("snapshot-policy", torus.JobOptions{
+			Interval: snapshotSchedulerInterval,
+		}, func(ctx context.Context, _ func(int, int)) error {
+			return block.RunSnapshotPolicies(srv, time.Now())
+		})
+		if err != nil {
+			fmt.Println("couldn't schedule snapshot policies:", err)
+			os.Exit(1)
+		}
+	}
+	if snapshotSchedule {
+		err = srv.Jobs.Register("trash-purge", torus.JobOptions{
+			Interval: snapshotSchedulerInterval,
+		}, func(ctx context.Context, _ func(int, int)) error {
+			return block.PurgeTrash(srv, time.Now())
+		})
+		if err != nil {
+			fmt.Println("couldn't schedule purging the trash:", err)
+			os.Exit(1)
+		}
+	}
+	if snapshotSchedule && mirrorInterval > 0 {
+		err = srv.Jobs.Register("mirror", torus.JobOptions{
+			Interval: mirrorInterval,
+		}, func(ctx context.Context, progress func(int, int)) error {
+			return block.RunMirrors(ctx, srv, connectMirrorTarget, progress)
+		})
+		if err != nil {
+			fmt.Println("couldn't schedule mirroring:", err)
+			os.Exit(1)
+		}
+	}
+	if erasureInterval > 0 {
+		err = srv.Jobs.Register("erasure-reconstruct", torus.JobOptions{
+			Interval: erasureInterval,
+		}, func(ctx context.Context, progress func(int, int)) error {
+			return block.RunErasureReconstruction(ctx, srv, progress)
+		})
+		if err != nil {
+			fmt.Println("couldn't schedule erasure reconstruction:", err)
+			os.Exit(1)
+		}
+	}
+	sink, err := metrics.OpenSink(metricsSink)
+	if err != nil {
+		fmt.Println("couldn't open metrics sink:", err)
+		os.Exit(1)
+	}
+	stopMetrics := make(chan struct{})
+	defer close(stopMetrics)
+	go metrics.Run(sink, metricsInterval, stopMetrics)
+	if s3Address != "" {
+		keys, err := readS3Credentials(s3Credentials)
+		if err != nil {
+			fmt.Println("couldn't read S3 credentials:", err)
+			os.Exit(1)
+		}
+		go func() {
+			err := nethttp.ListenAndServe(s3Address, s3.NewHandler(srv, keys))
+			fmt.Println("S3 gateway stopped:", err)
+			os.Exit(1)
+		}()
+	}
 	if httpAddress != "" {
-		http.ServeHTTP(httpAddress, srv)
+		hsrv := http.NewServer(srv)
+		if volumeGateway {
+			hsrv.EnableVolumeGateway(volumeToken)
+		}
+		hsrv.Run(httpAddress)
 	}
 	// Wait
 	<-mainClose
 }
 
+func readS3Credentials(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return s3.ReadCredentials(f)
+}
+
 func doAutojoin(s *torus.Server) error {
 	for {
 		ring, err := s.MDS.GetRing()
@@ -260,3 +480,28 @@ func doAutojoin(s *torus.Server) error {
 		return err
 	}
 }
+
+// snapshotSchedulerInterval is how often torusd checks for scheduled
+// snapshots that are due.
+const snapshotSchedulerInterval = time.Minute
+
+// defaultMirrorInterval is how often mirrored volumes are copied by default.
+const defaultMirrorInterval = 5 * time.Minute
+
+// connectMirrorTarget connects to the cluster a volume is mirrored to, whose
+// etcd is at address, as a client.
+func connectMirrorTarget(address string) (*torus.Server, error) {
+	remote, err := torus.NewServer(torus.Config{
+		MetadataAddress: address,
+		ReadLevel:       torus.ReadBlock,
+		WriteLevel:      torus.WriteAll,
+	}, "etcd", "temp")
+	if err != nil {
+		return nil, err
+	}
+	if err := distributor.OpenReplication(remote); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
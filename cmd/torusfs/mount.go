@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus/fs"
+	"github.com/coreos/torus/fs/fuse"
+)
+
+var mountCommand = &cobra.Command{
+	Use:   "mount VOLUME MOUNTPOINT",
+	Short: "mount a filesystem volume with FUSE",
+	Long: strings.TrimSpace(`
+Mount a filesystem volume at MOUNTPOINT with FUSE, serving it until it's
+unmounted or torusfs is interrupted. For example:
+
+	torusfs mount vol01 /mnt/vol01
+
+Any number of hosts may mount the same volume at once. Writes to a file are
+synced when it's closed, and read by those who open it afterwards; if two
+hosts write the same file at once, the writes of the one to close it last are
+lost, and its close fails with EIO.
+
+Permissions are checked by the kernel against the owners and modes of the
+volume's files, which are shared by every host, so user and group IDs should
+match between them. Without --allow-other, only the user who mounted the
+volume may use it.
+`),
+	Run: mountAction,
+}
+
+var mountAllowOther bool
+
+func init() {
+	mountCommand.Flags().BoolVar(&mountAllowOther, "allow-other", false, "let users other than the one mounting use the volume")
+}
+
+func mountAction(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	name, dir := args[0], args[1]
+
+	srv := createServer()
+	defer srv.Close()
+
+	vol, err := fs.OpenFSVolume(srv, name)
+	if err != nil {
+		die("can't open filesystem volume %s: %s", name, err)
+	}
+	defer vol.Close()
+
+	dev, err := fuse.Mount(dir, name, mountAllowOther)
+	if err != nil {
+		die("can't mount %s: %s", dir, err)
+	}
+	defer dev.Close()
+	handle := fuse.NewServer(vol)
+	defer handle.Close()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		for _ = range signalChan {
+			fmt.Println("\nReceived an interrupt, unmounting...")
+			if err := fuse.Unmount(dir); err != nil {
+				fmt.Fprintf(os.Stderr, "can't unmount %s: %s\n", dir, err)
+			}
+		}
+	}()
+
+	fmt.Println("Mounted", name, "at", dir)
+	if err := handle.Serve(dev); err != nil {
+		fmt.Fprintf(os.Stderr, "error from fuse server: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus/fs"
+	"github.com/coreos/torus/fs/nfs"
+)
+
+var nfsCommand = &cobra.Command{
+	Use:   "nfs VOLUME [VOLUME...]",
+	Short: "serve filesystem volumes over NFSv3 [EXPERIMENTAL]",
+	Long: strings.TrimSpace(`
+Serve filesystem volumes over NFSv3. Each volume is exported as /VOLUME, and
+the MOUNT protocol is served on the same port as NFS. For example:
+
+	torusfs nfs vol01 vol02
+
+and, on a Linux host:
+
+	mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,mountproto=tcp,nolock torus-gateway:/vol01 /mnt
+
+Several gateways may serve the same volume at once. Clients are trusted to
+say who they are (AUTH_SYS) and root isn't squashed, so serve only on a
+trusted network. Locking (NLM) isn't supported.
+`),
+	Run: nfsAction,
+}
+
+var nfsListen string
+
+func init() {
+	nfsCommand.Flags().StringVar(&nfsListen, "listen", fmt.Sprintf(":%d", nfs.DefaultPort), "address to accept NFS connections on")
+}
+
+func nfsAction(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	srv := createServer()
+	defer srv.Close()
+
+	var vols []*fs.Volume
+	for _, name := range args {
+		vol, err := fs.OpenFSVolume(srv, name)
+		if err != nil {
+			die("can't open filesystem volume %s: %s", name, err)
+		}
+		defer vol.Close()
+		vols = append(vols, vol)
+	}
+
+	handle, err := nfs.NewServer(vols...)
+	if err != nil {
+		die("%s", err)
+	}
+	l, err := net.Listen("tcp", nfsListen)
+	if err != nil {
+		die("can't listen for NFS clients: %s", err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		fmt.Println("\nReceived an interrupt, disconnecting...")
+		handle.Close()
+	}()
+
+	for _, vol := range vols {
+		fmt.Println("Serving", "/"+vol.Name())
+	}
+	if err := handle.Serve(l); err != nil {
+		fmt.Fprintf(os.Stderr, "error from nfs server: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+)
+
+var volumeCommand = &cobra.Command{
+	Use:   "volume",
+	Short: "manage volumes in the cluster",
+	Run:   volumeAction,
+}
+
+var volumeCreateCommand = &cobra.Command{
+	Use:   "create NAME",
+	Short: "create a filesystem volume in the cluster",
+	Long:  "creates an empty filesystem volume named NAME, whose root directory anyone may write, like /tmp; it grows as files are written, up to the size of the cluster",
+	Run:   volumeCreateAction,
+}
+
+func init() {
+	volumeCommand.AddCommand(volumeCreateCommand)
+}
+
+func volumeAction(cmd *cobra.Command, args []string) {
+	cmd.Usage()
+	os.Exit(1)
+}
+
+func volumeCreateAction(cmd *cobra.Command, args []string) {
+	mds := mustConnectToMDS()
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	if err := fs.CreateFSVolume(mds, args[0]); err != nil {
+		die("error creating volume %s: %v", args[0], err)
+	}
+}
+
+func mustConnectToMDS() torus.MetadataService {
+	cfg := torus.Config{
+		MetadataAddress: etcdAddress,
+	}
+	mds, err := torus.CreateMetadataService("etcd", cfg)
+	if err != nil {
+		die("couldn't connect to etcd: %v", err)
+	}
+	return mds
+}
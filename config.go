@@ -1,5 +1,7 @@
 package torus
 
+import "time"
+
 type Config struct {
 	DataDir         string
 	StorageSize     uint64
@@ -7,4 +9,62 @@ type Config struct {
 	ReadCacheSize   uint64
 	ReadLevel       ReadLevel
 	WriteLevel      WriteLevel
+	// Allocator names the block allocator used to place blocks on peers.
+	// The empty string selects the default, ring-based placement.
+	Allocator string
+	// FastDataDir and FastStorageSize describe the fast tier of the
+	// "tiered" block store, which keeps the hot blocks there and the rest
+	// in DataDir or on BlockDevice.
+	FastDataDir     string
+	FastStorageSize uint64
+	// BlockDevice is the raw disk or partition the "blockdev" block store
+	// keeps its blocks on, using up to StorageSize bytes of it, or all of
+	// it if that's zero. FormatBlockDevice lets the store format a device
+	// which doesn't hold one already, destroying what's on it.
+	BlockDevice       string
+	FormatBlockDevice bool
+	// StorageIO is how the "mfile" block store does its IO, and
+	// StorageSyncInterval how often it syncs in StorageIOBuffered mode;
+	// zero selects DefaultStorageSyncInterval.
+	StorageIO           StorageIOMode
+	StorageSyncInterval time.Duration
+	// Journal puts a write-ahead journal in front of the "mfile" and
+	// "blockdev" block stores, which is replayed when they're opened, so
+	// that a crash can't leave them serving torn blocks.
+	Journal bool
+	// TierPromoteReads is the number of reads from the slow tier which
+	// promote a block to the fast tier. TierDemoteThreshold is the fraction
+	// of the fast tier in use above which the least recently used blocks
+	// are demoted. Zero values select the defaults. TierPolicy says whether
+	// the fast tier holds blocks of its own or copies, and whether writes
+	// wait for the slow tier.
+	TierPromoteReads    int
+	TierDemoteThreshold float64
+	TierPolicy          TierPolicy
+	// WriteBackpressureFill is the fraction of a peer's storage in use at
+	// which writes to it are slowed down, and WriteRejectFill the fraction
+	// at which it stops receiving new blocks. Zero values select the
+	// defaults.
+	WriteBackpressureFill float64
+	WriteRejectFill       float64
+	// Memory is the budget the caches and in-memory block stores draw on.
+	// It is shared by every copy of the Config; nil leaves them to their
+	// own size limits.
+	Memory *MemoryBudget
+	// ConcurrentJobs is the number of background jobs, such as rebalancing
+	// and snapshot policies, which may run at once. Zero selects
+	// DefaultConcurrentJobs.
+	ConcurrentJobs int
+	// Topology is where this node sits in the network. Reads prefer
+	// replicas on nearby peers.
+	Topology Topology
+	// UnwrittenReads says what reading data which was never written
+	// returns. The default is zeros.
+	UnwrittenReads UnwrittenReadPolicy
+	// ScrubInterval is the time between the scrubber's passes over the
+	// blocks stored on the node, and ScrubRate how many blocks a second it
+	// reads. The scrubber is off when the interval is zero; a zero rate
+	// selects DefaultScrubRate.
+	ScrubInterval time.Duration
+	ScrubRate     int
 }
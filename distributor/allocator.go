@@ -0,0 +1,137 @@
+package distributor
+
+import (
+	"fmt"
+
+	"github.com/coreos/torus"
+)
+
+// DefaultAllocator is the name of the allocator used when the server config
+// doesn't name one; it places blocks exactly where the ring says.
+const DefaultAllocator = "ring"
+
+// Constraints narrow down the placement decision made by an Allocator.
+type Constraints struct {
+	// Exclude lists peers which must not be chosen.
+	Exclude torus.PeerList
+	// Write is set when choosing where a new block should be stored, as
+	// opposed to finding where an existing block lives.
+	Write bool
+}
+
+// Allocator decides which peers hold a block. The returned permutation lists
+// the peers in order of preference; the first Replication of them are the
+// ones expected to store the block, the rest are fallbacks.
+type Allocator interface {
+	// ChoosePeers picks the peers for ref out of the given ring. A
+	// replication of zero means the ring's own replication factor.
+	ChoosePeers(r torus.Ring, ref torus.BlockRef, replication int, c Constraints) (torus.PeerPermutation, error)
+}
+
+// CreateAllocatorFunc is the signature of a constructor used to create
+// a registered Allocator.
+type CreateAllocatorFunc func(srv *torus.Server) (Allocator, error)
+
+var allocators map[string]CreateAllocatorFunc
+
+// RegisterAllocator is the hook used by implementations of Allocator to
+// register themselves with the distributor. It is usually called from the
+// init() of the package implementing the allocator.
+func RegisterAllocator(name string, newFunc CreateAllocatorFunc) {
+	if allocators == nil {
+		allocators = make(map[string]CreateAllocatorFunc)
+	}
+
+	if _, ok := allocators[name]; ok {
+		panic("distributor: attempted to register allocator " + name + " twice")
+	}
+
+	allocators[name] = newFunc
+}
+
+// CreateAllocator creates the allocator registered under name.
+func CreateAllocator(name string, srv *torus.Server) (Allocator, error) {
+	if name == "" {
+		name = DefaultAllocator
+	}
+	newFunc, ok := allocators[name]
+	if !ok {
+		return nil, fmt.Errorf("distributor: no allocator named %s", name)
+	}
+	return newFunc(srv)
+}
+
+func init() {
+	RegisterAllocator(DefaultAllocator, func(_ *torus.Server) (Allocator, error) {
+		return ringAllocator{}, nil
+	})
+}
+
+// ringAllocator is the stock placement: the ring's permutation, minus any
+// excluded peers.
+type ringAllocator struct{}
+
+func (ringAllocator) ChoosePeers(r torus.Ring, ref torus.BlockRef, replication int, c Constraints) (torus.PeerPermutation, error) {
+	perm, err := r.GetPeers(ref)
+	if err != nil {
+		return perm, err
+	}
+	return applyConstraints(perm, replication, c), nil
+}
+
+// applyConstraints is the common tail of most allocators: drop the excluded
+// peers, promoting fallbacks in their place, and override the replication
+// factor if requested.
+func applyConstraints(perm torus.PeerPermutation, replication int, c Constraints) torus.PeerPermutation {
+	if len(c.Exclude) != 0 {
+		perm.Peers = perm.Peers.AndNot(c.Exclude)
+	}
+	if replication != 0 {
+		perm.Replication = replication
+	}
+	if perm.Replication > len(perm.Peers) {
+		perm.Replication = len(perm.Peers)
+	}
+	return perm
+}
+
+// ChoosePeers returns the placement of ref on the given ring according to
+// the distributor's allocator. It satisfies rebalance.Ringer.
+func (d *Distributor) ChoosePeers(r torus.Ring, ref torus.BlockRef) (torus.PeerPermutation, error) {
+	return d.placement(r, ref, Constraints{})
+}
+
+// placement is where the distributor keeps ref. Most blocks go where the
+// allocator puts them, replicated as their volume's replication factor says,
+// if it has one. The shards of an erasure coded stripe are placed
+// together, by their stripe, and each is stored once, on the peer at its
+// position in the stripe's permutation, so that they're spread over as many
+// peers as there are.
+func (d *Distributor) placement(r torus.Ring, ref torus.BlockRef, c Constraints) (torus.PeerPermutation, error) {
+	_, pos, ok := ref.Shard()
+	if !ok {
+		return d.allocator.ChoosePeers(r, ref, d.srv.VolumeReplication(ref.Volume()), c)
+	}
+	// Exclusions are applied after picking the shard's peer, so that a
+	// stripe's shards keep their places when some peers are excluded.
+	perm, err := d.allocator.ChoosePeers(r, ref.StripeRef(), 0, Constraints{Write: c.Write})
+	if err != nil {
+		return perm, err
+	}
+	return shardPlacement(perm, pos, c), nil
+}
+
+// shardPlacement rotates perm so that the peer at pos comes first, with the
+// rest as its fallbacks, and stores the shard once.
+func shardPlacement(perm torus.PeerPermutation, pos int, c Constraints) torus.PeerPermutation {
+	n := len(perm.Peers)
+	if n == 0 {
+		return perm
+	}
+	peers := make(torus.PeerList, 0, n)
+	for i := 0; i < n; i++ {
+		peers = append(peers, perm.Peers[(pos+i)%n])
+	}
+	perm.Peers = peers
+	return applyConstraints(perm, 1, c)
+}
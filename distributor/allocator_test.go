@@ -0,0 +1,109 @@
+package distributor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/torus"
+)
+
+type fixedRing struct {
+	torus.Ring
+	perm torus.PeerPermutation
+}
+
+func (r fixedRing) GetPeers(torus.BlockRef) (torus.PeerPermutation, error) {
+	return torus.PeerPermutation{
+		Peers:       append(torus.PeerList(nil), r.perm.Peers...),
+		Replication: r.perm.Replication,
+	}, nil
+}
+
+func TestRingAllocator(t *testing.T) {
+	r := fixedRing{perm: torus.PeerPermutation{
+		Peers:       torus.PeerList{"a", "b", "c", "d"},
+		Replication: 2,
+	}}
+	a, err := CreateAllocator("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rep  int
+		c    Constraints
+		want torus.PeerPermutation
+	}{
+		{0, Constraints{}, torus.PeerPermutation{Peers: torus.PeerList{"a", "b", "c", "d"}, Replication: 2}},
+		{3, Constraints{}, torus.PeerPermutation{Peers: torus.PeerList{"a", "b", "c", "d"}, Replication: 3}},
+		{0, Constraints{Exclude: torus.PeerList{"a"}}, torus.PeerPermutation{Peers: torus.PeerList{"b", "c", "d"}, Replication: 2}},
+		{5, Constraints{Exclude: torus.PeerList{"b", "d"}}, torus.PeerPermutation{Peers: torus.PeerList{"a", "c"}, Replication: 2}},
+	}
+	for i, tt := range tests {
+		got, err := a.ChoosePeers(r, torus.BlockRef{}, tt.rep, tt.c)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownAllocator(t *testing.T) {
+	if _, err := CreateAllocator("no-such-allocator", nil); err == nil {
+		t.Fatal("expected an error for an unregistered allocator")
+	}
+}
+
+func TestShardPlacement(t *testing.T) {
+	perm := torus.PeerPermutation{
+		Peers:       torus.PeerList{"a", "b", "c", "d"},
+		Replication: 2,
+	}
+	tests := []struct {
+		pos  int
+		c    Constraints
+		want torus.PeerPermutation
+	}{
+		{0, Constraints{}, torus.PeerPermutation{Peers: torus.PeerList{"a", "b", "c", "d"}, Replication: 1}},
+		{2, Constraints{}, torus.PeerPermutation{Peers: torus.PeerList{"c", "d", "a", "b"}, Replication: 1}},
+		// More shards than peers wrap around.
+		{5, Constraints{}, torus.PeerPermutation{Peers: torus.PeerList{"b", "c", "d", "a"}, Replication: 1}},
+		// An excluded peer's shard falls back to the next peer along,
+		// and the others stay put.
+		{1, Constraints{Exclude: torus.PeerList{"b"}}, torus.PeerPermutation{Peers: torus.PeerList{"c", "d", "a"}, Replication: 1}},
+		{2, Constraints{Exclude: torus.PeerList{"b"}}, torus.PeerPermutation{Peers: torus.PeerList{"c", "d", "a"}, Replication: 1}},
+	}
+	for i, tt := range tests {
+		got := shardPlacement(perm, tt.pos, tt.c)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestShardRef(t *testing.T) {
+	ref := torus.BlockRef{INodeRef: torus.NewINodeRef(3, 7), Index: 9}
+	if _, _, ok := ref.Shard(); ok {
+		t.Fatal("plain block is a shard")
+	}
+	a, b := ref, ref
+	a.SetShard(42, 1)
+	b.SetShard(42, 5)
+	b.Index = 10
+	key, pos, ok := b.Shard()
+	if !ok || key != 42 || pos != 5 {
+		t.Fatalf("got shard %d at %d (%v)", key, pos, ok)
+	}
+	if a.BlockType() != torus.TypeBlock || a.Volume() != 3 {
+		t.Error("shard lost its type or volume")
+	}
+	if a.StripeRef() != b.StripeRef() {
+		t.Error("shards of a stripe are placed apart")
+	}
+	c := ref
+	c.SetShard(43, 1)
+	if a.StripeRef() == c.StripeRef() {
+		t.Error("stripes share a placement")
+	}
+}
@@ -0,0 +1,109 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+const (
+	// DefaultBackpressureFill is the fraction of a peer's storage in use at
+	// which writes placed on it start being slowed down.
+	DefaultBackpressureFill = 0.90
+	// DefaultRejectFill is the fraction of a peer's storage in use at which
+	// it stops receiving new blocks altogether.
+	DefaultRejectFill = 0.98
+
+	// maxBackpressureDelay is how long a write is held back when its target
+	// is just short of the reject threshold.
+	maxBackpressureDelay = 100 * time.Millisecond
+	// fullnessRefresh bounds how stale the view of peer usage may get. Peers
+	// report their usage with every heartbeat, so refreshing more often
+	// gains nothing.
+	fullnessRefresh = time.Second
+)
+
+// fullness tracks how full each peer's storage is, as reported by the
+// heartbeats, to push back on writes before any peer runs out of space.
+type fullness struct {
+	mut      sync.Mutex
+	srv      *torus.Server
+	slowAt   float64
+	rejectAt float64
+	updated  time.Time
+	fill     map[string]float64
+	full     torus.PeerList
+}
+
+func newFullness(srv *torus.Server) *fullness {
+	f := &fullness{
+		srv:      srv,
+		slowAt:   srv.Cfg.WriteBackpressureFill,
+		rejectAt: srv.Cfg.WriteRejectFill,
+	}
+	if f.rejectAt <= 0 || f.rejectAt > 1 {
+		f.rejectAt = DefaultRejectFill
+	}
+	if f.slowAt <= 0 || f.slowAt > f.rejectAt {
+		f.slowAt = DefaultBackpressureFill
+		if f.slowAt > f.rejectAt {
+			f.slowAt = f.rejectAt
+		}
+	}
+	return f
+}
+
+func (f *fullness) refresh() {
+	if time.Since(f.updated) < fullnessRefresh {
+		return
+	}
+	fill := make(map[string]float64)
+	var full torus.PeerList
+	for uuid, p := range f.srv.GetPeerMap() {
+		if p.TimedOut || p.TotalBlocks == 0 {
+			continue
+		}
+		used := float64(p.UsedBlocks) / float64(p.TotalBlocks)
+		fill[uuid] = used
+		if used >= f.rejectAt {
+			full = append(full, uuid)
+		}
+	}
+	if len(full) > len(f.full) {
+		clog.Warningf("peers out of space for new blocks: %v", full)
+	}
+	f.fill = fill
+	f.full = full
+	f.updated = time.Now()
+}
+
+// Full returns the peers too full to take new blocks.
+func (f *fullness) Full() torus.PeerList {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.refresh()
+	return f.full
+}
+
+// Delay returns how long a write to peers should be held back: nothing while
+// they all have room to spare, growing linearly up to maxBackpressureDelay as
+// the fullest of them approaches the reject threshold.
+func (f *fullness) Delay(peers torus.PeerList) time.Duration {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.refresh()
+	worst := 0.0
+	for _, p := range peers {
+		if f.fill[p] > worst {
+			worst = f.fill[p]
+		}
+	}
+	if worst < f.slowAt {
+		return 0
+	}
+	if worst >= f.rejectAt || f.rejectAt == f.slowAt {
+		return maxBackpressureDelay
+	}
+	return time.Duration(float64(maxBackpressureDelay) * (worst - f.slowAt) / (f.rejectAt - f.slowAt))
+}
@@ -8,11 +8,13 @@ import (
 	"github.com/coreos/torus/distributor/protocols"
 	"github.com/coreos/torus/distributor/rebalance"
 	"github.com/coreos/torus/gc"
+	"github.com/coreos/torus/internal/ratelog"
 	"github.com/coreos/pkg/capnslog"
 )
 
 var (
 	clog = capnslog.NewPackageLogger("github.com/coreos/torus", "distributor")
+	rlog = ratelog.New(clog, ratelog.DefaultInterval)
 )
 
 type Distributor struct {
@@ -22,6 +24,8 @@ type Distributor struct {
 	client    *distClient
 	rpcSrv    protocols.RPCServer
 	readCache *cache
+	allocator Allocator
+	fullness  *fullness
 
 	ring            torus.Ring
 	closed          bool
@@ -29,18 +33,25 @@ type Distributor struct {
 	ringWatcherChan chan struct{}
 	rebalancer      rebalance.Rebalancer
 	rebalancing     bool
+	divergence      divergenceHistory
+	scrub           scrubState
 }
 
 func newDistributor(srv *torus.Server, addr *url.URL) (*Distributor, error) {
 	var err error
 	d := &Distributor{
-		blocks: srv.Blocks,
-		srv:    srv,
+		blocks:   srv.Blocks,
+		srv:      srv,
+		fullness: newFullness(srv),
 	}
 	gmd, err := d.srv.MDS.GlobalMetadata()
 	if err != nil {
 		return nil, err
 	}
+	d.allocator, err = CreateAllocator(srv.Cfg.Allocator, srv)
+	if err != nil {
+		return nil, err
+	}
 	if addr != nil {
 		d.rpcSrv, err = protocols.ListenRPC(addr, d, gmd)
 		if err != nil {
@@ -48,11 +59,14 @@ func newDistributor(srv *torus.Server, addr *url.URL) (*Distributor, error) {
 		}
 	}
 	if srv.Cfg.ReadCacheSize != 0 {
+		// The cache holds as many whole blocks as fit in its size, and
+		// at least one.
 		size := srv.Cfg.ReadCacheSize / gmd.BlockSize
-		if size < 100 {
-			size = 100
+		if size < 1 {
+			size = 1
 		}
-		d.readCache = newCache(int(size))
+		d.readCache = newCache(int(size), srv.Cfg.Memory, "read-cache")
+		d.readCache.gauge = promDistBlockCacheBytes
 	}
 
 	// Set up the rebalancer
@@ -66,7 +80,29 @@ func newDistributor(srv *torus.Server, addr *url.URL) (*Distributor, error) {
 	g := gc.NewGCController(d.srv, torus.NewINodeStore(d))
 	d.rebalancer = rebalance.NewRebalancer(d, d.blocks, d.client, g)
 	d.rebalancerChan = make(chan struct{})
-	go d.rebalanceTicker(d.rebalancerChan)
+	err = d.srv.Jobs.Register("rebalance", torus.JobOptions{
+		Interval: rebalanceInterval,
+		Priority: 1,
+	}, d.rebalanceCycle)
+	if err != nil {
+		return nil, err
+	}
+	err = d.srv.Jobs.Register("divergence", torus.JobOptions{
+		Interval: divergenceInterval,
+		Priority: 2,
+	}, d.divergenceCycle)
+	if err != nil {
+		return nil, err
+	}
+	if srv.Cfg.ScrubInterval > 0 {
+		err = d.srv.Jobs.Register("scrub", torus.JobOptions{
+			Interval: srv.Cfg.ScrubInterval,
+			Priority: 3,
+		}, d.scrubCycle)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return d, nil
 }
 
@@ -86,6 +122,8 @@ func (d *Distributor) Close() error {
 	if d.closed {
 		return nil
 	}
+	d.srv.Jobs.Unregister("rebalance")
+	d.srv.Jobs.Unregister("divergence")
 	close(d.rebalancerChan)
 	close(d.ringWatcherChan)
 	if d.rpcSrv != nil {
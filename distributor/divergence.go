@@ -0,0 +1,161 @@
+package distributor
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+const (
+	// divergenceInterval is the pause between one comparison of replicas
+	// and the next.
+	divergenceInterval = 10 * time.Minute
+	// divergenceSample is the number of local blocks compared against
+	// their other replicas each time.
+	divergenceSample = 32
+	// divergenceCycles is the number of recent comparisons whose blocks
+	// the divergence ratio is taken over.
+	divergenceCycles = 6
+	// divergenceWarnRatio is the fraction of compared blocks which may
+	// diverge before the comparison job reports an error.
+	divergenceWarnRatio = 0.01
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// divergenceHistory counts the blocks compared and found diverged in each of
+// the recent runs of the divergence job.
+type divergenceHistory struct {
+	compared [divergenceCycles]int
+	diverged [divergenceCycles]int
+	next     int
+}
+
+// add records a run and returns the totals over the recent runs.
+func (h *divergenceHistory) add(compared, diverged int) (int, int) {
+	h.compared[h.next] = compared
+	h.diverged[h.next] = diverged
+	h.next = (h.next + 1) % divergenceCycles
+	var c, d int
+	for i := range h.compared {
+		c += h.compared[i]
+		d += h.diverged[i]
+	}
+	return c, d
+}
+
+// divergenceCycle compares a random sample of the blocks stored here against
+// the other replicas of each, logging any whose contents differ. It is run as
+// the "divergence" job by the server's job scheduler, and fails when too many
+// of the recently compared blocks have diverged, as replicas of a block are
+// never legitimately different.
+func (d *Distributor) divergenceCycle(ctx context.Context, progress func(done, total int)) error {
+	refs, err := sampleBlocks(d.blocks.BlockIterator(), divergenceSample)
+	if err != nil {
+		return err
+	}
+	compared, diverged := 0, 0
+	for i, ref := range refs {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		progress(i, len(refs))
+		ok, differs := d.compareReplicas(ctx, ref)
+		if ok {
+			compared++
+		}
+		if differs {
+			diverged++
+		}
+	}
+	progress(len(refs), len(refs))
+
+	c, n := d.divergence.add(compared, diverged)
+	if c == 0 {
+		return nil
+	}
+	ratio := float64(n) / float64(c)
+	promDistReplicaDivergenceRatio.Set(ratio)
+	if ratio > divergenceWarnRatio {
+		clog.Warningf("%d of the last %d blocks compared differ between replicas", n, c)
+		return fmt.Errorf("%d of the last %d blocks compared differ between replicas", n, c)
+	}
+	return nil
+}
+
+// compareReplicas compares the local copy of ref against the copies on the
+// other peers it belongs on. It returns whether any copy could be compared,
+// and whether any differed.
+func (d *Distributor) compareReplicas(ctx context.Context, ref torus.BlockRef) (bool, bool) {
+	d.mut.RLock()
+	perm, err := d.placement(d.ring, ref, Constraints{})
+	d.mut.RUnlock()
+	if err != nil {
+		return false, false
+	}
+	owners := perm.Peers[:perm.Replication]
+	if !owners.Has(d.UUID()) {
+		// Left over from an earlier ring; the rebalancer deals with it.
+		return false, false
+	}
+	data, err := d.blocks.GetBlock(ctx, ref)
+	if err != nil {
+		return false, false
+	}
+	mine := crc32.Checksum(data, crcTable)
+	compared := false
+	var differ []string
+	for _, p := range owners {
+		if p == d.UUID() {
+			continue
+		}
+		theirs, err := d.client.GetBlock(ctx, p, ref)
+		if err != nil {
+			// Missing or unreachable replicas are for the rebalancer
+			// and the peer checks to find.
+			continue
+		}
+		compared = true
+		if sum := crc32.Checksum(theirs, crcTable); sum != mine {
+			differ = append(differ, fmt.Sprintf("%08x on %s", sum, p))
+		}
+	}
+	if compared {
+		promDistReplicaComparisons.Inc()
+	}
+	if len(differ) == 0 {
+		return compared, false
+	}
+	promDistReplicaDivergences.Inc()
+	clog.Errorf("replicas of block %s diverge: %08x on %s, but %s", ref, mine, d.UUID(), strings.Join(differ, ", "))
+	return true, true
+}
+
+// sampleBlocks returns up to n of the blocks of it, chosen at random, and
+// closes it.
+func sampleBlocks(it torus.BlockIterator, n int) ([]torus.BlockRef, error) {
+	defer it.Close()
+	var out []torus.BlockRef
+	seen := 0
+	for it.Next() {
+		ref := it.BlockRef()
+		if ref.IsZero() {
+			continue
+		}
+		seen++
+		if len(out) < n {
+			out = append(out, ref)
+		} else if i := rand.Intn(seen); i < n {
+			out[i] = ref
+		}
+	}
+	return out, it.Err()
+}
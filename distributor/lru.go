@@ -3,6 +3,9 @@ package distributor
 import (
 	"container/list"
 	"sync"
+
+	"github.com/coreos/torus"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // cache implements an LRU cache.
@@ -11,6 +14,13 @@ type cache struct {
 	priority *list.List
 	maxSize  int
 	mut      sync.Mutex
+	// memory accounts for the values, if they are byte slices, against the
+	// memory budget.
+	memory *torus.MemoryAccount
+	// bytes is the size of the values held, and gauge, if set, reports
+	// it.
+	bytes uint64
+	gauge prometheus.Gauge
 }
 
 type kv struct {
@@ -18,28 +28,56 @@ type kv struct {
 	value interface{}
 }
 
-func newCache(size int) *cache {
+func newCache(size int, budget *torus.MemoryBudget, name string) *cache {
 	var lru cache
 	lru.maxSize = size
 	lru.priority = list.New()
 	lru.cache = make(map[string]*list.Element)
+	lru.memory = budget.Account(name, lru.shrink)
 	return &lru
 }
 
+func sizeOf(v interface{}) uint64 {
+	if b, ok := v.([]byte); ok {
+		return uint64(len(b))
+	}
+	return 0
+}
+
 func (lru *cache) Put(key string, value interface{}) {
 	if lru == nil {
 		return
 	}
+	n := sizeOf(value)
+	if !lru.memory.Reserve(n) {
+		return
+	}
 	lru.mut.Lock()
 	defer lru.mut.Unlock()
 	if _, ok := lru.get(key); ok {
+		lru.memory.Release(n)
 		return
 	}
 	if len(lru.cache) == lru.maxSize {
-		lru.removeOldest()
+		lru.memory.Release(lru.removeOldest())
 	}
 	lru.priority.PushFront(kv{key: key, value: value})
 	lru.cache[key] = lru.priority.Front()
+	lru.bytes += n
+	lru.report()
+}
+
+// shrink evicts the oldest entries until n bytes are freed or the cache is
+// empty, for the memory budget.
+func (lru *cache) shrink(n uint64) uint64 {
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	var freed uint64
+	for freed < n && lru.priority.Len() != 0 {
+		freed += lru.removeOldest()
+	}
+	lru.report()
+	return freed
 }
 
 func (lru *cache) Get(key string) (interface{}, bool) {
@@ -59,7 +97,16 @@ func (lru *cache) get(key string) (interface{}, bool) {
 	return nil, false
 }
 
-func (lru *cache) removeOldest() {
-	last := lru.priority.Remove(lru.priority.Back())
-	delete(lru.cache, last.(kv).key)
+func (lru *cache) removeOldest() uint64 {
+	last := lru.priority.Remove(lru.priority.Back()).(kv)
+	delete(lru.cache, last.key)
+	n := sizeOf(last.value)
+	lru.bytes -= n
+	return n
+}
+
+func (lru *cache) report() {
+	if lru.gauge != nil {
+		lru.gauge.Set(float64(lru.bytes))
+	}
 }
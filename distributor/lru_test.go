@@ -0,0 +1,55 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/coreos/torus"
+)
+
+func TestCacheMemoryBudget(t *testing.T) {
+	budget := torus.NewMemoryBudget(3 * 1024)
+	c := newCache(100, budget, "read-cache")
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, make([]byte, 1024))
+	}
+	if used := budget.Used()["read-cache"]; used != 3*1024 {
+		t.Fatalf("expected 3KiB used by the cache, got %d", used)
+	}
+
+	// Memory that can't be given back pushes out the oldest entries.
+	other := budget.Account("other", nil)
+	other.Charge(1024)
+	if _, ok := c.Get("a"); ok {
+		t.Error("oldest entry survived the budget shrinking")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Error("newest entry was evicted")
+	}
+
+	other.Charge(2 * 1024)
+	c.Put("d", make([]byte, 1024))
+	if _, ok := c.Get("d"); ok {
+		t.Error("cached an entry with the budget exhausted")
+	}
+	if used := budget.Used()["read-cache"]; used != 0 {
+		t.Fatalf("expected the cache to have given back everything, has %d", used)
+	}
+}
+
+func TestCacheSizeLimit(t *testing.T) {
+	c := newCache(2, nil, "read-cache")
+	for _, k := range []string{"a", "b", "c"} {
+		c.Put(k, make([]byte, 1024))
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("least recently used entry wasn't evicted")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("entry %s was evicted", k)
+		}
+	}
+	if c.bytes != 2*1024 {
+		t.Fatalf("expected the cache to hold 2KiB, has %d", c.bytes)
+	}
+}
@@ -12,6 +12,14 @@ var (
 		Name: "torus_distributor_block_cached_blocks",
 		Help: "Number of blocks returned from read cache of the distributor layer",
 	})
+	promDistBlockCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_block_cache_misses",
+		Help: "Number of blocks requested of the distributor layer which weren't in its read cache",
+	})
+	promDistBlockCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_block_cache_bytes",
+		Help: "Size of the blocks held in the read cache of the distributor layer",
+	})
 	promDistBlockLocalHits = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_distributor_block_local_blocks",
 		Help: "Number of blocks returned from local storage",
@@ -28,10 +36,51 @@ var (
 		Name: "torus_distributor_block_peer_block_fails",
 		Help: "Number of failures incurred in retrieving a block from a peer",
 	}, []string{"peer"})
+	promDistBlockChecksumFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_block_checksum_failures_total",
+		Help: "Number of blocks read from a peer, or from local storage, which failed their checksum",
+	}, []string{"peer"})
+	promDistBlockLocality = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_distributor_block_reads_by_locality",
+		Help: "Number of blocks read from this node or a peer in the same zone (local) or from another zone (remote)",
+	}, []string{"locality"})
 	promDistBlockFailures = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_distributor_block_request_failures",
 		Help: "Number of failed block requests",
 	})
+	promDistWriteBackpressure = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "torus_distributor_write_backpressure_seconds",
+		Help:    "Histogram of delays added to block writes because their target peers are nearly full",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 8),
+	})
+	promDistWritesRejectedFull = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_writes_rejected_full",
+		Help: "Number of block writes rejected because every eligible peer is full",
+	})
+	promDistReplicaComparisons = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_replica_comparisons_total",
+		Help: "Number of sampled blocks compared against their other replicas",
+	})
+	promDistReplicaDivergences = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_replica_divergences_total",
+		Help: "Number of sampled blocks whose replicas had different contents",
+	})
+	promDistReplicaDivergenceRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_distributor_replica_divergence_ratio",
+		Help: "Fraction of the blocks compared in the last hour whose replicas had different contents",
+	})
+	promDistScrubBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_scrub_blocks_total",
+		Help: "Number of stored blocks the scrubber has checked against their checksums",
+	})
+	promDistScrubCorrupt = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_scrub_corrupt_blocks_total",
+		Help: "Number of stored blocks the scrubber found failing their checksums",
+	})
+	promDistScrubRepaired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "torus_distributor_scrub_repaired_blocks_total",
+		Help: "Number of corrupt blocks the scrubber rewrote from a healthy replica",
+	})
 	// RPCs
 	promDistPutBlockRPCs = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "torus_distributor_put_block_rpcs_total",
@@ -63,11 +112,23 @@ func init() {
 	// Block
 	prometheus.MustRegister(promDistBlockRequests)
 	prometheus.MustRegister(promDistBlockCacheHits)
+	prometheus.MustRegister(promDistBlockCacheMisses)
+	prometheus.MustRegister(promDistBlockCacheBytes)
 	prometheus.MustRegister(promDistBlockLocalHits)
 	prometheus.MustRegister(promDistBlockLocalFailures)
 	prometheus.MustRegister(promDistBlockPeerHits)
 	prometheus.MustRegister(promDistBlockPeerFailures)
+	prometheus.MustRegister(promDistBlockChecksumFailures)
+	prometheus.MustRegister(promDistBlockLocality)
 	prometheus.MustRegister(promDistBlockFailures)
+	prometheus.MustRegister(promDistWriteBackpressure)
+	prometheus.MustRegister(promDistWritesRejectedFull)
+	prometheus.MustRegister(promDistReplicaComparisons)
+	prometheus.MustRegister(promDistReplicaDivergences)
+	prometheus.MustRegister(promDistReplicaDivergenceRatio)
+	prometheus.MustRegister(promDistScrubBlocks)
+	prometheus.MustRegister(promDistScrubCorrupt)
+	prometheus.MustRegister(promDistScrubRepaired)
 	// RPC
 	prometheus.MustRegister(promDistPutBlockRPCs)
 	prometheus.MustRegister(promDistPutBlockRPCFailures)
@@ -0,0 +1,160 @@
+package distributor
+
+import (
+	"bytes"
+	"math/rand"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+// checkBatch is the number of refs asked about in a single RebalanceCheck.
+const checkBatch = 100
+
+// PeerCheck is the result of checking the blocks a peer should hold.
+type PeerCheck struct {
+	// Expected is the number of the given blocks which belong on the peer.
+	Expected int
+	// Missing lists the blocks which belong on the peer but which it
+	// doesn't have.
+	Missing []torus.BlockRef
+	// Sampled is the number of blocks which were read back from the peer
+	// and compared against another replica.
+	Sampled int
+	// Mismatched lists the sampled blocks whose contents differ from the
+	// other replica.
+	Mismatched []torus.BlockRef
+	// Unverified counts the sampled blocks which couldn't be read from any
+	// other replica to compare against.
+	Unverified int
+}
+
+func distributorOf(srv *torus.Server) (*Distributor, error) {
+	d, ok := srv.Blocks.(*Distributor)
+	if !ok {
+		return nil, torus.ErrNotSupported
+	}
+	return d, nil
+}
+
+// CheckPeer checks which of refs belong on the peer uuid, whether the peer
+// has them, and for a random sample of up to sample of them, whether the
+// peer's copy is identical to that held by another replica.
+func CheckPeer(srv *torus.Server, uuid string, refs []torus.BlockRef, sample int) (*PeerCheck, error) {
+	d, err := distributorOf(srv)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.TODO()
+	out := &PeerCheck{}
+	var mine []torus.BlockRef
+	others := make(map[torus.BlockRef]torus.PeerList)
+	d.mut.RLock()
+	for _, ref := range refs {
+		if ref.IsZero() {
+			continue
+		}
+		perm, err := d.placement(d.ring, ref, Constraints{})
+		if err != nil {
+			d.mut.RUnlock()
+			return nil, err
+		}
+		owners := perm.Peers[:perm.Replication]
+		if !owners.Has(uuid) {
+			continue
+		}
+		mine = append(mine, ref)
+		others[ref] = owners.AndNot(torus.PeerList{uuid})
+	}
+	d.mut.RUnlock()
+	out.Expected = len(mine)
+
+	var present []torus.BlockRef
+	for i := 0; i < len(mine); i += checkBatch {
+		end := i + checkBatch
+		if end > len(mine) {
+			end = len(mine)
+		}
+		ok, err := d.client.Check(ctx, uuid, mine[i:end])
+		if err != nil {
+			return nil, err
+		}
+		for j, has := range ok {
+			if has {
+				present = append(present, mine[i+j])
+			} else {
+				out.Missing = append(out.Missing, mine[i+j])
+			}
+		}
+	}
+
+	for _, idx := range rand.Perm(len(present)) {
+		if out.Sampled == sample {
+			break
+		}
+		ref := present[idx]
+		data, err := d.client.GetBlock(ctx, uuid, ref)
+		if err != nil {
+			return nil, err
+		}
+		out.Sampled++
+		verified := false
+		for _, p := range others[ref] {
+			theirs, err := d.client.GetBlock(ctx, p, ref)
+			if err != nil {
+				continue
+			}
+			if !bytes.Equal(data, theirs) {
+				clog.Errorf("block %s on peer %s differs from the copy on %s", ref, uuid, p)
+				out.Mismatched = append(out.Mismatched, ref)
+			}
+			verified = true
+			break
+		}
+		if !verified {
+			out.Unverified++
+		}
+	}
+	return out, nil
+}
+
+// CatchUpPeer copies each of refs to the peer uuid from another replica. It
+// returns the number of blocks copied; blocks which no other peer could
+// provide are skipped.
+func CatchUpPeer(srv *torus.Server, uuid string, refs []torus.BlockRef) (int, error) {
+	d, err := distributorOf(srv)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.TODO()
+	copied := 0
+	for _, ref := range refs {
+		d.mut.RLock()
+		perm, err := d.placement(d.ring, ref, Constraints{})
+		d.mut.RUnlock()
+		if err != nil {
+			return copied, err
+		}
+		var data []byte
+		for _, p := range perm.Peers {
+			if p == uuid {
+				continue
+			}
+			data, err = d.client.GetBlock(ctx, p, ref)
+			if err == nil {
+				break
+			}
+		}
+		if data == nil {
+			clog.Warningf("no replica of block %s available to copy to %s", ref, uuid)
+			continue
+		}
+		err = d.client.PutBlock(ctx, uuid, ref, data)
+		if err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
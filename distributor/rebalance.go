@@ -2,9 +2,10 @@ package distributor
 
 import (
 	"io"
-	"math/rand"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/models"
 )
@@ -40,60 +41,60 @@ exit:
 	}
 }
 
-func (d *Distributor) rebalanceTicker(closer chan struct{}) {
+// rebalanceInterval is the pause between one rebalance and GC cycle and the
+// next.
+const rebalanceInterval = 2 * time.Second
+
+// rebalanceCycle makes one rebalance and GC pass. It is run as the
+// "rebalance" job by the server's job scheduler.
+func (d *Distributor) rebalanceCycle(ctx context.Context, progress func(done, total int)) error {
+	clog.Tracef("starting rebalance/gc cycle")
+	defer d.rebalancer.Reset()
+	volset, _, err := d.srv.MDS.GetVolumes()
+	if err != nil {
+		clog.Error(err)
+	}
+	for _, x := range volset {
+		err := d.rebalancer.PrepVolume(x)
+		if err != nil {
+			clog.Errorf("gc prep failed: %s", err)
+		}
+	}
 	n := 0
 	total := 0
-	time.Sleep(time.Duration(250+rand.Intn(250)) * time.Millisecond)
-exit:
 	for {
-		clog.Tracef("starting rebalance/gc cycle")
-		volset, _, err := d.srv.MDS.GetVolumes()
-		if err != nil {
-			clog.Error(err)
+		timeout := 2 * time.Duration(n+1) * time.Millisecond
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(timeout):
 		}
-		for _, x := range volset {
-			err := d.rebalancer.PrepVolume(x)
-			if err != nil {
-				clog.Errorf("gc prep failed: %s", err)
-			}
+		written, err := d.rebalancer.Tick()
+		if d.ring.Version() != d.rebalancer.VersionStart() {
+			// Something is changed -- we are now rebalancing
+			d.rebalancing = true
 		}
-	ratelimit:
-		for {
-			timeout := 2 * time.Duration(n+1) * time.Millisecond
-			select {
-			case <-closer:
-				break exit
-			case <-time.After(timeout):
-				written, err := d.rebalancer.Tick()
-				if d.ring.Version() != d.rebalancer.VersionStart() {
-					// Something is changed -- we are now rebalancing
-					d.rebalancing = true
-				}
-				info := &models.RebalanceInfo{
-					Rebalancing: d.rebalancing,
-				}
-				total += written
-				info.LastRebalanceBlocks = uint64(total)
-				if err == io.EOF {
-					// Good job, sleep well, I'll most likely rebalance you in the morning.
-					info.LastRebalanceFinish = time.Now().UnixNano()
-					total = 0
-					finishver := d.rebalancer.VersionStart()
-					if finishver == d.ring.Version() {
-						d.rebalancing = false
-						info.Rebalancing = false
-					}
-					d.srv.UpdateRebalanceInfo(info)
-					break ratelimit
-				} else if err != nil {
-					// This is usually really bad
-					clog.Error(err)
-				}
-				n = written
-				d.srv.UpdateRebalanceInfo(info)
+		info := &models.RebalanceInfo{
+			Rebalancing: d.rebalancing,
+		}
+		total += written
+		progress(total, 0)
+		info.LastRebalanceBlocks = uint64(total)
+		if err == io.EOF {
+			// Good job, sleep well, I'll most likely rebalance you in the morning.
+			info.LastRebalanceFinish = time.Now().UnixNano()
+			finishver := d.rebalancer.VersionStart()
+			if finishver == d.ring.Version() {
+				d.rebalancing = false
+				info.Rebalancing = false
 			}
+			d.srv.UpdateRebalanceInfo(info)
+			return nil
+		} else if err != nil {
+			// This is usually really bad
+			clog.Error(err)
 		}
-		time.Sleep(time.Duration(rand.Intn(3)) * time.Second)
-		d.rebalancer.Reset()
+		n = written
+		d.srv.UpdateRebalanceInfo(info)
 	}
 }
@@ -13,6 +13,8 @@ var clog = capnslog.NewPackageLogger("github.com/coreos/torus", "rebalance")
 type Ringer interface {
 	Ring() torus.Ring
 	UUID() string
+	// ChoosePeers returns where ref belongs on the given ring.
+	ChoosePeers(torus.Ring, torus.BlockRef) (torus.PeerPermutation, error)
 }
 
 type Rebalancer interface {
@@ -40,7 +40,7 @@ func (r *rebalancer) Tick() (int, error) {
 			dead[ref] = true
 			continue
 		}
-		perm, err := r.ring.GetPeers(ref)
+		perm, err := r.r.ChoosePeers(r.ring, ref)
 		if err != nil {
 			return 0, err
 		}
@@ -0,0 +1,109 @@
+package distributor
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+// ReplicaCount is the result of counting the replicas of a set of blocks.
+type ReplicaCount struct {
+	// Blocks is the number of blocks counted.
+	Blocks int
+	// Target is the number of replicas the ring calls for.
+	Target int
+	// Min is the fewest replicas found of any block.
+	Min int
+	// UnderReplicated is the number of blocks with fewer replicas than the
+	// ring calls for.
+	UnderReplicated int
+}
+
+// CountReplicas asks the peers each of refs belongs on whether they have it,
+// and counts the replicas found. Peers that can't be reached count as not
+// having any of their blocks.
+func CountReplicas(srv *torus.Server, refs []torus.BlockRef) (*ReplicaCount, error) {
+	d, err := distributorOf(srv)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.TODO()
+	byPeer := make(map[string][]torus.BlockRef)
+	found := make(map[torus.BlockRef]int)
+	want := make(map[torus.BlockRef]int)
+	d.mut.RLock()
+	for _, ref := range refs {
+		if ref.IsZero() {
+			continue
+		}
+		if _, ok := found[ref]; ok {
+			continue
+		}
+		found[ref] = 0
+		perm, err := d.placement(d.ring, ref, Constraints{})
+		if err != nil {
+			d.mut.RUnlock()
+			return nil, err
+		}
+		want[ref] = perm.Replication
+		for _, p := range perm.Peers[:perm.Replication] {
+			byPeer[p] = append(byPeer[p], ref)
+		}
+	}
+	d.mut.RUnlock()
+
+	for p, mine := range byPeer {
+		for i := 0; i < len(mine); i += checkBatch {
+			end := i + checkBatch
+			if end > len(mine) {
+				end = len(mine)
+			}
+			has, err := d.hasBlocks(ctx, p, mine[i:end])
+			if err != nil {
+				clog.Warningf("couldn't count replicas on peer %s: %v", p, err)
+				break
+			}
+			for j, ok := range has {
+				if ok {
+					found[mine[i+j]]++
+				}
+			}
+		}
+	}
+
+	out := &ReplicaCount{
+		Blocks: len(found),
+	}
+	for _, n := range want {
+		if n > out.Target {
+			out.Target = n
+		}
+	}
+	out.Min = out.Target
+	for ref, n := range found {
+		if n < out.Min {
+			out.Min = n
+		}
+		if n < want[ref] {
+			out.UnderReplicated++
+		}
+	}
+	return out, nil
+}
+
+// hasBlocks reports which of refs the peer uuid has, asking the local store
+// if the peer is this one.
+func (d *Distributor) hasBlocks(ctx context.Context, uuid string, refs []torus.BlockRef) ([]bool, error) {
+	if uuid != d.UUID() {
+		return d.client.Check(ctx, uuid, refs)
+	}
+	out := make([]bool, len(refs))
+	for i, ref := range refs {
+		ok, err := d.blocks.HasBlock(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = ok
+	}
+	return out, nil
+}
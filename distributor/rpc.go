@@ -24,7 +24,7 @@ func (d *Distributor) PutBlock(ctx context.Context, ref torus.BlockRef, data []b
 	d.mut.RLock()
 	defer d.mut.RUnlock()
 	promDistPutBlockRPCs.Inc()
-	peers, err := d.ring.GetPeers(ref)
+	peers, err := d.placement(d.ring, ref, Constraints{})
 	if err != nil {
 		promDistPutBlockRPCFailures.Inc()
 		return err
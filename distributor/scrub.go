@@ -0,0 +1,142 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+// scrubState is the scrubber's record of what it has found, for ScrubStatus.
+type scrubState struct {
+	mut    sync.Mutex
+	status torus.ScrubStatus
+}
+
+func (s *scrubState) update(fn func(st *torus.ScrubStatus)) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	fn(&s.status)
+}
+
+// ScrubStatus reports what the scrubber has found in the blocks stored here.
+func (d *Distributor) ScrubStatus() torus.ScrubStatus {
+	d.scrub.mut.Lock()
+	defer d.scrub.mut.Unlock()
+	return d.scrub.status
+}
+
+// scrubCycle checks every block stored here which has a checksum against it,
+// at the configured rate, and rewrites those which fail with a copy from a
+// peer which passes. It is run as the "scrub" job by the server's job
+// scheduler. Each node scrubs its own blocks, so between them the whole
+// cluster is covered.
+func (d *Distributor) scrubCycle(ctx context.Context, progress func(done, total int)) error {
+	rate := d.srv.Cfg.ScrubRate
+	if rate <= 0 {
+		rate = torus.DefaultScrubRate
+	}
+	pace := time.NewTicker(time.Second / time.Duration(rate))
+	defer pace.Stop()
+	d.scrub.update(func(st *torus.ScrubStatus) {
+		st.Start = time.Now()
+		st.Finish = time.Time{}
+		st.Checked, st.Corrupt, st.Repaired = 0, 0, 0
+	})
+	total := int(d.blocks.UsedBlocks())
+	// Blocks shared by snapshots and clones are given more than once.
+	seen := make(map[torus.BlockRef]bool)
+	err := torus.WalkBlockChecks(ctx, d.srv, func(ref torus.BlockRef, check func([]byte) bool) error {
+		if seen[ref] {
+			return nil
+		}
+		if ok, err := d.blocks.HasBlock(ctx, ref); err != nil || !ok {
+			return err
+		}
+		seen[ref] = true
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pace.C:
+		}
+		d.scrubBlock(ctx, ref, check)
+		progress(len(seen), total)
+		return nil
+	})
+	if err == context.Canceled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.scrub.update(func(st *torus.ScrubStatus) {
+		st.Finish = time.Now()
+	})
+	return nil
+}
+
+// scrubBlock checks the copy of ref stored here, and repairs it if it fails.
+func (d *Distributor) scrubBlock(ctx context.Context, ref torus.BlockRef, check func([]byte) bool) {
+	data, err := d.blocks.GetBlock(ctx, ref)
+	if err != nil {
+		// Deleted since it was listed, most likely.
+		return
+	}
+	promDistScrubBlocks.Inc()
+	if check(data) {
+		d.scrub.update(func(st *torus.ScrubStatus) { st.Checked++ })
+		return
+	}
+	promDistScrubCorrupt.Inc()
+	clog.Errorf("scrub: block %s on %s fails its checksum", ref, d.UUID())
+	repaired := d.repairBlock(ctx, ref, check)
+	if repaired {
+		promDistScrubRepaired.Inc()
+	}
+	d.scrub.update(func(st *torus.ScrubStatus) {
+		st.Checked++
+		st.Corrupt++
+		st.TotalCorrupt++
+		if repaired {
+			st.Repaired++
+			st.TotalRepaired++
+		}
+	})
+}
+
+// repairBlock replaces the copy of ref stored here with one from another peer
+// which passes check, and reports whether it could.
+func (d *Distributor) repairBlock(ctx context.Context, ref torus.BlockRef, check func([]byte) bool) bool {
+	d.mut.RLock()
+	perm, err := d.placement(d.ring, ref, Constraints{})
+	d.mut.RUnlock()
+	if err != nil {
+		clog.Errorf("scrub: couldn't place block %s: %v", ref, err)
+		return false
+	}
+	for _, p := range perm.Peers[:perm.Replication] {
+		if p == d.UUID() {
+			continue
+		}
+		good, err := d.client.GetBlock(ctx, p, ref)
+		if err != nil || !check(good) {
+			continue
+		}
+		// Blocks are never overwritten in place, so the bad copy goes
+		// first.
+		err = d.blocks.DeleteBlock(ctx, ref)
+		if err == nil {
+			err = d.blocks.WriteBlock(ctx, ref, good)
+		}
+		if err != nil {
+			clog.Errorf("scrub: couldn't rewrite block %s from %s: %v", ref, p, err)
+			return false
+		}
+		clog.Infof("scrub: repaired block %s from %s", ref, p)
+		return true
+	}
+	clog.Errorf("scrub: no healthy replica of block %s to repair it from", ref)
+	return false
+}
@@ -0,0 +1,79 @@
+package distributor
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/metadata/temp"
+	"github.com/coreos/torus/models"
+	"github.com/coreos/torus/ring"
+)
+
+// scrubTestSums are the checksums the scrub test registers its blocks with.
+var scrubTestSums = make(map[torus.BlockRef]uint32)
+
+func init() {
+	torus.RegisterBlockChecks("scrubtest", func(ctx context.Context, srv *torus.Server, fn func(torus.BlockRef, func([]byte) bool) error) error {
+		for ref, sum := range scrubTestSums {
+			sum := sum
+			err := fn(ref, func(data []byte) bool { return crc32.ChecksumIEEE(data) == sum })
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestScrub(t *testing.T) {
+	md := temp.NewServer()
+	srv := newServer(md)
+	r, err := ring.CreateRing(&models.Ring{
+		Type:              uint32(ring.Single),
+		Peers:             torus.PeerInfoList{{UUID: srv.MDS.UUID(), TotalBlocks: 1000}},
+		ReplicationFactor: 1,
+		Version:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.MDS.SetRing(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenReplication(srv); err != nil {
+		t.Fatal(err)
+	}
+	defer md.Close()
+	defer srv.Close()
+	d := srv.Blocks.(*Distributor)
+	srv.Cfg.ScrubRate = 1000
+
+	var refs []torus.BlockRef
+	for i := 0; i < 4; i++ {
+		ref := torus.BlockRef{INodeRef: torus.NewINodeRef(1, 1), Index: torus.IndexID(i)}
+		data := bytes.Repeat([]byte{byte(i + 1)}, int(srv.Blocks.BlockSize()))
+		if err := srv.Blocks.WriteBlock(context.TODO(), ref, data); err != nil {
+			t.Fatal(err)
+		}
+		scrubTestSums[ref] = crc32.ChecksumIEEE(data)
+		refs = append(refs, ref)
+	}
+	d.blocks.DeleteBlock(context.TODO(), refs[2])
+	d.blocks.WriteBlock(context.TODO(), refs[2], []byte("Evil Corruption!!"))
+
+	if err := d.scrubCycle(context.TODO(), func(int, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	st := d.ScrubStatus()
+	if st.Checked != len(refs) || st.Corrupt != 1 || st.TotalCorrupt != 1 {
+		t.Fatalf("checked %d blocks and found %d corrupt, want %d and 1", st.Checked, st.Corrupt, len(refs))
+	}
+	// There's no other replica to repair it from.
+	if st.Repaired != 0 || st.Finish.IsZero() {
+		t.Fatalf("got %+v", st)
+	}
+}
@@ -18,11 +18,14 @@ func (d *Distributor) GetBlock(ctx context.Context, i torus.BlockRef) ([]byte, e
 	defer d.mut.RUnlock()
 	promDistBlockRequests.Inc()
 	bcache, ok := d.readCache.Get(string(i.ToBytes()))
-	if ok {
+	if ok && torus.CheckBlock(ctx, bcache.([]byte)) {
 		promDistBlockCacheHits.Inc()
 		return bcache.([]byte), nil
 	}
-	peers, err := d.ring.GetPeers(i)
+	if d.readCache != nil {
+		promDistBlockCacheMisses.Inc()
+	}
+	peers, err := d.placement(d.ring, i, Constraints{})
 	if err != nil {
 		promDistBlockFailures.Inc()
 		return nil, err
@@ -31,12 +34,19 @@ func (d *Distributor) GetBlock(ctx context.Context, i torus.BlockRef) ([]byte, e
 		promDistBlockFailures.Inc()
 		return nil, ErrNoPeersBlock
 	}
+	peers = d.nearestFirst(peers)
 	writeLevel := d.getWriteFromServer()
 	for _, p := range peers.Peers[:peers.Replication] {
 		if p == d.UUID() || writeLevel == torus.WriteLocal {
 			b, err := d.blocks.GetBlock(ctx, i)
-			if err == nil {
+			if err == nil && d.checkBlock(ctx, i, d.UUID(), b) {
 				promDistBlockLocalHits.Inc()
+				d.countRead(d.UUID())
+				if d.readCache != nil {
+					// The store may reuse its buffer once the
+					// block is deleted.
+					d.readCache.Put(string(i.ToBytes()), append([]byte(nil), b...))
+				}
 				return b, nil
 			}
 			promDistBlockLocalFailures.Inc()
@@ -79,8 +89,9 @@ func (d *Distributor) readSequential(ctx context.Context, i torus.BlockRef, peer
 		// If it's local, just try to get it.
 		if p == d.UUID() {
 			b, err := d.blocks.GetBlock(ctx, i)
-			if err == nil {
+			if err == nil && d.checkBlock(ctx, i, d.UUID(), b) {
 				promDistBlockLocalHits.Inc()
+				d.countRead(d.UUID())
 				return b, nil
 			}
 			promDistBlockLocalFailures.Inc()
@@ -99,14 +110,14 @@ func (d *Distributor) readSequential(ctx context.Context, i torus.BlockRef, peer
 
 		// If this peer didn't have it, continue
 		if err == torus.ErrBlockUnavailable || err == torus.ErrNoPeer {
-			clog.Warningf("block %s from %s failed, trying next peer", i, p)
+			rlog.Warningf("block %s from %s failed, trying next peer", i, p)
 			promDistBlockPeerFailures.WithLabelValues(p).Inc()
 			continue
 		}
 
 		// If there was a more significant error, fail hard.
 		promDistBlockFailures.Inc()
-		clog.Errorf("failed remote peer %s %s %#v", p, err, err)
+		rlog.Errorf("failed remote peer %s %s %#v", p, err, err)
 		return nil, err
 	}
 	return nil, ErrNoPeersBlock
@@ -153,15 +164,31 @@ func (d *Distributor) readSpread(ctx context.Context, i torus.BlockRef, peers to
 
 func (d *Distributor) readFromPeer(ctx context.Context, i torus.BlockRef, peer string) ([]byte, error) {
 	blk, err := d.client.GetBlock(ctx, peer, i)
+	if err == nil && !d.checkBlock(ctx, i, peer, blk) {
+		return nil, torus.ErrBlockUnavailable
+	}
 	// If we're successful, store that.
 	if err == nil {
 		d.readCache.Put(string(i.ToBytes()), blk)
 		promDistBlockPeerHits.WithLabelValues(peer).Inc()
+		d.countRead(peer)
 		return blk, nil
 	}
 	return nil, err
 }
 
+// checkBlock checks a copy of block i read from peer against the check of
+// whoever is reading it, if any, so that a corrupt replica is passed over for
+// the next one.
+func (d *Distributor) checkBlock(ctx context.Context, i torus.BlockRef, peer string, blk []byte) bool {
+	if torus.CheckBlock(ctx, blk) {
+		return true
+	}
+	promDistBlockChecksumFailures.WithLabelValues(peer).Inc()
+	rlog.Warningf("block %s from %s failed its checksum, trying another replica", i, peer)
+	return false
+}
+
 func (d *Distributor) getWriteFromServer() torus.WriteLevel {
 	return d.srv.Cfg.WriteLevel
 }
@@ -170,15 +197,58 @@ func (d *Distributor) getReadFromServer() torus.ReadLevel {
 	return d.srv.Cfg.ReadLevel
 }
 
+// writePeers returns the peers block i should be written to, leaving out
+// cordoned and full ones. It must be called with d.mut held.
+func (d *Distributor) writePeers(i torus.BlockRef) (torus.PeerPermutation, error) {
+	full := d.fullness.Full()
+	peers, err := d.placement(d.ring, i, Constraints{
+		Exclude: d.srv.Cordoned().Union(full),
+		Write:   true,
+	})
+	if err != nil {
+		return peers, err
+	}
+	if len(peers.Peers) == 0 {
+		if len(full) != 0 {
+			promDistWritesRejectedFull.Inc()
+			return peers, torus.ErrClusterFull
+		}
+		return peers, torus.ErrOutOfSpace
+	}
+	return peers, nil
+}
+
 func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []byte) error {
+	// Back off for peers filling up without holding the lock, so that the
+	// ring can change meanwhile.
 	d.mut.RLock()
-	defer d.mut.RUnlock()
-	peers, err := d.ring.GetPeers(i)
+	peers, err := d.writePeers(i)
+	var delay time.Duration
+	if err == nil {
+		delay = d.fullness.Delay(peers.Peers[:peers.Replication])
+	}
+	d.mut.RUnlock()
 	if err != nil {
 		return err
 	}
-	if len(peers.Peers) == 0 {
-		return torus.ErrOutOfSpace
+	if delay > 0 {
+		promDistWriteBackpressure.Observe(delay.Seconds())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	d.mut.RLock()
+	defer d.mut.RUnlock()
+	return d.writeBlock(ctx, i, data)
+}
+
+// writeBlock writes block i to its peers. It must be called with d.mut held.
+func (d *Distributor) writeBlock(ctx context.Context, i torus.BlockRef, data []byte) error {
+	peers, err := d.writePeers(i)
+	if err != nil {
+		return err
 	}
 	d.readCache.Put(string(i.ToBytes()), data)
 	switch d.getWriteFromServer() {
@@ -189,7 +259,7 @@ func (d *Distributor) WriteBlock(ctx context.Context, i torus.BlockRef, data []b
 		}
 		clog.Tracef("Couldn't write locally; writing to cluster")
 		// fallthrough is evil
-		return d.WriteBlock(context.WithValue(ctx, torus.CtxWriteLevel, torus.WriteOne), i, data)
+		return d.writeBlock(context.WithValue(ctx, torus.CtxWriteLevel, torus.WriteOne), i, data)
 	case torus.WriteOne:
 		for _, p := range peers.Peers[:peers.Replication] {
 			// If we're one of the desired peers, we count, write here first.
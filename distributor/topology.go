@@ -0,0 +1,29 @@
+package distributor
+
+import "github.com/coreos/torus"
+
+// zoneDistance is the topological distance between peers in the same zone
+// but on different racks.
+const zoneDistance = 1
+
+// nearestFirst reorders the replicas of perm so that those nearest to this
+// node in the network are read from first. The fallbacks stay after them.
+func (d *Distributor) nearestFirst(perm torus.PeerPermutation) torus.PeerPermutation {
+	topology := d.srv.PeerTopology()
+	if len(topology) == 0 {
+		return perm
+	}
+	peers := append(torus.PeerList(nil), perm.Peers...)
+	torus.SortByDistance(peers[:perm.Replication], d.srv.Cfg.Topology, topology)
+	perm.Peers = peers
+	return perm
+}
+
+// countRead records whether a block was read from within this node's zone.
+func (d *Distributor) countRead(peer string) {
+	locality := "local"
+	if peer != d.UUID() && d.srv.Cfg.Topology.Distance(d.srv.PeerTopology()[peer]) > zoneDistance {
+		locality = "remote"
+	}
+	promDistBlockLocality.WithLabelValues(locality).Inc()
+}
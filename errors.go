@@ -62,4 +62,16 @@ var (
 
 	// ErrLocked is returned if the resource is locked.
 	ErrLocked = errors.New("torus: locked")
+
+	// ErrClusterFull is returned if a block can't be written because every
+	// peer which could hold it is out of space.
+	ErrClusterFull = errors.New("torus: cluster is full")
+
+	// ErrHashCollision is returned if two blocks with different contents
+	// hash to the same content address.
+	ErrHashCollision = errors.New("torus: content hash collision")
+
+	// ErrUnwritten is returned by reads of data which was never written,
+	// when the UnwrittenReads policy is UnwrittenReadError.
+	ErrUnwritten = errors.New("torus: read of data that was never written")
 )
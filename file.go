@@ -81,16 +81,54 @@ type File struct {
 	openIdx   int
 	openData  []byte
 	openWrote bool
+
+	// readMut guards the last block read, and the read-ahead state, so
+	// that ReadAt may be called concurrently.
+	readMut  sync.Mutex
+	readIdx  int
+	readData []byte
+
+	// tuning
+	readAhead   int
+	readAheadTo int
+	lastRead    int
+	writeWindow int
+	behind      *writeBehind
 }
 
 func (f *File) WriteOpen() bool {
 	return f.writeOpen
 }
 
+// SetReadOnly makes the file refuse writes, or accept them again. Unlike
+// setting ReadOnly, it's safe while the file is being written to.
+func (f *File) SetReadOnly(ro bool) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.ReadOnly = ro
+}
+
+// IsReadOnly reports whether the file refuses writes.
+func (f *File) IsReadOnly() bool {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return f.ReadOnly
+}
+
 func (f *File) Replaces() uint64 {
 	return f.replaces
 }
 
+// Blocks returns the blockset backing the file.
+func (f *File) Blocks() Blockset {
+	return f.blocks
+}
+
+// INodeRef returns the ref of the INode the file currently reflects.
+func (f *File) INodeRef() INodeRef {
+	return NewINodeRef(VolumeID(f.inode.Volume), INodeID(f.inode.INode))
+}
+
 func (s *Server) CreateFile(volume *models.Volume, inode *models.INode, blocks Blockset) (*File, error) {
 	md, err := s.MDS.GlobalMetadata()
 	if err != nil {
@@ -98,11 +136,13 @@ func (s *Server) CreateFile(volume *models.Volume, inode *models.INode, blocks B
 	}
 	clog.Tracef("Creating File For Inode %d:%d", inode.Volume, inode.INode)
 	return &File{
-		volume:  volume,
-		inode:   inode,
-		srv:     s,
-		blocks:  blocks,
-		blkSize: int64(md.BlockSize),
+		volume:   volume,
+		inode:    inode,
+		srv:      s,
+		blocks:   blocks,
+		blkSize:  int64(md.BlockSize),
+		lastRead: -1,
+		readIdx:  -1,
 	}, nil
 }
 
@@ -132,7 +172,7 @@ func (f *File) openWrite() error {
 	return nil
 }
 
-func (f *File) openBlock(i int) error {
+func (f *File) openBlock(ctx context.Context, i int) error {
 	if f.openIdx == i && f.openData != nil {
 		return nil
 	}
@@ -142,18 +182,17 @@ func (f *File) openBlock(i int) error {
 			return err
 		}
 	}
-	if f.blocks.Length() == i {
-		f.openData = make([]byte, f.blkSize)
-		f.openIdx = i
-		return nil
-	}
-	start := time.Now()
-	d, err := f.blocks.GetBlock(f.getContext(), i)
-	if err != nil {
-		return err
+	d := f.dropReadBlock(i)
+	if d == nil {
+		start := time.Now()
+		var err error
+		d, err = f.getBlock(ctx, i)
+		if err != nil {
+			return err
+		}
+		delta := time.Now().Sub(start)
+		promFileBlockRead.Observe(float64(delta.Nanoseconds()) / 1000)
 	}
-	delta := time.Now().Sub(start)
-	promFileBlockRead.Observe(float64(delta.Nanoseconds()) / 1000)
 	f.openData = d
 	f.openIdx = i
 	return nil
@@ -175,7 +214,7 @@ func (f *File) syncBlock() error {
 		return nil
 	}
 	start := time.Now()
-	err := f.blocks.PutBlock(f.getContext(), f.writeINodeRef, f.openIdx, f.openData)
+	err := f.putBlock(f.openIdx, f.openData)
 	delta := time.Now().Sub(start)
 	promFileBlockWrite.Observe(float64(delta.Nanoseconds()) / 1000)
 	f.openIdx = -1
@@ -235,7 +274,7 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 		if frontlen > toWrite {
 			frontlen = toWrite
 		}
-		err := f.openBlock(blkIndex)
+		err := f.openBlock(f.getContext(), blkIndex)
 		if err != nil {
 			promFileWrittenBytes.WithLabelValues(f.volume.Name).Add(float64(n))
 			return n, err
@@ -269,7 +308,11 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 			clog.Tracef("bulk writing block at index %d, inoderef %s", blkIndex, f.writeINodeRef)
 		}
 		start := time.Now()
-		err = f.blocks.PutBlock(f.getContext(), f.writeINodeRef, blkIndex, b[:f.blkSize])
+		data := b[:f.blkSize]
+		if f.behind != nil {
+			data = append([]byte(nil), data...)
+		}
+		err = f.putBlock(blkIndex, data)
 		if err != nil {
 			promFileWrittenBytes.WithLabelValues(f.volume.Name).Add(float64(n))
 			return n, err
@@ -293,7 +336,7 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 		panic("Offset not equal to a block boundary after bulk")
 	}
 	blkIndex = int(off / f.blkSize)
-	err = f.openBlock(blkIndex)
+	err = f.openBlock(f.getContext(), blkIndex)
 	if err != nil {
 		promFileWrittenBytes.WithLabelValues(f.volume.Name).Add(float64(n))
 		return n, err
@@ -326,6 +369,7 @@ func (f *File) ReadAt(b []byte, off int64) (n int, ferr error) {
 		clog.Tracef("begin read @ %x of size %d", off, toRead)
 	}
 	n = 0
+	ctx := f.srv.readContext()
 	if int64(toRead)+off > int64(f.inode.Filesize) {
 		toRead = int(int64(f.inode.Filesize) - off)
 		ferr = io.EOF
@@ -337,7 +381,7 @@ func (f *File) ReadAt(b []byte, off int64) (n int, ferr error) {
 		if clog.LevelAt(capnslog.TRACE) {
 			clog.Tracef("getting block index %d", blkIndex)
 		}
-		err := f.openBlock(blkIndex)
+		d, err := f.readBlock(ctx, blkIndex)
 		if err != nil {
 			return n, err
 		}
@@ -345,7 +389,7 @@ func (f *File) ReadAt(b []byte, off int64) (n int, ferr error) {
 		if int64(toRead-n) < thisRead {
 			thisRead = int64(toRead - n)
 		}
-		count := copy(b[n:], f.openData[blkOff:blkOff+thisRead])
+		count := copy(b[n:], d[blkOff:blkOff+thisRead])
 		n += count
 		off += int64(count)
 	}
@@ -377,6 +421,10 @@ func (f *File) Close() error {
 		return ErrInvalid
 	}
 	var err error
+	if f.behind != nil {
+		err = f.behind.close()
+		f.behind = nil
+	}
 	promOpenFiles.WithLabelValues(f.volume.Name).Dec()
 	return err
 }
@@ -386,29 +434,74 @@ func (f *File) Truncate(size int64) error {
 	if err != nil {
 		return err
 	}
+	err = f.flushBehind()
+	if err != nil {
+		return err
+	}
 	nBlocks := (size / f.blkSize)
 	if size%f.blkSize != 0 {
 		nBlocks++
 	}
+	if f.openData != nil && int64(f.openIdx) >= nBlocks {
+		// The open block is cut off entirely.
+		f.openIdx = -1
+		f.openData = nil
+		f.openWrote = false
+	}
+	if cut := size % f.blkSize; cut != 0 && uint64(size) < f.inode.Filesize && int(nBlocks) <= f.blocks.Length() {
+		// Zero what is cut off the new last block, so that growing
+		// the file again reads zeros there rather than the old data.
+		err = f.openBlock(f.getContext(), int(nBlocks-1))
+		if err != nil {
+			return err
+		}
+		f.writeToBlock(int(cut), int(f.blkSize), make([]byte, f.blkSize-cut))
+	}
 	clog.Tracef("truncate to %d %d", size, nBlocks)
+	f.dropReadBlock(-1)
 	f.blocks.Truncate(int(nBlocks), uint64(f.blkSize))
 	f.inode.Filesize = uint64(size)
 	return nil
 }
 
+// Grow extends the file to size bytes, if it's smaller. Unlike Truncate, it
+// may be called while the file is being read and written.
+func (f *File) Grow(size int64) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if uint64(size) <= f.inode.Filesize {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
 // Trim zeroes data in the middle of a file.
 func (f *File) Trim(offset, length int64) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
 	clog.Debugf("trimming %d %d", offset, length)
 	err := f.openWrite()
 	if err != nil {
 		return err
 	}
+	err = f.flushBehind()
+	if err != nil {
+		return err
+	}
 	// find the block edges
 	blkFrom := offset / f.blkSize
 	if offset%f.blkSize != 0 {
 		blkFrom += 1
 	}
 	blkTo := (offset + length) / f.blkSize
+	if f.openData != nil && int64(f.openIdx) >= blkFrom && int64(f.openIdx) < blkTo {
+		// Drop the open block rather than letting its next sync
+		// write the trimmed data back.
+		f.openIdx = -1
+		f.openData = nil
+		f.openWrote = false
+	}
+	f.dropReadBlock(-1)
 	return f.blocks.Trim(int(blkFrom), int(blkTo))
 }
 
@@ -445,6 +538,11 @@ func (f *File) SyncBlocks() error {
 		clog.Error("sync: couldn't sync block")
 		return err
 	}
+	err = f.flushBehind()
+	if err != nil {
+		clog.Error("sync: couldn't store blocks written behind")
+		return err
+	}
 	return f.srv.Blocks.Flush()
 }
 
@@ -0,0 +1,280 @@
+package torus
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MaxReadAhead and MaxWriteBehind bound the read-ahead and write-behind a file
+// may be tuned to; larger settings are cut down to them.
+const (
+	MaxReadAhead   = 64 * 1024 * 1024
+	MaxWriteBehind = 64 * 1024 * 1024
+)
+
+// writeBehind stores the blocks written to a file in the background, in the
+// order they were written, while keeping them readable through the file until
+// they are stored.
+type writeBehind struct {
+	queue  chan pendingBlock
+	wg     sync.WaitGroup
+	memory *MemoryAccount
+
+	mut     sync.Mutex
+	pending map[int][]byte
+	err     error
+}
+
+type pendingBlock struct {
+	ref  INodeRef
+	i    int
+	data []byte
+}
+
+func newWriteBehind(f *File, window int) *writeBehind {
+	w := &writeBehind{
+		queue:   make(chan pendingBlock, window),
+		pending: make(map[int][]byte),
+		memory:  f.srv.writeBehindMemory,
+	}
+	go w.run(f.getContext(), f.blocks)
+	return w
+}
+
+func (w *writeBehind) run(ctx context.Context, blocks Blockset) {
+	for pb := range w.queue {
+		err := blocks.PutBlock(ctx, pb.ref, pb.i, pb.data)
+		w.mut.Lock()
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		if d, ok := w.pending[pb.i]; ok && &d[0] == &pb.data[0] {
+			delete(w.pending, pb.i)
+		}
+		w.mut.Unlock()
+		w.memory.Release(uint64(len(pb.data)))
+		w.wg.Done()
+	}
+}
+
+// put queues a block to be stored, waiting if the window is full. The block
+// must not be modified afterwards. It returns false, queuing nothing, if the
+// memory budget has no room for the block.
+func (w *writeBehind) put(ref INodeRef, i int, data []byte) bool {
+	if !w.memory.Reserve(uint64(len(data))) {
+		return false
+	}
+	w.mut.Lock()
+	w.pending[i] = data
+	w.mut.Unlock()
+	w.wg.Add(1)
+	w.queue <- pendingBlock{ref, i, data}
+	return true
+}
+
+// get returns a copy of block i if it hasn't been stored yet.
+func (w *writeBehind) get(i int) ([]byte, bool) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	d, ok := w.pending[i]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), d...), true
+}
+
+// wait waits for the queued blocks to be stored, leaving any error for the
+// next flush.
+func (w *writeBehind) wait() {
+	w.wg.Wait()
+}
+
+// flush waits for the queued blocks to be stored, and returns the first error
+// storing any of them since the last flush.
+func (w *writeBehind) flush() error {
+	w.wg.Wait()
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	err := w.err
+	w.err = nil
+	return err
+}
+
+// close flushes w and stops it.
+func (w *writeBehind) close() error {
+	err := w.flush()
+	close(w.queue)
+	return err
+}
+
+// SetReadAhead makes sequential reads of the file fetch up to n bytes beyond
+// the block being read in the background, so that they are cached by the time
+// they are read. Zero turns read-ahead off. Read-ahead only happens while the
+// file has no unsynced writes, and while the memory budget has room for the
+// blocks fetched. n is cut down to MaxReadAhead.
+func (f *File) SetReadAhead(n uint64) {
+	if n > MaxReadAhead {
+		n = MaxReadAhead
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.readAhead = int((int64(n) + f.blkSize - 1) / f.blkSize)
+}
+
+// SetWriteBehind lets up to n bytes of whole blocks written to the file be
+// stored in the background, rather than before the write returns. Errors
+// storing them are returned by the next sync. Zero stores every block before
+// the write returns. Any blocks queued under the previous setting are stored
+// first, and an error storing them returned. n is cut down to MaxWriteBehind,
+// and blocks are only queued while the memory budget has room for them.
+func (f *File) SetWriteBehind(n uint64) error {
+	if n > MaxWriteBehind {
+		n = MaxWriteBehind
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	window := int((int64(n) + f.blkSize - 1) / f.blkSize)
+	if window == f.writeWindow {
+		return nil
+	}
+	var err error
+	if f.behind != nil {
+		err = f.behind.close()
+		f.behind = nil
+	}
+	f.writeWindow = window
+	if window > 0 {
+		f.behind = newWriteBehind(f, window)
+	}
+	return err
+}
+
+// flushBehind waits for any blocks being written behind to be stored.
+func (f *File) flushBehind() error {
+	if f.behind == nil {
+		return nil
+	}
+	return f.behind.flush()
+}
+
+// putBlock stores block i, in the background if write-behind is on. With
+// write-behind, data is taken over and must not be modified by the caller.
+// If the memory budget has no room to queue it, it's stored before returning,
+// once the blocks ahead of it are, so that it isn't overwritten by an older
+// copy.
+func (f *File) putBlock(i int, data []byte) error {
+	if f.behind != nil {
+		if f.behind.put(f.writeINodeRef, i, data) {
+			return nil
+		}
+		f.behind.wait()
+	}
+	return f.blocks.PutBlock(f.getContext(), f.writeINodeRef, i, data)
+}
+
+// getBlock reads block i, from the write-behind queue if it is still there.
+// Blocks past those stored so far, about to be written by a write extending
+// the file, or a hole the blockset doesn't cover, are unwritten.
+func (f *File) getBlock(ctx context.Context, i int) ([]byte, error) {
+	if f.behind != nil {
+		if d, ok := f.behind.get(i); ok {
+			return d, nil
+		}
+	}
+	if i >= f.blocks.Length() {
+		if UnwrittenReadsFail(ctx) {
+			return nil, ErrUnwritten
+		}
+		return make([]byte, f.blkSize), nil
+	}
+	return f.blocks.GetBlock(ctx, i)
+}
+
+// readBlock returns block i for reading. Unlike openBlock, it leaves the block
+// open for writing alone, so concurrent readers holding f.mut for reading
+// don't disturb each other; the last block read is kept for the next read.
+// The block returned must not be modified.
+func (f *File) readBlock(ctx context.Context, i int) ([]byte, error) {
+	if f.openIdx == i && f.openData != nil {
+		return f.openData, nil
+	}
+	f.readMut.Lock()
+	if f.readIdx == i && f.readData != nil {
+		d := f.readData
+		f.readMut.Unlock()
+		return d, nil
+	}
+	f.readAheadFrom(i)
+	f.readMut.Unlock()
+
+	start := time.Now()
+	d, err := f.getBlock(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	delta := time.Now().Sub(start)
+	promFileBlockRead.Observe(float64(delta.Nanoseconds()) / 1000)
+
+	f.readMut.Lock()
+	f.readIdx = i
+	f.readData = d
+	f.readMut.Unlock()
+	return d, nil
+}
+
+// dropReadBlock forgets the last block read, once blocks are being changed.
+// If it was block i, it is returned for the writer to take over; f.mut must
+// be held exclusively, so that no reader still uses it.
+func (f *File) dropReadBlock(i int) []byte {
+	f.readMut.Lock()
+	defer f.readMut.Unlock()
+	var d []byte
+	if f.readIdx == i {
+		d = f.readData
+	}
+	f.readIdx = -1
+	f.readData = nil
+	return d
+}
+
+// readAheadFrom fetches the blocks following block i in the background when
+// reads are sequential. f.readMut must be held.
+func (f *File) readAheadFrom(i int) {
+	sequential := i == f.lastRead+1
+	f.lastRead = i
+	if f.readAhead == 0 || !sequential || f.writeOpen {
+		return
+	}
+	from := i + 1
+	if f.readAheadTo > from {
+		from = f.readAheadTo
+	}
+	to := i + 1 + f.readAhead
+	if to > f.blocks.Length() {
+		to = f.blocks.Length()
+	}
+	if from >= to {
+		return
+	}
+	// Each block is held until the caches below take it, so charge them
+	// all up front and skip reading ahead if there's no room; it's tried
+	// again on the next sequential read.
+	mem := f.srv.readAheadMemory
+	if !mem.Reserve(uint64(to-from) * uint64(f.blkSize)) {
+		return
+	}
+	f.readAheadTo = to
+	ctx := f.getContext()
+	blocks := f.blocks
+	blkSize := uint64(f.blkSize)
+	go func() {
+		for j := from; j < to; j++ {
+			// Only warms the caches below; the data itself is
+			// read again when it is asked for.
+			blocks.GetBlock(ctx, j)
+			mem.Release(blkSize)
+		}
+	}()
+}
@@ -0,0 +1,343 @@
+package fs
+
+import (
+	"encoding/json"
+	"strings"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/metadata/etcd"
+	"github.com/coreos/torus/models"
+)
+
+type fsEtcd struct {
+	*etcd.Etcd
+	name string
+	vid  torus.VolumeID
+}
+
+func createFSEtcdMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (fsMetadata, error) {
+	if e, ok := mds.(*etcd.Etcd); ok {
+		return &fsEtcd{
+			Etcd: e,
+			name: name,
+			vid:  vid,
+		}, nil
+	}
+	panic("how are we creating an etcd metadata that doesn't implement it but reports as being etcd")
+}
+
+func (b *fsEtcd) getContext() context.Context {
+	return context.TODO()
+}
+
+// key returns the key of the volume's filesystem metadata under parts.
+func (b *fsEtcd) key(parts ...string) string {
+	return etcd.MkKey(append([]string{"volumemeta", etcd.Uint64ToHex(uint64(b.vid)), "fs"}, parts...)...)
+}
+
+func (b *fsEtcd) nodeKey(id uint64) string {
+	return b.key("nodes", etcd.Uint64ToHex(id))
+}
+
+// dirKey is the prefix of the keys of dir's entries. Names may hold
+// anything MkKey would clean, so they're appended to it as they are.
+func (b *fsEtcd) dirKey(dir uint64) string {
+	return b.key("dirs", etcd.Uint64ToHex(dir)) + "/"
+}
+
+func (b *fsEtcd) handleKey(handle string) string {
+	return b.key("handles", handle)
+}
+
+// prefixEnd returns the end of the range of keys starting with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// Every key sorts before "\x00" taken as a range end.
+	return "\x00"
+}
+
+func (b *fsEtcd) CreateFSVolume(volume *models.Volume, root *Node) error {
+	new, err := b.AtomicModifyKey([]byte(etcd.MkKey("meta", "volumeminter")), etcd.BytesAddOne)
+	if err != nil {
+		return err
+	}
+	volume.Id = new.(uint64)
+	b.vid = torus.VolumeID(volume.Id)
+	vbytes, err := volume.Marshal()
+	if err != nil {
+		return err
+	}
+	rbytes, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	// The root takes the first INode index, as a block volume's empty
+	// INode does.
+	tx := b.Etcd.Client.Txn(b.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(etcd.MkKey("volumes", volume.Name)), "=", 0),
+	).Then(
+		etcdv3.OpPut(etcd.MkKey("volumes", volume.Name), string(etcd.Uint64ToBytes(volume.Id))),
+		etcdv3.OpPut(etcd.MkKey("volumeid", etcd.Uint64ToHex(volume.Id)), string(vbytes)),
+		etcdv3.OpPut(etcd.MkKey("volumemeta", etcd.Uint64ToHex(volume.Id), "inode"), string(etcd.Uint64ToBytes(RootID))),
+		etcdv3.OpPut(b.nodeKey(RootID), string(rbytes)),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrExists
+	}
+	return nil
+}
+
+func (b *fsEtcd) DeleteVolume() error {
+	vid := uint64(b.vid)
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.key("handles")+"/", etcdv3.WithPrefix(), etcdv3.WithLimit(1))
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) != 0 {
+		return torus.ErrLocked
+	}
+	_, err = b.Etcd.Client.Txn(b.getContext()).Then(
+		etcdv3.OpDelete(etcd.MkKey("volumes", b.name)),
+		etcdv3.OpDelete(etcd.MkKey("volumeid", etcd.Uint64ToHex(vid))),
+		etcdv3.OpDelete(etcd.MkKey("volumemeta", etcd.Uint64ToHex(vid)), etcdv3.WithPrefix()),
+		etcdv3.OpDelete(etcd.VolumeReplicationKey(vid)),
+	).Commit()
+	return err
+}
+
+func (b *fsEtcd) GetNode(id uint64) (*Node, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.nodeKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, torus.ErrNotExist
+	}
+	n := &Node{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (b *fsEtcd) GetNodes() ([]Node, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.key("nodes")+"/", etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Node, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		if err := json.Unmarshal(kv.Value, &out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (b *fsEtcd) Lookup(dir uint64, name string) (uint64, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.dirKey(dir)+name)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, torus.ErrNotExist
+	}
+	return etcd.BytesToUint64(resp.Kvs[0].Value), nil
+}
+
+func (b *fsEtcd) ReadDir(dir uint64, after string, max int) ([]DirEntry, error) {
+	prefix := b.dirKey(dir)
+	start := prefix
+	if after != "" {
+		start = prefix + after + "\x00"
+	}
+	resp, err := b.Etcd.Client.Get(b.getContext(), start,
+		etcdv3.WithRange(prefixEnd(prefix)), etcdv3.WithLimit(int64(max)))
+	if err != nil {
+		return nil, err
+	}
+	var out []DirEntry
+	for _, kv := range resp.Kvs {
+		out = append(out, DirEntry{
+			Name: strings.TrimPrefix(string(kv.Key), prefix),
+			ID:   etcd.BytesToUint64(kv.Value),
+		})
+	}
+	return out, nil
+}
+
+func (b *fsEtcd) Update(fn func(tx fsTxn) error) error {
+	for {
+		tx := &fsEtcdTxn{
+			b:      b,
+			read:   make(map[string][]byte),
+			writes: make(map[string][]byte),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if len(tx.writes) == 0 {
+			return nil
+		}
+		var ops []etcdv3.Op
+		for k, v := range tx.writes {
+			if v == nil {
+				ops = append(ops, etcdv3.OpDelete(k))
+			} else {
+				ops = append(ops, etcdv3.OpPut(k, string(v)))
+			}
+		}
+		resp, err := b.Etcd.Client.Txn(b.getContext()).If(tx.cmps...).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		// Something read changed under us; start again.
+	}
+}
+
+// fsEtcdTxn reads keys as the transaction goes, and compares each one's
+// revision when it's committed.
+type fsEtcdTxn struct {
+	b    *fsEtcd
+	cmps []etcdv3.Cmp
+	// read holds the values read, nil for keys which didn't exist.
+	read map[string][]byte
+	// writes holds the values put, nil for deletions.
+	writes map[string][]byte
+}
+
+func (t *fsEtcdTxn) get(k string) ([]byte, error) {
+	if v, ok := t.writes[k]; ok {
+		return v, nil
+	}
+	if v, ok := t.read[k]; ok {
+		return v, nil
+	}
+	resp, err := t.b.Etcd.Client.Get(t.b.getContext(), k)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		t.read[k] = nil
+		t.cmps = append(t.cmps, etcdv3.Compare(etcdv3.Version(k), "=", 0))
+		return nil, nil
+	}
+	t.read[k] = resp.Kvs[0].Value
+	t.cmps = append(t.cmps, etcdv3.Compare(etcdv3.ModRevision(k), "=", resp.Kvs[0].ModRevision))
+	return resp.Kvs[0].Value, nil
+}
+
+func (t *fsEtcdTxn) getNode(id uint64) (*Node, error) {
+	v, err := t.get(t.b.nodeKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, torus.ErrNotExist
+	}
+	n := &Node{}
+	if err := json.Unmarshal(v, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (t *fsEtcdTxn) lookup(dir uint64, name string) (uint64, error) {
+	v, err := t.get(t.b.dirKey(dir) + name)
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return 0, torus.ErrNotExist
+	}
+	return etcd.BytesToUint64(v), nil
+}
+
+func (t *fsEtcdTxn) isEmpty(dir uint64) (bool, error) {
+	prefix := t.b.dirKey(dir)
+	deleted := 0
+	for k, v := range t.writes {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if v != nil {
+			return false, nil
+		}
+		deleted++
+	}
+	resp, err := t.b.Etcd.Client.Get(t.b.getContext(), prefix,
+		etcdv3.WithPrefix(), etcdv3.WithLimit(int64(deleted+1)))
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range resp.Kvs {
+		if v, ok := t.writes[string(kv.Key)]; !ok || v != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *fsEtcdTxn) putNode(n *Node) {
+	v, err := json.Marshal(n)
+	if err != nil {
+		panic(err)
+	}
+	t.writes[t.b.nodeKey(n.ID)] = v
+}
+
+func (t *fsEtcdTxn) deleteNode(id uint64) {
+	t.writes[t.b.nodeKey(id)] = nil
+}
+
+func (t *fsEtcdTxn) putEntry(dir uint64, name string, id uint64) {
+	t.writes[t.b.dirKey(dir)+name] = etcd.Uint64ToBytes(id)
+}
+
+func (t *fsEtcdTxn) deleteEntry(dir uint64, name string) {
+	t.writes[t.b.dirKey(dir)+name] = nil
+}
+
+func (b *fsEtcd) SetWriteMark(handle string, mark torus.INodeID, lease int64) error {
+	if lease == 0 {
+		return torus.ErrInvalid
+	}
+	_, err := b.Etcd.Client.Put(b.getContext(), b.handleKey(handle),
+		string(etcd.Uint64ToBytes(uint64(mark))), etcdv3.WithLease(etcdv3.LeaseID(lease)))
+	return err
+}
+
+func (b *fsEtcd) ClearWriteMark(handle string) error {
+	_, err := b.Etcd.Client.Delete(b.getContext(), b.handleKey(handle))
+	return err
+}
+
+func (b *fsEtcd) GetWriteMarks() ([]torus.INodeID, error) {
+	resp, err := b.Etcd.Client.Get(b.getContext(), b.key("handles")+"/", etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var out []torus.INodeID
+	for _, kv := range resp.Kvs {
+		if mark := etcd.BytesToUint64(kv.Value); mark != 0 {
+			out = append(out, torus.INodeID(mark))
+		}
+	}
+	return out, nil
+}
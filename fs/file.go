@@ -0,0 +1,278 @@
+package fs
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+	"github.com/coreos/torus/models"
+)
+
+// File is an open file in a filesystem volume. It reads the contents the
+// file had when it was opened, or last synced, with its own writes on top.
+//
+// Reads and writes may be made concurrently. After an error from Sync the
+// File should be closed.
+type File struct {
+	vol  *Volume
+	node uint64
+
+	// mut is held to read and write, and held exclusively to truncate
+	// and sync.
+	mut  sync.RWMutex
+	file *torus.File
+	// base is the Data of the node the file was opened, or last synced,
+	// at.
+	base []byte
+	// writing is set from the first write after the file was opened or
+	// synced, when the Volume's write mark covers it.
+	writing bool
+	wmut    sync.Mutex
+}
+
+// OpenFile opens the file id.
+func (v *Volume) OpenFile(id uint64) (*File, error) {
+	n, err := v.mds.GetNode(id)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case n.IsDir():
+		return nil, ErrIsDir
+	case !n.Mode.IsRegular():
+		return nil, torus.ErrInvalid
+	}
+	tf, err := v.openData(n.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		vol:  v,
+		node: id,
+		file: tf,
+		base: n.Data,
+	}, nil
+}
+
+func (v *Volume) getContext() context.Context {
+	return context.TODO()
+}
+
+// openData opens the contents of a file, as of the INodeRef data.
+func (v *Volume) openData(data []byte) (*torus.File, error) {
+	var inode *models.INode
+	if len(data) == 0 {
+		gmd, err := v.srv.MDS.GlobalMetadata()
+		if err != nil {
+			return nil, err
+		}
+		bs, err := blockset.CreateBlocksetFromSpec(gmd.DefaultBlockSpec, nil)
+		if err != nil {
+			return nil, err
+		}
+		inode = models.NewEmptyINode()
+		inode.Volume = v.volume.Id
+		inode.Blocks, err = torus.MarshalBlocksetToProto(bs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		inode, err = v.srv.INodes.GetINode(v.getContext(), torus.INodeRefFromBytes(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+	bs, err := blockset.UnmarshalFromProto(inode.GetBlocks(), v.srv.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	return v.srv.CreateFile(v.volume, inode, bs)
+}
+
+// ID returns the ID of the file's node.
+func (f *File) ID() uint64 { return f.node }
+
+// Size returns the length of the file, including its writes.
+func (f *File) Size() uint64 {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return f.file.Size()
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return f.file.ReadAt(p, off)
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	end := uint64(off) + uint64(len(p))
+	f.mut.RLock()
+	if end <= f.file.Size() {
+		defer f.mut.RUnlock()
+		if err := f.beginWrite(); err != nil {
+			return 0, err
+		}
+		return f.file.WriteAt(p, off)
+	}
+	f.mut.RUnlock()
+	// torus.File can only write within its blocks, or just past them, so
+	// the file is extended first.
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if err := f.beginWrite(); err != nil {
+		return 0, err
+	}
+	if end > f.file.Size() {
+		if err := f.file.Truncate(int64(end)); err != nil {
+			return 0, err
+		}
+	}
+	return f.file.WriteAt(p, off)
+}
+
+// Truncate changes the length of the file.
+func (f *File) Truncate(size int64) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if err := f.beginWrite(); err != nil {
+		return err
+	}
+	return f.file.Truncate(size)
+}
+
+// Current reports whether n, the file's node, still has the contents the
+// file was opened at, or last synced.
+func (f *File) Current(n *Node) bool {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return bytes.Equal(n.Data, f.base)
+}
+
+// Dirty reports whether the file has writes which haven't been synced.
+func (f *File) Dirty() bool {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+	return f.writing
+}
+
+func (f *File) beginWrite() error {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+	if f.writing {
+		return nil
+	}
+	if err := f.vol.beginWrite(f); err != nil {
+		return err
+	}
+	f.writing = true
+	return nil
+}
+
+// Sync stores the file's writes, and makes them the file's contents. If the
+// file was synced by another File since this one was opened, it returns
+// ErrConflict, and the writes are lost.
+func (f *File) Sync() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if !f.Dirty() {
+		return nil
+	}
+	defer f.endWrite()
+	ref, err := f.file.SyncAllWrites()
+	if err != nil {
+		return err
+	}
+	data := ref.ToBytes()
+	size := f.file.Size()
+	now := time.Now()
+	err = f.vol.mds.Update(func(tx fsTxn) error {
+		n, err := tx.getNode(f.node)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(n.Data, f.base) {
+			return ErrConflict
+		}
+		n.Data = data
+		n.Size = size
+		n.Mtime, n.Ctime = now, now
+		tx.putNode(n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.base = data
+	return nil
+}
+
+func (f *File) endWrite() {
+	f.wmut.Lock()
+	defer f.wmut.Unlock()
+	if f.writing {
+		f.writing = false
+		f.vol.endWrite(f)
+	}
+}
+
+// Close closes the file. Writes which haven't been synced are discarded.
+func (f *File) Close() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.endWrite()
+	return f.file.Close()
+}
+
+// beginWrite covers the writes f is about to make with the volume's write
+// mark: the lowest INode index, at the time they began, of the writes of
+// any of its files which haven't been synced. The garbage collector leaves
+// the blocks of INodes above every mark of a volume alone, as they may yet
+// become part of a file.
+func (v *Volume) beginWrite(f *File) error {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	if v.closed {
+		return torus.ErrClosed
+	}
+	mark, err := v.srv.MDS.GetINodeIndex(v.ID())
+	if err != nil {
+		return err
+	}
+	if v.mark == 0 {
+		// INode indexes only grow, so only the first writer can lower
+		// the mark.
+		if err := v.mds.SetWriteMark(v.handle, mark, v.srv.Lease()); err != nil {
+			return err
+		}
+		v.mark = mark
+	}
+	v.writers[f] = mark
+	return nil
+}
+
+// endWrite drops f's writes from the volume's write mark.
+func (v *Volume) endWrite(f *File) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	delete(v.writers, f)
+	var low torus.INodeID
+	for _, mark := range v.writers {
+		if low == 0 || mark < low {
+			low = mark
+		}
+	}
+	if low == v.mark || v.closed {
+		return
+	}
+	if err := v.mds.SetWriteMark(v.handle, low, v.srv.Lease()); err != nil {
+		clog.Errorf("couldn't update write mark of volume %s: %v", v.volume.Name, err)
+		return
+	}
+	v.mark = low
+}
@@ -0,0 +1,300 @@
+// Package fs implements filesystem volumes: trees of directories, files and
+// symlinks which many clients may share. The tree -- each node's attributes,
+// and the entries of each directory -- is kept in the metadata service, while
+// the contents of each file are a torus INode of their own, stored in blocks
+// like those of a block volume.
+//
+// A file's writes are stored in the cluster as they're made, but only become
+// part of the file when it's synced. Each sync commits the file's new INode
+// if the file hasn't been synced elsewhere since it was opened, so files may
+// be shared between hosts with close-to-open consistency.
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/models"
+)
+
+var clog = capnslog.NewPackageLogger("github.com/coreos/torus", "fs")
+
+// VolumeType is the type of filesystem volumes.
+const VolumeType = "fs"
+
+// RootID is the ID of the root directory of every filesystem volume.
+const RootID = 1
+
+// MaxNameLen is the longest a name in a directory may be.
+const MaxNameLen = 255
+
+var (
+	// ErrIsDir is returned when a directory is used as a file.
+	ErrIsDir = errors.New("fs: is a directory")
+
+	// ErrNotEmpty is returned when removing, or replacing, a directory
+	// which has entries.
+	ErrNotEmpty = errors.New("fs: directory not empty")
+
+	// ErrInvalidName is returned for names which can't be in a
+	// directory.
+	ErrInvalidName = errors.New("fs: invalid name")
+
+	// ErrNameTooLong is returned for names longer than MaxNameLen.
+	ErrNameTooLong = errors.New("fs: name too long")
+
+	// ErrConflict is returned by File.Sync if the file was synced by
+	// another writer since it was opened. The writes made since are
+	// discarded.
+	ErrConflict = errors.New("fs: file changed by another writer")
+)
+
+// Node is a file, directory or symlink in a filesystem volume.
+type Node struct {
+	ID uint64
+	// Mode holds the node's type and permissions.
+	Mode os.FileMode
+	UID  uint32
+	GID  uint32
+	// Links is how many directory entries name the node; for a
+	// directory, 2 plus its number of subdirectories.
+	Links uint32
+	// Size is the length of a file as of its last sync, or of a
+	// symlink's target.
+	Size  uint64
+	Atime time.Time
+	Mtime time.Time
+	Ctime time.Time
+	// Parent is the directory a directory is in. The root is its own
+	// parent.
+	Parent uint64 `json:",omitempty"`
+	// Target is where a symlink points.
+	Target string `json:",omitempty"`
+	// Data is the INodeRef of a file's contents, or empty for an empty
+	// file.
+	Data []byte `json:",omitempty"`
+}
+
+// IsDir reports whether n is a directory.
+func (n *Node) IsDir() bool { return n.Mode.IsDir() }
+
+// IsSymlink reports whether n is a symlink.
+func (n *Node) IsSymlink() bool { return n.Mode&os.ModeSymlink != 0 }
+
+// DirEntry is a name in a directory.
+type DirEntry struct {
+	Name string
+	ID   uint64
+}
+
+// ValidateName checks that name can be an entry in a directory.
+func ValidateName(name string) error {
+	if len(name) > MaxNameLen {
+		return ErrNameTooLong
+	}
+	if name == "" || name == "." || name == ".." {
+		return ErrInvalidName
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' || name[i] == 0 {
+			return ErrInvalidName
+		}
+	}
+	return nil
+}
+
+// Volume is an open filesystem volume.
+type Volume struct {
+	srv    *torus.Server
+	mds    fsMetadata
+	volume *models.Volume
+	// handle identifies this Volume's write mark; see beginWrite.
+	handle string
+
+	mut sync.Mutex
+	// writers holds the write mark of each open file being written.
+	writers map[*File]torus.INodeID
+	mark    torus.INodeID
+	closed  bool
+}
+
+// CreateFSVolume creates an empty filesystem volume, whose root directory
+// is owned by root and may be written by anyone, like /tmp.
+func CreateFSVolume(mds torus.MetadataService, name string) error {
+	id, err := mds.NewVolumeID()
+	if err != nil {
+		return err
+	}
+	fsmd, err := createFSMetadata(mds, name, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return fsmd.CreateFSVolume(&models.Volume{
+		Name: name,
+		Id:   uint64(id),
+		Type: VolumeType,
+	}, &Node{
+		ID:     RootID,
+		Mode:   os.ModeDir | os.ModeSticky | 0777,
+		Links:  2,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Parent: RootID,
+	})
+}
+
+// OpenFSVolume opens a filesystem volume.
+func OpenFSVolume(srv *torus.Server, name string) (*Volume, error) {
+	vol, err := srv.MDS.GetVolume(name)
+	if err != nil {
+		return nil, err
+	}
+	if vol.Type != VolumeType {
+		return nil, torus.ErrWrongVolumeType
+	}
+	mds, err := createFSMetadata(srv.MDS, vol.Name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	v := &Volume{
+		srv:     srv,
+		mds:     mds,
+		volume:  vol,
+		handle:  srv.MDS.UUID() + "-" + hex.EncodeToString(buf),
+		writers: make(map[*File]torus.INodeID),
+	}
+	// The volume is registered as open, without a mark, until something
+	// is written.
+	if err := mds.SetWriteMark(v.handle, 0, srv.Lease()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// DeleteFSVolume deletes a filesystem volume and everything in it. Volumes
+// which are open can't be deleted.
+func DeleteFSVolume(mds torus.MetadataService, name string) error {
+	vol, err := mds.GetVolume(name)
+	if err != nil {
+		return err
+	}
+	if vol.Type != VolumeType {
+		return torus.ErrWrongVolumeType
+	}
+	fsmd, err := createFSMetadata(mds, vol.Name, torus.VolumeID(vol.Id))
+	if err != nil {
+		return err
+	}
+	return fsmd.DeleteVolume()
+}
+
+// Name returns the name of the volume.
+func (v *Volume) Name() string { return v.volume.Name }
+
+// ID returns the ID of the volume.
+func (v *Volume) ID() torus.VolumeID { return torus.VolumeID(v.volume.Id) }
+
+// Close closes the volume. Files opened from it must be closed first.
+func (v *Volume) Close() error {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	return v.mds.ClearWriteMark(v.handle)
+}
+
+// Statfs returns how many bytes the cluster can store, after replication,
+// and how many of those are free. Every filesystem volume shares them.
+func (v *Volume) Statfs() (total, free uint64, err error) {
+	gmd, err := v.srv.MDS.GlobalMetadata()
+	if err != nil {
+		return 0, 0, err
+	}
+	peers, err := v.srv.MDS.GetPeers()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range peers {
+		total += p.TotalBlocks
+		if p.UsedBlocks < p.TotalBlocks {
+			free += p.TotalBlocks - p.UsedBlocks
+		}
+	}
+	rep := 1
+	if r, err := v.srv.MDS.GetRing(); err == nil {
+		if perm, err := r.GetPeers(torus.BlockRef{}); err == nil && perm.Replication > 1 {
+			rep = perm.Replication
+		}
+	}
+	total = total * gmd.BlockSize / uint64(rep)
+	free = free * gmd.BlockSize / uint64(rep)
+	return total, free, nil
+}
+
+// GetNode returns the node with the given ID.
+func (v *Volume) GetNode(id uint64) (*Node, error) {
+	return v.mds.GetNode(id)
+}
+
+// Lookup returns the node named name in the directory dir.
+func (v *Volume) Lookup(dir uint64, name string) (*Node, error) {
+	if name == "." || name == ".." {
+		n, err := v.mds.GetNode(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !n.IsDir() {
+			return nil, torus.ErrNotDir
+		}
+		if name == "." {
+			return n, nil
+		}
+		return v.mds.GetNode(n.Parent)
+	}
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	id, err := v.mds.Lookup(dir, name)
+	if err == torus.ErrNotExist {
+		// Tell a missing entry from a missing or wrong directory.
+		n, err := v.mds.GetNode(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !n.IsDir() {
+			return nil, torus.ErrNotDir
+		}
+		return nil, torus.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.mds.GetNode(id)
+}
+
+// ReadDir returns up to max entries of dir, in order of name, starting
+// after the name after. The entries don't include "." and "..".
+func (v *Volume) ReadDir(dir uint64, after string, max int) ([]DirEntry, error) {
+	n, err := v.mds.GetNode(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDir() {
+		return nil, torus.ErrNotDir
+	}
+	return v.mds.ReadDir(dir, after, max)
+}
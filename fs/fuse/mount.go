@@ -0,0 +1,97 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Mount mounts a FUSE filesystem named torus:NAME at dir, returning the
+// connection to the kernel to Serve. Root mounts it directly; other users
+// through fusermount, as with any FUSE filesystem. Unless allowOther is set,
+// only the user who mounted it may use it.
+func Mount(dir, name string, allowOther bool) (*os.File, error) {
+	opts := "default_permissions"
+	if allowOther {
+		opts += ",allow_other"
+	}
+	if os.Geteuid() == 0 {
+		return mountDirect(dir, name, opts)
+	}
+	return mountFusermount(dir, name, opts)
+}
+
+func mountDirect(dir, name, opts string) (*os.File, error) {
+	dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=%o,user_id=%d,group_id=%d,%s", dev.Fd(), syscall.S_IFDIR, os.Getuid(), os.Getgid(), opts)
+	if err := syscall.Mount("torus:"+name, dir, "fuse.torus", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("fuse: mounting %s: %v", dir, err)
+	}
+	return dev, nil
+}
+
+// mountFusermount has fusermount mount dir, and pass back the connection to
+// the kernel over a socket.
+func mountFusermount(dir, name, opts string) (*os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ours := os.NewFile(uintptr(fds[0]), "fusermount")
+	theirs := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer ours.Close()
+
+	cmd := exec.Command("fusermount", "-o", opts+",fsname=torus:"+name+",subtype=torus", "--", dir)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{theirs}
+	out, err := cmd.CombinedOutput()
+	theirs.Close()
+	if err != nil {
+		return nil, fmt.Errorf("fuse: fusermount: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	conn, err := net.FileConn(ours)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("fuse: fusermount socket isn't a unix socket")
+	}
+	buf := make([]byte, 32)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("fuse: reading from fusermount: %v", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, fmt.Errorf("fuse: fusermount didn't pass a descriptor")
+	}
+	passed, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(passed) != 1 {
+		return nil, fmt.Errorf("fuse: fusermount didn't pass a descriptor")
+	}
+	return os.NewFile(uintptr(passed[0]), "/dev/fuse"), nil
+}
+
+// Unmount unmounts the filesystem at dir, after which Serve returns. It
+// fails if the filesystem is in use.
+func Unmount(dir string) error {
+	if os.Geteuid() == 0 {
+		return syscall.Unmount(dir, 0)
+	}
+	out, err := exec.Command("fusermount", "-u", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fuse: fusermount: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,614 @@
+package fuse
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+)
+
+// init answers the kernel's INIT.
+func (s *Server) init(r *request) (*reply, error) {
+	major := r.uint32()
+	minor := r.uint32()
+	readahead := r.uint32()
+	flags := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if major < kernelVersion || major == kernelVersion && minor < kernelMinorVersion {
+		log.Printf("fuse: kernel protocol %d.%d is older than %d.%d", major, minor, kernelVersion, kernelMinorVersion)
+		return nil, errProtocol
+	}
+	out := newReply(24)
+	out.uint32(kernelVersion)
+	out.uint32(kernelMinorVersion)
+	out.uint32(readahead)
+	out.uint32(flags & (initAsyncRead | initBigWrites))
+	// max_background and congestion_threshold
+	out.uint16(maxInflight)
+	out.uint16(maxInflight * 3 / 4)
+	out.uint32(maxWrite)
+	return out, nil
+}
+
+// An op serves a request, returning its reply, or nil if it needs none.
+type op func(s *Server, r *request) (*reply, error)
+
+var ops = map[uint32]op{
+	opLookup:      (*Server).lookup,
+	opForget:      noReply,
+	opBatchForget: noReply,
+	opInterrupt:   noReply,
+	opGetattr:     (*Server).getattr,
+	opSetattr:     (*Server).setattr,
+	opReadlink:    (*Server).readlink,
+	opSymlink:     (*Server).symlink,
+	opMknod:       (*Server).mknod,
+	opMkdir:       (*Server).mkdir,
+	opUnlink:      (*Server).unlink,
+	opRmdir:       (*Server).rmdir,
+	opRename:      (*Server).rename,
+	opLink:        (*Server).link,
+	opOpen:        (*Server).openOp,
+	opRead:        (*Server).read,
+	opWrite:       (*Server).write,
+	opStatfs:      (*Server).statfs,
+	opRelease:     (*Server).releaseOp,
+	opFsync:       (*Server).fsync,
+	opFlush:       (*Server).fsync,
+	opOpendir:     (*Server).opendir,
+	opReaddir:     (*Server).readdir,
+	opReleasedir:  (*Server).releasedir,
+	opFsyncdir:    (*Server).fsyncdir,
+	opCreate:      (*Server).create,
+}
+
+// handle serves a request. Those it doesn't know, such as for extended
+// attributes and locks, fail with ENOSYS, which the kernel takes to mean
+// they aren't supported.
+func (s *Server) handle(r *request) (*reply, error) {
+	f, ok := ops[r.opcode]
+	if !ok {
+		return nil, syscall.ENOSYS
+	}
+	out, err := f(s, r)
+	if err == nil && r.err != nil {
+		return nil, r.err
+	}
+	return out, err
+}
+
+// noReply serves the requests the kernel expects no reply to. Nodes are
+// never forgotten, as they're named by their IDs, and requests aren't
+// interrupted once they've been read.
+func noReply(s *Server, r *request) (*reply, error) {
+	return nil, nil
+}
+
+// entry returns the reply naming the node n.
+func (s *Server) entry(n *fs.Node) *reply {
+	out := newReply(entryOutSize)
+	out.entry(n)
+	return out
+}
+
+func (s *Server) lookup(r *request) (*reply, error) {
+	name := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	n, err := s.vol.Lookup(r.node, name)
+	if err != nil {
+		return nil, err
+	}
+	s.withWrites(n)
+	return s.entry(n), nil
+}
+
+func (s *Server) getattr(r *request) (*reply, error) {
+	n, err := s.getNode(r.node)
+	if err != nil {
+		return nil, err
+	}
+	out := newReply(attrOutSize)
+	out.attrOut(n)
+	return out, nil
+}
+
+// conflictRetries is how many times a truncation is made again when the
+// file was synced elsewhere first.
+const conflictRetries = 3
+
+func (s *Server) setattr(r *request) (*reply, error) {
+	valid := r.uint32()
+	r.uint32()
+	// fh and size
+	r.uint64()
+	size := r.uint64()
+	// lock_owner, atime, mtime and ctime
+	r.uint64()
+	atime := r.uint64()
+	mtime := r.uint64()
+	r.uint64()
+	atimensec := r.uint32()
+	mtimensec := r.uint32()
+	r.uint32()
+	r.uint32()
+	mode := r.uint32()
+	r.uint32()
+	uid := r.uint32()
+	gid := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var a fs.SetAttr
+	if valid&setattrMode != 0 {
+		m := fileMode(mode)
+		a.Mode = &m
+	}
+	if valid&setattrUID != 0 {
+		a.UID = &uid
+	}
+	if valid&setattrGID != 0 {
+		a.GID = &gid
+	}
+	now := time.Now()
+	switch {
+	case valid&setattrAtimeNow != 0:
+		a.Atime = &now
+	case valid&setattrAtime != 0:
+		t := time.Unix(int64(atime), int64(atimensec))
+		a.Atime = &t
+	}
+	switch {
+	case valid&setattrMtimeNow != 0:
+		a.Mtime = &now
+	case valid&setattrMtime != 0:
+		t := time.Unix(int64(mtime), int64(mtimensec))
+		a.Mtime = &t
+	}
+	if valid&setattrSize != 0 {
+		if err := s.truncate(r.node, size); err != nil {
+			return nil, err
+		}
+	}
+	if a != (fs.SetAttr{}) {
+		if _, err := s.vol.SetAttr(r.node, a); err != nil {
+			return nil, err
+		}
+	}
+	return s.getattr(r)
+}
+
+// truncate changes the size of the file id, through its open file if it
+// has one so that it doesn't conflict with the file's writes, and syncs it.
+func (s *Server) truncate(id uint64, size uint64) error {
+	if size > maxFileSize {
+		return syscall.EFBIG
+	}
+	s.mu.Lock()
+	of := s.nodes[id]
+	s.mu.Unlock()
+	if of == nil {
+		_, err := s.vol.SetAttr(id, fs.SetAttr{Size: &size})
+		return err
+	}
+	for try := 1; ; try++ {
+		if err := s.rlock(of); err != nil {
+			return err
+		}
+		of.mu.RUnlock()
+		of.mu.Lock()
+		var err error
+		if of.f == nil {
+			err = torus.ErrAgain
+		} else if err = of.f.Truncate(int64(size)); err == nil {
+			err = s.syncLocked(of)
+		}
+		of.mu.Unlock()
+		if err != fs.ErrConflict || try == conflictRetries {
+			return err
+		}
+	}
+}
+
+// maxFileSize is the largest a file may be.
+const maxFileSize = 1<<63 - 1
+
+func (s *Server) readlink(r *request) (*reply, error) {
+	n, err := s.vol.GetNode(r.node)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsSymlink() {
+		return nil, syscall.EINVAL
+	}
+	out := newReply(len(n.Target))
+	out.buf = append(out.buf, n.Target...)
+	return out, nil
+}
+
+// newNode returns a node of type typ with the permissions perm, made in the
+// directory dir by the user of r.
+func newNode(r *request, dir *fs.Node, typ, perm os.FileMode) fs.Node {
+	n := fs.Node{Mode: typ | perm, UID: r.uid, GID: r.gid}
+	if dir.Mode&os.ModeSetgid != 0 {
+		// Nodes take the group of a setgid directory, and directories
+		// its setgid bit too.
+		n.GID = dir.GID
+		if typ == os.ModeDir {
+			n.Mode |= os.ModeSetgid
+		}
+	}
+	return n
+}
+
+// add adds a node named name to the directory r.node, made by newNode, and
+// returns the reply naming it.
+func (s *Server) add(r *request, name string, typ, perm os.FileMode, target string) (*reply, error) {
+	n, err := s.makeNode(r, name, typ, perm, target)
+	if err != nil {
+		return nil, err
+	}
+	return s.entry(n), nil
+}
+
+func (s *Server) makeNode(r *request, name string, typ, perm os.FileMode, target string) (*fs.Node, error) {
+	dir, err := s.vol.GetNode(r.node)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.IsDir() {
+		return nil, torus.ErrNotDir
+	}
+	n := newNode(r, dir, typ, perm)
+	n.Target = target
+	return s.vol.Create(r.node, name, n)
+}
+
+func (s *Server) symlink(r *request) (*reply, error) {
+	name := r.name()
+	target := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return s.add(r, name, os.ModeSymlink, 0777, target)
+}
+
+// mknod only makes regular files: filesystem volumes have no devices,
+// sockets or FIFOs.
+func (s *Server) mknod(r *request) (*reply, error) {
+	mode := r.uint32()
+	// rdev, umask and padding
+	r.uint32()
+	r.uint32()
+	r.uint32()
+	name := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mode&syscall.S_IFMT != modeReg {
+		return nil, syscall.EPERM
+	}
+	return s.add(r, name, 0, fileMode(mode), "")
+}
+
+func (s *Server) mkdir(r *request) (*reply, error) {
+	mode := r.uint32()
+	// umask, which the kernel has applied
+	r.uint32()
+	name := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return s.add(r, name, os.ModeDir, fileMode(mode), "")
+}
+
+func (s *Server) unlink(r *request) (*reply, error) {
+	name := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return newReply(0), s.vol.Remove(r.node, name)
+}
+
+func (s *Server) rmdir(r *request) (*reply, error) {
+	name := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return newReply(0), s.vol.Rmdir(r.node, name)
+}
+
+func (s *Server) rename(r *request) (*reply, error) {
+	to := r.uint64()
+	fromName := r.name()
+	toName := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return newReply(0), s.vol.Rename(r.node, fromName, to, toName)
+}
+
+func (s *Server) link(r *request) (*reply, error) {
+	id := r.uint64()
+	name := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	n, err := s.vol.Link(r.node, name, id)
+	if err != nil {
+		return nil, err
+	}
+	s.withWrites(n)
+	return s.entry(n), nil
+}
+
+// openReply returns the fuse_open_out of the handle fh. The kernel drops
+// the pages it has cached of a file whenever it's opened.
+func openReply(out *reply, fh uint64) *reply {
+	out.uint64(fh)
+	out.uint32(0)
+	out.uint32(0)
+	return out
+}
+
+func (s *Server) openOp(r *request) (*reply, error) {
+	n, err := s.vol.GetNode(r.node)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := s.open(n)
+	if err != nil {
+		return nil, err
+	}
+	return openReply(newReply(openOutSize), fh), nil
+}
+
+func (s *Server) create(r *request) (*reply, error) {
+	flags := r.uint32()
+	mode := r.uint32()
+	// umask, which the kernel has applied, and padding
+	r.uint32()
+	r.uint32()
+	name := r.name()
+	if r.err != nil {
+		return nil, r.err
+	}
+	n, err := s.makeNode(r, name, 0, fileMode(mode), "")
+	if err == torus.ErrExists && flags&syscall.O_EXCL == 0 {
+		// Another host made it first.
+		n, err = s.vol.Lookup(r.node, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fh, err := s.open(n)
+	if err != nil {
+		return nil, err
+	}
+	s.withWrites(n)
+	out := newReply(entryOutSize + openOutSize)
+	out.entry(n)
+	return openReply(out, fh), nil
+}
+
+func (s *Server) read(r *request) (*reply, error) {
+	fh := r.uint64()
+	off := r.uint64()
+	size := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if size > maxWrite {
+		size = maxWrite
+	}
+	of, err := s.file(fh)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rlock(of); err != nil {
+		return nil, err
+	}
+	out := newReply(int(size))
+	buf := out.buf[outHeaderSize : outHeaderSize+int(size)]
+	n, err := of.f.ReadAt(buf, int64(off))
+	of.mu.RUnlock()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	out.buf = out.buf[:outHeaderSize+n]
+	return out, nil
+}
+
+func (s *Server) write(r *request) (*reply, error) {
+	fh := r.uint64()
+	off := r.uint64()
+	size := r.uint32()
+	// write_flags, lock_owner, flags and padding
+	r.uint32()
+	r.uint64()
+	r.uint32()
+	r.uint32()
+	data := r.take(int(size))
+	if r.err != nil {
+		return nil, r.err
+	}
+	if off+uint64(size) > maxFileSize {
+		return nil, syscall.EFBIG
+	}
+	of, err := s.file(fh)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rlock(of); err != nil {
+		return nil, err
+	}
+	_, err = of.f.WriteAt(data, int64(off))
+	atomic.StoreInt64(&of.wtime, time.Now().UnixNano())
+	of.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	out := newReply(8)
+	out.uint32(size)
+	out.uint32(0)
+	return out, nil
+}
+
+// Sizes reported by statfs.
+const (
+	statfsBlockSize = 4096
+	// fileSlots is how many nodes a volume is said to have room for.
+	fileSlots = 1 << 32
+)
+
+func (s *Server) statfs(r *request) (*reply, error) {
+	total, free, err := s.vol.Statfs()
+	if err != nil {
+		return nil, err
+	}
+	out := newReply(80)
+	out.uint64(total / statfsBlockSize)
+	out.uint64(free / statfsBlockSize)
+	out.uint64(free / statfsBlockSize)
+	out.uint64(fileSlots)
+	out.uint64(fileSlots)
+	out.uint32(statfsBlockSize)
+	out.uint32(fs.MaxNameLen)
+	out.uint32(statfsBlockSize)
+	// padding and spare
+	for i := 0; i < 7; i++ {
+		out.uint32(0)
+	}
+	return out, nil
+}
+
+func (s *Server) releaseOp(r *request) (*reply, error) {
+	fh := r.uint64()
+	if r.err != nil {
+		return nil, r.err
+	}
+	// Errors are only logged, as nothing is waiting for them.
+	s.release(fh)
+	return newReply(0), nil
+}
+
+// fsync syncs a file's writes, when it's flushed on close as well as on
+// fsync(2), so that they're seen by those who open it afterwards.
+func (s *Server) fsync(r *request) (*reply, error) {
+	fh := r.uint64()
+	if r.err != nil {
+		return nil, r.err
+	}
+	of, err := s.file(fh)
+	if err != nil {
+		return nil, err
+	}
+	of.mu.Lock()
+	defer of.mu.Unlock()
+	return newReply(0), s.syncLocked(of)
+}
+
+func (s *Server) opendir(r *request) (*reply, error) {
+	n, err := s.vol.GetNode(r.node)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDir() {
+		return nil, torus.ErrNotDir
+	}
+	s.mu.Lock()
+	s.nextHandle++
+	fh := s.nextHandle
+	s.dirs[fh] = &dirHandle{id: n.ID}
+	s.mu.Unlock()
+	return openReply(newReply(openOutSize), fh), nil
+}
+
+// readdirBatch is how many entries are read from the metadata at a time.
+const readdirBatch = 64
+
+func (s *Server) readdir(r *request) (*reply, error) {
+	fh := r.uint64()
+	off := r.uint64()
+	size := int(r.uint32())
+	if r.err != nil {
+		return nil, r.err
+	}
+	s.mu.Lock()
+	dh, ok := s.dirs[fh]
+	s.mu.Unlock()
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	out := newReply(size)
+	if off < 1 && !out.dirent(size, dh.id, 1, ".") {
+		return out, nil
+	}
+	if off < 2 {
+		n, err := s.vol.GetNode(dh.id)
+		if err != nil {
+			return nil, err
+		}
+		if !out.dirent(size, n.Parent, 2, "..") {
+			return out, nil
+		}
+	}
+	// Reading carries on after the entry at off, forgetting those read
+	// after it before.
+	var after string
+	if off >= 3 {
+		i := off - 3
+		if i >= uint64(len(dh.names)) {
+			return nil, syscall.EINVAL
+		}
+		after = dh.names[i]
+		dh.names = dh.names[:i+1]
+	} else {
+		dh.names = dh.names[:0]
+	}
+	for {
+		ents, err := s.vol.ReadDir(dh.id, after, readdirBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, ent := range ents {
+			if !out.dirent(size, ent.ID, uint64(len(dh.names)+3), ent.Name) {
+				return out, nil
+			}
+			dh.names = append(dh.names, ent.Name)
+			after = ent.Name
+		}
+		if len(ents) < readdirBatch {
+			return out, nil
+		}
+	}
+}
+
+func (s *Server) releasedir(r *request) (*reply, error) {
+	fh := r.uint64()
+	if r.err != nil {
+		return nil, r.err
+	}
+	s.mu.Lock()
+	delete(s.dirs, fh)
+	s.mu.Unlock()
+	return newReply(0), nil
+}
+
+// fsyncdir has nothing to do: changes to directories are made in the
+// metadata straight away.
+func (s *Server) fsyncdir(r *request) (*reply, error) {
+	return newReply(0), nil
+}
@@ -0,0 +1,311 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/coreos/torus/fs"
+)
+
+// The version of the kernel protocol spoken: 7.12, from Linux 2.6.29, which
+// the layouts of the messages below are for.
+const (
+	kernelVersion      = 7
+	kernelMinorVersion = 12
+)
+
+// Opcodes of the requests the kernel makes.
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opReadlink    = 5
+	opSymlink     = 6
+	opMknod       = 8
+	opMkdir       = 9
+	opUnlink      = 10
+	opRmdir       = 11
+	opRename      = 12
+	opLink        = 13
+	opOpen        = 14
+	opRead        = 15
+	opWrite       = 16
+	opStatfs      = 17
+	opRelease     = 18
+	opFsync       = 20
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opFsyncdir    = 30
+	opCreate      = 35
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+)
+
+// Flags of the INIT reply.
+const (
+	initAsyncRead = 1 << 0
+	initBigWrites = 1 << 5
+)
+
+// Bits of setattr_in.valid.
+const (
+	setattrMode     = 1 << 0
+	setattrUID      = 1 << 1
+	setattrGID      = 1 << 2
+	setattrSize     = 1 << 3
+	setattrAtime    = 1 << 4
+	setattrMtime    = 1 << 5
+	setattrAtimeNow = 1 << 7
+	setattrMtimeNow = 1 << 8
+)
+
+// Sizes of the fixed parts of messages.
+const (
+	inHeaderSize  = 40
+	outHeaderSize = 16
+	attrSize      = 88
+	entryOutSize  = 40 + attrSize
+	attrOutSize   = 16 + attrSize
+	openOutSize   = 16
+	direntSize    = 24
+)
+
+// Types of directory entries.
+const (
+	dtUnknown = 0
+)
+
+var (
+	// errShort is returned for requests shorter than their opcode
+	// needs.
+	errShort = errors.New("fuse: short request")
+	// errProtocol is returned by Serve if the kernel's protocol is
+	// too old.
+	errProtocol = errors.New("fuse: kernel protocol too old")
+)
+
+// request is a request from the kernel.
+type request struct {
+	opcode uint32
+	unique uint64
+	node   uint64
+	uid    uint32
+	gid    uint32
+	// body is what follows the header, which reads consume.
+	body []byte
+	err  error
+}
+
+func parseRequest(b []byte) (*request, error) {
+	if len(b) < inHeaderSize {
+		return nil, errShort
+	}
+	if n := binary.LittleEndian.Uint32(b); int(n) != len(b) {
+		return nil, errShort
+	}
+	return &request{
+		opcode: binary.LittleEndian.Uint32(b[4:]),
+		unique: binary.LittleEndian.Uint64(b[8:]),
+		node:   binary.LittleEndian.Uint64(b[16:]),
+		uid:    binary.LittleEndian.Uint32(b[24:]),
+		gid:    binary.LittleEndian.Uint32(b[28:]),
+		body:   b[inHeaderSize:],
+	}, nil
+}
+
+// take consumes n bytes of the body. Once the body runs out, it returns
+// zeroes and r.err is set.
+func (r *request) take(n int) []byte {
+	if r.err != nil || len(r.body) < n {
+		r.err = errShort
+		return make([]byte, n)
+	}
+	b := r.body[:n]
+	r.body = r.body[n:]
+	return b
+}
+
+func (r *request) uint32() uint32 { return binary.LittleEndian.Uint32(r.take(4)) }
+func (r *request) uint64() uint64 { return binary.LittleEndian.Uint64(r.take(8)) }
+
+// name consumes a NUL-terminated name.
+func (r *request) name() string {
+	for i, c := range r.body {
+		if c == 0 {
+			s := string(r.body[:i])
+			r.body = r.body[i+1:]
+			return s
+		}
+	}
+	r.err = errShort
+	return ""
+}
+
+// reply is a reply being built, starting with room for its header.
+type reply struct {
+	buf []byte
+}
+
+func newReply(size int) *reply {
+	return &reply{buf: make([]byte, outHeaderSize, outHeaderSize+size)}
+}
+
+func (r *reply) uint16(v uint16) {
+	r.buf = append(r.buf, byte(v), byte(v>>8))
+}
+
+func (r *reply) uint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	r.buf = append(r.buf, b[:]...)
+}
+
+func (r *reply) uint64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	r.buf = append(r.buf, b[:]...)
+}
+
+// bytes finishes the reply to unique.
+func (r *reply) bytes(unique uint64) []byte {
+	binary.LittleEndian.PutUint32(r.buf, uint32(len(r.buf)))
+	binary.LittleEndian.PutUint64(r.buf[8:], unique)
+	return r.buf
+}
+
+// errorReply returns the reply failing the request unique with errno.
+func errorReply(unique uint64, errno syscall.Errno) []byte {
+	b := make([]byte, outHeaderSize)
+	binary.LittleEndian.PutUint32(b, outHeaderSize)
+	binary.LittleEndian.PutUint32(b[4:], uint32(-int32(errno)))
+	binary.LittleEndian.PutUint64(b[8:], unique)
+	return b
+}
+
+// Types of node in a Unix mode.
+const (
+	modeReg = syscall.S_IFREG
+	modeDir = syscall.S_IFDIR
+	modeLnk = syscall.S_IFLNK
+)
+
+// unixMode returns the type and permission bits of the node n as in a
+// Unix mode.
+func unixMode(n *fs.Node) uint32 {
+	mode := uint32(n.Mode.Perm())
+	switch {
+	case n.IsDir():
+		mode |= modeDir
+	case n.IsSymlink():
+		mode |= modeLnk
+	default:
+		mode |= modeReg
+	}
+	if n.Mode&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if n.Mode&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if n.Mode&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// fileMode returns the permissions in the Unix mode mode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// dirSize is the size reported for directories.
+const dirSize = 4096
+
+// attr appends the fuse_attr of n.
+func (r *reply) attr(n *fs.Node) {
+	size := n.Size
+	if n.IsDir() {
+		size = dirSize
+	}
+	r.uint64(n.ID)
+	r.uint64(size)
+	r.uint64((size + 511) / 512)
+	r.uint64(uint64(n.Atime.Unix()))
+	r.uint64(uint64(n.Mtime.Unix()))
+	r.uint64(uint64(n.Ctime.Unix()))
+	r.uint32(uint32(n.Atime.Nanosecond()))
+	r.uint32(uint32(n.Mtime.Nanosecond()))
+	r.uint32(uint32(n.Ctime.Nanosecond()))
+	r.uint32(unixMode(n))
+	r.uint32(n.Links)
+	r.uint32(n.UID)
+	r.uint32(n.GID)
+	// rdev, blksize and padding
+	r.uint32(0)
+	r.uint32(0)
+	r.uint32(0)
+}
+
+// splitDuration splits d into seconds and nanoseconds, as the kernel is
+// told how long it may cache things.
+func splitDuration(d time.Duration) (uint64, uint32) {
+	return uint64(d / time.Second), uint32(d % time.Second)
+}
+
+// entry appends the fuse_entry_out of n.
+func (r *reply) entry(n *fs.Node) {
+	sec, nsec := splitDuration(attrValid)
+	r.uint64(n.ID)
+	// generation: node IDs aren't reused.
+	r.uint64(0)
+	r.uint64(sec)
+	r.uint64(sec)
+	r.uint32(nsec)
+	r.uint32(nsec)
+	r.attr(n)
+}
+
+// attrOut appends the fuse_attr_out of n.
+func (r *reply) attrOut(n *fs.Node) {
+	sec, nsec := splitDuration(attrValid)
+	r.uint64(sec)
+	r.uint32(nsec)
+	r.uint32(0)
+	r.attr(n)
+}
+
+// dirent appends a fuse_dirent, padded to 8 bytes, unless it wouldn't fit
+// in max bytes.
+func (r *reply) dirent(max int, id, off uint64, name string) bool {
+	size := direntSize + (len(name)+7)&^7
+	if len(r.buf)-outHeaderSize+size > max {
+		return false
+	}
+	r.uint64(id)
+	r.uint64(off)
+	r.uint32(uint32(len(name)))
+	r.uint32(dtUnknown)
+	r.buf = append(r.buf, name...)
+	for i := len(name); i%8 != 0; i++ {
+		r.buf = append(r.buf, 0)
+	}
+	return true
+}
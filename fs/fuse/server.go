@@ -0,0 +1,385 @@
+// Package fuse serves a torus filesystem volume to the kernel's FUSE
+// driver, so that it can be mounted on the local host as any other
+// filesystem.
+//
+// Permissions are checked by the kernel, from the attributes served, as
+// the mount is made with default_permissions. Writes to a file are synced
+// when it's flushed or closed, so files are consistent between hosts from
+// close to open, as over NFS.
+package fuse
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+)
+
+const (
+	// maxWrite is the most data written by one request.
+	maxWrite = 128 << 10
+	// readSize is the size of the buffer requests are read into, which
+	// the kernel needs to have room for the largest write.
+	readSize = maxWrite + 4096
+	// maxInflight is how many requests may be served at once.
+	maxInflight = 16
+	// attrValid is how long the kernel may cache attributes and names.
+	attrValid = time.Second
+)
+
+// Server serves a filesystem volume to the kernel.
+type Server struct {
+	vol *fs.Volume
+
+	mu     sync.Mutex
+	closed bool
+	// nextHandle is the last handle given to an open file or directory.
+	nextHandle uint64
+	// handles holds the open files by handle, and nodes by node.
+	handles map[uint64]*openFile
+	nodes   map[uint64]*openFile
+	dirs    map[uint64]*dirHandle
+}
+
+// NewServer creates a Server for the volume vol, which it doesn't close.
+func NewServer(vol *fs.Volume) *Server {
+	return &Server{
+		vol:     vol,
+		handles: make(map[uint64]*openFile),
+		nodes:   make(map[uint64]*openFile),
+		dirs:    make(map[uint64]*dirHandle),
+	}
+}
+
+// Serve serves the requests read from dev, the connection to the kernel
+// returned by Mount, until the filesystem is unmounted. Each read of dev
+// must return a single request, and each write to it takes a single reply.
+func (s *Server) Serve(dev io.ReadWriter) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, maxInflight)
+	for {
+		buf := make([]byte, readSize)
+		n, err := dev.Read(buf)
+		if err != nil {
+			switch errnoOf(err) {
+			case syscall.EINTR, syscall.EAGAIN, syscall.ENOENT:
+				// ENOENT means the request was interrupted
+				// before it was read.
+				continue
+			case syscall.ENODEV:
+				return nil
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		r, err := parseRequest(buf[:n])
+		if err != nil {
+			log.Printf("fuse: %s", err)
+			continue
+		}
+		switch r.opcode {
+		case opInit:
+			// Nothing else is sent until INIT is answered.
+			out, err := s.init(r)
+			if werr := s.reply(dev, r, out, err); werr != nil {
+				return werr
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		case opDestroy:
+			s.reply(dev, r, newReply(0), nil)
+			return nil
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := s.handle(r)
+			s.reply(dev, r, out, err)
+			<-sem
+		}()
+	}
+}
+
+// reply writes the reply to r, unless it needs none, which is when out is
+// nil and err isn't set.
+func (s *Server) reply(dev io.Writer, r *request, out *reply, err error) error {
+	var b []byte
+	switch {
+	case err != nil:
+		b = errorReply(r.unique, errno(err))
+	case out == nil:
+		return nil
+	default:
+		b = out.bytes(r.unique)
+	}
+	if _, err := dev.Write(b); err != nil && errnoOf(err) != syscall.ENOENT {
+		// ENOENT means the request was interrupted, and has gone.
+		log.Printf("fuse: replying to request %d: %s", r.unique, err)
+		return err
+	}
+	return nil
+}
+
+// errnoOf returns the errno of an error from reading or writing the
+// device, or 0.
+func errnoOf(err error) syscall.Errno {
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e
+	case *os.PathError:
+		return errnoOf(e.Err)
+	case *os.SyscallError:
+		return errnoOf(e.Err)
+	}
+	return 0
+}
+
+// errno returns the errno the kernel is given for err.
+func errno(err error) syscall.Errno {
+	switch err {
+	case torus.ErrNotExist:
+		return syscall.ENOENT
+	case torus.ErrExists:
+		return syscall.EEXIST
+	case torus.ErrNotDir:
+		return syscall.ENOTDIR
+	case fs.ErrIsDir:
+		return syscall.EISDIR
+	case fs.ErrNotEmpty:
+		return syscall.ENOTEMPTY
+	case fs.ErrNameTooLong:
+		return syscall.ENAMETOOLONG
+	case errProtocol:
+		return syscall.EPROTO
+	case fs.ErrInvalidName, torus.ErrInvalid, errShort:
+		return syscall.EINVAL
+	case torus.ErrNotSupported:
+		return syscall.EOPNOTSUPP
+	case torus.ErrLocked:
+		return syscall.EROFS
+	case torus.ErrAgain:
+		return syscall.EAGAIN
+	case torus.ErrOutOfSpace, torus.ErrClusterFull:
+		return syscall.ENOSPC
+	case fs.ErrConflict:
+		// The writes have been logged as lost already.
+		return syscall.EIO
+	}
+	if e, ok := err.(syscall.Errno); ok {
+		return e
+	}
+	log.Printf("fuse: %s", err)
+	return syscall.EIO
+}
+
+// Close syncs the writes to files the kernel hasn't released, and closes
+// them. It's called once Serve has returned.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	nodes := s.nodes
+	s.nodes = make(map[uint64]*openFile)
+	s.handles = make(map[uint64]*openFile)
+	s.dirs = make(map[uint64]*dirHandle)
+	s.mu.Unlock()
+
+	var err error
+	for _, of := range nodes {
+		of.mu.Lock()
+		if serr := s.syncLocked(of); serr != nil && err == nil {
+			err = serr
+		}
+		if of.f != nil {
+			of.f.Close()
+			of.f = nil
+		}
+		of.mu.Unlock()
+	}
+	return err
+}
+
+// getNode returns the node id, with the size and modification time the
+// writes to it which haven't been synced give it.
+func (s *Server) getNode(id uint64) (*fs.Node, error) {
+	n, err := s.vol.GetNode(id)
+	if err != nil {
+		return nil, err
+	}
+	s.withWrites(n)
+	return n, nil
+}
+
+// withWrites sets the size and modification time of n to those the writes
+// to it which haven't been synced give it.
+func (s *Server) withWrites(n *fs.Node) {
+	s.mu.Lock()
+	of := s.nodes[n.ID]
+	s.mu.Unlock()
+	if of == nil {
+		return
+	}
+	of.mu.RLock()
+	if of.f != nil && of.f.Dirty() {
+		n.Size = of.f.Size()
+		n.Mtime = time.Unix(0, atomic.LoadInt64(&of.wtime))
+	}
+	of.mu.RUnlock()
+}
+
+// openFile is a file opened by the kernel, through one or more handles.
+type openFile struct {
+	id uint64
+	// handles is guarded by the Server's mu.
+	handles int
+
+	// mu is held to use f, and held exclusively to sync or replace it.
+	mu sync.RWMutex
+	// f is nil once the file has been dropped after a failed sync.
+	f *fs.File
+	// wtime is when the file was last written, in Unix nanoseconds.
+	wtime int64
+}
+
+// rlock locks of for reading, opening the file again if it was dropped.
+func (s *Server) rlock(of *openFile) error {
+	for {
+		of.mu.RLock()
+		if of.f != nil {
+			return nil
+		}
+		of.mu.RUnlock()
+		of.mu.Lock()
+		if of.f == nil {
+			f, err := s.vol.OpenFile(of.id)
+			if err != nil {
+				of.mu.Unlock()
+				return err
+			}
+			of.f = f
+		}
+		of.mu.Unlock()
+	}
+}
+
+// open opens the node n for a new handle, returning the handle. If the file
+// is already open, with no writes, but was synced elsewhere since, it's
+// opened again, so that it's read as it now is.
+func (s *Server) open(n *fs.Node) (uint64, error) {
+	s.mu.Lock()
+	of, ok := s.nodes[n.ID]
+	if !ok {
+		of = &openFile{id: n.ID}
+		s.nodes[n.ID] = of
+	}
+	of.handles++
+	s.nextHandle++
+	fh := s.nextHandle
+	s.handles[fh] = of
+	s.mu.Unlock()
+
+	of.mu.Lock()
+	if of.f != nil && !of.f.Dirty() && !of.f.Current(n) {
+		of.f.Close()
+		of.f = nil
+	}
+	var err error
+	if of.f == nil {
+		of.f, err = s.vol.OpenFile(n.ID)
+	}
+	of.mu.Unlock()
+	if err != nil {
+		s.release(fh)
+		return 0, err
+	}
+	return fh, nil
+}
+
+// file returns the file open as fh.
+func (s *Server) file(fh uint64) (*openFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	of, ok := s.handles[fh]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return of, nil
+}
+
+// release closes the handle fh. Once a file has no handles left, its
+// writes are synced and it's closed.
+func (s *Server) release(fh uint64) error {
+	s.mu.Lock()
+	of, ok := s.handles[fh]
+	if !ok {
+		s.mu.Unlock()
+		return syscall.EBADF
+	}
+	delete(s.handles, fh)
+	of.handles--
+	last := of.handles == 0
+	s.mu.Unlock()
+	if !last {
+		return nil
+	}
+	of.mu.Lock()
+	err := s.syncLocked(of)
+	if of.f != nil {
+		of.f.Close()
+		of.f = nil
+	}
+	of.mu.Unlock()
+	// The file is only forgotten once it's synced, so that it isn't
+	// opened again as it was before.
+	s.mu.Lock()
+	if of.handles == 0 && s.nodes[of.id] == of {
+		delete(s.nodes, of.id)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// syncLocked syncs the writes to of. If they're lost, the File is dropped,
+// to be opened again. of.mu must be held exclusively.
+func (s *Server) syncLocked(of *openFile) error {
+	if of.f == nil || !of.f.Dirty() {
+		return nil
+	}
+	err := of.f.Sync()
+	if err == nil {
+		return nil
+	}
+	of.f.Close()
+	of.f = nil
+	// The writes to a file which has been removed don't matter.
+	if err == torus.ErrNotExist {
+		return nil
+	}
+	log.Printf("fuse: writes to file %d of volume %s lost: %s", of.id, s.vol.Name(), err)
+	return err
+}
+
+// dirHandle is a directory opened by the kernel to read.
+type dirHandle struct {
+	id uint64
+
+	mu sync.Mutex
+	// names holds the entries read so far. The offset of each is its
+	// index plus 3, after those of "." and "..".
+	names []string
+}
@@ -0,0 +1,444 @@
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+	_ "github.com/coreos/torus/metadata/temp"
+	_ "github.com/coreos/torus/storage"
+)
+
+// testDev stands in for /dev/fuse, passing whole messages.
+type testDev struct {
+	reqs    chan []byte
+	replies chan []byte
+}
+
+func (d *testDev) Read(p []byte) (int, error) {
+	b, ok := <-d.reqs
+	if !ok {
+		return 0, syscall.ENODEV
+	}
+	return copy(p, b), nil
+}
+
+func (d *testDev) Write(p []byte) (int, error) {
+	d.replies <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// kernel makes requests as the kernel would, one at a time.
+type kernel struct {
+	t      *testing.T
+	dev    *testDev
+	unique uint64
+	// uid and gid are those of the process making requests.
+	uid, gid uint32
+	served   chan error
+}
+
+// args builds the body of a request.
+type args struct {
+	buf []byte
+}
+
+func (a *args) u32(v uint32) *args {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	a.buf = append(a.buf, b[:]...)
+	return a
+}
+
+func (a *args) u64(v uint64) *args {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	a.buf = append(a.buf, b[:]...)
+	return a
+}
+
+func (a *args) name(s string) *args {
+	a.buf = append(append(a.buf, s...), 0)
+	return a
+}
+
+func (a *args) bytes(b []byte) *args {
+	a.buf = append(a.buf, b...)
+	return a
+}
+
+// newMount serves the volume name of srv, creating it if it doesn't exist,
+// and returns the kernel it's mounted by, which has sent INIT.
+func newMount(t *testing.T, srv *torus.Server, name string) (*kernel, func()) {
+	if err := fs.CreateFSVolume(srv.MDS, name); err != nil && err != torus.ErrExists {
+		t.Fatal(err)
+	}
+	vol, err := fs.OpenFSVolume(srv, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(vol)
+	k := &kernel{
+		t:      t,
+		dev:    &testDev{reqs: make(chan []byte), replies: make(chan []byte, 1)},
+		served: make(chan error, 1),
+	}
+	go func() { k.served <- s.Serve(k.dev) }()
+	k.expect(0, opInit, 0, new(args).u32(7).u32(31).u32(128<<10).u32(initAsyncRead|1<<30))
+	return k, func() {
+		close(k.dev.reqs)
+		if err := <-k.served; err != nil {
+			t.Error(err)
+		}
+		s.Close()
+		vol.Close()
+	}
+}
+
+// call makes a request of the node, returning the errno and body of the
+// reply.
+func (k *kernel) call(opcode uint32, node uint64, a *args) (syscall.Errno, *request) {
+	k.unique++
+	var body []byte
+	if a != nil {
+		body = a.buf
+	}
+	h := new(args).u32(uint32(inHeaderSize + len(body))).u32(opcode).u64(k.unique).u64(node).u32(k.uid).u32(k.gid).u32(1).u32(0)
+	k.dev.reqs <- append(h.buf, body...)
+	b := <-k.dev.replies
+	if len(b) < outHeaderSize || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		k.t.Fatalf("bad reply to opcode %d", opcode)
+	}
+	if u := binary.LittleEndian.Uint64(b[8:]); u != k.unique {
+		k.t.Fatalf("reply to request %d, expected %d", u, k.unique)
+	}
+	errno := syscall.Errno(-int32(binary.LittleEndian.Uint32(b[4:])))
+	return errno, &request{body: b[outHeaderSize:]}
+}
+
+// expect makes a request, failing unless it returns errno.
+func (k *kernel) expect(errno syscall.Errno, opcode uint32, node uint64, a *args) *request {
+	e, r := k.call(opcode, node, a)
+	if e != errno {
+		k.t.Fatalf("opcode %d on node %d returned %v, expected %v", opcode, node, e, errno)
+	}
+	return r
+}
+
+// attr is the part of a fuse_attr the tests look at.
+type attr struct {
+	id, size     uint64
+	mode         uint32
+	links        uint32
+	uid, gid     uint32
+	atime, mtime uint64
+}
+
+func parseAttr(r *request) attr {
+	var a attr
+	a.id = r.uint64()
+	a.size = r.uint64()
+	r.uint64()
+	a.atime = r.uint64()
+	a.mtime = r.uint64()
+	r.take(8 + 12)
+	a.mode = r.uint32()
+	a.links = r.uint32()
+	a.uid = r.uint32()
+	a.gid = r.uint32()
+	r.take(12)
+	return a
+}
+
+// parseEntry parses a fuse_entry_out.
+func parseEntry(r *request) attr {
+	r.take(40)
+	return parseAttr(r)
+}
+
+func (k *kernel) lookup(dir uint64, name string) attr {
+	return parseEntry(k.expect(0, opLookup, dir, new(args).name(name)))
+}
+
+func (k *kernel) getattr(id uint64) attr {
+	r := k.expect(0, opGetattr, id, new(args).u32(0).u32(0).u64(0))
+	r.take(16)
+	return parseAttr(r)
+}
+
+// create makes a file with mode 0644, and returns it and its handle.
+func (k *kernel) create(dir uint64, name string) (attr, uint64) {
+	r := k.expect(0, opCreate, dir, new(args).u32(syscall.O_RDWR|syscall.O_CREAT).u32(syscall.S_IFREG|0644).u32(022).u32(0).name(name))
+	a := parseEntry(r)
+	return a, r.uint64()
+}
+
+func (k *kernel) mkdir(dir uint64, name string, mode uint32) attr {
+	return parseEntry(k.expect(0, opMkdir, dir, new(args).u32(mode).u32(022).name(name)))
+}
+
+func (k *kernel) open(id uint64) uint64 {
+	return k.expect(0, opOpen, id, new(args).u32(syscall.O_RDWR).u32(0)).uint64()
+}
+
+func (k *kernel) write(id, fh, off uint64, data []byte) {
+	r := k.expect(0, opWrite, id, new(args).u64(fh).u64(off).u32(uint32(len(data))).u32(0).u64(0).u32(0).u32(0).bytes(data))
+	if n := r.uint32(); n != uint32(len(data)) {
+		k.t.Fatalf("wrote %d bytes, expected %d", n, len(data))
+	}
+}
+
+func (k *kernel) read(id, fh, off uint64, size uint32) []byte {
+	r := k.expect(0, opRead, id, new(args).u64(fh).u64(off).u32(size).u32(0).u64(0).u32(0).u32(0))
+	return r.body
+}
+
+func (k *kernel) flush(id, fh uint64) syscall.Errno {
+	e, _ := k.call(opFlush, id, new(args).u64(fh).u32(0).u32(0).u64(0))
+	return e
+}
+
+func (k *kernel) release(id, fh uint64) {
+	k.expect(0, opRelease, id, new(args).u64(fh).u32(0).u32(0).u64(0))
+}
+
+// readdir lists dir size bytes at a time.
+func (k *kernel) readdir(dir uint64, size uint32) []string {
+	fh := k.expect(0, opOpendir, dir, new(args).u32(0).u32(0)).uint64()
+	var names []string
+	var off uint64
+	for {
+		r := k.expect(0, opReaddir, dir, new(args).u64(fh).u64(off).u32(size).u32(0).u64(0).u32(0).u32(0))
+		if len(r.body) == 0 {
+			break
+		}
+		for len(r.body) > 0 {
+			r.uint64()
+			off = r.uint64()
+			n := r.uint32()
+			r.uint32()
+			names = append(names, string(r.take(int(n))))
+			r.take(int((n+7)&^7 - n))
+		}
+		if r.err != nil {
+			k.t.Fatal(r.err)
+		}
+	}
+	k.expect(0, opReleasedir, dir, new(args).u64(fh).u32(0).u32(0).u64(0))
+	return names
+}
+
+func TestInit(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	if err := fs.CreateFSVolume(srv.MDS, "vol"); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := fs.OpenFSVolume(srv, "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+
+	k := &kernel{
+		t:      t,
+		dev:    &testDev{reqs: make(chan []byte), replies: make(chan []byte, 1)},
+		served: make(chan error, 1),
+	}
+	go func() { k.served <- NewServer(vol).Serve(k.dev) }()
+	k.expect(syscall.EPROTO, opInit, 0, new(args).u32(7).u32(8).u32(0).u32(0))
+	if err := <-k.served; err != errProtocol {
+		t.Fatalf("serving an old kernel returned %v", err)
+	}
+
+	k, done := newMount(t, srv, "vol")
+	defer done()
+	k.expect(syscall.ENOSYS, 22, fs.RootID, new(args).u32(0).u32(0).name("user.x"))
+	if a := k.getattr(fs.RootID); a.id != fs.RootID || a.mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Fatalf("root has attributes %+v", a)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	k, done := newMount(t, srv, "vol")
+	defer done()
+
+	f, fh := k.create(fs.RootID, "file")
+	if f.mode != syscall.S_IFREG|0644 || f.size != 0 {
+		t.Fatalf("created file has attributes %+v", f)
+	}
+	data := bytes.Repeat([]byte("torus"), 100000)
+	for off := 0; off < len(data); off += maxWrite {
+		end := off + maxWrite
+		if end > len(data) {
+			end = len(data)
+		}
+		k.write(f.id, fh, uint64(off), data[off:end])
+	}
+	if a := k.getattr(f.id); a.size != uint64(len(data)) {
+		t.Fatalf("file has size %d before it's synced, expected %d", a.size, len(data))
+	}
+	fh2 := k.open(f.id)
+	if got := k.read(f.id, fh2, 5, 10); string(got) != "torustorus" {
+		t.Fatalf("read %q from another handle", got)
+	}
+	if got := k.read(f.id, fh2, uint64(len(data)-3), 10); string(got) != "rus" {
+		t.Fatalf("read %q at the end of the file", got)
+	}
+	if e := k.flush(f.id, fh); e != 0 {
+		t.Fatalf("flush returned %v", e)
+	}
+	k.release(f.id, fh)
+	k.release(f.id, fh2)
+
+	// Another host sees the file once it's closed.
+	k2, done2 := newMount(t, srv, "vol")
+	defer done2()
+	a := k2.lookup(fs.RootID, "file")
+	if a.id != f.id || a.size != uint64(len(data)) {
+		t.Fatalf("file looked up elsewhere has attributes %+v", a)
+	}
+	fh = k2.open(a.id)
+	var got []byte
+	for off := 0; off < len(data); off += maxWrite {
+		got = append(got, k2.read(a.id, fh, uint64(off), maxWrite)...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file read elsewhere differs")
+	}
+	k2.release(a.id, fh)
+
+	// Truncating through an open file keeps its writes.
+	fh = k.open(f.id)
+	k.write(f.id, fh, 0, []byte("TORUS"))
+	k.expect(0, opSetattr, f.id, new(args).u32(setattrSize).u32(0).u64(fh).u64(8).bytes(make([]byte, 64)))
+	if e := k.flush(f.id, fh); e != 0 {
+		t.Fatalf("flush returned %v", e)
+	}
+	k.release(f.id, fh)
+	fh = k2.open(f.id)
+	if got := k2.read(f.id, fh, 0, 100); string(got) != "TORUStor" {
+		t.Fatalf("read %q after truncating", got)
+	}
+	k2.release(f.id, fh)
+}
+
+func TestConflictingWrites(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	k1, done1 := newMount(t, srv, "vol")
+	defer done1()
+	k2, done2 := newMount(t, srv, "vol")
+	defer done2()
+
+	f, fh := k1.create(fs.RootID, "file")
+	k1.release(f.id, fh)
+
+	fh1 := k1.open(f.id)
+	fh2 := k2.open(f.id)
+	k1.write(f.id, fh1, 0, []byte("one"))
+	k2.write(f.id, fh2, 0, []byte("two"))
+	if e := k1.flush(f.id, fh1); e != 0 {
+		t.Fatalf("first flush returned %v", e)
+	}
+	if e := k2.flush(f.id, fh2); e != syscall.EIO {
+		t.Fatalf("conflicting flush returned %v", e)
+	}
+	// The handle now reads the file as it was synced.
+	if got := k2.read(f.id, fh2, 0, 10); string(got) != "one" {
+		t.Fatalf("read %q after a conflict", got)
+	}
+	k1.release(f.id, fh1)
+	k2.release(f.id, fh2)
+}
+
+func TestDirectories(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	k, done := newMount(t, srv, "vol")
+	defer done()
+
+	d := k.mkdir(fs.RootID, "dir", 0755)
+	if d.mode != syscall.S_IFDIR|0755 || d.links != 2 {
+		t.Fatalf("made directory with attributes %+v", d)
+	}
+	k.expect(syscall.EEXIST, opMkdir, fs.RootID, new(args).u32(0755).u32(0).name("dir"))
+	k.expect(syscall.ENOENT, opLookup, fs.RootID, new(args).name("missing"))
+
+	var want []string
+	for i := 0; i < 100; i++ {
+		name := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		f, fh := k.create(d.id, name)
+		k.release(f.id, fh)
+		want = append(want, name)
+	}
+	sort.Strings(want)
+	got := k.readdir(d.id, 256)
+	if len(got) != len(want)+2 || got[0] != "." || got[1] != ".." {
+		t.Fatalf("listed %d entries: %v", len(got), got)
+	}
+	for i, name := range want {
+		if got[i+2] != name {
+			t.Fatalf("listed %v, expected %v", got[2:], want)
+		}
+	}
+
+	k.expect(0, opSymlink, d.id, new(args).name("link").name("aa"))
+	l := k.lookup(d.id, "link")
+	if r := k.expect(0, opReadlink, l.id, nil); string(r.body) != "aa" {
+		t.Fatalf("readlink returned %q", r.body)
+	}
+	k.expect(syscall.EPERM, opMknod, d.id, new(args).u32(syscall.S_IFIFO|0644).u32(0).u32(0).u32(0).name("fifo"))
+
+	k.expect(syscall.ENOTEMPTY, opRmdir, fs.RootID, new(args).name("dir"))
+	k.expect(0, opRename, d.id, new(args).u64(fs.RootID).name("aa").name("moved"))
+	k.expect(0, opLink, fs.RootID, new(args).u64(k.lookup(fs.RootID, "moved").id).name("again"))
+	if a := k.lookup(fs.RootID, "again"); a.links != 2 {
+		t.Fatalf("linked file has %d links", a.links)
+	}
+	for _, name := range append(want[1:], "link") {
+		k.expect(0, opUnlink, d.id, new(args).name(name))
+	}
+	k.expect(0, opRmdir, fs.RootID, new(args).name("dir"))
+	got = k.readdir(fs.RootID, 4096)
+	if len(got) != 4 || got[2] != "again" || got[3] != "moved" {
+		t.Fatalf("root lists %v", got)
+	}
+}
+
+func TestSetattr(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	k, done := newMount(t, srv, "vol")
+	defer done()
+	k.uid, k.gid = 1000, 1000
+
+	d := k.mkdir(fs.RootID, "shared", 02775)
+	if d.uid != 1000 || d.mode != syscall.S_IFDIR|syscall.S_ISGID|0775 {
+		t.Fatalf("made directory with attributes %+v", d)
+	}
+	k.gid = 2000
+	f, fh := k.create(d.id, "file")
+	k.release(f.id, fh)
+	if f.gid != 1000 {
+		t.Fatalf("file in a setgid directory has group %d", f.gid)
+	}
+
+	r := k.expect(0, opSetattr, f.id, new(args).u32(setattrMode|setattrMtime).u32(0).u64(0).u64(0).u64(0).u64(0).u64(12345).u64(0).u32(0).u32(6789).u32(0).u32(0).u32(0600).u32(0).u32(0).u32(0).u32(0))
+	r.take(16)
+	a := parseAttr(r)
+	if a.mode != syscall.S_IFREG|0600 || a.mtime != 12345 {
+		t.Fatalf("file has attributes %+v after setattr", a)
+	}
+	k.expect(0, opSetattr, f.id, new(args).u32(setattrSize).u32(0).u64(0).u64(100).bytes(make([]byte, 64)))
+	if a := k.getattr(f.id); a.size != 100 {
+		t.Fatalf("file has size %d after truncating", a.size)
+	}
+	k.expect(syscall.EISDIR, opSetattr, d.id, new(args).u32(setattrSize).u32(0).u64(0).u64(100).bytes(make([]byte, 64)))
+}
@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/blockset"
+	"github.com/coreos/torus/gc"
+	"github.com/coreos/torus/models"
+)
+
+func init() {
+	gc.RegisterGC("fs", NewFSGC)
+}
+
+type fsGC struct {
+	srv    *torus.Server
+	inodes gc.INodeFetcher
+	// lows holds, for each filesystem volume, the INode index below which
+	// blocks are garbage unless a file uses them.
+	lows      map[torus.VolumeID]torus.INodeID
+	set       map[torus.BlockRef]bool
+	curINodes map[torus.INodeRef]bool
+}
+
+func NewFSGC(srv *torus.Server, inodes gc.INodeFetcher) (gc.GC, error) {
+	f := &fsGC{
+		srv:    srv,
+		inodes: inodes,
+	}
+	f.Clear()
+	return f, nil
+}
+
+func (f *fsGC) getContext() context.Context {
+	ctx, _ := context.WithTimeout(context.TODO(), 2*time.Second)
+	return f.srv.ExtendContext(ctx)
+}
+
+func (f *fsGC) PrepVolume(vol *models.Volume) error {
+	if vol.Type != VolumeType {
+		return nil
+	}
+	vid := torus.VolumeID(vol.Id)
+	mds, err := createFSMetadata(f.srv.MDS, vol.Name, vid)
+	if err != nil {
+		return err
+	}
+	// The index is read before the marks, so that writes begun after the
+	// marks were read have INodes above it.
+	low, err := f.srv.MDS.GetINodeIndex(vid)
+	if err != nil {
+		return err
+	}
+	marks, err := mds.GetWriteMarks()
+	if err != nil {
+		return err
+	}
+	for _, m := range marks {
+		if m < low {
+			low = m
+		}
+	}
+	nodes, err := mds.GetNodes()
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if len(n.Data) == 0 {
+			continue
+		}
+		ref := torus.INodeRefFromBytes(n.Data)
+		inode, err := f.inodes.GetINode(f.getContext(), ref)
+		if err != nil {
+			return err
+		}
+		set, err := blockset.UnmarshalFromProto(inode.Blocks, nil)
+		if err != nil {
+			return err
+		}
+		for _, b := range set.GetAllBlockRefs() {
+			if !b.IsZero() {
+				f.set[b] = true
+			}
+		}
+		f.curINodes[ref] = true
+	}
+	f.lows[vid] = low
+	return nil
+}
+
+func (f *fsGC) IsDead(ref torus.BlockRef) bool {
+	low, ok := f.lows[ref.Volume()]
+	if !ok {
+		// Not a filesystem volume; if it's been deleted, the other GCs
+		// say so.
+		return false
+	}
+	// It may belong to a write which hasn't been synced yet.
+	if ref.INode > low {
+		return false
+	}
+	if ref.BlockType() == torus.TypeINode {
+		if f.curINodes[torus.NewINodeRef(ref.Volume(), ref.INode)] {
+			return false
+		}
+		if clog.LevelAt(capnslog.TRACE) {
+			clog.Tracef("%s is a dead INode", ref)
+		}
+		return true
+	}
+	if f.set[ref] {
+		return false
+	}
+	if clog.LevelAt(capnslog.TRACE) {
+		clog.Tracef("%s is dead", ref)
+	}
+	return true
+}
+
+func (f *fsGC) Clear() {
+	f.lows = make(map[torus.VolumeID]torus.INodeID)
+	f.set = make(map[torus.BlockRef]bool)
+	f.curINodes = make(map[torus.INodeRef]bool)
+}
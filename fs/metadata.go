@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"errors"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/models"
+)
+
+type fsMetadata interface {
+	torus.MetadataService
+
+	CreateFSVolume(volume *models.Volume, root *Node) error
+	// DeleteVolume deletes the volume, unless it's open.
+	DeleteVolume() error
+
+	GetNode(id uint64) (*Node, error)
+	// GetNodes returns every node in the volume.
+	GetNodes() ([]Node, error)
+	Lookup(dir uint64, name string) (uint64, error)
+	ReadDir(dir uint64, after string, max int) ([]DirEntry, error)
+
+	// Update runs fn with a transaction, and commits the changes it
+	// makes to the tree all at once. If anything fn read changed in the
+	// meantime, fn is run again.
+	Update(fn func(tx fsTxn) error) error
+
+	// SetWriteMark registers an open handle on the volume, and the
+	// lowest INode index its files' writes may have, or 0 if it isn't
+	// writing. It's kept for as long as the lease.
+	SetWriteMark(handle string, mark torus.INodeID, lease int64) error
+	ClearWriteMark(handle string) error
+	// GetWriteMarks returns the marks of the handles which are writing.
+	GetWriteMarks() ([]torus.INodeID, error)
+}
+
+// fsTxn is a view of a volume's tree, in which changes are made to be
+// committed together. Its reads see its own changes.
+type fsTxn interface {
+	getNode(id uint64) (*Node, error)
+	lookup(dir uint64, name string) (uint64, error)
+	// isEmpty reports whether a directory has no entries. The answer
+	// holds as long as the directory node is unchanged, as every change
+	// to its entries also updates it.
+	isEmpty(dir uint64) (bool, error)
+
+	putNode(n *Node)
+	deleteNode(id uint64)
+	putEntry(dir uint64, name string, id uint64)
+	deleteEntry(dir uint64, name string)
+}
+
+func createFSMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (fsMetadata, error) {
+	switch mds.Kind() {
+	case torus.EtcdMetadata:
+		return createFSEtcdMetadata(mds, name, vid)
+	case torus.TempMetadata:
+		return createFSTempMetadata(mds, name, vid)
+	default:
+		return nil, errors.New("unimplemented for this kind of metadata")
+	}
+}
@@ -0,0 +1,279 @@
+package nfs
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+)
+
+// nfsstat3 values.
+const (
+	nfsOK             = 0
+	nfsErrPerm        = 1
+	nfsErrNoEnt       = 2
+	nfsErrIO          = 5
+	nfsErrAcces       = 13
+	nfsErrExist       = 17
+	nfsErrNotDir      = 20
+	nfsErrIsDir       = 21
+	nfsErrInval       = 22
+	nfsErrFBig        = 27
+	nfsErrNoSpc       = 28
+	nfsErrROFS        = 30
+	nfsErrNameTooLong = 63
+	nfsErrNotEmpty    = 66
+	nfsErrStale       = 70
+	nfsErrBadHandle   = 10001
+	nfsErrNotSync     = 10002
+	nfsErrBadCookie   = 10003
+	nfsErrNotSupp     = 10004
+	nfsErrJukebox     = 10008
+)
+
+// errStatus returns the status for err.
+func errStatus(err error) uint32 {
+	switch err {
+	case nil:
+		return nfsOK
+	case torus.ErrNotExist:
+		return nfsErrNoEnt
+	case torus.ErrExists:
+		return nfsErrExist
+	case torus.ErrNotDir:
+		return nfsErrNotDir
+	case fs.ErrIsDir:
+		return nfsErrIsDir
+	case fs.ErrNotEmpty:
+		return nfsErrNotEmpty
+	case fs.ErrNameTooLong:
+		return nfsErrNameTooLong
+	case fs.ErrInvalidName, torus.ErrInvalid:
+		return nfsErrInval
+	case torus.ErrNotSupported:
+		return nfsErrNotSupp
+	case torus.ErrLocked:
+		return nfsErrROFS
+	case torus.ErrAgain, fs.ErrConflict:
+		return nfsErrJukebox
+	case torus.ErrOutOfSpace, torus.ErrClusterFull:
+		return nfsErrNoSpc
+	}
+	log.Printf("nfs: %s", err)
+	return nfsErrIO
+}
+
+// ftype3 values.
+const (
+	nf3Reg = 1
+	nf3Dir = 2
+	nf3Lnk = 5
+)
+
+func fileType(n *fs.Node) uint32 {
+	switch {
+	case n.IsDir():
+		return nf3Dir
+	case n.IsSymlink():
+		return nf3Lnk
+	}
+	return nf3Reg
+}
+
+// Mode bits beyond the permissions.
+const (
+	modeSetuid = 04000
+	modeSetgid = 02000
+	modeSticky = 01000
+)
+
+// unixMode returns the permission bits of m as in a Unix mode.
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= modeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= modeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= modeSticky
+	}
+	return mode
+}
+
+// fileMode returns the permissions in the Unix mode mode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&modeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&modeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// dirSize is the size reported for directories.
+const dirSize = 4096
+
+func encodeTime(e *encoder, t time.Time) {
+	e.uint32(uint32(t.Unix()))
+	e.uint32(uint32(t.Nanosecond()))
+}
+
+func decodeTime(d *decoder) time.Time {
+	sec := d.uint32()
+	nsec := d.uint32()
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// encodeAttrs encodes the fattr3 of n, in the volume vid.
+func encodeAttrs(e *encoder, vid torus.VolumeID, n *fs.Node) {
+	size := n.Size
+	if n.IsDir() {
+		size = dirSize
+	}
+	e.uint32(fileType(n))
+	e.uint32(unixMode(n.Mode))
+	e.uint32(n.Links)
+	e.uint32(n.UID)
+	e.uint32(n.GID)
+	e.uint64(size)
+	e.uint64(size)
+	// rdev
+	e.uint32(0)
+	e.uint32(0)
+	e.uint64(uint64(vid))
+	e.uint64(n.ID)
+	encodeTime(e, n.Atime)
+	encodeTime(e, n.Mtime)
+	encodeTime(e, n.Ctime)
+}
+
+// encodePostOpAttrs encodes a post_op_attr, which is empty if n is nil.
+func encodePostOpAttrs(e *encoder, vid torus.VolumeID, n *fs.Node) {
+	e.bool(n != nil)
+	if n != nil {
+		encodeAttrs(e, vid, n)
+	}
+}
+
+// encodeWcc encodes wcc_data. Attributes from before an operation aren't
+// kept, so clients only get those after it, when n isn't nil.
+func encodeWcc(e *encoder, vid torus.VolumeID, n *fs.Node) {
+	e.bool(false)
+	encodePostOpAttrs(e, vid, n)
+}
+
+// time_how values.
+const (
+	dontChange      = 0
+	setToServerTime = 1
+	setToClientTime = 2
+)
+
+// sattr is a decoded sattr3.
+type sattr struct {
+	fs.SetAttr
+	// clientTime is set if a time is set to one the client chose.
+	clientTime bool
+}
+
+func decodeSattr(d *decoder) sattr {
+	var a sattr
+	if d.bool() {
+		mode := fileMode(d.uint32())
+		a.Mode = &mode
+	}
+	if d.bool() {
+		uid := d.uint32()
+		a.UID = &uid
+	}
+	if d.bool() {
+		gid := d.uint32()
+		a.GID = &gid
+	}
+	if d.bool() {
+		size := d.uint64()
+		a.Size = &size
+	}
+	a.Atime = a.decodeSetTime(d)
+	a.Mtime = a.decodeSetTime(d)
+	return a
+}
+
+func (a *sattr) decodeSetTime(d *decoder) *time.Time {
+	switch how := d.uint32(); how {
+	case dontChange:
+		return nil
+	case setToServerTime:
+		t := time.Now()
+		return &t
+	case setToClientTime:
+		t := decodeTime(d)
+		a.clientTime = true
+		return &t
+	default:
+		if d.err == nil {
+			d.err = errGarbage
+		}
+		return nil
+	}
+}
+
+// ACCESS bits.
+const (
+	accessRead    = 0x01
+	accessLookup  = 0x02
+	accessModify  = 0x04
+	accessExtend  = 0x08
+	accessDelete  = 0x10
+	accessExecute = 0x20
+)
+
+// Permission bits, as in the other, group and owner parts of a mode.
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// permissions returns which of permRead, permWrite and permExec c has on
+// n. Root has every permission, but only executes files something may.
+func permissions(c *cred, n *fs.Node) uint32 {
+	mode := uint32(n.Mode.Perm())
+	if c.uid == 0 {
+		if n.IsDir() || mode&0111 != 0 {
+			return permRead | permWrite | permExec
+		}
+		return permRead | permWrite
+	}
+	switch {
+	case c.uid == n.UID:
+		return mode >> 6 & 7
+	case c.inGroup(n.GID):
+		return mode >> 3 & 7
+	}
+	return mode & 7
+}
+
+// may reports whether c has all of the permissions perm on n.
+func may(c *cred, n *fs.Node, perm uint32) bool {
+	return permissions(c, n)&perm == perm
+}
+
+// mayDelete reports whether c may remove the entry of victim from the
+// directory dir, which it may write. In a sticky directory only the owners
+// of the directory or the victim may.
+func mayDelete(c *cred, dir, victim *fs.Node) bool {
+	if dir.Mode&os.ModeSticky == 0 || c.uid == 0 {
+		return true
+	}
+	return c.uid == dir.UID || c.uid == victim.UID
+}
@@ -0,0 +1,121 @@
+package nfs
+
+import (
+	"sort"
+
+	"github.com/coreos/torus/fs"
+)
+
+// mountstat3 values.
+const (
+	mntOK       = 0
+	mntErrNoEnt = 2
+)
+
+// maxPathLen is the longest path a client may send.
+const maxPathLen = 1024
+
+// mount is a volume a client says it has mounted.
+type mount struct {
+	host string
+	path string
+}
+
+var mountProgram = &program{
+	name: "MOUNT",
+	prog: 100005,
+	vers: 3,
+	procs: []procedure{
+		0: nullProc,
+		1: mountMnt,
+		2: mountDump,
+		3: mountUmnt,
+		4: mountUmntAll,
+		5: mountExport,
+	},
+}
+
+func nullProc(s *Server, c *call, d *decoder, e *encoder) error {
+	return nil
+}
+
+func mountMnt(s *Server, c *call, d *decoder, e *encoder) error {
+	path := d.string(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, ok := s.export(path)
+	if !ok {
+		e.uint32(mntErrNoEnt)
+		return nil
+	}
+	s.mu.Lock()
+	s.mounts[mount{c.host, path}] = true
+	s.mu.Unlock()
+	e.uint32(mntOK)
+	e.opaque(fileHandle(vol.ID(), fs.RootID))
+	e.uint32(1)
+	e.uint32(authSys)
+	return nil
+}
+
+func mountDump(s *Server, c *call, d *decoder, e *encoder) error {
+	s.mu.Lock()
+	var mounts []mount
+	for m := range s.mounts {
+		mounts = append(mounts, m)
+	}
+	s.mu.Unlock()
+	sort.Sort(byHost(mounts))
+	for _, m := range mounts {
+		e.bool(true)
+		e.string(m.host)
+		e.string(m.path)
+	}
+	e.bool(false)
+	return nil
+}
+
+type byHost []mount
+
+func (m byHost) Len() int      { return len(m) }
+func (m byHost) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byHost) Less(i, j int) bool {
+	if m[i].host != m[j].host {
+		return m[i].host < m[j].host
+	}
+	return m[i].path < m[j].path
+}
+
+func mountUmnt(s *Server, c *call, d *decoder, e *encoder) error {
+	path := d.string(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+	s.mu.Lock()
+	delete(s.mounts, mount{c.host, path})
+	s.mu.Unlock()
+	return nil
+}
+
+func mountUmntAll(s *Server, c *call, d *decoder, e *encoder) error {
+	s.mu.Lock()
+	for m := range s.mounts {
+		if m.host == c.host {
+			delete(s.mounts, m)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func mountExport(s *Server, c *call, d *decoder, e *encoder) error {
+	for _, path := range s.paths {
+		e.bool(true)
+		e.string(path)
+		// Every host may mount it.
+		e.bool(false)
+	}
+	e.bool(false)
+	return nil
+}
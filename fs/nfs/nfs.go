@@ -0,0 +1,1134 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+)
+
+var nfsProgram = &program{
+	name: "NFS",
+	prog: 100003,
+	vers: 3,
+	procs: []procedure{
+		0:  nullProc,
+		1:  nfsGetattr,
+		2:  nfsSetattr,
+		3:  nfsLookup,
+		4:  nfsAccess,
+		5:  nfsReadlink,
+		6:  nfsRead,
+		7:  nfsWrite,
+		8:  nfsCreate,
+		9:  nfsMkdir,
+		10: nfsSymlink,
+		11: nfsMknod,
+		12: nfsRemove,
+		13: nfsRmdir,
+		14: nfsRename,
+		15: nfsLink,
+		16: nfsReaddir,
+		17: nfsReaddirplus,
+		18: nfsFsstat,
+		19: nfsFsinfo,
+		20: nfsPathconf,
+		21: nfsCommit,
+	},
+}
+
+var programs = []*program{nfsProgram, mountProgram}
+
+// maxFileSize is the largest a file may be.
+const maxFileSize = math.MaxInt64
+
+// nfsErrXDev is returned for renames and links between volumes.
+const nfsErrXDev = 18
+
+// nodeStatus returns the status for err, from getting the node of a file
+// handle.
+func nodeStatus(err error) uint32 {
+	if err == torus.ErrNotExist {
+		return nfsErrStale
+	}
+	return errStatus(err)
+}
+
+func nfsGetattr(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	e.uint32(st)
+	if st == nfsOK {
+		encodeAttrs(e, vol.ID(), n)
+	}
+	return nil
+}
+
+func nfsSetattr(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	a := decodeSattr(d)
+	guard := d.bool()
+	var ctime time.Time
+	if guard {
+		ctime = decodeTime(d)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	if st == nfsOK && guard && !sameTime(ctime, n.Ctime) {
+		st = nfsErrNotSync
+	}
+	if st == nfsOK {
+		st = s.setattr(&c.cred, vol, n, a)
+	}
+	e.uint32(st)
+	encodeWcc(e, vol.ID(), s.postOpAttrs(vol, id))
+	return nil
+}
+
+// sameTime reports whether a and b are the same to the client.
+func sameTime(a, b time.Time) bool {
+	return uint32(a.Unix()) == uint32(b.Unix()) && a.Nanosecond() == b.Nanosecond()
+}
+
+// setattr changes the attributes of n as c asked.
+func (s *Server) setattr(c *cred, vol *fs.Volume, n *fs.Node, a sattr) uint32 {
+	owner := c.uid == 0 || c.uid == n.UID
+	switch {
+	case a.Mode != nil && !owner:
+		return nfsErrPerm
+	case a.UID != nil && *a.UID != n.UID && c.uid != 0:
+		return nfsErrPerm
+	case a.GID != nil && *a.GID != n.GID && c.uid != 0 && !(owner && c.inGroup(*a.GID)):
+		return nfsErrPerm
+	}
+	if (a.Atime != nil || a.Mtime != nil) && !owner {
+		if a.clientTime {
+			return nfsErrPerm
+		}
+		if !may(c, n, permWrite) {
+			return nfsErrAcces
+		}
+	}
+	if a.Size != nil {
+		switch {
+		case n.IsDir():
+			return nfsErrIsDir
+		case n.IsSymlink():
+			return nfsErrInval
+		case !owner && !may(c, n, permWrite):
+			return nfsErrAcces
+		case *a.Size > maxFileSize:
+			return nfsErrFBig
+		}
+		if err := s.truncate(vol, n, *a.Size); err != nil {
+			return nodeStatus(err)
+		}
+	}
+	rest := a.SetAttr
+	rest.Size = nil
+	if rest == (fs.SetAttr{}) {
+		return nfsOK
+	}
+	_, err := vol.SetAttr(n.ID, rest)
+	return nodeStatus(err)
+}
+
+// conflictRetries is how many times a change is made again when another
+// writer synced the file first.
+const conflictRetries = 3
+
+// truncate changes the size of the file n, through its open file so that
+// it doesn't conflict with the file's unstable writes.
+func (s *Server) truncate(vol *fs.Volume, n *fs.Node, size uint64) error {
+	of := s.openFile(vol, n.ID)
+	defer s.release(of)
+	for try := 1; ; try++ {
+		if err := of.lock(n); err != nil {
+			return err
+		}
+		err := of.f.Truncate(int64(size))
+		if err == nil {
+			err = s.syncLocked(of)
+		}
+		of.mu.Unlock()
+		if err != fs.ErrConflict || try == conflictRetries {
+			return err
+		}
+	}
+}
+
+func nfsLookup(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	name := d.string(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, dir, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	dn, st := s.getNode(vol, dir)
+	var n *fs.Node
+	if st == nfsOK {
+		switch {
+		case !dn.IsDir():
+			st = nfsErrNotDir
+		case !may(&c.cred, dn, permExec):
+			st = nfsErrAcces
+		default:
+			var err error
+			n, err = vol.Lookup(dir, name)
+			st = errStatus(err)
+		}
+	}
+	e.uint32(st)
+	if st == nfsOK {
+		e.opaque(fileHandle(vol.ID(), n.ID))
+		encodePostOpAttrs(e, vol.ID(), s.postOpAttrs(vol, n.ID))
+	}
+	encodePostOpAttrs(e, vol.ID(), dn)
+	return nil
+}
+
+func nfsAccess(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	want := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	e.uint32(st)
+	encodePostOpAttrs(e, vol.ID(), n)
+	if st == nfsOK {
+		e.uint32(want & access(&c.cred, n))
+	}
+	return nil
+}
+
+// access returns the ACCESS bits c has on n.
+func access(c *cred, n *fs.Node) uint32 {
+	p := permissions(c, n)
+	var a uint32
+	if p&permRead != 0 {
+		a |= accessRead
+	}
+	if p&permWrite != 0 {
+		a |= accessModify | accessExtend
+		if n.IsDir() {
+			a |= accessDelete
+		}
+	}
+	if p&permExec != 0 {
+		if n.IsDir() {
+			a |= accessLookup
+		} else {
+			a |= accessExecute
+		}
+	}
+	return a
+}
+
+func nfsReadlink(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	if st == nfsOK && !n.IsSymlink() {
+		st = nfsErrInval
+	}
+	e.uint32(st)
+	encodePostOpAttrs(e, vol.ID(), n)
+	if st == nfsOK {
+		e.string(n.Target)
+	}
+	return nil
+}
+
+// checkFile checks that n is a regular file, which c may use with the
+// permission perm. Owners may always read and write their files, as the
+// client checked their permissions when the file was opened.
+func checkFile(c *cred, n *fs.Node, perm uint32) uint32 {
+	switch {
+	case n.IsDir():
+		return nfsErrIsDir
+	case !n.Mode.IsRegular():
+		return nfsErrInval
+	case c.uid != n.UID && !may(c, n, perm):
+		return nfsErrAcces
+	}
+	return nfsOK
+}
+
+func nfsRead(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	off := d.uint64()
+	count := d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	if st == nfsOK {
+		st = checkFile(&c.cred, n, permRead)
+	}
+	var data []byte
+	var eof bool
+	if st == nfsOK {
+		var err error
+		data, eof, err = s.read(vol, n, off, count)
+		st = nodeStatus(err)
+	}
+	e.uint32(st)
+	encodePostOpAttrs(e, vol.ID(), s.postOpAttrs(vol, id))
+	if st == nfsOK {
+		e.uint32(uint32(len(data)))
+		e.bool(eof)
+		e.opaque(data)
+	}
+	return nil
+}
+
+// read reads count bytes of the file n from off, or as many as there are,
+// and reports whether they reach the end of the file.
+func (s *Server) read(vol *fs.Volume, n *fs.Node, off uint64, count uint32) ([]byte, bool, error) {
+	if count > maxTransfer {
+		count = maxTransfer
+	}
+	of := s.openFile(vol, n.ID)
+	defer s.release(of)
+	if err := of.rlock(n); err != nil {
+		return nil, false, err
+	}
+	defer of.mu.RUnlock()
+	size := of.f.Size()
+	if off >= size {
+		return nil, true, nil
+	}
+	if uint64(count) > size-off {
+		count = uint32(size - off)
+	}
+	buf := make([]byte, count)
+	k, err := of.f.ReadAt(buf, int64(off))
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:k], off+uint64(k) >= size, err
+}
+
+// stable_how values.
+const (
+	unstable = 0
+	dataSync = 1
+	fileSync = 2
+)
+
+func nfsWrite(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	off := d.uint64()
+	d.uint32()
+	stable := d.uint32()
+	data := d.opaque(maxTransfer)
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	if st == nfsOK {
+		st = checkFile(&c.cred, n, permWrite)
+	}
+	if st == nfsOK && off > maxFileSize-uint64(len(data)) {
+		st = nfsErrFBig
+	}
+	var committed uint32
+	var verf []byte
+	if st == nfsOK {
+		var err error
+		committed, verf, err = s.write(vol, n, off, data, stable)
+		st = nodeStatus(err)
+	}
+	e.uint32(st)
+	encodeWcc(e, vol.ID(), s.postOpAttrs(vol, id))
+	if st == nfsOK {
+		e.uint32(uint32(len(data)))
+		e.uint32(committed)
+		e.fixed(verf)
+	}
+	return nil
+}
+
+// write writes data to the file n at off, and returns how stable it is,
+// and the write verifier it was made under.
+func (s *Server) write(vol *fs.Volume, n *fs.Node, off uint64, data []byte, stable uint32) (uint32, []byte, error) {
+	of := s.openFile(vol, n.ID)
+	defer s.release(of)
+	if stable == unstable {
+		if err := of.rlock(n); err != nil {
+			return 0, nil, err
+		}
+		defer of.mu.RUnlock()
+		if _, err := of.f.WriteAt(data, int64(off)); err != nil {
+			return 0, nil, err
+		}
+		atomic.StoreInt64(&of.wtime, time.Now().UnixNano())
+		// The verifier can't change until of is unlocked.
+		return unstable, s.verifier(), nil
+	}
+	for try := 1; ; try++ {
+		if err := of.lock(n); err != nil {
+			return 0, nil, err
+		}
+		_, err := of.f.WriteAt(data, int64(off))
+		if err == nil {
+			err = s.syncLocked(of)
+		}
+		verf := s.verifier()
+		of.mu.Unlock()
+		if err == nil {
+			return fileSync, verf, nil
+		}
+		if err != fs.ErrConflict || try == conflictRetries {
+			return 0, nil, err
+		}
+	}
+}
+
+// createhow3 modes.
+const (
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+)
+
+// checkDir returns the directory dir of vol, if c has the permissions perm
+// on it.
+func (s *Server) checkDir(c *cred, vol *fs.Volume, dir uint64, perm uint32) (*fs.Node, uint32) {
+	dn, st := s.getNode(vol, dir)
+	switch {
+	case st != nfsOK:
+		return nil, st
+	case !dn.IsDir():
+		return nil, nfsErrNotDir
+	case !may(c, dn, perm):
+		return nil, nfsErrAcces
+	}
+	return dn, nfsOK
+}
+
+// newNode returns a node of type typ made by c in the directory dir, with
+// the permissions perm unless a sets them.
+func newNode(c *cred, dir *fs.Node, typ, perm os.FileMode, a sattr) fs.Node {
+	if a.Mode != nil {
+		perm = *a.Mode
+	}
+	n := fs.Node{Mode: typ | perm, UID: c.uid, GID: c.gid}
+	if dir.Mode&os.ModeSetgid != 0 {
+		// Nodes take the group of a setgid directory, and directories
+		// its setgid bit too.
+		n.GID = dir.GID
+		if typ == os.ModeDir {
+			n.Mode |= os.ModeSetgid
+		}
+	}
+	if c.uid == 0 {
+		if a.UID != nil {
+			n.UID = *a.UID
+		}
+		if a.GID != nil {
+			n.GID = *a.GID
+		}
+	}
+	if a.Atime != nil {
+		n.Atime = *a.Atime
+	}
+	if a.Mtime != nil {
+		n.Mtime = *a.Mtime
+	}
+	return n
+}
+
+// encodeCreated encodes the results of making a node n in dir.
+func (s *Server) encodeCreated(e *encoder, vol *fs.Volume, dir uint64, n *fs.Node, st uint32) {
+	e.uint32(st)
+	if st == nfsOK {
+		e.bool(true)
+		e.opaque(fileHandle(vol.ID(), n.ID))
+		encodePostOpAttrs(e, vol.ID(), s.postOpAttrs(vol, n.ID))
+	}
+	encodeWcc(e, vol.ID(), s.postOpAttrs(vol, dir))
+}
+
+func nfsCreate(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	name := d.string(maxPathLen)
+	how := d.uint32()
+	var a sattr
+	var verf []byte
+	switch how {
+	case createUnchecked, createGuarded:
+		a = decodeSattr(d)
+	case createExclusive:
+		verf = d.fixed(8)
+	default:
+		return errGarbage
+	}
+	if d.err != nil {
+		return d.err
+	}
+	vol, dir, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	n, st := s.create(&c.cred, vol, dir, name, how, a, verf)
+	s.encodeCreated(e, vol, dir, n, st)
+	return nil
+}
+
+// create makes the file name in dir as CREATE does. An exclusive create
+// keeps the client's verifier in the file's access and modification times,
+// to find if it's made again, until the client sets them.
+func (s *Server) create(c *cred, vol *fs.Volume, dir uint64, name string, how uint32, a sattr, verf []byte) (*fs.Node, uint32) {
+	dn, st := s.checkDir(c, vol, dir, permWrite|permExec)
+	if st != nfsOK {
+		return nil, st
+	}
+	if err := fs.ValidateName(name); err != nil {
+		return nil, errStatus(err)
+	}
+	var atime, mtime time.Time
+	if how == createExclusive {
+		atime = time.Unix(int64(binary.BigEndian.Uint32(verf)), 0)
+		mtime = time.Unix(int64(binary.BigEndian.Uint32(verf[4:])), 0)
+	}
+	for {
+		old, err := vol.Lookup(dir, name)
+		switch err {
+		case nil:
+			switch {
+			case how == createExclusive:
+				if old.Mode.IsRegular() && old.Atime.Equal(atime) && old.Mtime.Equal(mtime) {
+					return old, nfsOK
+				}
+				return nil, nfsErrExist
+			case how == createGuarded, !old.Mode.IsRegular():
+				return nil, nfsErrExist
+			}
+			// Creating a file which exists only truncates it.
+			if a.Size != nil {
+				if st := s.setattr(c, vol, old, sattr{SetAttr: fs.SetAttr{Size: a.Size}}); st != nfsOK {
+					return nil, st
+				}
+			}
+			return old, nfsOK
+		case torus.ErrNotExist:
+		default:
+			return nil, errStatus(err)
+		}
+		node := newNode(c, dn, 0, 0644, a)
+		if how == createExclusive {
+			node.Mode = 0600
+			node.Atime, node.Mtime = atime, mtime
+		}
+		n, err := vol.Create(dir, name, node)
+		if err == torus.ErrExists {
+			// Made by someone else in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, errStatus(err)
+		}
+		if a.Size != nil && *a.Size != 0 {
+			if *a.Size > maxFileSize {
+				return nil, nfsErrFBig
+			}
+			if err := s.truncate(vol, n, *a.Size); err != nil {
+				return nil, errStatus(err)
+			}
+		}
+		return n, nfsOK
+	}
+}
+
+func nfsMkdir(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	name := d.string(maxPathLen)
+	a := decodeSattr(d)
+	if d.err != nil {
+		return d.err
+	}
+	vol, dir, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	dn, st := s.checkDir(&c.cred, vol, dir, permWrite|permExec)
+	var n *fs.Node
+	if st == nfsOK {
+		var err error
+		n, err = vol.Create(dir, name, newNode(&c.cred, dn, os.ModeDir, 0755, a))
+		st = errStatus(err)
+	}
+	s.encodeCreated(e, vol, dir, n, st)
+	return nil
+}
+
+func nfsSymlink(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	name := d.string(maxPathLen)
+	a := decodeSattr(d)
+	target := d.string(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, dir, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	dn, st := s.checkDir(&c.cred, vol, dir, permWrite|permExec)
+	if st == nfsOK && target == "" {
+		st = nfsErrInval
+	}
+	var n *fs.Node
+	if st == nfsOK {
+		node := newNode(&c.cred, dn, os.ModeSymlink, 0777, a)
+		node.Mode = os.ModeSymlink | 0777
+		node.Target = target
+		var err error
+		n, err = vol.Create(dir, name, node)
+		st = errStatus(err)
+	}
+	s.encodeCreated(e, vol, dir, n, st)
+	return nil
+}
+
+// nfsMknod refuses to make devices, sockets and FIFOs, which filesystem
+// volumes don't have.
+func nfsMknod(s *Server, c *call, d *decoder, e *encoder) error {
+	e.uint32(nfsErrNotSupp)
+	encodeWcc(e, 0, nil)
+	return nil
+}
+
+func nfsRemove(s *Server, c *call, d *decoder, e *encoder) error {
+	return remove(s, c, d, e, false)
+}
+
+func nfsRmdir(s *Server, c *call, d *decoder, e *encoder) error {
+	return remove(s, c, d, e, true)
+}
+
+// remove serves REMOVE, or RMDIR if isDir is set.
+func remove(s *Server, c *call, d *decoder, e *encoder, isDir bool) error {
+	fh := d.opaque(maxHandleLen)
+	name := d.string(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, dir, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	dn, st := s.checkDir(&c.cred, vol, dir, permWrite|permExec)
+	if st == nfsOK {
+		st = s.checkDelete(&c.cred, vol, dn, name)
+	}
+	if st == nfsOK {
+		if isDir {
+			st = errStatus(vol.Rmdir(dir, name))
+		} else {
+			st = errStatus(vol.Remove(dir, name))
+		}
+	}
+	e.uint32(st)
+	encodeWcc(e, vol.ID(), s.postOpAttrs(vol, dir))
+	return nil
+}
+
+// checkDelete checks that c may remove name from the directory dn.
+func (s *Server) checkDelete(c *cred, vol *fs.Volume, dn *fs.Node, name string) uint32 {
+	n, err := vol.Lookup(dn.ID, name)
+	if err != nil {
+		return errStatus(err)
+	}
+	if !mayDelete(c, dn, n) {
+		return nfsErrAcces
+	}
+	return nfsOK
+}
+
+func nfsRename(s *Server, c *call, d *decoder, e *encoder) error {
+	ffh := d.opaque(maxHandleLen)
+	fromName := d.string(maxPathLen)
+	tfh := d.opaque(maxHandleLen)
+	toName := d.string(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, from, st := s.fromHandle(ffh)
+	tvol, to, tst := s.fromHandle(tfh)
+	if st == nfsOK {
+		st = tst
+	}
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	if tvol != vol {
+		st = nfsErrXDev
+	}
+	var fd, td *fs.Node
+	if st == nfsOK {
+		fd, st = s.checkDir(&c.cred, vol, from, permWrite|permExec)
+	}
+	if st == nfsOK {
+		td, st = s.checkDir(&c.cred, vol, to, permWrite|permExec)
+	}
+	if st == nfsOK {
+		st = s.checkDelete(&c.cred, vol, fd, fromName)
+	}
+	if st == nfsOK {
+		// Whatever is replaced is removed from its directory.
+		if st = s.checkDelete(&c.cred, vol, td, toName); st == nfsErrNoEnt {
+			st = nfsOK
+		}
+	}
+	if st == nfsOK {
+		st = errStatus(vol.Rename(from, fromName, to, toName))
+	}
+	e.uint32(st)
+	encodeWcc(e, vol.ID(), s.postOpAttrs(vol, from))
+	encodeWcc(e, tvol.ID(), s.postOpAttrs(tvol, to))
+	return nil
+}
+
+func nfsLink(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	dfh := d.opaque(maxHandleLen)
+	name := d.string(maxPathLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	dvol, dir, dst := s.fromHandle(dfh)
+	if st == nfsOK {
+		st = dst
+	}
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	if dvol != vol {
+		st = nfsErrXDev
+	}
+	if st == nfsOK {
+		_, st = s.checkDir(&c.cred, vol, dir, permWrite|permExec)
+	}
+	if st == nfsOK {
+		_, err := vol.Link(dir, name, id)
+		st = errStatus(err)
+	}
+	e.uint32(st)
+	encodePostOpAttrs(e, vol.ID(), s.postOpAttrs(vol, id))
+	encodeWcc(e, dvol.ID(), s.postOpAttrs(dvol, dir))
+	return nil
+}
+
+func nfsReaddir(s *Server, c *call, d *decoder, e *encoder) error {
+	return readdir(s, c, d, e, false)
+}
+
+func nfsReaddirplus(s *Server, c *call, d *decoder, e *encoder) error {
+	return readdir(s, c, d, e, true)
+}
+
+// Cookies of the "." and ".." entries of a directory. The others' are
+// hashes of their names, so that listings resume after the last name
+// returned, wherever it's moved to.
+const (
+	cookieDot    = 1
+	cookieDotDot = 2
+)
+
+func nameCookie(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64() | 1<<63
+}
+
+// Sizes of the parts of READDIR and READDIRPLUS results which aren't
+// entries: the status, directory attributes, cookie verifier, the end of
+// the entries, and the eof flag.
+const readdirOverhead = 4 + 4 + 84 + 8 + 4 + 4
+
+// nfsErrTooSmall is returned when not even one entry fits in a listing.
+const nfsErrTooSmall = 10005
+
+// readdir serves READDIR, or READDIRPLUS if plus is set.
+func readdir(s *Server, c *call, d *decoder, e *encoder, plus bool) error {
+	fh := d.opaque(maxHandleLen)
+	cookie := d.uint64()
+	d.fixed(8)
+	dircount := d.uint32()
+	maxcount := dircount
+	if plus {
+		maxcount = d.uint32()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	vol, dir, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	dn, st := s.checkDir(&c.cred, vol, dir, permRead)
+	if st == nfsErrNotDir || st == nfsErrAcces {
+		dn, _ = s.getNode(vol, dir)
+	}
+	vid := vol.ID()
+	ents := &encoder{}
+	var eof bool
+	if st == nfsOK {
+		size := readdirOverhead
+		dsize := 0
+		var err error
+		eof, err = s.dirEntries(vol, dn, cookie, func(name string, id, cookie uint64) bool {
+			ent := &encoder{}
+			ent.bool(true)
+			ent.uint64(id)
+			ent.string(name)
+			ent.uint64(cookie)
+			dlen := len(ent.buf)
+			if plus {
+				encodePostOpAttrs(ent, vid, s.postOpAttrs(vol, id))
+				ent.bool(true)
+				ent.opaque(fileHandle(vid, id))
+			}
+			if size+len(ent.buf) > int(maxcount) || (plus && dsize+dlen > int(dircount)) {
+				return false
+			}
+			size += len(ent.buf)
+			dsize += dlen
+			ents.buf = append(ents.buf, ent.buf...)
+			return true
+		})
+		switch {
+		case err == errBadCookie:
+			st = nfsErrBadCookie
+		case err != nil:
+			st = nodeStatus(err)
+		case len(ents.buf) == 0 && !eof:
+			st = nfsErrTooSmall
+		}
+	}
+	e.uint32(st)
+	encodePostOpAttrs(e, vid, dn)
+	if st == nfsOK {
+		// Cookies stay valid as the directory changes, so the verifier
+		// is always zero.
+		e.uint64(0)
+		e.buf = append(e.buf, ents.buf...)
+		e.bool(false)
+		e.bool(eof)
+	}
+	return nil
+}
+
+var errBadCookie = errors.New("nfs: bad readdir cookie")
+
+// readdirBatch is how many entries are read from a directory at a time.
+const readdirBatch = 128
+
+// dirEntries calls fn with the entries of the directory dn after the one
+// with cookie, and their cookies, until it returns false. It reports whether
+// it got to the end of the directory.
+func (s *Server) dirEntries(vol *fs.Volume, dn *fs.Node, cookie uint64, fn func(name string, id, cookie uint64) bool) (bool, error) {
+	if cookie == 0 && !fn(".", dn.ID, cookieDot) {
+		return false, nil
+	}
+	if cookie <= cookieDot && !fn("..", dn.Parent, cookieDotDot) {
+		return false, nil
+	}
+	var after string
+	if cookie > cookieDotDot {
+		var err error
+		after, err = s.cursorName(vol, dn.ID, cookie)
+		if err != nil {
+			return false, err
+		}
+	}
+	last := after
+	defer func() {
+		if last != after {
+			s.setCursor(vol, dn.ID, nameCookie(last), last)
+		}
+	}()
+	for {
+		ents, err := vol.ReadDir(dn.ID, last, readdirBatch)
+		if err != nil {
+			return false, err
+		}
+		for _, ent := range ents {
+			if !fn(ent.Name, ent.ID, nameCookie(ent.Name)) {
+				return false, nil
+			}
+			last = ent.Name
+		}
+		if len(ents) < readdirBatch {
+			return true, nil
+		}
+	}
+}
+
+// cursor is where a listing of a directory got to.
+type cursor struct {
+	vol    torus.VolumeID
+	dir    uint64
+	cookie uint64
+}
+
+// maxCursors is how many cursors are kept.
+const maxCursors = 4096
+
+func (s *Server) setCursor(vol *fs.Volume, dir, cookie uint64, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cursors) >= maxCursors {
+		s.cursors = make(map[cursor]string)
+	}
+	s.cursors[cursor{vol.ID(), dir, cookie}] = name
+}
+
+// cursorName returns the name of the entry of dir with cookie. If the
+// cursor has been forgotten, the directory is searched for it.
+func (s *Server) cursorName(vol *fs.Volume, dir, cookie uint64) (string, error) {
+	s.mu.Lock()
+	name, ok := s.cursors[cursor{vol.ID(), dir, cookie}]
+	s.mu.Unlock()
+	if ok {
+		return name, nil
+	}
+	var after string
+	for {
+		ents, err := vol.ReadDir(dir, after, readdirBatch)
+		if err != nil {
+			return "", err
+		}
+		for _, ent := range ents {
+			if nameCookie(ent.Name) == cookie {
+				return ent.Name, nil
+			}
+			after = ent.Name
+		}
+		if len(ents) < readdirBatch {
+			return "", errBadCookie
+		}
+	}
+}
+
+// fileSlots is the number of files reported as possible, and free, as
+// there's no fixed limit.
+const fileSlots = 1 << 32
+
+func nfsFsstat(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	var total, free uint64
+	if st == nfsOK {
+		var err error
+		total, free, err = vol.Statfs()
+		st = errStatus(err)
+	}
+	e.uint32(st)
+	encodePostOpAttrs(e, vol.ID(), n)
+	if st == nfsOK {
+		e.uint64(total)
+		e.uint64(free)
+		e.uint64(free)
+		e.uint64(fileSlots)
+		e.uint64(fileSlots)
+		e.uint64(fileSlots)
+		// invarsec: the figures may change at any time.
+		e.uint32(0)
+	}
+	return nil
+}
+
+// FSINFO properties.
+const (
+	fsfLink        = 0x01
+	fsfSymlink     = 0x02
+	fsfHomogeneous = 0x08
+	fsfCanSetTime  = 0x10
+)
+
+// prefMultiple is the multiple of reads and writes clients should make.
+const prefMultiple = 4096
+
+func nfsFsinfo(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	e.uint32(st)
+	encodePostOpAttrs(e, vol.ID(), n)
+	if st == nfsOK {
+		// rtmax, rtpref and rtmult, and the same for writes.
+		e.uint32(maxTransfer)
+		e.uint32(maxTransfer)
+		e.uint32(prefMultiple)
+		e.uint32(maxTransfer)
+		e.uint32(maxTransfer)
+		e.uint32(prefMultiple)
+		// dtpref
+		e.uint32(8192)
+		e.uint64(maxFileSize)
+		// time_delta: times are kept to the nanosecond.
+		e.uint32(0)
+		e.uint32(1)
+		e.uint32(fsfLink | fsfSymlink | fsfHomogeneous | fsfCanSetTime)
+	}
+	return nil
+}
+
+func nfsPathconf(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodePostOpAttrs(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	e.uint32(st)
+	encodePostOpAttrs(e, vol.ID(), n)
+	if st == nfsOK {
+		e.uint32(math.MaxUint32)
+		e.uint32(fs.MaxNameLen)
+		// no_trunc, chown_restricted, case_insensitive and
+		// case_preserving.
+		e.bool(true)
+		e.bool(true)
+		e.bool(false)
+		e.bool(true)
+	}
+	return nil
+}
+
+func nfsCommit(s *Server, c *call, d *decoder, e *encoder) error {
+	fh := d.opaque(maxHandleLen)
+	d.uint64()
+	d.uint32()
+	if d.err != nil {
+		return d.err
+	}
+	vol, id, st := s.fromHandle(fh)
+	if st != nfsOK {
+		e.uint32(st)
+		encodeWcc(e, 0, nil)
+		return nil
+	}
+	n, st := s.getNode(vol, id)
+	if st == nfsOK {
+		st = checkFile(&c.cred, n, 0)
+	}
+	verf := s.verifier()
+	if st == nfsOK {
+		if of := s.cachedFile(vol, id); of != nil {
+			of.mu.Lock()
+			err := s.syncLocked(of)
+			verf = s.verifier()
+			of.mu.Unlock()
+			s.release(of)
+			// Writes lost to a conflict are sent again, as the
+			// verifier has changed.
+			if err != nil && err != fs.ErrConflict {
+				st = nodeStatus(err)
+			}
+		}
+	}
+	e.uint32(st)
+	encodeWcc(e, vol.ID(), s.postOpAttrs(vol, id))
+	if st == nfsOK {
+		e.fixed(verf)
+	}
+	return nil
+}
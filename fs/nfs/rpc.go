@@ -0,0 +1,248 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+)
+
+// ONC RPC message constants, from RFC 5531.
+const (
+	rpcVersion = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+	acceptSystemErr    = 5
+
+	rejectRPCMismatch = 0
+	rejectAuthError   = 1
+
+	authBadCred = 1
+	authTooWeak = 5
+
+	authNone = 0
+	authSys  = 1
+
+	// maxAuthLen is the longest credential or verifier body.
+	maxAuthLen = 400
+)
+
+// maxRecord is the longest RPC record accepted, which holds a WRITE of
+// maxTransfer bytes with room to spare.
+const maxRecord = maxTransfer + 64<<10
+
+// Credentials of clients which don't send AUTH_SYS.
+const (
+	nobodyUID = 65534
+	nobodyGID = 65534
+)
+
+var errRecordTooLong = errors.New("nfs: RPC record too long")
+
+// readRecord reads an RPC record, which is sent as one or more fragments
+// each with a header holding its length, and whether it's the last.
+func readRecord(r io.Reader) ([]byte, error) {
+	var rec []byte
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && rec != nil) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		n := int(h &^ (1 << 31))
+		if len(rec)+n > maxRecord {
+			return nil, errRecordTooLong
+		}
+		start := len(rec)
+		rec = append(rec, make([]byte, n)...)
+		if _, err := io.ReadFull(r, rec[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if h&(1<<31) != 0 {
+			return rec, nil
+		}
+	}
+}
+
+// cred is who a call is made by.
+type cred struct {
+	uid  uint32
+	gid  uint32
+	gids []uint32
+}
+
+// inGroup reports whether gid is one of c's groups.
+func (c *cred) inGroup(gid uint32) bool {
+	if c.gid == gid {
+		return true
+	}
+	for _, g := range c.gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// call is an RPC call being served.
+type call struct {
+	xid  uint32
+	prog uint32
+	vers uint32
+	proc uint32
+	cred cred
+	// host is the address of the client.
+	host string
+}
+
+// procedure serves a call, decoding its arguments from d and encoding its
+// results to e. errGarbage is returned for arguments which can't be
+// decoded, and any other error is a fault of the server.
+type procedure func(s *Server, c *call, d *decoder, e *encoder) error
+
+// program is a version of an RPC program served.
+type program struct {
+	name  string
+	prog  uint32
+	vers  uint32
+	procs []procedure
+}
+
+// handle serves the RPC record rec, returning the record to reply with, or
+// nil if there's nothing to reply.
+func (s *Server) handle(host string, rec []byte) []byte {
+	d := &decoder{buf: rec}
+	c := &call{host: host}
+	c.xid = d.uint32()
+	if d.uint32() != msgCall || d.err != nil {
+		return nil
+	}
+	rpcvers := d.uint32()
+	c.prog = d.uint32()
+	c.vers = d.uint32()
+	c.proc = d.uint32()
+	flavor := d.uint32()
+	body := d.opaque(maxAuthLen)
+	d.uint32()
+	d.opaque(maxAuthLen)
+	if d.err != nil {
+		return nil
+	}
+	e := &encoder{}
+	e.uint32(0)
+	e.uint32(c.xid)
+	e.uint32(msgReply)
+	if rpcvers != rpcVersion {
+		e.uint32(replyDenied)
+		e.uint32(rejectRPCMismatch)
+		e.uint32(rpcVersion)
+		e.uint32(rpcVersion)
+		return record(e)
+	}
+	switch flavor {
+	case authSys:
+		if !decodeAuthSys(body, &c.cred) {
+			e.uint32(replyDenied)
+			e.uint32(rejectAuthError)
+			e.uint32(authBadCred)
+			return record(e)
+		}
+	case authNone:
+		c.cred = cred{uid: nobodyUID, gid: nobodyGID}
+	default:
+		e.uint32(replyDenied)
+		e.uint32(rejectAuthError)
+		e.uint32(authTooWeak)
+		return record(e)
+	}
+
+	e.uint32(replyAccepted)
+	// Replies have an AUTH_NONE verifier.
+	e.uint32(authNone)
+	e.uint32(0)
+	var prog *program
+	var low, high uint32
+	for _, p := range programs {
+		if p.prog != c.prog {
+			continue
+		}
+		if p.vers == c.vers {
+			prog = p
+			break
+		}
+		if low == 0 || p.vers < low {
+			low = p.vers
+		}
+		if p.vers > high {
+			high = p.vers
+		}
+	}
+	switch {
+	case prog != nil:
+	case high != 0:
+		e.uint32(acceptProgMismatch)
+		e.uint32(low)
+		e.uint32(high)
+		return record(e)
+	default:
+		e.uint32(acceptProgUnavail)
+		return record(e)
+	}
+	if c.proc >= uint32(len(prog.procs)) {
+		e.uint32(acceptProcUnavail)
+		return record(e)
+	}
+	res := &encoder{}
+	switch err := prog.procs[c.proc](s, c, d, res); err {
+	case nil:
+		e.uint32(acceptSuccess)
+		e.buf = append(e.buf, res.buf...)
+	case errGarbage:
+		e.uint32(acceptGarbageArgs)
+	default:
+		log.Printf("nfs: %s: %s procedure %d: %s", host, prog.name, c.proc, err)
+		e.uint32(acceptSystemErr)
+	}
+	return record(e)
+}
+
+// decodeAuthSys decodes the body of AUTH_SYS credentials to c.
+func decodeAuthSys(body []byte, c *cred) bool {
+	d := &decoder{buf: body}
+	// The stamp, and the client's host name.
+	d.uint32()
+	d.opaque(255)
+	c.uid = d.uint32()
+	c.gid = d.uint32()
+	n := d.uint32()
+	if n > 16 {
+		return false
+	}
+	for i := uint32(0); i < n; i++ {
+		c.gids = append(c.gids, d.uint32())
+	}
+	return d.err == nil
+}
+
+// record completes the record in e, which starts with a placeholder for its
+// header, as a single fragment.
+func record(e *encoder) []byte {
+	binary.BigEndian.PutUint32(e.buf, 1<<31|uint32(len(e.buf)-4))
+	return e.buf
+}
@@ -0,0 +1,463 @@
+// Package nfs implements an NFSv3 server exporting torus filesystem volumes,
+// so that hosts may mount them with the kernel's NFS client.
+//
+// The NFS and MOUNT protocols are both served over TCP on a single port,
+// with AUTH_SYS credentials; there's no portmapper or lock manager, so
+// clients mount with port, mountport and nolock set. Each volume is exported
+// as /NAME.
+//
+// Unstable writes are kept in an open file until the client commits them,
+// or they've been idle a while. If another writer synced the file in the
+// meantime, they're lost, and the write verifier changes, so that clients
+// send them again.
+package nfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+)
+
+// DefaultPort is the TCP port NFS is served on.
+const DefaultPort = 2049
+
+const (
+	// maxTransfer is the most data read or written by one call.
+	maxTransfer = 1 << 20
+	// maxInflight is how many calls a connection may have served at
+	// once.
+	maxInflight = 16
+	// syncAfter is how long unstable writes to a file may be idle
+	// before they're synced without a COMMIT.
+	syncAfter = 5 * time.Second
+	// closeAfter is how long a file is kept open once it's idle.
+	closeAfter = 30 * time.Second
+)
+
+// Server serves filesystem volumes to NFS clients.
+type Server struct {
+	vols    map[torus.VolumeID]*fs.Volume
+	exports map[string]*fs.Volume
+	paths   []string
+
+	// verf is the write verifier, which changes whenever unstable writes
+	// are lost.
+	verf uint64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	done     chan struct{}
+	files    map[fileKey]*openFile
+	mounts   map[mount]bool
+	cursors  map[cursor]string
+}
+
+// NewServer creates a Server exporting the given volumes, which it doesn't
+// close.
+func NewServer(vols ...*fs.Volume) (*Server, error) {
+	s := &Server{
+		vols:    make(map[torus.VolumeID]*fs.Volume),
+		exports: make(map[string]*fs.Volume),
+		verf:    uint64(time.Now().UnixNano()),
+		conns:   make(map[net.Conn]bool),
+		done:    make(chan struct{}),
+		files:   make(map[fileKey]*openFile),
+		mounts:  make(map[mount]bool),
+		cursors: make(map[cursor]string),
+	}
+	for _, v := range vols {
+		path := "/" + v.Name()
+		if _, ok := s.exports[path]; ok {
+			return nil, fmt.Errorf("nfs: volume %s exported twice", v.Name())
+		}
+		s.vols[v.ID()] = v
+		s.exports[path] = v
+		s.paths = append(s.paths, path)
+	}
+	go s.sweeper()
+	return s, nil
+}
+
+// Serve accepts connections on l, serving each in its own goroutine, until
+// the Server is closed or l fails.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil && err != io.EOF {
+				log.Printf("nfs: %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves RPC calls from conn until the client disconnects. Calls
+// are served concurrently, and may be replied to out of order.
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return conn.Close()
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+
+	host := conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var (
+		wg  sync.WaitGroup
+		wmu sync.Mutex
+		sem = make(chan struct{}, maxInflight)
+	)
+	defer func() {
+		conn.Close()
+		wg.Wait()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	for {
+		rec, err := readRecord(conn)
+		if err != nil {
+			return err
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			reply := s.handle(host, rec)
+			if reply == nil {
+				return
+			}
+			wmu.Lock()
+			defer wmu.Unlock()
+			conn.Write(reply)
+		}()
+	}
+}
+
+// Close stops accepting connections, drops every client, and syncs the
+// unstable writes made to files.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	files := s.files
+	s.files = make(map[fileKey]*openFile)
+	s.mu.Unlock()
+
+	for _, of := range files {
+		of.mu.Lock()
+		if serr := s.syncLocked(of); serr != nil && err == nil {
+			err = serr
+		}
+		if of.f != nil {
+			of.f.Close()
+			of.f = nil
+		}
+		of.mu.Unlock()
+	}
+	return err
+}
+
+// verifier returns the write verifier.
+func (s *Server) verifier() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, atomic.LoadUint64(&s.verf))
+	return b
+}
+
+// handleLen is the length of file handles: a volume ID and node ID.
+const handleLen = 16
+
+// maxHandleLen is the longest file handle a client may send.
+const maxHandleLen = 64
+
+func fileHandle(vid torus.VolumeID, id uint64) []byte {
+	b := make([]byte, handleLen)
+	binary.BigEndian.PutUint64(b, uint64(vid))
+	binary.BigEndian.PutUint64(b[8:], id)
+	return b
+}
+
+// fromHandle returns the volume and node of a file handle.
+func (s *Server) fromHandle(fh []byte) (*fs.Volume, uint64, uint32) {
+	if len(fh) != handleLen {
+		return nil, 0, nfsErrBadHandle
+	}
+	id := binary.BigEndian.Uint64(fh[8:])
+	if id == 0 {
+		return nil, 0, nfsErrBadHandle
+	}
+	v, ok := s.vols[torus.VolumeID(binary.BigEndian.Uint64(fh))]
+	if !ok {
+		return nil, 0, nfsErrStale
+	}
+	return v, id, nfsOK
+}
+
+// export returns the volume exported at path, which may leave out the
+// leading slash.
+func (s *Server) export(path string) (*fs.Volume, bool) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	v, ok := s.exports[strings.TrimSuffix(path, "/")]
+	return v, ok
+}
+
+// getNode returns the node id in vol, as the client sees it: with the size
+// and modification time its unstable writes give it.
+func (s *Server) getNode(vol *fs.Volume, id uint64) (*fs.Node, uint32) {
+	n, err := vol.GetNode(id)
+	if err == torus.ErrNotExist {
+		return nil, nfsErrStale
+	}
+	if err != nil {
+		return nil, errStatus(err)
+	}
+	if n.IsDir() || n.IsSymlink() {
+		return n, nfsOK
+	}
+	of := s.cachedFile(vol, id)
+	if of == nil {
+		return n, nfsOK
+	}
+	defer s.release(of)
+	of.mu.RLock()
+	if of.f != nil && of.f.Dirty() {
+		n.Size = of.f.Size()
+		n.Mtime = time.Unix(0, atomic.LoadInt64(&of.wtime))
+	}
+	of.mu.RUnlock()
+	return n, nfsOK
+}
+
+// postOpAttrs returns the node id in vol, for post-operation attributes,
+// or nil if it can't be got.
+func (s *Server) postOpAttrs(vol *fs.Volume, id uint64) *fs.Node {
+	n, _ := s.getNode(vol, id)
+	return n
+}
+
+type fileKey struct {
+	vol torus.VolumeID
+	id  uint64
+}
+
+// openFile is a file kept open to serve reads and writes.
+type openFile struct {
+	vol *fs.Volume
+	id  uint64
+
+	// users and used are guarded by the Server's mu.
+	users int
+	used  time.Time
+
+	// mu is held to use f, and held exclusively to sync or replace it.
+	mu sync.RWMutex
+	// f is nil once the file has been dropped after a failed sync.
+	f *fs.File
+	// wtime is when the file was last written, in Unix nanoseconds.
+	wtime int64
+}
+
+// usable reports whether f may serve the node n: if it has unstable writes,
+// or its contents are still n's. of.mu must be held.
+func (of *openFile) usable(n *fs.Node) bool {
+	return of.f != nil && (of.f.Dirty() || of.f.Current(n))
+}
+
+// reopenLocked opens the file again, unless it's usable for n. of.mu must
+// be held exclusively.
+func (of *openFile) reopenLocked(n *fs.Node) error {
+	if of.usable(n) {
+		return nil
+	}
+	if of.f != nil {
+		of.f.Close()
+		of.f = nil
+	}
+	f, err := of.vol.OpenFile(of.id)
+	if err != nil {
+		return err
+	}
+	of.f = f
+	return nil
+}
+
+// rlock locks of for reading, with a File usable for the node n, or
+// opened since n was read.
+func (of *openFile) rlock(n *fs.Node) error {
+	of.mu.RLock()
+	if of.usable(n) {
+		return nil
+	}
+	of.mu.RUnlock()
+	if err := of.lock(n); err != nil {
+		return err
+	}
+	of.mu.Unlock()
+	of.mu.RLock()
+	if of.f == nil {
+		of.mu.RUnlock()
+		return torus.ErrAgain
+	}
+	return nil
+}
+
+// lock locks of exclusively, with a File usable for the node n.
+func (of *openFile) lock(n *fs.Node) error {
+	of.mu.Lock()
+	if err := of.reopenLocked(n); err != nil {
+		of.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// openFile returns the file id of vol, opening it if it isn't already. It
+// must be released once it's been used.
+func (s *Server) openFile(vol *fs.Volume, id uint64) *openFile {
+	k := fileKey{vol.ID(), id}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	of, ok := s.files[k]
+	if !ok {
+		// The File is opened on first use.
+		of = &openFile{vol: vol, id: id}
+		s.files[k] = of
+	}
+	of.users++
+	return of
+}
+
+// cachedFile returns the file id of vol if it's open, or nil. It must be
+// released once it's been used.
+func (s *Server) cachedFile(vol *fs.Volume, id uint64) *openFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	of, ok := s.files[fileKey{vol.ID(), id}]
+	if !ok {
+		return nil
+	}
+	of.users++
+	return of
+}
+
+func (s *Server) release(of *openFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	of.users--
+	of.used = time.Now()
+}
+
+// syncLocked syncs the unstable writes to of. If they're lost, the write
+// verifier changes, and the File is dropped to be opened again. of.mu must
+// be held exclusively.
+func (s *Server) syncLocked(of *openFile) error {
+	if of.f == nil || !of.f.Dirty() {
+		return nil
+	}
+	err := of.f.Sync()
+	if err == nil {
+		return nil
+	}
+	of.f.Close()
+	of.f = nil
+	// The writes to a file which has been removed don't matter.
+	if err != torus.ErrNotExist {
+		atomic.AddUint64(&s.verf, 1)
+		log.Printf("nfs: unstable writes to file %d of volume %s lost: %s", of.id, of.vol.Name(), err)
+	}
+	return err
+}
+
+// sweeper syncs the unstable writes of idle files, and closes them.
+func (s *Server) sweeper() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			s.sweep(now)
+		}
+	}
+}
+
+func (s *Server) sweep(now time.Time) {
+	var dirty []*openFile
+	s.mu.Lock()
+	for k, of := range s.files {
+		if of.users != 0 {
+			continue
+		}
+		// Nothing else uses of without being one of its users.
+		idle := now.Sub(of.used)
+		switch {
+		case of.f != nil && of.f.Dirty():
+			if idle >= syncAfter {
+				of.users++
+				dirty = append(dirty, of)
+			}
+		case idle >= closeAfter:
+			delete(s.files, k)
+			if of.f != nil {
+				of.f.Close()
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, of := range dirty {
+		of.mu.Lock()
+		s.syncLocked(of)
+		of.mu.Unlock()
+		s.release(of)
+	}
+}
@@ -0,0 +1,545 @@
+package nfs
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/fs"
+	_ "github.com/coreos/torus/metadata/temp"
+	_ "github.com/coreos/torus/storage"
+)
+
+// NFS procedures used by the tests.
+const (
+	procGetattr     = 1
+	procSetattr     = 2
+	procLookup      = 3
+	procAccess      = 4
+	procRead        = 6
+	procWrite       = 7
+	procCreate      = 8
+	procMkdir       = 9
+	procRemove      = 12
+	procRmdir       = 13
+	procRename      = 14
+	procReaddir     = 16
+	procReaddirplus = 17
+	procCommit      = 21
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	xid  uint32
+	// uid and gid are sent as AUTH_SYS credentials.
+	uid, gid uint32
+}
+
+// newGateway serves the volume vol of srv, creating it if it doesn't
+// exist, and returns a client of it as root.
+func newGateway(t *testing.T, srv *torus.Server, name string) (*client, func()) {
+	if err := fs.CreateFSVolume(srv.MDS, name); err != nil && err != torus.ErrExists {
+		t.Fatal(err)
+	}
+	vol, err := fs.OpenFSVolume(srv, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cconn, sconn := net.Pipe()
+	go s.ServeConn(sconn)
+	return &client{t: t, conn: cconn}, func() {
+		cconn.Close()
+		s.Close()
+		vol.Close()
+	}
+}
+
+// rawCall makes a call, and returns the accept_stat of the reply, or its
+// reject_stat plus 100 if it was denied, and a decoder of its results.
+func (c *client) rawCall(prog, vers, proc uint32, args func(e *encoder)) (uint32, *decoder) {
+	c.xid++
+	e := &encoder{}
+	e.uint32(0)
+	e.uint32(c.xid)
+	e.uint32(msgCall)
+	e.uint32(rpcVersion)
+	e.uint32(prog)
+	e.uint32(vers)
+	e.uint32(proc)
+	cred := &encoder{}
+	cred.uint32(0)
+	cred.string("test")
+	cred.uint32(c.uid)
+	cred.uint32(c.gid)
+	cred.uint32(0)
+	e.uint32(authSys)
+	e.opaque(cred.buf)
+	e.uint32(authNone)
+	e.uint32(0)
+	if args != nil {
+		args(e)
+	}
+	if _, err := c.conn.Write(record(e)); err != nil {
+		c.t.Fatal(err)
+	}
+	rec, err := readRecord(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	d := &decoder{buf: rec}
+	if xid := d.uint32(); xid != c.xid {
+		c.t.Fatalf("reply to call %d, expected %d", xid, c.xid)
+	}
+	d.uint32()
+	if d.uint32() == replyDenied {
+		return 100 + d.uint32(), d
+	}
+	d.uint32()
+	d.opaque(maxAuthLen)
+	return d.uint32(), d
+}
+
+// call makes an NFS call, and returns the status and a decoder of the rest
+// of its results.
+func (c *client) call(proc uint32, args func(e *encoder)) (uint32, *decoder) {
+	stat, d := c.rawCall(nfsProgram.prog, 3, proc, args)
+	if stat != acceptSuccess {
+		c.t.Fatalf("NFS procedure %d: accept_stat %d", proc, stat)
+	}
+	return d.uint32(), d
+}
+
+// expect makes an NFS call, failing unless it returns status.
+func (c *client) expect(status, proc uint32, args func(e *encoder)) *decoder {
+	st, d := c.call(proc, args)
+	if st != status {
+		c.t.Fatalf("NFS procedure %d returned %d, expected %d", proc, st, status)
+	}
+	return d
+}
+
+func (c *client) mount(path string) []byte {
+	stat, d := c.rawCall(mountProgram.prog, 3, 1, func(e *encoder) { e.string(path) })
+	if stat != acceptSuccess {
+		c.t.Fatalf("MNT: accept_stat %d", stat)
+	}
+	if st := d.uint32(); st != mntOK {
+		c.t.Fatalf("MNT %s returned %d", path, st)
+	}
+	return d.opaque(maxHandleLen)
+}
+
+// decodeAttrs decodes a post_op_attr, returning the type, mode, size and
+// file ID in it.
+func decodeAttrs(d *decoder) (typ, mode uint32, size, id uint64) {
+	if !d.bool() {
+		return
+	}
+	typ = d.uint32()
+	mode = d.uint32()
+	d.fixed(12)
+	size = d.uint64()
+	d.fixed(8 + 8 + 8)
+	id = d.uint64()
+	d.fixed(24)
+	return
+}
+
+// skipWcc skips wcc_data.
+func skipWcc(d *decoder) {
+	if d.bool() {
+		d.fixed(24)
+	}
+	decodeAttrs(d)
+}
+
+func diropargs(dir []byte, name string) func(e *encoder) {
+	return func(e *encoder) {
+		e.opaque(dir)
+		e.string(name)
+	}
+}
+
+// create makes a file with mode 0644, and returns its handle.
+func (c *client) create(dir []byte, name string) []byte {
+	d := c.expect(nfsOK, procCreate, func(e *encoder) {
+		diropargs(dir, name)(e)
+		e.uint32(createGuarded)
+		e.bool(true)
+		e.uint32(0644)
+		e.fixed(make([]byte, 5*4))
+	})
+	d.bool()
+	return d.opaque(maxHandleLen)
+}
+
+func (c *client) mkdir(dir []byte, name string) []byte {
+	d := c.expect(nfsOK, procMkdir, func(e *encoder) {
+		diropargs(dir, name)(e)
+		e.bool(true)
+		e.uint32(0755)
+		e.fixed(make([]byte, 5*4))
+	})
+	d.bool()
+	return d.opaque(maxHandleLen)
+}
+
+// write makes an unstable write, and returns the verifier.
+func (c *client) write(fh []byte, off uint64, data []byte) []byte {
+	d := c.expect(nfsOK, procWrite, func(e *encoder) {
+		e.opaque(fh)
+		e.uint64(off)
+		e.uint32(uint32(len(data)))
+		e.uint32(unstable)
+		e.opaque(data)
+	})
+	skipWcc(d)
+	if n := d.uint32(); n != uint32(len(data)) {
+		c.t.Fatalf("wrote %d bytes, expected %d", n, len(data))
+	}
+	if how := d.uint32(); how != unstable {
+		c.t.Fatalf("unstable write committed as %d", how)
+	}
+	return d.fixed(8)
+}
+
+func (c *client) commit(fh []byte) []byte {
+	d := c.expect(nfsOK, procCommit, func(e *encoder) {
+		e.opaque(fh)
+		e.uint64(0)
+		e.uint32(0)
+	})
+	skipWcc(d)
+	return d.fixed(8)
+}
+
+func (c *client) read(fh []byte, off uint64, count uint32) ([]byte, bool) {
+	d := c.expect(nfsOK, procRead, func(e *encoder) {
+		e.opaque(fh)
+		e.uint64(off)
+		e.uint32(count)
+	})
+	decodeAttrs(d)
+	d.uint32()
+	eof := d.bool()
+	return d.opaque(maxTransfer), eof
+}
+
+func (c *client) size(fh []byte) uint64 {
+	d := c.expect(nfsOK, procGetattr, func(e *encoder) { e.opaque(fh) })
+	d.uint32()
+	d.uint32()
+	d.fixed(12)
+	return d.uint64()
+}
+
+// readdir lists dir count bytes at a time, calling between with each page's
+// names before asking for the next.
+func (c *client) readdir(dir []byte, count uint32, between func(names []string)) []string {
+	var all []string
+	var cookie uint64
+	for {
+		d := c.expect(nfsOK, procReaddir, func(e *encoder) {
+			e.opaque(dir)
+			e.uint64(cookie)
+			e.fixed(make([]byte, 8))
+			e.uint32(count)
+		})
+		decodeAttrs(d)
+		d.fixed(8)
+		var names []string
+		for d.bool() {
+			d.uint64()
+			names = append(names, d.string(fs.MaxNameLen))
+			cookie = d.uint64()
+		}
+		if d.err != nil {
+			c.t.Fatal(d.err)
+		}
+		all = append(all, names...)
+		if d.bool() {
+			return all
+		}
+		if between != nil {
+			between(names)
+		}
+	}
+}
+
+func TestMount(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	c, done := newGateway(t, srv, "vol")
+	defer done()
+
+	root := c.mount("/vol")
+	if !bytes.Equal(c.mount("vol"), root) {
+		t.Fatal("exports mounted by different paths have different handles")
+	}
+	stat, d := c.rawCall(mountProgram.prog, 3, 1, func(e *encoder) { e.string("/other") })
+	if stat != acceptSuccess || d.uint32() != mntErrNoEnt {
+		t.Fatal("mounted a volume which isn't exported")
+	}
+
+	stat, d = c.rawCall(mountProgram.prog, 3, 5, nil)
+	if stat != acceptSuccess {
+		t.Fatalf("EXPORT: accept_stat %d", stat)
+	}
+	var exports []string
+	for d.bool() {
+		exports = append(exports, d.string(maxPathLen))
+		for d.bool() {
+			d.string(maxPathLen)
+		}
+	}
+	if len(exports) != 1 || exports[0] != "/vol" {
+		t.Fatalf("exports %v, expected [/vol]", exports)
+	}
+
+	d = c.expect(nfsOK, procGetattr, func(e *encoder) { e.opaque(root) })
+	if typ, mode := d.uint32(), d.uint32(); typ != nf3Dir || mode != 01777 {
+		t.Fatalf("root has type %d and mode %o", typ, mode)
+	}
+	c.expect(nfsErrBadHandle, procGetattr, func(e *encoder) { e.opaque([]byte("short")) })
+	c.expect(nfsErrStale, procGetattr, func(e *encoder) { e.opaque(fileHandle(torus.VolumeID(999), 1)) })
+
+	if stat, _ := c.rawCall(nfsProgram.prog, 2, 0, nil); stat != acceptProgMismatch {
+		t.Fatalf("NFSv2 call: accept_stat %d", stat)
+	}
+	if stat, _ := c.rawCall(nfsProgram.prog, 3, 22, nil); stat != acceptProcUnavail {
+		t.Fatalf("unknown procedure: accept_stat %d", stat)
+	}
+	if stat, _ := c.rawCall(nfsProgram.prog, 3, procGetattr, nil); stat != acceptGarbageArgs {
+		t.Fatalf("call without arguments: accept_stat %d", stat)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	c, done := newGateway(t, srv, "vol")
+	defer done()
+	root := c.mount("/vol")
+
+	fh := c.create(root, "file")
+	c.expect(nfsErrExist, procCreate, func(e *encoder) {
+		diropargs(root, "file")(e)
+		e.uint32(createGuarded)
+		e.fixed(make([]byte, 6*4))
+	})
+
+	data := bytes.Repeat([]byte("torus!!!"), 200000)
+	verf := c.write(fh, 0, data[:maxTransfer])
+	if v := c.write(fh, maxTransfer, data[maxTransfer:]); !bytes.Equal(v, verf) {
+		t.Fatal("write verifier changed")
+	}
+	// Unstable writes are seen before they're committed.
+	if size := c.size(fh); size != uint64(len(data)) {
+		t.Fatalf("size %d, expected %d", size, len(data))
+	}
+	got, eof := c.read(fh, 5, 100)
+	if !bytes.Equal(got, data[5:105]) || eof {
+		t.Fatalf("read %q, eof %v", got, eof)
+	}
+	if v := c.commit(fh); !bytes.Equal(v, verf) {
+		t.Fatal("commit verifier differs from the writes'")
+	}
+
+	// Another gateway sees the committed file.
+	c2, done2 := newGateway(t, srv, "vol")
+	defer done2()
+	root2 := c2.mount("/vol")
+	d := c2.expect(nfsOK, procLookup, diropargs(root2, "file"))
+	fh2 := d.opaque(maxHandleLen)
+	got, eof = c2.read(fh2, uint64(len(data))-10, 100)
+	if !bytes.Equal(got, data[len(data)-10:]) || !eof {
+		t.Fatalf("read %q, eof %v from the other gateway", got, eof)
+	}
+
+	// Truncating keeps the start of the file.
+	c.expect(nfsOK, procSetattr, func(e *encoder) {
+		e.opaque(fh)
+		e.bool(false)
+		e.bool(false)
+		e.bool(false)
+		e.bool(true)
+		e.uint64(10)
+		e.uint32(dontChange)
+		e.uint32(dontChange)
+		e.bool(false)
+	})
+	if got, eof = c2.read(fh2, 0, 100); !bytes.Equal(got, data[:10]) || !eof {
+		t.Fatalf("read %q, eof %v after truncating", got, eof)
+	}
+}
+
+func TestConflictingWrites(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	c1, done1 := newGateway(t, srv, "vol")
+	defer done1()
+	c2, done2 := newGateway(t, srv, "vol")
+	defer done2()
+	root := c1.mount("/vol")
+	fh := c1.create(root, "file")
+
+	verf1 := c1.write(fh, 0, []byte("first"))
+	verf2 := c2.write(fh, 0, []byte("second"))
+	if v := c1.commit(fh); !bytes.Equal(v, verf1) {
+		t.Fatal("first commit lost its writes")
+	}
+	// The second gateway's writes are lost, so its client must send them
+	// again.
+	v := c2.commit(fh)
+	if bytes.Equal(v, verf2) {
+		t.Fatal("conflicting commit kept the write verifier")
+	}
+	if got := c2.write(fh, 0, []byte("second")); !bytes.Equal(got, v) {
+		t.Fatal("write verifier changed again")
+	}
+	if got := c2.commit(fh); !bytes.Equal(got, v) {
+		t.Fatal("commit after resending lost its writes")
+	}
+	if got, _ := c1.read(fh, 0, 100); string(got) != "second" {
+		t.Fatalf("read %q, expected the resent writes", got)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	c, done := newGateway(t, srv, "vol")
+	defer done()
+	root := c.mount("/vol")
+
+	dir := c.mkdir(root, "dir")
+	var want []string
+	for i := 0; i < 300; i++ {
+		name := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		c.create(dir, name)
+		want = append(want, name)
+	}
+	sort.Strings(want)
+	got := c.readdir(dir, 1024, nil)
+	if len(got) != len(want)+2 || got[0] != "." || got[1] != ".." {
+		t.Fatalf("listed %d entries, expected %d", len(got), len(want)+2)
+	}
+	for i, name := range want {
+		if got[i+2] != name {
+			t.Fatalf("entry %d is %s, expected %s", i+2, got[i+2], name)
+		}
+	}
+
+	// Removing what's been listed so far doesn't make a listing skip
+	// anything.
+	got = c.readdir(dir, 1024, func(names []string) {
+		for _, name := range names {
+			if name != "." && name != ".." {
+				c.expect(nfsOK, procRemove, diropargs(dir, name))
+			}
+		}
+	})
+	if len(got) != len(want)+2 {
+		t.Fatalf("listed %d entries while removing them, expected %d", len(got), len(want)+2)
+	}
+
+	// READDIRPLUS gives handles.
+	c.create(dir, "file")
+	d := c.expect(nfsOK, procReaddirplus, func(e *encoder) {
+		e.opaque(dir)
+		e.uint64(0)
+		e.fixed(make([]byte, 8))
+		e.uint32(4096)
+		e.uint32(65536)
+	})
+	decodeAttrs(d)
+	d.fixed(8)
+	var fh []byte
+	for d.bool() {
+		d.uint64()
+		name := d.string(fs.MaxNameLen)
+		d.uint64()
+		decodeAttrs(d)
+		d.bool()
+		h := d.opaque(maxHandleLen)
+		if name == "file" {
+			fh = h
+		}
+	}
+	if !d.bool() || fh == nil {
+		t.Fatal("READDIRPLUS didn't list the file")
+	}
+	d = c.expect(nfsOK, procLookup, diropargs(dir, "file"))
+	if !bytes.Equal(d.opaque(maxHandleLen), fh) {
+		t.Fatal("LOOKUP returned a different handle")
+	}
+	if _, _, _, id := decodeAttrs(d); id == 0 {
+		t.Fatal("LOOKUP returned no attributes")
+	}
+
+	c.expect(nfsErrNotEmpty, procRmdir, diropargs(root, "dir"))
+	c.expect(nfsErrNotDir, procLookup, diropargs(fh, "x"))
+	c.expect(nfsErrInval, procRename, func(e *encoder) {
+		diropargs(root, "dir")(e)
+		diropargs(dir, "sub")(e)
+	})
+	c.expect(nfsOK, procRename, func(e *encoder) {
+		diropargs(dir, "file")(e)
+		diropargs(root, "moved")(e)
+	})
+	c.expect(nfsErrNoEnt, procLookup, diropargs(dir, "file"))
+	c.expect(nfsOK, procLookup, diropargs(root, "moved"))
+	for _, name := range c.readdir(dir, 65536, nil)[2:] {
+		c.expect(nfsOK, procRemove, diropargs(dir, name))
+	}
+	c.expect(nfsOK, procRmdir, diropargs(root, "dir"))
+	c.expect(nfsErrStale, procGetattr, func(e *encoder) { e.opaque(dir) })
+}
+
+func TestPermissions(t *testing.T) {
+	srv := torus.NewMemoryServer()
+	defer srv.Close()
+	c, done := newGateway(t, srv, "vol")
+	defer done()
+	root := c.mount("/vol")
+	dir := c.mkdir(root, "private")
+	fh := c.create(root, "rootfile")
+
+	c.uid, c.gid = 1000, 1000
+	c.expect(nfsErrAcces, procCreate, func(e *encoder) {
+		diropargs(dir, "x")(e)
+		e.uint32(createUnchecked)
+		e.fixed(make([]byte, 6*4))
+	})
+	d := c.expect(nfsOK, procAccess, func(e *encoder) {
+		e.opaque(fh)
+		e.uint32(accessRead | accessModify)
+	})
+	decodeAttrs(d)
+	if a := d.uint32(); a != accessRead {
+		t.Fatalf("access %#x to another's file, expected read", a)
+	}
+	c.expect(nfsErrAcces, procWrite, func(e *encoder) {
+		e.opaque(fh)
+		e.uint64(0)
+		e.uint32(1)
+		e.uint32(fileSync)
+		e.opaque([]byte("x"))
+	})
+	// The root is sticky, so only the owner may remove its files.
+	c.expect(nfsErrAcces, procRemove, diropargs(root, "rootfile"))
+	mine := c.create(root, "mine")
+	d = c.expect(nfsOK, procGetattr, func(e *encoder) { e.opaque(mine) })
+	d.fixed(8 + 4)
+	if uid := d.uint32(); uid != 1000 {
+		t.Fatalf("file created with owner %d", uid)
+	}
+	c.expect(nfsOK, procRemove, diropargs(root, "mine"))
+}
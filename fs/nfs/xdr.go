@@ -0,0 +1,109 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errGarbage is returned for arguments which can't be decoded.
+var errGarbage = errors.New("nfs: garbage arguments")
+
+// decoder reads XDR data. The first error sticks, and every read after it
+// returns zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errGarbage
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) bool() bool {
+	return d.uint32() != 0
+}
+
+// fixed reads fixed length opaque data.
+func (d *decoder) fixed(n int) []byte {
+	b := d.take(n)
+	d.take(pad(n))
+	return b
+}
+
+// opaque reads variable length opaque data of at most max bytes.
+func (d *decoder) opaque(max int) []byte {
+	n := d.uint32()
+	if d.err == nil && n > uint32(max) {
+		d.err = errGarbage
+	}
+	return d.fixed(int(n))
+}
+
+func (d *decoder) string(max int) string {
+	return string(d.opaque(max))
+}
+
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
+
+// encoder writes XDR data.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.uint32(uint32(v >> 32))
+	e.uint32(uint32(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+func (e *encoder) fixed(b []byte) {
+	e.buf = append(e.buf, b...)
+	e.buf = append(e.buf, make([]byte, pad(len(b)))...)
+}
+
+func (e *encoder) opaque(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.fixed(b)
+}
+
+func (e *encoder) string(s string) {
+	e.opaque([]byte(s))
+}
@@ -0,0 +1,295 @@
+package fs
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/metadata/temp"
+	"github.com/coreos/torus/models"
+)
+
+type fsTemp struct {
+	*temp.Client
+	name string
+	vid  torus.VolumeID
+}
+
+type fsTempVolumeData struct {
+	nodes map[uint64]*Node
+	dirs  map[uint64]map[string]uint64
+	marks map[string]torus.INodeID
+}
+
+func createFSTempMetadata(mds torus.MetadataService, name string, vid torus.VolumeID) (fsMetadata, error) {
+	if t, ok := mds.(*temp.Client); ok {
+		return &fsTemp{
+			Client: t,
+			name:   name,
+			vid:    vid,
+		}, nil
+	}
+	panic("how are we creating a temp metadata that doesn't implement it but reports as being temp")
+}
+
+// dataKey is where the volume's data is kept, apart from that of block
+// volumes, which is under their ID.
+func (b *fsTemp) dataKey() string {
+	return fmt.Sprint("fs/", b.vid)
+}
+
+// data returns the volume's data. The data lock must be held.
+func (b *fsTemp) data() (*fsTempVolumeData, bool) {
+	v, _ := b.GetData(b.dataKey())
+	d, ok := v.(*fsTempVolumeData)
+	return d, ok && d != nil
+}
+
+func copyNode(n *Node) *Node {
+	c := *n
+	c.Data = append([]byte(nil), n.Data...)
+	return &c
+}
+
+func (b *fsTemp) CreateFSVolume(volume *models.Volume, root *Node) error {
+	// The client takes the data lock itself.
+	if _, err := b.Client.GetVolume(volume.Name); err == nil {
+		return torus.ErrExists
+	}
+	b.LockData()
+	defer b.UnlockData()
+	if _, ok := b.data(); ok {
+		return torus.ErrExists
+	}
+	b.CreateVolume(volume)
+	b.SetData(b.dataKey(), &fsTempVolumeData{
+		nodes: map[uint64]*Node{RootID: copyNode(root)},
+		dirs:  make(map[uint64]map[string]uint64),
+		marks: make(map[string]torus.INodeID),
+	})
+	return nil
+}
+
+func (b *fsTemp) DeleteVolume() error {
+	b.LockData()
+	d, ok := b.data()
+	if !ok {
+		b.UnlockData()
+		return torus.ErrNotExist
+	}
+	if len(d.marks) != 0 {
+		b.UnlockData()
+		return torus.ErrLocked
+	}
+	b.SetData(b.dataKey(), (*fsTempVolumeData)(nil))
+	b.UnlockData()
+	// The client takes the data lock itself.
+	return b.Client.DeleteVolume(b.name)
+}
+
+func (b *fsTemp) GetNode(id uint64) (*Node, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	n, ok := d.nodes[id]
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	return copyNode(n), nil
+}
+
+func (b *fsTemp) GetNodes() ([]Node, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	var out []Node
+	for _, n := range d.nodes {
+		out = append(out, *copyNode(n))
+	}
+	return out, nil
+}
+
+func (b *fsTemp) Lookup(dir uint64, name string) (uint64, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return 0, torus.ErrNotExist
+	}
+	id, ok := d.dirs[dir][name]
+	if !ok {
+		return 0, torus.ErrNotExist
+	}
+	return id, nil
+}
+
+func (b *fsTemp) ReadDir(dir uint64, after string, max int) ([]DirEntry, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	var names []string
+	for name := range d.dirs[dir] {
+		if name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > max {
+		names = names[:max]
+	}
+	var out []DirEntry
+	for _, name := range names {
+		out = append(out, DirEntry{Name: name, ID: d.dirs[dir][name]})
+	}
+	return out, nil
+}
+
+// Update holds the data lock throughout, so nothing can change under the
+// transaction.
+func (b *fsTemp) Update(fn func(tx fsTxn) error) error {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return torus.ErrNotExist
+	}
+	tx := &fsTempTxn{
+		d:       d,
+		nodes:   make(map[uint64]*Node),
+		entries: make(map[tempEntry]uint64),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for id, n := range tx.nodes {
+		if n == nil {
+			delete(d.nodes, id)
+		} else {
+			d.nodes[id] = n
+		}
+	}
+	for e, id := range tx.entries {
+		if id == 0 {
+			delete(d.dirs[e.dir], e.name)
+			if len(d.dirs[e.dir]) == 0 {
+				delete(d.dirs, e.dir)
+			}
+			continue
+		}
+		if d.dirs[e.dir] == nil {
+			d.dirs[e.dir] = make(map[string]uint64)
+		}
+		d.dirs[e.dir][e.name] = id
+	}
+	return nil
+}
+
+type tempEntry struct {
+	dir  uint64
+	name string
+}
+
+// fsTempTxn stages changes to apply once the transaction succeeds.
+type fsTempTxn struct {
+	d *fsTempVolumeData
+	// nodes holds the nodes put, nil for deletions.
+	nodes map[uint64]*Node
+	// entries holds the entries put, 0 for deletions.
+	entries map[tempEntry]uint64
+}
+
+func (t *fsTempTxn) getNode(id uint64) (*Node, error) {
+	n, ok := t.nodes[id]
+	if !ok {
+		n, ok = t.d.nodes[id]
+	}
+	if !ok || n == nil {
+		return nil, torus.ErrNotExist
+	}
+	return copyNode(n), nil
+}
+
+func (t *fsTempTxn) lookup(dir uint64, name string) (uint64, error) {
+	id, ok := t.entries[tempEntry{dir, name}]
+	if !ok {
+		id, ok = t.d.dirs[dir][name]
+	}
+	if !ok || id == 0 {
+		return 0, torus.ErrNotExist
+	}
+	return id, nil
+}
+
+func (t *fsTempTxn) isEmpty(dir uint64) (bool, error) {
+	for e, id := range t.entries {
+		if e.dir == dir && id != 0 {
+			return false, nil
+		}
+	}
+	for name := range t.d.dirs[dir] {
+		if id, ok := t.entries[tempEntry{dir, name}]; !ok || id != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *fsTempTxn) putNode(n *Node) { t.nodes[n.ID] = copyNode(n) }
+
+func (t *fsTempTxn) deleteNode(id uint64) { t.nodes[id] = nil }
+
+func (t *fsTempTxn) putEntry(dir uint64, name string, id uint64) {
+	t.entries[tempEntry{dir, name}] = id
+}
+
+func (t *fsTempTxn) deleteEntry(dir uint64, name string) {
+	t.entries[tempEntry{dir, name}] = 0
+}
+
+// The temp metadata has no leases; marks last until they're cleared.
+func (b *fsTemp) SetWriteMark(handle string, mark torus.INodeID, lease int64) error {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return torus.ErrNotExist
+	}
+	d.marks[handle] = mark
+	return nil
+}
+
+func (b *fsTemp) ClearWriteMark(handle string) error {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return nil
+	}
+	delete(d.marks, handle)
+	return nil
+}
+
+func (b *fsTemp) GetWriteMarks() ([]torus.INodeID, error) {
+	b.LockData()
+	defer b.UnlockData()
+	d, ok := b.data()
+	if !ok {
+		return nil, torus.ErrNotExist
+	}
+	var out []torus.INodeID
+	for _, mark := range d.marks {
+		if mark != 0 {
+			out = append(out, mark)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,342 @@
+package fs
+
+import (
+	"os"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+// permMask is the part of a node's mode SetAttr may change.
+const permMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Create adds a node named name to the directory dir, and returns it. The
+// new node takes the type and permissions in n.Mode -- a regular file, or a
+// directory or symlink -- and its owner, and for a symlink its Target.
+// Unset access and modification times are set to now.
+func (v *Volume) Create(dir uint64, name string, n Node) (*Node, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	switch {
+	case n.Mode.IsRegular(), n.IsDir():
+	case n.IsSymlink():
+		n.Size = uint64(len(n.Target))
+	default:
+		return nil, torus.ErrNotSupported
+	}
+	id, err := v.srv.MDS.CommitINodeIndex(v.ID())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	n.ID = uint64(id)
+	n.Links = 1
+	n.Data = nil
+	n.Ctime = now
+	if n.Atime.IsZero() {
+		n.Atime = now
+	}
+	if n.Mtime.IsZero() {
+		n.Mtime = now
+	}
+	if n.IsDir() {
+		n.Links = 2
+		n.Parent = dir
+	}
+	err = v.mds.Update(func(tx fsTxn) error {
+		d, err := getDir(tx, dir)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.lookup(dir, name); err != torus.ErrNotExist {
+			if err == nil {
+				return torus.ErrExists
+			}
+			return err
+		}
+		if n.IsDir() {
+			d.Links++
+		}
+		d.Mtime, d.Ctime = now, now
+		tx.putNode(d)
+		tx.putNode(&n)
+		tx.putEntry(dir, name, n.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// getDir returns the directory dir in tx.
+func getDir(tx fsTxn, dir uint64) (*Node, error) {
+	d, err := tx.getNode(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !d.IsDir() {
+		return nil, torus.ErrNotDir
+	}
+	return d, nil
+}
+
+// Link adds another name for the node id, which mustn't be a directory.
+func (v *Volume) Link(dir uint64, name string, id uint64) (*Node, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	var out *Node
+	err := v.mds.Update(func(tx fsTxn) error {
+		n, err := tx.getNode(id)
+		if err != nil {
+			return err
+		}
+		if n.IsDir() {
+			return ErrIsDir
+		}
+		d, err := getDir(tx, dir)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.lookup(dir, name); err != torus.ErrNotExist {
+			if err == nil {
+				return torus.ErrExists
+			}
+			return err
+		}
+		now := time.Now()
+		n.Links++
+		n.Ctime = now
+		d.Mtime, d.Ctime = now, now
+		tx.putNode(n)
+		tx.putNode(d)
+		tx.putEntry(dir, name, id)
+		out = n
+		return nil
+	})
+	return out, err
+}
+
+// Remove removes the name name of a file or symlink from dir. The node is
+// deleted with its last name, and its contents are collected as garbage.
+func (v *Volume) Remove(dir uint64, name string) error {
+	return v.mds.Update(func(tx fsTxn) error {
+		d, err := getDir(tx, dir)
+		if err != nil {
+			return err
+		}
+		id, err := tx.lookup(dir, name)
+		if err != nil {
+			return err
+		}
+		n, err := tx.getNode(id)
+		if err != nil {
+			return err
+		}
+		if n.IsDir() {
+			return ErrIsDir
+		}
+		now := time.Now()
+		unlink(tx, n, now)
+		tx.deleteEntry(dir, name)
+		d.Mtime, d.Ctime = now, now
+		tx.putNode(d)
+		return nil
+	})
+}
+
+// unlink drops a link to the file or symlink n, deleting it if it was the
+// last.
+func unlink(tx fsTxn, n *Node, now time.Time) {
+	n.Links--
+	n.Ctime = now
+	if n.Links == 0 {
+		tx.deleteNode(n.ID)
+	} else {
+		tx.putNode(n)
+	}
+}
+
+// Rmdir removes the empty directory name from dir.
+func (v *Volume) Rmdir(dir uint64, name string) error {
+	return v.mds.Update(func(tx fsTxn) error {
+		d, err := getDir(tx, dir)
+		if err != nil {
+			return err
+		}
+		id, err := tx.lookup(dir, name)
+		if err != nil {
+			return err
+		}
+		if _, err := getDir(tx, id); err != nil {
+			return err
+		}
+		empty, err := tx.isEmpty(id)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return ErrNotEmpty
+		}
+		now := time.Now()
+		tx.deleteNode(id)
+		tx.deleteEntry(dir, name)
+		d.Links--
+		d.Mtime, d.Ctime = now, now
+		tx.putNode(d)
+		return nil
+	})
+}
+
+// Rename moves the entry fromName in the directory from to toName in to,
+// replacing whatever toName named, as rename(2) does: a file or symlink may
+// only replace another, and a directory only an empty directory.
+func (v *Volume) Rename(from uint64, fromName string, to uint64, toName string) error {
+	if err := ValidateName(toName); err != nil {
+		return err
+	}
+	return v.mds.Update(func(tx fsTxn) error {
+		fd, err := getDir(tx, from)
+		if err != nil {
+			return err
+		}
+		td := fd
+		if to != from {
+			td, err = getDir(tx, to)
+			if err != nil {
+				return err
+			}
+		}
+		id, err := tx.lookup(from, fromName)
+		if err != nil {
+			return err
+		}
+		n, err := tx.getNode(id)
+		if err != nil {
+			return err
+		}
+		if n.IsDir() && to != from {
+			// A directory can't be moved beneath itself.
+			for p := to; p != RootID; {
+				if p == id {
+					return torus.ErrInvalid
+				}
+				pn, err := tx.getNode(p)
+				if err != nil {
+					return err
+				}
+				p = pn.Parent
+			}
+		}
+		now := time.Now()
+		old, err := tx.lookup(to, toName)
+		switch err {
+		case nil:
+			if old == id {
+				// Both names are links to the same node.
+				return nil
+			}
+			o, err := tx.getNode(old)
+			if err != nil {
+				return err
+			}
+			if n.IsDir() {
+				if !o.IsDir() {
+					return torus.ErrNotDir
+				}
+				empty, err := tx.isEmpty(old)
+				if err != nil {
+					return err
+				}
+				if !empty {
+					return ErrNotEmpty
+				}
+				tx.deleteNode(old)
+				td.Links--
+			} else {
+				if o.IsDir() {
+					return ErrIsDir
+				}
+				unlink(tx, o, now)
+			}
+		case torus.ErrNotExist:
+		default:
+			return err
+		}
+		tx.deleteEntry(from, fromName)
+		tx.putEntry(to, toName, id)
+		if n.IsDir() && to != from {
+			fd.Links--
+			td.Links++
+			n.Parent = to
+		}
+		n.Ctime = now
+		tx.putNode(n)
+		fd.Mtime, fd.Ctime = now, now
+		td.Mtime, td.Ctime = now, now
+		tx.putNode(fd)
+		tx.putNode(td)
+		return nil
+	})
+}
+
+// SetAttr holds changes to a node's attributes. Nil fields are left as
+// they are.
+type SetAttr struct {
+	// Mode changes the permissions, and the setuid, setgid and sticky
+	// bits; the type of the node can't be changed.
+	Mode  *os.FileMode
+	UID   *uint32
+	GID   *uint32
+	Size  *uint64
+	Atime *time.Time
+	Mtime *time.Time
+}
+
+// SetAttr changes the attributes of node id. Changing the size of a file
+// truncates or extends it, as a File of its own synced straight away.
+func (v *Volume) SetAttr(id uint64, a SetAttr) (*Node, error) {
+	if a.Size != nil {
+		f, err := v.OpenFile(id)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Truncate(int64(*a.Size))
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var out *Node
+	err := v.mds.Update(func(tx fsTxn) error {
+		n, err := tx.getNode(id)
+		if err != nil {
+			return err
+		}
+		if a.Mode != nil {
+			n.Mode = n.Mode&^permMask | *a.Mode&permMask
+		}
+		if a.UID != nil {
+			n.UID = *a.UID
+		}
+		if a.GID != nil {
+			n.GID = *a.GID
+		}
+		if a.Atime != nil {
+			n.Atime = *a.Atime
+		}
+		if a.Mtime != nil {
+			n.Mtime = *a.Mtime
+		}
+		n.Ctime = time.Now()
+		tx.putNode(n)
+		out = n
+		return nil
+	})
+	return out, err
+}
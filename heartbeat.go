@@ -56,6 +56,10 @@ func (s *Server) BeginHeartbeat(addr *url.URL) error {
 	if err != nil {
 		return err
 	}
+	err = s.MDS.SetTopology(s.MDS.UUID(), s.Cfg.Topology)
+	if err != nil {
+		return err
+	}
 	s.UpdateRebalanceInfo(&models.RebalanceInfo{})
 	ch := make(chan interface{})
 	s.closeChans = append(s.closeChans, ch)
@@ -108,6 +112,30 @@ func (s *Server) updatePeerMap() {
 		clog.Warningf("couldn't update peerlist: %s", err)
 	}
 	promServerPeers.Set(float64(len(peers)))
+	cordoned, err := s.MDS.WithContext(ctxget).GetCordoned()
+	if err != nil {
+		clog.Warningf("couldn't update cordoned peers: %s", err)
+	} else {
+		s.mut.Lock()
+		s.cordoned = cordoned
+		s.mut.Unlock()
+	}
+	topology, err := s.MDS.WithContext(ctxget).GetTopology()
+	if err != nil {
+		clog.Warningf("couldn't update peer topology: %s", err)
+	} else {
+		s.mut.Lock()
+		s.topology = topology
+		s.mut.Unlock()
+	}
+	replication, err := s.MDS.WithContext(ctxget).GetVolumeReplication()
+	if err != nil {
+		clog.Warningf("couldn't update volume replication: %s", err)
+	} else {
+		s.mut.Lock()
+		s.replication = replication
+		s.mut.Unlock()
+	}
 	for _, p := range peers {
 		s.peersMap[p.UUID] = p
 	}
@@ -0,0 +1,102 @@
+package torus
+
+import (
+	"testing"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+func TestCheckpoint(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 20
+	before := makeTestData(size)
+	after := makeTestData(size)
+
+	for _, name := range []string{"testvol", "other"} {
+		f := createVol(t, client, name, uint64(size))
+		if _, err := f.WriteAt(before, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := block.SaveCheckpoint(client.MDS, "ck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Volumes) != 2 {
+		t.Fatalf("checkpoint covers %d volumes, expected 2", len(c.Volumes))
+	}
+	if _, err := block.SaveCheckpoint(client.MDS, "ck"); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists saving a checkpoint twice, got %v", err)
+	}
+	cps, err := block.GetCheckpoints(client.MDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cps) != 1 || cps[0].Name != "ck" {
+		t.Fatalf("listed checkpoints %v", cps)
+	}
+
+	f := openVol(t, client, "testvol")
+	if _, err := f.WriteAt(after, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is restored while a volume is attached.
+	if _, err := block.RestoreCheckpoint(client.MDS, "ck"); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked restoring over an attached volume, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, after, "testvol")
+
+	if err := block.DeleteBlockVolume(client.MDS, "other"); err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := block.RestoreCheckpoint(client.MDS, "ck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0] != "other" {
+		t.Fatalf("expected the deleted volume to be skipped, got %v", skipped)
+	}
+	compareBytes(t, mds, before, "testvol")
+
+	if err := block.DeleteCheckpoint(client.MDS, "ck"); err != nil {
+		t.Fatal(err)
+	}
+	cps, err = block.GetCheckpoints(client.MDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cps) != 0 {
+		t.Fatalf("checkpoints left after deleting: %v", cps)
+	}
+	vol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := vol.GetSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 0 {
+		t.Fatalf("checkpoint snapshots left after deleting: %v", snaps)
+	}
+	if err := block.DeleteCheckpoint(client.MDS, "ck"); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist deleting a missing checkpoint, got %v", err)
+	}
+}
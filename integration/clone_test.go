@@ -0,0 +1,78 @@
+package torus
+
+import (
+	"testing"
+
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+func TestCloneOutlivesSource(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 20
+	snapped := makeTestData(size)
+
+	f := createVol(t, client, "source", uint64(size))
+	if _, err := f.WriteAt(snapped, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src, err := block.OpenBlockVolume(client, "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	// The source moves on from the snapshot, so that the clone's blocks
+	// are only the snapshot's.
+	f = openVol(t, client, "source")
+	if _, err := f.WriteAt(makeTestData(size), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := block.CloneVolume(client, "source", "snap", "testvol"); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, snapped, "testvol")
+
+	// Neither the snapshot nor the source volume going takes the clone's
+	// blocks with it.
+	if err := src.DeleteSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	runGC(t, servers...)
+	compareBytes(t, mds, snapped, "testvol")
+	used := usedBlocks(servers...)
+	if err := block.DeleteBlockVolume(client.MDS, "source"); err != nil {
+		t.Fatal(err)
+	}
+	runGC(t, servers...)
+	compareBytes(t, mds, snapped, "testvol")
+	// Though the blocks only the source held are collected.
+	if n := usedBlocks(servers...); n >= used {
+		t.Fatalf("%d blocks stored after the source was collected, %d before", n, used)
+	}
+
+	// The clone can still be written.
+	written := makeTestData(size)
+	f = openVol(t, client, "testvol")
+	if _, err := f.WriteAt(written, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	runGC(t, servers...)
+	compareBytes(t, mds, written, "testvol")
+}
@@ -0,0 +1,82 @@
+package torus
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+func TestCompactAttached(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	writer := newServer(t, mds)
+	if err := distributor.OpenReplication(writer); err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	// The first half of the volume holds zeroes, the second half data.
+	const nBlocks = 20
+	size := BlockSize * nBlocks
+	data := makeTestData(size)
+	for i := 0; i < size/2; i++ {
+		data[i] = 0
+	}
+	f := createVol(t, writer, "testvol", uint64(size))
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep rewriting the second half while the volume is compacted.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			off := (nBlocks/2 + rand.Intn(nBlocks/2)) * BlockSize
+			rand.Read(data[off : off+BlockSize])
+			if _, err := f.WriteAt(data[off:off+BlockSize], int64(off)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	vol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := vol.Compact()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BlocksAfter > stats.BlocksBefore-nBlocks/2 {
+		t.Errorf("expected the %d zeroed blocks to be released, but went from %d to %d blocks", nBlocks/2, stats.BlocksBefore, stats.BlocksAfter)
+	}
+	if t.Failed() {
+		return
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, data, "testvol")
+}
@@ -0,0 +1,50 @@
+package torus
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/distributor"
+	"github.com/coreos/torus/internal/faultinject"
+)
+
+func TestReadAroundFailingReplica(t *testing.T) {
+	f := faultinject.New(1)
+	servers, mds := ringNWithStores(t, 3, func(i int, bs torus.BlockStore) torus.BlockStore {
+		if i != 0 {
+			return bs
+		}
+		return f.BlockStore(bs)
+	})
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 100
+	data := makeTestData(size)
+	vol := createVol(t, client, "testvol", uint64(size))
+	_, err = io.Copy(vol, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("couldn't copy: %v", err)
+	}
+	err = vol.Close()
+	if err != nil {
+		t.Fatalf("couldn't close: %v", err)
+	}
+
+	// Every read from the first server now fails; the other replica of each
+	// block should be used instead.
+	f.Add(faultinject.Rule{
+		Ops: []faultinject.Op{faultinject.OpGetBlock},
+		Err: torus.ErrBlockUnavailable,
+	})
+	compareBytes(t, mds, data, "testvol")
+	if f.Injected() == 0 {
+		t.Error("no reads were sent to the failing replica")
+	}
+	closeAll(t, servers...)
+}
@@ -8,11 +8,13 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/coreos/torus"
 	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/blockset"
 	"github.com/coreos/torus/distributor"
 	"github.com/coreos/torus/metadata/temp"
 	"github.com/coreos/torus/models"
@@ -27,6 +29,12 @@ const (
 )
 
 func newServer(t testing.TB, md *temp.Server) *torus.Server {
+	return newServerWithStore(t, md, nil)
+}
+
+// newServerWithStore creates a server whose block store is passed through
+// wrap, if it isn't nil.
+func newServerWithStore(t testing.TB, md *temp.Server, wrap func(torus.BlockStore) torus.BlockStore) *torus.Server {
 	dir, _ := ioutil.TempDir("", "torus-integration")
 	torus.MkdirsFor(dir)
 	cfg := torus.Config{
@@ -39,15 +47,29 @@ func newServer(t testing.TB, md *temp.Server) *torus.Server {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if wrap != nil {
+		blocks = wrap(blocks)
+	}
 	s, _ := torus.NewServerByImpl(cfg, mds, blocks)
 	return s
 }
 
 func createN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
+	return createNWithStores(t, n, nil)
+}
+
+// createNWithStores is createN, but the block store of the i'th server is
+// passed through wrap(i, store), if wrap isn't nil.
+func createNWithStores(t testing.TB, n int, wrap func(int, torus.BlockStore) torus.BlockStore) ([]*torus.Server, *temp.Server) {
 	var out []*torus.Server
 	s := temp.NewServer()
 	for i := 0; i < n; i++ {
-		srv := newServer(t, s)
+		var w func(torus.BlockStore) torus.BlockStore
+		if wrap != nil {
+			i := i
+			w = func(bs torus.BlockStore) torus.BlockStore { return wrap(i, bs) }
+		}
+		srv := newServerWithStore(t, s, w)
 		addr := fmt.Sprintf("http://127.0.0.1:%d", 40000+i)
 		uri, err := url.Parse(addr)
 		if err != nil {
@@ -65,7 +87,11 @@ func createN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
 }
 
 func ringN(t testing.TB, n int) ([]*torus.Server, *temp.Server) {
-	servers, mds := createN(t, n)
+	return ringNWithStores(t, n, nil)
+}
+
+func ringNWithStores(t testing.TB, n int, wrap func(int, torus.BlockStore) torus.BlockStore) ([]*torus.Server, *temp.Server) {
+	servers, mds := createNWithStores(t, n, wrap)
 	var peers torus.PeerInfoList
 	for _, s := range servers {
 		peers = append(peers, &models.PeerInfo{
@@ -169,6 +195,277 @@ func TestLoadAndDump(t *testing.T) {
 	closeAll(t, servers...)
 }
 
+func TestTunedVolume(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 100
+	data := makeTestData(size)
+	err = block.CreateBlockVolume(client.MDS, "testvol", uint64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = block.SetVolumeTuning(client.MDS, "testvol", &block.VolumeTuning{
+		ReadAhead:   BlockSize * 8,
+		WriteWindow: BlockSize * 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := openVol(t, client, "testvol")
+	_, err = io.Copy(f, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("couldn't copy: %v", err)
+	}
+	// Blocks still queued behind the write must read back as written.
+	readback := make([]byte, size)
+	_, err = f.ReadAt(readback, 0)
+	if err != nil && err != io.EOF {
+		t.Fatalf("couldn't read back: %v", err)
+	}
+	if !bytes.Equal(readback, data) {
+		t.Error("unsynced writes didn't read back")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("couldn't close: %v", err)
+	}
+
+	compareBytes(t, mds, data, "testvol")
+	closeAll(t, servers...)
+}
+
+// TestTunedFileRace reads, writes behind and reads ahead of a file on a bare
+// base blockset at once, for the race detector.
+func TestTunedFileRace(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	const nBlocks = 64
+	size := BlockSize * nBlocks
+	err = block.CreateBlockVolume(client.MDS, "testvol", uint64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := client.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := blockset.CreateBlocksetFromSpec(blockset.MustParseBlockLayerSpec("base"), client.Blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Truncate(nBlocks, BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	inode := &models.INode{Volume: vol.Id, INode: 1, Filesize: uint64(size)}
+	f, err := client.CreateFile(vol, inode, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetReadAhead(BlockSize * 8)
+	if err := f.SetWriteBehind(BlockSize * 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks written behind are stored while others are read.
+	data := makeTestData(size)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 4; round++ {
+			if _, err := f.WriteAt(data, 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, BlockSize)
+		for round := 0; round < 4; round++ {
+			for i := 0; i < nBlocks; i++ {
+				if _, err := f.ReadAt(buf, int64(i*BlockSize)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	if _, err := f.SyncAllWrites(); err != nil {
+		t.Fatal(err)
+	}
+	readback := make([]byte, size)
+	if _, err := f.ReadAt(readback, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readback, data) {
+		t.Fatal("written blocks didn't read back")
+	}
+
+	// Blocks read ahead, reading on past the old end of the file, are
+	// fetched while the blockset is trimmed and grown.
+	if err := f.Grow(int64(size * 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SyncAllWrites(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, BlockSize)
+	for i := nBlocks; i < nBlocks+4; i++ {
+		if _, err := f.ReadAt(buf, int64(i*BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Trim(0, int64(size*2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Grow(int64(size * 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnwrittenReads(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	client := newServer(t, mds)
+	err := distributor.OpenReplication(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 10
+	f := createVol(t, client, "testvol", uint64(size))
+	// Leave a hole before and after some data in the middle of block 3,
+	// and the rest of the volume past it unwritten.
+	at := BlockSize*3 + 10
+	written := makeTestData(100)
+	_, err = f.WriteAt(written, int64(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	copy(want[at:], written)
+	got := make([]byte, size)
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("unwritten data didn't read as zeros")
+	}
+
+	// Shrinking into the data and growing again must not bring it back.
+	err = f.Truncate(int64(at + 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := at + 50; i < at+100; i++ {
+		want[i] = 0
+	}
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("data cut off by truncation came back")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strict := newServer(t, mds)
+	strict.Cfg.UnwrittenReads = torus.UnwrittenReadError
+	err = distributor.OpenReplication(strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer strict.Close()
+	f = openVol(t, strict, "testvol")
+	defer f.Close()
+	buf := make([]byte, 50)
+	_, err = f.ReadAt(buf, int64(at))
+	if err != nil {
+		t.Fatalf("couldn't read written data: %v", err)
+	}
+	_, err = f.ReadAt(buf, BlockSize*5)
+	if err != torus.ErrUnwritten {
+		t.Fatalf("expected ErrUnwritten reading a hole, got %v", err)
+	}
+	closeAll(t, servers...)
+}
+
+// runGC has each server make a rebalance and GC pass, started after it's
+// called, and waits for them to finish.
+func runGC(t *testing.T, servers ...*torus.Server) {
+	for _, srv := range servers {
+		st := jobStatus(srv, "rebalance")
+		// A pass already going may have been prepared before the
+		// caller's changes, so it's the one after that counts.
+		want := st.Runs + 1
+		if st.Running {
+			want++
+		}
+		if err := srv.Jobs.Trigger("rebalance"); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(30 * time.Second)
+		for jobStatus(srv, "rebalance").Runs < want {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for a GC pass")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func jobStatus(srv *torus.Server, name string) torus.JobStatus {
+	for _, st := range srv.Jobs.Status() {
+		if st.Name == name {
+			return st
+		}
+	}
+	return torus.JobStatus{}
+}
+
+// usedBlocks counts the blocks stored on servers.
+func usedBlocks(servers ...*torus.Server) uint64 {
+	var n uint64
+	for _, srv := range servers {
+		n += srv.Blocks.UsedBlocks()
+	}
+	return n
+}
+
 func compareBytes(t *testing.T, mds *temp.Server, data []byte, volume string) {
 	reader := newServer(t, mds)
 	err := distributor.OpenReplication(reader)
@@ -0,0 +1,143 @@
+package torus
+
+import (
+	"testing"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+func TestShrinkVolume(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 20
+	data := makeTestData(BlockSize * 10)
+
+	// Blocks 0 to 9 and 17 are written, and the rest never are.
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(makeTestData(BlockSize), BlockSize*17); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is shrunk while the volume is attached.
+	if _, err := block.ShrinkBlockVolume(client, "testvol", BlockSize*15, true); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked shrinking an attached volume, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := block.ShrinkBlockVolume(client, "testvol", 0, true); err == nil {
+		t.Fatal("shrunk a volume to nothing")
+	}
+	if _, err := block.ShrinkBlockVolume(client, "testvol", uint64(size)+BlockSize, true); err == nil {
+		t.Fatal("shrunk a volume to more than its size")
+	}
+
+	// Block 17 is only dropped by force.
+	if _, err := block.ShrinkBlockVolume(client, "testvol", BlockSize*15, false); err != block.ErrShrinkData {
+		t.Fatalf("expected ErrShrinkData dropping written data, got %v", err)
+	}
+	if n := volumeSize(t, client); n != uint64(size) {
+		t.Fatalf("volume is %d bytes after a refused shrink, expected %d", n, size)
+	}
+	dropped, err := block.ShrinkBlockVolume(client, "testvol", BlockSize*15, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 1 {
+		t.Fatalf("dropped %d blocks, expected 1", dropped)
+	}
+	want := make([]byte, BlockSize*15)
+	copy(want, data)
+	compareBytes(t, mds, want, "testvol")
+
+	// A new end partway through block 9 keeps the block, so it's only
+	// refused while there's data in it past the end.
+	end := BlockSize*9 + 100
+	if _, err := block.ShrinkBlockVolume(client, "testvol", uint64(end), false); err != block.ErrShrinkData {
+		t.Fatalf("expected ErrShrinkData dropping the end of a straddling block, got %v", err)
+	}
+	f = openVol(t, client, "testvol")
+	if _, err := f.WriteAt(make([]byte, BlockSize*10-end), int64(end)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dropped, err = block.ShrinkBlockVolume(client, "testvol", uint64(end), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 0 {
+		t.Fatalf("dropped %d blocks, expected none", dropped)
+	}
+	if n := volumeSize(t, client); n != uint64(end) {
+		t.Fatalf("volume is %d bytes after shrinking, expected %d", n, end)
+	}
+	compareBytes(t, mds, data[:end], "testvol")
+}
+
+func TestGrowVolume(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize*10 + 100
+	data := makeTestData(size)
+
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := block.GrowBlockVolume(client, "testvol", uint64(size)-1); err == nil {
+		t.Fatal("grew a volume to less than its size")
+	}
+	if err := block.GrowBlockVolume(client, "testvol", BlockSize*15); err != nil {
+		t.Fatal(err)
+	}
+	if n := volumeSize(t, client); n != BlockSize*15 {
+		t.Fatalf("volume is %d bytes after growing, expected %d", n, BlockSize*15)
+	}
+	// The new space, including the rest of the last block, reads as
+	// zeroes.
+	want := make([]byte, BlockSize*15)
+	copy(want, data)
+	compareBytes(t, mds, want, "testvol")
+
+	// An attached volume is grown by its host once it notices.
+	f = openVol(t, client, "testvol")
+	if err := block.GrowBlockVolume(client, "testvol", BlockSize*20); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.RefreshSize(); err != nil || n != BlockSize*20 {
+		t.Fatalf("attached volume refreshed to %d bytes (%v), expected %d", n, err, BlockSize*20)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, make([]byte, BlockSize*5)...)
+	compareBytes(t, mds, want, "testvol")
+}
+
+// volumeSize returns the size recorded for testvol.
+func volumeSize(t *testing.T, srv *torus.Server) uint64 {
+	vol, err := srv.MDS.GetVolume("testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vol.MaxBytes
+}
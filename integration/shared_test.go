@@ -0,0 +1,86 @@
+package torus
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+	"github.com/coreos/torus/metadata/temp"
+)
+
+func openSharedVol(t *testing.T, mds *temp.Server) (*torus.Server, *block.BlockFile) {
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := vol.OpenSharedBlockFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, f
+}
+
+func TestSharedConcurrentWriters(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	// Two ranges, one written by each host, and a few blocks at the start
+	// of the second written by both.
+	size := 2 << 20
+	data := makeTestData(size)
+	creator := newServer(t, mds)
+	err := block.CreateBlockVolumeWithOptions(creator.MDS, "testvol", uint64(size), block.VolumeOptions{Shared: true})
+	creator.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, fa := openSharedVol(t, mds)
+	defer a.Close()
+	b, fb := openSharedVol(t, mds)
+	defer b.Close()
+
+	const chunk = 16 * 1024
+	var wg sync.WaitGroup
+	write := func(f *block.BlockFile, from, to int) {
+		defer wg.Done()
+		for off := from; off < to; off += chunk {
+			if _, err := f.WriteAt(data[off:off+chunk], int64(off)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+	wg.Add(4)
+	go write(fa, 0, size/2)
+	go write(fb, size/2, size)
+	go write(fa, size/2, size/2+4*chunk)
+	go write(fb, size/2, size/2+4*chunk)
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// Every write is committed, and seen by the other host, once it has
+	// returned.
+	got := make([]byte, size)
+	if _, err := fa.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if got[i] != data[i] {
+			t.Fatalf("host a read the wrong data at %d", i)
+		}
+	}
+	if err := fa.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, data, "testvol")
+}
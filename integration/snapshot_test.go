@@ -0,0 +1,113 @@
+package torus
+
+import (
+	"testing"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+func TestSnapshotRollback(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 20
+	before := makeTestData(size)
+	after := makeTestData(size)
+
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(before, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.SaveSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+	f = openVol(t, client, "testvol")
+	if _, err := f.WriteAt(after, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, after, "testvol")
+
+	if err := block.RollbackSnapshot(client.MDS, "testvol", "before", false); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, before, "testvol")
+	if err := block.RollbackSnapshot(client.MDS, "testvol", "nonesuch", false); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist rolling back to a missing snapshot, got %v", err)
+	}
+}
+
+func TestSnapshotRollbackAttached(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 20
+	before := makeTestData(size)
+	after := makeTestData(size)
+
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(before, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := block.OpenBlockVolume(client, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.SaveSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(after, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The attached volume is left alone without --force.
+	if err := block.RollbackSnapshot(client.MDS, "testvol", "before", false); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked rolling back an attached volume, got %v", err)
+	}
+	if _, err := f.WriteAt(after[:BlockSize], 0); err != nil {
+		t.Fatalf("writer was disturbed by a refused rollback: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("writer was disturbed by a refused rollback: %v", err)
+	}
+
+	// With it, the writer is fenced off, and can't undo the rollback.
+	if err := block.RollbackSnapshot(client.MDS, "testvol", "before", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(after[:BlockSize], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != torus.ErrLocked {
+		t.Fatalf("expected the fenced writer's sync to fail with ErrLocked, got %v", err)
+	}
+	if _, err := f.WriteAt(after[:BlockSize], 0); err != torus.ErrLocked {
+		t.Fatalf("expected the fenced writer's writes to fail with ErrLocked, got %v", err)
+	}
+	compareBytes(t, mds, before, "testvol")
+}
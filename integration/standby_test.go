@@ -0,0 +1,179 @@
+package torus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+// openStandby follows testvol from a server of its own, so that it holds a
+// different lease from the writer's.
+func openStandby(t *testing.T, srv *torus.Server) *block.Standby {
+	vol, err := block.OpenBlockVolume(srv, "testvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := vol.OpenStandby(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sb
+}
+
+// waitStandby waits until the standby serves data.
+func waitStandby(t *testing.T, sb *block.Standby, data []byte) {
+	buf := make([]byte, len(data))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := sb.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(buf, data) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("standby didn't catch up with the writer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStandbyPromote(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	standby := newServer(t, mds)
+	if err := distributor.OpenReplication(standby); err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	size := BlockSize * 20
+	first := makeTestData(size)
+	second := makeTestData(size)
+	third := makeTestData(size)
+
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	sb := openStandby(t, standby)
+	defer sb.Close()
+	waitStandby(t, sb, first)
+
+	// The standby follows what the writer commits, and can't write itself.
+	if _, err := f.WriteAt(second, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	waitStandby(t, sb, second)
+	if _, err := sb.File().WriteAt(third, 0); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked writing to the standby, got %v", err)
+	}
+
+	if _, err := sb.Promote(false); err != torus.ErrLocked {
+		t.Fatalf("expected ErrLocked promoting over an attached writer, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pf, err := sb.Promote(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.File() != pf {
+		t.Error("promoted standby doesn't serve the file it returned")
+	}
+	if _, err := sb.Promote(false); err != torus.ErrInvalid {
+		t.Fatalf("expected ErrInvalid promoting twice, got %v", err)
+	}
+	if _, err := pf.WriteAt(third, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, third, "testvol")
+}
+
+func TestStandbyFence(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	standby := newServer(t, mds)
+	if err := distributor.OpenReplication(standby); err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	size := BlockSize * 20
+	first := makeTestData(size)
+	second := makeTestData(size)
+
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	sb := openStandby(t, standby)
+	defer sb.Close()
+
+	pf, err := sb.Promote(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, pf, size), first) {
+		t.Fatal("promoted standby doesn't hold the last committed data")
+	}
+
+	// The fenced writer's next sync fails, and it refuses writes from then
+	// on, so it can't overwrite what the new holder commits.
+	if _, err := f.WriteAt(second[:BlockSize], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != torus.ErrLocked {
+		t.Fatalf("expected the fenced writer's sync to fail with ErrLocked, got %v", err)
+	}
+	if _, err := f.WriteAt(second[:BlockSize], 0); err != torus.ErrLocked {
+		t.Fatalf("expected the fenced writer's writes to fail with ErrLocked, got %v", err)
+	}
+	// Closing the fenced writer leaves the new holder's lock alone.
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pf.WriteAt(second, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := pf.Sync(); err != nil {
+		t.Fatalf("new holder lost the lock when the fenced writer closed: %v", err)
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, mds, second, "testvol")
+}
+
+func readAll(t *testing.T, f *block.BlockFile, size int) []byte {
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
@@ -0,0 +1,108 @@
+package torus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/coreos/torus/distributor"
+)
+
+func TestTrashRestore(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 20
+	data := makeTestData(size)
+
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	used := usedBlocks(servers...)
+	if used == 0 {
+		t.Fatal("no blocks stored")
+	}
+	if err := block.TrashBlockVolume(client.MDS, "testvol", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := block.OpenBlockVolume(client, "testvol"); err == nil {
+		t.Fatal("trashed volume can still be opened")
+	}
+
+	// The GC keeps the blocks of volumes in the trash.
+	runGC(t, servers...)
+	if n := usedBlocks(servers...); n != used {
+		t.Fatalf("%d blocks stored after a GC pass with the volume in the trash, expected %d", n, used)
+	}
+	if err := block.RestoreBlockVolume(client.MDS, "testvol", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := block.RestoreBlockVolume(client.MDS, "testvol", ""); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist restoring twice, got %v", err)
+	}
+	runGC(t, servers...)
+	compareBytes(t, mds, data, "testvol")
+}
+
+func TestTrashPurge(t *testing.T) {
+	servers, mds := ringN(t, 3)
+	defer closeAll(t, servers...)
+	client := newServer(t, mds)
+	if err := distributor.OpenReplication(client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	size := BlockSize * 20
+
+	f := createVol(t, client, "testvol", uint64(size))
+	if _, err := f.WriteAt(makeTestData(size), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := block.TrashBlockVolume(client.MDS, "testvol", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is purged before it expires.
+	now := time.Now()
+	if err := block.PurgeTrash(client, now); err != nil {
+		t.Fatal(err)
+	}
+	trash, err := block.GetTrash(client.MDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Name != "testvol" {
+		t.Fatalf("trash holds %v before the volume expired", trash)
+	}
+
+	if err := block.PurgeTrash(client, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	trash, err = block.GetTrash(client.MDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 0 {
+		t.Fatalf("trash holds %v after the volume expired", trash)
+	}
+	if err := block.RestoreBlockVolume(client.MDS, "testvol", ""); err != torus.ErrNotExist {
+		t.Fatalf("expected ErrNotExist restoring a purged volume, got %v", err)
+	}
+	// Then its blocks are collected.
+	runGC(t, servers...)
+	if n := usedBlocks(servers...); n != 0 {
+		t.Fatalf("%d blocks left after the purged volume was collected", n)
+	}
+}
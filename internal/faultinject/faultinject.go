@@ -0,0 +1,288 @@
+// Package faultinject wraps the block storage and peer RPC interfaces so that
+// tests can make them fail, stall or lose operations on demand.
+package faultinject
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/distributor/protocols"
+)
+
+// Op names a kind of operation a Rule applies to.
+type Op string
+
+const (
+	OpHasBlock    Op = "hasblock"
+	OpGetBlock    Op = "getblock"
+	OpWriteBlock  Op = "writeblock"
+	OpDeleteBlock Op = "deleteblock"
+	OpPutBlock    Op = "putblock"
+	OpBlock       Op = "block"
+	OpCheck       Op = "check"
+)
+
+// ErrInjected is what a Rule with no Delay, Err or Drop fails operations with.
+var ErrInjected = errors.New("faultinject: injected fault")
+
+// Rule describes a fault and the operations it applies to. An operation
+// matches if it is one of Ops and, if Match is set, Match returns true for the
+// block it concerns.
+type Rule struct {
+	// Ops lists the operations the rule applies to; empty means all of them.
+	Ops []Op
+	// Match restricts the rule to some blocks. Operations on several blocks
+	// at once, such as RebalanceCheck, match if any of their blocks do.
+	Match func(torus.BlockRef) bool
+	// After skips the first After matching operations.
+	After int
+	// Times limits the rule to that many faults; zero means no limit.
+	Times int
+	// Probability is the chance a matching operation is faulted; zero means
+	// always.
+	Probability float64
+
+	// Delay is added to faulted operations before anything else happens.
+	Delay time.Duration
+	// Err, if set, fails the operation without performing it.
+	Err error
+	// Drop loses the operation. Writes and deletes report success without
+	// doing anything; everything else waits for its context to be done.
+	Drop bool
+
+	seen     int
+	injected int
+}
+
+// Ref returns a Match function for a single block.
+func Ref(ref torus.BlockRef) func(torus.BlockRef) bool {
+	return func(b torus.BlockRef) bool {
+		return b == ref
+	}
+}
+
+func (r *Rule) matches(op Op, refs []torus.BlockRef) bool {
+	if len(r.Ops) != 0 {
+		found := false
+		for _, o := range r.Ops {
+			if o == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Match == nil {
+		return true
+	}
+	for _, ref := range refs {
+		if r.Match(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultInjector holds the rules shared by the stores and RPC clients it wraps.
+// Rules are checked in the order they were added and the first one to fault
+// an operation decides what happens to it.
+type FaultInjector struct {
+	mut   sync.Mutex
+	rules []*Rule
+	rand  *rand.Rand
+	calls map[Op]int
+}
+
+// New creates a FaultInjector with no rules. The seed makes probabilistic
+// rules repeatable.
+func New(seed int64) *FaultInjector {
+	return &FaultInjector{
+		rand:  rand.New(rand.NewSource(seed)),
+		calls: make(map[Op]int),
+	}
+}
+
+// Add adds a rule.
+func (f *FaultInjector) Add(r Rule) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.rules = append(f.rules, &r)
+}
+
+// Reset removes all the rules and zeroes the call counts.
+func (f *FaultInjector) Reset() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.rules = nil
+	f.calls = make(map[Op]int)
+}
+
+// Calls returns how many operations of kind op have been seen, faulted or not.
+func (f *FaultInjector) Calls(op Op) int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.calls[op]
+}
+
+// Injected returns the number of faults injected by all the rules.
+func (f *FaultInjector) Injected() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	n := 0
+	for _, r := range f.rules {
+		n += r.injected
+	}
+	return n
+}
+
+func (f *FaultInjector) choose(op Op, refs []torus.BlockRef) *Rule {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.calls[op]++
+	for _, r := range f.rules {
+		if !r.matches(op, refs) {
+			continue
+		}
+		r.seen++
+		if r.seen <= r.After {
+			continue
+		}
+		if r.Times != 0 && r.injected >= r.Times {
+			continue
+		}
+		if r.Probability != 0 && f.rand.Float64() >= r.Probability {
+			continue
+		}
+		r.injected++
+		return r
+	}
+	return nil
+}
+
+// inject applies any fault for an operation. It returns true if the operation
+// should not be performed, in which case err is what it should return.
+func (f *FaultInjector) inject(ctx context.Context, op Op, refs ...torus.BlockRef) (bool, error) {
+	r := f.choose(op, refs)
+	if r == nil {
+		return false, nil
+	}
+	if r.Delay != 0 {
+		select {
+		case <-time.After(r.Delay):
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+	if r.Err != nil {
+		return true, r.Err
+	}
+	if !r.Drop {
+		if r.Delay != 0 {
+			return false, nil
+		}
+		return true, ErrInjected
+	}
+	switch op {
+	case OpWriteBlock, OpDeleteBlock, OpPutBlock:
+		return true, nil
+	}
+	<-ctx.Done()
+	return true, ctx.Err()
+}
+
+// BlockStore wraps bs so that its operations are subject to the rules.
+func (f *FaultInjector) BlockStore(bs torus.BlockStore) torus.BlockStore {
+	return &blockStore{BlockStore: bs, f: f}
+}
+
+// RPC wraps r so that its operations are subject to the rules. r may be either
+// a client connection to a peer or the handler given to an RPC listener.
+func (f *FaultInjector) RPC(r protocols.RPC) protocols.RPC {
+	return &rpc{RPC: r, f: f}
+}
+
+type blockStore struct {
+	torus.BlockStore
+	f *FaultInjector
+}
+
+func (b *blockStore) HasBlock(ctx context.Context, ref torus.BlockRef) (bool, error) {
+	if skip, err := b.f.inject(ctx, OpHasBlock, ref); skip {
+		return false, err
+	}
+	return b.BlockStore.HasBlock(ctx, ref)
+}
+
+func (b *blockStore) GetBlock(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	if skip, err := b.f.inject(ctx, OpGetBlock, ref); skip {
+		return nil, err
+	}
+	return b.BlockStore.GetBlock(ctx, ref)
+}
+
+func (b *blockStore) WriteBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
+	if skip, err := b.f.inject(ctx, OpWriteBlock, ref); skip {
+		return err
+	}
+	return b.BlockStore.WriteBlock(ctx, ref, data)
+}
+
+func (b *blockStore) WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	if skip, err := b.f.inject(ctx, OpWriteBlock, ref); skip {
+		if err != nil {
+			return nil, err
+		}
+		// Dropped: hand out a buffer that goes nowhere.
+		return make([]byte, b.BlockSize()), nil
+	}
+	return b.BlockStore.WriteBuf(ctx, ref)
+}
+
+func (b *blockStore) DeleteBlock(ctx context.Context, ref torus.BlockRef) error {
+	if skip, err := b.f.inject(ctx, OpDeleteBlock, ref); skip {
+		return err
+	}
+	return b.BlockStore.DeleteBlock(ctx, ref)
+}
+
+type rpc struct {
+	protocols.RPC
+	f *FaultInjector
+}
+
+func (r *rpc) PutBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
+	if skip, err := r.f.inject(ctx, OpPutBlock, ref); skip {
+		return err
+	}
+	return r.RPC.PutBlock(ctx, ref, data)
+}
+
+func (r *rpc) Block(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	if skip, err := r.f.inject(ctx, OpBlock, ref); skip {
+		return nil, err
+	}
+	return r.RPC.Block(ctx, ref)
+}
+
+func (r *rpc) RebalanceCheck(ctx context.Context, refs []torus.BlockRef) ([]bool, error) {
+	if skip, err := r.f.inject(ctx, OpCheck, refs...); skip {
+		return nil, err
+	}
+	return r.RPC.RebalanceCheck(ctx, refs)
+}
+
+func (r *rpc) WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	// There's no knowing how big a buffer to fake here, so a dropped
+	// WriteBuf is performed anyway.
+	if _, err := r.f.inject(ctx, OpPutBlock, ref); err != nil {
+		return nil, err
+	}
+	return r.RPC.WriteBuf(ctx, ref)
+}
@@ -0,0 +1,102 @@
+package faultinject
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func ref(i int) torus.BlockRef {
+	return torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 1),
+		Index:    torus.IndexID(i),
+	}
+}
+
+func TestRuleMatching(t *testing.T) {
+	f := New(1)
+	f.Add(Rule{
+		Ops:   []Op{OpGetBlock},
+		Match: Ref(ref(2)),
+		After: 1,
+		Times: 2,
+	})
+	ctx := context.TODO()
+	var got []bool
+	for i := 0; i < 4; i++ {
+		skip, _ := f.inject(ctx, OpGetBlock, ref(2))
+		got = append(got, skip)
+	}
+	want := []bool{false, true, true, false}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("call %d: expected fault %v, got %v", i, want[i], got[i])
+		}
+	}
+	if skip, _ := f.inject(ctx, OpGetBlock, ref(3)); skip {
+		t.Error("faulted an operation on another block")
+	}
+	if skip, _ := f.inject(ctx, OpWriteBlock, ref(2)); skip {
+		t.Error("faulted another kind of operation")
+	}
+	if f.Calls(OpGetBlock) != 5 || f.Injected() != 2 {
+		t.Errorf("expected 5 calls and 2 faults, got %d and %d", f.Calls(OpGetBlock), f.Injected())
+	}
+}
+
+func TestProbabilityIsRepeatable(t *testing.T) {
+	run := func() []bool {
+		f := New(42)
+		f.Add(Rule{Probability: 0.5})
+		var out []bool
+		for i := 0; i < 50; i++ {
+			skip, _ := f.inject(context.TODO(), OpBlock, ref(i))
+			out = append(out, skip)
+		}
+		return out
+	}
+	a, b := run(), run()
+	faults := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatal("the same seed gave different faults")
+		}
+		if a[i] {
+			faults++
+		}
+	}
+	if faults == 0 || faults == len(a) {
+		t.Errorf("expected some but not all operations to fault, got %d of %d", faults, len(a))
+	}
+}
+
+func TestDropAndDelay(t *testing.T) {
+	f := New(1)
+	f.Add(Rule{Ops: []Op{OpWriteBlock}, Drop: true})
+	f.Add(Rule{Ops: []Op{OpGetBlock}, Drop: true})
+	f.Add(Rule{Ops: []Op{OpHasBlock}, Delay: 10 * time.Millisecond})
+
+	skip, err := f.inject(context.TODO(), OpWriteBlock, ref(1))
+	if !skip || err != nil {
+		t.Errorf("expected a dropped write to succeed silently, got %v, %v", skip, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	skip, err = f.inject(ctx, OpGetBlock, ref(1))
+	if !skip || err != context.DeadlineExceeded {
+		t.Errorf("expected a dropped read to time out, got %v, %v", skip, err)
+	}
+
+	start := time.Now()
+	skip, err = f.inject(context.TODO(), OpHasBlock, ref(1))
+	if skip || err != nil {
+		t.Errorf("expected a delayed operation to go ahead, got %v, %v", skip, err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("operation wasn't delayed")
+	}
+}
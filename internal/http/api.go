@@ -29,6 +29,7 @@ func NewServer(dfs *torus.Server) *Server {
 
 func (s *Server) setupRoutes() {
 	s.router.GET("/metrics", s.prometheus)
+	s.setupJobRoutes()
 	ginpprof.Wrapper(s.router)
 }
 
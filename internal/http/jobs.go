@@ -0,0 +1,43 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/coreos/torus"
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) setupJobRoutes() {
+	s.router.GET("/v1/jobs", s.getJobs)
+	s.router.POST("/v1/jobs/:name/pause", s.controlJob((*torus.JobScheduler).Pause))
+	s.router.POST("/v1/jobs/:name/resume", s.controlJob((*torus.JobScheduler).Resume))
+	s.router.POST("/v1/jobs/:name/trigger", s.controlJob((*torus.JobScheduler).Trigger))
+	s.router.GET("/v1/scrub", s.getScrub)
+}
+
+func (s *Server) getJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, s.dfs.Jobs.Status())
+}
+
+func (s *Server) getScrub(c *gin.Context) {
+	sc, ok := s.dfs.Blocks.(torus.Scrubber)
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, sc.ScrubStatus())
+}
+
+func (s *Server) controlJob(op func(*torus.JobScheduler, string) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := op(s.dfs.Jobs, c.Param("name"))
+		switch err {
+		case nil:
+			c.Status(http.StatusNoContent)
+		case torus.ErrNoJob:
+			c.AbortWithStatus(http.StatusNotFound)
+		default:
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+	}
+}
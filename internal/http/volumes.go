@@ -0,0 +1,107 @@
+package http
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/torus"
+	"github.com/coreos/torus/block"
+	"github.com/gin-gonic/gin"
+)
+
+// EnableVolumeGateway serves the contents of block volumes, read-only, at
+// /v1/volumes/NAME, with support for Range requests; ?snapshot=SNAPSHOT
+// serves one of the volume's snapshots instead. /v1/volumes/NAME/diff lists
+// the extents changed between the snapshots ?from and ?to, as
+// BlockVolume.ChangedExtents does, for incremental backups. If token is not
+// empty, requests must carry it as a bearer token in the Authorization
+// header.
+func (s *Server) EnableVolumeGateway(token string) {
+	g := s.router.Group("/v1/volumes", s.requireToken(token))
+	g.GET("/:name", s.getVolume)
+	g.HEAD("/:name", s.getVolume)
+	g.GET("/:name/diff", s.getVolumeDiff)
+}
+
+func (s *Server) requireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.Next()
+			return
+		}
+		auth := c.Request.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+func (s *Server) getVolume(c *gin.Context) {
+	name := c.Param("name")
+	v, err := s.dfs.MDS.GetVolume(name)
+	if err != nil || v.Type != block.VolumeType {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	vol, err := block.OpenBlockVolume(s.dfs, name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	var f *block.BlockFile
+	if snap := c.Query("snapshot"); snap != "" {
+		f, err = vol.OpenSnapshot(snap)
+	} else {
+		f, err = vol.OpenReadOnlyBlockFile()
+	}
+	if err == torus.ErrNotExist {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+	// Every write to a volume produces a new INode, so the INode identifies
+	// this version of the contents and lets clients resume with If-Range.
+	ref := f.INodeRef()
+	c.Header("ETag", fmt.Sprintf(`"%d-%d"`, ref.Volume(), ref.INode))
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, io.NewSectionReader(f, 0, int64(f.Size())))
+}
+
+func (s *Server) getVolumeDiff(c *gin.Context) {
+	name := c.Param("name")
+	v, err := s.dfs.MDS.GetVolume(name)
+	if err != nil || v.Type != block.VolumeType {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	vol, err := block.OpenBlockVolume(s.dfs, name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	extents, err := vol.ChangedExtents(c.Query("from"), c.Query("to"))
+	if err == torus.ErrNotExist {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if extents == nil {
+		extents = []block.Extent{}
+	}
+	c.JSON(http.StatusOK, extents)
+}
@@ -0,0 +1,152 @@
+// Package metrics sends the Prometheus metrics a process collects to wherever
+// its operators want them: scraped from the HTTP API, or pushed to a metrics
+// pipeline.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/torus/internal/ratelog"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	clog = capnslog.NewPackageLogger("github.com/coreos/torus", "metrics")
+	rlog = ratelog.New(clog, ratelog.DefaultInterval)
+)
+
+// Sink receives the metrics of a process.
+type Sink interface {
+	// Push sends the current value of every metric.
+	Push(families []*dto.MetricFamily) error
+	Close() error
+}
+
+// NewSinkFunc creates a Sink from the URL naming it.
+type NewSinkFunc func(u *url.URL) (Sink, error)
+
+var sinks map[string]NewSinkFunc
+
+// RegisterSink makes a kind of Sink available to OpenSink under the given
+// URL scheme.
+func RegisterSink(scheme string, newFunc NewSinkFunc) {
+	if sinks == nil {
+		sinks = make(map[string]NewSinkFunc)
+	}
+
+	if _, ok := sinks[scheme]; ok {
+		panic("metrics: attempted to register sink " + scheme + " twice")
+	}
+
+	sinks[scheme] = newFunc
+}
+
+// OpenSink opens the Sink named by spec, a URL such as
+// "statsd://localhost:8125", or just the scheme for sinks which need no
+// address, such as "prometheus".
+func OpenSink(spec string) (Sink, error) {
+	if !strings.Contains(spec, "://") {
+		spec += "://"
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	newFunc, ok := sinks[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("metrics: no sink %q; have %s", u.Scheme, strings.Join(sinkNames(), ", "))
+	}
+	return newFunc(u)
+}
+
+func sinkNames() []string {
+	var out []string
+	for k := range sinks {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Prometheus is the sink for metrics scraped from the /metrics endpoint of
+// the HTTP API, which serves them whatever the sink. It ignores pushes.
+var Prometheus Sink = prometheusSink{}
+
+type prometheusSink struct{}
+
+func (prometheusSink) Push([]*dto.MetricFamily) error { return nil }
+func (prometheusSink) Close() error                   { return nil }
+
+func init() {
+	RegisterSink("prometheus", func(*url.URL) (Sink, error) {
+		return Prometheus, nil
+	})
+}
+
+// Gather returns the current value of every registered metric, as they would
+// be scraped.
+func Gather() ([]*dto.MetricFamily, error) {
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain; version=0.0.4")
+	rec := httptest.NewRecorder()
+	prometheus.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("metrics: gathering failed: %s", strings.TrimSpace(rec.Body.String()))
+	}
+	var p expfmt.TextParser
+	byName, err := p.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		out = append(out, mf)
+	}
+	sort.Sort(byFamilyName(out))
+	return out, nil
+}
+
+type byFamilyName []*dto.MetricFamily
+
+func (f byFamilyName) Len() int           { return len(f) }
+func (f byFamilyName) Less(i, j int) bool { return f[i].GetName() < f[j].GetName() }
+func (f byFamilyName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// Run pushes the metrics to sink every interval until stop is closed, then
+// closes the sink. Pushing to the Prometheus sink would do nothing, so Run
+// returns at once for it.
+func Run(sink Sink, interval time.Duration, stop <-chan struct{}) {
+	if sink == Prometheus {
+		return
+	}
+	defer sink.Close()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		families, err := Gather()
+		if err == nil {
+			err = sink.Push(families)
+		}
+		if err != nil {
+			rlog.Warningf("couldn't push metrics: %v", err)
+		}
+	}
+}
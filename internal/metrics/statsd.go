@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdPacketSize bounds the datagrams sent to StatsD, so that they aren't
+// fragmented on a typical network.
+const statsdPacketSize = 1432
+
+func init() {
+	RegisterSink("statsd", newStatsdSink)
+}
+
+// statsdSink pushes metrics to a StatsD server over UDP. Gauges are sent as
+// gauges; counters, and the count and sum of histograms and summaries, as
+// the counts since the previous push.
+//
+// StatsD has no labels, so by default label values are appended to the
+// metric name, separated by dots. With ?tags=dogstatsd in the URL, they are
+// sent as DogStatsD tags instead, which many StatsD servers understand.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+	last   map[string]float64
+}
+
+func newStatsdSink(u *url.URL) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("metrics: statsd sink needs an address, as statsd://HOST:PORT")
+	}
+	q := u.Query()
+	s := &statsdSink{
+		prefix: q.Get("prefix"),
+		last:   make(map[string]float64),
+	}
+	switch q.Get("tags") {
+	case "":
+	case "dogstatsd":
+		s.tags = true
+	default:
+		return nil, fmt.Errorf("metrics: unknown statsd tag format %q", q.Get("tags"))
+	}
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, ".") {
+		s.prefix += "."
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return s, nil
+}
+
+func (s *statsdSink) Push(families []*dto.MetricFamily) error {
+	var buf bytes.Buffer
+	for _, line := range s.lines(families) {
+		if buf.Len() != 0 && buf.Len()+1+len(line) > statsdPacketSize {
+			if _, err := s.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() != 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
+
+// lines formats families as StatsD lines, remembering the counts sent.
+func (s *statsdSink) lines(families []*dto.MetricFamily) []string {
+	var out []string
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				out = s.count(out, name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				out = append(out, s.line(name, m, m.GetGauge().GetValue(), "g"))
+			case dto.MetricType_UNTYPED:
+				out = append(out, s.line(name, m, m.GetUntyped().GetValue(), "g"))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				out = s.count(out, name+"_count", m, float64(h.GetSampleCount()))
+				out = s.count(out, name+"_sum", m, h.GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				sm := m.GetSummary()
+				out = s.count(out, name+"_count", m, float64(sm.GetSampleCount()))
+				out = s.count(out, name+"_sum", m, sm.GetSampleSum())
+			}
+		}
+	}
+	return out
+}
+
+// count appends a counter line for the increase in a cumulative value since
+// the last push. A value which went down was reset, so it is sent whole.
+func (s *statsdSink) count(out []string, name string, m *dto.Metric, v float64) []string {
+	key := name
+	for _, l := range m.GetLabel() {
+		key += "," + l.GetName() + "=" + l.GetValue()
+	}
+	delta := v - s.last[key]
+	if delta < 0 {
+		delta = v
+	}
+	s.last[key] = v
+	if delta == 0 {
+		return out
+	}
+	return append(out, s.line(name, m, delta, "c"))
+}
+
+func (s *statsdSink) line(name string, m *dto.Metric, v float64, kind string) string {
+	line := s.name(name, m) + ":" + strconv.FormatFloat(v, 'g', -1, 64) + "|" + kind
+	if s.tags && len(m.GetLabel()) != 0 {
+		var tags []string
+		for _, l := range m.GetLabel() {
+			tags = append(tags, statsdClean(l.GetName())+":"+statsdClean(l.GetValue()))
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// name returns the StatsD name of a metric, including its label values unless
+// they are sent as tags.
+func (s *statsdSink) name(name string, m *dto.Metric) string {
+	out := s.prefix + name
+	if s.tags {
+		return out
+	}
+	for _, l := range m.GetLabel() {
+		out += "." + strings.Replace(statsdClean(l.GetValue()), ".", "_", -1)
+	}
+	return out
+}
+
+// statsdClean replaces the characters with special meaning to StatsD.
+func statsdClean(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
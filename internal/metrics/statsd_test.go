@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func family(name string, typ dto.MetricType, metrics ...*dto.Metric) *dto.MetricFamily {
+	return &dto.MetricFamily{Name: &name, Type: &typ, Metric: metrics}
+}
+
+func labelled(k, v string, m *dto.Metric) *dto.Metric {
+	m.Label = append(m.Label, &dto.LabelPair{Name: &k, Value: &v})
+	return m
+}
+
+func counter(v float64) *dto.Metric { return &dto.Metric{Counter: &dto.Counter{Value: &v}} }
+func gauge(v float64) *dto.Metric   { return &dto.Metric{Gauge: &dto.Gauge{Value: &v}} }
+
+func TestStatsdLines(t *testing.T) {
+	push := func(reqs float64) []*dto.MetricFamily {
+		return []*dto.MetricFamily{
+			family("reqs_total", dto.MetricType_COUNTER, labelled("peer", "10.0.0.1:40000", counter(reqs))),
+			family("used", dto.MetricType_GAUGE, gauge(0.5)),
+		}
+	}
+
+	s := &statsdSink{prefix: "torus.", last: make(map[string]float64)}
+	for _, tt := range []struct {
+		reqs float64
+		want []string
+	}{
+		{5, []string{"torus.reqs_total.10_0_0_1_40000:5|c", "torus.used:0.5|g"}},
+		{5, []string{"torus.used:0.5|g"}},
+		{8, []string{"torus.reqs_total.10_0_0_1_40000:3|c", "torus.used:0.5|g"}},
+		{2, []string{"torus.reqs_total.10_0_0_1_40000:2|c", "torus.used:0.5|g"}},
+	} {
+		if got := s.lines(push(tt.reqs)); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("counter at %v: got %q, expected %q", tt.reqs, got, tt.want)
+		}
+	}
+
+	s = &statsdSink{tags: true, last: make(map[string]float64)}
+	want := []string{"reqs_total:5|c|#peer:10.0.0.1_40000", "used:0.5|g"}
+	if got := s.lines(push(5)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("with tags: got %q, expected %q", got, want)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -44,22 +45,49 @@ const (
 const (
 	flagSendFlush = (1 << 2) // can flush writeback cache
 	flagSendTrim  = (1 << 5) // Send TRIM (discard)
+	flagReadOnly  = (1 << 1) // device is read-only
+	flagSendFUA   = (1 << 3) // Send FUA (Force Unit Access)
 	// flagHasFlags   = (1 << 0) // nbd-server supports flags
-	// flagReadOnly   = (1 << 1) // device is read-only
-	// flagSendFUA    = (1 << 3) // Send FUA (Force Unit Access)
 	// flagRotational = (1 << 4) // Use elevator algorithm - rotational media
 )
 
 const (
-	magicRequest = 0x25609513
-	magicReply   = 0x67446698
+	cmdFlagFUA = (1 << 0) // write must be on stable storage before the reply
+)
+
+const (
+	magicRequest         = 0x25609513
+	magicReply           = 0x67446698
+	magicStructuredReply = 0x668e33ef
 	// Do *not* use magics: 0x12560953 0x96744668.
 )
 
+// Structured replies, sent to reads once a client has negotiated them with
+// NBD_OPT_STRUCTURED_REPLY.
+const (
+	replyFlagDone = (1 << 0) // last chunk of the reply
+
+	replyTypeNone       = 0
+	replyTypeOffsetData = 1
+	replyTypeOffsetHole = 2
+	replyTypeError      = (1 << 15) + 1
+)
+
+// holeGranularity is the size of the aligned runs of zeroes a structured
+// reply to a read sends as holes rather than data.
+const holeGranularity = 4096
+
 const (
-	errIO = 5
+	errPerm  = 1
+	errIO    = 5
+	errInval = 22
 )
 
+// maxRequestLength bounds the data of a single read or write request. The
+// kernel never sends more than a few hundred KiB; remote clients asking for
+// more are disconnected.
+const maxRequestLength = 32 << 20
+
 // ioctl() helper function
 func ioctl(a1, a2, a3 uintptr) (err error) {
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a1, a2, a3)
@@ -78,13 +106,16 @@ type Device interface {
 }
 
 type NBD struct {
-	device    Device
+	device Device
+	// size is read and written atomically, as it may be changed by
+	// Resize while the device is served.
 	size      int64
 	blocksize int64
 	nbd       *os.File
 	socket    int
 	setsocket int
 	closer    chan error
+	readOnly  bool
 }
 
 func Create(device Device, size int64, blocksize int64) *NBD {
@@ -100,13 +131,30 @@ func Create(device Device, size int64, blocksize int64) *NBD {
 	return nil
 }
 
+// SetReadOnly makes the kernel treat the device as read-only. It must be
+// called before Serve.
+func (nbd *NBD) SetReadOnly(ro bool) {
+	nbd.readOnly = ro
+}
+
 // return true if connected
 func (nbd *NBD) IsConnected() bool {
 	return nbd.nbd != nil && nbd.socket > 0
 }
 
 func (nbd *NBD) Size() int64 {
-	return nbd.size
+	return atomic.LoadInt64(&nbd.size)
+}
+
+// Resize changes the size of the device while it is served. Requests are
+// checked against the new size straight away; the kernel is told of it, but
+// anything on the device, such as a filesystem, must be grown separately.
+func (nbd *NBD) Resize(size int64) error {
+	if err := nbd.SetSize(size); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&nbd.size, size)
+	return nil
 }
 
 func (nbd *NBD) SetSize(size int64) error {
@@ -171,7 +219,7 @@ func (nbd *NBD) OpenDevice(dev string) (string, error) {
 
 func (nbd *NBD) Serve() error {
 	blksized := true
-	if err := nbd.SetSize(nbd.size); err != nil {
+	if err := nbd.SetSize(nbd.Size()); err != nil {
 		return err // already set by nbd.Size()
 	}
 	if err := nbd.SetBlockSize(nbd.blocksize); err != nil {
@@ -183,7 +231,11 @@ func (nbd *NBD) Serve() error {
 		// even when disconnected. Changing it only when connected is fine -- but keep my intent.
 		blksized = false
 	}
-	if err := ioctl(nbd.nbd.Fd(), ioctlSetFlags, uintptr(flagSendFlush|flagSendTrim)); err != nil {
+	flags := uintptr(flagSendFlush | flagSendFUA | flagSendTrim)
+	if nbd.readOnly {
+		flags |= flagReadOnly
+	}
+	if err := ioctl(nbd.nbd.Fd(), ioctlSetFlags, flags); err != nil {
 		return &os.PathError{
 			Path: nbd.nbd.Name(),
 			Op:   "ioctl NBD_SET_FLAGS",
@@ -192,7 +244,9 @@ func (nbd *NBD) Serve() error {
 	}
 
 	c := &serverConn{
-		rw: os.NewFile(uintptr(nbd.socket), "<nbd socket>"),
+		rw:       os.NewFile(uintptr(nbd.socket), "<nbd socket>"),
+		size:     &nbd.size,
+		readOnly: nbd.readOnly,
 	}
 	// TODO(barakmich): Scale up NBD by handling multiple requests.
 	// Requires thread-safety across the block.BlockFile/torus.File
@@ -278,6 +332,14 @@ func waitDisconnect(f *os.File) error {
 type serverConn struct {
 	mu sync.Mutex
 	rw io.ReadWriteCloser
+	// size points at the size of the device, which is read atomically.
+	size     *int64
+	readOnly bool
+	// structured is set if the client negotiated structured replies,
+	// which reads are then answered with. chunks is the buffer they're
+	// put in.
+	structured bool
+	chunks     []byte
 }
 
 func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
@@ -301,7 +363,11 @@ func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
 			return fmt.Errorf("nbd: invalid magic: 0x%x", magic)
 		}
 
-		cmd, _ := hdr.command()
+		cmd, cmdFlags := hdr.command()
+		if (cmd == cmdRead || cmd == cmdWrite) && hdr.length() > maxRequestLength {
+			c.mu.Unlock()
+			return fmt.Errorf("nbd: request too long: %d bytes", hdr.length())
+		}
 		if cmd == cmdWrite {
 			buf = hdr.resize(buf)
 			if _, err := io.ReadFull(c.rw, buf[16:]); err != nil {
@@ -310,33 +376,50 @@ func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
 		}
 		c.mu.Unlock()
 
-		switch cmd {
-		case cmdRead:
+		switch {
+		case cmd == cmdRead && c.structured:
+			buf = hdr.resize(buf)
+			c.chunks = c.readChunks(dev, hdr, buf[16:])
+			if _, err := c.rw.Write(c.chunks); err != nil {
+				return err
+			}
+			continue
+		case (cmd == cmdWrite || cmd == cmdTrim) && c.readOnly:
+			hdr.putReplyHeader(buf, errPerm)
+			buf = buf[:16]
+		case (cmd == cmdRead || cmd == cmdWrite || cmd == cmdTrim) && !c.inRange(hdr):
+			hdr.putReplyHeader(buf, errInval)
+			buf = buf[:16]
+		case cmd == cmdRead:
 			buf = hdr.resize(buf)
 			if _, err := dev.ReadAt(buf[16:], hdr.offset()); err != nil {
 				hdr.putReplyHeader(buf, errIO)
 			} else {
 				hdr.putReplyHeader(buf, 0)
 			}
-		case cmdWrite:
+		case cmd == cmdWrite:
 			if _, err := dev.WriteAt(buf[16:], hdr.offset()); err != nil {
 				hdr.putReplyHeader(buf, errIO)
+			} else if cmdFlags&cmdFlagFUA != 0 {
+				c.sync(dev, hdr, buf)
 			} else {
 				hdr.putReplyHeader(buf, 0)
 			}
 			buf = buf[:16]
-		case cmdTrim:
+		case cmd == cmdTrim:
+			// Sync as well, so that the blocks released are dropped from
+			// the volume's inode and can be collected.
 			if err := dev.Trim(hdr.offset(), int64(hdr.length())); err != nil {
 				log.Printf("nbd: trim error: %s", err)
+				hdr.putReplyHeader(buf, errIO)
+			} else {
+				c.sync(dev, hdr, buf)
 			}
-			fallthrough
-		case cmdFlush:
-			if err := dev.Sync(); err != nil {
-				log.Printf("nbd: sync error: %s", err)
-			}
-			hdr.putReplyHeader(buf, 0)
 			buf = buf[:16]
-		case cmdDisc:
+		case cmd == cmdFlush:
+			c.sync(dev, hdr, buf)
+			buf = buf[:16]
+		case cmd == cmdDisc:
 			// FIXME: We're actually supposed to wait for outstanding requests to finish.
 			if err := dev.Sync(); err != nil {
 				log.Printf("nbd: sync error: %s", err)
@@ -353,6 +436,111 @@ func (c *serverConn) serveLoop(dev Device, wg *sync.WaitGroup) error {
 	}
 }
 
+// sync commits everything written to dev so far, and puts the reply to the
+// request in hdr in buf. The device is a torus volume, so writes are only
+// durable once they are synced to the cluster.
+func (c *serverConn) sync(dev Device, hdr *reqHeader, buf []byte) {
+	if err := dev.Sync(); err != nil {
+		log.Printf("nbd: sync error: %s", err)
+		hdr.putReplyHeader(buf, errIO)
+		return
+	}
+	hdr.putReplyHeader(buf, 0)
+}
+
+// readChunks reads the request in hdr from dev into data, and returns the
+// structured reply to it, put in c.chunks. Aligned runs of zeroes, such as the
+// unwritten blocks of a sparse volume, are sent as holes, so the client
+// needn't be sent them.
+func (c *serverConn) readChunks(dev Device, hdr *reqHeader, data []byte) []byte {
+	out := c.chunks[:0]
+	if !c.inRange(hdr) {
+		return appendErrorChunk(out, hdr, errInval)
+	}
+	off := hdr.offset()
+	if _, err := dev.ReadAt(data, off); err != nil {
+		return appendErrorChunk(out, hdr, errIO)
+	}
+	if len(data) == 0 {
+		return appendChunkHeader(out, hdr, replyFlagDone, replyTypeNone, 0)
+	}
+	for start := 0; start < len(data); {
+		hole := false
+		end := start
+		for end < len(data) {
+			next := end + holeGranularity - int((off+int64(end))%holeGranularity)
+			if next > len(data) {
+				next = len(data)
+			}
+			zero := isZero(data[end:next])
+			if end == start {
+				hole = zero
+			} else if zero != hole {
+				break
+			}
+			end = next
+		}
+		var flags uint16
+		if end == len(data) {
+			flags = replyFlagDone
+		}
+		if hole {
+			out = appendChunkHeader(out, hdr, flags, replyTypeOffsetHole, 12)
+			out = appendUint64(out, uint64(off)+uint64(start))
+			out = appendUint32(out, uint32(end-start))
+		} else {
+			out = appendChunkHeader(out, hdr, flags, replyTypeOffsetData, uint32(8+end-start))
+			out = appendUint64(out, uint64(off)+uint64(start))
+			out = append(out, data[start:end]...)
+		}
+		start = end
+	}
+	return out
+}
+
+// appendErrorChunk appends the final chunk of a structured reply, failing the
+// request in hdr with err.
+func appendErrorChunk(out []byte, hdr *reqHeader, err uint32) []byte {
+	out = appendChunkHeader(out, hdr, replyFlagDone, replyTypeError, 6)
+	out = appendUint32(out, err)
+	return append(out, 0, 0) // no message
+}
+
+func appendChunkHeader(out []byte, hdr *reqHeader, flags, typ uint16, length uint32) []byte {
+	out = appendUint32(out, magicStructuredReply)
+	out = append(out, byte(flags>>8), byte(flags), byte(typ>>8), byte(typ))
+	out = append(out, hdr[8:16]...)
+	return appendUint32(out, length)
+}
+
+func appendUint32(out []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(out, b[:]...)
+}
+
+func appendUint64(out []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(out, b[:]...)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// inRange reports whether the request in hdr lies within the device.
+func (c *serverConn) inRange(hdr *reqHeader) bool {
+	off := binary.BigEndian.Uint64(hdr[16:24])
+	size := uint64(atomic.LoadInt64(c.size))
+	return off <= size && uint64(hdr.length()) <= size-off
+}
+
 type reqHeader [28]byte
 
 func (h *reqHeader) command() (cmd, flags uint16) {
@@ -0,0 +1,516 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Fixed newstyle negotiation, as described in the NBD protocol document.
+const (
+	magicInit   = 0x4e42444d41474943 // "NBDMAGIC"
+	magicOption = 0x49484156454f5054 // "IHAVEOPT"
+	magicRepOpt = 0x3e889045565a9
+
+	handshakeFixedNewstyle = (1 << 0)
+	handshakeNoZeroes      = (1 << 1)
+
+	clientFixedNewstyle = (1 << 0)
+	clientNoZeroes      = (1 << 1)
+
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optStartTLS   = 5
+	optInfo       = 6
+	optGo         = 7
+
+	optStructuredReply = 8
+
+	repAck        = 1
+	repServer     = 2
+	repInfo       = 3
+	repErrUnsup   = (1 << 31) + 1
+	repErrPolicy  = (1 << 31) + 2
+	repErrInvalid = (1 << 31) + 3
+	repErrTLSReqd = (1 << 31) + 5
+	repErrUnknown = (1 << 31) + 6
+
+	infoExport = 0
+
+	flagHasFlags = (1 << 0)
+
+	// maxOptionLength bounds the data of an option a client may send
+	// during negotiation.
+	maxOptionLength = 4096
+)
+
+var errAborted = errors.New("nbd: client aborted negotiation")
+
+// ErrNoExport is returned by an ExportSource asked for an export it doesn't
+// have.
+var ErrNoExport = errors.New("nbd: no such export")
+
+// Export is a device offered to remote clients by a Server, under a name.
+type Export struct {
+	Name     string
+	Device   Device
+	Size     int64
+	ReadOnly bool
+
+	// The device is shared by every client attached to the export, and
+	// isn't safe for concurrent use.
+	mu sync.Mutex
+	// Clients attached to the export, guarded by Server.openMu.
+	refs int
+}
+
+// ExportSource looks up the exports of a Server as clients ask for them, so
+// that a Server can offer more exports than it keeps open.
+type ExportSource interface {
+	// Names lists the exports clients may choose from.
+	Names() ([]string, error)
+	// Open returns the named export, or ErrNoExport.
+	Open(name string) (*Export, error)
+	// Close releases an export returned by Open, once no client is
+	// attached to it.
+	Close(e *Export) error
+}
+
+// Server serves exports to NBD clients, such as nbd-client or qemu, over the
+// network.
+type Server struct {
+	source    ExportSource
+	tlsConfig *tls.Config
+
+	openMu sync.Mutex
+	open   map[string]*Export
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// NewServer creates a Server for the given exports. Their names must be
+// distinct.
+func NewServer(exports ...*Export) (*Server, error) {
+	src := &staticSource{exports: make(map[string]*Export)}
+	for _, e := range exports {
+		if _, ok := src.exports[e.Name]; ok {
+			return nil, fmt.Errorf("nbd: more than one export named %q", e.Name)
+		}
+		src.exports[e.Name] = e
+		src.names = append(src.names, e.Name)
+	}
+	return NewSourceServer(src), nil
+}
+
+// NewSourceServer creates a Server for the exports of src. An export is
+// opened when the first client chooses it, and closed when the last one
+// disconnects.
+func NewSourceServer(src ExportSource) *Server {
+	return &Server{
+		source: src,
+		open:   make(map[string]*Export),
+		conns:  make(map[net.Conn]bool),
+	}
+}
+
+// staticSource is the ExportSource of a fixed set of exports, which are
+// always open.
+type staticSource struct {
+	exports map[string]*Export
+	names   []string
+}
+
+func (src *staticSource) Names() ([]string, error) {
+	return src.names, nil
+}
+
+func (src *staticSource) Open(name string) (*Export, error) {
+	e, ok := src.exports[name]
+	if !ok {
+		return nil, ErrNoExport
+	}
+	return e, nil
+}
+
+func (src *staticSource) Close(e *Export) error {
+	return nil
+}
+
+// acquire opens the named export for a client.
+func (s *Server) acquire(name string) (*Export, error) {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if e, ok := s.open[name]; ok {
+		e.refs++
+		return e, nil
+	}
+	e, err := s.source.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	e.refs = 1
+	s.open[name] = e
+	return e, nil
+}
+
+// release closes the export e if no other client holds it.
+func (s *Server) release(e *Export) {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	e.refs--
+	if e.refs > 0 {
+		return
+	}
+	delete(s.open, e.Name)
+	if err := s.source.Close(e); err != nil {
+		log.Printf("nbd: closing export %s: %s", e.Name, err)
+	}
+}
+
+// SetTLSConfig makes clients upgrade their connections to TLS with
+// NBD_OPT_STARTTLS before they may choose an export. To verify client
+// certificates, set ClientAuth and ClientCAs in config. It must be called
+// before Serve.
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// Serve accepts connections on l, serving each in its own goroutine, until
+// the Server is closed or l fails.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil && err != io.EOF {
+				log.Printf("nbd: %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn negotiates an export with the client on conn, then serves its
+// requests until it disconnects.
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return conn.Close()
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c, e, err := s.negotiate(conn)
+	if err != nil {
+		if err == errAborted {
+			return nil
+		}
+		return err
+	}
+	defer s.release(e)
+	return c.serveLoop(&exportDevice{e}, nil)
+}
+
+// Close stops accepting connections and disconnects every client.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// negotiate runs the fixed newstyle handshake on conn, returning the export
+// the client chose and the connection to serve it on, which is over TLS if the
+// client started TLS, and sends structured replies if the client asked for
+// them.
+func (s *Server) negotiate(conn net.Conn) (*serverConn, *Export, error) {
+	hello := make([]byte, 18)
+	binary.BigEndian.PutUint64(hello[0:8], magicInit)
+	binary.BigEndian.PutUint64(hello[8:16], magicOption)
+	binary.BigEndian.PutUint16(hello[16:18], handshakeFixedNewstyle|handshakeNoZeroes)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, nil, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return nil, nil, err
+	}
+	if clientFlags&clientFixedNewstyle == 0 {
+		return nil, nil, errors.New("nbd: client doesn't support fixed newstyle negotiation")
+	}
+	noZeroes := clientFlags&clientNoZeroes != 0
+	secure := false
+	structured := false
+	serve := func(e *Export) *serverConn {
+		return &serverConn{
+			rw:         conn,
+			size:       &e.Size,
+			readOnly:   e.ReadOnly,
+			structured: structured,
+		}
+	}
+
+	for {
+		var opt struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &opt); err != nil {
+			return nil, nil, err
+		}
+		if opt.Magic != magicOption {
+			return nil, nil, fmt.Errorf("nbd: invalid option magic: 0x%x", opt.Magic)
+		}
+		if opt.Length > maxOptionLength {
+			return nil, nil, fmt.Errorf("nbd: option %d too long: %d bytes", opt.Option, opt.Length)
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, nil, err
+		}
+
+		if s.tlsConfig != nil && !secure {
+			switch opt.Option {
+			case optExportName:
+				return nil, nil, errors.New("nbd: client chose an export without starting TLS")
+			case optStartTLS, optAbort:
+			default:
+				if err := writeOptionReply(conn, opt.Option, repErrTLSReqd, nil); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+		}
+
+		switch opt.Option {
+		case optStartTLS:
+			var typ uint32
+			switch {
+			case s.tlsConfig == nil:
+				typ = repErrPolicy
+			case secure || len(data) != 0:
+				typ = repErrInvalid
+			default:
+				typ = repAck
+			}
+			if err := writeOptionReply(conn, opt.Option, typ, nil); err != nil {
+				return nil, nil, err
+			}
+			if typ != repAck {
+				continue
+			}
+			tconn := tls.Server(conn, s.tlsConfig)
+			if err := tconn.Handshake(); err != nil {
+				return nil, nil, err
+			}
+			conn = tconn
+			secure = true
+		case optExportName:
+			e, err := s.acquire(string(data))
+			if err != nil {
+				// The only way to refuse this option is to hang up.
+				return nil, nil, fmt.Errorf("nbd: can't open export %q: %s", data, err)
+			}
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply[0:8], uint64(e.Size))
+			binary.BigEndian.PutUint16(reply[8:10], e.flags())
+			if !noZeroes {
+				reply = reply[:10+124]
+			}
+			if _, err := conn.Write(reply); err != nil {
+				s.release(e)
+				return nil, nil, err
+			}
+			return serve(e), e, nil
+		case optStructuredReply:
+			typ := uint32(repAck)
+			if len(data) != 0 {
+				typ = repErrInvalid
+			}
+			if err := writeOptionReply(conn, opt.Option, typ, nil); err != nil {
+				return nil, nil, err
+			}
+			if typ == repAck {
+				structured = true
+			}
+		case optAbort:
+			writeOptionReply(conn, opt.Option, repAck, nil)
+			return nil, nil, errAborted
+		case optList:
+			if len(data) != 0 {
+				if err := writeOptionReply(conn, opt.Option, repErrInvalid, nil); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			names, err := s.source.Names()
+			if err != nil {
+				log.Printf("nbd: listing exports: %s", err)
+				if err := writeOptionReply(conn, opt.Option, repErrPolicy, []byte(err.Error())); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			for _, name := range names {
+				buf := make([]byte, 4+len(name))
+				binary.BigEndian.PutUint32(buf[0:4], uint32(len(name)))
+				copy(buf[4:], name)
+				if err := writeOptionReply(conn, opt.Option, repServer, buf); err != nil {
+					return nil, nil, err
+				}
+			}
+			if err := writeOptionReply(conn, opt.Option, repAck, nil); err != nil {
+				return nil, nil, err
+			}
+		case optInfo, optGo:
+			name, ok := parseInfoRequest(data)
+			if !ok {
+				if err := writeOptionReply(conn, opt.Option, repErrInvalid, nil); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			e, err := s.acquire(name)
+			if err != nil {
+				// The error is sent along for the client to show.
+				var msg []byte
+				if err != ErrNoExport {
+					msg = []byte(err.Error())
+				}
+				if err := writeOptionReply(conn, opt.Option, repErrUnknown, msg); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info[0:2], infoExport)
+			binary.BigEndian.PutUint64(info[2:10], uint64(e.Size))
+			binary.BigEndian.PutUint16(info[10:12], e.flags())
+			err = writeOptionReply(conn, opt.Option, repInfo, info)
+			if err == nil {
+				err = writeOptionReply(conn, opt.Option, repAck, nil)
+			}
+			if err != nil || opt.Option != optGo {
+				s.release(e)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if opt.Option == optGo {
+				return serve(e), e, nil
+			}
+		default:
+			if err := writeOptionReply(conn, opt.Option, repErrUnsup, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// parseInfoRequest returns the export name from the data of an
+// NBD_OPT_INFO or NBD_OPT_GO option. The information requests that follow it
+// are ignored; the export information is always sent.
+func parseInfoRequest(data []byte) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	n := binary.BigEndian.Uint32(data[0:4])
+	if uint64(len(data)) < 4+uint64(n)+2 {
+		return "", false
+	}
+	name := data[4 : 4+n]
+	nreqs := binary.BigEndian.Uint16(data[4+n:])
+	if len(data) != int(4+n+2+2*uint32(nreqs)) {
+		return "", false
+	}
+	return string(name), true
+}
+
+func writeOptionReply(w io.Writer, opt, typ uint32, data []byte) error {
+	buf := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint64(buf[0:8], magicRepOpt)
+	binary.BigEndian.PutUint32(buf[8:12], opt)
+	binary.BigEndian.PutUint32(buf[12:16], typ)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(len(data)))
+	copy(buf[20:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// flags returns the transmission flags of the export.
+func (e *Export) flags() uint16 {
+	flags := uint16(flagHasFlags | flagSendFlush | flagSendFUA | flagSendTrim)
+	if e.ReadOnly {
+		flags |= flagReadOnly
+	}
+	return flags
+}
+
+// exportDevice serializes access to the device of an export.
+type exportDevice struct {
+	e *Export
+}
+
+func (d *exportDevice) ReadAt(b []byte, off int64) (int, error) {
+	d.e.mu.Lock()
+	defer d.e.mu.Unlock()
+	return d.e.Device.ReadAt(b, off)
+}
+
+func (d *exportDevice) WriteAt(b []byte, off int64) (int, error) {
+	d.e.mu.Lock()
+	defer d.e.mu.Unlock()
+	return d.e.Device.WriteAt(b, off)
+}
+
+func (d *exportDevice) Sync() error {
+	d.e.mu.Lock()
+	defer d.e.mu.Unlock()
+	return d.e.Device.Sync()
+}
+
+func (d *exportDevice) Trim(off, length int64) error {
+	d.e.mu.Lock()
+	defer d.e.mu.Unlock()
+	return d.e.Device.Trim(off, length)
+}
@@ -0,0 +1,529 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+type memDevice []byte
+
+func (m memDevice) ReadAt(b []byte, off int64) (int, error) {
+	return copy(b, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(b []byte, off int64) (int, error) {
+	return copy(m[off:], b), nil
+}
+
+func (m memDevice) Sync() error { return nil }
+
+func (m memDevice) Trim(off, length int64) error {
+	for i := off; i < off+length; i++ {
+		m[i] = 0
+	}
+	return nil
+}
+
+func sendOption(t *testing.T, w io.Writer, opt uint32, data []byte) {
+	buf := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint64(buf[0:8], magicOption)
+	binary.BigEndian.PutUint32(buf[8:12], opt)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(len(data)))
+	copy(buf[16:], data)
+	if _, err := w.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readOptionReply(t *testing.T, r io.Reader) (typ uint32, data []byte) {
+	hdr := make([]byte, 20)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.BigEndian.Uint64(hdr[0:8]); magic != magicRepOpt {
+		t.Fatalf("bad reply magic %#x", magic)
+	}
+	data = make([]byte, binary.BigEndian.Uint32(hdr[16:20]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(hdr[12:16]), data
+}
+
+func goRequest(name string) []byte {
+	data := make([]byte, 4+len(name)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(name)))
+	copy(data[4:], name)
+	return data
+}
+
+func request(cmd uint16, handle uint64, off uint64, length uint32) []byte {
+	buf := make([]byte, 28)
+	binary.BigEndian.PutUint32(buf[0:4], magicRequest)
+	binary.BigEndian.PutUint16(buf[6:8], cmd)
+	binary.BigEndian.PutUint64(buf[8:16], handle)
+	binary.BigEndian.PutUint64(buf[16:24], off)
+	binary.BigEndian.PutUint32(buf[24:28], length)
+	return buf
+}
+
+func readReply(t *testing.T, r io.Reader, handle uint64) uint32 {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.BigEndian.Uint32(buf[0:4]); magic != magicReply {
+		t.Fatalf("bad reply magic %#x", magic)
+	}
+	if h := binary.BigEndian.Uint64(buf[8:16]); h != handle {
+		t.Fatalf("reply for handle %d, expected %d", h, handle)
+	}
+	return binary.BigEndian.Uint32(buf[4:8])
+}
+
+func TestServerNegotiation(t *testing.T) {
+	dev := make(memDevice, 4096)
+	srv, err := NewServer(
+		&Export{Name: "vol1", Device: dev, Size: int64(len(dev))},
+		&Export{Name: "ro", Device: make(memDevice, 4096), Size: 4096, ReadOnly: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConn(conn) }()
+
+	hello := make([]byte, 18)
+	if _, err := io.ReadFull(client, hello); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint64(hello[0:8]) != magicInit || binary.BigEndian.Uint64(hello[8:16]) != magicOption {
+		t.Fatalf("bad greeting % x", hello)
+	}
+	if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle|clientNoZeroes)); err != nil {
+		t.Fatal(err)
+	}
+
+	sendOption(t, client, optList, nil)
+	var names []string
+	for {
+		typ, data := readOptionReply(t, client)
+		if typ == repAck {
+			break
+		}
+		if typ != repServer {
+			t.Fatalf("unexpected list reply %#x", typ)
+		}
+		names = append(names, string(data[4:]))
+	}
+	if len(names) != 2 || names[0] != "vol1" || names[1] != "ro" {
+		t.Fatalf("listed %v", names)
+	}
+
+	sendOption(t, client, 0x1234, nil)
+	if typ, _ := readOptionReply(t, client); typ != repErrUnsup {
+		t.Fatalf("unknown option answered with %#x", typ)
+	}
+
+	sendOption(t, client, optGo, goRequest("missing"))
+	if typ, _ := readOptionReply(t, client); typ != repErrUnknown {
+		t.Fatalf("missing export answered with %#x", typ)
+	}
+
+	sendOption(t, client, optGo, goRequest("vol1"))
+	typ, info := readOptionReply(t, client)
+	if typ != repInfo || len(info) != 12 {
+		t.Fatalf("expected export info, got %#x % x", typ, info)
+	}
+	if size := binary.BigEndian.Uint64(info[2:10]); size != 4096 {
+		t.Fatalf("export size %d", size)
+	}
+	if typ, _ := readOptionReply(t, client); typ != repAck {
+		t.Fatalf("expected ack, got %#x", typ)
+	}
+
+	data := bytes.Repeat([]byte{0xab}, 512)
+	if _, err := client.Write(append(request(cmdWrite, 1, 512, 512), data...)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, client, 1); e != 0 {
+		t.Fatalf("write failed: %d", e)
+	}
+	if _, err := client.Write(request(cmdRead, 2, 512, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, client, 2); e != 0 {
+		t.Fatalf("read failed: %d", e)
+	}
+	got := make([]byte, 512)
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read back different data")
+	}
+	if _, err := client.Write(request(cmdRead, 3, 4096, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, client, 3); e != errInval {
+		t.Fatalf("read past the end answered with %d", e)
+	}
+
+	if _, err := client.Write(request(cmdDisc, 4, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerReadOnlyExport(t *testing.T) {
+	srv, err := NewServer(&Export{Name: "ro", Device: make(memDevice, 4096), Size: 4096, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(conn)
+
+	if _, err := io.ReadFull(client, make([]byte, 18)); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle)); err != nil {
+		t.Fatal(err)
+	}
+	sendOption(t, client, optExportName, []byte("ro"))
+	reply := make([]byte, 10+124)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if flags := binary.BigEndian.Uint16(reply[8:10]); flags&flagReadOnly == 0 {
+		t.Fatalf("read-only export has flags %#x", flags)
+	}
+
+	if _, err := client.Write(append(request(cmdWrite, 1, 0, 512), make([]byte, 512)...)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, client, 1); e != errPerm {
+		t.Fatalf("write to read-only export answered with %d", e)
+	}
+}
+
+func TestNewServerDuplicateExport(t *testing.T) {
+	_, err := NewServer(&Export{Name: "a"}, &Export{Name: "a"})
+	if err == nil {
+		t.Fatal("expected an error for duplicate export names")
+	}
+}
+
+type failingTrimDevice struct {
+	memDevice
+}
+
+func (failingTrimDevice) Trim(off, length int64) error {
+	return errors.New("trim failed")
+}
+
+func TestServerTrim(t *testing.T) {
+	dev := memDevice(bytes.Repeat([]byte{0xab}, 4096))
+	srv, err := NewServer(
+		&Export{Name: "vol1", Device: dev, Size: int64(len(dev))},
+		&Export{Name: "broken", Device: failingTrimDevice{make(memDevice, 4096)}, Size: 4096},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		export string
+		want   uint32
+	}{
+		{"vol1", 0},
+		{"broken", errIO},
+	} {
+		client, conn := net.Pipe()
+		go srv.ServeConn(conn)
+		if _, err := io.ReadFull(client, make([]byte, 18)); err != nil {
+			t.Fatal(err)
+		}
+		if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle|clientNoZeroes)); err != nil {
+			t.Fatal(err)
+		}
+		sendOption(t, client, optExportName, []byte(tt.export))
+		if _, err := io.ReadFull(client, make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(request(cmdTrim, 1, 1024, 2048)); err != nil {
+			t.Fatal(err)
+		}
+		if e := readReply(t, client, 1); e != tt.want {
+			t.Errorf("trim on %s answered with %d, expected %d", tt.export, e, tt.want)
+		}
+		client.Close()
+	}
+	if !bytes.Equal(dev[1024:3072], make([]byte, 2048)) {
+		t.Error("trimmed range wasn't zeroed")
+	}
+	if dev[1023] != 0xab || dev[3072] != 0xab {
+		t.Error("trim zeroed data outside its range")
+	}
+}
+
+type syncCountingDevice struct {
+	memDevice
+	syncs   int
+	syncErr error
+}
+
+func (d *syncCountingDevice) Sync() error {
+	d.syncs++
+	return d.syncErr
+}
+
+func TestServerFlushAndFUA(t *testing.T) {
+	dev := &syncCountingDevice{memDevice: make(memDevice, 4096)}
+	srv, err := NewServer(&Export{Name: "vol1", Device: dev, Size: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(conn)
+	if _, err := io.ReadFull(client, make([]byte, 18)); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle|clientNoZeroes)); err != nil {
+		t.Fatal(err)
+	}
+	sendOption(t, client, optExportName, []byte("vol1"))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if flags := binary.BigEndian.Uint16(reply[8:10]); flags&flagSendFUA == 0 || flags&flagSendFlush == 0 {
+		t.Fatalf("export has flags %#x, expected FUA and flush", flags)
+	}
+
+	write := func(handle uint64, fua bool) uint32 {
+		req := request(cmdWrite, handle, 0, 512)
+		if fua {
+			binary.BigEndian.PutUint16(req[4:6], cmdFlagFUA)
+		}
+		if _, err := client.Write(append(req, make([]byte, 512)...)); err != nil {
+			t.Fatal(err)
+		}
+		return readReply(t, client, handle)
+	}
+	if e := write(1, false); e != 0 || dev.syncs != 0 {
+		t.Fatalf("plain write answered %d after %d syncs", e, dev.syncs)
+	}
+	if e := write(2, true); e != 0 || dev.syncs != 1 {
+		t.Fatalf("FUA write answered %d after %d syncs", e, dev.syncs)
+	}
+	if _, err := client.Write(request(cmdFlush, 3, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, client, 3); e != 0 || dev.syncs != 2 {
+		t.Fatalf("flush answered %d after %d syncs", e, dev.syncs)
+	}
+
+	dev.syncErr = errors.New("sync failed")
+	if e := write(4, true); e != errIO {
+		t.Fatalf("FUA write with failing sync answered %d", e)
+	}
+	if _, err := client.Write(request(cmdFlush, 5, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, client, 5); e != errIO {
+		t.Fatalf("failing flush answered %d", e)
+	}
+}
+
+type countingSource struct {
+	mu     sync.Mutex
+	names  []string
+	opens  int
+	closes int
+}
+
+func (src *countingSource) Names() ([]string, error) {
+	return src.names, nil
+}
+
+func (src *countingSource) Open(name string) (*Export, error) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	for _, n := range src.names {
+		if n == name {
+			src.opens++
+			return &Export{Name: name, Device: make(memDevice, 4096), Size: 4096}, nil
+		}
+	}
+	return nil, ErrNoExport
+}
+
+func (src *countingSource) Close(e *Export) error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.closes++
+	return nil
+}
+
+func (src *countingSource) counts() (int, int) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	return src.opens, src.closes
+}
+
+func TestSourceServerOpensOnDemand(t *testing.T) {
+	src := &countingSource{names: []string{"a", "b"}}
+	srv := NewSourceServer(src)
+
+	attach := func(name string) (net.Conn, chan error) {
+		client, conn := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- srv.ServeConn(conn) }()
+		if _, err := io.ReadFull(client, make([]byte, 18)); err != nil {
+			t.Fatal(err)
+		}
+		if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle|clientNoZeroes)); err != nil {
+			t.Fatal(err)
+		}
+		sendOption(t, client, optGo, goRequest(name))
+		if typ, _ := readOptionReply(t, client); typ != repInfo {
+			t.Fatalf("expected export info for %s, got %#x", name, typ)
+		}
+		if typ, _ := readOptionReply(t, client); typ != repAck {
+			t.Fatalf("expected ack, got %#x", typ)
+		}
+		return client, done
+	}
+	detach := func(client net.Conn, done chan error) {
+		if _, err := client.Write(request(cmdDisc, 1, 0, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c1, d1 := attach("a")
+	c2, d2 := attach("a")
+	if opens, _ := src.counts(); opens != 1 {
+		t.Fatalf("two clients of one export opened it %d times", opens)
+	}
+	detach(c1, d1)
+	if _, closes := src.counts(); closes != 0 {
+		t.Fatal("export closed while a client was still attached")
+	}
+	detach(c2, d2)
+	if opens, closes := src.counts(); opens != 1 || closes != 1 {
+		t.Fatalf("after both clients left: %d opens, %d closes", opens, closes)
+	}
+}
+
+// readChunk reads a chunk of a structured reply to the request handle.
+func readChunk(t *testing.T, r io.Reader, handle uint64) (flags, typ uint16, data []byte) {
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.BigEndian.Uint32(buf[0:4]); magic != magicStructuredReply {
+		t.Fatalf("bad structured reply magic %#x", magic)
+	}
+	if h := binary.BigEndian.Uint64(buf[8:16]); h != handle {
+		t.Fatalf("reply for handle %d, expected %d", h, handle)
+	}
+	data = make([]byte, binary.BigEndian.Uint32(buf[16:20]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint16(buf[4:6]), binary.BigEndian.Uint16(buf[6:8]), data
+}
+
+func TestServerStructuredRead(t *testing.T) {
+	dev := make(memDevice, 4*holeGranularity)
+	for i := 0; i < 100; i++ {
+		dev[holeGranularity+i] = 0xab
+	}
+	srv, err := NewServer(&Export{Name: "vol1", Device: dev, Size: int64(len(dev))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(conn)
+	if _, err := io.ReadFull(client, make([]byte, 18)); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle|clientNoZeroes)); err != nil {
+		t.Fatal(err)
+	}
+	sendOption(t, client, optStructuredReply, []byte{1})
+	if typ, _ := readOptionReply(t, client); typ != repErrInvalid {
+		t.Fatalf("structured reply option with data answered with %#x", typ)
+	}
+	sendOption(t, client, optStructuredReply, nil)
+	if typ, _ := readOptionReply(t, client); typ != repAck {
+		t.Fatalf("structured reply option answered with %#x", typ)
+	}
+	sendOption(t, client, optGo, goRequest("vol1"))
+	readOptionReply(t, client)
+	if typ, _ := readOptionReply(t, client); typ != repAck {
+		t.Fatalf("expected ack, got %#x", typ)
+	}
+
+	// A read from the middle of the first granule to the end of the third:
+	// a hole, the data of the second granule, then another hole.
+	if _, err := client.Write(request(cmdRead, 1, 512, 3*holeGranularity-512)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		flags, typ  uint16
+		off, length uint64
+	}{
+		{0, replyTypeOffsetHole, 512, holeGranularity - 512},
+		{0, replyTypeOffsetData, holeGranularity, holeGranularity},
+		{replyFlagDone, replyTypeOffsetHole, 2 * holeGranularity, holeGranularity},
+	} {
+		flags, typ, data := readChunk(t, client, 1)
+		if flags != want.flags || typ != want.typ {
+			t.Fatalf("got chunk type %d flags %d, expected type %d flags %d", typ, flags, want.typ, want.flags)
+		}
+		if off := binary.BigEndian.Uint64(data[0:8]); off != want.off {
+			t.Fatalf("chunk of type %d at %d, expected %d", typ, off, want.off)
+		}
+		if typ == replyTypeOffsetHole {
+			if n := binary.BigEndian.Uint32(data[8:12]); uint64(n) != want.length {
+				t.Fatalf("hole of %d bytes, expected %d", n, want.length)
+			}
+		} else if !bytes.Equal(data[8:], dev[want.off:want.off+want.length]) {
+			t.Fatal("read back different data")
+		}
+	}
+
+	if _, err := client.Write(request(cmdRead, 2, 4*holeGranularity, 512)); err != nil {
+		t.Fatal(err)
+	}
+	flags, typ, data := readChunk(t, client, 2)
+	if flags != replyFlagDone || typ != replyTypeError {
+		t.Fatalf("read past the end answered with chunk type %d flags %d", typ, flags)
+	}
+	if e := binary.BigEndian.Uint32(data[0:4]); e != errInval {
+		t.Fatalf("read past the end failed with %d", e)
+	}
+
+	// Other commands still get simple replies.
+	if _, err := client.Write(request(cmdFlush, 3, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, client, 3); e != 0 {
+		t.Fatalf("flush failed: %d", e)
+	}
+}
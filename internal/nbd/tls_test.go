@@ -0,0 +1,126 @@
+package nbd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate for both ends of a test connection, and a
+// pool which trusts it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "torus-test"},
+		DNSNames:              []string{"torus-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestServerStartTLS(t *testing.T) {
+	cert, pool := selfSigned(t)
+	srv, err := NewServer(&Export{Name: "vol1", Device: make(memDevice, 4096), Size: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(conn)
+	if _, err := io.ReadFull(client, make([]byte, 18)); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle|clientNoZeroes)); err != nil {
+		t.Fatal(err)
+	}
+
+	sendOption(t, client, optList, nil)
+	if typ, _ := readOptionReply(t, client); typ != repErrTLSReqd {
+		t.Fatalf("list before STARTTLS answered with %#x", typ)
+	}
+
+	sendOption(t, client, optStartTLS, nil)
+	if typ, _ := readOptionReply(t, client); typ != repAck {
+		t.Fatalf("STARTTLS answered with %#x", typ)
+	}
+	tconn := tls.Client(client, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   "torus-test",
+	})
+	if err := tconn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendOption(t, tconn, optStartTLS, nil)
+	if typ, _ := readOptionReply(t, tconn); typ != repErrInvalid {
+		t.Fatalf("second STARTTLS answered with %#x", typ)
+	}
+	sendOption(t, tconn, optGo, goRequest("vol1"))
+	if typ, _ := readOptionReply(t, tconn); typ != repInfo {
+		t.Fatalf("expected export info, got %#x", typ)
+	}
+	if typ, _ := readOptionReply(t, tconn); typ != repAck {
+		t.Fatalf("expected ack, got %#x", typ)
+	}
+	if _, err := tconn.Write(request(cmdRead, 1, 0, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if e := readReply(t, tconn, 1); e != 0 {
+		t.Fatalf("read over TLS failed: %d", e)
+	}
+}
+
+func TestServerStartTLSWithoutConfig(t *testing.T) {
+	srv, err := NewServer(&Export{Name: "vol1", Device: make(memDevice, 4096), Size: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(conn)
+	if _, err := io.ReadFull(client, make([]byte, 18)); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(client, binary.BigEndian, uint32(clientFixedNewstyle|clientNoZeroes)); err != nil {
+		t.Fatal(err)
+	}
+	sendOption(t, client, optStartTLS, nil)
+	if typ, _ := readOptionReply(t, client); typ != repErrPolicy {
+		t.Fatalf("STARTTLS without TLS configured answered with %#x", typ)
+	}
+}
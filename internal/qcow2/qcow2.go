@@ -0,0 +1,138 @@
+// Package qcow2 reads and writes disk images in QEMU's qcow2 format, as far
+// as is needed to move whole images in and out of block volumes: images
+// with a backing file, encryption, internal snapshots' contents or external
+// data files aren't supported.
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	magic = 0x514649fb // "QFI\xfb"
+
+	// headerV2Size and headerV3Size are the sizes of the fixed headers of
+	// each version.
+	headerV2Size = 72
+	headerV3Size = 104
+
+	// offsetMask picks the host offset out of an L1 or L2 entry.
+	offsetMask = 0x00fffffffffffe00
+	// flagCopied marks clusters whose refcount is exactly one.
+	flagCopied = 1 << 63
+	// flagCompressed marks compressed clusters in L2 entries.
+	flagCompressed = 1 << 62
+	// flagZero marks clusters which read as zeroes in version 3 L2
+	// entries.
+	flagZero = 1
+
+	// incompatDirty is the only incompatible feature which doesn't
+	// change how the image is read: its refcounts may be stale.
+	incompatDirty = 1 << 0
+
+	// maxL1Size is the largest L1 table QEMU accepts, in bytes.
+	maxL1Size = 32 * 1024 * 1024
+)
+
+// ClusterBits is the log2 of the cluster size of images written by Writer.
+const ClusterBits = 16
+
+// ClusterSize is the size of the clusters of images written by Writer.
+const ClusterSize = 1 << ClusterBits
+
+var (
+	// ErrNotQcow2 is returned for images which don't start with the
+	// qcow2 magic.
+	ErrNotQcow2 = errors.New("qcow2: not a qcow2 image")
+	// ErrBackingFile is returned for images which rely on a backing file
+	// for some of their contents.
+	ErrBackingFile = errors.New("qcow2: images with a backing file aren't supported")
+)
+
+// IsImage reports whether head, the start of a file, is that of a qcow2
+// image.
+func IsImage(head []byte) bool {
+	return len(head) >= 4 && binary.BigEndian.Uint32(head) == magic
+}
+
+type header struct {
+	version             uint32
+	backingFileOffset   uint64
+	clusterBits         uint32
+	size                uint64
+	cryptMethod         uint32
+	l1Size              uint32
+	l1TableOffset       uint64
+	refcountTableOffset uint64
+	refcountClusters    uint32
+	incompatible        uint64
+	refcountOrder       uint32
+	headerLength        uint32
+	compressionType     uint8
+}
+
+func (h *header) unmarshal(b []byte) error {
+	if len(b) < headerV2Size || !IsImage(b) {
+		return ErrNotQcow2
+	}
+	be := binary.BigEndian
+	h.version = be.Uint32(b[4:])
+	h.backingFileOffset = be.Uint64(b[8:])
+	h.clusterBits = be.Uint32(b[20:])
+	h.size = be.Uint64(b[24:])
+	h.cryptMethod = be.Uint32(b[32:])
+	h.l1Size = be.Uint32(b[36:])
+	h.l1TableOffset = be.Uint64(b[40:])
+	h.refcountTableOffset = be.Uint64(b[48:])
+	h.refcountClusters = be.Uint32(b[56:])
+	switch h.version {
+	case 2:
+		h.refcountOrder = 4
+		h.headerLength = headerV2Size
+	case 3:
+		if len(b) < headerV3Size {
+			return errors.New("qcow2: short header")
+		}
+		h.incompatible = be.Uint64(b[72:])
+		h.refcountOrder = be.Uint32(b[96:])
+		h.headerLength = be.Uint32(b[100:])
+		if h.headerLength > headerV3Size && len(b) > headerV3Size {
+			h.compressionType = b[104]
+		}
+	default:
+		return fmt.Errorf("qcow2: unsupported version %d", h.version)
+	}
+	return nil
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, headerV3Size)
+	be := binary.BigEndian
+	be.PutUint32(b[0:], magic)
+	be.PutUint32(b[4:], h.version)
+	be.PutUint64(b[8:], h.backingFileOffset)
+	be.PutUint32(b[20:], h.clusterBits)
+	be.PutUint64(b[24:], h.size)
+	be.PutUint32(b[32:], h.cryptMethod)
+	be.PutUint32(b[36:], h.l1Size)
+	be.PutUint64(b[40:], h.l1TableOffset)
+	be.PutUint64(b[48:], h.refcountTableOffset)
+	be.PutUint32(b[56:], h.refcountClusters)
+	be.PutUint64(b[72:], h.incompatible)
+	be.PutUint32(b[96:], h.refcountOrder)
+	be.PutUint32(b[100:], h.headerLength)
+	return b
+}
+
+// l1Entries is how many L1 entries an image of size bytes with clusters of
+// 1<<bits bytes needs, each covering an L2 table's worth of clusters.
+func l1Entries(size uint64, bits uint32) uint64 {
+	span := uint64(1) << (bits + bits - 3)
+	n := size / span
+	if size%span != 0 {
+		n++
+	}
+	return n
+}
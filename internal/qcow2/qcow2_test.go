@@ -0,0 +1,207 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// memFile is an in-memory io.ReaderAt and io.WriterAt.
+type memFile []byte
+
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(*m) {
+		*m = append(*m, make([]byte, end-len(*m))...)
+	}
+	return copy((*m)[off:], p), nil
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(*m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, (*m)[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Enough clusters for a second L2 table, and a partial last cluster.
+	const l2Span = ClusterSize / 8
+	size := int64((l2Span+3)*ClusterSize + 1000)
+	last := size / ClusterSize
+	r := rand.New(rand.NewSource(1))
+	data := make(map[int64][]byte)
+	for _, c := range []int64{0, 5, l2Span, last} {
+		n := int64(ClusterSize)
+		if c == last {
+			n = size % ClusterSize
+		}
+		data[c] = make([]byte, n)
+		r.Read(data[c])
+	}
+
+	img := &memFile{}
+	w, err := NewWriter(img, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c := int64(0); c <= last; c++ {
+		d, ok := data[c]
+		if !ok {
+			d = make([]byte, ClusterSize)
+		}
+		if err := w.WriteCluster(c*ClusterSize, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteCluster(0, data[0]); err == nil {
+		t.Fatal("rewrote the first cluster")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Header, L1, two L2 tables, four data clusters, one refcount block
+	// and the refcount table.
+	if want := 10 * ClusterSize; len(*img) != want {
+		t.Errorf("image is %d bytes, want %d", len(*img), want)
+	}
+
+	qr, err := NewReader(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qr.Size() != size {
+		t.Fatalf("got size %d, want %d", qr.Size(), size)
+	}
+	for _, c := range []int64{0, 1, 5, l2Span - 1, l2Span, l2Span + 1, last} {
+		want, ok := data[c]
+		if !ok {
+			want = make([]byte, ClusterSize)
+		}
+		got := make([]byte, len(want))
+		if _, err := qr.ReadAt(got, c*ClusterSize); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("cluster %d doesn't read back as written", c)
+		}
+	}
+	if n, err := qr.ReadAt(make([]byte, 2000), size-1000); n != 1000 || err != io.EOF {
+		t.Errorf("reading past the end got %d, %v", n, err)
+	}
+	for _, x := range []struct {
+		off, n int64
+		want   bool
+	}{
+		{0, 1, true},
+		{ClusterSize, 4 * ClusterSize, false},
+		{ClusterSize, 5 * ClusterSize, true},
+		{(l2Span + 1) * ClusterSize, 2 * ClusterSize, false},
+		{size - 1, 1, true},
+	} {
+		if a, err := qr.Allocated(x.off, x.n); err != nil || a != x.want {
+			t.Errorf("Allocated(%d, %d) = %v, %v; want %v", x.off, x.n, a, err, x.want)
+		}
+	}
+
+	// Every cluster is referenced once.
+	be := binary.BigEndian
+	rt := be.Uint64((*img)[48:])
+	rb := be.Uint64((*img)[rt:])
+	for i := 0; i < len(*img)/ClusterSize; i++ {
+		if rc := be.Uint16((*img)[rb+uint64(2*i):]); rc != 1 {
+			t.Errorf("cluster %d has refcount %d", i, rc)
+		}
+	}
+}
+
+func TestCompressedCluster(t *testing.T) {
+	img := &memFile{}
+	w, err := NewWriter(img, 4*ClusterSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteCluster(0, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compress a cluster on the end of the image, as qemu-img convert -c
+	// would, and map it as the third.
+	want := bytes.Repeat([]byte("compressible "), ClusterSize/13+1)[:ClusterSize]
+	var buf bytes.Buffer
+	zw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	zw.Write(want)
+	zw.Close()
+	host := uint64(len(*img)) + 100
+	img.WriteAt(buf.Bytes(), int64(host))
+	sectors := (host%512 + uint64(buf.Len()) + 511) / 512
+	x := uint(62 - (ClusterBits - 8))
+	be := binary.BigEndian
+	l2 := be.Uint64((*img)[ClusterSize:]) & offsetMask
+	be.PutUint64((*img)[l2+2*8:], flagCompressed|(sectors-1)<<x|host)
+
+	qr, err := NewReader(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 2*ClusterSize)
+	if _, err := qr.ReadAt(got, ClusterSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:ClusterSize], make([]byte, ClusterSize)) || !bytes.Equal(got[ClusterSize:], want) {
+		t.Fatal("compressed cluster doesn't read back")
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	img := &memFile{}
+	w, _ := NewWriter(img, ClusterSize)
+	w.Close()
+	binary.BigEndian.PutUint64((*img)[8:], 4096)
+	if _, err := NewReader(img); err != ErrBackingFile {
+		t.Errorf("got %v for an image with a backing file", err)
+	}
+	if _, err := NewReader(&memFile{0, 0, 0, 0}); err != ErrNotQcow2 {
+		t.Errorf("got %v for a raw image", err)
+	}
+}
+
+func TestL1Size(t *testing.T) {
+	for _, tt := range []struct {
+		size   uint64
+		l1Size uint32
+		ok     bool
+	}{
+		{ClusterSize, 1, true},
+		{ClusterSize, 3, true},
+		{ClusterSize, 4, false},
+		{ClusterSize, 0, false},
+		// An L1 table past QEMU's limit, however large the disk.
+		{1 << 62, maxL1Size/8 + 1, false},
+		// A size for which the entries needed overflow if rounded up
+		// naively.
+		{^uint64(0), 1, false},
+	} {
+		img := &memFile{}
+		w, err := NewWriter(img, ClusterSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		binary.BigEndian.PutUint64((*img)[24:], tt.size)
+		binary.BigEndian.PutUint32((*img)[36:], tt.l1Size)
+		_, err = NewReader(img)
+		if (err == nil) != tt.ok {
+			t.Errorf("size %d, L1 table of %d entries: got %v", tt.size, tt.l1Size, err)
+		}
+	}
+}
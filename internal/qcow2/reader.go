@@ -0,0 +1,194 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reader reads the virtual disk of a qcow2 image. Clusters which aren't
+// allocated read as zeroes. A Reader is not safe for concurrent use.
+type Reader struct {
+	r    io.ReaderAt
+	h    header
+	l1   []uint64
+	bits uint32
+
+	// The last L2 table and compressed cluster read, as sequential reads
+	// use each many times.
+	l2Offset   uint64
+	l2         []uint64
+	compOffset uint64
+	comp       []byte
+}
+
+// NewReader reads the header and L1 table of the qcow2 image in r.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	buf := make([]byte, headerV3Size+1)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	qr := &Reader{r: r}
+	if err := qr.h.unmarshal(buf[:n]); err != nil {
+		return nil, err
+	}
+	h := &qr.h
+	switch {
+	case h.backingFileOffset != 0:
+		return nil, ErrBackingFile
+	case h.cryptMethod != 0:
+		return nil, errors.New("qcow2: encrypted images aren't supported")
+	case h.clusterBits < 9 || h.clusterBits > 21:
+		return nil, fmt.Errorf("qcow2: invalid cluster size 2^%d", h.clusterBits)
+	case h.incompatible&^incompatDirty != 0:
+		return nil, fmt.Errorf("qcow2: unsupported incompatible features %#x", h.incompatible)
+	case h.compressionType != 0:
+		return nil, fmt.Errorf("qcow2: unsupported compression type %d", h.compressionType)
+	case uint64(h.l1Size) < l1Entries(h.size, h.clusterBits):
+		return nil, fmt.Errorf("qcow2: L1 table of %d entries is too small for %d bytes", h.l1Size, h.size)
+	case uint64(h.l1Size) > maxL1Size/8:
+		return nil, fmt.Errorf("qcow2: L1 table of %d entries is too large", h.l1Size)
+	case uint64(h.l1Size) > 2*l1Entries(h.size, h.clusterBits)+1:
+		// QEMU grows the table half as much again as it needs at a
+		// time; anything much larger is corrupt.
+		return nil, fmt.Errorf("qcow2: L1 table of %d entries is too large for %d bytes", h.l1Size, h.size)
+	}
+	qr.bits = h.clusterBits
+	raw := make([]byte, 8*int(h.l1Size))
+	if _, err := r.ReadAt(raw, int64(h.l1TableOffset)); err != nil {
+		return nil, fmt.Errorf("qcow2: couldn't read L1 table: %v", err)
+	}
+	qr.l1 = make([]uint64, h.l1Size)
+	for i := range qr.l1 {
+		qr.l1[i] = binary.BigEndian.Uint64(raw[8*i:])
+	}
+	return qr, nil
+}
+
+// Size returns the size of the virtual disk.
+func (r *Reader) Size() int64 { return int64(r.h.size) }
+
+// ClusterSize returns the image's cluster size.
+func (r *Reader) ClusterSize() int { return 1 << r.bits }
+
+// entry returns the L2 entry for the cluster at guest offset off, or zero if
+// it isn't allocated.
+func (r *Reader) entry(off int64) (uint64, error) {
+	l2Entries := uint64(1) << (r.bits - 3)
+	cluster := uint64(off) >> r.bits
+	l2Offset := r.l1[cluster/l2Entries] & offsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	if l2Offset != r.l2Offset || r.l2 == nil {
+		raw := make([]byte, 8*l2Entries)
+		if _, err := r.r.ReadAt(raw, int64(l2Offset)); err != nil {
+			return 0, fmt.Errorf("qcow2: couldn't read L2 table: %v", err)
+		}
+		if r.l2 == nil {
+			r.l2 = make([]uint64, l2Entries)
+		}
+		for i := range r.l2 {
+			r.l2[i] = binary.BigEndian.Uint64(raw[8*i:])
+		}
+		r.l2Offset = l2Offset
+	}
+	return r.l2[cluster%l2Entries], nil
+}
+
+// Allocated reports whether any of the n bytes from off have data in the
+// image. Ranges for which it returns false read as zeroes.
+func (r *Reader) Allocated(off, n int64) (bool, error) {
+	cs := int64(1) << r.bits
+	end := off + n
+	if end > r.Size() {
+		end = r.Size()
+	}
+	for off = off &^ (cs - 1); off < end; off += cs {
+		e, err := r.entry(off)
+		if err != nil {
+			return false, err
+		}
+		if e&flagCompressed != 0 || (e&offsetMask != 0 && e&flagZero == 0) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReadAt reads the virtual disk.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.Size() {
+		return 0, io.EOF
+	}
+	var ferr error
+	if max := r.Size() - off; int64(len(p)) > max {
+		p = p[:max]
+		ferr = io.EOF
+	}
+	cs := int64(1) << r.bits
+	n := 0
+	for n < len(p) {
+		within := off & (cs - 1)
+		chunk := p[n:]
+		if int64(len(chunk)) > cs-within {
+			chunk = chunk[:cs-within]
+		}
+		e, err := r.entry(off)
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case e&flagCompressed != 0:
+			data, err := r.compressed(e)
+			if err != nil {
+				return n, err
+			}
+			copy(chunk, data[within:])
+		case e&offsetMask == 0 || e&flagZero != 0:
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		default:
+			if _, err := r.r.ReadAt(chunk, int64(e&offsetMask)+within); err != nil {
+				return n, fmt.Errorf("qcow2: couldn't read cluster: %v", err)
+			}
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	return n, ferr
+}
+
+// compressed returns the contents of the compressed cluster described by
+// the L2 entry e.
+func (r *Reader) compressed(e uint64) ([]byte, error) {
+	x := 62 - (r.bits - 8)
+	desc := e &^ (flagCopied | flagCompressed)
+	hostOffset := desc & (1<<x - 1)
+	sectors := (desc >> x) + 1
+	if hostOffset == r.compOffset && r.comp != nil {
+		return r.comp, nil
+	}
+	// The compressed data may end anywhere in its last sector, and that
+	// sector may be cut short at the end of the file.
+	raw := make([]byte, sectors*512-(hostOffset&511))
+	n, err := r.r.ReadAt(raw, int64(hostOffset))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("qcow2: couldn't read compressed cluster: %v", err)
+	}
+	data := make([]byte, 1<<r.bits)
+	zr := flate.NewReader(bytes.NewReader(raw[:n]))
+	_, err = io.ReadFull(zr, data)
+	zr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: couldn't decompress cluster: %v", err)
+	}
+	r.compOffset = hostOffset
+	r.comp = data
+	return data, nil
+}
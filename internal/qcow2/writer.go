@@ -0,0 +1,181 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Writer writes a version 3 qcow2 image, with clusters of ClusterSize bytes,
+// one cluster of the virtual disk at a time, in order. Clusters which aren't
+// written, or which are all zeroes, take no space in the image.
+//
+// The image is laid out as the header, the L1 table, then the data clusters
+// with each L2 table before the first cluster it maps, and finally the
+// refcount blocks and table. Every cluster is used exactly once.
+type Writer struct {
+	w    io.WriterAt
+	size uint64
+	l1   []uint64
+	// l2 is the table being filled, for L1 entry l2Index, to be written
+	// at l2Offset.
+	l2       []uint64
+	l2Index  int
+	l2Offset uint64
+	next     uint64 // the next free cluster in the image
+	last     int64  // the last guest offset written
+	closed   bool
+}
+
+// NewWriter starts an image of a virtual disk of size bytes in w.
+func NewWriter(w io.WriterAt, size int64) (*Writer, error) {
+	if size <= 0 {
+		return nil, errors.New("qcow2: image must have a size")
+	}
+	l1 := make([]uint64, l1Entries(uint64(size), ClusterBits))
+	l1Clusters := (uint64(len(l1))*8 + ClusterSize - 1) / ClusterSize
+	return &Writer{
+		w:       w,
+		size:    uint64(size),
+		l1:      l1,
+		l2Index: -1,
+		next:    (1 + l1Clusters) * ClusterSize,
+		last:    -1,
+	}, nil
+}
+
+func (w *Writer) alloc() uint64 {
+	off := w.next
+	w.next += ClusterSize
+	return off
+}
+
+// WriteCluster stores the cluster of the virtual disk at off, which must be
+// a multiple of ClusterSize beyond the last one written. data may only be
+// short of ClusterSize for the last cluster of the disk.
+func (w *Writer) WriteCluster(off int64, data []byte) error {
+	switch {
+	case w.closed:
+		return errors.New("qcow2: write to closed image")
+	case off%ClusterSize != 0 || off <= w.last:
+		return fmt.Errorf("qcow2: cluster at %d is out of order", off)
+	case uint64(off) >= w.size || len(data) > ClusterSize:
+		return fmt.Errorf("qcow2: cluster at %d is beyond the end of the disk", off)
+	}
+	w.last = off
+	if isZeroes(data) {
+		return nil
+	}
+	const l2Entries = ClusterSize / 8
+	cluster := uint64(off) / ClusterSize
+	if idx := int(cluster / l2Entries); idx != w.l2Index {
+		if err := w.flushL2(); err != nil {
+			return err
+		}
+		w.l2 = make([]uint64, l2Entries)
+		w.l2Index = idx
+		w.l2Offset = w.alloc()
+		w.l1[idx] = w.l2Offset | flagCopied
+	}
+	host := w.alloc()
+	if len(data) < ClusterSize {
+		data = append(data, make([]byte, ClusterSize-len(data))...)
+	}
+	if _, err := w.w.WriteAt(data, int64(host)); err != nil {
+		return err
+	}
+	w.l2[cluster%l2Entries] = host | flagCopied
+	return nil
+}
+
+func (w *Writer) flushL2() error {
+	if w.l2 == nil {
+		return nil
+	}
+	_, err := w.w.WriteAt(encodeTable(w.l2), int64(w.l2Offset))
+	w.l2 = nil
+	return err
+}
+
+// Close writes the image's metadata. The image isn't valid until it has.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.flushL2(); err != nil {
+		return err
+	}
+	if _, err := w.w.WriteAt(encodeTable(w.l1), ClusterSize); err != nil {
+		return err
+	}
+
+	// The refcount blocks and table count themselves, so grow them until
+	// they cover everything.
+	const perBlock = ClusterSize / 2 // with 16 bit refcounts
+	used := w.next / ClusterSize
+	var blocks, tableClusters uint64
+	for {
+		total := used + blocks + tableClusters
+		b := (total + perBlock - 1) / perBlock
+		t := (b*8 + ClusterSize - 1) / ClusterSize
+		if b == blocks && t == tableClusters {
+			break
+		}
+		blocks, tableClusters = b, t
+	}
+	total := used + blocks + tableClusters
+	table := make([]uint64, tableClusters*ClusterSize/8)
+	for i := uint64(0); i < blocks; i++ {
+		off := w.alloc()
+		table[i] = off
+		rc := make([]byte, ClusterSize)
+		for j := uint64(0); j < perBlock && i*perBlock+j < total; j++ {
+			binary.BigEndian.PutUint16(rc[2*j:], 1)
+		}
+		if _, err := w.w.WriteAt(rc, int64(off)); err != nil {
+			return err
+		}
+	}
+	tableOffset := w.next
+	w.next += tableClusters * ClusterSize
+	if _, err := w.w.WriteAt(encodeTable(table), int64(tableOffset)); err != nil {
+		return err
+	}
+
+	h := header{
+		version:             3,
+		clusterBits:         ClusterBits,
+		size:                w.size,
+		l1Size:              uint32(len(w.l1)),
+		l1TableOffset:       ClusterSize,
+		refcountTableOffset: tableOffset,
+		refcountClusters:    uint32(tableClusters),
+		refcountOrder:       4,
+		headerLength:        headerV3Size,
+	}
+	// The rest of the header cluster is zero, which ends the (empty) list
+	// of header extensions.
+	hc := make([]byte, ClusterSize)
+	copy(hc, h.marshal())
+	_, err := w.w.WriteAt(hc, 0)
+	return err
+}
+
+func encodeTable(t []uint64) []byte {
+	b := make([]byte, 8*len(t))
+	for i, x := range t {
+		binary.BigEndian.PutUint64(b[8*i:], x)
+	}
+	return b
+}
+
+func isZeroes(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
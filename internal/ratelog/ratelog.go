@@ -0,0 +1,97 @@
+// Package ratelog wraps a capnslog logger so that a message logged over and
+// over again, as happens when a peer or initiator misbehaves, is collapsed
+// into a periodic summary instead of flooding the log.
+package ratelog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+// DefaultInterval is the window over which repeats of a message are collapsed.
+const DefaultInterval = 10 * time.Second
+
+type logfFunc func(l capnslog.LogLevel, format string, args ...interface{})
+
+// Logger logs the first occurrence of each message immediately. Further
+// occurrences within the interval are counted and reported as a single line
+// once the interval is up. Messages are told apart by their format string,
+// so the same failure with different arguments counts as a repeat.
+type Logger struct {
+	interval time.Duration
+	logf     logfFunc
+
+	mut  sync.Mutex
+	msgs map[string]*window
+}
+
+type window struct {
+	level      capnslog.LogLevel
+	start      time.Time
+	suppressed int
+	last       string
+	flush      *time.Timer
+}
+
+// New creates a Logger writing to l which reports repeats every interval.
+func New(l *capnslog.PackageLogger, interval time.Duration) *Logger {
+	return newLogger(l.Logf, interval)
+}
+
+func newLogger(logf logfFunc, interval time.Duration) *Logger {
+	return &Logger{
+		interval: interval,
+		logf:     logf,
+		msgs:     make(map[string]*window),
+	}
+}
+
+func (r *Logger) Errorf(format string, args ...interface{}) {
+	r.log(capnslog.ERROR, format, args...)
+}
+
+func (r *Logger) Warningf(format string, args ...interface{}) {
+	r.log(capnslog.WARNING, format, args...)
+}
+
+func (r *Logger) Noticef(format string, args ...interface{}) {
+	r.log(capnslog.NOTICE, format, args...)
+}
+
+func (r *Logger) log(level capnslog.LogLevel, format string, args ...interface{}) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	w, ok := r.msgs[format]
+	if ok && time.Since(w.start) < r.interval {
+		w.suppressed++
+		w.last = fmt.Sprintf(format, args...)
+		if w.flush == nil {
+			w.flush = time.AfterFunc(r.interval-time.Since(w.start), func() {
+				r.flush(format)
+			})
+		}
+		return
+	}
+	r.msgs[format] = &window{
+		level: level,
+		start: time.Now(),
+	}
+	r.logf(level, format, args...)
+}
+
+func (r *Logger) flush(format string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	w, ok := r.msgs[format]
+	if !ok {
+		return
+	}
+	delete(r.msgs, format)
+	if w.suppressed == 0 {
+		return
+	}
+	r.logf(w.level, "%s (%d occurrences in the last %s)", w.last, w.suppressed, r.interval)
+}
@@ -0,0 +1,73 @@
+package ratelog
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+)
+
+type recorder struct {
+	mut   sync.Mutex
+	lines []string
+}
+
+func (r *recorder) logf(_ capnslog.LogLevel, format string, args ...interface{}) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) get() []string {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	out := make([]string, len(r.lines))
+	copy(out, r.lines)
+	return out
+}
+
+func TestCollapseRepeats(t *testing.T) {
+	rec := &recorder{}
+	l := newLogger(rec.logf, 50*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		l.Errorf("read failed: %d", i)
+	}
+	l.Errorf("something else")
+	lines := rec.get()
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines before the summary, got %d: %v", len(lines), lines)
+	}
+	if lines[0] != "read failed: 0" {
+		t.Fatalf("unexpected first line %q", lines[0])
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	lines = rec.get()
+	if len(lines) != 3 {
+		t.Fatalf("expected a summary line, got %v", lines)
+	}
+	if !strings.HasPrefix(lines[2], "read failed: 99 (99 occurrences") {
+		t.Fatalf("unexpected summary %q", lines[2])
+	}
+
+	// A new window starts after the summary.
+	l.Errorf("read failed: %d", 100)
+	lines = rec.get()
+	if len(lines) != 4 || lines[3] != "read failed: 100" {
+		t.Fatalf("expected the message to be logged again, got %v", lines)
+	}
+}
+
+func TestNoSummaryWithoutRepeats(t *testing.T) {
+	rec := &recorder{}
+	l := newLogger(rec.logf, 20*time.Millisecond)
+	l.Warningf("once")
+	time.Sleep(60 * time.Millisecond)
+	l.Warningf("once")
+	if lines := rec.get(); len(lines) != 2 {
+		t.Fatalf("expected each message to be logged, got %v", lines)
+	}
+}
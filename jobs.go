@@ -0,0 +1,284 @@
+package torus
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultConcurrentJobs is the number of background jobs a server runs at
+// once when its Config doesn't say.
+const DefaultConcurrentJobs = 2
+
+// ErrNoJob is returned when asked about a background job that isn't
+// registered.
+var ErrNoJob = errors.New("torus: no such job")
+
+// JobFunc does a single run of a background job. It should return promptly
+// once ctx is done, and may report how far along it is with progress.
+type JobFunc func(ctx context.Context, progress func(done, total int)) error
+
+// JobOptions describes when a background job runs.
+type JobOptions struct {
+	// Interval is the time from the end of one run to the start of the
+	// next.
+	Interval time.Duration
+	// Priority orders the jobs that are due when there aren't enough
+	// slots to run them all; lower values go first.
+	Priority int
+}
+
+// JobStatus reports the state of a background job.
+type JobStatus struct {
+	Name     string
+	Interval time.Duration
+	Priority int
+	Paused   bool
+	Running  bool
+	// Done and Total are the progress last reported by the current or
+	// latest run. Total is zero when the job can't tell.
+	Done  int
+	Total int
+
+	Runs       int
+	LastStart  time.Time
+	LastFinish time.Time
+	LastError  string
+	NextRun    time.Time
+}
+
+type job struct {
+	fn     JobFunc
+	status JobStatus
+	cancel context.CancelFunc
+	// triggered is set when the job is triggered while it is running, so
+	// that it runs again straight after.
+	triggered bool
+}
+
+// JobScheduler runs the background jobs of a server, such as rebalancing and
+// snapshot policies, so that they share a limit on how many run at once and
+// can be watched and controlled in one place.
+type JobScheduler struct {
+	mut   sync.Mutex
+	jobs  map[string]*job
+	slots int
+	used  int
+	wake  chan struct{}
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// NewJobScheduler creates a scheduler which runs up to concurrency jobs at a
+// time, and starts it.
+func NewJobScheduler(concurrency int) *JobScheduler {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrentJobs
+	}
+	s := &JobScheduler{
+		jobs:  make(map[string]*job),
+		slots: concurrency,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// Register adds a job. Its first run is due immediately.
+func (s *JobScheduler) Register(name string, opts JobOptions, fn JobFunc) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.jobs[name]; ok {
+		return ErrExists
+	}
+	s.jobs[name] = &job{
+		fn: fn,
+		status: JobStatus{
+			Name:     name,
+			Interval: opts.Interval,
+			Priority: opts.Priority,
+			NextRun:  time.Now(),
+		},
+	}
+	s.poke()
+	return nil
+}
+
+// Unregister removes a job, stopping it if it is running.
+func (s *JobScheduler) Unregister(name string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if j, ok := s.jobs[name]; ok && j.cancel != nil {
+		j.cancel()
+	}
+	delete(s.jobs, name)
+}
+
+// Status returns the status of every job, ordered by name.
+func (s *JobScheduler) Status() []JobStatus {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	out := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		out = append(out, j.status)
+	}
+	sort.Sort(jobsByName(out))
+	return out
+}
+
+// Pause stops a job from running until it is resumed. A run in progress is
+// stopped.
+func (s *JobScheduler) Pause(name string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return ErrNoJob
+	}
+	j.status.Paused = true
+	if j.cancel != nil {
+		j.cancel()
+	}
+	return nil
+}
+
+// Resume lets a paused job run again.
+func (s *JobScheduler) Resume(name string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return ErrNoJob
+	}
+	j.status.Paused = false
+	s.poke()
+	return nil
+}
+
+// Trigger makes a job due now, rather than at the end of its interval. It
+// still waits for a free slot, and for the current run if there is one.
+func (s *JobScheduler) Trigger(name string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return ErrNoJob
+	}
+	j.status.NextRun = time.Now()
+	if j.status.Running {
+		j.triggered = true
+	}
+	s.poke()
+	return nil
+}
+
+// Close stops the scheduler and any jobs that are running.
+func (s *JobScheduler) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.mut.Lock()
+		for _, j := range s.jobs {
+			if j.cancel != nil {
+				j.cancel()
+			}
+		}
+		s.mut.Unlock()
+	})
+}
+
+// poke wakes the loop to look for due jobs. s.mut must be held.
+func (s *JobScheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *JobScheduler) loop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		s.startDue(time.Now())
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *JobScheduler) startDue(now time.Time) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	var due []*job
+	for _, j := range s.jobs {
+		if !j.status.Paused && !j.status.Running && !now.Before(j.status.NextRun) {
+			due = append(due, j)
+		}
+	}
+	sort.Sort(jobsByPriority(due))
+	for _, j := range due {
+		if s.used == s.slots {
+			return
+		}
+		s.used++
+		s.start(j, now)
+	}
+}
+
+// start runs j. s.mut must be held.
+func (s *JobScheduler) start(j *job, now time.Time) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.status.Running = true
+	j.status.LastStart = now
+	j.status.Done, j.status.Total = 0, 0
+	progress := func(done, total int) {
+		s.mut.Lock()
+		j.status.Done, j.status.Total = done, total
+		s.mut.Unlock()
+	}
+	go func() {
+		err := j.fn(ctx, progress)
+		cancel()
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		s.used--
+		j.cancel = nil
+		j.status.Running = false
+		j.status.Runs++
+		j.status.LastFinish = time.Now()
+		j.status.LastError = ""
+		if err != nil {
+			j.status.LastError = err.Error()
+		}
+		j.status.NextRun = j.status.LastFinish.Add(j.status.Interval)
+		if j.triggered {
+			j.status.NextRun = j.status.LastFinish
+			j.triggered = false
+		}
+		s.poke()
+	}()
+}
+
+type jobsByName []JobStatus
+
+func (b jobsByName) Len() int           { return len(b) }
+func (b jobsByName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b jobsByName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+type jobsByPriority []*job
+
+func (b jobsByPriority) Len() int      { return len(b) }
+func (b jobsByPriority) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b jobsByPriority) Less(i, j int) bool {
+	if b[i].status.Priority != b[j].status.Priority {
+		return b[i].status.Priority < b[j].status.Priority
+	}
+	return b[i].status.Name < b[j].status.Name
+}
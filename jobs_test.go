@@ -0,0 +1,263 @@
+package torus
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Jobs in these tests run once when registered and then only when triggered,
+// as their interval is never reached.
+const testJobInterval = time.Hour
+
+const testJobTimeout = 5 * time.Second
+
+func expectRun(t *testing.T, ch <-chan string, name string) {
+	select {
+	case got := <-ch:
+		if got != name {
+			t.Fatalf("job %s ran, expected %s", got, name)
+		}
+	case <-time.After(testJobTimeout):
+		t.Fatalf("job %s didn't run", name)
+	}
+}
+
+func expectNoRun(t *testing.T, ch <-chan string) {
+	select {
+	case got := <-ch:
+		t.Fatalf("job %s ran unexpectedly", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func jobStatus(s *JobScheduler, name string) JobStatus {
+	for _, st := range s.Status() {
+		if st.Name == name {
+			return st
+		}
+	}
+	return JobStatus{}
+}
+
+// waitJob waits until the status of the named job satisfies cond.
+func waitJob(t *testing.T, s *JobScheduler, name string, cond func(JobStatus) bool) JobStatus {
+	deadline := time.Now().Add(testJobTimeout)
+	for {
+		st := jobStatus(s, name)
+		if cond(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting on job %s: %+v", name, st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockingJob returns a job which reports each run on started and then
+// waits for a value on release, or for its context to be done.
+func blockingJob(name string, started chan<- string, release <-chan struct{}) JobFunc {
+	return func(ctx context.Context, progress func(done, total int)) error {
+		started <- name
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestJobSchedulerPauseResumeTrigger(t *testing.T) {
+	s := NewJobScheduler(1)
+	defer s.Close()
+	runs := make(chan string, 10)
+	err := s.Register("job", JobOptions{Interval: testJobInterval}, func(ctx context.Context, progress func(done, total int)) error {
+		progress(1, 2)
+		runs <- "job"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("job", JobOptions{}, nil); err != ErrExists {
+		t.Fatalf("registering a job twice: expected ErrExists, got %v", err)
+	}
+	expectRun(t, runs, "job")
+	st := waitJob(t, s, "job", func(st JobStatus) bool { return st.Runs == 1 })
+	if st.Done != 1 || st.Total != 2 {
+		t.Errorf("job progress %d/%d, expected 1/2", st.Done, st.Total)
+	}
+	if st.NextRun.Sub(st.LastFinish) != testJobInterval {
+		t.Errorf("next run due %v after the last, expected %v", st.NextRun.Sub(st.LastFinish), testJobInterval)
+	}
+
+	if err := s.Trigger("job"); err != nil {
+		t.Fatal(err)
+	}
+	expectRun(t, runs, "job")
+	waitJob(t, s, "job", func(st JobStatus) bool { return st.Runs == 2 })
+
+	if err := s.Pause("job"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Trigger("job"); err != nil {
+		t.Fatal(err)
+	}
+	expectNoRun(t, runs)
+	if !jobStatus(s, "job").Paused {
+		t.Error("paused job isn't reported paused")
+	}
+	if err := s.Resume("job"); err != nil {
+		t.Fatal(err)
+	}
+	expectRun(t, runs, "job")
+
+	for _, fn := range []func(string) error{s.Pause, s.Resume, s.Trigger} {
+		if err := fn("missing"); err != ErrNoJob {
+			t.Errorf("expected ErrNoJob for a missing job, got %v", err)
+		}
+	}
+}
+
+func TestJobSchedulerSlots(t *testing.T) {
+	s := NewJobScheduler(2)
+	defer s.Close()
+	var (
+		mut              sync.Mutex
+		running, maxSeen int
+	)
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		name := name
+		err := s.Register(name, JobOptions{Interval: testJobInterval}, func(ctx context.Context, progress func(done, total int)) error {
+			mut.Lock()
+			running++
+			if running > maxSeen {
+				maxSeen = running
+			}
+			mut.Unlock()
+			started <- name
+			<-release
+			mut.Lock()
+			running--
+			mut.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	<-started
+	expectNoRun(t, started)
+	for range names {
+		release <- struct{}{}
+	}
+	<-started
+	<-started
+	for _, name := range names {
+		waitJob(t, s, name, func(st JobStatus) bool { return st.Runs == 1 })
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	if maxSeen != 2 {
+		t.Fatalf("%d jobs ran at once with 2 slots", maxSeen)
+	}
+}
+
+func TestJobSchedulerPriority(t *testing.T) {
+	s := NewJobScheduler(1)
+	defer s.Close()
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	if err := s.Register("blocker", JobOptions{Interval: testJobInterval}, blockingJob("blocker", started, release)); err != nil {
+		t.Fatal(err)
+	}
+	expectRun(t, started, "blocker")
+
+	// Both jobs are due by the time the slot is free, and the one with the
+	// lower priority value goes first, whatever the order they came in.
+	for _, j := range []struct {
+		name     string
+		priority int
+	}{
+		{"low", 2},
+		{"high", 1},
+	} {
+		if err := s.Register(j.name, JobOptions{Interval: testJobInterval, Priority: j.priority}, blockingJob(j.name, started, release)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectNoRun(t, started)
+	release <- struct{}{}
+	expectRun(t, started, "high")
+	release <- struct{}{}
+	expectRun(t, started, "low")
+	release <- struct{}{}
+}
+
+func TestJobSchedulerTriggerWhileRunning(t *testing.T) {
+	s := NewJobScheduler(1)
+	defer s.Close()
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	if err := s.Register("job", JobOptions{Interval: testJobInterval}, blockingJob("job", started, release)); err != nil {
+		t.Fatal(err)
+	}
+	expectRun(t, started, "job")
+	if err := s.Trigger("job"); err != nil {
+		t.Fatal(err)
+	}
+	expectNoRun(t, started)
+
+	// The run that was going when the job was triggered doesn't count; it
+	// runs again straight after, rather than at the end of its interval.
+	release <- struct{}{}
+	expectRun(t, started, "job")
+	st := jobStatus(s, "job")
+	if st.Runs != 1 || !st.Running {
+		t.Fatalf("expected the second run to be going, got %+v", st)
+	}
+	release <- struct{}{}
+	st = waitJob(t, s, "job", func(st JobStatus) bool { return st.Runs == 2 })
+	if st.NextRun.Sub(st.LastFinish) != testJobInterval {
+		t.Errorf("next run due %v after the last, expected %v", st.NextRun.Sub(st.LastFinish), testJobInterval)
+	}
+}
+
+func TestJobSchedulerCancel(t *testing.T) {
+	s := NewJobScheduler(2)
+	started := make(chan string, 10)
+	for _, name := range []string{"paused", "closed"} {
+		if err := s.Register(name, JobOptions{Interval: testJobInterval}, blockingJob(name, started, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	<-started
+
+	if err := s.Pause("paused"); err != nil {
+		t.Fatal(err)
+	}
+	st := waitJob(t, s, "paused", func(st JobStatus) bool { return !st.Running })
+	if st.LastError != context.Canceled.Error() {
+		t.Errorf("paused job returned %q, expected it to be canceled", st.LastError)
+	}
+	if !jobStatus(s, "closed").Running {
+		t.Error("pausing one job stopped another")
+	}
+
+	s.Close()
+	st = waitJob(t, s, "closed", func(st JobStatus) bool { return !st.Running })
+	if st.LastError != context.Canceled.Error() {
+		t.Errorf("job returned %q when the scheduler closed, expected it to be canceled", st.LastError)
+	}
+	// Closing twice is harmless.
+	s.Close()
+}
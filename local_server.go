@@ -67,8 +67,11 @@ func NewServerByImpl(cfg Config, mds MetadataService, blocks BlockStore) (*Serve
 		INodes:   NewINodeStore(blocks),
 		peersMap: make(map[string]*models.PeerInfo),
 		Cfg:      cfg,
+		Jobs:     NewJobScheduler(cfg.ConcurrentJobs),
 		peerInfo: &models.PeerInfo{
 			UUID: mds.UUID(),
 		},
+		writeBehindMemory: cfg.Memory.Account("write-behind", nil),
+		readAheadMemory:   cfg.Memory.Account("read-ahead", nil),
 	}, nil
 }
@@ -0,0 +1,179 @@
+package torus
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promMemoryUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_memory_used_bytes",
+		Help: "Memory held by each subsystem drawing on the memory budget",
+	}, []string{"subsystem"})
+	promMemoryLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "torus_memory_limit_bytes",
+		Help: "Size of the memory budget",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promMemoryUsed)
+	prometheus.MustRegister(promMemoryLimit)
+}
+
+// MemoryBudget bounds the memory used by caches and buffers across a process.
+// Each subsystem draws on it through a MemoryAccount. When the budget runs
+// out, subsystems that can give memory back, such as caches, are asked to
+// shrink to make room.
+type MemoryBudget struct {
+	mut      sync.Mutex
+	limit    uint64
+	used     uint64
+	accounts []*MemoryAccount
+}
+
+// MemoryAccount is a subsystem's share of a MemoryBudget. A nil
+// *MemoryAccount places no limits, so subsystems can use one whether or not a
+// budget was configured.
+type MemoryAccount struct {
+	budget *MemoryBudget
+	name   string
+	used   uint64
+	// shrink frees up to n bytes and returns how many it freed.
+	shrink func(n uint64) uint64
+}
+
+// NewMemoryBudget creates a budget of limit bytes. A limit of zero tracks
+// usage without limiting it.
+func NewMemoryBudget(limit uint64) *MemoryBudget {
+	promMemoryLimit.Set(float64(limit))
+	return &MemoryBudget{limit: limit}
+}
+
+// Account opens an account for a subsystem. If the subsystem can give memory
+// back, shrink is called to free some when the budget is short; it must not
+// call back into the account, and the account must not be used while holding
+// locks shrink takes. Calling Account on a nil budget returns a nil account.
+func (b *MemoryBudget) Account(name string, shrink func(n uint64) uint64) *MemoryAccount {
+	if b == nil {
+		return nil
+	}
+	a := &MemoryAccount{budget: b, name: name, shrink: shrink}
+	b.mut.Lock()
+	b.accounts = append(b.accounts, a)
+	b.mut.Unlock()
+	return a
+}
+
+// Used returns the bytes held through each account, by subsystem.
+func (b *MemoryBudget) Used() map[string]uint64 {
+	out := make(map[string]uint64)
+	if b == nil {
+		return out
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for _, a := range b.accounts {
+		out[a.name] += a.used
+	}
+	return out
+}
+
+// Reserve takes n bytes from the budget, shrinking other subsystems to make
+// room if need be. It returns false, taking nothing, if there isn't room; the
+// caller should then do without, as a cache would by not caching.
+func (a *MemoryAccount) Reserve(n uint64) bool {
+	if a == nil {
+		return true
+	}
+	b := a.budget
+	if !b.makeRoom(n) {
+		return false
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if !b.fits(n) {
+		// Someone else took the room in the meantime.
+		return false
+	}
+	a.add(n)
+	return true
+}
+
+// Charge takes n bytes from the budget whether or not there is room, for
+// memory the caller can't do without. Other subsystems are shrunk to bring
+// the budget back within its limit.
+func (a *MemoryAccount) Charge(n uint64) {
+	if a == nil {
+		return
+	}
+	a.budget.makeRoom(n)
+	a.budget.mut.Lock()
+	a.add(n)
+	a.budget.mut.Unlock()
+}
+
+// Release returns n bytes to the budget.
+func (a *MemoryAccount) Release(n uint64) {
+	if a == nil {
+		return
+	}
+	a.budget.mut.Lock()
+	a.sub(n)
+	a.budget.mut.Unlock()
+}
+
+func (a *MemoryAccount) add(n uint64) {
+	a.used += n
+	a.budget.used += n
+	promMemoryUsed.WithLabelValues(a.name).Set(float64(a.used))
+}
+
+func (a *MemoryAccount) sub(n uint64) {
+	if n > a.used {
+		n = a.used
+	}
+	a.used -= n
+	a.budget.used -= n
+	promMemoryUsed.WithLabelValues(a.name).Set(float64(a.used))
+}
+
+// makeRoom shrinks accounts until n more bytes fit in the budget, and reports
+// whether they do.
+func (b *MemoryBudget) makeRoom(n uint64) bool {
+	if b.limit == 0 {
+		return true
+	}
+	if n > b.limit {
+		return false
+	}
+	b.mut.Lock()
+	accounts := append([]*MemoryAccount(nil), b.accounts...)
+	b.mut.Unlock()
+	for _, a := range accounts {
+		b.mut.Lock()
+		fits := b.fits(n)
+		need := b.used + n - b.limit
+		b.mut.Unlock()
+		if fits {
+			return true
+		}
+		if a.shrink == nil {
+			continue
+		}
+		// Shrink without holding the lock, as the subsystem will take
+		// its own.
+		freed := a.shrink(need)
+		b.mut.Lock()
+		a.sub(freed)
+		b.mut.Unlock()
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.fits(n)
+}
+
+func (b *MemoryBudget) fits(n uint64) bool {
+	return b.limit == 0 || b.used+n <= b.limit
+}
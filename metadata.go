@@ -44,6 +44,25 @@ type MetadataService interface {
 	RegisterPeer(lease int64, pi *models.PeerInfo) error
 	GetPeers() (PeerInfoList, error)
 
+	// GetCordoned returns the peers which are kept out of the placement of
+	// new blocks.
+	GetCordoned() (PeerList, error)
+	SetCordoned(uuid string, cordoned bool) error
+
+	// GetTopology returns where each peer which has published it sits in
+	// the network, by UUID.
+	GetTopology() (map[string]Topology, error)
+	// SetTopology publishes where a peer sits; an empty Topology removes
+	// it.
+	SetTopology(uuid string, t Topology) error
+
+	// GetVolumeReplication returns the replication factor of each volume
+	// which overrides the ring's.
+	GetVolumeReplication() (map[VolumeID]int, error)
+	// SetVolumeReplication overrides the ring's replication factor for a
+	// volume's blocks; zero goes back to the ring's.
+	SetVolumeReplication(vid VolumeID, r int) error
+
 	Close() error
 
 	CommitINodeIndex(VolumeID) (INodeID, error)
@@ -165,3 +184,64 @@ func SetRing(name string, cfg Config, r Ring) error {
 	clog.Debugf("running setRing for service type: %s", name)
 	return setRingFuncs[name](cfg, r)
 }
+
+// ExportMDSFunc is the signature of a function which writes all of a
+// metadata service's metadata to w, in a form its ImportMDSFunc can read.
+type ExportMDSFunc func(cfg Config, w io.Writer) error
+
+// ImportMDSFunc is the signature of a function which loads metadata written
+// by an ExportMDSFunc into an empty metadata service.
+type ImportMDSFunc func(cfg Config, r io.Reader) error
+
+var (
+	exportMDSFuncs map[string]ExportMDSFunc
+	importMDSFuncs map[string]ImportMDSFunc
+)
+
+// RegisterMetadataExport is the hook used for implementations of
+// MetadataServices to register their ways of dumping their metadata.
+func RegisterMetadataExport(name string, newFunc ExportMDSFunc) {
+	if exportMDSFuncs == nil {
+		exportMDSFuncs = make(map[string]ExportMDSFunc)
+	}
+
+	if _, ok := exportMDSFuncs[name]; ok {
+		panic("torus: attempted to register ExportMDSFunc " + name + " twice")
+	}
+
+	exportMDSFuncs[name] = newFunc
+}
+
+// RegisterMetadataImport is the hook used for implementations of
+// MetadataServices to register their ways of loading dumped metadata.
+func RegisterMetadataImport(name string, newFunc ImportMDSFunc) {
+	if importMDSFuncs == nil {
+		importMDSFuncs = make(map[string]ImportMDSFunc)
+	}
+
+	if _, ok := importMDSFuncs[name]; ok {
+		panic("torus: attempted to register ImportMDSFunc " + name + " twice")
+	}
+
+	importMDSFuncs[name] = newFunc
+}
+
+// ExportMDS calls the specific export function provided by a metadata package.
+func ExportMDS(name string, cfg Config, w io.Writer) error {
+	clog.Debugf("running ExportMDS for service type: %s", name)
+	f, ok := exportMDSFuncs[name]
+	if !ok {
+		return fmt.Errorf("torus: the metadata service %q can't be exported", name)
+	}
+	return f(cfg, w)
+}
+
+// ImportMDS calls the specific import function provided by a metadata package.
+func ImportMDS(name string, cfg Config, r io.Reader) error {
+	clog.Debugf("running ImportMDS for service type: %s", name)
+	f, ok := importMDSFuncs[name]
+	if !ok {
+		return fmt.Errorf("torus: the metadata service %q can't be imported", name)
+	}
+	return f(cfg, r)
+}
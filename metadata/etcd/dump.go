@@ -0,0 +1,149 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+const dumpVersion = 1
+
+// importBatch is the number of keys written per transaction on import; etcd
+// limits the operations in a single transaction.
+const importBatch = 64
+
+// metadataDump is the exported form of a cluster's metadata.
+type metadataDump struct {
+	Version int
+	Created time.Time
+	// Revision is the etcd revision everything was read at.
+	Revision int64
+	// Keys are relative to KeyPrefix, so a dump can be imported under a
+	// different one.
+	Keys []dumpedKey
+}
+
+type dumpedKey struct {
+	Key   string
+	Value []byte
+}
+
+// exportEtcdMetadata writes every key torus has in etcd, as of a single
+// revision. Keys attached to a lease, such as peer registrations and volume
+// locks, belong to running processes and are left out.
+func exportEtcdMetadata(cfg torus.Config, w io.Writer) error {
+	client, err := etcdv3.New(etcdv3.Config{Endpoints: []string{cfg.MetadataAddress}})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	resp, err := client.Get(context.Background(), MkKey(), etcdv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	dump := metadataDump{
+		Version:  dumpVersion,
+		Created:  time.Now(),
+		Revision: resp.Header.Revision,
+	}
+	found := false
+	for _, kv := range resp.Kvs {
+		if kv.Lease != 0 {
+			continue
+		}
+		k := strings.TrimPrefix(string(kv.Key), KeyPrefix)
+		if k == "meta/globalmetadata" {
+			found = true
+		}
+		dump.Keys = append(dump.Keys, dumpedKey{Key: k, Value: kv.Value})
+	}
+	if !found {
+		return torus.ErrNoGlobalMetadata
+	}
+	return json.NewEncoder(w).Encode(&dump)
+}
+
+// importEtcdMetadata loads a dump into an etcd holding no torus metadata. The
+// global metadata is written last, so that until the import is complete the
+// cluster doesn't appear to exist.
+func importEtcdMetadata(cfg torus.Config, r io.Reader) error {
+	var dump metadataDump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return fmt.Errorf("couldn't read metadata dump: %v", err)
+	}
+	if dump.Version != dumpVersion {
+		return fmt.Errorf("unsupported metadata dump version %d", dump.Version)
+	}
+
+	client, err := etcdv3.New(etcdv3.Config{Endpoints: []string{cfg.MetadataAddress}})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	resp, err := client.Get(context.Background(), MkKey(), etcdv3.WithPrefix(), etcdv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) != 0 {
+		return torus.ErrExists
+	}
+
+	gmdkey := MkKey("meta", "globalmetadata")
+	var gmd []byte
+	for _, k := range dump.Keys {
+		if MkKey(k.Key) == gmdkey {
+			gmd = k.Value
+		}
+	}
+	if gmd == nil {
+		return torus.ErrNoGlobalMetadata
+	}
+
+	var ops []etcdv3.Op
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		_, err := client.Txn(context.Background()).If(
+			etcdv3.Compare(etcdv3.Version(gmdkey), "=", 0),
+		).Then(ops...).Commit()
+		ops = ops[:0]
+		return err
+	}
+	for _, k := range dump.Keys {
+		key := MkKey(k.Key)
+		if key == gmdkey {
+			continue
+		}
+		ops = append(ops, etcdv3.OpPut(key, string(k.Value)))
+		if len(ops) == importBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	tresp, err := client.Txn(context.Background()).If(
+		etcdv3.Compare(etcdv3.Version(gmdkey), "=", 0),
+	).Then(
+		etcdv3.OpPut(gmdkey, string(gmd)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if !tresp.Succeeded {
+		return torus.ErrExists
+	}
+	return nil
+}
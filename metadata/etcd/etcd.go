@@ -3,6 +3,8 @@ package etcd
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -42,6 +44,8 @@ func init() {
 	torus.RegisterMetadataService("etcd", newEtcdMetadata)
 	torus.RegisterMetadataInit("etcd", initEtcdMetadata)
 	torus.RegisterSetRing("etcd", setRing)
+	torus.RegisterMetadataExport("etcd", exportEtcdMetadata)
+	torus.RegisterMetadataImport("etcd", importEtcdMetadata)
 
 	prometheus.MustRegister(promAtomicRetries)
 	prometheus.MustRegister(promOps)
@@ -223,6 +227,117 @@ func (c *etcdCtx) GetPeers() (torus.PeerInfoList, error) {
 	return torus.PeerInfoList(out), nil
 }
 
+func (c *etcdCtx) GetCordoned() (torus.PeerList, error) {
+	promOps.WithLabelValues("get-cordoned").Inc()
+	prefix := MkKey("meta", "cordoned") + "/"
+	resp, err := c.etcd.Client.Get(c.getContext(), prefix, etcdv3.WithPrefix(), etcdv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	var out torus.PeerList
+	for _, x := range resp.Kvs {
+		out = append(out, strings.TrimPrefix(string(x.Key), prefix))
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) SetCordoned(uuid string, cordoned bool) error {
+	promOps.WithLabelValues("set-cordoned").Inc()
+	k := MkKey("meta", "cordoned", uuid)
+	if !cordoned {
+		_, err := c.etcd.Client.Delete(c.getContext(), k)
+		return err
+	}
+	_, err := c.etcd.Client.Put(c.getContext(), k, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (c *etcdCtx) GetTopology() (map[string]torus.Topology, error) {
+	promOps.WithLabelValues("get-topology").Inc()
+	prefix := MkKey("meta", "topology") + "/"
+	resp, err := c.etcd.Client.Get(c.getContext(), prefix, etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]torus.Topology)
+	for _, x := range resp.Kvs {
+		var t torus.Topology
+		err := json.Unmarshal(x.Value, &t)
+		if err != nil {
+			return nil, err
+		}
+		out[strings.TrimPrefix(string(x.Key), prefix)] = t
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) SetTopology(uuid string, t torus.Topology) error {
+	promOps.WithLabelValues("set-topology").Inc()
+	k := MkKey("meta", "topology", uuid)
+	if len(t) == 0 {
+		_, err := c.etcd.Client.Delete(c.getContext(), k)
+		return err
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = c.etcd.Client.Put(c.getContext(), k, string(b))
+	return err
+}
+
+// VolumeReplicationKey is the key holding a volume's replication factor, so
+// that it can be deleted along with the volume.
+func VolumeReplicationKey(vid uint64) string {
+	return MkKey("meta", "replication", Uint64ToHex(vid))
+}
+
+func (c *etcdCtx) GetVolumeReplication() (map[torus.VolumeID]int, error) {
+	promOps.WithLabelValues("get-volume-replication").Inc()
+	prefix := MkKey("meta", "replication") + "/"
+	resp, err := c.etcd.Client.Get(c.getContext(), prefix, etcdv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[torus.VolumeID]int)
+	for _, x := range resp.Kvs {
+		vid, err := strconv.ParseUint(strings.TrimPrefix(string(x.Key), prefix), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		r, err := strconv.Atoi(string(x.Value))
+		if err != nil {
+			return nil, err
+		}
+		out[torus.VolumeID(vid)] = r
+	}
+	return out, nil
+}
+
+func (c *etcdCtx) SetVolumeReplication(vid torus.VolumeID, r int) error {
+	promOps.WithLabelValues("set-volume-replication").Inc()
+	k := VolumeReplicationKey(uint64(vid))
+	if r == 0 {
+		_, err := c.etcd.Client.Delete(c.getContext(), k)
+		return err
+	}
+	// Guard against racing a volume delete, which would leave the setting
+	// orphaned.
+	tx := c.etcd.Client.Txn(c.getContext()).If(
+		etcdv3.Compare(etcdv3.Version(MkKey("volumeid", Uint64ToHex(uint64(vid)))), ">", 0),
+	).Then(
+		etcdv3.OpPut(k, strconv.Itoa(r)),
+	)
+	resp, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return torus.ErrNotExist
+	}
+	return nil
+}
+
 // AtomicModifyFunc is a class of commutative functions that, given the current
 // state of a key's value `in`, returns the new state of the key `out`, and
 // `data` to be returned to the calling function on success, or an `err`.
@@ -26,11 +26,16 @@ type Server struct {
 	volIndex map[string]*models.Volume
 	global   torus.GlobalMetadata
 	peers    torus.PeerInfoList
+	cordoned torus.PeerList
+	topology map[string]torus.Topology
 	ring     torus.Ring
 	newRing  torus.Ring
 
 	keys map[string]interface{}
 
+	// replication holds the volumes' replication factors.
+	replication map[torus.VolumeID]int
+
 	ringListeners []chan torus.Ring
 }
 
@@ -56,9 +61,12 @@ func NewServer() *Server {
 			DefaultBlockSpec: blockset.MustParseBlockLayerSpec("crc,base"),
 			INodeReplication: 2,
 		},
-		ring:  r,
-		keys:  make(map[string]interface{}),
-		inode: make(map[torus.VolumeID]torus.INodeID),
+		ring:     r,
+		keys:     make(map[string]interface{}),
+		inode:    make(map[torus.VolumeID]torus.INodeID),
+		topology: make(map[string]torus.Topology),
+
+		replication: make(map[torus.VolumeID]int),
 	}
 }
 
@@ -110,6 +118,67 @@ func (t *Client) RegisterPeer(_ int64, pi *models.PeerInfo) error {
 	return nil
 }
 
+func (t *Client) GetCordoned() (torus.PeerList, error) {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	return append(torus.PeerList(nil), t.srv.cordoned...), nil
+}
+
+func (t *Client) GetTopology() (map[string]torus.Topology, error) {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	out := make(map[string]torus.Topology)
+	for k, v := range t.srv.topology {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (t *Client) SetTopology(uuid string, topo torus.Topology) error {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	if len(topo) == 0 {
+		delete(t.srv.topology, uuid)
+		return nil
+	}
+	t.srv.topology[uuid] = topo
+	return nil
+}
+
+func (t *Client) GetVolumeReplication() (map[torus.VolumeID]int, error) {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	out := make(map[torus.VolumeID]int)
+	for k, v := range t.srv.replication {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (t *Client) SetVolumeReplication(vid torus.VolumeID, r int) error {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	if r == 0 {
+		delete(t.srv.replication, vid)
+		return nil
+	}
+	t.srv.replication[vid] = r
+	return nil
+}
+
+func (t *Client) SetCordoned(uuid string, cordoned bool) error {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	has := t.srv.cordoned.Has(uuid)
+	switch {
+	case cordoned && !has:
+		t.srv.cordoned = append(t.srv.cordoned, uuid)
+	case !cordoned && has:
+		t.srv.cordoned = t.srv.cordoned.AndNot(torus.PeerList{uuid})
+	}
+	return nil
+}
+
 func (t *Client) NewVolumeID() (torus.VolumeID, error) {
 	t.srv.mut.Lock()
 	defer t.srv.mut.Unlock()
@@ -144,6 +213,49 @@ func (t *Client) CreateVolume(volume *models.Volume) error {
 	return nil
 }
 
+// IndexVolume lists an existing volume under its name again, as
+// CreateVolume does, but keeping its INode index. The data lock must be
+// held.
+func (t *Client) IndexVolume(volume *models.Volume) {
+	t.srv.volIndex[volume.Name] = volume
+}
+
+// RenameVolume lists an existing volume under the name to in place of the
+// name from. The data lock must be held.
+func (t *Client) RenameVolume(from, to string) error {
+	vol, ok := t.srv.volIndex[from]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	if _, ok := t.srv.volIndex[to]; ok {
+		return torus.ErrExists
+	}
+	renamed := *vol
+	renamed.Name = to
+	delete(t.srv.volIndex, from)
+	t.srv.volIndex[to] = &renamed
+	return nil
+}
+
+// UpdateVolume atomically replaces the record of an existing volume with a
+// copy changed by fn. If fn fails, the record is left alone.
+func (t *Client) UpdateVolume(volume string, fn func(v *models.Volume) error) error {
+	t.srv.mut.Lock()
+	defer t.srv.mut.Unlock()
+	vol, ok := t.srv.volIndex[volume]
+	if !ok {
+		return torus.ErrNotExist
+	}
+	// Records are shared with whoever has looked them up, so change a
+	// copy.
+	updated := *vol
+	if err := fn(&updated); err != nil {
+		return err
+	}
+	t.srv.volIndex[volume] = &updated
+	return nil
+}
+
 func (t *Client) GetVolume(volume string) (*models.Volume, error) {
 	t.srv.mut.Lock()
 	defer t.srv.mut.Unlock()
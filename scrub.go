@@ -0,0 +1,71 @@
+package torus
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultScrubInterval is the time torusd leaves from the end of one
+	// scrub of a node's blocks to the start of the next.
+	DefaultScrubInterval = 24 * time.Hour
+	// DefaultScrubRate is how many blocks a second the scrubber reads.
+	DefaultScrubRate = 20
+)
+
+// ScrubStatus reports what a node's scrubber has found in the blocks it
+// stores.
+type ScrubStatus struct {
+	// Start and Finish bound the latest pass over the node's blocks.
+	// Finish is zero while a pass is running.
+	Start  time.Time
+	Finish time.Time
+	// Checked, Corrupt and Repaired count the blocks checked against
+	// their checksums in the latest pass, those which failed, and those
+	// rewritten from a healthy replica.
+	Checked  int
+	Corrupt  int
+	Repaired int
+	// TotalCorrupt and TotalRepaired count the same since the node
+	// started.
+	TotalCorrupt  int
+	TotalRepaired int
+}
+
+// Scrubber is implemented by block stores which check the blocks they hold
+// in the background, such as the distributor.
+type Scrubber interface {
+	ScrubStatus() ScrubStatus
+}
+
+// BlockCheckFunc calls fn with every block of the volumes of some type, and
+// a check the block's data must pass, as its checksum layer would check it.
+// Blocks without checksums are left out. It stops at the first error from fn.
+type BlockCheckFunc func(ctx context.Context, srv *Server, fn func(ref BlockRef, check func(data []byte) bool) error) error
+
+var blockChecks map[string]BlockCheckFunc
+
+// RegisterBlockChecks is the hook used by volume types to tell the scrubber
+// what their blocks should hold.
+func RegisterBlockChecks(name string, f BlockCheckFunc) {
+	if blockChecks == nil {
+		blockChecks = make(map[string]BlockCheckFunc)
+	}
+	if _, ok := blockChecks[name]; ok {
+		panic("torus: attempted to register block checks " + name + " twice")
+	}
+	blockChecks[name] = f
+}
+
+// WalkBlockChecks calls fn with every block in the cluster which has a
+// checksum, and its check, as the registered BlockCheckFuncs find them. A
+// block shared between volumes or snapshots may be given more than once.
+func WalkBlockChecks(ctx context.Context, srv *Server, fn func(ref BlockRef, check func(data []byte) bool) error) error {
+	for _, f := range blockChecks {
+		if err := f(ctx, srv, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -24,6 +24,8 @@ func init() {
 const (
 	CtxWriteLevel int = iota
 	CtxReadLevel
+	CtxUnwrittenReads
+	CtxBlockCheck
 )
 
 // Server is the type representing the generic distributed block store.
@@ -35,11 +37,20 @@ type Server struct {
 	MDS           MetadataService
 	INodes        *INodeStore
 	peersMap      map[string]*models.PeerInfo
+	cordoned      PeerList
+	topology      map[string]Topology
+	replication   map[VolumeID]int
 	closeChans    []chan interface{}
 	Cfg           Config
+	Jobs          *JobScheduler
 	peerInfo      *models.PeerInfo
 	ctx           context.Context
 
+	// writeBehindMemory and readAheadMemory charge the blocks files
+	// queue to be stored and fetch ahead of reads to Cfg.Memory.
+	writeBehindMemory *MemoryAccount
+	readAheadMemory   *MemoryAccount
+
 	lease            int64
 	heartbeating     bool
 	ReplicationOpen  bool
@@ -51,6 +62,7 @@ func (s *Server) Lease() int64 {
 }
 
 func (s *Server) Close() error {
+	s.Jobs.Close()
 	for _, c := range s.closeChans {
 		close(c)
 	}
@@ -94,6 +106,41 @@ func (s *Server) ExtendContext(ctx context.Context) context.Context {
 	return rl
 }
 
+// readContext returns the context for reading file data, which also carries
+// the server's UnwrittenReads policy. Writes which fill in part of a block
+// must always see zeros where nothing was written, so it isn't part of the
+// server's context.
+func (s *Server) readContext() context.Context {
+	ctx := s.getContext()
+	if s.Cfg.UnwrittenReads == UnwrittenReadZeros {
+		return ctx
+	}
+	return context.WithValue(ctx, CtxUnwrittenReads, s.Cfg.UnwrittenReads)
+}
+
+// Cordoned returns the peers which were cordoned as of the last heartbeat.
+func (s *Server) Cordoned() PeerList {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.cordoned
+}
+
+// PeerTopology returns where each peer sits in the network, as of the last
+// heartbeat.
+func (s *Server) PeerTopology() map[string]Topology {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.topology
+}
+
+// VolumeReplication returns the replication factor of a volume's blocks, as
+// of the last heartbeat, or zero if they're replicated as the ring says.
+func (s *Server) VolumeReplication(vid VolumeID) int {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.replication[vid]
+}
+
 func (s *Server) GetPeerMap() map[string]*models.PeerInfo {
 	s.infoMut.Lock()
 	defer s.infoMut.Unlock()
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -169,7 +170,56 @@ func (b BlockRef) HasINode(i INodeRef, t BlockType) bool {
 }
 
 func (b BlockRef) BlockType() BlockType {
-	return BlockType((b.volume &^ VolumeMax) >> 40)
+	return BlockType(b.typeBits() & blockTypeMask)
+}
+
+// typeBits are the 24 bits above the volume ID, which hold the BlockType and
+// shard placement.
+func (b BlockRef) typeBits() uint64 {
+	return uint64(b.volume&^VolumeMax) >> 40
+}
+
+// The shards of an erasure coded stripe are each stored once, rather than
+// replicated, and should sit on different peers. Above the BlockType, the ref
+// of a shard records that it is one, its position in its stripe and a key
+// shared by the shards of the stripe, which they're placed by.
+const (
+	blockTypeMask = 0xF
+	shardFlag     = 1 << 4
+	shardPosShift = 5
+	shardPosBits  = 5
+	shardKeyShift = shardPosShift + shardPosBits
+	shardKeyMask  = 1<<(24-shardKeyShift) - 1
+
+	// MaxShards is the most shards an erasure coded stripe can have.
+	MaxShards = 1 << shardPosBits
+)
+
+// SetShard marks b as the shard at pos in the erasure coded stripe whose
+// shards share key. Only the low bits of key are kept.
+func (b *BlockRef) SetShard(key uint64, pos int) {
+	bits := shardFlag | uint64(pos)<<shardPosShift | (key&shardKeyMask)<<shardKeyShift
+	b.volume = VolumeID(uint64(b.volume) | bits<<40)
+}
+
+// Shard returns the key and position b was given by SetShard. ok is false if
+// b isn't an erasure coded shard.
+func (b BlockRef) Shard() (key uint64, pos int, ok bool) {
+	t := b.typeBits()
+	if t&shardFlag == 0 {
+		return 0, 0, false
+	}
+	return t >> shardKeyShift, int(t>>shardPosShift) & (MaxShards - 1), true
+}
+
+// StripeRef returns the ref the ring places the stripe of the shard b by.
+// Every shard of the stripe has the same one.
+func (b BlockRef) StripeRef() BlockRef {
+	key, _, _ := b.Shard()
+	return BlockRef{
+		INodeRef: INodeRef{volume: b.Volume() | shardFlag<<40},
+		Index:    IndexID(key),
+	}
 }
 
 func (b *BlockRef) SetBlockType(t BlockType) {
@@ -218,6 +268,125 @@ const (
 	ReadSpread
 )
 
+// UnwrittenReadPolicy says what reading data which was never written returns:
+// the holes left by extending a file or volume, data that was trimmed, and
+// blocks released by compaction because they held only zeros.
+type UnwrittenReadPolicy int
+
+const (
+	// UnwrittenReadZeros returns zeros, as a sparse file does.
+	UnwrittenReadZeros UnwrittenReadPolicy = iota
+	// UnwrittenReadError fails the read with ErrUnwritten, for
+	// applications which should never read data before writing it.
+	UnwrittenReadError
+)
+
+func ParseUnwrittenReadPolicy(s string) (UnwrittenReadPolicy, error) {
+	switch s {
+	case "zeros":
+		return UnwrittenReadZeros, nil
+	case "error":
+		return UnwrittenReadError, nil
+	}
+	return UnwrittenReadZeros, errors.New("invalid unwritten read policy; use one of 'zeros' or 'error'")
+}
+
+// StorageIOMode is how the file block store reads and writes its data file.
+// The best choice depends on the disk: the page cache helps HDDs, while fast
+// SSDs and cloud disks often do better without it.
+type StorageIOMode int
+
+const (
+	// StorageIOMmap maps the data file into memory, and writes it back
+	// asynchronously when flushed.
+	StorageIOMmap StorageIOMode = iota
+	// StorageIODirect reads and writes the data file with O_DIRECT,
+	// bypassing the page cache, and syncs it when flushed. The block size
+	// must be a multiple of 4KiB.
+	StorageIODirect
+	// StorageIOBuffered reads and writes the data file through the page
+	// cache, and syncs it every StorageSyncInterval, so that a crash may
+	// lose the blocks written since.
+	StorageIOBuffered
+)
+
+// DefaultStorageSyncInterval is how often buffered block stores sync their
+// data to disk.
+const DefaultStorageSyncInterval = 5 * time.Second
+
+func ParseStorageIOMode(s string) (StorageIOMode, error) {
+	switch s {
+	case "mmap":
+		return StorageIOMmap, nil
+	case "direct":
+		return StorageIODirect, nil
+	case "buffered":
+		return StorageIOBuffered, nil
+	}
+	return StorageIOMmap, errors.New("invalid storage IO mode; use one of 'mmap', 'direct' or 'buffered'")
+}
+
+func (m StorageIOMode) String() string {
+	switch m {
+	case StorageIODirect:
+		return "direct"
+	case StorageIOBuffered:
+		return "buffered"
+	}
+	return "mmap"
+}
+
+// TierPolicy says how the "tiered" block store shares blocks between its fast
+// and slow tiers.
+type TierPolicy int
+
+const (
+	// TierMove keeps each block on one tier, moving hot blocks to the fast
+	// tier and cold ones back, so the node's capacity is the sum of both.
+	TierMove TierPolicy = iota
+	// TierWriteThrough keeps copies of the hot blocks on the fast tier,
+	// which doesn't add to the capacity, and writes blocks to the slow tier
+	// before the write returns.
+	TierWriteThrough
+	// TierWriteBack is like TierWriteThrough, but writes new blocks to the
+	// fast tier only, and copies them to the slow tier in the background.
+	TierWriteBack
+)
+
+func ParseTierPolicy(s string) (TierPolicy, error) {
+	switch s {
+	case "move":
+		return TierMove, nil
+	case "write-through":
+		return TierWriteThrough, nil
+	case "write-back":
+		return TierWriteBack, nil
+	}
+	return TierMove, errors.New("invalid tier policy; use one of 'move', 'write-through' or 'write-back'")
+}
+
+// UnwrittenReadsFail returns whether reads of unwritten data under ctx must
+// fail with ErrUnwritten rather than return zeros.
+func UnwrittenReadsFail(ctx context.Context) bool {
+	p, ok := ctx.Value(CtxUnwrittenReads).(UnwrittenReadPolicy)
+	return ok && p == UnwrittenReadError
+}
+
+// WithBlockCheck returns a context under which block stores which can read a
+// block from more than one place, such as the distributor reading from
+// replicas, only accept data which passes check, and try elsewhere when it
+// doesn't. A nil check removes any check set further up.
+func WithBlockCheck(ctx context.Context, check func(data []byte) bool) context.Context {
+	return context.WithValue(ctx, CtxBlockCheck, check)
+}
+
+// CheckBlock reports whether data, read for a block under ctx, passes the
+// context's block check. Data always passes when there's no check.
+func CheckBlock(ctx context.Context, data []byte) bool {
+	check, ok := ctx.Value(CtxBlockCheck).(func([]byte) bool)
+	return !ok || check == nil || check(data)
+}
+
 // BlockStore is the interface representing the standardized methods to
 // interact with something storing blocks.
 type BlockStore interface {
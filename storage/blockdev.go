@@ -0,0 +1,503 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+var _ torus.BlockStore = &blockDevice{}
+
+func init() {
+	torus.RegisterBlockStore("blockdev", newBlockDeviceStore)
+}
+
+// A block device store lays out the whole device itself, with no filesystem
+// underneath:
+//
+//	superblock | allocation bitmap | block refs | blocks
+//
+// The superblock records the layout, the bitmap which slots hold a block, and
+// the refs which block each holds. Each region starts on a blockDevAlign
+// boundary.
+const (
+	blockDevMagic   = "TORUSBDV"
+	blockDevVersion = 1
+	blockDevAlign   = 4096
+	// superblockSize is the length of the encoded superblock, which sits
+	// alone in the first blockDevAlign bytes.
+	superblockSize = 60
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type superblock struct {
+	blockSize    uint64
+	nBlocks      uint64
+	bitmapOffset uint64
+	refOffset    uint64
+	dataOffset   uint64
+}
+
+func alignUp(n uint64) uint64 {
+	return (n + blockDevAlign - 1) / blockDevAlign * blockDevAlign
+}
+
+// layoutSuperblock fits as many blocks as it can into size bytes.
+func layoutSuperblock(size, blockSize uint64) (superblock, error) {
+	sb := superblock{
+		blockSize:    blockSize,
+		bitmapOffset: blockDevAlign,
+	}
+	if size <= blockDevAlign {
+		return sb, errors.New("blockdev: device too small")
+	}
+	// Each block takes up its own size, its ref and a bit of the bitmap;
+	// start from that and back off until the alignment fits too.
+	n := (size - blockDevAlign) * 8 / (blockSize*8 + torus.BlockRefByteSize*8 + 1)
+	for ; n > 0; n-- {
+		sb.nBlocks = n
+		sb.refOffset = sb.bitmapOffset + alignUp((n+7)/8)
+		sb.dataOffset = sb.refOffset + alignUp(n*torus.BlockRefByteSize)
+		if sb.dataOffset+n*blockSize <= size {
+			return sb, nil
+		}
+	}
+	return sb, errors.New("blockdev: device too small for a single block")
+}
+
+func (sb superblock) marshal() []byte {
+	buf := make([]byte, blockDevAlign)
+	copy(buf, blockDevMagic)
+	binary.LittleEndian.PutUint32(buf[8:], blockDevVersion)
+	binary.LittleEndian.PutUint64(buf[16:], sb.blockSize)
+	binary.LittleEndian.PutUint64(buf[24:], sb.nBlocks)
+	binary.LittleEndian.PutUint64(buf[32:], sb.bitmapOffset)
+	binary.LittleEndian.PutUint64(buf[40:], sb.refOffset)
+	binary.LittleEndian.PutUint64(buf[48:], sb.dataOffset)
+	binary.LittleEndian.PutUint32(buf[56:], crc32.Checksum(buf[:56], castagnoli))
+	return buf
+}
+
+// errNoSuperblock is returned when a device hasn't been formatted for Torus.
+var errNoSuperblock = errors.New("blockdev: no superblock")
+
+func unmarshalSuperblock(buf []byte) (superblock, error) {
+	var sb superblock
+	if len(buf) < superblockSize || !bytes.Equal(buf[:8], []byte(blockDevMagic)) {
+		return sb, errNoSuperblock
+	}
+	if crc32.Checksum(buf[:56], castagnoli) != binary.LittleEndian.Uint32(buf[56:]) {
+		return sb, errors.New("blockdev: corrupt superblock")
+	}
+	if v := binary.LittleEndian.Uint32(buf[8:]); v != blockDevVersion {
+		return sb, fmt.Errorf("blockdev: unknown superblock version %d", v)
+	}
+	sb.blockSize = binary.LittleEndian.Uint64(buf[16:])
+	sb.nBlocks = binary.LittleEndian.Uint64(buf[24:])
+	sb.bitmapOffset = binary.LittleEndian.Uint64(buf[32:])
+	sb.refOffset = binary.LittleEndian.Uint64(buf[40:])
+	sb.dataOffset = binary.LittleEndian.Uint64(buf[48:])
+	return sb, nil
+}
+
+// blockDevice stores blocks on a raw disk or partition, avoiding the
+// overhead of a filesystem. Writes go through the kernel's buffer cache, and
+// Flush syncs them to the device.
+type blockDevice struct {
+	mut      sync.RWMutex
+	f        *os.File
+	path     string
+	name     string
+	sb       superblock
+	bitmap   []byte
+	refIndex map[torus.BlockRef]uint64
+	lastFree uint64
+	closed   bool
+
+	// dirty holds the buffers handed out by WriteBuf, which their callers
+	// fill afterwards, by slot; they're written to the device when
+	// flushed. fresh holds those handed out since the last flush, which may
+	// still have been being filled then, so they're written again at the
+	// next.
+	dirty map[uint64][]byte
+	fresh map[uint64]bool
+}
+
+func newBlockDeviceStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	if cfg.BlockDevice == "" {
+		return nil, torus.ErrInvalid
+	}
+	b, err := openBlockDevice(name, cfg.BlockDevice, cfg.StorageSize, meta.BlockSize, cfg.FormatBlockDevice)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Journal {
+		return b, nil
+	}
+	j, err := openJournaledStore(name, b, journalPath(cfg, name))
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// openBlockDevice opens the Torus store on the device at path. A device
+// without one is formatted, using up to size bytes of it (all of it if size is
+// zero), only if format is set.
+func openBlockDevice(name, path string, size, blockSize uint64, format bool) (*blockDevice, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	b := &blockDevice{
+		f:        f,
+		path:     path,
+		name:     name,
+		refIndex: make(map[torus.BlockRef]uint64),
+		dirty:    make(map[uint64][]byte),
+		fresh:    make(map[uint64]bool),
+	}
+	buf := make([]byte, blockDevAlign)
+	_, err = f.ReadAt(buf, 0)
+	if err == nil {
+		b.sb, err = unmarshalSuperblock(buf)
+	}
+	if err == errNoSuperblock {
+		if !format {
+			f.Close()
+			return nil, fmt.Errorf("blockdev: %s isn't formatted for Torus; format it to use it, which destroys what's on it", path)
+		}
+		err = b.format(size, blockSize)
+	} else if err == nil {
+		err = b.load()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if b.sb.blockSize != blockSize {
+		f.Close()
+		return nil, fmt.Errorf("blockdev: %s holds blocks of %d bytes, not %d", path, b.sb.blockSize, blockSize)
+	}
+	promBytesPerBlock.Set(float64(blockSize))
+	promBlocksAvail.WithLabelValues(name).Set(float64(b.sb.nBlocks))
+	promBlocks.WithLabelValues(name).Set(float64(len(b.refIndex)))
+	return b, nil
+}
+
+func (b *blockDevice) format(size, blockSize uint64) error {
+	clog.Infof("formatting %s for block storage", b.path)
+	end, err := b.f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if size == 0 || size > uint64(end) {
+		size = uint64(end)
+	}
+	b.sb, err = layoutSuperblock(size, blockSize)
+	if err != nil {
+		return err
+	}
+	// Clear the bitmap, and the old superblock with it, before writing
+	// the new one, so that a format cut short leaves nothing that looks
+	// valid.
+	b.bitmap = make([]byte, b.sb.refOffset-b.sb.bitmapOffset)
+	if _, err := b.f.WriteAt(make([]byte, blockDevAlign), 0); err != nil {
+		return err
+	}
+	if _, err := b.f.WriteAt(b.bitmap, int64(b.sb.bitmapOffset)); err != nil {
+		return err
+	}
+	if err := b.f.Sync(); err != nil {
+		return err
+	}
+	if _, err := b.f.WriteAt(b.sb.marshal(), 0); err != nil {
+		return err
+	}
+	return b.f.Sync()
+}
+
+func (b *blockDevice) load() error {
+	clog.Infof("loading block index from %s...", b.path)
+	b.bitmap = make([]byte, b.sb.refOffset-b.sb.bitmapOffset)
+	if _, err := b.f.ReadAt(b.bitmap, int64(b.sb.bitmapOffset)); err != nil {
+		return err
+	}
+	refs := make([]byte, b.sb.nBlocks*torus.BlockRefByteSize)
+	if _, err := b.f.ReadAt(refs, int64(b.sb.refOffset)); err != nil {
+		return err
+	}
+	for i := uint64(0); i < b.sb.nBlocks; i++ {
+		if !b.allocated(i) {
+			continue
+		}
+		ref := torus.BlockRefFromBytes(refs[i*torus.BlockRefByteSize : (i+1)*torus.BlockRefByteSize])
+		b.refIndex[ref] = i
+	}
+	clog.Infof("done loading block index")
+	return nil
+}
+
+func (b *blockDevice) allocated(i uint64) bool {
+	return b.bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// setAllocated marks slot i used or free, on the device as well.
+func (b *blockDevice) setAllocated(i uint64, used bool) error {
+	if used {
+		b.bitmap[i/8] |= 1 << (i % 8)
+	} else {
+		b.bitmap[i/8] &^= 1 << (i % 8)
+	}
+	_, err := b.f.WriteAt(b.bitmap[i/8:i/8+1], int64(b.sb.bitmapOffset+i/8))
+	return err
+}
+
+func (b *blockDevice) dataOffset(i uint64) int64 {
+	return int64(b.sb.dataOffset + i*b.sb.blockSize)
+}
+
+func (b *blockDevice) findEmpty() (uint64, bool) {
+	n := b.sb.nBlocks
+	for j := uint64(0); j < n; j++ {
+		i := (b.lastFree + 1 + j) % n
+		if !b.allocated(i) {
+			b.lastFree = i
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// allocate takes a free slot for s, recording its ref. The block's data must
+// be written to the slot first, or handed out to be.
+func (b *blockDevice) allocate(i uint64, s torus.BlockRef) error {
+	_, err := b.f.WriteAt(s.ToBytes(), int64(b.sb.refOffset+i*torus.BlockRefByteSize))
+	if err != nil {
+		return err
+	}
+	if err := b.setAllocated(i, true); err != nil {
+		return err
+	}
+	b.refIndex[s] = i
+	promBlocks.WithLabelValues(b.name).Inc()
+	promBlocksWritten.WithLabelValues(b.name).Inc()
+	return nil
+}
+
+func (b *blockDevice) Kind() string { return "blockdev" }
+
+func (b *blockDevice) NumBlocks() uint64 { return b.sb.nBlocks }
+
+func (b *blockDevice) BlockSize() uint64 { return b.sb.blockSize }
+
+func (b *blockDevice) UsedBlocks() uint64 {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	return uint64(len(b.refIndex))
+}
+
+func (b *blockDevice) Flush() error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *blockDevice) sync() error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		return torus.ErrClosed
+	}
+	return b.flush()
+}
+
+func (b *blockDevice) flush() error {
+	for i, buf := range b.dirty {
+		if _, err := b.f.WriteAt(buf, b.dataOffset(i)); err != nil {
+			return err
+		}
+		if b.fresh[i] {
+			delete(b.fresh, i)
+		} else {
+			delete(b.dirty, i)
+		}
+	}
+	if err := b.f.Sync(); err != nil {
+		return err
+	}
+	promStorageFlushes.WithLabelValues(b.name).Inc()
+	return nil
+}
+
+func (b *blockDevice) Close() error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		return nil
+	}
+	// Whatever has been handed out is complete by now.
+	b.fresh = make(map[uint64]bool)
+	err := b.flush()
+	if err != nil {
+		return err
+	}
+	b.closed = true
+	return b.f.Close()
+}
+
+func (b *blockDevice) HasBlock(_ context.Context, s torus.BlockRef) (bool, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	_, ok := b.refIndex[s]
+	return ok, nil
+}
+
+func (b *blockDevice) GetBlock(_ context.Context, s torus.BlockRef) ([]byte, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	if b.closed {
+		promBlocksFailed.WithLabelValues(b.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	i, ok := b.refIndex[s]
+	if !ok {
+		promBlocksFailed.WithLabelValues(b.name).Inc()
+		return nil, torus.ErrBlockNotExist
+	}
+	if buf, ok := b.dirty[i]; ok {
+		promBlocksRetrieved.WithLabelValues(b.name).Inc()
+		return buf, nil
+	}
+	buf := make([]byte, b.sb.blockSize)
+	if _, err := b.f.ReadAt(buf, b.dataOffset(i)); err != nil {
+		promBlocksFailed.WithLabelValues(b.name).Inc()
+		return nil, err
+	}
+	promBlocksRetrieved.WithLabelValues(b.name).Inc()
+	return buf, nil
+}
+
+func (b *blockDevice) WriteBlock(_ context.Context, s torus.BlockRef, data []byte) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return torus.ErrClosed
+	}
+	if uint64(len(data)) > b.sb.blockSize {
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return errors.New("blockdev: data block too large")
+	}
+	if i, ok := b.refIndex[s]; ok {
+		old := b.dirty[i]
+		if old == nil {
+			old = make([]byte, b.sb.blockSize)
+			if _, err := b.f.ReadAt(old, b.dataOffset(i)); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(old[:len(data)], data) {
+			clog.Error("getting wrong data for block", s)
+			return torus.ErrExists
+		}
+		// Not an error, if we already have it
+		return nil
+	}
+	i, ok := b.findEmpty()
+	if !ok {
+		clog.Error("blockdev: out of space")
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return torus.ErrOutOfSpace
+	}
+	buf := data
+	if uint64(len(buf)) < b.sb.blockSize {
+		buf = make([]byte, b.sb.blockSize)
+		copy(buf, data)
+	}
+	if _, err := b.f.WriteAt(buf, b.dataOffset(i)); err != nil {
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return err
+	}
+	if err := b.allocate(i, s); err != nil {
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return err
+	}
+	return nil
+}
+
+func (b *blockDevice) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return nil, torus.ErrClosed
+	}
+	if _, ok := b.refIndex[s]; ok {
+		return nil, torus.ErrExists
+	}
+	i, ok := b.findEmpty()
+	if !ok {
+		clog.Error("blockdev: out of space")
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return nil, torus.ErrOutOfSpace
+	}
+	if err := b.allocate(i, s); err != nil {
+		promBlockWritesFailed.WithLabelValues(b.name).Inc()
+		return nil, err
+	}
+	buf := make([]byte, b.sb.blockSize)
+	b.dirty[i] = buf
+	b.fresh[i] = true
+	return buf, nil
+}
+
+func (b *blockDevice) DeleteBlock(_ context.Context, s torus.BlockRef) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		promBlockDeletesFailed.WithLabelValues(b.name).Inc()
+		return torus.ErrClosed
+	}
+	i, ok := b.refIndex[s]
+	if !ok {
+		promBlockDeletesFailed.WithLabelValues(b.name).Inc()
+		return torus.ErrBlockNotExist
+	}
+	if err := b.setAllocated(i, false); err != nil {
+		promBlockDeletesFailed.WithLabelValues(b.name).Inc()
+		return err
+	}
+	delete(b.refIndex, s)
+	delete(b.dirty, i)
+	delete(b.fresh, i)
+	promBlocks.WithLabelValues(b.name).Dec()
+	promBlocksDeleted.WithLabelValues(b.name).Inc()
+	return nil
+}
+
+func (b *blockDevice) BlockIterator() torus.BlockIterator {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+	l := make([]torus.BlockRef, 0, len(b.refIndex))
+	for k := range b.refIndex {
+		l = append(l, k)
+	}
+	return &mfileIterator{
+		set: l,
+		i:   -1,
+	}
+}
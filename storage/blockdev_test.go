@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+// newTestDevice makes a file standing in for a raw device of size bytes.
+func newTestDevice(t *testing.T, size int64) string {
+	f, err := ioutil.TempFile("", "torus-blockdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestBlockDeviceFormat(t *testing.T) {
+	path := newTestDevice(t, 1024*1024)
+	defer os.Remove(path)
+	if _, err := openBlockDevice("test", path, 0, 1024, false); err == nil {
+		t.Fatal("opened an unformatted device without formatting it")
+	}
+	b, err := openBlockDevice("test", path, 0, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	sb := b.sb
+	if sb.dataOffset+sb.nBlocks*sb.blockSize > 1024*1024 {
+		t.Fatalf("layout %+v overruns the device", sb)
+	}
+	// The bitmap and refs take a little under 32KiB.
+	if sb.nBlocks < 990 {
+		t.Fatalf("expected about 990 blocks, got %d", sb.nBlocks)
+	}
+}
+
+func TestBlockDeviceReopen(t *testing.T) {
+	path := newTestDevice(t, 256*1024)
+	defer os.Remove(path)
+	ctx := context.TODO()
+	b, err := openBlockDevice("test", path, 0, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		if err := b.WriteBlock(ctx, testRef(i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := b.WriteBuf(ctx, testRef(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 11
+	if err := b.DeleteBlock(ctx, testRef(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = openBlockDevice("test", path, 0, 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.UsedBlocks() != 10 {
+		t.Fatalf("expected 10 blocks, got %d", b.UsedBlocks())
+	}
+	for i := 1; i <= 11; i++ {
+		data, err := b.GetBlock(ctx, testRef(i))
+		if i == 3 {
+			if err != torus.ErrBlockNotExist {
+				t.Errorf("deleted block 3 came back: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1024 || data[0] != byte(i) || !bytes.Equal(data[1:], make([]byte, 1023)) {
+			t.Errorf("block %d has the wrong contents", i)
+		}
+	}
+	if _, err := openBlockDevice("other", path, 0, 512, false); err == nil {
+		t.Error("opened a device with the wrong block size")
+	}
+}
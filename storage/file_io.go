@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/coreos/torus"
+)
+
+// blockFile is a file of fixed-size blocks, read and written in one of the
+// torus.StorageIOMode ways. Every mode lays the blocks out the same way, so
+// the mode of an existing file can be changed.
+type blockFile interface {
+	NumBlocks() uint64
+	// ReadBlock returns the n-th block, including any trailing zero
+	// padding.
+	ReadBlock(n uint64) ([]byte, error)
+	// WriteBlock writes data to the n-th block, padding it with zeros.
+	WriteBlock(n uint64, data []byte) error
+	// WriteBuf returns a buffer for the n-th block, which the caller fills
+	// afterwards; it's stored once flushed.
+	WriteBuf(n uint64) ([]byte, error)
+	Flush() error
+	// Sync is like Flush, but waits for the blocks to reach the disk.
+	Sync() error
+	Close() error
+}
+
+// directAlign is the alignment O_DIRECT needs of offsets, lengths and buffers.
+const directAlign = 4096
+
+// openBlockFile opens the block file at path, creating it size bytes long if
+// it doesn't exist.
+func openBlockFile(path string, size, blkSize uint64, mode torus.StorageIOMode, syncInterval time.Duration) (blockFile, error) {
+	if mode == torus.StorageIOMmap {
+		m, err := CreateOrOpenMFile(path, size, blkSize)
+		if err != nil {
+			return nil, err
+		}
+		return mmapBlockFile{m}, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err := CreateMFile(path, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return openOSBlockFile(path, blkSize, mode, syncInterval)
+}
+
+type mmapBlockFile struct {
+	*MFile
+}
+
+func (m mmapBlockFile) ReadBlock(n uint64) ([]byte, error) {
+	b := m.GetBlock(n)
+	if b == nil {
+		return nil, errors.New("Offset too large")
+	}
+	return b, nil
+}
+
+// WriteBuf returns the mapped block itself.
+func (m mmapBlockFile) WriteBuf(n uint64) ([]byte, error) {
+	return m.ReadBlock(n)
+}
+
+// osBlockFile reads and writes its file with pread and pwrite, with or
+// without O_DIRECT.
+type osBlockFile struct {
+	mut     sync.Mutex
+	f       *os.File
+	blkSize uint64
+	size    uint64
+	direct  bool
+
+	// pending holds the buffers handed out by WriteBuf, by block, until
+	// they're written. fresh holds those handed out since the last flush,
+	// which may still have been being filled then, so they're written
+	// again at the next.
+	pending map[uint64][]byte
+	fresh   map[uint64]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func openOSBlockFile(path string, blkSize uint64, mode torus.StorageIOMode, syncInterval time.Duration) (*osBlockFile, error) {
+	flags := os.O_RDWR
+	direct := mode == torus.StorageIODirect
+	if direct {
+		if blkSize%directAlign != 0 {
+			return nil, fmt.Errorf("direct IO needs a block size which is a multiple of %d, not %d", directAlign, blkSize)
+		}
+		flags |= syscall.O_DIRECT
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := uint64(st.Size())
+	if size%blkSize != 0 {
+		f.Close()
+		return nil, fmt.Errorf("File size is not a multiple of the block size: %d size, %d blksize", size, blkSize)
+	}
+	o := &osBlockFile{
+		f:       f,
+		blkSize: blkSize,
+		size:    size,
+		direct:  direct,
+		pending: make(map[uint64][]byte),
+		fresh:   make(map[uint64]bool),
+	}
+	if mode == torus.StorageIOBuffered {
+		if syncInterval <= 0 {
+			syncInterval = torus.DefaultStorageSyncInterval
+		}
+		o.stop = make(chan struct{})
+		o.wg.Add(1)
+		go o.syncEvery(syncInterval)
+	}
+	return o, nil
+}
+
+// newBuf returns a zeroed block buffer, aligned for O_DIRECT if need be.
+func (o *osBlockFile) newBuf() []byte {
+	if !o.direct {
+		return make([]byte, o.blkSize)
+	}
+	buf := make([]byte, o.blkSize+directAlign)
+	off := 0
+	if r := int(uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1)); r != 0 {
+		off = directAlign - r
+	}
+	return buf[off : off+int(o.blkSize) : off+int(o.blkSize)]
+}
+
+func (o *osBlockFile) NumBlocks() uint64 {
+	return o.size / o.blkSize
+}
+
+func (o *osBlockFile) offset(n uint64) (int64, error) {
+	if n >= o.NumBlocks() {
+		return 0, errors.New("Offset too large")
+	}
+	return int64(n * o.blkSize), nil
+}
+
+func (o *osBlockFile) ReadBlock(n uint64) ([]byte, error) {
+	off, err := o.offset(n)
+	if err != nil {
+		return nil, err
+	}
+	o.mut.Lock()
+	buf, ok := o.pending[n]
+	o.mut.Unlock()
+	if ok {
+		return buf, nil
+	}
+	buf = o.newBuf()
+	if _, err := o.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (o *osBlockFile) WriteBlock(n uint64, data []byte) error {
+	if uint64(len(data)) > o.blkSize {
+		return errors.New("Data block too large")
+	}
+	off, err := o.offset(n)
+	if err != nil {
+		return err
+	}
+	o.mut.Lock()
+	delete(o.pending, n)
+	delete(o.fresh, n)
+	o.mut.Unlock()
+	buf := data
+	if o.direct || uint64(len(data)) < o.blkSize {
+		buf = o.newBuf()
+		copy(buf, data)
+	}
+	_, err = o.f.WriteAt(buf, off)
+	return err
+}
+
+func (o *osBlockFile) WriteBuf(n uint64) ([]byte, error) {
+	if _, err := o.offset(n); err != nil {
+		return nil, err
+	}
+	buf := o.newBuf()
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	o.pending[n] = buf
+	o.fresh[n] = true
+	return buf, nil
+}
+
+// writePending writes the buffers handed out by WriteBuf. Those handed out
+// since the last call are kept for the next unless all is set.
+func (o *osBlockFile) writePending(all bool) error {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	for n, buf := range o.pending {
+		if _, err := o.f.WriteAt(buf, int64(n*o.blkSize)); err != nil {
+			return err
+		}
+		if o.fresh[n] && !all {
+			delete(o.fresh, n)
+		} else {
+			delete(o.pending, n)
+			delete(o.fresh, n)
+		}
+	}
+	return nil
+}
+
+// Flush writes out the pending buffers, and syncs the file unless it's
+// buffered, which syncs on its own schedule.
+func (o *osBlockFile) Flush() error {
+	if err := o.writePending(false); err != nil {
+		return err
+	}
+	if o.stop != nil {
+		return nil
+	}
+	return o.f.Sync()
+}
+
+func (o *osBlockFile) Sync() error {
+	if err := o.writePending(false); err != nil {
+		return err
+	}
+	return o.f.Sync()
+}
+
+func (o *osBlockFile) syncEvery(interval time.Duration) {
+	defer o.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-t.C:
+			if err := o.f.Sync(); err != nil {
+				clog.Errorf("couldn't sync %s: %v", o.f.Name(), err)
+			}
+		}
+	}
+}
+
+func (o *osBlockFile) Close() error {
+	if o.stop != nil {
+		close(o.stop)
+		o.wg.Wait()
+	}
+	if err := o.writePending(true); err != nil {
+		return err
+	}
+	if err := o.f.Sync(); err != nil {
+		return err
+	}
+	return o.f.Close()
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/torus"
+)
+
+func testBlockFileMode(t *testing.T, mode torus.StorageIOMode) {
+	dir, err := ioutil.TempDir("", "torus-fileio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.blk")
+	f, err := openBlockFile(path, 16*4096, 4096, mode, time.Millisecond)
+	if err != nil {
+		if mode == torus.StorageIODirect {
+			// Not every filesystem, tmpfs among them, supports O_DIRECT.
+			t.Skipf("no direct IO here: %v", err)
+		}
+		t.Fatal(err)
+	}
+	if f.NumBlocks() != 16 {
+		t.Fatalf("expected 16 blocks, got %d", f.NumBlocks())
+	}
+	if err := f.WriteBlock(3, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := f.WriteBuf(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, "world")
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every mode reads what any other wrote.
+	f, err = openBlockFile(path, 16*4096, 4096, torus.StorageIOMmap, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for n, want := range map[uint64]string{3: "hello", 5: "world"} {
+		b, err := f.ReadBlock(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 4096 || string(b[:len(want)]) != want || !bytes.Equal(b[len(want):], make([]byte, 4096-len(want))) {
+			t.Errorf("block %d has the wrong contents", n)
+		}
+	}
+	if _, err := f.ReadBlock(16); err == nil {
+		t.Error("read past the end of the file")
+	}
+}
+
+func TestBlockFileBuffered(t *testing.T) {
+	testBlockFileMode(t, torus.StorageIOBuffered)
+}
+
+func TestBlockFileDirect(t *testing.T) {
+	testBlockFileMode(t, torus.StorageIODirect)
+}
@@ -0,0 +1,488 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promJournalCommits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_journal_commits",
+		Help: "Number of times the journal of a block store was synced and its changes applied",
+	}, []string{"storage"})
+	promJournalReplayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_journal_replayed",
+		Help: "Number of journal records replayed into a block store when it was opened",
+	}, []string{"storage"})
+)
+
+func init() {
+	prometheus.MustRegister(promJournalCommits)
+	prometheus.MustRegister(promJournalReplayed)
+}
+
+const (
+	// journalMaxPending is how many changes may wait in memory for the
+	// next flush before they're committed anyway.
+	journalMaxPending = 64
+	// journalCheckpointBlocks is how many blocks' worth of records the
+	// journal may hold before the store is synced and the journal emptied.
+	journalCheckpointBlocks = 256
+)
+
+type journalOp byte
+
+const (
+	journalWrite journalOp = iota + 1
+	journalDelete
+)
+
+// A journal record is a castagnoli crc32 of the rest of the record, the
+// length of the data, the op, the block ref and the data.
+const journalHeaderSize = 4 + 4 + 1 + torus.BlockRefByteSize
+
+// journal is an append-only file of the changes made to a block store.
+type journal struct {
+	f    *os.File
+	size int64
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f: f}, nil
+}
+
+// replay calls fn for each whole record in the journal, in order. A record
+// cut short or corrupted by a crash, or longer than maxLen, ends the journal.
+func (j *journal) replay(maxLen uint64, fn func(op journalOp, ref torus.BlockRef, data []byte) error) (int, error) {
+	if _, err := j.f.Seek(0, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(j.f)
+	hdr := make([]byte, journalHeaderSize)
+	n := 0
+	for {
+		if _, err := io.ReadFull(r, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		size := binary.LittleEndian.Uint32(hdr[4:])
+		if uint64(size) > maxLen {
+			clog.Warningf("discarding a corrupt record at the end of journal %s", j.f.Name())
+			return n, nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			clog.Warningf("discarding a record cut short at the end of journal %s", j.f.Name())
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		crc := crc32.Update(crc32.Checksum(hdr[4:], castagnoli), castagnoli, data)
+		if crc != binary.LittleEndian.Uint32(hdr) {
+			clog.Warningf("discarding a torn record at the end of journal %s", j.f.Name())
+			return n, nil
+		}
+		ref := torus.BlockRefFromBytes(hdr[9:])
+		if err := fn(journalOp(hdr[8]), ref, data); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func (j *journal) append(op journalOp, ref torus.BlockRef, data []byte) error {
+	buf := make([]byte, journalHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(data)))
+	buf[8] = byte(op)
+	ref.ToBytesBuf(buf[9:journalHeaderSize])
+	copy(buf[journalHeaderSize:], data)
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], castagnoli))
+	n, err := j.f.WriteAt(buf, j.size)
+	j.size += int64(n)
+	return err
+}
+
+func (j *journal) sync() error {
+	return j.f.Sync()
+}
+
+// reset empties the journal, once its changes are safely in the store.
+func (j *journal) reset() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	return j.f.Sync()
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
+
+// durableStore is a block store which can sync its changes to disk, and wait
+// for them to get there, which Flush may not.
+type durableStore interface {
+	torus.BlockStore
+	sync() error
+}
+
+var _ torus.BlockStore = &journaledStore{}
+
+// journaledStore puts a write-ahead journal in front of a block store, so
+// that a crash can't leave the store with torn blocks, or with refs for data
+// which never reached the disk.
+//
+// Changes are logged to the journal as they're made, but kept in memory, and
+// only made to the store once the journal has been synced, when the store is
+// flushed; so every change in the store which may not have reached the disk
+// is in the journal too, and is made again when the store is opened. The
+// journal is emptied once it grows large, after syncing the store.
+type journaledStore struct {
+	mut     sync.Mutex
+	name    string
+	store   durableStore
+	j       *journal
+	pending map[torus.BlockRef]*journalEntry
+	closed  bool
+}
+
+type journalEntry struct {
+	data    []byte
+	deleted bool
+	// logged is set once the change is in the journal for good, and may
+	// be made in the store.
+	logged bool
+	// fresh is set for a buffer handed out by WriteBuf since the last
+	// flush, which may still be being filled. Its contents so far are
+	// logged at each flush, and journaled set, but it's only logged for
+	// good by a flush which finds it no longer fresh.
+	fresh     bool
+	journaled bool
+}
+
+// journalPath is where the journal of the named store is kept.
+func journalPath(cfg torus.Config, name string) string {
+	return filepath.Join(cfg.DataDir, "block", fmt.Sprintf("journal-%s.wal", name))
+}
+
+// openJournaledStore replays the journal at path into store, and journals
+// the changes made to it from then on.
+func openJournaledStore(name string, store durableStore, path string) (*journaledStore, error) {
+	j, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.TODO()
+	n, err := j.replay(store.BlockSize(), func(op journalOp, ref torus.BlockRef, data []byte) error {
+		switch op {
+		case journalWrite:
+			// The block may be torn, so write it afresh.
+			if ok, _ := store.HasBlock(ctx, ref); ok {
+				if err := store.DeleteBlock(ctx, ref); err != nil {
+					return err
+				}
+			}
+			return store.WriteBlock(ctx, ref, data)
+		case journalDelete:
+			if ok, _ := store.HasBlock(ctx, ref); ok {
+				return store.DeleteBlock(ctx, ref)
+			}
+		}
+		return nil
+	})
+	if err == nil && n > 0 {
+		clog.Infof("replayed %d records from journal %s", n, path)
+		promJournalReplayed.WithLabelValues(name).Add(float64(n))
+		err = store.sync()
+	}
+	if err == nil {
+		err = j.reset()
+	}
+	if err != nil {
+		j.close()
+		return nil, err
+	}
+	return &journaledStore{
+		name:    name,
+		store:   store,
+		j:       j,
+		pending: make(map[torus.BlockRef]*journalEntry),
+	}, nil
+}
+
+func (s *journaledStore) Kind() string      { return s.store.Kind() }
+func (s *journaledStore) NumBlocks() uint64 { return s.store.NumBlocks() }
+func (s *journaledStore) BlockSize() uint64 { return s.store.BlockSize() }
+
+func (s *journaledStore) UsedBlocks() uint64 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.usedBlocks()
+}
+
+// usedBlocks counts the blocks the store will hold once the pending changes
+// are made. It must be called with the lock held.
+func (s *journaledStore) usedBlocks() uint64 {
+	ctx := context.TODO()
+	n := s.store.UsedBlocks()
+	for ref, e := range s.pending {
+		ok, _ := s.store.HasBlock(ctx, ref)
+		switch {
+		case e.deleted && ok:
+			n--
+		case !e.deleted && !ok:
+			n++
+		}
+	}
+	return n
+}
+
+// has reports whether a block is stored, or will be. It must be called with
+// the lock held.
+func (s *journaledStore) has(ctx context.Context, ref torus.BlockRef) bool {
+	if e, ok := s.pending[ref]; ok {
+		return !e.deleted
+	}
+	ok, _ := s.store.HasBlock(ctx, ref)
+	return ok
+}
+
+func (s *journaledStore) HasBlock(ctx context.Context, ref torus.BlockRef) (bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.has(ctx, ref), nil
+}
+
+func (s *journaledStore) GetBlock(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return nil, torus.ErrClosed
+	}
+	return s.getBlock(ctx, ref)
+}
+
+func (s *journaledStore) getBlock(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	if e, ok := s.pending[ref]; ok {
+		if e.deleted {
+			return nil, torus.ErrBlockNotExist
+		}
+		return e.data, nil
+	}
+	return s.store.GetBlock(ctx, ref)
+}
+
+func (s *journaledStore) WriteBlock(ctx context.Context, ref torus.BlockRef, data []byte) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return torus.ErrClosed
+	}
+	if uint64(len(data)) > s.store.BlockSize() {
+		return torus.ErrInvalid
+	}
+	if s.has(ctx, ref) {
+		old, err := s.getBlock(ctx, ref)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(old[:len(data)], data) {
+			clog.Error("getting wrong data for block", ref)
+			return torus.ErrExists
+		}
+		// Not an error, if we already have it
+		return nil
+	}
+	if s.usedBlocks() >= s.store.NumBlocks() {
+		return torus.ErrOutOfSpace
+	}
+	buf := make([]byte, s.store.BlockSize())
+	copy(buf, data)
+	if err := s.j.append(journalWrite, ref, buf); err != nil {
+		return err
+	}
+	s.pending[ref] = &journalEntry{data: buf, logged: true}
+	if len(s.pending) >= journalMaxPending {
+		return s.commit(false)
+	}
+	return nil
+}
+
+// WriteBuf hands out a buffer whose contents are logged at each flush, so
+// that a flushed write survives a crash, and which is made in the store once
+// it's surely filled, a flush later.
+func (s *journaledStore) WriteBuf(ctx context.Context, ref torus.BlockRef) ([]byte, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return nil, torus.ErrClosed
+	}
+	if s.has(ctx, ref) {
+		return nil, torus.ErrExists
+	}
+	if s.usedBlocks() >= s.store.NumBlocks() {
+		return nil, torus.ErrOutOfSpace
+	}
+	buf := make([]byte, s.store.BlockSize())
+	s.pending[ref] = &journalEntry{data: buf, fresh: true}
+	return buf, nil
+}
+
+func (s *journaledStore) DeleteBlock(ctx context.Context, ref torus.BlockRef) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return torus.ErrClosed
+	}
+	if !s.has(ctx, ref) {
+		return torus.ErrBlockNotExist
+	}
+	if err := s.j.append(journalDelete, ref, nil); err != nil {
+		return err
+	}
+	s.pending[ref] = &journalEntry{deleted: true, logged: true}
+	if len(s.pending) >= journalMaxPending {
+		return s.commit(false)
+	}
+	return nil
+}
+
+func (s *journaledStore) Flush() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return nil
+	}
+	return s.commit(true)
+}
+
+// commit syncs the journal, then makes the changes logged in it in the store.
+// When flushing, the buffers still being filled are logged as they stand,
+// and are logged again at the next flush. It must be called with the lock
+// held.
+func (s *journaledStore) commit(flushing bool) error {
+	for ref, e := range s.pending {
+		if e.logged || (e.fresh && !flushing) {
+			continue
+		}
+		if err := s.j.append(journalWrite, ref, e.data); err != nil {
+			return err
+		}
+		if e.fresh {
+			e.fresh = false
+			e.journaled = true
+			continue
+		}
+		e.logged = true
+	}
+	if err := s.j.sync(); err != nil {
+		return err
+	}
+	ctx := context.TODO()
+	for ref, e := range s.pending {
+		if !e.logged {
+			continue
+		}
+		// A block written again after being deleted replaces the old
+		// one, which may be torn.
+		if ok, _ := s.store.HasBlock(ctx, ref); ok {
+			if err := s.store.DeleteBlock(ctx, ref); err != nil {
+				return err
+			}
+		}
+		if !e.deleted {
+			if err := s.store.WriteBlock(ctx, ref, e.data); err != nil {
+				return err
+			}
+		}
+		delete(s.pending, ref)
+	}
+	if err := s.store.Flush(); err != nil {
+		return err
+	}
+	promJournalCommits.WithLabelValues(s.name).Inc()
+	if uint64(s.j.size) < journalCheckpointBlocks*s.store.BlockSize() {
+		return nil
+	}
+	if err := s.store.sync(); err != nil {
+		return err
+	}
+	if err := s.j.reset(); err != nil {
+		return err
+	}
+	// The buffers logged as they stood are still only in the journal.
+	for ref, e := range s.pending {
+		if e.journaled && !e.logged {
+			if err := s.j.append(journalWrite, ref, e.data); err != nil {
+				return err
+			}
+		}
+	}
+	return s.j.sync()
+}
+
+func (s *journaledStore) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return nil
+	}
+	// Whatever has been handed out is filled by now.
+	for _, e := range s.pending {
+		e.fresh = false
+	}
+	err := s.commit(false)
+	if err == nil {
+		err = s.store.sync()
+	}
+	if err == nil {
+		err = s.j.reset()
+	}
+	if err != nil {
+		return err
+	}
+	s.closed = true
+	if err := s.j.close(); err != nil {
+		return err
+	}
+	return s.store.Close()
+}
+
+func (s *journaledStore) BlockIterator() torus.BlockIterator {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	var set []torus.BlockRef
+	it := s.store.BlockIterator()
+	for it.Next() {
+		if _, ok := s.pending[it.BlockRef()]; !ok {
+			set = append(set, it.BlockRef())
+		}
+	}
+	it.Close()
+	for ref, e := range s.pending {
+		if !e.deleted {
+			set = append(set, ref)
+		}
+	}
+	return &mfileIterator{
+		set: set,
+		i:   -1,
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func newTestJournaledConfig(t *testing.T) torus.Config {
+	dir, err := ioutil.TempDir("", "torus-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torus.MkdirsFor(dir); err != nil {
+		t.Fatal(err)
+	}
+	return torus.Config{DataDir: dir, StorageSize: 16 * 1024, Journal: true}
+}
+
+func openTestJournaledStore(t *testing.T, cfg torus.Config) *journaledStore {
+	s, err := newMFileBlockStore("test", cfg, torus.GlobalMetadata{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*journaledStore)
+}
+
+func TestJournalReplay(t *testing.T) {
+	cfg := newTestJournaledConfig(t)
+	defer os.RemoveAll(cfg.DataDir)
+	ctx := context.TODO()
+	s := openTestJournaledStore(t, cfg)
+	if err := s.WriteBlock(ctx, testRef(1), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBlock(ctx, testRef(2), []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBlock(ctx, testRef(1)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.store.HasBlock(ctx, testRef(2)); ok {
+		t.Fatal("block 2 reached the store before the journal was synced")
+	}
+	if err := s.j.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash, leaving s as it is, and start again.
+	s = openTestJournaledStore(t, cfg)
+	if ok, _ := s.store.HasBlock(ctx, testRef(1)); ok {
+		t.Error("deleting block 1 wasn't replayed")
+	}
+	data, err := s.store.GetBlock(ctx, testRef(2))
+	if err != nil {
+		t.Fatalf("writing block 2 wasn't replayed: %v", err)
+	}
+	if data[0] != 2 {
+		t.Error("block 2 has the wrong contents")
+	}
+	if s.j.size != 0 {
+		t.Error("journal wasn't emptied after replaying it")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record torn by a crash is ignored.
+	f, err := os.OpenFile(filepath.Join(cfg.DataDir, "block", "journal-test.wal"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, journalHeaderSize+10))
+	f.Close()
+	s = openTestJournaledStore(t, cfg)
+	defer s.Close()
+	if s.UsedBlocks() != 1 {
+		t.Fatalf("expected 1 block stored, got %d", s.UsedBlocks())
+	}
+}
+
+func TestJournalWriteBuf(t *testing.T) {
+	cfg := newTestJournaledConfig(t)
+	defer os.RemoveAll(cfg.DataDir)
+	ctx := context.TODO()
+	s := openTestJournaledStore(t, cfg)
+	defer s.Close()
+	buf, err := s.WriteBuf(ctx, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 1
+	if _, err := s.WriteBuf(ctx, testRef(1)); err != torus.ErrExists {
+		t.Fatalf("expected ErrExists writing block 1 again, got %v", err)
+	}
+	s.Flush()
+	if ok, _ := s.store.HasBlock(ctx, testRef(1)); ok {
+		t.Fatal("block 1 reached the store before it was surely filled")
+	}
+	buf[1] = 1
+	s.Flush()
+	data, err := s.store.GetBlock(ctx, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 1 || data[1] != 1 {
+		t.Error("block 1 has the wrong contents")
+	}
+	if s.UsedBlocks() != 1 {
+		t.Fatalf("expected 1 block stored, got %d", s.UsedBlocks())
+	}
+}
+
+func TestJournalWriteBufCrash(t *testing.T) {
+	cfg := newTestJournaledConfig(t)
+	defer os.RemoveAll(cfg.DataDir)
+	ctx := context.TODO()
+	s := openTestJournaledStore(t, cfg)
+	buf, err := s.WriteBuf(ctx, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 1
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash once the write is flushed, as it's acknowledged then.
+	s = openTestJournaledStore(t, cfg)
+	defer s.Close()
+	data, err := s.store.GetBlock(ctx, testRef(1))
+	if err != nil {
+		t.Fatalf("flushed block 1 wasn't replayed: %v", err)
+	}
+	if data[0] != 1 {
+		t.Error("block 1 has the wrong contents")
+	}
+}
+
+func TestJournalReplayRejectsLongRecord(t *testing.T) {
+	cfg := newTestJournaledConfig(t)
+	defer os.RemoveAll(cfg.DataDir)
+	s := openTestJournaledStore(t, cfg)
+	if err := s.j.append(journalWrite, testRef(1), make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.j.sync(); err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	if _, err := s.j.replay(1024, func(journalOp, torus.BlockRef, []byte) error {
+		called = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Fatal("replayed a record longer than a block")
+	}
+}
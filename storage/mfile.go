@@ -22,7 +22,7 @@ func init() {
 
 type mfileBlock struct {
 	mut       sync.RWMutex
-	dataFile  *MFile
+	dataFile  blockFile
 	refFile   *MFile
 	refIndex  map[torus.BlockRef]int
 	closed    bool
@@ -64,12 +64,28 @@ func loadIndex(m *MFile) (map[torus.BlockRef]int, error) {
 }
 
 func newMFileBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	m, err := openMFileBlockStore(name, cfg, meta)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Journal {
+		return m, nil
+	}
+	j, err := openJournaledStore(name, m, journalPath(cfg, name))
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func openMFileBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (*mfileBlock, error) {
 	nBlocks := cfg.StorageSize / meta.BlockSize
 	promBytesPerBlock.Set(float64(meta.BlockSize))
 	promBlocksAvail.WithLabelValues(name).Set(float64(nBlocks))
 	dpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("data-%s.blk", name))
 	mpath := filepath.Join(cfg.DataDir, "block", fmt.Sprintf("map-%s.blk", name))
-	d, err := CreateOrOpenMFile(dpath, cfg.StorageSize, meta.BlockSize)
+	d, err := openBlockFile(dpath, cfg.StorageSize, meta.BlockSize, cfg.StorageIO, cfg.StorageSyncInterval)
 	if err != nil {
 		return nil, err
 	}
@@ -129,6 +145,19 @@ func (m *mfileBlock) Flush() error {
 	return nil
 }
 
+func (m *mfileBlock) sync() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return torus.ErrClosed
+	}
+	err := m.dataFile.Sync()
+	if err != nil {
+		return err
+	}
+	return m.refFile.Sync()
+}
+
 func (m *mfileBlock) Close() error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
@@ -197,8 +226,13 @@ func (m *mfileBlock) GetBlock(_ context.Context, s torus.BlockRef) ([]byte, erro
 		return nil, torus.ErrBlockNotExist
 	}
 	clog.Tracef("mfile: getting block at index %d", index)
+	data, err := m.dataFile.ReadBlock(uint64(index))
+	if err != nil {
+		promBlocksFailed.WithLabelValues(m.name).Inc()
+		return nil, err
+	}
 	promBlocksRetrieved.WithLabelValues(m.name).Inc()
-	return m.dataFile.GetBlock(uint64(index)), nil
+	return data, nil
 }
 
 func (m *mfileBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte) error {
@@ -228,7 +262,10 @@ func (m *mfileBlock) WriteBlock(_ context.Context, s torus.BlockRef, data []byte
 	if v := m.findIndex(s); v != -1 {
 		// we already have it
 		clog.Debug("mfile: block already exists", s)
-		olddata := m.dataFile.GetBlock(uint64(v))
+		olddata, err := m.dataFile.ReadBlock(uint64(v))
+		if err != nil {
+			return err
+		}
 		if !bytes.Equal(olddata, data) {
 			clog.Error("getting wrong data for block", s)
 			clog.Errorf("%s, %s", olddata[:10], data[:10])
@@ -257,8 +294,12 @@ func (m *mfileBlock) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte, erro
 		return nil, torus.ErrOutOfSpace
 	}
 	clog.Tracef("mfile: writing block at index %d", index)
-	buf := m.dataFile.GetBlock(uint64(index))
-	err := m.refFile.WriteBlock(uint64(index), s.ToBytes())
+	buf, err := m.dataFile.WriteBuf(uint64(index))
+	if err != nil {
+		promBlockWritesFailed.WithLabelValues(m.name).Inc()
+		return nil, err
+	}
+	err = m.refFile.WriteBlock(uint64(index), s.ToBytes())
 	if err != nil {
 		promBlockWritesFailed.WithLabelValues(m.name).Inc()
 		return nil, err
@@ -102,6 +102,11 @@ func (m *MFile) Flush() error {
 	return m.mmap.FlushAsync()
 }
 
+// Sync writes the file back, and waits for it to reach the disk.
+func (m *MFile) Sync() error {
+	return m.mmap.Flush()
+}
+
 func (m *MFile) Close() error {
 	if err := m.mmap.Flush(); err != nil {
 		return err
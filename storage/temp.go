@@ -20,6 +20,7 @@ type tempBlockStore struct {
 	nBlocks   uint64
 	name      string
 	blockSize uint64
+	memory    *torus.MemoryAccount
 }
 
 func openTempBlockStore(name string, cfg torus.Config, gmd torus.GlobalMetadata) (torus.BlockStore, error) {
@@ -32,6 +33,7 @@ func openTempBlockStore(name string, cfg torus.Config, gmd torus.GlobalMetadata)
 		nBlocks:   nBlocks,
 		name:      name,
 		blockSize: gmd.BlockSize,
+		memory:    cfg.Memory.Account("temp-blocks", nil),
 	}, nil
 }
 
@@ -43,6 +45,7 @@ func (t *tempBlockStore) Close() error {
 	t.mut.Lock()
 	defer t.mut.Unlock()
 	if t.store != nil {
+		t.memory.Release(uint64(len(t.store)) * t.blockSize)
 		t.store = nil
 	}
 	return nil
@@ -96,6 +99,9 @@ func (t *tempBlockStore) WriteBlock(_ context.Context, s torus.BlockRef, data []
 	if int(t.nBlocks) <= len(t.store) {
 		return torus.ErrOutOfSpace
 	}
+	if _, ok := t.store[s]; !ok {
+		t.memory.Charge(t.blockSize)
+	}
 	buf := make([]byte, len(data))
 	copy(buf, data)
 	t.store[s] = buf
@@ -115,6 +121,9 @@ func (t *tempBlockStore) WriteBuf(_ context.Context, s torus.BlockRef) ([]byte,
 	if int(t.nBlocks) <= len(t.store) {
 		return nil, torus.ErrOutOfSpace
 	}
+	if _, ok := t.store[s]; !ok {
+		t.memory.Charge(t.blockSize)
+	}
 	buf := make([]byte, t.blockSize)
 	t.store[s] = buf
 	promBlocks.WithLabelValues(t.name).Set(float64(len(t.store)))
@@ -131,6 +140,9 @@ func (t *tempBlockStore) DeleteBlock(_ context.Context, s torus.BlockRef) error
 		return torus.ErrClosed
 	}
 
+	if _, ok := t.store[s]; ok {
+		t.memory.Release(t.blockSize)
+	}
 	delete(t.store, s)
 	promBlocks.WithLabelValues(t.name).Set(float64(len(t.store)))
 	promBlocksDeleted.WithLabelValues(t.name).Inc()
@@ -0,0 +1,671 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promTierHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_tier_hits",
+		Help: "Number of blocks read from each storage tier",
+	}, []string{"storage", "tier"})
+	promTierPromotions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_tier_promotions",
+		Help: "Number of blocks moved or copied from the slow tier to the fast tier",
+	}, []string{"storage"})
+	promTierDemotions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_tier_demotions",
+		Help: "Number of blocks moved or evicted from the fast tier",
+	}, []string{"storage"})
+	promTierDestaged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "torus_storage_tier_destaged",
+		Help: "Number of blocks written back from the fast tier to the slow tier",
+	}, []string{"storage"})
+	promTierDirty = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "torus_storage_tier_dirty_blocks",
+		Help: "Number of blocks on the fast tier which aren't on the slow tier",
+	}, []string{"storage"})
+)
+
+const (
+	// DefaultTierPromoteReads is the number of reads from the slow tier
+	// after which a block is promoted.
+	DefaultTierPromoteReads = 2
+	// DefaultTierDemoteThreshold is the fraction of the fast tier which may
+	// be used before the least recently used blocks are demoted.
+	DefaultTierDemoteThreshold = 0.9
+)
+
+// tierDestageInterval is how often dirty blocks are written back to the slow
+// tier under torus.TierWriteBack.
+const tierDestageInterval = time.Second
+
+func init() {
+	prometheus.MustRegister(promTierHits)
+	prometheus.MustRegister(promTierPromotions)
+	prometheus.MustRegister(promTierDemotions)
+	prometheus.MustRegister(promTierDestaged)
+	prometheus.MustRegister(promTierDirty)
+	torus.RegisterBlockStore("tiered", newTieredBlockStore)
+}
+
+var _ torus.BlockStore = &tieredBlock{}
+
+// tieredBlock stores blocks in a small fast store (an SSD) in front of a
+// large slow one (HDDs, in an mfile store or on a block device). New blocks
+// and blocks read often enough from the slow tier go to the fast tier, and
+// the fast tier is kept below its threshold by demoting the least recently
+// used blocks.
+//
+// Under torus.TierMove every block lives in exactly one of the tiers. Under
+// torus.TierWriteThrough and torus.TierWriteBack the fast tier holds copies
+// of blocks on the slow tier instead, which are dropped when they're
+// demoted, and only blocks written under write-back which haven't been
+// destaged yet are on the fast tier alone. Either way those blocks only on
+// the fast tier are dirty, and demoting them writes them to the slow tier
+// first. The fast tier is persistent, so a block on it but not on the slow
+// tier when the store opens was dirty when it closed.
+type tieredBlock struct {
+	mut    sync.Mutex
+	name   string
+	fast   torus.BlockStore
+	slow   torus.BlockStore
+	policy torus.TierPolicy
+
+	promoteReads int
+	demoteAt     uint64
+
+	// lru orders the blocks on the fast tier, most recently used first.
+	lru     *list.List
+	inFast  map[torus.BlockRef]*list.Element
+	dirty   int
+	reads   map[torus.BlockRef]int
+	closed  bool
+	maxRead int
+
+	// The lock only covers the bookkeeping; the tiers are read and written
+	// without it. busy holds the blocks with an operation in flight, each
+	// with a channel closed when it's done, and nothing else touches them
+	// in the meantime. reserved counts the slots on the fast tier taken by
+	// blocks being written there, and demoting the blocks on their way off
+	// it.
+	busy     map[torus.BlockRef]chan struct{}
+	reserved int
+	demoting int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type tierEntry struct {
+	ref   torus.BlockRef
+	dirty bool
+	// fresh counts the flushes before a buffer handed out by WriteBuf is
+	// surely filled, and may be demoted or destaged.
+	fresh int
+}
+
+func newTieredBlockStore(name string, cfg torus.Config, meta torus.GlobalMetadata) (torus.BlockStore, error) {
+	if cfg.FastDataDir == "" || cfg.FastStorageSize == 0 {
+		return nil, torus.ErrInvalid
+	}
+	fastCfg := cfg
+	fastCfg.DataDir = cfg.FastDataDir
+	fastCfg.StorageSize = cfg.FastStorageSize
+	fast, err := newMFileBlockStore(name+"-fast", fastCfg, meta)
+	if err != nil {
+		return nil, err
+	}
+	var slow torus.BlockStore
+	if cfg.BlockDevice != "" {
+		slow, err = newBlockDeviceStore(name, cfg, meta)
+	} else {
+		slow, err = newMFileBlockStore(name, cfg, meta)
+	}
+	if err != nil {
+		fast.Close()
+		return nil, err
+	}
+	var interval time.Duration
+	if cfg.TierPolicy == torus.TierWriteBack {
+		interval = tierDestageInterval
+	}
+	return newTieredStore(name, fast, slow, cfg.TierPolicy, cfg.TierPromoteReads, cfg.TierDemoteThreshold, interval), nil
+}
+
+// newTieredStore layers fast over slow. Under write-back, dirty blocks are
+// destaged every interval, or only when demoted if it's zero.
+func newTieredStore(name string, fast, slow torus.BlockStore, policy torus.TierPolicy, promoteReads int, demoteThreshold float64, interval time.Duration) *tieredBlock {
+	if promoteReads <= 0 {
+		promoteReads = DefaultTierPromoteReads
+	}
+	if demoteThreshold <= 0 || demoteThreshold > 1 {
+		demoteThreshold = DefaultTierDemoteThreshold
+	}
+	t := &tieredBlock{
+		name:         name,
+		fast:         fast,
+		slow:         slow,
+		policy:       policy,
+		promoteReads: promoteReads,
+		demoteAt:     uint64(float64(fast.NumBlocks()) * demoteThreshold),
+		lru:          list.New(),
+		inFast:       make(map[torus.BlockRef]*list.Element),
+		reads:        make(map[torus.BlockRef]int),
+		busy:         make(map[torus.BlockRef]chan struct{}),
+		maxRead:      int(fast.NumBlocks()) * 4,
+	}
+	// We don't know how recently the blocks already on the fast tier were
+	// used, so they start out in whatever order they're found.
+	ctx := context.TODO()
+	it := fast.BlockIterator()
+	for it.Next() {
+		e := &tierEntry{ref: it.BlockRef()}
+		if ok, _ := slow.HasBlock(ctx, e.ref); !ok {
+			e.dirty = true
+			t.dirty++
+		}
+		t.inFast[e.ref] = t.lru.PushBack(e)
+	}
+	it.Close()
+	promTierDirty.WithLabelValues(name).Set(float64(t.dirty))
+	if policy == torus.TierWriteBack && interval > 0 {
+		t.stop = make(chan struct{})
+		t.wg.Add(1)
+		go t.destageEvery(interval)
+	}
+	return t
+}
+
+func (t *tieredBlock) Kind() string { return "tiered" }
+
+// caching reports whether the fast tier holds copies of the slow tier's
+// blocks, rather than blocks of its own.
+func (t *tieredBlock) caching() bool {
+	return t.policy != torus.TierMove
+}
+
+func (t *tieredBlock) NumBlocks() uint64 {
+	if t.caching() {
+		return t.slow.NumBlocks()
+	}
+	return t.fast.NumBlocks() + t.slow.NumBlocks()
+}
+
+// UsedBlocks counts the blocks on the slow tier, and the dirty blocks only on
+// the fast tier.
+func (t *tieredBlock) UsedBlocks() uint64 {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.slow.UsedBlocks() + uint64(t.dirty)
+}
+
+func (t *tieredBlock) BlockSize() uint64 {
+	return t.slow.BlockSize()
+}
+
+func (t *tieredBlock) Flush() error {
+	t.mut.Lock()
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		if te := e.Value.(*tierEntry); te.fresh > 0 {
+			te.fresh--
+		}
+	}
+	t.mut.Unlock()
+	err := t.fast.Flush()
+	if err != nil {
+		return err
+	}
+	return t.slow.Flush()
+}
+
+func (t *tieredBlock) Close() error {
+	t.mut.Lock()
+	if t.closed {
+		t.mut.Unlock()
+		return nil
+	}
+	t.closed = true
+	// Let the operations in flight finish before closing the tiers.
+	for len(t.busy) > 0 {
+		for _, ch := range t.busy {
+			t.mut.Unlock()
+			<-ch
+			t.mut.Lock()
+			break
+		}
+	}
+	t.mut.Unlock()
+	if t.stop != nil {
+		close(t.stop)
+		t.wg.Wait()
+	}
+	// Dirty blocks stay on the fast tier, and are found there on opening.
+	err := t.fast.Close()
+	if err != nil {
+		return err
+	}
+	return t.slow.Close()
+}
+
+func (t *tieredBlock) HasBlock(ctx context.Context, s torus.BlockRef) (bool, error) {
+	t.mut.Lock()
+	_, ok := t.inFast[s]
+	t.mut.Unlock()
+	if ok {
+		return true, nil
+	}
+	return t.slow.HasBlock(ctx, s)
+}
+
+func (t *tieredBlock) GetBlock(ctx context.Context, s torus.BlockRef) ([]byte, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if err := t.acquire(s); err != nil {
+		return nil, err
+	}
+	defer t.release(s)
+	var data []byte
+	if e, ok := t.inFast[s]; ok {
+		t.lru.MoveToFront(e)
+		promTierHits.WithLabelValues(t.name, "fast").Inc()
+		err := t.unlocked(func() (err error) {
+			data, err = t.fast.GetBlock(ctx, s)
+			return err
+		})
+		return data, err
+	}
+	err := t.unlocked(func() (err error) {
+		data, err = t.slow.GetBlock(ctx, s)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	promTierHits.WithLabelValues(t.name, "slow").Inc()
+	if len(t.reads) >= t.maxRead {
+		// Forget the read history rather than letting it grow without
+		// bound; blocks which are really hot will earn promotion again.
+		t.reads = make(map[torus.BlockRef]int)
+	}
+	t.reads[s]++
+	if t.reads[s] < t.promoteReads {
+		return data, nil
+	}
+	delete(t.reads, s)
+	// The slow tier may hand out its slot as soon as the block is promoted,
+	// or reuse its buffer for the next read, so hold on to a copy.
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	err = t.promote(ctx, s, buf)
+	if err != nil {
+		clog.Debugf("tiered: couldn't promote block %s: %v", s, err)
+	}
+	return buf, nil
+}
+
+// acquire waits until no other operation is in flight on a block, and then
+// marks it in flight, so that it doesn't move between the tiers while it's
+// being read or written with the lock released. It must be called with the
+// lock held, and the block released once the operation is done.
+func (t *tieredBlock) acquire(s torus.BlockRef) error {
+	for {
+		if t.closed {
+			return torus.ErrClosed
+		}
+		ch, ok := t.busy[s]
+		if !ok {
+			break
+		}
+		t.mut.Unlock()
+		<-ch
+		t.mut.Lock()
+	}
+	t.busy[s] = make(chan struct{})
+	return nil
+}
+
+// release ends the operation in flight on a block. It must be called with the
+// lock held.
+func (t *tieredBlock) release(s torus.BlockRef) {
+	close(t.busy[s])
+	delete(t.busy, s)
+}
+
+// unlocked runs fn, which does IO on the tiers, with the lock released. It
+// must be called with the lock held.
+func (t *tieredBlock) unlocked(fn func() error) error {
+	t.mut.Unlock()
+	defer t.mut.Lock()
+	return fn()
+}
+
+// promote moves a block from the slow to the fast tier, or copies it there
+// if the fast tier is a cache. It must be called with the lock held and the
+// block in flight.
+func (t *tieredBlock) promote(ctx context.Context, s torus.BlockRef, data []byte) error {
+	err := t.makeRoom(ctx)
+	if err != nil {
+		return err
+	}
+	err = t.unlocked(func() error { return t.fast.WriteBlock(ctx, s, data) })
+	if err != nil {
+		t.reserved--
+		return err
+	}
+	promTierPromotions.WithLabelValues(t.name).Inc()
+	if t.caching() {
+		t.add(&tierEntry{ref: s})
+		return nil
+	}
+	t.add(&tierEntry{ref: s, dirty: true})
+	return t.unlocked(func() error { return t.slow.DeleteBlock(ctx, s) })
+}
+
+// add puts a block on the fast tier at the front of the LRU list, filling the
+// slot makeRoom reserved for it. It must be called with the lock held.
+func (t *tieredBlock) add(e *tierEntry) {
+	t.reserved--
+	t.inFast[e.ref] = t.lru.PushFront(e)
+	if e.dirty {
+		t.dirty++
+		promTierDirty.WithLabelValues(t.name).Inc()
+	}
+}
+
+// makeRoom demotes the least recently used blocks until a new one fits on
+// the fast tier without going over the threshold, writing dirty ones to the
+// slow tier first, and reserves a slot for it. The caller must fill the slot
+// with add, or give it back by decrementing reserved. It must be called with
+// the lock held, which it releases while demoting.
+func (t *tieredBlock) makeRoom(ctx context.Context) error {
+	if t.demoteAt == 0 {
+		return torus.ErrOutOfSpace
+	}
+	// Blocks being demoted are as good as gone, and slots reserved for
+	// blocks being written are as good as taken.
+	for uint64(t.lru.Len()+t.reserved-t.demoting) >= t.demoteAt {
+		e := t.lru.Back()
+		for e != nil {
+			te := e.Value.(*tierEntry)
+			if _, busy := t.busy[te.ref]; te.fresh == 0 && !busy {
+				break
+			}
+			e = e.Prev()
+		}
+		if e == nil {
+			return torus.ErrOutOfSpace
+		}
+		te := e.Value.(*tierEntry)
+		t.busy[te.ref] = make(chan struct{})
+		t.demoting++
+		dirty := te.dirty
+		var cleaned bool
+		err := t.unlocked(func() error {
+			if dirty {
+				if err := t.copyDown(ctx, te.ref); err != nil {
+					return err
+				}
+				cleaned = true
+			}
+			return t.fast.DeleteBlock(ctx, te.ref)
+		})
+		t.demoting--
+		if cleaned {
+			t.markClean(te)
+		}
+		if err == nil {
+			t.lru.Remove(e)
+			delete(t.inFast, te.ref)
+			promTierDemotions.WithLabelValues(t.name).Inc()
+		}
+		t.release(te.ref)
+		if err != nil {
+			return err
+		}
+	}
+	t.reserved++
+	return nil
+}
+
+// copyDown copies a block on the fast tier to the slow tier. It's called
+// without the lock, with the block in flight.
+func (t *tieredBlock) copyDown(ctx context.Context, s torus.BlockRef) error {
+	data, err := t.fast.GetBlock(ctx, s)
+	if err != nil {
+		return err
+	}
+	return t.slow.WriteBlock(ctx, s, data)
+}
+
+// markClean records that a dirty block has been copied to the slow tier. It
+// must be called with the lock held.
+func (t *tieredBlock) markClean(te *tierEntry) {
+	te.dirty = false
+	t.dirty--
+	promTierDirty.WithLabelValues(t.name).Dec()
+}
+
+// destageAll writes back every dirty block which is ready, oldest first,
+// holding each in flight while it's copied so as not to hold up IO on the
+// others. The blocks stay cached.
+func (t *tieredBlock) destageAll(ctx context.Context) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	var todo []*tierEntry
+	for e := t.lru.Back(); e != nil; e = e.Prev() {
+		if te := e.Value.(*tierEntry); te.dirty && te.fresh == 0 {
+			todo = append(todo, te)
+		}
+	}
+	for _, te := range todo {
+		if err := t.acquire(te.ref); err != nil {
+			// Closed.
+			return nil
+		}
+		var err error
+		// It may have been demoted or deleted in the meantime.
+		if e, ok := t.inFast[te.ref]; ok && e.Value == te && te.dirty {
+			err = t.unlocked(func() error { return t.copyDown(ctx, te.ref) })
+			if err == nil {
+				t.markClean(te)
+				promTierDestaged.WithLabelValues(t.name).Inc()
+			}
+		}
+		t.release(te.ref)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tieredBlock) destageEvery(interval time.Duration) {
+	defer t.wg.Done()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-tick.C:
+			if err := t.destageAll(context.TODO()); err != nil {
+				clog.Errorf("tiered: couldn't destage blocks: %v", err)
+			}
+		}
+	}
+}
+
+// slowFull reports whether a new block written back wouldn't fit on the slow
+// tier once the dirty blocks were destaged. It must be called with the lock
+// held.
+func (t *tieredBlock) slowFull() bool {
+	return t.policy == torus.TierWriteBack && t.slow.UsedBlocks()+uint64(t.dirty) >= t.slow.NumBlocks()
+}
+
+// inSlow reports whether the slow tier has a block. It must be called with the
+// lock held.
+func (t *tieredBlock) inSlow(ctx context.Context, s torus.BlockRef) bool {
+	var ok bool
+	t.unlocked(func() error {
+		ok, _ = t.slow.HasBlock(ctx, s)
+		return nil
+	})
+	return ok
+}
+
+func (t *tieredBlock) WriteBlock(ctx context.Context, s torus.BlockRef, data []byte) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if err := t.acquire(s); err != nil {
+		return err
+	}
+	defer t.release(s)
+	if e, ok := t.inFast[s]; ok {
+		te := e.Value.(*tierEntry)
+		if !te.dirty {
+			// A cached copy: the slow tier's must change too, now or
+			// when it's destaged.
+			if t.policy == torus.TierWriteThrough {
+				err := t.unlocked(func() error { return t.slow.WriteBlock(ctx, s, data) })
+				if err != nil {
+					return err
+				}
+			} else {
+				te.dirty = true
+				t.dirty++
+				promTierDirty.WithLabelValues(t.name).Inc()
+			}
+		}
+		return t.unlocked(func() error { return t.fast.WriteBlock(ctx, s, data) })
+	}
+	if t.policy == torus.TierWriteThrough {
+		err := t.unlocked(func() error { return t.slow.WriteBlock(ctx, s, data) })
+		if err != nil {
+			return err
+		}
+		if err := t.makeRoom(ctx); err != nil {
+			clog.Debugf("tiered: couldn't cache block %s: %v", s, err)
+			return nil
+		}
+		if err := t.unlocked(func() error { return t.fast.WriteBlock(ctx, s, data) }); err != nil {
+			t.reserved--
+			clog.Debugf("tiered: couldn't cache block %s: %v", s, err)
+			return nil
+		}
+		t.add(&tierEntry{ref: s})
+		return nil
+	}
+	if t.inSlow(ctx, s) {
+		return t.unlocked(func() error { return t.slow.WriteBlock(ctx, s, data) })
+	}
+	if t.slowFull() {
+		return torus.ErrOutOfSpace
+	}
+	err := t.makeRoom(ctx)
+	if err != nil {
+		// Fall back to the slow tier rather than failing the write.
+		clog.Debugf("tiered: writing block %s to the slow tier: %v", s, err)
+		return t.unlocked(func() error { return t.slow.WriteBlock(ctx, s, data) })
+	}
+	err = t.unlocked(func() error { return t.fast.WriteBlock(ctx, s, data) })
+	if err != nil {
+		t.reserved--
+		return err
+	}
+	t.add(&tierEntry{ref: s, dirty: true})
+	return nil
+}
+
+// WriteBuf hands out a buffer on the slow tier under write-through, as the
+// block can't be copied to the fast tier until it's filled; it's promoted if
+// it's read often enough. Otherwise it hands out one on the fast tier, which
+// isn't demoted or destaged until it's surely filled.
+func (t *tieredBlock) WriteBuf(ctx context.Context, s torus.BlockRef) ([]byte, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if err := t.acquire(s); err != nil {
+		return nil, err
+	}
+	defer t.release(s)
+	if _, ok := t.inFast[s]; ok {
+		return nil, torus.ErrExists
+	}
+	if t.policy == torus.TierWriteThrough {
+		return t.slow.WriteBuf(ctx, s)
+	}
+	if t.inSlow(ctx, s) {
+		return nil, torus.ErrExists
+	}
+	if t.slowFull() {
+		return nil, torus.ErrOutOfSpace
+	}
+	err := t.makeRoom(ctx)
+	if err != nil {
+		return t.slow.WriteBuf(ctx, s)
+	}
+	buf, err := t.fast.WriteBuf(ctx, s)
+	if err != nil {
+		t.reserved--
+		return nil, err
+	}
+	t.add(&tierEntry{ref: s, dirty: true, fresh: 2})
+	return buf, nil
+}
+
+func (t *tieredBlock) DeleteBlock(ctx context.Context, s torus.BlockRef) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if err := t.acquire(s); err != nil {
+		return err
+	}
+	defer t.release(s)
+	delete(t.reads, s)
+	e, ok := t.inFast[s]
+	if !ok {
+		return t.unlocked(func() error { return t.slow.DeleteBlock(ctx, s) })
+	}
+	te := e.Value.(*tierEntry)
+	t.lru.Remove(e)
+	delete(t.inFast, s)
+	if te.dirty {
+		t.dirty--
+		promTierDirty.WithLabelValues(t.name).Dec()
+		return t.unlocked(func() error { return t.fast.DeleteBlock(ctx, s) })
+	}
+	return t.unlocked(func() error {
+		if err := t.fast.DeleteBlock(ctx, s); err != nil {
+			return err
+		}
+		return t.slow.DeleteBlock(ctx, s)
+	})
+}
+
+// BlockIterator lists the blocks on the slow tier and the dirty blocks only
+// on the fast tier.
+func (t *tieredBlock) BlockIterator() torus.BlockIterator {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	var set []torus.BlockRef
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		if te := e.Value.(*tierEntry); te.dirty {
+			set = append(set, te.ref)
+		}
+	}
+	it := t.slow.BlockIterator()
+	for it.Next() {
+		set = append(set, it.BlockRef())
+	}
+	it.Close()
+	return &mfileIterator{
+		set: set,
+		i:   -1,
+	}
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/torus"
+)
+
+func newTestTieredStore(t *testing.T, policy torus.TierPolicy) *tieredBlock {
+	gmd := torus.GlobalMetadata{BlockSize: 1024}
+	fast, err := openTempBlockStore("fast", torus.Config{StorageSize: 4 * 1024}, gmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := openTempBlockStore("slow", torus.Config{StorageSize: 100 * 1024}, gmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Demote once three of the four fast blocks are in use. There's no
+	// background destaging; the tests destage when they choose.
+	return newTieredStore("test", fast, slow, policy, 2, 0.75, 0)
+}
+
+func testRef(i int) torus.BlockRef {
+	return torus.BlockRef{
+		INodeRef: torus.NewINodeRef(1, 1),
+		Index:    torus.IndexID(i),
+	}
+}
+
+func TestTieredDemotion(t *testing.T) {
+	s := newTestTieredStore(t, torus.TierMove)
+	ctx := context.TODO()
+	for i := 1; i <= 5; i++ {
+		err := s.WriteBlock(ctx, testRef(i), []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.fast.UsedBlocks() != 3 {
+		t.Fatalf("expected 3 blocks on the fast tier, got %d", s.fast.UsedBlocks())
+	}
+	// The two oldest blocks should have been demoted.
+	for i := 1; i <= 2; i++ {
+		if ok, _ := s.slow.HasBlock(ctx, testRef(i)); !ok {
+			t.Errorf("block %d wasn't demoted", i)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		data, err := s.GetBlock(ctx, testRef(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != byte(i) {
+			t.Errorf("block %d has the wrong contents", i)
+		}
+	}
+	if s.UsedBlocks() != 5 {
+		t.Fatalf("expected 5 blocks stored, got %d", s.UsedBlocks())
+	}
+}
+
+func TestTieredPromotion(t *testing.T) {
+	s := newTestTieredStore(t, torus.TierMove)
+	ctx := context.TODO()
+	for i := 1; i <= 4; i++ {
+		s.WriteBlock(ctx, testRef(i), []byte{byte(i)})
+	}
+	if ok, _ := s.slow.HasBlock(ctx, testRef(1)); !ok {
+		t.Fatal("block 1 should start on the slow tier")
+	}
+	s.GetBlock(ctx, testRef(1))
+	if ok, _ := s.slow.HasBlock(ctx, testRef(1)); !ok {
+		t.Fatal("block 1 was promoted after a single read")
+	}
+	data, err := s.GetBlock(ctx, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 1 {
+		t.Fatal("promoted block has the wrong contents")
+	}
+	if ok, _ := s.fast.HasBlock(ctx, testRef(1)); !ok {
+		t.Fatal("block 1 wasn't promoted")
+	}
+	if ok, _ := s.slow.HasBlock(ctx, testRef(1)); ok {
+		t.Fatal("block 1 is on both tiers")
+	}
+	if s.UsedBlocks() != 4 {
+		t.Fatalf("expected 4 blocks stored, got %d", s.UsedBlocks())
+	}
+	err = s.DeleteBlock(ctx, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.HasBlock(ctx, testRef(1)); ok {
+		t.Fatal("deleted block is still present")
+	}
+}
+
+func TestTieredWriteThrough(t *testing.T) {
+	s := newTestTieredStore(t, torus.TierWriteThrough)
+	ctx := context.TODO()
+	for i := 1; i <= 5; i++ {
+		if err := s.WriteBlock(ctx, testRef(i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := s.slow.HasBlock(ctx, testRef(i)); !ok {
+			t.Fatalf("block %d isn't on the slow tier", i)
+		}
+	}
+	// The fast tier holds copies of the three most recently written.
+	for i := 1; i <= 5; i++ {
+		ok, _ := s.fast.HasBlock(ctx, testRef(i))
+		if ok != (i > 2) {
+			t.Errorf("block %d on the fast tier: %v", i, ok)
+		}
+	}
+	for j := 0; j < 2; j++ {
+		data, err := s.GetBlock(ctx, testRef(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != 1 {
+			t.Fatal("block 1 has the wrong contents")
+		}
+	}
+	if ok, _ := s.fast.HasBlock(ctx, testRef(1)); !ok {
+		t.Fatal("block 1 wasn't promoted")
+	}
+	if ok, _ := s.slow.HasBlock(ctx, testRef(1)); !ok {
+		t.Fatal("promoting block 1 took it off the slow tier")
+	}
+	if s.NumBlocks() != s.slow.NumBlocks() {
+		t.Fatal("a caching fast tier added to the capacity")
+	}
+	if s.UsedBlocks() != 5 {
+		t.Fatalf("expected 5 blocks stored, got %d", s.UsedBlocks())
+	}
+	if err := s.DeleteBlock(ctx, testRef(1)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.HasBlock(ctx, testRef(1)); ok {
+		t.Fatal("deleted block is still present")
+	}
+}
+
+func TestTieredWriteBack(t *testing.T) {
+	s := newTestTieredStore(t, torus.TierWriteBack)
+	ctx := context.TODO()
+	if err := s.WriteBlock(ctx, testRef(1), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.slow.HasBlock(ctx, testRef(1)); ok {
+		t.Fatal("block 1 reached the slow tier before it was destaged")
+	}
+	if s.UsedBlocks() != 1 {
+		t.Fatalf("expected 1 block stored, got %d", s.UsedBlocks())
+	}
+	buf, err := s.WriteBuf(ctx, testRef(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 3
+	if err := s.destageAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.slow.HasBlock(ctx, testRef(1)); !ok {
+		t.Fatal("block 1 wasn't destaged")
+	}
+	if ok, _ := s.slow.HasBlock(ctx, testRef(3)); ok {
+		t.Fatal("block 3 was destaged before it was surely filled")
+	}
+	// Writing more demotes block 1, which is clean now, then block 2,
+	// which has to be destaged first; block 3 isn't ready to go.
+	for i := 2; i <= 5; i++ {
+		if i == 3 {
+			continue
+		}
+		if err := s.WriteBlock(ctx, testRef(i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, _ := s.fast.HasBlock(ctx, testRef(3)); !ok {
+		t.Fatal("block 3 was demoted before it was surely filled")
+	}
+	if ok, _ := s.slow.HasBlock(ctx, testRef(2)); !ok {
+		t.Fatal("block 2 was demoted without being destaged")
+	}
+	s.Flush()
+	s.Flush()
+	if err := s.destageAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		data, err := s.slow.GetBlock(ctx, testRef(i))
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if data[0] != byte(i) {
+			t.Errorf("block %d has the wrong contents", i)
+		}
+	}
+	if s.UsedBlocks() != 5 {
+		t.Fatalf("expected 5 blocks stored, got %d", s.UsedBlocks())
+	}
+	// A dirty block deleted before it's destaged leaves nothing behind.
+	if err := s.WriteBlock(ctx, testRef(6), []byte{6}); err != nil {
+		t.Fatal(err)
+	}
+	if s.UsedBlocks() != 6 {
+		t.Fatalf("expected 6 blocks stored, got %d", s.UsedBlocks())
+	}
+	if err := s.DeleteBlock(ctx, testRef(6)); err != nil {
+		t.Fatal(err)
+	}
+	if s.UsedBlocks() != 5 {
+		t.Fatalf("expected 5 blocks stored, got %d", s.UsedBlocks())
+	}
+}
+
+// stallStore holds reads of one block until release is closed, reporting on
+// started when one begins.
+type stallStore struct {
+	torus.BlockStore
+	ref     torus.BlockRef
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *stallStore) GetBlock(ctx context.Context, b torus.BlockRef) ([]byte, error) {
+	if b == s.ref {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return s.BlockStore.GetBlock(ctx, b)
+}
+
+func TestTieredIOUnlocked(t *testing.T) {
+	s := newTestTieredStore(t, torus.TierMove)
+	ctx := context.TODO()
+	for i := 1; i <= 4; i++ {
+		if err := s.WriteBlock(ctx, testRef(i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stall := &stallStore{BlockStore: s.slow, ref: testRef(1), started: make(chan struct{}, 1), release: make(chan struct{})}
+	s.slow = stall
+	done := make(chan error)
+	go func() {
+		_, err := s.GetBlock(ctx, testRef(1))
+		done <- err
+	}()
+	<-stall.started
+	// A slow read of block 1 holds up neither the other blocks nor
+	// writes of new ones.
+	for i := 2; i <= 4; i++ {
+		data, err := s.GetBlock(ctx, testRef(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != byte(i) {
+			t.Errorf("block %d has the wrong contents", i)
+		}
+	}
+	if err := s.WriteBlock(ctx, testRef(5), []byte{5}); err != nil {
+		t.Fatal(err)
+	}
+	// But a write of block 1 waits for the read.
+	wrote := make(chan error)
+	go func() { wrote <- s.WriteBlock(ctx, testRef(1), []byte{9}) }()
+	select {
+	case <-wrote:
+		t.Fatal("block 1 was written while it was being read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stall.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.GetBlock(ctx, testRef(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 9 {
+		t.Fatal("block 1 has the wrong contents")
+	}
+}
+
+func TestTieredConcurrent(t *testing.T) {
+	for _, policy := range []torus.TierPolicy{torus.TierMove, torus.TierWriteThrough, torus.TierWriteBack} {
+		s := newTestTieredStore(t, policy)
+		ctx := context.TODO()
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				// Each goroutine has blocks of its own, and they all
+				// compete for the fast tier.
+				for n := 0; n < 50; n++ {
+					i := g*10 + n%10
+					if err := s.WriteBlock(ctx, testRef(i), []byte{byte(n)}); err != nil {
+						errs <- err
+						return
+					}
+					data, err := s.GetBlock(ctx, testRef(i))
+					if err != nil {
+						errs <- err
+						return
+					}
+					if data[0] != byte(n) {
+						errs <- fmt.Errorf("block %d has the wrong contents", i)
+						return
+					}
+					if n%7 == 0 {
+						if err := s.DeleteBlock(ctx, testRef(i)); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}
+			}(g)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				s.destageAll(ctx)
+			}
+		}()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("policy %v: %v", policy, err)
+		}
+		if s.reserved != 0 || s.demoting != 0 || len(s.busy) != 0 {
+			t.Errorf("policy %v: %d slots reserved, %d demoting and %d in flight when idle", policy, s.reserved, s.demoting, len(s.busy))
+		}
+		if uint64(s.lru.Len()) > s.demoteAt {
+			t.Errorf("policy %v: %d blocks on the fast tier, over the threshold of %d", policy, s.lru.Len(), s.demoteAt)
+		}
+	}
+}
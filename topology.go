@@ -0,0 +1,85 @@
+package torus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TopologyLevels are the levels of a peer's location, broadest first.
+var TopologyLevels = []string{"region", "zone", "rack"}
+
+// Topology is where a peer sits in the network, as a value for some of the
+// TopologyLevels, e.g. {"zone": "us-east-1a", "rack": "r12"}. Levels which
+// aren't set compare equal between peers which both leave them out.
+type Topology map[string]string
+
+// ParseTopology parses a comma separated list of LEVEL=VALUE pairs.
+func ParseTopology(s string) (Topology, error) {
+	t := make(Topology)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("topology %q must be LEVEL=VALUE", part)
+		}
+		if !isTopologyLevel(kv[0]) {
+			return nil, fmt.Errorf("unknown topology level %q; must be one of %s", kv[0], strings.Join(TopologyLevels, ", "))
+		}
+		t[kv[0]] = kv[1]
+	}
+	return t, nil
+}
+
+func isTopologyLevel(level string) bool {
+	for _, l := range TopologyLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// Distance is how far apart two peers are: zero if they share a rack, and one
+// more for each level up the topology where they differ, up to
+// len(TopologyLevels) if they aren't even in the same region.
+func (t Topology) Distance(o Topology) int {
+	for i, l := range TopologyLevels {
+		if t[l] != o[l] {
+			return len(TopologyLevels) - i
+		}
+	}
+	return 0
+}
+
+func (t Topology) String() string {
+	var kvs []string
+	for _, l := range TopologyLevels {
+		if v, ok := t[l]; ok {
+			kvs = append(kvs, l+"="+v)
+		}
+	}
+	return strings.Join(kvs, ",")
+}
+
+// SortByDistance reorders peers, nearest to from first, keeping the order of
+// peers at the same distance. Peers without a known topology are treated as
+// having none set.
+func SortByDistance(peers PeerList, from Topology, topology map[string]Topology) {
+	sort.Stable(byDistance{peers, from, topology})
+}
+
+type byDistance struct {
+	peers    PeerList
+	from     Topology
+	topology map[string]Topology
+}
+
+func (b byDistance) Len() int      { return len(b.peers) }
+func (b byDistance) Swap(i, j int) { b.peers[i], b.peers[j] = b.peers[j], b.peers[i] }
+func (b byDistance) Less(i, j int) bool {
+	return b.from.Distance(b.topology[b.peers[i]]) < b.from.Distance(b.topology[b.peers[j]])
+}